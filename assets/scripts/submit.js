@@ -13,6 +13,10 @@
   const twoFactorPasscodeInput = document.getElementById('two-factor-passcode')
   const twoFactorTokenInput = document.getElementById('two-factor-token')
   const twoFactorTrustDeviceCheckbox = document.getElementById('two-factor-trust-device')
+  const twoFactorPasscodeLine = document.getElementById('two-factor-passcode-line')
+  const twoFactorWebAuthnInput = document.getElementById('two-factor-webauthn')
+  const twoFactorHelps = document.getElementsByClassName('two-factor-help')
+  const twoFactorMethodButtons = document.getElementsByClassName('two-factor-method')
   const longRunSessionCheckbox = document.getElementById('long-run-session')
   const twoFactorForms = document.getElementsByClassName('two-factor-form')
   const passwordForms = document.getElementsByClassName('password-form')
@@ -26,6 +30,51 @@
     localStorage = window.localStorage
   } catch(e) {}
 
+  const base64urlToBuffer = function (str) {
+    const base64 = str.replace(/-/g, '+').replace(/_/g, '/')
+    const binary = window.atob(base64 + '==='.slice((base64.length + 3) % 4))
+    const bytes = new Uint8Array(binary.length)
+    for (let i = 0; i < binary.length; i++) {
+      bytes[i] = binary.charCodeAt(i)
+    }
+    return bytes.buffer
+  }
+
+  const bufferToBase64url = function (buffer) {
+    const bytes = new Uint8Array(buffer)
+    let binary = ''
+    for (let i = 0; i < bytes.length; i++) {
+      binary += String.fromCharCode(bytes[i])
+    }
+    return window.btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '')
+  }
+
+  // Asks the security key of the user to sign the challenge of the server,
+  // and returns the assertion serialized in JSON, to be sent as the passcode.
+  const getWebAuthnAssertion = function (options) {
+    const publicKey = options.publicKey
+    publicKey.challenge = base64urlToBuffer(publicKey.challenge)
+    if (publicKey.allowCredentials) {
+      publicKey.allowCredentials.forEach(function (cred) {
+        cred.id = base64urlToBuffer(cred.id)
+      })
+    }
+    return navigator.credentials.get({ publicKey: publicKey }).then(function (cred) {
+      const response = cred.response
+      return JSON.stringify({
+        id: cred.id,
+        rawId: bufferToBase64url(cred.rawId),
+        type: cred.type,
+        response: {
+          authenticatorData: bufferToBase64url(response.authenticatorData),
+          clientDataJSON: bufferToBase64url(response.clientDataJSON),
+          signature: bufferToBase64url(response.signature),
+          userHandle: response.userHandle ? bufferToBase64url(response.userHandle) : ''
+        }
+      })
+    })
+  }
+
   const showError = function (error) {
     if (error) {
       error = '' + error
@@ -73,7 +122,7 @@
       response.json().then(function(body) {
         if (loginSuccess) {
           if (body.two_factor_token) {
-            renderTwoFactorForm(body.two_factor_token)
+            renderTwoFactorForm(body)
             return
           }
           submitButton.innerHTML = '<svg width="16" height="16"><use xlink:href="#fa-check"/></svg>'
@@ -93,6 +142,10 @@
 
   const onSubmitTwoFactorCode = function(event) {
     event.preventDefault()
+    submitTwoFactorCode()
+  }
+
+  const submitTwoFactorCode = function() {
     submitButton.setAttribute('disabled', true)
 
     const longRunSession = longRunSessionCheckbox && longRunSessionCheckbox.checked ? '1' : '0'
@@ -137,22 +190,92 @@
     }).catch(showError)
   }
 
-  function renderTwoFactorForm(twoFactorToken) {
+  // Asks the server for the second step of the authentication with another
+  // method (mail, authenticator app, security key or recovery code)
+  const onChooseTwoFactorMethod = function(event) {
+    event.preventDefault()
+    const method = event.currentTarget.value
+    const longRunSession = longRunSessionCheckbox && longRunSessionCheckbox.checked ? '1' : '0'
+    const redirect = redirectInput.value + window.location.hash
+
+    let headers = new Headers()
+    headers.append('Content-Type', 'application/x-www-form-urlencoded')
+    headers.append('Accept', 'application/json')
+    const reqBody = 'two-factor-method=' + encodeURIComponent(method) +
+      '&two-factor-token=' + encodeURIComponent(twoFactorTokenInput.value) +
+      '&long-run-session=' + encodeURIComponent(longRunSession) +
+      '&redirect=' + encodeURIComponent(redirect) +
+      '&csrf_token=' + encodeURIComponent(csrfTokenInput.value);
+    fetch('/auth/login', {
+      method: 'POST',
+      headers: headers,
+      body: reqBody,
+      credentials: 'same-origin'
+    }).then(function(response) {
+      const success = response.status < 400
+      response.json().then(function(body) {
+        if (success && body.two_factor_token) {
+          renderTwoFactorForm(body)
+        } else {
+          showError(body.error)
+        }
+      }).catch(showError)
+    }).catch(showError)
+  }
+
+  function renderTwoFactorForm(body) {
+    const method = body.two_factor_method || 'mail'
     for (let i = 0; i < twoFactorForms.length; i++) {
       twoFactorForms[i].classList.remove('display-none')
     }
     for (let i = 0; i < passwordForms.length; i++) {
       passwordForms[i].classList.add('display-none')
     }
+    for (let i = 0; i < twoFactorHelps.length; i++) {
+      const hidden = twoFactorHelps[i].getAttribute('data-method') !== method
+      twoFactorHelps[i].classList[hidden ? 'add' : 'remove']('display-none')
+    }
+    if (body.two_factor_methods) {
+      for (let i = 0; i < twoFactorMethodButtons.length; i++) {
+        const value = twoFactorMethodButtons[i].value
+        const hidden = value === method || body.two_factor_methods.indexOf(value) < 0
+        twoFactorMethodButtons[i].classList[hidden ? 'add' : 'remove']('display-none')
+      }
+    }
     submitButton.removeAttribute('disabled')
-    twoFactorTokenInput.value = twoFactorToken
+    twoFactorTokenInput.value = body.two_factor_token
     twoFactorPasscodeInput.value = ''
-    twoFactorPasscodeInput.focus()
     loginForm.removeEventListener('submit', onSubmitPassphrase)
+    loginForm.removeEventListener('submit', onSubmitTwoFactorCode)
     loginForm.addEventListener('submit', onSubmitTwoFactorCode)
+
+    if (method === 'webauthn' && body.webauthn && navigator.credentials) {
+      twoFactorPasscodeLine.classList.add('display-none')
+      getWebAuthnAssertion(body.webauthn).then(function(assertion) {
+        twoFactorPasscodeInput.value = assertion
+        submitTwoFactorCode()
+      }).catch(showError)
+    } else {
+      twoFactorPasscodeLine.classList.remove('display-none')
+      twoFactorPasscodeInput.focus()
+    }
   }
 
-  loginForm && loginForm.addEventListener('submit', onSubmitPassphrase)
+  for (let i = 0; i < twoFactorMethodButtons.length; i++) {
+    twoFactorMethodButtons[i].addEventListener('click', onChooseTwoFactorMethod)
+  }
+
+  if (loginForm && twoFactorTokenInput.value) {
+    // The second step of the authentication has been rendered by the server
+    const options = twoFactorWebAuthnInput.value
+    renderTwoFactorForm({
+      two_factor_token: twoFactorTokenInput.value,
+      two_factor_method: twoFactorTokenInput.getAttribute('data-method'),
+      webauthn: options ? JSON.parse(options) : null
+    })
+  } else {
+    loginForm && loginForm.addEventListener('submit', onSubmitPassphrase)
+  }
 
   resetForm && resetForm.addEventListener('submit', function(event) {
     event.preventDefault()
@@ -169,6 +292,6 @@
     submitButton[label == 'weak' ? 'setAttribute' : 'removeAttribute']('disabled', '')
   })
 
-  passphraseInput.focus()
+  passphraseInput && passphraseInput.focus()
   loginForm && submitButton.removeAttribute('disabled')
 })(window, document)
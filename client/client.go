@@ -189,6 +189,32 @@ func readJSONAPILinks(r io.Reader, included, links interface{}) (err error) {
 	return nil
 }
 
+func readJSONAPIDataLinks(r io.Reader, data, links interface{}) (err error) {
+	defer func() {
+		if rc, ok := r.(io.ReadCloser); ok {
+			if cerr := rc.Close(); err == nil && cerr != nil {
+				err = cerr
+			}
+		}
+	}()
+	var doc jsonAPIDocument
+	decoder := json.NewDecoder(r)
+	if err = decoder.Decode(&doc); err != nil {
+		return err
+	}
+	if data != nil && doc.Data != nil {
+		if err = json.Unmarshal(*doc.Data, &data); err != nil {
+			return err
+		}
+	}
+	if links != nil && doc.Links != nil {
+		if err = json.Unmarshal(*doc.Links, &links); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func writeJSONAPI(data interface{}) (io.Reader, error) {
 	buf, err := json.Marshal(data)
 	if err != nil {
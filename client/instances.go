@@ -3,6 +3,7 @@ package client
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -382,6 +383,64 @@ func (c *Client) Import(domain string, opts *ImportOptions) error {
 	return err
 }
 
+// AuthAttempts is a struct holding the counter of authentication attempts
+// made from an IP address on an instance.
+type AuthAttempts struct {
+	Type      string    `json:"type"`
+	IP        string    `json:"ip"`
+	Count     int64     `json:"count"`
+	Locked    bool      `json:"locked"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ListAuthAttempts returns the counters of authentication attempts for the
+// given instance.
+func (c *Client) ListAuthAttempts(domain string) ([]*AuthAttempts, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/instances/" + url.PathEscape(domain) + "/auth_attempts",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var list []*AuthAttempts
+	if err = json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// ResetAuthAttempts resets the counters of authentication attempts for the
+// given instance, and unlocks the IP addresses. If ip is not empty, only the
+// counters for this IP address are reset.
+func (c *Client) ResetAuthAttempts(domain, ip string) error {
+	var q url.Values
+	if ip != "" {
+		q = url.Values{"IP": {ip}}
+	}
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       "/instances/" + url.PathEscape(domain) + "/auth_attempts",
+		Queries:    q,
+		NoResponse: true,
+	})
+	return err
+}
+
+// ExportAudit returns the audit log of the given instance, with one JSON
+// document by line. The caller must close the returned reader.
+func (c *Client) ExportAudit(domain string) (io.ReadCloser, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   "/instances/" + url.PathEscape(domain) + "/audit",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
 // RebuildRedis puts the triggers in redis.
 func (c *Client) RebuildRedis() error {
 	_, err := c.Req(&request.Options{
@@ -392,6 +451,47 @@ func (c *Client) RebuildRedis() error {
 	return err
 }
 
+// UpdateSharingTriggers recreates the share-track triggers of the sharings
+// of the given instance that are not up-to-date with their rules, and returns
+// the number of triggers that have been updated.
+func (c *Client) UpdateSharingTriggers(domain string) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + url.PathEscape(domain) + "/sharing_triggers",
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Updated int `json:"updated"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Updated, nil
+}
+
+// AddMissingTriggers creates the default triggers that are missing on the
+// given instance, and returns the number of triggers that have been created.
+func (c *Client) AddMissingTriggers(domain string) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   "/instances/" + url.PathEscape(domain) + "/triggers",
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Created int `json:"created"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Created, nil
+}
+
 func readInstance(res *http.Response) (*Instance, error) {
 	in := &Instance{}
 	if err := readJSONAPI(res.Body, &in); err != nil {
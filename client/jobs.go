@@ -242,3 +242,127 @@ func (c *Client) ListTriggers() ([]*Trigger, error) {
 	}
 	return list, nil
 }
+
+// DeadLetter is a struct representing a job that has failed after all its
+// executions.
+type DeadLetter struct {
+	ID    string `json:"id"`
+	Rev   string `json:"rev"`
+	Attrs struct {
+		Domain    string          `json:"domain"`
+		Worker    string          `json:"worker"`
+		JobID     string          `json:"job_id"`
+		TriggerID string          `json:"trigger_id"`
+		Message   json.RawMessage `json:"message"`
+		Attempts  int             `json:"attempts"`
+		Error     string          `json:"error"`
+		Logs      []struct {
+			Time    time.Time `json:"time"`
+			Level   string    `json:"level"`
+			Message string    `json:"message"`
+		} `json:"logs"`
+		QueuedAt time.Time `json:"queued_at"`
+		FailedAt time.Time `json:"failed_at"`
+	} `json:"attributes"`
+}
+
+// ListDeadLetters returns the dead letters of the instance, optionally
+// filtered on a worker type. The pages of the list are all fetched.
+func (c *Client) ListDeadLetters(worker string) ([]*DeadLetter, error) {
+	reqPath := "/jobs/dlq"
+	reqQuery := url.Values{"Worker": {worker}}
+	var list []*DeadLetter
+	for {
+		res, err := c.Req(&request.Options{
+			Method:  "GET",
+			Path:    reqPath,
+			Queries: reqQuery,
+		})
+		if err != nil {
+			return nil, err
+		}
+		var page []*DeadLetter
+		var links struct {
+			Next string
+		}
+		if err := readJSONAPIDataLinks(res.Body, &page, &links); err != nil {
+			return nil, err
+		}
+		list = append(list, page...)
+		if links.Next == "" {
+			break
+		}
+		u, err := url.Parse(links.Next)
+		if err != nil {
+			return nil, err
+		}
+		reqPath = u.Path
+		reqQuery = u.Query()
+	}
+	return list, nil
+}
+
+// ReplayDeadLetter pushes again the job of a dead letter.
+func (c *Client) ReplayDeadLetter(id string) (*Job, error) {
+	res, err := c.Req(&request.Options{
+		Method: "POST",
+		Path:   fmt.Sprintf("/jobs/dlq/%s/replay", url.PathEscape(id)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var j *Job
+	if err := readJSONAPI(res.Body, &j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// DeleteDeadLetter deletes a dead letter without replaying its job.
+func (c *Client) DeleteDeadLetter(id string) error {
+	_, err := c.Req(&request.Options{
+		Method:     "DELETE",
+		Path:       fmt.Sprintf("/jobs/dlq/%s", url.PathEscape(id)),
+		NoResponse: true,
+	})
+	return err
+}
+
+// PurgeDeadLetters deletes all the dead letters of the instance, optionally
+// filtered on a worker type, and returns the number of deleted dead letters.
+func (c *Client) PurgeDeadLetters(worker string) (int, error) {
+	res, err := c.Req(&request.Options{
+		Method:  "DELETE",
+		Path:    "/jobs/dlq",
+		Queries: url.Values{"Worker": {worker}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Deleted, nil
+}
+
+// JobsBacklog returns the number of pending jobs of each instance, by domain,
+// in the queue of the given worker type.
+func (c *Client) JobsBacklog(worker string) (map[string]int, error) {
+	res, err := c.Req(&request.Options{
+		Method: "GET",
+		Path:   fmt.Sprintf("/jobs/backlog/%s", url.PathEscape(worker)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var counts map[string]int
+	if err := json.NewDecoder(res.Body).Decode(&counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
@@ -173,6 +173,39 @@ keyfiles written in:
 	},
 }
 
+var genFilesKeyCmd = &cobra.Command{
+	Use:   "gen-files-key <filepath>",
+	Short: "Generate the master key for the encryption of the files",
+	Long: `
+cozy-stack config gen-files-key generates the master key used to wrap the keys
+of the instances that encrypt their files at rest, and saves it in the
+specified path.
+
+The file permissions are 0400.`,
+
+	Example: `$ cozy-stack config gen-files-key ~/files.key
+keyfile written in:
+	~/files.key
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+
+		filename := filepath.Join(utils.AbsPath(args[0]))
+		marshaledKey, err := keymgmt.GenerateEncodedSecretKey()
+		if err != nil {
+			return err
+		}
+
+		if err = writeFile(filename, marshaledKey, 0400); err != nil {
+			return err
+		}
+		errPrintfln("keyfile written in:\n  %s", filename)
+		return nil
+	},
+}
+
 var encryptCredentialsDataCmd = &cobra.Command{
 	Use:   "encrypt-data <encoding keyfile> <text>",
 	Short: "Encrypt data with the specified encryption keyfile.",
@@ -392,6 +425,7 @@ func init() {
 	configCmdGroup.AddCommand(configPrintCmd)
 	configCmdGroup.AddCommand(adminPasswdCmd)
 	configCmdGroup.AddCommand(genKeysCmd)
+	configCmdGroup.AddCommand(genFilesKeyCmd)
 	configCmdGroup.AddCommand(encryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(decryptCredentialsDataCmd)
 	configCmdGroup.AddCommand(encryptCredentialsCmd)
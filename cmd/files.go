@@ -110,6 +110,35 @@ var importFilesCmd = &cobra.Command{
 	},
 }
 
+var reindexFilesCmd = &cobra.Command{
+	Use:   "reindex [--domain domain]",
+	Short: "Rebuild the full-text index of the files",
+	Long: `
+Rebuild the full-text index of the files of the specified domain. It can be
+used to index the files of an instance created before the full-text search was
+enabled, or after a change of the indexed formats.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagFilesDomain == "" {
+			errPrintfln("%s", errFilesMissingDomain)
+			return cmd.Usage()
+		}
+		c := newClient(flagFilesDomain, consts.Jobs)
+		res, err := c.JobPush(&client.JobOptions{
+			Worker: "searchreindex",
+		})
+		if err != nil {
+			return err
+		}
+		b, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	},
+}
+
 func execCommand(c *client.Client, command string, w io.Writer) error {
 	args := splitArgs(command)
 	if len(args) == 0 {
@@ -488,6 +517,7 @@ func init() {
 
 	filesCmdGroup.AddCommand(execFilesCmd)
 	filesCmdGroup.AddCommand(importFilesCmd)
+	filesCmdGroup.AddCommand(reindexFilesCmd)
 
 	RootCmd.AddCommand(filesCmdGroup)
 }
@@ -177,6 +177,38 @@ var mimeFixerCmd = &cobra.Command{
 	},
 }
 
+var instanceTriggersFixer = &cobra.Command{
+	Use:   "instance-triggers",
+	Short: "Add the default triggers that are missing on the instances",
+	Long: `
+The instances created by an older version of the stack may not have all the
+default triggers, like the ones that remove the expired upload sessions and
+the expired entries of the list of revoked tokens. This command adds them.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListInstances()
+		if err != nil {
+			return err
+		}
+		var hasErrored bool
+		for _, i := range list {
+			fmt.Printf("Adding the missing triggers on '%s'...", i.Attrs.Domain)
+			count, err := c.AddMissingTriggers(i.Attrs.Domain)
+			if err != nil {
+				fmt.Printf("failed: %s\n", err)
+				hasErrored = true
+			} else {
+				fmt.Printf("%d created\n", count)
+			}
+		}
+		if hasErrored {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
 var jobsFixer = &cobra.Command{
 	Use:   "jobs <domain>",
 	Short: "Take a look at the consistency of the jobs",
@@ -249,6 +281,33 @@ var redisFixer = &cobra.Command{
 	},
 }
 
+var sharingTriggersFixer = &cobra.Command{
+	Use:   "sharing-triggers",
+	Short: "Update the triggers of the sharings to follow their rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := newAdminClient()
+		list, err := c.ListInstances()
+		if err != nil {
+			return err
+		}
+		var hasErrored bool
+		for _, i := range list {
+			fmt.Printf("Updating the sharing triggers on '%s'...", i.Attrs.Domain)
+			count, err := c.UpdateSharingTriggers(i.Attrs.Domain)
+			if err != nil {
+				fmt.Printf("failed: %s\n", err)
+				hasErrored = true
+			} else {
+				fmt.Printf("%d updated\n", count)
+			}
+		}
+		if hasErrored {
+			os.Exit(1)
+		}
+		return nil
+	},
+}
+
 var thumbnailsFixer = &cobra.Command{
 	Use:   "thumbnails <domain>",
 	Short: "Rebuild thumbnails image for images files",
@@ -410,11 +469,13 @@ func init() {
 	thumbnailsFixer.Flags().BoolVar(&withMetadataFlag, "with-metadata", false, "Recalculate images metadata")
 
 	fixerCmdGroup.AddCommand(albumsCreatedAtFixerCmd)
+	fixerCmdGroup.AddCommand(instanceTriggersFixer)
 	fixerCmdGroup.AddCommand(jobsFixer)
 	fixerCmdGroup.AddCommand(md5FixerCmd)
 	fixerCmdGroup.AddCommand(mimeFixerCmd)
 	fixerCmdGroup.AddCommand(onboardingsFixer)
 	fixerCmdGroup.AddCommand(redisFixer)
+	fixerCmdGroup.AddCommand(sharingTriggersFixer)
 	fixerCmdGroup.AddCommand(thumbnailsFixer)
 	fixerCmdGroup.AddCommand(contactEmailsFixer)
 
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"os"
 	"reflect"
@@ -54,6 +55,7 @@ var flagExpire time.Duration
 var flagAllowLoginScope bool
 var flagFsckIndexIntegrity bool
 var flagAvailableFields bool
+var flagIP string
 
 // instanceCmdGroup represents the instances command
 var instanceCmdGroup = &cobra.Command{
@@ -839,6 +841,86 @@ var showSwiftPrefixInstanceCmd = &cobra.Command{
 	},
 }
 
+var authAttemptsInstanceCmd = &cobra.Command{
+	Use:   "auth-attempts <domain>",
+	Short: "Show the failed authentication attempts on an instance",
+	Long: `
+cozy-stack instances auth-attempts shows the counters of failed authentication
+attempts (login, two-factor passcode and passphrase reset) on an instance, by
+IP address, and if the address is currently locked out.
+`,
+	Example: "$ cozy-stack instances auth-attempts cozy.tools:8080",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		list, err := c.ListAuthAttempts(args[0])
+		if err != nil {
+			return err
+		}
+		if flagJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(list)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, a := range list {
+			status := "-"
+			if a.Locked {
+				status = "locked"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				a.IP, a.Type, a.Count, status, a.ExpiresAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	},
+}
+
+var resetAuthAttemptsInstanceCmd = &cobra.Command{
+	Use:   "reset-auth-attempts <domain>",
+	Short: "Reset the failed authentication attempts on an instance",
+	Long: `
+cozy-stack instances reset-auth-attempts resets the counters of failed
+authentication attempts on an instance, and unlocks the IP addresses that were
+locked out. The --ip flag can be used to reset only the counters of an IP
+address.
+`,
+	Example: "$ cozy-stack instances reset-auth-attempts cozy.tools:8080 --ip 203.0.113.42",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		return c.ResetAuthAttempts(args[0], flagIP)
+	},
+}
+
+var auditInstanceCmd = &cobra.Command{
+	Use:   "audit <domain>",
+	Short: "Export the audit log of an instance",
+	Long: `
+cozy-stack instances audit exports the log of the sensitive events of an
+instance (passphrase and two-factor changes, OAuth clients, permissions,
+sharings and exports), as one JSON document by line, from the oldest to the
+most recent event.
+`,
+	Example: "$ cozy-stack instances audit cozy.tools:8080 > audit.ndjson",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		body, err := c.ExportAudit(args[0])
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = io.Copy(os.Stdout, body)
+		return err
+	},
+}
+
 var instanceAppVersionCmd = &cobra.Command{
 	Use:     "show-app-version [app-slug] [version]",
 	Short:   `Show instances that have a particular app version`,
@@ -902,6 +984,9 @@ func init() {
 	instanceCmdGroup.AddCommand(importCmd)
 	instanceCmdGroup.AddCommand(showSwiftPrefixInstanceCmd)
 	instanceCmdGroup.AddCommand(instanceAppVersionCmd)
+	instanceCmdGroup.AddCommand(authAttemptsInstanceCmd)
+	instanceCmdGroup.AddCommand(resetAuthAttemptsInstanceCmd)
+	instanceCmdGroup.AddCommand(auditInstanceCmd)
 	addInstanceCmd.Flags().StringSliceVar(&flagDomainAliases, "domain-aliases", nil, "Specify one or more aliases domain for the instance (separated by ',')")
 	addInstanceCmd.Flags().StringVar(&flagLocale, "locale", instance.DefaultLocale, "Locale of the new cozy instance")
 	addInstanceCmd.Flags().StringVar(&flagUUID, "uuid", "", "The UUID of the instance")
@@ -937,6 +1022,8 @@ func init() {
 	oauthClientInstanceCmd.Flags().BoolVar(&flagAllowLoginScope, "allow-login-scope", false, "Allow login scope")
 	oauthTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
 	appTokenInstanceCmd.Flags().DurationVar(&flagExpire, "expire", 0, "Make the token expires in this amount of time")
+	authAttemptsInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Output the counters in JSON format")
+	resetAuthAttemptsInstanceCmd.Flags().StringVar(&flagIP, "ip", "", "Reset only the counters of this IP address")
 	lsInstanceCmd.Flags().BoolVar(&flagJSON, "json", false, "Show each line as a json representation of the instance")
 	lsInstanceCmd.Flags().StringSliceVar(&flagListFields, "fields", nil, "Arguments shown for each line in the list")
 	lsInstanceCmd.Flags().BoolVar(&flagAvailableFields, "available-fields", false, "List available fields for --fields option")
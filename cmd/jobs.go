@@ -4,16 +4,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cozy/cozy-stack/client"
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/spf13/cobra"
 )
 
 var flagJobJSONArg string
 var flagJobPrintLogs bool
 var flagJobPrintLogsVerbose bool
+var flagJobDLQWorker string
 
 var jobsCmdGroup = &cobra.Command{
 	Use:   "jobs <command>",
@@ -63,6 +67,141 @@ var jobsRunCmd = &cobra.Command{
 	},
 }
 
+var jobsBacklogCmd = &cobra.Command{
+	Use:   "backlog <worker>",
+	Short: "Show the number of pending jobs of each instance for a worker",
+	Long: `
+cozy-stack jobs backlog shows the instances that have jobs waiting in the
+queue of the given worker, with the number of pending jobs, from the largest
+backlog to the smallest.
+`,
+	Example: "$ cozy-stack jobs backlog konnector",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return cmd.Usage()
+		}
+		c := newAdminClient()
+		counts, err := c.JobsBacklog(args[0])
+		if err != nil {
+			return err
+		}
+		domains := make([]string, 0, len(counts))
+		for domain := range counts {
+			domains = append(domains, domain)
+		}
+		sort.Slice(domains, func(i, j int) bool {
+			if counts[domains[i]] != counts[domains[j]] {
+				return counts[domains[i]] > counts[domains[j]]
+			}
+			return domains[i] < domains[j]
+		})
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, domain := range domains {
+			fmt.Fprintf(w, "%s\t%d\n", domain, counts[domain])
+		}
+		return w.Flush()
+	},
+}
+
+var jobsDLQCmdGroup = &cobra.Command{
+	Use:   "dlq <command>",
+	Short: "Inspect and replay the jobs that have failed after all their executions",
+}
+
+var jobsDLQListCmd = &cobra.Command{
+	Use:     "ls",
+	Short:   "List the dead letters of an instance",
+	Example: "$ cozy-stack jobs dlq ls --domain cozy.tools:8080 --worker sendmail",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagDomain == "" {
+			return errAppsMissingDomain
+		}
+		c := newClient(flagDomain, consts.JobsDeadLetters)
+		list, err := c.ListDeadLetters(flagJobDLQWorker)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, d := range list {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+				d.ID,
+				d.Attrs.Worker,
+				d.Attrs.Attempts,
+				d.Attrs.FailedAt.Format(time.RFC3339),
+				d.Attrs.Error,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var jobsDLQReplayCmd = &cobra.Command{
+	Use:   "replay [id...]",
+	Short: "Push again the jobs of some dead letters",
+	Long: `
+cozy-stack jobs dlq replay removes the given dead letters from the queue and
+pushes again their jobs. Without identifiers, all the dead letters of the
+instance (or of the worker given by the --worker flag) are replayed.
+`,
+	Example: "$ cozy-stack jobs dlq replay --domain cozy.tools:8080 --worker sendmail",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagDomain == "" {
+			return errAppsMissingDomain
+		}
+		c := newClient(flagDomain, consts.JobsDeadLetters)
+		ids := args
+		if len(ids) == 0 {
+			list, err := c.ListDeadLetters(flagJobDLQWorker)
+			if err != nil {
+				return err
+			}
+			for _, d := range list {
+				ids = append(ids, d.ID)
+			}
+		}
+		for _, id := range ids {
+			j, err := c.ReplayDeadLetter(id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Dead letter %s replayed as job %s (%s)\n", id, j.ID, j.Attrs.Worker)
+		}
+		return nil
+	},
+}
+
+var jobsDLQPurgeCmd = &cobra.Command{
+	Use:   "purge [id...]",
+	Short: "Delete some dead letters without replaying them",
+	Long: `
+cozy-stack jobs dlq purge deletes the given dead letters. Without identifiers,
+all the dead letters of the instance (or of the worker given by the --worker
+flag) are deleted.
+`,
+	Example: "$ cozy-stack jobs dlq purge --domain cozy.tools:8080 --worker sendmail",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagDomain == "" {
+			return errAppsMissingDomain
+		}
+		c := newClient(flagDomain, consts.JobsDeadLetters)
+		if len(args) == 0 {
+			n, err := c.PurgeDeadLetters(flagJobDLQWorker)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%d dead letter(s) deleted\n", n)
+			return nil
+		}
+		for _, id := range args {
+			if err := c.DeleteDeadLetter(id); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%d dead letter(s) deleted\n", len(args))
+		return nil
+	},
+}
+
 func init() {
 	domain := os.Getenv("COZY_DOMAIN")
 	if domain == "" && config.IsDevRelease() {
@@ -75,6 +214,13 @@ func init() {
 	jobsRunCmd.Flags().BoolVar(&flagJobPrintLogs, "logs", false, "print jobs log in stdout")
 	jobsRunCmd.Flags().BoolVar(&flagJobPrintLogsVerbose, "logs-verbose", false, "verbose logging (with --logs flag)")
 
+	jobsDLQCmdGroup.PersistentFlags().StringVar(&flagJobDLQWorker, "worker", "", "only the dead letters of this worker type")
+	jobsDLQCmdGroup.AddCommand(jobsDLQListCmd)
+	jobsDLQCmdGroup.AddCommand(jobsDLQReplayCmd)
+	jobsDLQCmdGroup.AddCommand(jobsDLQPurgeCmd)
+
 	jobsCmdGroup.AddCommand(jobsRunCmd)
+	jobsCmdGroup.AddCommand(jobsBacklogCmd)
+	jobsCmdGroup.AddCommand(jobsDLQCmdGroup)
 	RootCmd.AddCommand(jobsCmdGroup)
 }
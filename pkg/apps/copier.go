@@ -1,8 +1,10 @@
 package apps
 
 import (
+	"bytes"
 	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"strconv"
@@ -225,3 +227,47 @@ func (f *fileInfo) Mode() os.FileMode  { return f.mode }
 func (f *fileInfo) ModTime() time.Time { return f.time }
 func (f *fileInfo) IsDir() bool        { return false }
 func (f *fileInfo) Sys() interface{}   { return nil }
+
+// CopyVersion copies the files of a version of an application from a file
+// server to a copier. It is used when the files of an instance are moved to
+// another storage.
+func CopyVersion(src FileServer, dst Copier, slug, version string) (err error) {
+	exists, err := dst.Start(slug, version)
+	if err != nil || exists {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Abort() // #nosec
+		}
+	}()
+	names, err := src.FilesList(slug, version)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var content []byte
+		content, err = readFile(src, slug, version, name)
+		if err != nil {
+			return err
+		}
+		err = dst.Copy(&fileInfo{
+			name: name,
+			size: int64(len(content)),
+			mode: 0640,
+		}, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+	}
+	return dst.Commit()
+}
+
+func readFile(src FileServer, slug, version, name string) ([]byte, error) {
+	f, err := src.Open(slug, version, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,178 @@
+// Package audit keeps a log of the sensitive events that happen on an
+// instance, like a change of passphrase or the registration of an OAuth
+// client. The log is append-only: the entries are never updated, and they
+// can't be written by the applications.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+// Event is the kind of sensitive event recorded in the audit log.
+type Event string
+
+const (
+	// PassphraseChanged is used when the owner changes their passphrase
+	PassphraseChanged Event = "passphrase_changed"
+	// PassphraseRenewed is used when the passphrase is renewed after a reset
+	PassphraseRenewed Event = "passphrase_renewed"
+	// TwoFactorChanged is used when the two-factor authentication is
+	// enabled, disabled, or when a second factor is enrolled or removed
+	TwoFactorChanged Event = "two_factor_changed"
+	// OAuthClientRegistered is used when a new OAuth client is registered
+	OAuthClientRegistered Event = "oauth_client_registered"
+	// OAuthClientRevoked is used when an OAuth client is deleted
+	OAuthClientRevoked Event = "oauth_client_revoked"
+	// AppPasswordCreated is used when an app password is created
+	AppPasswordCreated Event = "app_password_created"
+	// AppPasswordRevoked is used when an app password is revoked
+	AppPasswordRevoked Event = "app_password_revoked"
+	// PermissionCreated is used when a permission is created, like a share
+	// by link
+	PermissionCreated Event = "permission_created"
+	// PermissionRevoked is used when a permission is revoked
+	PermissionRevoked Event = "permission_revoked"
+	// SharingAccepted is used when a sharing is accepted, by the owner of
+	// the instance for a recipient, or by a recipient for the sharer
+	SharingAccepted Event = "sharing_accepted"
+	// ExportRequested is used when an export of the instance is requested
+	ExportRequested Event = "export_requested"
+	// ExportDownloaded is used when the data of an export is downloaded
+	ExportDownloaded Event = "export_downloaded"
+)
+
+// DefaultLimit is the default number of entries returned by a page of the
+// audit log.
+const DefaultLimit = 50
+
+// exportPageSize is the number of entries fetched by request to CouchDB when
+// the audit log is exported.
+const exportPageSize = 1000
+
+// Entry is an entry of the audit log.
+type Entry struct {
+	DocID     string                 `json:"_id,omitempty"`
+	DocRev    string                 `json:"_rev,omitempty"`
+	Event     Event                  `json:"event"`
+	IP        string                 `json:"ip,omitempty"`
+	UA        string                 `json:"user_agent,omitempty"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// DocType implements couchdb.Doc
+func (e *Entry) DocType() string { return consts.Audit }
+
+// ID implements couchdb.Doc
+func (e *Entry) ID() string { return e.DocID }
+
+// SetID implements couchdb.Doc
+func (e *Entry) SetID(v string) { e.DocID = v }
+
+// Rev implements couchdb.Doc
+func (e *Entry) Rev() string { return e.DocRev }
+
+// SetRev implements couchdb.Doc
+func (e *Entry) SetRev(v string) { e.DocRev = v }
+
+// Clone implements couchdb.Doc
+func (e *Entry) Clone() couchdb.Doc {
+	clone := *e
+	if e.Details != nil {
+		clone.Details = make(map[string]interface{}, len(e.Details))
+		for k, v := range e.Details {
+			clone.Details[k] = v
+		}
+	}
+	return &clone
+}
+
+// Log records a sensitive event in the audit log of the instance. The request
+// is used to know the IP address and the user-agent of the client, and can be
+// nil. A failure to record the event is logged, but doesn't stop the action
+// that has triggered it.
+func Log(i *instance.Instance, req *http.Request, event Event, details map[string]interface{}) {
+	e := &Entry{
+		Event:     event,
+		Details:   details,
+		CreatedAt: time.Now(),
+	}
+	if req != nil {
+		e.IP = req.RemoteAddr
+		if ip := config.ClientIP(req); ip != nil {
+			e.IP = ip.String()
+		}
+		e.UA = req.UserAgent()
+	}
+	if err := couchdb.CreateDoc(i, e); err != nil {
+		i.Logger().WithField("nspace", "audit").
+			Errorf("Cannot record the %s event: %s", event, err)
+	}
+}
+
+// List returns a page of the audit log, the most recent entries first.
+func List(i *instance.Instance, cursor couchdb.Cursor) ([]*Entry, error) {
+	req := &couchdb.ViewRequest{
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(i, consts.AuditByDateView, req, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*Entry{}, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	entries := make([]*Entry, len(res.Rows))
+	for k, row := range res.Rows {
+		var e Entry
+		if err := json.Unmarshal(row.Doc, &e); err != nil {
+			return nil, err
+		}
+		entries[k] = &e
+	}
+	return entries, nil
+}
+
+// Export writes the whole audit log of the instance to w, as one JSON
+// document by line, from the oldest entry to the most recent one.
+func Export(i *instance.Instance, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	cursor := couchdb.NewKeyCursor(exportPageSize, nil, "")
+	for {
+		req := &couchdb.ViewRequest{IncludeDocs: true}
+		cursor.ApplyTo(req)
+
+		var res couchdb.ViewResponse
+		err := couchdb.ExecView(i, consts.AuditByDateView, req, &res)
+		if err != nil {
+			if couchdb.IsNoDatabaseError(err) {
+				return nil
+			}
+			return err
+		}
+		cursor.UpdateFrom(&res)
+
+		for _, row := range res.Rows {
+			if err := encoder.Encode(row.Doc); err != nil {
+				return err
+			}
+		}
+		if !cursor.HasMore() {
+			return nil
+		}
+	}
+}
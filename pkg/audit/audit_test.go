@@ -0,0 +1,122 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/stretchr/testify/assert"
+)
+
+var inst *instance.Instance
+
+func TestLogRecordsTheFieldsOfTheRequest(t *testing.T) {
+	req := httptest.NewRequest("PUT", "/settings/passphrase", nil)
+	req.RemoteAddr = "198.51.100.2:5678"
+	req.Header.Set("User-Agent", "Audit-Test/1.0")
+	// The header is ignored, as the client is not a trusted proxy
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	before := time.Now()
+	Log(inst, req, AppPasswordCreated, map[string]interface{}{
+		"app_password_id": "123",
+		"name":            "Thunderbird",
+	})
+
+	entries, err := List(inst, couchdb.NewKeyCursor(1, nil, ""))
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	e := entries[0]
+	assert.NotEmpty(t, e.DocID)
+	assert.Equal(t, AppPasswordCreated, e.Event)
+	assert.Equal(t, "198.51.100.2", e.IP)
+	assert.Equal(t, "Audit-Test/1.0", e.UA)
+	assert.Equal(t, "123", e.Details["app_password_id"])
+	assert.Equal(t, "Thunderbird", e.Details["name"])
+	assert.False(t, e.CreatedAt.Before(before))
+}
+
+func TestLogUsesTheForwardedIPOfATrustedProxy(t *testing.T) {
+	req := httptest.NewRequest("POST", "/auth/register", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	Log(inst, req, OAuthClientRegistered, nil)
+
+	entries, err := List(inst, couchdb.NewKeyCursor(1, nil, ""))
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Equal(t, OAuthClientRegistered, entries[0].Event)
+	assert.Equal(t, "203.0.113.7", entries[0].IP)
+	assert.Empty(t, entries[0].Details)
+}
+
+func TestLogWithoutRequest(t *testing.T) {
+	Log(inst, nil, ExportRequested, nil)
+
+	entries, err := List(inst, couchdb.NewKeyCursor(1, nil, ""))
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 1) {
+		return
+	}
+	assert.Equal(t, ExportRequested, entries[0].Event)
+	assert.Empty(t, entries[0].IP)
+	assert.Empty(t, entries[0].UA)
+}
+
+func TestListAndExportOrder(t *testing.T) {
+	events := []Event{PassphraseChanged, TwoFactorChanged, PermissionRevoked}
+	for _, event := range events {
+		time.Sleep(10 * time.Millisecond)
+		Log(inst, nil, event, nil)
+	}
+
+	// The most recent entries first, page by page
+	cursor := couchdb.NewKeyCursor(2, nil, "")
+	entries, err := List(inst, cursor)
+	if !assert.NoError(t, err) || !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.Equal(t, PermissionRevoked, entries[0].Event)
+	assert.Equal(t, TwoFactorChanged, entries[1].Event)
+	assert.True(t, cursor.HasMore())
+	entries, err = List(inst, cursor)
+	if assert.NoError(t, err) && assert.NotEmpty(t, entries) {
+		assert.Equal(t, PassphraseChanged, entries[0].Event)
+	}
+
+	// The oldest entries first, one JSON document by line
+	var buf bytes.Buffer
+	if !assert.NoError(t, Export(inst, &buf)) {
+		return
+	}
+	decoder := json.NewDecoder(&buf)
+	var exported []Event
+	for decoder.More() {
+		var e Entry
+		if !assert.NoError(t, decoder.Decode(&e)) {
+			return
+		}
+		assert.False(t, e.CreatedAt.IsZero())
+		exported = append(exported, e.Event)
+	}
+	if assert.True(t, len(exported) >= len(events)) {
+		assert.Equal(t, events, exported[len(exported)-len(events):])
+	}
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+	testutils.NeedCouchdb()
+
+	setup := testutils.NewSetup(m, "audit_test")
+	inst = setup.GetTestInstance()
+
+	os.Exit(setup.Run())
+}
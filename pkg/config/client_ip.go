@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultTrustedProxies are the reverse proxies trusted when the
+// trusted_proxies key is not in the configuration file.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// parseTrustedProxies parses the list of CIDR (or IP addresses) of the
+// trusted_proxies key.
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, cidr := range list {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("config: invalid IP address %q in trusted_proxies", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("config: invalid CIDR %q in trusted_proxies", cidr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP address of the client that has made the request.
+// The X-Forwarded-For header can be forged by the client, so it is used only
+// when the request comes from a trusted proxy: the address is then the
+// rightmost one of the header that is not a trusted proxy.
+func ClientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	var trusted []*net.IPNet
+	if config != nil {
+		trusted = config.TrustedProxies
+	}
+	if !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for k := len(hops) - 1; k >= 0; k-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[k]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip
+}
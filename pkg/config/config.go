@@ -79,6 +79,8 @@ const (
 	SchemeMem = "mem"
 	// SchemeSwift is the URL scheme used to configure a swift filesystem.
 	SchemeSwift = "swift"
+	// SchemeS3 is the URL scheme used to configure a S3 filesystem.
+	SchemeS3 = "s3"
 )
 
 // defaultAdminSecretFileName is the default name of the file containing the
@@ -110,6 +112,7 @@ type Config struct {
 
 	CredentialsEncryptorKey string
 	CredentialsDecryptorKey string
+	FilesMasterKey          string
 
 	RemoteAssets map[string]string
 
@@ -136,6 +139,10 @@ type Config struct {
 	CSPDisabled  bool
 	CSPWhitelist map[string]string
 
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is
+	// used to know the IP address of the clients.
+	TrustedProxies []*net.IPNet
+
 	AssetsPollingDisabled bool
 	AssetsPollingInterval time.Duration
 }
@@ -145,6 +152,7 @@ type Config struct {
 type Vault struct {
 	credsEncryptor *keymgmt.NACLKey
 	credsDecryptor *keymgmt.NACLKey
+	filesMaster    *keymgmt.SecretKey
 }
 
 // CredentialsEncryptorKey returns the key used to encrypt credentials values,
@@ -159,10 +167,37 @@ func (v *Vault) CredentialsDecryptorKey() *keymgmt.NACLKey {
 	return v.credsDecryptor
 }
 
+// FilesMasterKey returns the key used to wrap the keys of the instances that
+// encrypt the contents of their files.
+func (v *Vault) FilesMasterKey() *keymgmt.SecretKey {
+	return v.filesMaster
+}
+
 // Fs contains the configuration values of the file-system
 type Fs struct {
 	Auth *url.Userinfo
 	URL  *url.URL
+	// PreviousURL is the URL of the storage used before the current one, for
+	// the instances whose files have not yet been moved to the new storage.
+	PreviousURL *url.URL
+	Versioning  FsVersioning
+	// Dedup enables the storage of the contents of the files by their hash,
+	// with a single copy for the files with the same content.
+	Dedup bool
+	// SearchPath is the directory where the full-text indexes of the files are
+	// stored. If empty, the full-text search is disabled.
+	SearchPath string
+}
+
+// FsVersioning contains the configuration values for the retention policy of
+// the old versions of the files.
+type FsVersioning struct {
+	// MaxNumberToKeep is the maximal number of old versions kept for a file. If
+	// zero, the versioning is disabled.
+	MaxNumberToKeep int
+	// MaxAge is the maximal duration an old version is kept. If zero, there is
+	// no limit on the age of the versions.
+	MaxAge time.Duration
 }
 
 // CouchDB contains the configuration values of the database
@@ -179,6 +214,7 @@ type Jobs struct {
 	NoWorkers             bool
 	WhiteList             bool
 	Workers               []Worker
+	Weights               map[string]int
 	ImageMagickConvertCmd string
 	// XXX for retro-compatibility
 	NbWorkers int
@@ -204,10 +240,11 @@ type Notifications struct {
 
 // Worker contains the configuration fields for a specific worker type.
 type Worker struct {
-	WorkerType   string
-	Concurrency  *int
-	MaxExecCount *int
-	Timeout      *time.Duration
+	WorkerType     string
+	Concurrency    *int
+	MaxExecCount   *int
+	MaxPerInstance *int
+	Timeout        *time.Duration
 }
 
 // RedisConfig contains the configuration values for a redis system
@@ -277,6 +314,41 @@ func FsURL() *url.URL {
 	return config.Fs.URL
 }
 
+// FsPreviousURL returns the URL of the previous storage of the files, or nil
+// if the storage has not been changed.
+func FsPreviousURL() *url.URL {
+	return config.Fs.PreviousURL
+}
+
+// storageCredentials are the parameters of the URL of a storage that are
+// only used to authenticate, and not to locate the files.
+var storageCredentials = []string{"UserName", "Password", "Token", "AccessKeyID", "SecretAccessKey"}
+
+// StorageID returns an identifier for the storage of the given URL, with its
+// scheme, host, path and parameters, but without the credentials. It can be
+// saved to know on which storage the files of an instance are.
+func StorageID(fsURL *url.URL) string {
+	q := fsURL.Query()
+	for _, param := range storageCredentials {
+		q.Del(param)
+	}
+	id := url.URL{
+		Scheme:   fsURL.Scheme,
+		Host:     fsURL.Host,
+		Path:     fsURL.Path,
+		RawQuery: q.Encode(),
+	}
+	return id.String()
+}
+
+// SameStorage returns true if the two URLs are for the same storage.
+func SameStorage(a, b *url.URL) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return StorageID(a) == StorageID(b)
+}
+
 // ServerAddr returns the address on which the stack is run
 func ServerAddr() string {
 	return net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
@@ -384,6 +456,8 @@ func applyDefaults(v *viper.Viper) {
 	v.SetDefault("jobs.imagemagick_convert_cmd", "convert")
 	v.SetDefault("assets_polling_disabled", false)
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
+	v.SetDefault("fs.versioning.max_number_of_versions_to_keep", 20)
+	v.SetDefault("fs.versioning.max_age", 30*24*time.Hour)
 }
 
 func envMap() map[string]string {
@@ -404,13 +478,20 @@ func UseViper(v *viper.Viper) error {
 	if err != nil {
 		return err
 	}
-	if fsURL.Scheme == "file" {
-		fsPath := fsURL.Path
-		if fsPath != "" && !path.IsAbs(fsPath) {
-			return fmt.Errorf("Filesystem path should be absolute, was: %q", fsPath)
+	if err = checkFsURL(fsURL); err != nil {
+		return err
+	}
+	var fsPreviousURL *url.URL
+	if previous := v.GetString("fs.previous_url"); previous != "" {
+		fsPreviousURL, err = url.Parse(previous)
+		if err != nil {
+			return err
 		}
-		if fsPath == "/" {
-			return fmt.Errorf("Filesystem path should not be root, was: %q", fsPath)
+		if err = checkFsURL(fsPreviousURL); err != nil {
+			return err
+		}
+		if SameStorage(fsURL, fsPreviousURL) {
+			return fmt.Errorf("config: fs.previous_url %q must be another storage than fs.url", StorageID(fsPreviousURL))
 		}
 	}
 
@@ -440,6 +521,15 @@ func UseViper(v *viper.Viper) error {
 		return err
 	}
 
+	proxiesList := defaultTrustedProxies
+	if v.IsSet("trusted_proxies") {
+		proxiesList = v.GetStringSlice("trusted_proxies")
+	}
+	trustedProxies, err := parseTrustedProxies(proxiesList)
+	if err != nil {
+		return err
+	}
+
 	var subdomains SubdomainType
 	if subs := v.GetString("subdomains"); subs != "" {
 		switch subs {
@@ -551,6 +641,10 @@ func UseViper(v *viper.Viper) error {
 							if maxExecCount, ok := v.(int); ok {
 								w.MaxExecCount = &maxExecCount
 							}
+						case "max_per_instance":
+							if maxPerInstance, ok := v.(int); ok {
+								w.MaxPerInstance = &maxPerInstance
+							}
 						case "timeout":
 							if timeout, ok := v.(string); ok {
 								var d time.Duration
@@ -575,6 +669,17 @@ func UseViper(v *viper.Viper) error {
 			}
 			jobs.Workers = workers
 		}
+		if weightsMap := v.GetStringMap("jobs.weights"); len(weightsMap) > 0 {
+			jobs.Weights = make(map[string]int, len(weightsMap))
+			for contextName, value := range weightsMap {
+				weight, ok := value.(int)
+				if !ok || weight < 1 {
+					return fmt.Errorf("config: expecting a positive integer in the key %q",
+						"jobs.weights."+contextName)
+				}
+				jobs.Weights[contextName] = weight
+			}
+		}
 	}
 
 	config = &Config{
@@ -598,9 +703,17 @@ func UseViper(v *viper.Viper) error {
 
 		CredentialsEncryptorKey: v.GetString("vault.credentials_encryptor_key"),
 		CredentialsDecryptorKey: v.GetString("vault.credentials_decryptor_key"),
+		FilesMasterKey:          v.GetString("vault.files_master_key"),
 
 		Fs: Fs{
-			URL: fsURL,
+			URL:         fsURL,
+			PreviousURL: fsPreviousURL,
+			Versioning: FsVersioning{
+				MaxNumberToKeep: v.GetInt("fs.versioning.max_number_of_versions_to_keep"),
+				MaxAge:          v.GetDuration("fs.versioning.max_age"),
+			},
+			Dedup:      v.GetBool("fs.dedup"),
+			SearchPath: v.GetString("fs.search_path"),
 		},
 		CouchDB: CouchDB{
 			Auth:   couchAuth,
@@ -644,7 +757,8 @@ func UseViper(v *viper.Viper) error {
 		Registries: regs,
 		Clouderies: v.GetStringMap("clouderies"),
 
-		CSPWhitelist: v.GetStringMapString("csp_whitelist"),
+		CSPWhitelist:   v.GetStringMapString("csp_whitelist"),
+		TrustedProxies: trustedProxies,
 
 		AssetsPollingDisabled: v.GetBool("assets_polling_disabled"),
 		AssetsPollingInterval: v.GetDuration("assets_polling_interval"),
@@ -661,6 +775,7 @@ func UseViper(v *viper.Viper) error {
 func MakeVault(c *Config) error {
 	var credsEncryptor *keymgmt.NACLKey
 	var credsDecryptor *keymgmt.NACLKey
+	var filesMaster *keymgmt.SecretKey
 
 	if credsEncryptorKey := config.CredentialsEncryptorKey; credsEncryptorKey != "" {
 		keyBytes, err := ioutil.ReadFile(credsEncryptorKey)
@@ -684,9 +799,21 @@ func MakeVault(c *Config) error {
 		}
 	}
 
+	if filesMasterKey := config.FilesMasterKey; filesMasterKey != "" {
+		keyBytes, err := ioutil.ReadFile(filesMasterKey)
+		if err != nil {
+			return err
+		}
+		filesMaster, err = keymgmt.UnmarshalSecretKey(keyBytes)
+		if err != nil {
+			return err
+		}
+	}
+
 	vault = &Vault{
 		credsEncryptor: credsEncryptor,
 		credsDecryptor: credsDecryptor,
+		filesMaster:    filesMaster,
 	}
 	return nil
 }
@@ -814,3 +941,16 @@ func parseURL(u string) (*url.URL, *url.Userinfo, error) {
 	parsedURL.User = nil
 	return parsedURL, user, nil
 }
+
+func checkFsURL(fsURL *url.URL) error {
+	if fsURL.Scheme == SchemeFile {
+		fsPath := fsURL.Path
+		if fsPath != "" && !path.IsAbs(fsPath) {
+			return fmt.Errorf("Filesystem path should be absolute, was: %q", fsPath)
+		}
+		if fsPath == "/" {
+			return fmt.Errorf("Filesystem path should not be root, was: %q", fsPath)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -97,6 +99,42 @@ registries:
 	assert.EqualValues(t, []string{"https://default"}, regsToStrings(GetConfig().Registries["default"]))
 }
 
+func TestStorageID(t *testing.T) {
+	s3, _ := url.Parse("s3://minio:9000/cozy?AccessKeyID=key&SecretAccessKey=secret&Region=eu")
+	assert.Equal(t, "s3://minio:9000/cozy?Region=eu", StorageID(s3))
+
+	other, _ := url.Parse("s3://minio:9000/cozy-new?AccessKeyID=key&SecretAccessKey=secret&Region=eu")
+	assert.False(t, SameStorage(s3, other))
+	rotated, _ := url.Parse("s3://minio:9000/cozy?AccessKeyID=key2&SecretAccessKey=secret2&Region=eu")
+	assert.True(t, SameStorage(s3, rotated))
+	assert.False(t, SameStorage(s3, nil))
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"127.0.0.1", "10.0.0.0/8"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = parseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+
+	previous := config.TrustedProxies
+	config.TrustedProxies = trusted
+	defer func() { config.TrustedProxies = previous }()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.True(t, net.ParseIP("203.0.113.7").Equal(ClientIP(req)))
+
+	req.RemoteAddr = "127.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.8, 10.1.2.3")
+	assert.True(t, net.ParseIP("203.0.113.8").Equal(ClientIP(req)))
+
+	req.Header.Del("X-Forwarded-For")
+	assert.True(t, net.ParseIP("127.0.0.1").Equal(ClientIP(req)))
+}
+
 func regsToStrings(regs []*url.URL) []string {
 	ss := make([]string, len(regs))
 	for i, r := range regs {
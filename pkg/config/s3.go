@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	minio "github.com/minio/minio-go/v6"
+)
+
+var s3Client *minio.Client
+var s3Bucket string
+var previousS3Client *minio.Client
+var previousS3Bucket string
+
+// InitS3Client initialize the global S3 client. The host of the URL is the
+// endpoint of the S3 server, and its path is the name of the bucket. This is
+// not a thread-safe method.
+func InitS3Client(s3URL *url.URL) error {
+	client, bucket, err := newS3Client(s3URL)
+	if err != nil {
+		return err
+	}
+	s3Client = client
+	s3Bucket = bucket
+	return nil
+}
+
+// InitPreviousS3Client initialize the S3 client for the storage of
+// fs.previous_url. It is kept apart from the global client, as the two
+// storages can be on different servers or buckets. This is not a thread-safe
+// method.
+func InitPreviousS3Client(s3URL *url.URL) error {
+	client, bucket, err := newS3Client(s3URL)
+	if err != nil {
+		return err
+	}
+	previousS3Client = client
+	previousS3Bucket = bucket
+	return nil
+}
+
+func newS3Client(s3URL *url.URL) (*minio.Client, string, error) {
+	q := s3URL.Query()
+
+	bucket := strings.Trim(s3URL.Path, "/")
+	if bucket == "" {
+		return nil, "", fmt.Errorf("s3: the bucket is missing in the url for %s", s3URL.Host)
+	}
+
+	secure := q.Get("DisableSSL") != "true"
+	client, err := minio.NewWithRegion(s3URL.Host,
+		q.Get("AccessKeyID"), q.Get("SecretAccessKey"),
+		secure, q.Get("Region"))
+	if err != nil {
+		return nil, "", err
+	}
+
+	exists, err := client.BucketExists(bucket)
+	if err == nil && !exists {
+		err = client.MakeBucket(bucket, q.Get("Region"))
+	}
+	if err != nil {
+		log.Errorf("Could not access the bucket %s on the S3 server %s",
+			bucket, s3URL.Host)
+		return nil, "", err
+	}
+
+	log.Infof("Successfully connected to the S3 server %s", s3URL.Host)
+	return client, bucket, nil
+}
+
+// GetS3Client returns the S3 client created from the actual configuration.
+func GetS3Client() *minio.Client {
+	if s3Client == nil {
+		panic("Called GetS3Client() before InitS3Client()")
+	}
+	return s3Client
+}
+
+// GetS3Bucket returns the name of the bucket where the files are stored on
+// the S3 server.
+func GetS3Bucket() string {
+	return s3Bucket
+}
+
+// S3ClientFor returns the S3 client and the bucket for the given storage: the
+// client of fs.previous_url if it is this one, and the global client
+// otherwise.
+func S3ClientFor(fsURL *url.URL) (*minio.Client, string) {
+	if previousS3Client != nil && SameStorage(fsURL, FsPreviousURL()) {
+		return previousS3Client, previousS3Bucket
+	}
+	return GetS3Client(), GetS3Bucket()
+}
@@ -9,10 +9,33 @@ import (
 )
 
 var swiftConn *swift.Connection
+var previousSwiftConn *swift.Connection
 
 // InitSwiftConnection initialize the global swift handler connection. This is
 // not a thread-safe method.
 func InitSwiftConnection(swiftURL *url.URL) error {
+	c, err := newSwiftConnection(swiftURL)
+	if err != nil {
+		return err
+	}
+	swiftConn = c
+	return nil
+}
+
+// InitPreviousSwiftConnection initialize the swift connection to the storage
+// of fs.previous_url. It is kept apart from the global connection, as the two
+// storages can be on different swift servers. This is not a thread-safe
+// method.
+func InitPreviousSwiftConnection(swiftURL *url.URL) error {
+	c, err := newSwiftConnection(swiftURL)
+	if err != nil {
+		return err
+	}
+	previousSwiftConn = c
+	return nil
+}
+
+func newSwiftConnection(swiftURL *url.URL) (*swift.Connection, error) {
 	q := swiftURL.Query()
 
 	var authURL *url.URL
@@ -39,7 +62,7 @@ func InitSwiftConnection(swiftURL *url.URL) error {
 		password = q.Get("Token")
 	}
 
-	swiftConn = &swift.Connection{
+	c := &swift.Connection{
 		UserName:       username,
 		ApiKey:         password,
 		AuthUrl:        authURL.String(),
@@ -54,13 +77,13 @@ func InitSwiftConnection(swiftURL *url.URL) error {
 		Timeout:        300 * time.Second,
 	}
 
-	if err = swiftConn.Authenticate(); err != nil {
+	if err = c.Authenticate(); err != nil {
 		log.Errorf("Authentication failed with the OpenStack Swift server on %s",
-			swiftConn.AuthUrl)
-		return err
+			c.AuthUrl)
+		return nil, err
 	}
-	log.Infof("Successfully authenticated with server %s", swiftConn.AuthUrl)
-	return nil
+	log.Infof("Successfully authenticated with server %s", c.AuthUrl)
+	return c, nil
 }
 
 // GetSwiftConnection returns a swift.Connection pointer created from the
@@ -71,3 +94,13 @@ func GetSwiftConnection() *swift.Connection {
 	}
 	return swiftConn
 }
+
+// SwiftConnectionFor returns the swift connection for the given storage: the
+// connection to the storage of fs.previous_url if it is this one, and the
+// global connection otherwise.
+func SwiftConnectionFor(fsURL *url.URL) *swift.Connection {
+	if previousSwiftConn != nil && SameStorage(fsURL, FsPreviousURL()) {
+		return previousSwiftConn
+	}
+	return GetSwiftConnection()
+}
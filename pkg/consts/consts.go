@@ -17,12 +17,24 @@ const (
 	KonnectorLogs = "io.cozy.konnectors.logs"
 	// Archives doc type for zip archives with files and directories
 	Archives = "io.cozy.files.archives"
+	// AppPasswords doc type for the passwords of the legacy clients that
+	// can't use OAuth
+	AppPasswords = "io.cozy.app_passwords"
+	// Audit doc type for the log of the sensitive events of an instance
+	Audit = "io.cozy.audit"
 	// Exports doc type for global exports archives
 	Exports = "io.cozy.exports"
 	// Doctypes doc type for doctype list
 	Doctypes = "io.cozy.doctypes"
 	// Files doc type for type for files and directories
 	Files = "io.cozy.files"
+	// FilesVersions doc type for the old versions of the content of files
+	FilesVersions = "io.cozy.files.versions"
+	// FilesUploads doc type for the sessions of resumable uploads
+	FilesUploads = "io.cozy.files.uploads"
+	// FilesBlobs doc type for the reference counting of the deduplicated
+	// contents of files
+	FilesBlobs = "io.cozy.files.blobs"
 	// PhotosAlbums doc type for photos albums
 	PhotosAlbums = "io.cozy.photos.albums"
 	// Intents doc type for intents persisted in couchdb
@@ -31,18 +43,29 @@ const (
 	Jobs = "io.cozy.jobs"
 	// JobEvents doc type for realt time events sent by jobs
 	JobEvents = "io.cozy.jobs.events"
+	// JobsWorkflows doc type for the workflows of jobs with dependencies
+	JobsWorkflows = "io.cozy.jobs.workflows"
+	// JobsDeadLetters doc type for the jobs that have failed after all their
+	// executions
+	JobsDeadLetters = "io.cozy.jobs.dead_letters"
 	// Notifications doc type for notifications
 	Notifications = "io.cozy.notifications"
 	// OAuthAccessCodes doc type for OAuth2 access codes
 	OAuthAccessCodes = "io.cozy.oauth.access_codes"
 	// OAuthClients doc type for OAuth2 clients
 	OAuthClients = "io.cozy.oauth.clients"
+	// OAuthDeviceCodes doc type for OAuth2 device codes
+	OAuthDeviceCodes = "io.cozy.oauth.device_codes"
 	// Permissions doc type for permissions identifying a connection
 	Permissions = "io.cozy.permissions"
+	// PermissionsAccesses doc type for the access log of the shares by link
+	PermissionsAccesses = "io.cozy.permissions.accesses"
 	// Contacts doc type for sharing
 	Contacts = "io.cozy.contacts"
 	// RemoteRequests doc type for logging requests to remote websites
 	RemoteRequests = "io.cozy.remote.requests"
+	// RevokedTokens doc type for the tokens revoked before their expiration
+	RevokedTokens = "io.cozy.revoked_tokens"
 	// Sessions doc type for sessions identifying a connection
 	Sessions = "io.cozy.sessions"
 	// SessionsLogins doc type for sessions identifying a connection
@@ -55,6 +78,10 @@ const (
 	Sharings = "io.cozy.sharings"
 	// SharingsAnswer doc type for credentials exchange for sharings
 	SharingsAnswer = "io.cozy.sharings.answer"
+	// SharingsActivity doc type for the activity feed of the sharings
+	SharingsActivity = "io.cozy.sharings.activity"
+	// SharingsConflicts doc type for the conflicts on the shared files
+	SharingsConflicts = "io.cozy.sharings.conflicts"
 	// SharingsInitialSync doc type for real-time events for initial sync of a
 	// sharing
 	SharingsInitialSync = "io.cozy.sharings.initial-sync"
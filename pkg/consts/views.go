@@ -7,7 +7,7 @@ import (
 
 // IndexViewsVersion is the version of current definition of views & indexes.
 // This number should be incremented when this file changes.
-const IndexViewsVersion int = 18
+const IndexViewsVersion int = 23
 
 // globalIndexes is the index list required on the global databases to run
 // properly.
@@ -51,11 +51,15 @@ func InitGlobalDB() error {
 var Indexes = []*mango.Index{
 	// Permissions
 	mango.IndexOnFields(Permissions, "by-source-and-type", []string{"source_id", "type"}),
+	// Used to lookup the access log of a share by link
+	mango.IndexOnFields(PermissionsAccesses, "by-permission-id", []string{"permission_id", "created_at"}),
 
 	// Used to lookup over the children of a directory
 	mango.IndexOnFields(Files, "dir-children", []string{"dir_id", "_id"}),
 	// Used to lookup a directory given its path
 	mango.IndexOnFields(Files, "dir-by-path", []string{"path"}),
+	// Used to lookup the old versions of a file
+	mango.IndexOnFields(FilesVersions, "by-file-id", []string{"file_id", "updated_at"}),
 
 	// Used to lookup a queued and running jobs
 	mango.IndexOnFields(Jobs, "by-worker-and-state", []string{"worker", "state"}),
@@ -87,6 +91,64 @@ function(doc) {
 	Reduce: "_sum",
 }
 
+// VersionsDiskUsageView is the view used for computing the disk usage of the
+// old versions of the files
+var VersionsDiskUsageView = &couchdb.View{
+	Name:    "versions-disk-usage",
+	Doctype: FilesVersions,
+	Map: `
+function(doc) {
+  emit(doc._id, +doc.size);
+}
+`,
+	Reduce: "_sum",
+}
+
+// UploadsDiskUsageView is the view used for computing the space reserved by
+// the upload sessions, by their expiration dates
+var UploadsDiskUsageView = &couchdb.View{
+	Name:    "uploads-disk-usage",
+	Doctype: FilesUploads,
+	Map: `
+function(doc) {
+  if (!doc.completing) {
+    emit(doc.expires_at, +doc.size);
+  }
+}
+`,
+	Reduce: "_sum",
+}
+
+// BlobsDiskSavingsView is the view used for computing the disk space saved by
+// the deduplication of the contents of the files
+var BlobsDiskSavingsView = &couchdb.View{
+	Name:    "blobs-disk-savings",
+	Doctype: FilesBlobs,
+	Map: `
+function(doc) {
+  if (isArray(doc.refs) && doc.refs.length > 1) {
+    emit(doc._id, (doc.refs.length - 1) * doc.size);
+  }
+}
+`,
+	Reduce: "_sum",
+}
+
+// BlobsByRefView is the view used for finding the blob referenced by a file
+var BlobsByRefView = &couchdb.View{
+	Name:    "blobs-by-ref",
+	Doctype: FilesBlobs,
+	Map: `
+function(doc) {
+  if (isArray(doc.refs)) {
+    doc.refs.forEach(function(ref) {
+      emit(ref);
+    });
+  }
+}
+`,
+}
+
 // FilesReferencedByView is the view used for fetching files referenced by a
 // given document
 var FilesReferencedByView = &couchdb.View{
@@ -229,9 +291,58 @@ function(doc) {
 `,
 }
 
+// AuditByDateView is the view for fetching the entries of the audit log,
+// sorted by date
+var AuditByDateView = &couchdb.View{
+	Name:    "audit-by-date",
+	Doctype: Audit,
+	Map: `
+function(doc) {
+  emit(doc.created_at);
+}`,
+}
+
+// SharingsActivityView is the view for fetching the activity feed of a
+// sharing, sorted by date
+var SharingsActivityView = &couchdb.View{
+	Name:    "activity-by-sharing",
+	Doctype: SharingsActivity,
+	Map: `
+function(doc) {
+  emit([doc.sharing_id, doc.created_at]);
+}`,
+}
+
+// SharingsConflictsView is the view for fetching the conflicts on the files
+// of a sharing, sorted by date
+var SharingsConflictsView = &couchdb.View{
+	Name:    "conflicts-by-sharing",
+	Doctype: SharingsConflicts,
+	Map: `
+function(doc) {
+  emit([doc.sharing_id, doc.created_at]);
+}`,
+}
+
+// DeadLettersByWorkerView is the view for fetching the dead letters of a
+// worker type, sorted by date of failure, and for counting them
+var DeadLettersByWorkerView = &couchdb.View{
+	Name:    "dead-letters-by-worker",
+	Doctype: JobsDeadLetters,
+	Map: `
+function(doc) {
+  emit([doc.worker, doc.failed_at]);
+}`,
+	Reduce: "_count",
+}
+
 // Views is the list of all views that are created by the stack.
 var Views = []*couchdb.View{
 	DiskUsageView,
+	VersionsDiskUsageView,
+	UploadsDiskUsageView,
+	BlobsDiskSavingsView,
+	BlobsByRefView,
 	FilesReferencedByView,
 	ReferencedBySortedByDatetimeView,
 	FilesByParentView,
@@ -241,6 +352,10 @@ var Views = []*couchdb.View{
 	SharedDocsBySharingID,
 	SharingsByDocTypeView,
 	ContactByEmail,
+	AuditByDateView,
+	SharingsActivityView,
+	SharingsConflictsView,
+	DeadLettersByWorkerView,
 }
 
 // ViewsByDoctype returns the list of views for a specified doc type.
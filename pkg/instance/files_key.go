@@ -0,0 +1,58 @@
+package instance
+
+import (
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// FilesKey returns the key used to encrypt the contents of the files of the
+// instance, or nil if they are not encrypted. It implements the
+// vfs.ContentKeyer interface.
+func (i *Instance) FilesKey() (*keymgmt.SecretKey, error) {
+	if len(i.WrappedFilesKey) == 0 {
+		return nil, nil
+	}
+	master := config.GetVault().FilesMasterKey()
+	if master == nil {
+		return nil, vfs.ErrEncryptionDisabled
+	}
+	return keymgmt.UnwrapKey(master, i.WrappedFilesKey)
+}
+
+func (i *Instance) generateFilesKey() error {
+	key, err := keymgmt.GenerateSecretKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := keymgmt.WrapKey(config.GetVault().FilesMasterKey(), key)
+	if err != nil {
+		return err
+	}
+	i.WrappedFilesKey = wrapped
+	return nil
+}
+
+// EnableFilesEncryption generates the key used to encrypt the contents of the
+// files of an existing instance. The new contents are encrypted as soon as the
+// key is saved, and the contents written before must be encrypted with the
+// VFS EncryptContents method.
+func (i *Instance) EnableFilesEncryption() error {
+	if len(i.WrappedFilesKey) > 0 {
+		return nil
+	}
+	if config.GetVault().FilesMasterKey() == nil {
+		return vfs.ErrEncryptionDisabled
+	}
+	if i.SwiftCluster == 0 && i.StorageURL().Scheme == config.SchemeSwift {
+		return vfs.ErrEncryptionNotSupported
+	}
+	if err := i.generateFilesKey(); err != nil {
+		return err
+	}
+	if err := i.update(); err != nil {
+		return err
+	}
+	i.vfs = nil
+	return i.makeVFS()
+}
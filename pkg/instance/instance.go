@@ -26,10 +26,13 @@ import (
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/cozy/cozy-stack/pkg/search"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
 	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
@@ -68,6 +71,12 @@ var (
 	// ErrInvalidTwoFactor is returned when the two-factor authentication
 	// verification is invalid.
 	ErrInvalidTwoFactor = errors.New("Invalid two-factor parameters")
+	// ErrTwoFactorNotEnrolled is returned when a second factor is used before
+	// its enrollment.
+	ErrTwoFactorNotEnrolled = errors.New("The second factor is not enrolled")
+	// ErrTwoFactorInUse is returned when removing a second factor needed by
+	// the current authentication mode.
+	ErrTwoFactorInUse = errors.New("The second factor is used by the authentication mode")
 	// ErrContextNotFound is returned when the instance has no context
 	ErrContextNotFound = errors.New("Context not found")
 	// ErrResetAlreadyRequested is returned when a passphrase reset token is already set and valid
@@ -104,6 +113,11 @@ type Instance struct {
 
 	// Swift cluster number, indexed from 1. If not zero, it indicates we're using swift layout 2, see pkg/vfs/swift.
 	SwiftCluster int `json:"swift_cluster,omitempty"`
+	// Storage identifies the storage where the files of the instance are
+	// persisted, by its URL without the credentials (see config.StorageID).
+	// It is used to know if the instance is still on the previous storage
+	// when fs.url is changed.
+	Storage string `json:"storage,omitempty"`
 
 	// PassphraseHash is a hash of the user's passphrase. For more informations,
 	// see crypto.GenerateFromPassphrase.
@@ -123,6 +137,23 @@ type Instance struct {
 	OAuthSecret []byte `json:"oauth_secret,omitempty"`
 	// CLISecret is used to authenticate request from the CLI
 	CLISecret []byte `json:"cli_secret,omitempty"`
+	// WrappedFilesKey is the key used to encrypt the contents of the files,
+	// wrapped by the master key of the vault. It is empty if the files are not
+	// encrypted.
+	WrappedFilesKey []byte `json:"files_key,omitempty"`
+	// TOTPSecret is the secret shared with the authenticator app of the user
+	// for the two-factor authentication with TOTP.
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// TOTPLastStep is the time step of the last passcode of the authenticator
+	// app that has been accepted. The passcodes of this step and of the
+	// previous ones are refused, so that a passcode can't be used twice.
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are the hashes of the codes that the user can use, once
+	// each, when the authenticator app or the security keys are lost.
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// WebAuthnCredentials are the security keys registered for the two-factor
+	// authentication with WebAuthn.
+	WebAuthnCredentials []WebAuthnCredential `json:"webauthn_credentials,omitempty"`
 
 	vfs              vfs.VFS
 	contextualDomain string
@@ -199,6 +230,21 @@ func (i *Instance) Clone() couchdb.Doc {
 
 	cloned.CLISecret = make([]byte, len(i.CLISecret))
 	copy(cloned.CLISecret, i.CLISecret)
+
+	if i.WrappedFilesKey != nil {
+		cloned.WrappedFilesKey = make([]byte, len(i.WrappedFilesKey))
+		copy(cloned.WrappedFilesKey, i.WrappedFilesKey)
+	}
+
+	if i.RecoveryCodes != nil {
+		cloned.RecoveryCodes = make([]string, len(i.RecoveryCodes))
+		copy(cloned.RecoveryCodes, i.RecoveryCodes)
+	}
+
+	if i.WebAuthnCredentials != nil {
+		cloned.WebAuthnCredentials = make([]WebAuthnCredential, len(i.WebAuthnCredentials))
+		copy(cloned.WebAuthnCredentials, i.WebAuthnCredentials)
+	}
 	return &cloned
 }
 
@@ -234,30 +280,39 @@ func (i *Instance) makeVFS() error {
 	if i.vfs != nil {
 		return nil
 	}
-	fsURL := config.FsURL()
+	var err error
+	i.vfs, err = i.vfsOn(i.StorageURL())
+	return err
+}
+
+func (i *Instance) vfsOn(fsURL *url.URL) (vfs.VFS, error) {
 	mutex := lock.ReadWrite(i, "vfs")
 	index := vfs.NewCouchdbIndexer(i)
 	disk := vfs.DiskThresholder(i)
-	var err error
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
-		i.vfs, err = vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
+		return vfsafero.New(i, index, disk, mutex, fsURL, i.DirName())
 	case config.SchemeSwift:
+		c := config.SwiftConnectionFor(fsURL)
 		if i.SwiftCluster > 0 {
-			i.vfs, err = vfsswift.NewV2(i, index, disk, mutex)
-		} else {
-			i.vfs, err = vfsswift.New(i, index, disk, mutex)
+			return vfsswift.NewV2(i, index, disk, mutex, c)
 		}
+		return vfsswift.New(i, index, disk, mutex, c)
+	case config.SchemeS3:
+		client, bucket := config.S3ClientFor(fsURL)
+		return vfss3.New(i, index, disk, mutex, client, bucket)
 	default:
-		err = fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
+		return nil, fmt.Errorf("instance: unknown storage provider %s", fsURL.Scheme)
 	}
-	return err
 }
 
 // AppsCopier returns the application copier associated with the specified
 // application type
 func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
-	fsURL := config.FsURL()
+	return i.appsCopierOn(i.StorageURL(), appsType)
+}
+
+func (i *Instance) appsCopierOn(fsURL *url.URL, appsType apps.AppType) apps.Copier {
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
 		var baseDirName string
@@ -271,7 +326,10 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 			path.Join(fsURL.Path, i.DirName(), baseDirName))
 		return apps.NewAferoCopier(baseFS)
 	case config.SchemeSwift:
-		return apps.NewSwiftCopier(config.GetSwiftConnection(), appsType)
+		return apps.NewSwiftCopier(config.SwiftConnectionFor(fsURL), appsType)
+	case config.SchemeS3:
+		client, bucket := config.S3ClientFor(fsURL)
+		return vfss3.NewAppsCopier(client, bucket, appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -280,30 +338,30 @@ func (i *Instance) AppsCopier(appsType apps.AppType) apps.Copier {
 // AppsFileServer returns the web-application file server associated to this
 // instance.
 func (i *Instance) AppsFileServer() apps.FileServer {
-	fsURL := config.FsURL()
-	switch fsURL.Scheme {
-	case config.SchemeFile, config.SchemeMem:
-		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
-			path.Join(fsURL.Path, i.DirName(), vfs.WebappsDirName))
-		return apps.NewAferoFileServer(baseFS, nil)
-	case config.SchemeSwift:
-		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Webapp)
-	default:
-		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
-	}
+	return i.fileServerOn(i.StorageURL(), apps.Webapp)
 }
 
 // KonnectorsFileServer returns the web-application file server associated to this
 // instance.
 func (i *Instance) KonnectorsFileServer() apps.FileServer {
-	fsURL := config.FsURL()
+	return i.fileServerOn(i.StorageURL(), apps.Konnector)
+}
+
+func (i *Instance) fileServerOn(fsURL *url.URL, appsType apps.AppType) apps.FileServer {
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
+		baseDirName := vfs.WebappsDirName
+		if appsType == apps.Konnector {
+			baseDirName = vfs.KonnectorsDirName
+		}
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
-			path.Join(fsURL.Path, i.DirName(), vfs.KonnectorsDirName))
+			path.Join(fsURL.Path, i.DirName(), baseDirName))
 		return apps.NewAferoFileServer(baseFS, nil)
 	case config.SchemeSwift:
-		return apps.NewSwiftFileServer(config.GetSwiftConnection(), apps.Konnector)
+		return apps.NewSwiftFileServer(config.SwiftConnectionFor(fsURL), appsType)
+	case config.SchemeS3:
+		client, bucket := config.S3ClientFor(fsURL)
+		return vfss3.NewAppsFileServer(client, bucket, appsType)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -312,17 +370,21 @@ func (i *Instance) KonnectorsFileServer() apps.FileServer {
 // ThumbsFS returns the hidden filesystem for storing the thumbnails of the
 // photos/image
 func (i *Instance) ThumbsFS() vfs.Thumbser {
-	fsURL := config.FsURL()
+	fsURL := i.StorageURL()
 	switch fsURL.Scheme {
 	case config.SchemeFile, config.SchemeMem:
 		baseFS := afero.NewBasePathFs(afero.NewOsFs(),
 			path.Join(fsURL.Path, i.DirName(), vfs.ThumbsDirName))
 		return vfsafero.NewThumbsFs(baseFS)
 	case config.SchemeSwift:
+		c := config.SwiftConnectionFor(fsURL)
 		if i.SwiftCluster > 0 {
-			return vfsswift.NewThumbsFsV2(config.GetSwiftConnection(), i)
+			return vfsswift.NewThumbsFsV2(c, i)
 		}
-		return vfsswift.NewThumbsFs(config.GetSwiftConnection(), i.Domain)
+		return vfsswift.NewThumbsFs(c, i.Domain)
+	case config.SchemeS3:
+		client, bucket := config.S3ClientFor(fsURL)
+		return vfss3.NewThumbsFs(client, bucket, i)
 	default:
 		panic(fmt.Sprintf("instance: unknown storage provider %s", fsURL.Scheme))
 	}
@@ -415,6 +477,35 @@ func (i *Instance) DiskQuota() int64 {
 	return i.BytesDiskQuota
 }
 
+// JobsWeight returns the weight of the instance for the fair scheduling of the
+// jobs between the instances, as configured for its context. It implements
+// the jobs.Weighter interface.
+func (i *Instance) JobsWeight() int {
+	weights := config.GetConfig().Jobs.Weights
+	var weight int
+	var ok bool
+	if i.ContextName != "" {
+		weight, ok = weights[i.ContextName]
+	}
+	if !ok {
+		weight, ok = weights["default"]
+	}
+	if !ok || weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// JobsWeightOf returns the weight of the instance of the given prefixer, for
+// the jobs pushed with a prefixer that is not an instance.
+func JobsWeightOf(db prefixer.Prefixer) int {
+	i, err := Get(db.DomainName())
+	if err != nil {
+		return 1
+	}
+	return i.JobsWeight()
+}
+
 // WithContextualDomain the current instance context with the given hostname.
 func (i *Instance) WithContextualDomain(domain string) *Instance {
 	if i.HasDomain(domain) {
@@ -671,6 +762,13 @@ func CreateWithoutHooks(opts *Options) (*Instance, error) {
 	i.SessionSecret = crypto.GenerateRandomBytes(SessionSecretLen)
 	i.OAuthSecret = crypto.GenerateRandomBytes(OauthSecretLen)
 	i.CLISecret = crypto.GenerateRandomBytes(OauthSecretLen)
+	if config.GetVault().FilesMasterKey() != nil {
+		if err = i.generateFilesKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	i.Storage = config.StorageID(config.FsURL())
 
 	// If not cluster number is given, we rely on cluster one.
 	if opts.SwiftCluster == 0 {
@@ -1185,6 +1283,10 @@ func DestroyWithoutHooks(domain string) error {
 		i.Logger().Errorf("Could not delete VFS: %s", err.Error())
 	}
 
+	if err = search.DeleteIndex(i); err != nil {
+		i.Logger().Errorf("Could not delete the search index: %s", err.Error())
+	}
+
 	return couchdb.DeleteDoc(couchdb.GlobalDB, i)
 }
 
@@ -1361,8 +1463,8 @@ func (i *Instance) UpdatePassphrase(pass, current []byte, twoFactorPasscode stri
 	// With two factor authentication, we do not check the validity of the
 	// current passphrase, but the validity of the pair passcode/token which has
 	// been exchanged against the current passphrase.
-	if i.HasAuthMode(TwoFactorMail) {
-		if !i.ValidateTwoFactorPasscode(twoFactorToken, twoFactorPasscode) {
+	if i.HasTwoFactor() {
+		if !i.ValidateTwoFactor(twoFactorToken, twoFactorPasscode) {
 			return ErrInvalidTwoFactor
 		}
 	} else {
@@ -1423,7 +1525,8 @@ func (i *Instance) PickKey(audience string) ([]byte, error) {
 		return i.SessionSecret, nil
 	case permissions.RefreshTokenAudience,
 		permissions.AccessTokenAudience,
-		permissions.ShareAudience:
+		permissions.ShareAudience,
+		permissions.UnlockedShareAudience:
 		return i.OAuthSecret, nil
 	case permissions.CLIAudience:
 		return i.CLISecret, nil
@@ -15,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/stack"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/stretchr/testify/assert"
@@ -486,6 +487,44 @@ func TestCheckTOSNotSigned(t *testing.T) {
 	assert.Equal(t, instance.TOSNone, deadline)
 }
 
+func TestAddMissingTriggers(t *testing.T) {
+	inst, err := instance.Get("test.cozycloud.cc")
+	if !assert.NoError(t, err) {
+		return
+	}
+	count, err := instance.AddMissingTriggers(inst)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	sched := jobs.System()
+	triggers, err := sched.GetAllTriggers(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// The instances created before the revocation of the tokens don't have
+	// the trigger that cleans the revocation list
+	removed := map[string]bool{"clean-uploads": true, "clean-revoked-tokens": true}
+	for _, trigger := range triggers {
+		if removed[trigger.Infos().WorkerType] {
+			assert.NoError(t, sched.DeleteTrigger(inst, trigger.Infos().TID))
+		}
+	}
+
+	count, err = instance.AddMissingTriggers(inst)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	triggers, err = sched.GetAllTriggers(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+	found := make(map[string]int)
+	for _, trigger := range triggers {
+		found[trigger.Infos().WorkerType]++
+	}
+	assert.Equal(t, 1, found["clean-uploads"])
+	assert.Equal(t, 1, found["clean-revoked-tokens"])
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -0,0 +1,72 @@
+package instance
+
+import (
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// StorageURL returns the URL of the storage where the files of the instance
+// are persisted. It is fs.url, except for the instances that have not been
+// moved yet when fs.previous_url is configured.
+func (i *Instance) StorageURL() *url.URL {
+	if i.OnPreviousStorage() {
+		return config.FsPreviousURL()
+	}
+	return config.FsURL()
+}
+
+// OnPreviousStorage returns true if the files of the instance are still on
+// the storage configured with fs.previous_url, and should be moved to the
+// storage of fs.url. The storages are compared by their full URLs, as they
+// can have the same scheme.
+func (i *Instance) OnPreviousStorage() bool {
+	previous := config.FsPreviousURL()
+	if previous == nil {
+		return false
+	}
+	current := config.FsURL()
+	if i.Storage == config.StorageID(current) {
+		return false
+	}
+	// The older instances have only the scheme of their storage, which is
+	// enough when the two storages have different schemes.
+	return i.Storage != current.Scheme || current.Scheme == previous.Scheme
+}
+
+// NewStorageVFS returns a VFS for the instance on the storage of fs.url. It
+// is used to move the files from the previous storage.
+func (i *Instance) NewStorageVFS() (vfs.VFS, error) {
+	fsURL := config.FsURL()
+	inst := i
+	if fsURL.Scheme == config.SchemeSwift && i.SwiftCluster == 0 {
+		// The files are imported with the swift layout v2
+		cloned := i.Clone().(*Instance)
+		cloned.SwiftCluster = 1
+		inst = cloned
+	}
+	return inst.vfsOn(fsURL)
+}
+
+// NewStorageAppsCopier returns the application copier on the storage of
+// fs.url for the given application type.
+func (i *Instance) NewStorageAppsCopier(appsType apps.AppType) apps.Copier {
+	return i.appsCopierOn(config.FsURL(), appsType)
+}
+
+// CommitNewStorage saves that the files of the instance have been moved to
+// the storage of fs.url.
+func (i *Instance) CommitNewStorage() error {
+	fsURL := config.FsURL()
+	i.Storage = config.StorageID(fsURL)
+	if fsURL.Scheme == config.SchemeSwift && i.SwiftCluster == 0 {
+		i.SwiftCluster = 1
+	}
+	if err := i.update(); err != nil {
+		return err
+	}
+	i.vfs = nil
+	return i.makeVFS()
+}
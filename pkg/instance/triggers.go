@@ -3,12 +3,13 @@ package instance
 import (
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/search"
 )
 
 // Triggers returns the list of the triggers to add when an instance is created
 func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
 	// Create/update/remove thumbnails when an image is created/updated/removed
-	return []jobs.TriggerInfos{
+	triggers := []jobs.TriggerInfos{
 		{
 			Domain:     db.DomainName(),
 			Prefix:     db.DBPrefix(),
@@ -16,5 +17,72 @@ func Triggers(db prefixer.Prefixer) []jobs.TriggerInfos {
 			WorkerType: "thumbnail",
 			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED:image:class",
 		},
+		// Remove the upload sessions that have expired
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@every",
+			WorkerType: "clean-uploads",
+			Arguments:  "24h",
+		},
+		// Remove the revoked tokens that have expired
+		{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@every",
+			WorkerType: "clean-revoked-tokens",
+			Arguments:  "24h",
+		},
+	}
+	// Update the full-text index of the files, when the search is enabled
+	if search.Enabled() {
+		triggers = append(triggers, jobs.TriggerInfos{
+			Domain:     db.DomainName(),
+			Prefix:     db.DBPrefix(),
+			Type:       "@event",
+			WorkerType: "search",
+			Arguments:  "io.cozy.files:CREATED,UPDATED,DELETED",
+		})
+	}
+	return triggers
+}
+
+// AddMissingTriggers creates the triggers of the list returned by Triggers
+// that are missing on the instance, for example because the instance was
+// created before they were added to this list. It returns the number of
+// triggers that have been created.
+func AddMissingTriggers(i *Instance) (int, error) {
+	sched := jobs.System()
+	triggers, err := sched.GetAllTriggers(i)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, infos := range Triggers(i) {
+		if hasTrigger(triggers, infos) {
+			continue
+		}
+		t, err := jobs.NewTrigger(i, infos, nil)
+		if err != nil {
+			return count, err
+		}
+		if err = sched.AddTrigger(t); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// hasTrigger returns true if one of the triggers has the same type and worker
+// as infos. The arguments are not compared, as they may have been changed
+// since the creation of the instance.
+func hasTrigger(triggers []jobs.Trigger, infos jobs.TriggerInfos) bool {
+	for _, t := range triggers {
+		ti := t.Infos()
+		if ti.Type == infos.Type && ti.WorkerType == infos.WorkerType {
+			return true
+		}
 	}
+	return false
 }
@@ -2,12 +2,18 @@ package instance
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
 	"github.com/mssola/user_agent"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
@@ -33,6 +39,26 @@ var trustedDeviceMACConfig = crypto.MACConfig{
 	MaxLen: 256,
 }
 
+var twoFactorMACConfig = crypto.MACConfig{
+	Name:   "two-factor",
+	MaxAge: 10 * time.Minute,
+	MaxLen: 2048,
+}
+
+var totpEnrollmentMACConfig = crypto.MACConfig{
+	Name:   "totp-enrollment",
+	MaxAge: 1 * time.Hour,
+	MaxLen: 256,
+}
+
+// totpPeriod is the duration in seconds of a time step of the authenticator
+// apps.
+const totpPeriod = 30
+
+// recoveryCodesCount is the number of recovery codes generated for the user
+// when a TOTP or WebAuthn second factor is enrolled.
+const recoveryCodesCount = 10
+
 // AuthMode defines the authentication mode chosen for the connection to this
 // instance.
 type AuthMode int
@@ -42,13 +68,62 @@ const (
 	Basic AuthMode = iota
 	// TwoFactorMail authentication mode, with passcode sent via email
 	TwoFactorMail
+	// TwoFactorTOTP authentication mode, with passcode generated by an
+	// authenticator app
+	TwoFactorTOTP
+	// TwoFactorWebAuthn authentication mode, with a security key
+	TwoFactorWebAuthn
 )
 
+const (
+	// TwoFactorMethodMail is the second factor with a passcode sent via email
+	TwoFactorMethodMail = "mail"
+	// TwoFactorMethodTOTP is the second factor with a passcode generated by an
+	// authenticator app
+	TwoFactorMethodTOTP = "totp"
+	// TwoFactorMethodWebAuthn is the second factor with a security key
+	TwoFactorMethodWebAuthn = "webauthn"
+	// TwoFactorMethodRecoveryCode is the second factor with one of the
+	// recovery codes given at the enrollment of the TOTP or WebAuthn factor
+	TwoFactorMethodRecoveryCode = "recovery_code"
+)
+
+// TwoFactorChallenge is the second step of the two-factor authentication, for
+// one of the methods of the instance.
+type TwoFactorChallenge struct {
+	Method string
+	// Token is the proof that the user has entered the correct passphrase. It
+	// must be sent back with the second factor.
+	Token []byte
+	// WebAuthn is the options for the navigator.credentials.get call of the
+	// browser, for the WebAuthn method.
+	WebAuthn *protocol.CredentialAssertion
+}
+
+// TOTPEnrollment is what the user needs for adding the instance in an
+// authenticator app.
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+}
+
+// twoFactorState is the value of the token given after the passphrase step,
+// for the methods other than the mail.
+type twoFactorState struct {
+	Method   string                `json:"method"`
+	WebAuthn *webauthn.SessionData `json:"webauthn,omitempty"`
+}
+
 // AuthModeToString encode authentication mode in a string
 func AuthModeToString(authMode AuthMode) string {
 	switch authMode {
 	case TwoFactorMail:
 		return "two_factor_mail"
+	case TwoFactorTOTP:
+		return "two_factor_totp"
+	case TwoFactorWebAuthn:
+		return "two_factor_webauthn"
 	default:
 		return "basic"
 	}
@@ -60,6 +135,10 @@ func StringToAuthMode(authMode string) (AuthMode, error) {
 	switch authMode {
 	case "two_factor_mail":
 		return TwoFactorMail, nil
+	case "two_factor_totp":
+		return TwoFactorTOTP, nil
+	case "two_factor_webauthn":
+		return TwoFactorWebAuthn, nil
 	case "basic":
 		return Basic, nil
 	default:
@@ -73,6 +152,299 @@ func (i *Instance) HasAuthMode(authMode AuthMode) bool {
 	return i.AuthMode == authMode
 }
 
+// HasTwoFactor returns whether or not the instance has a two-factor
+// authentication mode activated.
+func (i *Instance) HasTwoFactor() bool {
+	return i.AuthMode != Basic
+}
+
+// TwoFactorMethods returns the methods that can be used for the second step
+// of the authentication, the one of the authentication mode first. The mail
+// can be used only if it is the authentication mode, the other methods as
+// soon as they have been enrolled.
+func (i *Instance) TwoFactorMethods() []string {
+	if !i.HasTwoFactor() {
+		return nil
+	}
+	var methods []string
+	switch i.AuthMode {
+	case TwoFactorMail:
+		methods = append(methods, TwoFactorMethodMail)
+	case TwoFactorTOTP:
+		methods = append(methods, TwoFactorMethodTOTP)
+	case TwoFactorWebAuthn:
+		methods = append(methods, TwoFactorMethodWebAuthn)
+	}
+	if i.TOTPSecret != "" && !i.HasAuthMode(TwoFactorTOTP) {
+		methods = append(methods, TwoFactorMethodTOTP)
+	}
+	if len(i.WebAuthnCredentials) > 0 && !i.HasAuthMode(TwoFactorWebAuthn) {
+		methods = append(methods, TwoFactorMethodWebAuthn)
+	}
+	if len(i.RecoveryCodes) > 0 {
+		methods = append(methods, TwoFactorMethodRecoveryCode)
+	}
+	return methods
+}
+
+// BeginTwoFactor starts the second step of the authentication with the given
+// method, after the user has entered the correct passphrase. An empty method
+// means the method of the authentication mode.
+func (i *Instance) BeginTwoFactor(method string) (*TwoFactorChallenge, error) {
+	methods := i.TwoFactorMethods()
+	if len(methods) == 0 {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	if method == "" {
+		method = methods[0]
+	}
+	available := false
+	for _, m := range methods {
+		if m == method {
+			available = true
+		}
+	}
+	if !available {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	challenge := &TwoFactorChallenge{Method: method}
+	if method == TwoFactorMethodMail {
+		token, err := i.SendTwoFactorPasscode()
+		if err != nil {
+			return nil, err
+		}
+		challenge.Token = token
+		return challenge, nil
+	}
+
+	state := twoFactorState{Method: method}
+	if method == TwoFactorMethodWebAuthn {
+		options, session, err := i.beginWebAuthnLogin()
+		if err != nil {
+			return nil, err
+		}
+		challenge.WebAuthn = options
+		state.WebAuthn = session
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	challenge.Token, err = crypto.EncodeAuthMessage(twoFactorMACConfig, i.SessionSecret, value, nil)
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ValidateTwoFactorToken returns true if the given token has been given to
+// the user after the passphrase step, whatever the method.
+func (i *Instance) ValidateTwoFactorToken(token []byte) bool {
+	if _, err := crypto.DecodeAuthMessage(totpMACConfig, i.SessionSecret, token, nil); err == nil {
+		return true
+	}
+	_, ok := i.decodeTwoFactorState(token)
+	return ok
+}
+
+// ValidateTwoFactor validates the second factor given by the user with the
+// token of the passphrase step. The passcode is the code sent by mail, the
+// code of the authenticator app, a recovery code, or the JSON of the
+// assertion of the security key, depending on the method of the token.
+func (i *Instance) ValidateTwoFactor(token []byte, passcode string) bool {
+	if i.HasAuthMode(TwoFactorMail) && i.ValidateTwoFactorPasscode(token, passcode) {
+		return true
+	}
+	state, ok := i.decodeTwoFactorState(token)
+	if !ok {
+		return false
+	}
+	switch state.Method {
+	case TwoFactorMethodTOTP:
+		return i.TOTPSecret != "" && i.validateTOTP(passcode)
+	case TwoFactorMethodRecoveryCode:
+		return i.useRecoveryCode(passcode)
+	case TwoFactorMethodWebAuthn:
+		return state.WebAuthn != nil && i.validateWebAuthnLogin(state.WebAuthn, passcode)
+	}
+	return false
+}
+
+func (i *Instance) decodeTwoFactorState(token []byte) (*twoFactorState, bool) {
+	value, err := crypto.DecodeAuthMessage(twoFactorMACConfig, i.SessionSecret, token, nil)
+	if err != nil {
+		return nil, false
+	}
+	var state twoFactorState
+	if err = json.Unmarshal(value, &state); err != nil {
+		return nil, false
+	}
+	return &state, true
+}
+
+// BeginTOTPEnrollment generates a new secret for an authenticator app. The
+// enrollment is finished when the user sends back the token with a passcode
+// generated by the app.
+func (i *Instance) BeginTOTPEnrollment() (*TOTPEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Cozy",
+		AccountName: i.Domain,
+	})
+	if err != nil {
+		return nil, err
+	}
+	token, err := crypto.EncodeAuthMessage(totpEnrollmentMACConfig, i.SessionSecret, []byte(key.Secret()), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret: key.Secret(),
+		URL:    key.URL(),
+		Token:  string(token),
+	}, nil
+}
+
+// FinishTOTPEnrollment checks the passcode generated by the authenticator
+// app and keeps its secret. If the user had no recovery codes, they are
+// generated and returned.
+func (i *Instance) FinishTOTPEnrollment(token []byte, passcode string) ([]string, error) {
+	secret, err := crypto.DecodeAuthMessage(totpEnrollmentMACConfig, i.SessionSecret, token, nil)
+	if err != nil {
+		return nil, ErrInvalidTwoFactor
+	}
+	step, ok := totpStep(string(secret), passcode, 0)
+	if !ok {
+		return nil, ErrInvalidTwoFactor
+	}
+	i.TOTPSecret = string(secret)
+	i.TOTPLastStep = step
+	codes := i.ensureRecoveryCodes()
+	if err = i.update(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// validateTOTP checks a passcode of the authenticator app. The passcode is
+// refused if a passcode of the same time step, or of a later one, has already
+// been accepted.
+func (i *Instance) validateTOTP(passcode string) bool {
+	step, ok := totpStep(i.TOTPSecret, passcode, i.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	i.TOTPLastStep = step
+	return i.update() == nil
+}
+
+// totpStep returns the time step of the passcode for the secret, if it is
+// after the given step. The step before and the one after the current step
+// are also tried, for the clocks that are not synchronized.
+func totpStep(secret, passcode string, after int64) (int64, bool) {
+	opts := totp.ValidateOpts{
+		Period:    totpPeriod,
+		Skew:      0,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+	current := time.Now().Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if step <= after {
+			continue
+		}
+		at := time.Unix(step*totpPeriod, 0).UTC()
+		if ok, err := totp.ValidateCustom(passcode, secret, at, opts); ok && err == nil {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// RemoveTOTP removes the authenticator app of the second factors.
+func (i *Instance) RemoveTOTP() error {
+	if i.TOTPSecret == "" {
+		return ErrTwoFactorNotEnrolled
+	}
+	if i.HasAuthMode(TwoFactorTOTP) {
+		return ErrTwoFactorInUse
+	}
+	i.TOTPSecret = ""
+	i.TOTPLastStep = 0
+	i.clearRecoveryCodes()
+	return i.update()
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user by new
+// ones, and returns them.
+func (i *Instance) RegenerateRecoveryCodes() ([]string, error) {
+	if i.TOTPSecret == "" && len(i.WebAuthnCredentials) == 0 {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+	codes, hashes := generateRecoveryCodes()
+	i.RecoveryCodes = hashes
+	if err := i.update(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ensureRecoveryCodes generates the recovery codes if the user has none, and
+// returns them. The caller is responsible for saving the instance.
+func (i *Instance) ensureRecoveryCodes() []string {
+	if len(i.RecoveryCodes) > 0 {
+		return nil
+	}
+	codes, hashes := generateRecoveryCodes()
+	i.RecoveryCodes = hashes
+	return codes
+}
+
+// clearRecoveryCodes removes the recovery codes when there is no longer a
+// second factor that they can replace.
+func (i *Instance) clearRecoveryCodes() {
+	if i.TOTPSecret == "" && len(i.WebAuthnCredentials) == 0 {
+		i.RecoveryCodes = nil
+	}
+}
+
+// useRecoveryCode checks the given recovery code, and removes it from the
+// recovery codes of the user if it is valid.
+func (i *Instance) useRecoveryCode(code string) bool {
+	hash := []byte(hashRecoveryCode(code))
+	for k, h := range i.RecoveryCodes {
+		if subtle.ConstantTimeCompare(hash, []byte(h)) == 1 {
+			i.RecoveryCodes = append(i.RecoveryCodes[:k], i.RecoveryCodes[k+1:]...)
+			if err := i.update(); err != nil {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// generateRecoveryCodes returns new recovery codes, formatted for the user,
+// and their hashes, to be kept in the instance.
+func generateRecoveryCodes() (codes []string, hashes []string) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for k := 0; k < recoveryCodesCount; k++ {
+		code := strings.ToLower(encoding.EncodeToString(crypto.GenerateRandomBytes(8)))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// hashRecoveryCode returns the hash of a recovery code. The codes are random,
+// so a simple hash is enough to protect them.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.Replace(code, "-", "", -1)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
 // GenerateTwoFactorSecrets generates a (token, passcode) pair that can be
 // used as a two factor authentication secret value. The token is used to allow
 // the two-factor form — meaning the user has correctly entered its passphrase
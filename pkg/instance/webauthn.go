@@ -0,0 +1,216 @@
+package instance
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/duo-labs/webauthn/protocol"
+	"github.com/duo-labs/webauthn/webauthn"
+)
+
+var webAuthnRegistrationMACConfig = crypto.MACConfig{
+	Name:   "webauthn-registration",
+	MaxAge: 10 * time.Minute,
+	MaxLen: 2048,
+}
+
+// WebAuthnCredential is a security key registered for the two-factor
+// authentication with WebAuthn.
+type WebAuthnCredential struct {
+	ID              []byte    `json:"id"`
+	Name            string    `json:"name,omitempty"`
+	PublicKey       []byte    `json:"public_key"`
+	AttestationType string    `json:"attestation_type,omitempty"`
+	AAGUID          []byte    `json:"aaguid,omitempty"`
+	SignCount       uint32    `json:"sign_count"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// WebAuthnRegistration is what the browser needs to register a new security
+// key. The token must be sent back with the new credential.
+type WebAuthnRegistration struct {
+	Token   string                       `json:"token"`
+	Options *protocol.CredentialCreation `json:"options"`
+}
+
+// webAuthnUser is the owner of the instance, as a user of the webauthn
+// library.
+type webAuthnUser struct {
+	inst *Instance
+}
+
+func (u webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.inst.DocID)
+}
+
+func (u webAuthnUser) WebAuthnName() string {
+	return u.inst.Domain
+}
+
+func (u webAuthnUser) WebAuthnDisplayName() string {
+	name, err := u.inst.PublicName()
+	if err != nil || name == "" {
+		return u.inst.Domain
+	}
+	return name
+}
+
+func (u webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, len(u.inst.WebAuthnCredentials))
+	for k, c := range u.inst.WebAuthnCredentials {
+		creds[k] = webauthn.Credential{
+			ID:              c.ID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+	}
+	return creds
+}
+
+// webAuthn returns the relying party for the security keys of the instance.
+// The keys are bound to the domain used by the current request.
+func (i *Instance) webAuthn() (*webauthn.WebAuthn, error) {
+	origin := i.PageURL("", nil)
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: "Cozy",
+		RPID:          u.Hostname(),
+		RPOrigin:      origin,
+	})
+}
+
+// BeginWebAuthnRegistration starts the registration of a new security key.
+func (i *Instance) BeginWebAuthnRegistration() (*WebAuthnRegistration, error) {
+	w, err := i.webAuthn()
+	if err != nil {
+		return nil, err
+	}
+	options, session, err := w.BeginRegistration(webAuthnUser{i})
+	if err != nil {
+		return nil, err
+	}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	token, err := crypto.EncodeAuthMessage(webAuthnRegistrationMACConfig, i.SessionSecret, value, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnRegistration{
+		Token:   string(token),
+		Options: options,
+	}, nil
+}
+
+// FinishWebAuthnRegistration checks the credential created by the security
+// key and keeps it. If the user had no recovery codes, they are generated and
+// returned.
+func (i *Instance) FinishWebAuthnRegistration(token []byte, name string, credential []byte) (*WebAuthnCredential, []string, error) {
+	value, err := crypto.DecodeAuthMessage(webAuthnRegistrationMACConfig, i.SessionSecret, token, nil)
+	if err != nil {
+		return nil, nil, ErrInvalidTwoFactor
+	}
+	var session webauthn.SessionData
+	if err = json.Unmarshal(value, &session); err != nil {
+		return nil, nil, ErrInvalidTwoFactor
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(credential))
+	if err != nil {
+		return nil, nil, ErrInvalidTwoFactor
+	}
+	w, err := i.webAuthn()
+	if err != nil {
+		return nil, nil, err
+	}
+	created, err := w.CreateCredential(webAuthnUser{i}, session, parsed)
+	if err != nil {
+		return nil, nil, ErrInvalidTwoFactor
+	}
+	for _, c := range i.WebAuthnCredentials {
+		if bytes.Equal(c.ID, created.ID) {
+			return nil, nil, ErrInvalidTwoFactor
+		}
+	}
+
+	cred := WebAuthnCredential{
+		ID:              created.ID,
+		Name:            name,
+		PublicKey:       created.PublicKey,
+		AttestationType: created.AttestationType,
+		AAGUID:          created.Authenticator.AAGUID,
+		SignCount:       created.Authenticator.SignCount,
+		CreatedAt:       time.Now().UTC(),
+	}
+	i.WebAuthnCredentials = append(i.WebAuthnCredentials, cred)
+	codes := i.ensureRecoveryCodes()
+	if err = i.update(); err != nil {
+		return nil, nil, err
+	}
+	return &cred, codes, nil
+}
+
+// RemoveWebAuthnCredential removes a security key of the second factors.
+func (i *Instance) RemoveWebAuthnCredential(id []byte) error {
+	for k, c := range i.WebAuthnCredentials {
+		if !bytes.Equal(c.ID, id) {
+			continue
+		}
+		if i.HasAuthMode(TwoFactorWebAuthn) && len(i.WebAuthnCredentials) == 1 {
+			return ErrTwoFactorInUse
+		}
+		i.WebAuthnCredentials = append(i.WebAuthnCredentials[:k], i.WebAuthnCredentials[k+1:]...)
+		i.clearRecoveryCodes()
+		return i.update()
+	}
+	return ErrTwoFactorNotEnrolled
+}
+
+func (i *Instance) beginWebAuthnLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	w, err := i.webAuthn()
+	if err != nil {
+		return nil, nil, err
+	}
+	return w.BeginLogin(webAuthnUser{i})
+}
+
+// validateWebAuthnLogin checks the assertion of a security key, and updates
+// its signature counter.
+func (i *Instance) validateWebAuthnLogin(session *webauthn.SessionData, assertion string) bool {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(strings.NewReader(assertion))
+	if err != nil {
+		return false
+	}
+	w, err := i.webAuthn()
+	if err != nil {
+		return false
+	}
+	cred, err := w.ValidateLogin(webAuthnUser{i}, *session, parsed)
+	if err != nil || cred.Authenticator.CloneWarning {
+		return false
+	}
+	for k, c := range i.WebAuthnCredentials {
+		if bytes.Equal(c.ID, cred.ID) {
+			i.WebAuthnCredentials[k].SignCount = cred.Authenticator.SignCount
+		}
+	}
+	if err = i.update(); err != nil {
+		i.Logger().Errorf("Could not update the signature counter of a security key: %s", err)
+	}
+	return true
+}
@@ -46,6 +46,9 @@ type (
 		// WorkerQueueLen returns the total element in the queue of the specified
 		// worker type.
 		WorkerQueueLen(workerType string) (int, error)
+		// WorkerQueueLenByDomain returns the number of pending jobs of each
+		// instance, by domain, in the queue of the specified worker type.
+		WorkerQueueLenByDomain(workerType string) (map[string]int, error)
 		// WorkersTypes returns the list of registered workers types.
 		WorkersTypes() []string
 	}
@@ -79,6 +82,11 @@ type (
 		FinishedAt  time.Time   `json:"finished_at"`
 		Error       string      `json:"error,omitempty"`
 		ForwardLogs bool        `json:"forward_logs,omitempty"`
+
+		// WorkflowID and WorkflowStep are set when the job has been pushed
+		// for a step of a workflow.
+		WorkflowID   string `json:"workflow_id,omitempty"`
+		WorkflowStep string `json:"workflow_step,omitempty"`
 	}
 
 	// JobRequest struct is used to represent a new job request.
@@ -93,6 +101,9 @@ type (
 		ForwardLogs bool
 		Admin       bool
 		Options     *JobOptions
+
+		WorkflowID   string
+		WorkflowStep string
 	}
 
 	// JobOptions struct contains the execution properties of the jobs.
@@ -265,6 +276,9 @@ func NewJob(db prefixer.Prefixer, req *JobRequest) *Job {
 		ForwardLogs: req.ForwardLogs,
 		State:       Queued,
 		QueuedAt:    time.Now(),
+
+		WorkflowID:   req.WorkflowID,
+		WorkflowStep: req.WorkflowStep,
 	}
 }
 
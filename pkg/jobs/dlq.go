@@ -0,0 +1,254 @@
+package jobs
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/metrics"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/sirupsen/logrus"
+)
+
+// maxDeadLetterLogs is the maximal number of log entries of a job kept in its
+// dead letter.
+const maxDeadLetterLogs = 50
+
+type (
+	// DeadLetter is a job that has failed after all its executions. It is kept
+	// in the dead-letter queue of its worker type, to be inspected and
+	// replayed.
+	DeadLetter struct {
+		DocID      string          `json:"_id,omitempty"`
+		DocRev     string          `json:"_rev,omitempty"`
+		Domain     string          `json:"domain"`
+		Prefix     string          `json:"prefix,omitempty"`
+		WorkerType string          `json:"worker"`
+		JobID      string          `json:"job_id"`
+		TriggerID  string          `json:"trigger_id,omitempty"`
+		Message    Message         `json:"message"`
+		Event      Event           `json:"event,omitempty"`
+		Options    *JobOptions     `json:"options,omitempty"`
+		Attempts   int             `json:"attempts"`
+		Error      string          `json:"error"`
+		Logs       []DeadLetterLog `json:"logs,omitempty"`
+		QueuedAt   time.Time       `json:"queued_at"`
+		FailedAt   time.Time       `json:"failed_at"`
+	}
+
+	// DeadLetterLog is a log entry of the job of a dead letter.
+	DeadLetterLog struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"message"`
+	}
+
+	// logsRecorder is a logrus hook that keeps the last log entries of a job,
+	// for its dead letter.
+	logsRecorder struct {
+		mu   sync.Mutex
+		logs []DeadLetterLog
+	}
+)
+
+// ID implements the couchdb.Doc interface
+func (d *DeadLetter) ID() string { return d.DocID }
+
+// Rev implements the couchdb.Doc interface
+func (d *DeadLetter) Rev() string { return d.DocRev }
+
+// DocType implements the couchdb.Doc interface
+func (d *DeadLetter) DocType() string { return consts.JobsDeadLetters }
+
+// SetID implements the couchdb.Doc interface
+func (d *DeadLetter) SetID(id string) { d.DocID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (d *DeadLetter) SetRev(rev string) { d.DocRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (d *DeadLetter) Clone() couchdb.Doc {
+	cloned := *d
+	if d.Options != nil {
+		tmp := *d.Options
+		cloned.Options = &tmp
+	}
+	if d.Message != nil {
+		cloned.Message = make(Message, len(d.Message))
+		copy(cloned.Message, d.Message)
+	}
+	if d.Event != nil {
+		cloned.Event = make(Event, len(d.Event))
+		copy(cloned.Event, d.Event)
+	}
+	cloned.Logs = make([]DeadLetterLog, len(d.Logs))
+	copy(cloned.Logs, d.Logs)
+	return &cloned
+}
+
+// Match implements the permissions.Matcher interface
+func (d *DeadLetter) Match(key, value string) bool {
+	switch key {
+	case WorkerType:
+		return d.WorkerType == value
+	}
+	return false
+}
+
+func (r *logsRecorder) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.InfoLevel,
+		logrus.WarnLevel,
+		logrus.ErrorLevel,
+		logrus.FatalLevel,
+		logrus.PanicLevel,
+	}
+}
+
+func (r *logsRecorder) Fire(entry *logrus.Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.logs) >= maxDeadLetterLogs {
+		r.logs = r.logs[1:]
+	}
+	r.logs = append(r.logs, DeadLetterLog{
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+	})
+	return nil
+}
+
+func (r *logsRecorder) entries() []DeadLetterLog {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logs := make([]DeadLetterLog, len(r.logs))
+	copy(logs, r.logs)
+	return logs
+}
+
+// addDeadLetter puts a job that has failed in the dead-letter queue of its
+// worker type, after its last execution: when all its tries have failed, or
+// when its error can't be retried.
+func addDeadLetter(job *Job, attempts int, errRun error, logs []DeadLetterLog) {
+	d := &DeadLetter{
+		Domain:     job.Domain,
+		Prefix:     job.Prefix,
+		WorkerType: job.WorkerType,
+		JobID:      job.ID(),
+		TriggerID:  job.TriggerID,
+		Message:    job.Message,
+		Event:      job.Event,
+		Options:    job.Options,
+		Attempts:   attempts,
+		Error:      errRun.Error(),
+		Logs:       logs,
+		QueuedAt:   job.QueuedAt,
+		FailedAt:   time.Now(),
+	}
+	if err := couchdb.CreateDoc(job, d); err != nil {
+		job.Logger().Errorf("Could not add the job to the dead-letter queue: %s", err)
+		return
+	}
+	metrics.WorkerDLQCounter.WithLabelValues(job.WorkerType, metrics.WorkerDLQAdded).Inc()
+}
+
+// DefaultDeadLettersLimit is the default number of dead letters returned by
+// a page of a dead-letter queue.
+const DefaultDeadLettersLimit = 100
+
+// GetDeadLetters returns a page of the dead letters of an instance. If
+// workerType is not empty, only the dead letters of this worker type are
+// returned, from the oldest to the newest. Else, they are sorted by worker
+// type, and then by date.
+func GetDeadLetters(db prefixer.Prefixer, workerType string, cursor couchdb.Cursor) ([]*DeadLetter, error) {
+	req := &couchdb.ViewRequest{IncludeDocs: true}
+	if workerType != "" {
+		req.StartKey = []interface{}{workerType}
+		req.EndKey = []interface{}{workerType, map[string]interface{}{}}
+	}
+	cursor.ApplyTo(req)
+
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.DeadLettersByWorkerView, req, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*DeadLetter{}, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	letters := make([]*DeadLetter, len(res.Rows))
+	for i, row := range res.Rows {
+		var d DeadLetter
+		if err := json.Unmarshal(row.Doc, &d); err != nil {
+			return nil, err
+		}
+		letters[i] = &d
+	}
+	return letters, nil
+}
+
+// GetDeadLetter returns the dead letter with the given identifier.
+func GetDeadLetter(db prefixer.Prefixer, id string) (*DeadLetter, error) {
+	var d DeadLetter
+	if err := couchdb.GetDoc(db, consts.JobsDeadLetters, id, &d); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrNotFoundDeadLetter
+		}
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ReplayDeadLetter removes a dead letter from its queue, and pushes again its
+// job. The admin flag is needed for the workers that are only available to
+// the administrators.
+func ReplayDeadLetter(b Broker, db prefixer.Prefixer, d *DeadLetter, admin bool) (*Job, error) {
+	// The dead letter is deleted first, so that it can't be replayed twice
+	if err := couchdb.DeleteDoc(db, d); err != nil {
+		return nil, err
+	}
+	job, err := b.PushJob(db, &JobRequest{
+		WorkerType: d.WorkerType,
+		TriggerID:  d.TriggerID,
+		Message:    d.Message,
+		Event:      d.Event,
+		Options:    d.Options,
+		Manual:     true,
+		Admin:      admin,
+	})
+	if err != nil {
+		d.SetRev("")
+		if errc := couchdb.CreateNamedDoc(db, d); errc != nil {
+			joblog.Errorf("Could not restore the dead letter %s: %s", d.ID(), errc)
+		}
+		return nil, err
+	}
+	metrics.WorkerDLQCounter.WithLabelValues(d.WorkerType, metrics.WorkerDLQReplayed).Inc()
+	return job, nil
+}
+
+// PurgeDeadLetters deletes the given dead letters.
+func PurgeDeadLetters(db prefixer.Prefixer, letters []*DeadLetter) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	docs := make([]couchdb.Doc, len(letters))
+	for i, d := range letters {
+		docs[i] = d
+	}
+	if err := couchdb.BulkDeleteDocs(db, consts.JobsDeadLetters, docs); err != nil {
+		return err
+	}
+	for _, d := range letters {
+		metrics.WorkerDLQCounter.WithLabelValues(d.WorkerType, metrics.WorkerDLQPurged).Inc()
+	}
+	return nil
+}
+
+var _ permissions.Matcher = (*DeadLetter)(nil)
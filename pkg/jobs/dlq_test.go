@@ -0,0 +1,132 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogsRecorder(t *testing.T) {
+	r := &logsRecorder{}
+	logger := logrus.New()
+	logger.Hooks.Add(r)
+	logger.Out = ioutil.Discard
+	logger.Level = logrus.DebugLevel
+
+	logger.Debug("not recorded")
+	for i := 0; i < maxDeadLetterLogs+10; i++ {
+		logger.Infof("log %d", i)
+	}
+	logs := r.entries()
+	assert.Len(t, logs, maxDeadLetterLogs)
+	assert.Equal(t, "log 10", logs[0].Message)
+	assert.Equal(t, fmt.Sprintf("log %d", maxDeadLetterLogs+9), logs[len(logs)-1].Message)
+	assert.Equal(t, "info", logs[0].Level)
+}
+
+func TestDeadLetterQueue(t *testing.T) {
+	calls := make(chan string, 10)
+	broker := NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(WorkersList{
+		{
+			WorkerType:   "dlq",
+			Concurrency:  1,
+			MaxExecCount: 2,
+			RetryDelay:   time.Millisecond,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				var msg string
+				if err := ctx.UnmarshalMessage(&msg); err != nil {
+					return err
+				}
+				ctx.Logger().Warnf("trying %s", msg)
+				calls <- msg
+				if msg == "fail" {
+					return errors.New("always failing")
+				}
+				return nil
+			},
+		},
+	}))
+
+	fail, _ := NewMessage("fail")
+	_, err := broker.PushJob(localDB, &JobRequest{WorkerType: "dlq", Message: fail})
+	assert.NoError(t, err)
+	assert.Equal(t, "fail", <-calls)
+	assert.Equal(t, "fail", <-calls)
+
+	var letters []*DeadLetter
+	for i := 0; i < 50; i++ {
+		letters, err = GetDeadLetters(localDB, "dlq", couchdb.NewSkipCursor(10, 0))
+		assert.NoError(t, err)
+		if len(letters) > 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if assert.Len(t, letters, 1) {
+		d := letters[0]
+		assert.Equal(t, 2, d.Attempts)
+		assert.Equal(t, "always failing", d.Error)
+		assert.NotEmpty(t, d.Logs)
+		assert.NoError(t, PurgeDeadLetters(localDB, letters))
+	}
+
+	letters, err = GetDeadLetters(localDB, "dlq", couchdb.NewSkipCursor(10, 0))
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
+
+func TestDeadLetterQueueNoRetry(t *testing.T) {
+	calls := make(chan string, 10)
+	broker := NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(WorkersList{
+		{
+			WorkerType:   "dlq-noretry",
+			Concurrency:  1,
+			MaxExecCount: 5,
+			RetryDelay:   time.Millisecond,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				calls <- "called"
+				ctx.SetNoRetry()
+				return errors.New("not retried")
+			},
+		},
+		{
+			WorkerType:   "dlq-badtrigger",
+			Concurrency:  1,
+			MaxExecCount: 5,
+			RetryDelay:   time.Millisecond,
+			WorkerFunc: func(ctx *WorkerContext) error {
+				calls <- "called"
+				return ErrBadTrigger{errors.New("bad trigger")}
+			},
+		},
+	}))
+
+	for _, workerType := range []string{"dlq-noretry", "dlq-badtrigger"} {
+		_, err := broker.PushJob(localDB, &JobRequest{WorkerType: workerType})
+		assert.NoError(t, err)
+		assert.Equal(t, "called", <-calls)
+
+		var letters []*DeadLetter
+		for i := 0; i < 50; i++ {
+			letters, err = GetDeadLetters(localDB, workerType, couchdb.NewSkipCursor(10, 0))
+			assert.NoError(t, err)
+			if len(letters) > 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if assert.Len(t, letters, 1) {
+			assert.Equal(t, 1, letters[0].Attempts)
+			assert.NoError(t, PurgeDeadLetters(localDB, letters))
+		}
+	}
+	assert.Len(t, calls, 0)
+}
@@ -30,6 +30,22 @@ var (
 	ErrNotFoundTrigger = errors.New("Trigger with specified ID does not exist")
 	// ErrMalformedTrigger is used to indicate the trigger is unparsable
 	ErrMalformedTrigger = echo.NewHTTPError(http.StatusBadRequest, "Trigger unparsable")
+
+	// ErrNotFoundDeadLetter is used when the dead letter could not be found
+	ErrNotFoundDeadLetter = errors.New("jobs: dead letter not found")
+	// ErrNotFoundWorkflow is used when the workflow could not be found
+	ErrNotFoundWorkflow = errors.New("jobs: workflow not found")
+	// ErrWorkflowNoSteps is used when a workflow is created without steps
+	ErrWorkflowNoSteps = errors.New("jobs: the workflow has no steps")
+	// ErrWorkflowStepName is used when the steps of a workflow don't have
+	// unique names
+	ErrWorkflowStepName = errors.New("jobs: the steps of the workflow must have unique names")
+	// ErrWorkflowDependency is used when a step depends on an unknown step
+	ErrWorkflowDependency = errors.New("jobs: a step of the workflow depends on an unknown step")
+	// ErrWorkflowCycle is used when the dependencies of the steps have a cycle
+	ErrWorkflowCycle = errors.New("jobs: the dependencies of the workflow have a cycle")
+	// ErrWorkflowFailurePolicy is used for an unknown failure policy
+	ErrWorkflowFailurePolicy = errors.New("jobs: unknown failure policy")
 )
 
 // ErrBadTrigger is an error conveying the information of a trigger that is not
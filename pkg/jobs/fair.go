@@ -0,0 +1,123 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// The brokers share the workers between the instances with a weighted
+// round-robin: each instance with pending jobs for a worker type has its own
+// queue, and when its turn comes, it can have as many jobs taken as its
+// weight before the next instance. The weight of an instance is given by its
+// context, with the jobs.weights parameter of the configuration file.
+//
+// The number of jobs of an instance running at the same time for a worker
+// type can also be limited with the max_per_instance parameter of the worker.
+
+type (
+	// Weighter is implemented by the prefixers that know their weight for the
+	// fair scheduling of the jobs, like the instances.
+	Weighter interface {
+		JobsWeight() int
+	}
+
+	// WeightFunc returns the weight of an instance for the fair scheduling of
+	// the jobs.
+	WeightFunc func(db prefixer.Prefixer) int
+
+	// jobReleaser is implemented by the brokers that need to know when a job
+	// is no longer running, to limit the number of jobs running at the same
+	// time for an instance.
+	jobReleaser interface {
+		releaseJob(job *Job)
+	}
+
+	cachedWeight struct {
+		weight  int
+		expires time.Time
+	}
+)
+
+// weightsCacheTTL is the time during which the weight of an instance is kept
+// in memory, when it is given by the weight function.
+const weightsCacheTTL = 5 * time.Minute
+
+var (
+	weightFunc   WeightFunc
+	weightsCache = make(map[string]cachedWeight)
+	weightsMu    sync.Mutex
+)
+
+// SetWeightFunc sets the function used to know the weight of an instance,
+// when the prefixer of a job is not a Weighter (for example, for the jobs
+// pushed by the triggers).
+func SetWeightFunc(fn WeightFunc) {
+	weightsMu.Lock()
+	defer weightsMu.Unlock()
+	weightFunc = fn
+	weightsCache = make(map[string]cachedWeight)
+}
+
+// instanceWeight returns the weight of the instance of the given prefixer.
+// It is at least 1.
+func instanceWeight(db prefixer.Prefixer) int {
+	if len(config.GetConfig().Jobs.Weights) == 0 {
+		return 1
+	}
+	if w, ok := db.(Weighter); ok {
+		return normalizeWeight(w.JobsWeight())
+	}
+
+	key := db.DBPrefix()
+	weightsMu.Lock()
+	fn := weightFunc
+	cached, ok := weightsCache[key]
+	weightsMu.Unlock()
+	if fn == nil {
+		return 1
+	}
+	if ok && time.Now().Before(cached.expires) {
+		return cached.weight
+	}
+
+	weight := normalizeWeight(fn(db))
+	weightsMu.Lock()
+	weightsCache[key] = cachedWeight{
+		weight:  weight,
+		expires: time.Now().Add(weightsCacheTTL),
+	}
+	weightsMu.Unlock()
+	return weight
+}
+
+func normalizeWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+// maxRetriesDuration is the cap of the time spent between the retries of a
+// job in maxRunningDuration, as the exponential backoff overflows for a large
+// number of executions.
+const maxRetriesDuration = 24 * time.Hour
+
+// maxRunningDuration returns the maximal duration of a job of the worker,
+// with its retries. After this duration, a job is no longer counted in the
+// running jobs of its instance, even if it has not been released (for
+// example, if the stack running it has crashed).
+func maxRunningDuration(c *WorkerConfig) time.Duration {
+	d := time.Duration(c.MaxExecCount) * c.Timeout
+	retries := maxRetriesDuration
+	if c.MaxExecCount < 32 && c.RetryDelay < maxRetriesDuration>>uint(c.MaxExecCount+1) {
+		retries = 2 * c.RetryDelay << uint(c.MaxExecCount)
+	}
+	return d + retries + time.Minute
+}
+
+func toMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
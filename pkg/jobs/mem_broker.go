@@ -14,14 +14,21 @@ import (
 
 type (
 	// memQueue is a queue in-memory implementation of the Queue interface.
+	// The jobs are kept in a list per instance, and the instances are served
+	// with a weighted round-robin.
 	memQueue struct {
-		MaxCapacity int
-		Jobs        chan *Job
-		closed      chan struct{}
+		MaxCapacity    int
+		MaxPerInstance int
+		Jobs           chan *Job
+		closed         chan struct{}
 
-		list *list.List
-		run  bool
-		jmu  sync.RWMutex
+		lists   map[string]*list.List
+		ring    []string
+		weights map[string]int
+		credits map[string]int
+		running map[string]int
+		run     bool
+		jmu     sync.RWMutex
 	}
 
 	// memBroker is an in-memory broker implementation of the Broker interface.
@@ -34,45 +41,110 @@ type (
 )
 
 // newMemQueue creates and a new in-memory queue.
-func newMemQueue(workerType string) *memQueue {
+func newMemQueue(workerType string, maxPerInstance int) *memQueue {
 	return &memQueue{
-		list:   list.New(),
-		Jobs:   make(chan *Job),
-		closed: make(chan struct{}),
+		MaxPerInstance: maxPerInstance,
+		Jobs:           make(chan *Job),
+		closed:         make(chan struct{}),
+		lists:          make(map[string]*list.List),
+		weights:        make(map[string]int),
+		credits:        make(map[string]int),
+		running:        make(map[string]int),
 	}
 }
 
 // Enqueue into the queue
-func (q *memQueue) Enqueue(job *Job) error {
+func (q *memQueue) Enqueue(job *Job, weight int) error {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
-	q.list.PushBack(job.Clone())
-	if !q.run {
+	prefix := job.DBPrefix()
+	l, ok := q.lists[prefix]
+	if !ok {
+		l = list.New()
+		q.lists[prefix] = l
+		q.ring = append(q.ring, prefix)
+	}
+	l.PushBack(job.Clone())
+	q.weights[prefix] = weight
+	q.start()
+	return nil
+}
+
+// start launches the sending of the jobs to the workers if it is not already
+// running. It must be called with the lock held.
+func (q *memQueue) start() {
+	if !q.run && len(q.ring) > 0 {
 		q.run = true
 		go q.send()
 	}
-	return nil
 }
 
 func (q *memQueue) send() {
 	for {
 		q.jmu.Lock()
-		e := q.list.Front()
-		if e == nil || !q.run {
+		if !q.run {
+			q.jmu.Unlock()
+			return
+		}
+		job := q.next()
+		if job == nil {
 			q.run = false
 			q.jmu.Unlock()
 			return
 		}
-		q.list.Remove(e)
 		q.jmu.Unlock()
 		select {
 		case <-q.closed:
 			return
-		case q.Jobs <- e.Value.(*Job):
+		case q.Jobs <- job:
 		}
 	}
 }
 
+// next removes from the queue the next job to execute, or returns nil if
+// there are no jobs that can be executed now. It must be called with the lock
+// held.
+func (q *memQueue) next() *Job {
+	for i := 0; i < len(q.ring); i++ {
+		prefix := q.ring[0]
+		q.ring = q.ring[1:]
+		if q.MaxPerInstance > 0 && q.running[prefix] >= q.MaxPerInstance {
+			q.ring = append(q.ring, prefix)
+			continue
+		}
+
+		l := q.lists[prefix]
+		e := l.Front()
+		l.Remove(e)
+		q.running[prefix]++
+		if l.Len() == 0 {
+			delete(q.lists, prefix)
+			delete(q.weights, prefix)
+			delete(q.credits, prefix)
+		} else if q.credits[prefix]++; q.credits[prefix] >= q.weights[prefix] {
+			delete(q.credits, prefix)
+			q.ring = append(q.ring, prefix)
+		} else {
+			q.ring = append([]string{prefix}, q.ring...)
+		}
+		return e.Value.(*Job)
+	}
+	return nil
+}
+
+// release is called when a job of the queue is no longer running.
+func (q *memQueue) release(job *Job) {
+	q.jmu.Lock()
+	defer q.jmu.Unlock()
+	prefix := job.DBPrefix()
+	if q.running[prefix] <= 1 {
+		delete(q.running, prefix)
+	} else {
+		q.running[prefix]--
+	}
+	q.start()
+}
+
 func (q *memQueue) close() {
 	q.jmu.Lock()
 	defer q.jmu.Unlock()
@@ -87,7 +159,24 @@ func (q *memQueue) close() {
 func (q *memQueue) Len() int {
 	q.jmu.RLock()
 	defer q.jmu.RUnlock()
-	return q.list.Len()
+	count := 0
+	for _, l := range q.lists {
+		count += l.Len()
+	}
+	return count
+}
+
+// LenByDomain returns the number of pending jobs of each instance in the
+// queue.
+func (q *memQueue) LenByDomain() map[string]int {
+	q.jmu.RLock()
+	defer q.jmu.RUnlock()
+	counts := make(map[string]int, len(q.lists))
+	for _, l := range q.lists {
+		job := l.Front().Value.(*Job)
+		counts[job.DomainName()] += l.Len()
+	}
+	return counts
 }
 
 // NewMemBroker creates a new in-memory broker system.
@@ -110,8 +199,9 @@ func (b *memBroker) StartWorkers(ws WorkersList) error {
 		if conf.Concurrency <= 0 {
 			continue
 		}
-		q := newMemQueue(conf.WorkerType)
+		q := newMemQueue(conf.WorkerType, conf.MaxPerInstance)
 		w := NewWorker(conf)
+		w.broker = b
 		b.queues[conf.WorkerType] = q
 		b.workers = append(b.workers, w)
 		if err := w.Start(q.Jobs); err != nil {
@@ -204,7 +294,7 @@ func (b *memBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error)
 	}
 
 	q := b.queues[workerType]
-	if err := q.Enqueue(job); err != nil {
+	if err := q.Enqueue(job, instanceWeight(db)); err != nil {
 		return nil, err
 	}
 	return job, nil
@@ -220,10 +310,27 @@ func (b *memBroker) WorkerQueueLen(workerType string) (int, error) {
 	return q.Len(), nil
 }
 
+// WorkerQueueLenByDomain returns the number of pending jobs of each instance
+// in the queue of the specified worker type.
+func (b *memBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	q, ok := b.queues[workerType]
+	if !ok {
+		return nil, ErrUnknownWorker
+	}
+	return q.LenByDomain(), nil
+}
+
+func (b *memBroker) releaseJob(job *Job) {
+	if q, ok := b.queues[job.WorkerType]; ok {
+		q.release(job)
+	}
+}
+
 func (b *memBroker) WorkersTypes() []string {
 	return b.workersTypes
 }
 
 var (
-	_ Broker = &memBroker{}
+	_ Broker      = &memBroker{}
+	_ jobReleaser = &memBroker{}
 )
@@ -2,6 +2,7 @@ package jobs
 
 import (
 	"encoding/json"
+	"fmt"
 	"strconv"
 	"strings"
 	"sync"
@@ -302,3 +303,80 @@ func TestPanic(t *testing.T) {
 	assert.NoError(t, err)
 	w.Wait()
 }
+
+func newFairTestQueue(maxPerInstance int) *memQueue {
+	q := newMemQueue("test", maxPerInstance)
+	// The jobs are taken with next in the test, not sent to the workers
+	q.run = true
+	return q
+}
+
+func enqueueFairTestJobs(q *memQueue, prefix string, weight, n int) {
+	for i := 0; i < n; i++ {
+		job := &Job{
+			JobID:      fmt.Sprintf("%s-%d", prefix, i),
+			Domain:     prefix + ".cozy.tools",
+			Prefix:     prefix,
+			WorkerType: "test",
+		}
+		q.Enqueue(job, weight)
+	}
+}
+
+func nextPrefixes(q *memQueue, n int) []string {
+	var prefixes []string
+	for i := 0; i < n; i++ {
+		job := q.next()
+		if job == nil {
+			prefixes = append(prefixes, "")
+		} else {
+			prefixes = append(prefixes, job.Prefix)
+		}
+	}
+	return prefixes
+}
+
+func TestMemQueueFairScheduling(t *testing.T) {
+	q := newFairTestQueue(0)
+	enqueueFairTestJobs(q, "a", 1, 4)
+	enqueueFairTestJobs(q, "b", 2, 2)
+	enqueueFairTestJobs(q, "c", 1, 1)
+	assert.Equal(t, 7, q.Len())
+	assert.Equal(t, map[string]int{
+		"a.cozy.tools": 4,
+		"b.cozy.tools": 2,
+		"c.cozy.tools": 1,
+	}, q.LenByDomain())
+
+	assert.Equal(t, []string{"a", "b", "b", "c", "a", "a", "a", ""}, nextPrefixes(q, 8))
+	assert.Equal(t, 0, q.Len())
+}
+
+func TestMemQueueMaxPerInstance(t *testing.T) {
+	q := newFairTestQueue(1)
+	enqueueFairTestJobs(q, "a", 1, 2)
+	enqueueFairTestJobs(q, "b", 1, 1)
+
+	first := q.next()
+	assert.Equal(t, "a", first.Prefix)
+	assert.Equal(t, []string{"b", ""}, nextPrefixes(q, 2))
+	q.release(first)
+	assert.Equal(t, []string{"a", ""}, nextPrefixes(q, 2))
+}
+
+func TestMaxRunningDuration(t *testing.T) {
+	d := maxRunningDuration(&WorkerConfig{
+		MaxExecCount: 3,
+		Timeout:      time.Minute,
+		RetryDelay:   time.Second,
+	})
+	assert.Equal(t, 3*time.Minute+16*time.Second+time.Minute, d)
+
+	// The backoff is capped instead of overflowing
+	d = maxRunningDuration(&WorkerConfig{
+		MaxExecCount: 60,
+		Timeout:      time.Minute,
+		RetryDelay:   time.Hour,
+	})
+	assert.Equal(t, 60*time.Minute+maxRetriesDuration+time.Minute, d)
+}
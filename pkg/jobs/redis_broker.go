@@ -19,8 +19,147 @@ const (
 	redisPrefix = "j/"
 	// redisHighPrioritySuffix suffix is the suffix used for prioritized queue.
 	redisHighPrioritySuffix = "/p0"
+	// redisInstancesInfix is put between the worker type and the prefix of an
+	// instance for the keys of the queues of this instance.
+	redisInstancesInfix = "/i/"
+	// redisRunningSuffix is the suffix of the sorted set of the running jobs
+	// of an instance, with their deadlines as scores.
+	redisRunningSuffix = "/running"
+	// redisMaxWakeTokens is the maximal length of the wake list.
+	redisMaxWakeTokens = 100
+	// redisPopCandidates is the maximal number of instances of the ring that
+	// are tried by a call of the luaPopJob script.
+	redisPopCandidates = 10
 )
 
+// The keys used by the fair scheduling of a worker type have the worker type
+// as hash tag, j/{<worker>}, so that they are on the same node with Redis
+// Cluster. The lua scripts only use the keys given in KEYS:
+//   - j/{<worker>}/ring, the round-robin list of the instances with pending
+//     jobs
+//   - j/{<worker>}/active, the set of the instances in the ring
+//   - j/{<worker>}/weights, the weights of the instances in the ring
+//   - j/{<worker>}/domains, the domains of the instances in the ring
+//   - j/{<worker>}/credits, the number of jobs taken in a row for the
+//     instance at the head of the ring
+//   - j/{<worker>}/wake, the list used to wake up the polling loops
+//   - j/{<worker>}/i/<prefix> and j/{<worker>}/i/<prefix>/p0, the queues of
+//     an instance, and j/{<worker>}/i/<prefix>/running, its running jobs.
+//
+// The j/<worker> and j/<worker>/p0 lists are the queues used before the fair
+// scheduling: they are still polled for the jobs pushed by an older version of
+// the stack.
+type redisFairKeys struct {
+	base    string
+	ring    string
+	active  string
+	weights string
+	domains string
+	credits string
+	wake    string
+}
+
+func newRedisFairKeys(workerType string) redisFairKeys {
+	base := redisPrefix + "{" + workerType + "}"
+	return redisFairKeys{
+		base:    base,
+		ring:    base + "/ring",
+		active:  base + "/active",
+		weights: base + "/weights",
+		domains: base + "/domains",
+		credits: base + "/credits",
+		wake:    base + "/wake",
+	}
+}
+
+// queue returns the key of the main or manual queue of an instance.
+func (k redisFairKeys) queue(prefix string, manual bool) string {
+	queue := k.base + redisInstancesInfix + prefix
+	if manual {
+		queue += redisHighPrioritySuffix
+	}
+	return queue
+}
+
+// running returns the key of the running jobs of an instance.
+func (k redisFairKeys) running(prefix string) string {
+	return k.base + redisInstancesInfix + prefix + redisRunningSuffix
+}
+
+// luaPushJob is the lua script used to push a job in the queue of its
+// instance, and to put the instance in the ring if it is not already here.
+// KEYS are the queue of the instance (main or manual), the ring, the active
+// set, the weights, the domains and the wake list. ARGV are the prefix of the
+// instance, the job identifier, the weight and the domain of the instance,
+// and the index of the last element kept by the LTRIM of the wake list.
+const luaPushJob = `
+redis.call("LPUSH", KEYS[1], ARGV[1] .. "/" .. ARGV[2])
+redis.call("HSET", KEYS[4], ARGV[1], ARGV[3])
+redis.call("HSET", KEYS[5], ARGV[1], ARGV[4])
+if redis.call("SADD", KEYS[3], ARGV[1]) == 1 then
+  redis.call("RPUSH", KEYS[2], ARGV[1])
+end
+redis.call("LPUSH", KEYS[6], "1")
+redis.call("LTRIM", KEYS[6], 0, ARGV[5])
+return 1`
+
+// luaPopJob is the lua script used to take the next job with the weighted
+// round-robin between the instances. The candidates are the instances at the
+// head of the ring, read just before: if the ring has changed, the script
+// returns 1 and the candidates must be read again. The instances that already
+// have the maximal number of running jobs are skipped. KEYS are the ring, the
+// active set, the weights, the domains and the credits, and then for each
+// candidate its main queue, its manual queue and its running jobs. ARGV are
+// the current time and the deadline of the job in milliseconds, the maximal
+// number of running jobs per instance (0 for no limit), "1" to take in
+// priority from the manual queue, and then the prefixes of the candidates.
+const luaPopJob = `
+local max = tonumber(ARGV[3])
+for i = 5, #ARGV do
+  local prefix = ARGV[i]
+  if redis.call("LINDEX", KEYS[1], 0) ~= prefix then
+    return 1
+  end
+  redis.call("LPOP", KEYS[1])
+  local k = 5 + 3 * (i - 5)
+  local queue, queueP0, running = KEYS[k + 1], KEYS[k + 2], KEYS[k + 3]
+  redis.call("ZREMRANGEBYSCORE", running, "-inf", ARGV[1])
+  if max > 0 and redis.call("ZCARD", running) >= max then
+    redis.call("RPUSH", KEYS[1], prefix)
+  else
+    local first, second = queueP0, queue
+    if ARGV[4] ~= "1" then
+      first, second = second, first
+    end
+    local val = redis.call("RPOP", first)
+    if not val then
+      val = redis.call("RPOP", second)
+    end
+    local left = redis.call("LLEN", first) + redis.call("LLEN", second)
+    if left == 0 then
+      redis.call("SREM", KEYS[2], prefix)
+      redis.call("HDEL", KEYS[3], prefix)
+      redis.call("HDEL", KEYS[4], prefix)
+      redis.call("HDEL", KEYS[5], prefix)
+    end
+    if val then
+      redis.call("ZADD", running, ARGV[2], string.sub(val, string.len(prefix) + 2))
+      redis.call("PEXPIREAT", running, ARGV[2])
+      if left > 0 then
+        local weight = tonumber(redis.call("HGET", KEYS[3], prefix) or "1")
+        if redis.call("HINCRBY", KEYS[5], prefix, 1) >= weight then
+          redis.call("HDEL", KEYS[5], prefix)
+          redis.call("RPUSH", KEYS[1], prefix)
+        else
+          redis.call("LPUSH", KEYS[1], prefix)
+        end
+      end
+      return val
+    end
+  end
+end
+return false`
+
 type redisBroker struct {
 	client         redis.UniversalClient
 	workers        []*Worker
@@ -48,6 +187,7 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 	for _, conf := range ws {
 		b.workersTypes = append(b.workersTypes, conf.WorkerType)
 		w := NewWorker(conf)
+		w.broker = b
 		b.workers = append(b.workers, w)
 		if conf.Concurrency <= 0 {
 			continue
@@ -57,7 +197,7 @@ func (b *redisBroker) StartWorkers(ws WorkersList) error {
 		if err := w.Start(ch); err != nil {
 			return err
 		}
-		go b.pollLoop(redisPrefix+conf.WorkerType, ch)
+		go b.pollLoop(w, ch)
 	}
 
 	if len(b.workersRunning) > 0 {
@@ -120,44 +260,43 @@ func (b *redisBroker) ShutdownWorkers(ctx context.Context) error {
 
 var redisBRPopTimeout = 10 * time.Second
 
-func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
+func (b *redisBroker) pollLoop(w *Worker, ch chan<- *Job) {
 	defer func() {
 		b.closed <- struct{}{}
 	}()
 
+	keys := newRedisFairKeys(w.Type)
+	conf := w.defaultedConf(nil)
+	maxDuration := maxRunningDuration(conf)
 	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for {
 		if atomic.LoadUint32(&b.running) == 0 {
 			return
 		}
 
-		// The brpop redis command will always take elements in priority from the
-		// first key containing elements at the call. By always priorizing the
-		// manual queue, this would cause a starvation for our main queue if too
-		// many "manual" jobs are pushed. By randomizing the order we make sure we
-		// avoid such starvation. For one in three call, the main queue is
-		// selected.
-		keyP0 := key + redisHighPrioritySuffix
-		keyP1 := key
-		if rng.Intn(3) == 0 {
-			keyP1, keyP0 = keyP0, keyP1
+		// Always taking in priority from the manual queue of an instance would
+		// cause a starvation of its main queue if too many "manual" jobs are
+		// pushed. By randomizing the order we make sure we avoid such
+		// starvation. For one in three call, the main queue is selected.
+		p0First := rng.Intn(3) != 0
+		res, err := b.popJob(keys, maxDuration, conf.MaxPerInstance, p0First)
+		if err == redis.Nil {
+			res, err = b.popLegacyJob(redisPrefix+w.Type, p0First)
 		}
-		results, err := b.client.BRPop(redisBRPopTimeout, keyP0, keyP1).Result()
-		if err != nil || len(results) < 2 {
-			time.Sleep(100 * time.Millisecond)
+		if err == redis.Nil {
+			// Nothing to do for the moment: wait for a new job, or for a
+			// running job of a capped instance to finish.
+			b.client.BRPop(redisBRPopTimeout, keys.wake)
 			continue
 		}
-
-		key := results[0]
-		val := results[1]
-		if len(key) < len(redisPrefix) {
-			joblog.Warnf("Invalid key %s", key)
+		if err != nil {
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
 
-		parts := strings.SplitN(val, "/", 2)
+		parts := strings.SplitN(res, "/", 2)
 		if len(parts) != 2 {
-			joblog.Warnf("Invalid val %s", val)
+			joblog.Warnf("Invalid val %s", res)
 			continue
 		}
 
@@ -165,6 +304,7 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 		job, err := Get(prefixer.NewPrefixer("", prefix), jobID)
 		if err != nil {
 			joblog.Warnf("Cannot find job %s on domain %s: %s", parts[1], parts[0], err)
+			b.releaseJob(&Job{JobID: jobID, Prefix: prefix, WorkerType: w.Type})
 			continue
 		}
 
@@ -172,6 +312,125 @@ func (b *redisBroker) pollLoop(key string, ch chan<- *Job) {
 	}
 }
 
+// popJob takes the next job of the fair scheduling, with the luaPopJob
+// script. The instances of the ring are tried by groups of candidates, until
+// a job is found or all the instances have been tried. It returns redis.Nil
+// if there is no job to take.
+func (b *redisBroker) popJob(keys redisFairKeys, maxDuration time.Duration, maxPerInstance int, p0First bool) (string, error) {
+	manual := "0"
+	if p0First {
+		manual = "1"
+	}
+	tried := int64(0)
+	for {
+		pipe := b.client.Pipeline()
+		lenCmd := pipe.LLen(keys.ring)
+		candidatesCmd := pipe.LRange(keys.ring, 0, redisPopCandidates-1)
+		if _, err := pipe.Exec(); err != nil {
+			return "", err
+		}
+		candidates := candidatesCmd.Val()
+		if len(candidates) == 0 {
+			return "", redis.Nil
+		}
+
+		scriptKeys := []string{keys.ring, keys.active, keys.weights, keys.domains, keys.credits}
+		now := time.Now()
+		args := []interface{}{
+			toMilliseconds(now),
+			toMilliseconds(now.Add(maxDuration)),
+			maxPerInstance,
+			manual,
+		}
+		for _, prefix := range candidates {
+			scriptKeys = append(scriptKeys,
+				keys.queue(prefix, false),
+				keys.queue(prefix, true),
+				keys.running(prefix))
+			args = append(args, prefix)
+		}
+
+		res, err := b.client.Eval(luaPopJob, scriptKeys, args...).Result()
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+		if val, ok := res.(string); ok {
+			return val, nil
+		}
+		if changed, ok := res.(int64); ok && changed == 1 {
+			// The ring has been modified by another stack
+			continue
+		}
+		// All the candidates have been skipped: the next instances of the
+		// ring are tried, unless the whole ring has been seen.
+		tried += int64(len(candidates))
+		if tried >= lenCmd.Val() {
+			return "", redis.Nil
+		}
+	}
+}
+
+// pushJob puts a job in the queue of its instance, with the luaPushJob
+// script.
+func (b *redisBroker) pushJob(job *Job, weight int, manual bool) error {
+	keys := newRedisFairKeys(job.WorkerType)
+	scriptKeys := []string{
+		keys.queue(job.DBPrefix(), manual),
+		keys.ring,
+		keys.active,
+		keys.weights,
+		keys.domains,
+		keys.wake,
+	}
+	return b.client.Eval(luaPushJob, scriptKeys,
+		job.DBPrefix(),
+		job.JobID,
+		weight,
+		job.Domain,
+		redisMaxWakeTokens-1,
+	).Err()
+}
+
+// popLegacyJob takes a job from the queues used before the fair scheduling,
+// for the jobs pushed by an older version of the stack.
+func (b *redisBroker) popLegacyJob(key string, p0First bool) (string, error) {
+	keyP0 := key + redisHighPrioritySuffix
+	keyP1 := key
+	if !p0First {
+		keyP1, keyP0 = keyP0, keyP1
+	}
+	val, err := b.client.RPop(keyP0).Result()
+	if err == redis.Nil {
+		val, err = b.client.RPop(keyP1).Result()
+	}
+	return val, err
+}
+
+// releaseJob removes the job from the running jobs of its instance, and wakes
+// up the polling loops if this instance was waiting for a slot.
+func (b *redisBroker) releaseJob(job *Job) {
+	keys := newRedisFairKeys(job.WorkerType)
+	pipe := b.client.Pipeline()
+	pipe.ZRem(keys.running(job.DBPrefix()), job.ID())
+	if b.maxPerInstance(job.WorkerType) > 0 {
+		pipe.LPush(keys.wake, "1")
+		pipe.LTrim(keys.wake, 0, redisMaxWakeTokens-1)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		joblog.Warnf("Cannot release job %s on domain %s: %s",
+			job.ID(), job.DomainName(), err)
+	}
+}
+
+func (b *redisBroker) maxPerInstance(workerType string) int {
+	for _, w := range b.workers {
+		if w.Type == workerType {
+			return w.Conf.MaxPerInstance
+		}
+	}
+	return 0
+}
+
 // PushJob will produce a new Job with the given options and enqueue the job in
 // the proper queue.
 func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, error) {
@@ -208,25 +467,22 @@ func (b *redisBroker) PushJob(db prefixer.Prefixer, req *JobRequest) (*Job, erro
 		return nil, err
 	}
 
-	key := redisPrefix + job.WorkerType
-	val := job.DBPrefix() + "/" + job.JobID
-
 	// When the job is manual, it is being pushed in a specific prioritized
 	// queue.
-	if job.Manual {
-		key += redisHighPrioritySuffix
-	}
-
-	if err := b.client.LPush(key, val).Err(); err != nil {
+	if err := b.pushJob(job, instanceWeight(db), job.Manual); err != nil {
 		return nil, err
 	}
 
 	return job, nil
 }
 
-// QueueLen returns the size of the number of elements in queue of the
+// WorkerQueueLen returns the size of the number of elements in queue of the
 // specified worker type.
 func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
+	counts, err := b.WorkerQueueLenByDomain(workerType)
+	if err != nil {
+		return 0, err
+	}
 	key := redisPrefix + workerType
 	l1, err := b.client.LLen(key).Result()
 	if err != nil {
@@ -236,5 +492,44 @@ func (b *redisBroker) WorkerQueueLen(workerType string) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return int(l1 + l2), nil
+	count := int(l1 + l2)
+	for _, c := range counts {
+		count += c
+	}
+	return count, nil
 }
+
+// WorkerQueueLenByDomain returns the number of pending jobs of each instance
+// in the queue of the specified worker type.
+func (b *redisBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	keys := newRedisFairKeys(workerType)
+	domains, err := b.client.HGetAll(keys.domains).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := b.client.Pipeline()
+	cmds := make(map[string][2]*redis.IntCmd, len(domains))
+	for prefix := range domains {
+		cmds[prefix] = [2]*redis.IntCmd{
+			pipe.LLen(keys.queue(prefix, false)),
+			pipe.LLen(keys.queue(prefix, true)),
+		}
+	}
+	if len(cmds) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, err
+		}
+	}
+	counts := make(map[string]int, len(domains))
+	for prefix, domain := range domains {
+		if n := int(cmds[prefix][0].Val() + cmds[prefix][1].Val()); n > 0 {
+			counts[domain] += n
+		}
+	}
+	return counts, nil
+}
+
+var (
+	_ Broker      = &redisBroker{}
+	_ jobReleaser = &redisBroker{}
+)
@@ -2,7 +2,9 @@ package jobs
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
@@ -112,3 +114,76 @@ func TestRedisJobs(t *testing.T) {
 	assert.NoError(t, err)
 	time.Sleep(1 * time.Second)
 }
+
+func newFairTestRedisBroker(t *testing.T) *redisBroker {
+	// This test needs a redis server where the keys of the test worker can be
+	// removed, given by the REDIS_URL env variable.
+	u := os.Getenv("REDIS_URL")
+	if u == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+	opts, err := redis.ParseURL(u)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	client := redis.NewClient(opts)
+	keys, err := client.Keys(redisPrefix + "{fair-test}*").Result()
+	if assert.NoError(t, err) && len(keys) > 0 {
+		assert.NoError(t, client.Del(keys...).Err())
+	}
+	return NewRedisBroker(client).(*redisBroker)
+}
+
+func pushFairTestJobs(t *testing.T, b *redisBroker, prefix string, weight, n int) {
+	for i := 0; i < n; i++ {
+		job := &Job{
+			JobID:      fmt.Sprintf("%s-%d", prefix, i),
+			Domain:     prefix + ".cozy.tools",
+			Prefix:     prefix,
+			WorkerType: "fair-test",
+		}
+		assert.NoError(t, b.pushJob(job, weight, false))
+	}
+}
+
+func popFairTestPrefixes(t *testing.T, b *redisBroker, maxPerInstance, n int) []string {
+	keys := newRedisFairKeys("fair-test")
+	var prefixes []string
+	for i := 0; i < n; i++ {
+		val, err := b.popJob(keys, time.Minute, maxPerInstance, true)
+		if err == redis.Nil {
+			prefixes = append(prefixes, "")
+			continue
+		}
+		assert.NoError(t, err)
+		prefixes = append(prefixes, strings.SplitN(val, "/", 2)[0])
+	}
+	return prefixes
+}
+
+func TestRedisFairScheduling(t *testing.T) {
+	b := newFairTestRedisBroker(t)
+	pushFairTestJobs(t, b, "a", 1, 4)
+	pushFairTestJobs(t, b, "b", 2, 2)
+	pushFairTestJobs(t, b, "c", 1, 1)
+
+	counts, err := b.WorkerQueueLenByDomain("fair-test")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"a.cozy.tools": 4,
+		"b.cozy.tools": 2,
+		"c.cozy.tools": 1,
+	}, counts)
+
+	assert.Equal(t, []string{"a", "b", "b", "c", "a", "a", "a", ""}, popFairTestPrefixes(t, b, 0, 8))
+}
+
+func TestRedisMaxPerInstance(t *testing.T) {
+	b := newFairTestRedisBroker(t)
+	pushFairTestJobs(t, b, "a", 1, 2)
+	pushFairTestJobs(t, b, "b", 1, 1)
+
+	assert.Equal(t, []string{"a", "b", ""}, popFairTestPrefixes(t, b, 1, 3))
+	b.releaseJob(&Job{JobID: "a-0", Prefix: "a", WorkerType: "fair-test"})
+	assert.Equal(t, []string{"a", ""}, popFairTestPrefixes(t, b, 1, 2))
+}
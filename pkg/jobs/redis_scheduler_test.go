@@ -62,6 +62,10 @@ func (b *mockBroker) WorkerQueueLen(workerType string) (int, error) {
 	return count, nil
 }
 
+func (b *mockBroker) WorkerQueueLenByDomain(workerType string) (map[string]int, error) {
+	return map[string]int{}, nil
+}
+
 func (b *mockBroker) WorkersTypes() []string {
 	return []string{}
 }
@@ -51,17 +51,18 @@ type (
 	// system. It contains parameters of the worker along with the worker main
 	// function that perform the work against a job's message.
 	WorkerConfig struct {
-		WorkerInit   WorkerInitFunc
-		WorkerStart  WorkerStartFunc
-		WorkerFunc   WorkerFunc
-		WorkerCommit WorkerCommit
-		WorkerType   string
-		BeforeHook   WorkerBeforeHook
-		Concurrency  int
-		MaxExecCount int
-		AdminOnly    bool
-		Timeout      time.Duration
-		RetryDelay   time.Duration
+		WorkerInit     WorkerInitFunc
+		WorkerStart    WorkerStartFunc
+		WorkerFunc     WorkerFunc
+		WorkerCommit   WorkerCommit
+		WorkerType     string
+		BeforeHook     WorkerBeforeHook
+		Concurrency    int
+		MaxExecCount   int
+		MaxPerInstance int
+		AdminOnly      bool
+		Timeout        time.Duration
+		RetryDelay     time.Duration
 	}
 
 	// Worker is a unit of work that will consume from a queue and execute the do
@@ -72,6 +73,9 @@ type (
 		jobs    chan *Job
 		running uint32
 		closed  chan struct{}
+		// broker is the broker that pushes the jobs of the next steps when
+		// the job is a step of a workflow.
+		broker Broker
 	}
 
 	// WorkerContext is a context.Context passed to the worker for each job
@@ -80,6 +84,7 @@ type (
 		context.Context
 		job     *Job
 		log     *logrus.Entry
+		logs    *logsRecorder
 		id      string
 		cookie  interface{}
 		noRetry bool
@@ -110,19 +115,23 @@ func NewWorkerContext(workerID string, job *Job) *WorkerContext {
 		WithField("worker_id", workerID).
 		WithField("nspace", "jobs")
 
+	// we need to clone the underlying logger in order to add specific hooks
+	// only on this logger: the last logs are kept for the dead-letter queue,
+	// and they can be forwarded to the realtime hub.
+	logs := &logsRecorder{}
+	loggerClone := logger.Clone(log.Logger)
+	loggerClone.AddHook(logs)
 	if job.ForwardLogs {
-		// we need to clone the underlying logger in order to add a specific hook
-		// only on this logger.
-		loggerClone := logger.Clone(log.Logger)
 		loggerClone.AddHook(realtime.LogHook(job, realtime.GetHub(),
 			consts.Jobs, job.ID()))
-		log.Logger = loggerClone
 	}
+	log.Logger = loggerClone
 
 	return &WorkerContext{
 		Context: ctx,
 		job:     job,
 		log:     log,
+		logs:    logs,
 		id:      id,
 	}
 }
@@ -157,6 +166,7 @@ func (c *WorkerContext) clone() *WorkerContext {
 		Context: c.Context,
 		job:     c.job,
 		log:     c.log,
+		logs:    c.logs,
 		id:      c.id,
 		cookie:  c.cookie,
 	}
@@ -256,12 +266,14 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 		domain := job.Domain
 		if domain == "" {
 			joblog.Errorf("%s: missing domain from job request", workerID)
+			w.release(job)
 			continue
 		}
 		parentCtx := NewWorkerContext(workerID, job)
 		if err := job.AckConsumed(); err != nil {
 			parentCtx.Logger().Errorf("error acking consume job: %s",
 				err.Error())
+			w.release(job)
 			continue
 		}
 		t := &task{
@@ -281,6 +293,10 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 				errRun.Error())
 			runResultLabel = metrics.WorkerExecResultErrored
 			errAck = job.Nack(errRun)
+			// The job is not retried after run has returned an error, be it
+			// because all its tries have failed, or because the error can't be
+			// retried (no-retry flag, bad trigger, invalid message).
+			addDeadLetter(job, t.execCount, errRun, parentCtx.logs.entries())
 		} else {
 			runResultLabel = metrics.WorkerExecResultSuccess
 			errAck = job.Ack()
@@ -290,6 +306,11 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 			parentCtx.Logger().Errorf("error while acking job done: %s",
 				errAck.Error())
 		}
+		w.release(job)
+
+		if job.WorkflowID != "" && w.broker != nil {
+			advanceWorkflow(w.broker, job, job.WorkflowID, job.WorkflowStep, job.ID(), errRun)
+		}
 
 		// Delete the trigger associated with the job (if any) when we receive a
 		// ErrBadTrigger.
@@ -306,6 +327,14 @@ func (w *Worker) work(workerID string, closed chan<- struct{}) {
 	closed <- struct{}{}
 }
 
+// release tells the broker that the job is no longer running, so that it can
+// give its slot to another job of the same instance.
+func (w *Worker) release(job *Job) {
+	if r, ok := w.broker.(jobReleaser); ok {
+		r.releaseJob(job)
+	}
+}
+
 // onBadTriggerError is the handler executed when we receive a specific
 // ErrBadTrigger error message:
 //   - delete the associated trigger
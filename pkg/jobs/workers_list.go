@@ -67,6 +67,9 @@ func applyWorkerConfig(w *WorkerConfig, c config.Worker) *WorkerConfig {
 	if c.MaxExecCount != nil {
 		w.MaxExecCount = *c.MaxExecCount
 	}
+	if c.MaxPerInstance != nil {
+		w.MaxPerInstance = *c.MaxPerInstance
+	}
 	if c.Timeout != nil {
 		w.Timeout = *c.Timeout
 	}
@@ -0,0 +1,435 @@
+package jobs
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+const (
+	// Pending state is the state of a step of a workflow that waits for its
+	// dependencies.
+	Pending State = "pending"
+	// Skipped state is the state of a step of a workflow that will not be
+	// executed, because a step it depends on has failed.
+	Skipped State = "skipped"
+	// Canceled state is the state of a workflow that has been canceled, and
+	// of its steps that were still pending.
+	Canceled State = "canceled"
+)
+
+// FailurePolicy tells what to do with the next steps of a workflow when a
+// step has failed.
+type FailurePolicy string
+
+const (
+	// FailAbort stops the workflow: the steps that have not been started are
+	// skipped. It is the default policy.
+	FailAbort FailurePolicy = "abort"
+	// FailSkip skips the steps that depend on the failed step, but the other
+	// branches of the workflow continue.
+	FailSkip FailurePolicy = "skip"
+	// FailContinue executes the steps that depend on the failed step as if it
+	// had succeeded.
+	FailContinue FailurePolicy = "continue"
+)
+
+// maxWorkflowUpdates is the number of tries to update a workflow when there
+// are conflicts, as several jobs of the same workflow can end at the same
+// time.
+const maxWorkflowUpdates = 10
+
+type (
+	// Workflow is a directed acyclic graph of job requests: a step is pushed
+	// in the job system when all the steps it depends on are finished. Many
+	// steps can depend on the same step (fan-out), and a step can depend on
+	// many steps (fan-in).
+	Workflow struct {
+		WorkflowID  string          `json:"_id,omitempty"`
+		WorkflowRev string          `json:"_rev,omitempty"`
+		Domain      string          `json:"domain"`
+		Prefix      string          `json:"prefix,omitempty"`
+		State       State           `json:"state"`
+		Steps       []*WorkflowStep `json:"steps"`
+		Admin       bool            `json:"admin,omitempty"`
+		CreatedAt   time.Time       `json:"created_at"`
+		FinishedAt  time.Time       `json:"finished_at"`
+	}
+
+	// WorkflowStep is a step of a workflow, executed by a job.
+	WorkflowStep struct {
+		Name       string        `json:"name"`
+		WorkerType string        `json:"worker"`
+		Message    Message       `json:"message,omitempty"`
+		Options    *JobOptions   `json:"options,omitempty"`
+		DependsOn  []string      `json:"depends_on,omitempty"`
+		OnFailure  FailurePolicy `json:"on_failure,omitempty"`
+		State      State         `json:"state"`
+		JobID      string        `json:"job_id,omitempty"`
+		Error      string        `json:"error,omitempty"`
+	}
+
+	// WorkflowRequest is used to create a new workflow.
+	WorkflowRequest struct {
+		Steps []*WorkflowStep
+		Admin bool
+	}
+)
+
+// DBPrefix implements the prefixer.Prefixer interface.
+func (w *Workflow) DBPrefix() string {
+	if w.Prefix != "" {
+		return w.Prefix
+	}
+	return w.Domain
+}
+
+// DomainName implements the prefixer.Prefixer interface.
+func (w *Workflow) DomainName() string {
+	return w.Domain
+}
+
+// ID implements the couchdb.Doc interface
+func (w *Workflow) ID() string { return w.WorkflowID }
+
+// Rev implements the couchdb.Doc interface
+func (w *Workflow) Rev() string { return w.WorkflowRev }
+
+// DocType implements the couchdb.Doc interface
+func (w *Workflow) DocType() string { return consts.JobsWorkflows }
+
+// SetID implements the couchdb.Doc interface
+func (w *Workflow) SetID(id string) { w.WorkflowID = id }
+
+// SetRev implements the couchdb.Doc interface
+func (w *Workflow) SetRev(rev string) { w.WorkflowRev = rev }
+
+// Clone implements the couchdb.Doc interface
+func (w *Workflow) Clone() couchdb.Doc {
+	cloned := *w
+	cloned.Steps = make([]*WorkflowStep, len(w.Steps))
+	for i, s := range w.Steps {
+		step := *s
+		if s.Options != nil {
+			tmp := *s.Options
+			step.Options = &tmp
+		}
+		if s.Message != nil {
+			step.Message = make(Message, len(s.Message))
+			copy(step.Message, s.Message)
+		}
+		step.DependsOn = make([]string, len(s.DependsOn))
+		copy(step.DependsOn, s.DependsOn)
+		cloned.Steps[i] = &step
+	}
+	return &cloned
+}
+
+// Step returns the step of the workflow with the given name, or nil.
+func (w *Workflow) Step(name string) *WorkflowStep {
+	for _, s := range w.Steps {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *WorkflowStep) policy() FailurePolicy {
+	if s.OnFailure == "" {
+		return FailAbort
+	}
+	return s.OnFailure
+}
+
+// validate checks that the steps have unique names, known workers and
+// failure policies, and that their dependencies form an acyclic graph.
+func (w *Workflow) validate(workersTypes []string) error {
+	if len(w.Steps) == 0 {
+		return ErrWorkflowNoSteps
+	}
+	names := make(map[string]bool, len(w.Steps))
+	for _, s := range w.Steps {
+		if s.Name == "" || names[s.Name] {
+			return ErrWorkflowStepName
+		}
+		names[s.Name] = true
+		if !utils.IsInArray(s.WorkerType, workersTypes) {
+			return ErrUnknownWorker
+		}
+		switch s.OnFailure {
+		case "", FailAbort, FailSkip, FailContinue:
+		default:
+			return ErrWorkflowFailurePolicy
+		}
+	}
+	for _, s := range w.Steps {
+		for _, dep := range s.DependsOn {
+			if !names[dep] || dep == s.Name {
+				return ErrWorkflowDependency
+			}
+		}
+	}
+
+	// Kahn's algorithm: the graph is acyclic if all the steps can be sorted.
+	indegrees := make(map[string]int, len(w.Steps))
+	for _, s := range w.Steps {
+		indegrees[s.Name] = len(s.DependsOn)
+	}
+	var sorted []string
+	for _, s := range w.Steps {
+		if indegrees[s.Name] == 0 {
+			sorted = append(sorted, s.Name)
+		}
+	}
+	for i := 0; i < len(sorted); i++ {
+		for _, s := range w.Steps {
+			for _, dep := range s.DependsOn {
+				if dep == sorted[i] {
+					indegrees[s.Name]--
+					if indegrees[s.Name] == 0 {
+						sorted = append(sorted, s.Name)
+					}
+				}
+			}
+		}
+	}
+	if len(sorted) != len(w.Steps) {
+		return ErrWorkflowCycle
+	}
+	return nil
+}
+
+// schedule marks as queued the pending steps whose dependencies are
+// finished, and as skipped the ones that can't be executed. It returns the
+// steps that must be pushed in the job system.
+func (w *Workflow) schedule() []*WorkflowStep {
+	if w.State != Running {
+		return nil
+	}
+	for _, s := range w.Steps {
+		if s.State == Errored && s.policy() == FailAbort {
+			for _, p := range w.Steps {
+				if p.State == Pending {
+					p.State = Skipped
+				}
+			}
+			break
+		}
+	}
+
+	var ready []*WorkflowStep
+	for changed := true; changed; {
+		changed = false
+		for _, s := range w.Steps {
+			if s.State != Pending {
+				continue
+			}
+			runnable, skip := w.dependenciesState(s)
+			if skip {
+				s.State = Skipped
+				changed = true
+			} else if runnable {
+				s.State = Queued
+				ready = append(ready, s)
+			}
+		}
+	}
+
+	w.updateState()
+	return ready
+}
+
+// dependenciesState tells if a step can be executed, or if it must be
+// skipped.
+func (w *Workflow) dependenciesState(s *WorkflowStep) (runnable, skip bool) {
+	runnable = true
+	for _, name := range s.DependsOn {
+		dep := w.Step(name)
+		switch dep.State {
+		case Done:
+		case Errored:
+			if dep.policy() != FailContinue {
+				skip = true
+			}
+		case Skipped, Canceled:
+			skip = true
+		default:
+			runnable = false
+		}
+	}
+	return
+}
+
+// updateState computes the state of the workflow from the states of its
+// steps.
+func (w *Workflow) updateState() {
+	if w.State != Running {
+		return
+	}
+	state := Done
+	for _, s := range w.Steps {
+		switch s.State {
+		case Pending, Queued, Running:
+			return
+		case Errored:
+			if s.policy() != FailContinue {
+				state = Errored
+			}
+		}
+	}
+	w.State = state
+	w.FinishedAt = time.Now()
+}
+
+// PushWorkflow creates a new workflow and pushes the jobs of the steps that
+// have no dependencies.
+func PushWorkflow(b Broker, db prefixer.Prefixer, req *WorkflowRequest) (*Workflow, error) {
+	w := &Workflow{
+		Domain:    db.DomainName(),
+		Prefix:    db.DBPrefix(),
+		State:     Running,
+		Steps:     req.Steps,
+		Admin:     req.Admin,
+		CreatedAt: time.Now(),
+	}
+	if err := w.validate(b.WorkersTypes()); err != nil {
+		return nil, err
+	}
+	for _, s := range w.Steps {
+		s.State = Pending
+		s.JobID = ""
+		s.Error = ""
+	}
+	ready := w.schedule()
+	if err := couchdb.CreateDoc(w, w); err != nil {
+		return nil, err
+	}
+	pushWorkflowSteps(b, w, ready)
+	return GetWorkflow(w, w.ID())
+}
+
+// GetWorkflow returns the workflow with the given identifier.
+func GetWorkflow(db prefixer.Prefixer, workflowID string) (*Workflow, error) {
+	var w Workflow
+	if err := couchdb.GetDoc(db, consts.JobsWorkflows, workflowID, &w); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrNotFoundWorkflow
+		}
+		return nil, err
+	}
+	return &w, nil
+}
+
+// CancelWorkflow cancels a workflow: the steps that have not been started
+// are canceled, and the jobs already pushed can still finish.
+func CancelWorkflow(db prefixer.Prefixer, workflowID string) (*Workflow, error) {
+	return updateWorkflow(db, workflowID, func(w *Workflow) bool {
+		if w.State != Running {
+			return false
+		}
+		for _, s := range w.Steps {
+			if s.State == Pending {
+				s.State = Canceled
+			}
+		}
+		w.State = Canceled
+		w.FinishedAt = time.Now()
+		return true
+	})
+}
+
+// updateWorkflow applies fn on the last revision of the workflow, and saves
+// it if fn returns true. It is retried on conflicts.
+func updateWorkflow(db prefixer.Prefixer, workflowID string, fn func(w *Workflow) bool) (*Workflow, error) {
+	var err error
+	for i := 0; i < maxWorkflowUpdates; i++ {
+		var w *Workflow
+		if w, err = GetWorkflow(db, workflowID); err != nil {
+			return nil, err
+		}
+		if !fn(w) {
+			return w, nil
+		}
+		if err = couchdb.UpdateDoc(w, w); err == nil {
+			return w, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// pushWorkflowSteps pushes the jobs for the given steps of the workflow, and
+// saves their identifiers in the workflow.
+func pushWorkflowSteps(b Broker, w *Workflow, steps []*WorkflowStep) {
+	for _, s := range steps {
+		job, err := b.PushJob(w, &JobRequest{
+			WorkerType:   s.WorkerType,
+			Message:      s.Message,
+			Options:      s.Options,
+			Admin:        w.Admin,
+			WorkflowID:   w.ID(),
+			WorkflowStep: s.Name,
+		})
+		if err != nil {
+			advanceWorkflow(b, w, w.ID(), s.Name, "", err)
+			continue
+		}
+		if job.ID() == "" {
+			// The job has been skipped by the before hook of the worker
+			advanceWorkflow(b, w, w.ID(), s.Name, "", nil)
+			continue
+		}
+		name := s.Name
+		_, err = updateWorkflow(w, w.ID(), func(w *Workflow) bool {
+			step := w.Step(name)
+			if step == nil || step.State != Queued || step.JobID != "" {
+				return false
+			}
+			step.JobID = job.ID()
+			return true
+		})
+		if err != nil {
+			logger.WithDomain(w.Domain).WithField("nspace", "jobs").
+				Errorf("Could not save the job of the step %s of workflow %s: %s",
+					name, w.ID(), err)
+		}
+	}
+}
+
+// advanceWorkflow is called when the job of a step is finished, or could not
+// be pushed. It saves the result of the step, and pushes the jobs of the
+// steps that are ready.
+func advanceWorkflow(b Broker, db prefixer.Prefixer, workflowID, stepName, jobID string, errRun error) {
+	var ready []*WorkflowStep
+	w, err := updateWorkflow(db, workflowID, func(w *Workflow) bool {
+		step := w.Step(stepName)
+		if step == nil || step.State != Queued {
+			return false
+		}
+		if step.JobID != "" && step.JobID != jobID {
+			return false
+		}
+		step.JobID = jobID
+		if errRun != nil {
+			step.State = Errored
+			step.Error = errRun.Error()
+		} else {
+			step.State = Done
+		}
+		ready = w.schedule()
+		return true
+	})
+	if err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "jobs").
+			Errorf("Could not update the workflow %s: %s", workflowID, err)
+		return
+	}
+	pushWorkflowSteps(b, w, ready)
+}
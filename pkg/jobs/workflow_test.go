@@ -0,0 +1,205 @@
+package jobs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkflowValidate(t *testing.T) {
+	workers := []string{"a", "b"}
+
+	w := &Workflow{}
+	assert.Equal(t, ErrWorkflowNoSteps, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a"},
+		{Name: "one", WorkerType: "b"},
+	}
+	assert.Equal(t, ErrWorkflowStepName, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a"},
+		{Name: "two", WorkerType: "c"},
+	}
+	assert.Equal(t, ErrUnknownWorker, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a"},
+		{Name: "two", WorkerType: "b", DependsOn: []string{"three"}},
+	}
+	assert.Equal(t, ErrWorkflowDependency, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a", OnFailure: "retry"},
+	}
+	assert.Equal(t, ErrWorkflowFailurePolicy, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a"},
+		{Name: "two", WorkerType: "b", DependsOn: []string{"one", "four"}},
+		{Name: "three", WorkerType: "b", DependsOn: []string{"two"}},
+		{Name: "four", WorkerType: "b", DependsOn: []string{"three"}},
+	}
+	assert.Equal(t, ErrWorkflowCycle, w.validate(workers))
+
+	w.Steps = []*WorkflowStep{
+		{Name: "one", WorkerType: "a"},
+		{Name: "two", WorkerType: "b", DependsOn: []string{"one"}},
+		{Name: "three", WorkerType: "b", DependsOn: []string{"one"}},
+		{Name: "four", WorkerType: "a", DependsOn: []string{"two", "three"}},
+	}
+	assert.NoError(t, w.validate(workers))
+}
+
+func newTestWorkflow(steps ...*WorkflowStep) *Workflow {
+	for _, s := range steps {
+		s.State = Pending
+	}
+	return &Workflow{State: Running, Steps: steps}
+}
+
+func stepNames(steps []*WorkflowStep) []string {
+	names := make([]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.Name
+	}
+	return names
+}
+
+func TestWorkflowScheduleFanOutFanIn(t *testing.T) {
+	w := newTestWorkflow(
+		&WorkflowStep{Name: "one"},
+		&WorkflowStep{Name: "two", DependsOn: []string{"one"}},
+		&WorkflowStep{Name: "three", DependsOn: []string{"one"}},
+		&WorkflowStep{Name: "four", DependsOn: []string{"two", "three"}},
+	)
+	assert.Equal(t, []string{"one"}, stepNames(w.schedule()))
+
+	w.Step("one").State = Done
+	assert.Equal(t, []string{"two", "three"}, stepNames(w.schedule()))
+
+	w.Step("two").State = Done
+	assert.Empty(t, w.schedule())
+
+	w.Step("three").State = Done
+	assert.Equal(t, []string{"four"}, stepNames(w.schedule()))
+	assert.Equal(t, Running, w.State)
+
+	w.Step("four").State = Done
+	assert.Empty(t, w.schedule())
+	assert.Equal(t, Done, w.State)
+	assert.False(t, w.FinishedAt.IsZero())
+}
+
+func TestWorkflowScheduleFailurePolicies(t *testing.T) {
+	// abort
+	w := newTestWorkflow(
+		&WorkflowStep{Name: "one"},
+		&WorkflowStep{Name: "two"},
+		&WorkflowStep{Name: "three", DependsOn: []string{"two"}},
+	)
+	w.schedule()
+	w.Step("one").State = Errored
+	assert.Empty(t, w.schedule())
+	assert.Equal(t, Queued, w.Step("two").State)
+	assert.Equal(t, Skipped, w.Step("three").State)
+	assert.Equal(t, Running, w.State)
+	w.Step("two").State = Done
+	w.schedule()
+	assert.Equal(t, Errored, w.State)
+
+	// skip
+	w = newTestWorkflow(
+		&WorkflowStep{Name: "one", OnFailure: FailSkip},
+		&WorkflowStep{Name: "two"},
+		&WorkflowStep{Name: "three", DependsOn: []string{"one"}},
+		&WorkflowStep{Name: "four", DependsOn: []string{"three"}},
+		&WorkflowStep{Name: "five", DependsOn: []string{"two"}},
+	)
+	w.schedule()
+	w.Step("one").State = Errored
+	w.Step("two").State = Done
+	assert.Equal(t, []string{"five"}, stepNames(w.schedule()))
+	assert.Equal(t, Skipped, w.Step("three").State)
+	assert.Equal(t, Skipped, w.Step("four").State)
+	w.Step("five").State = Done
+	w.schedule()
+	assert.Equal(t, Errored, w.State)
+
+	// continue
+	w = newTestWorkflow(
+		&WorkflowStep{Name: "one", OnFailure: FailContinue},
+		&WorkflowStep{Name: "two", DependsOn: []string{"one"}},
+	)
+	w.schedule()
+	w.Step("one").State = Errored
+	assert.Equal(t, []string{"two"}, stepNames(w.schedule()))
+	w.Step("two").State = Done
+	w.schedule()
+	assert.Equal(t, Done, w.State)
+}
+
+func TestWorkflowInMemoryBroker(t *testing.T) {
+	var mu sync.Mutex
+	var executed []string
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	workerFunc := func(ctx *WorkerContext) error {
+		var msg string
+		if err := ctx.UnmarshalMessage(&msg); err != nil {
+			return err
+		}
+		mu.Lock()
+		executed = append(executed, msg)
+		mu.Unlock()
+		wg.Done()
+		if msg == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	broker := NewMemBroker()
+	assert.NoError(t, broker.StartWorkers(WorkersList{
+		{WorkerType: "wf", Concurrency: 2, WorkerFunc: workerFunc},
+	}))
+
+	first, _ := NewMessage("first")
+	fail, _ := NewMessage("fail")
+	last, _ := NewMessage("last")
+	never, _ := NewMessage("never")
+	w, err := PushWorkflow(broker, localDB, &WorkflowRequest{
+		Steps: []*WorkflowStep{
+			{Name: "first", WorkerType: "wf", Message: first},
+			{Name: "fail", WorkerType: "wf", Message: fail, DependsOn: []string{"first"}, OnFailure: FailSkip},
+			{Name: "never", WorkerType: "wf", Message: never, DependsOn: []string{"fail"}},
+			{Name: "last", WorkerType: "wf", Message: last, DependsOn: []string{"first"}},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, Running, w.State)
+	wg.Wait()
+
+	var final *Workflow
+	for i := 0; i < 50; i++ {
+		final, err = GetWorkflow(localDB, w.ID())
+		assert.NoError(t, err)
+		if final.State != Running {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, Errored, final.State)
+	assert.Equal(t, Done, final.Step("first").State)
+	assert.Equal(t, Errored, final.Step("fail").State)
+	assert.Equal(t, "failed", final.Step("fail").Error)
+	assert.Equal(t, Skipped, final.Step("never").State)
+	assert.Equal(t, Done, final.Step("last").State)
+	assert.NotEmpty(t, final.Step("last").JobID)
+	assert.Len(t, executed, 3)
+	assert.NotContains(t, executed, "never")
+}
@@ -0,0 +1,95 @@
+package keymgmt
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	secretKeyBlockType = "NACL SECRET KEY"
+
+	secretKeyLen   = 32
+	secretNonceLen = 24
+)
+
+var errSecretBadKey = errors.New("keymgmt: bad secret key")
+
+// ErrUnwrapKey is returned when a wrapped key cannot be decrypted with the
+// given master key.
+var ErrUnwrapKey = errors.New("keymgmt: could not unwrap the key")
+
+// SecretKey is a key for symmetric encryption, using the nacl secretbox API.
+type SecretKey [secretKeyLen]byte
+
+// GenerateSecretKey returns a new random secret key.
+func GenerateSecretKey() (*SecretKey, error) {
+	key := new(SecretKey)
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GenerateEncodedSecretKey returns the encoded value of a secret key freshly
+// generated.
+func GenerateEncodedSecretKey() ([]byte, error) {
+	key, err := GenerateSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	return MarshalSecretKey(key), nil
+}
+
+// MarshalSecretKey takes a secret key and returns its encoded version.
+func MarshalSecretKey(key *SecretKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  secretKeyBlockType,
+		Bytes: key[:],
+	})
+}
+
+// UnmarshalSecretKey takes the encoded value of a secret key and returns the
+// associated key.
+func UnmarshalSecretKey(marshaledKey []byte) (*SecretKey, error) {
+	keyBytes, err := unmarshalPEMBlock(marshaledKey, secretKeyBlockType)
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != secretKeyLen {
+		return nil, errSecretBadKey
+	}
+	key := new(SecretKey)
+	copy(key[:], keyBytes)
+	return key, nil
+}
+
+// WrapKey encrypts a key with a master key, so that it can be stored next to
+// the data it protects. The result contains the nonce followed by the sealed
+// key.
+func WrapKey(master, key *SecretKey) ([]byte, error) {
+	var nonce [secretNonceLen]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], key[:], &nonce, (*[secretKeyLen]byte)(master)), nil
+}
+
+// UnwrapKey decrypts a key that has been wrapped with WrapKey.
+func UnwrapKey(master *SecretKey, wrapped []byte) (*SecretKey, error) {
+	if len(wrapped) != secretNonceLen+secretKeyLen+secretbox.Overhead {
+		return nil, ErrUnwrapKey
+	}
+	var nonce [secretNonceLen]byte
+	copy(nonce[:], wrapped[:secretNonceLen])
+	opened, ok := secretbox.Open(nil, wrapped[secretNonceLen:], &nonce, (*[secretKeyLen]byte)(master))
+	if !ok {
+		return nil, ErrUnwrapKey
+	}
+	key := new(SecretKey)
+	copy(key[:], opened)
+	return key, nil
+}
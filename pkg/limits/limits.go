@@ -0,0 +1,339 @@
+// Package limits is used to protect the authentication endpoints against the
+// brute-force attacks. The failed attempts are counted by instance and IP
+// address: after a few free attempts, the client must wait for a progressive
+// delay before trying again, and then the IP address is locked out for some
+// time. The attempts are also counted for the whole instance: when they come
+// from many IP addresses, each failed attempt is delayed for the maximal
+// duration and a warning is logged, but the instance is not locked out, as it
+// would allow anyone to prevent its owner from logging in.
+package limits
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// CounterType is the type of the action whose attempts are counted.
+type CounterType string
+
+const (
+	// AuthType is used for the login with the passphrase.
+	AuthType CounterType = "auth"
+	// TwoFactorType is used for the check of the two-factor passcode.
+	TwoFactorType CounterType = "two-factor"
+	// PassphraseResetType is used for the requests to reset the passphrase.
+	PassphraseResetType CounterType = "passphrase-reset"
+	// SharePasswordType is used for the password of the shares by link.
+	SharePasswordType CounterType = "share-password"
+	// AppPasswordType is used for the app passwords sent with the HTTP basic
+	// authentication.
+	AppPasswordType CounterType = "app-password"
+)
+
+// Policy describes how the attempts of a type are limited.
+type Policy struct {
+	// FreeAttempts is the number of attempts before the delays
+	FreeAttempts int64
+	// MaxAttempts is the number of attempts before the lockout
+	MaxAttempts int64
+	// InstanceMaxAttempts is the number of attempts, from all the IP
+	// addresses, after which every failed attempt is delayed for MaxDelay
+	InstanceMaxAttempts int64
+	// Period is the duration during which the attempts are counted
+	Period time.Duration
+	// Lockout is the duration of the lockout
+	Lockout time.Duration
+}
+
+// Policies are the policies for each type of counter.
+var Policies = map[CounterType]Policy{
+	AuthType: {
+		FreeAttempts:        3,
+		MaxAttempts:         10,
+		InstanceMaxAttempts: 100,
+		Period:              1 * time.Hour,
+		Lockout:             15 * time.Minute,
+	},
+	TwoFactorType: {
+		FreeAttempts:        3,
+		MaxAttempts:         10,
+		InstanceMaxAttempts: 100,
+		Period:              1 * time.Hour,
+		Lockout:             15 * time.Minute,
+	},
+	PassphraseResetType: {
+		FreeAttempts:        2,
+		MaxAttempts:         5,
+		InstanceMaxAttempts: 20,
+		Period:              1 * time.Hour,
+		Lockout:             1 * time.Hour,
+	},
+	SharePasswordType: {
+		FreeAttempts:        3,
+		MaxAttempts:         10,
+		InstanceMaxAttempts: 100,
+		Period:              1 * time.Hour,
+		Lockout:             1 * time.Hour,
+	},
+	AppPasswordType: {
+		FreeAttempts:        10,
+		MaxAttempts:         20,
+		InstanceMaxAttempts: 100,
+		Period:              1 * time.Hour,
+		Lockout:             15 * time.Minute,
+	},
+}
+
+var (
+	// DelayStep is the delay for the first attempt after the free ones. It is
+	// doubled for each new attempt.
+	DelayStep = 500 * time.Millisecond
+	// MaxDelay is the maximal delay for an attempt.
+	MaxDelay = 8 * time.Second
+)
+
+var limitslog = logger.WithNamespace("limits")
+
+// Counter is a counter of attempts, stored in memory or in redis. The values
+// expire after a given duration.
+type Counter interface {
+	// Increment adds one to the counter of the given key, and returns the new
+	// value. The counter expires after the given duration if it is new.
+	Increment(key string, ttl time.Duration) (int64, error)
+	// Expire changes the expiration of the counter.
+	Expire(key string, ttl time.Duration) error
+	// Get returns the value of the counter, and when it expires.
+	Get(key string) (int64, time.Time, error)
+	// Reset removes the counter.
+	Reset(key string) error
+	// Keys returns the keys of the counters with the given prefix.
+	Keys(prefix string) ([]string, error)
+}
+
+var globalCounter Counter
+var globalCounterMutex sync.Mutex
+
+// GetCounter returns the counter used for the limits, in redis if the lock
+// storage is configured with redis, and in memory else.
+func GetCounter() Counter {
+	globalCounterMutex.Lock()
+	defer globalCounterMutex.Unlock()
+	if globalCounter != nil {
+		return globalCounter
+	}
+	cli := config.GetConfig().Lock.Client()
+	if cli == nil {
+		globalCounter = NewMemCounter()
+	} else {
+		globalCounter = NewRedisCounter(cli)
+	}
+	return globalCounter
+}
+
+// AllIPs is used in place of an IP address for the counter of the attempts
+// made on the whole instance.
+const AllIPs = "all"
+
+const keySep = ":"
+
+func keyPrefix(db prefixer.Prefixer) string {
+	return "limits" + keySep + db.DBPrefix() + keySep
+}
+
+func counterKey(db prefixer.Prefixer, typ CounterType, ip string) string {
+	return keyPrefix(db) + string(typ) + keySep + ip
+}
+
+func waitPrefix(db prefixer.Prefixer) string {
+	return "limits-wait" + keySep + db.DBPrefix() + keySep
+}
+
+// waitKey is the key of the counter that exists while the client must wait
+// before a new attempt.
+func waitKey(db prefixer.Prefixer, typ CounterType, ip string) string {
+	return waitPrefix(db) + string(typ) + keySep + ip
+}
+
+// RequestIP returns the IP address used to count the attempts of the client
+// that has made the request.
+func RequestIP(req *http.Request) string {
+	if ip := config.ClientIP(req); ip != nil {
+		return ip.String()
+	}
+	return req.RemoteAddr
+}
+
+// RetryAfter returns how long the IP address must wait before a new attempt,
+// because of the delay after its last failed attempt or of a lockout, or 0 if
+// it can try now.
+func RetryAfter(db prefixer.Prefixer, typ CounterType, ip string) time.Duration {
+	policy := Policies[typ]
+	counter := GetCounter()
+	var wait time.Duration
+	check := func(key string, limit int64) {
+		n, expiresAt, err := counter.Get(key)
+		if err != nil {
+			limitslog.Errorf("Cannot check the attempts for %s: %s", ip, err)
+			return
+		}
+		if n < limit {
+			return
+		}
+		d := time.Until(expiresAt)
+		if d < time.Second {
+			d = time.Second
+		}
+		if d > wait {
+			wait = d
+		}
+	}
+	check(waitKey(db, typ, ip), 1)
+	check(counterKey(db, typ, ip), policy.MaxAttempts)
+	return wait
+}
+
+// Attempt counts a failed attempt for the IP address, and for the whole
+// instance. It returns the delay that the client must wait before a new
+// attempt, and true if this attempt has caused the lockout of the IP address.
+func Attempt(db prefixer.Prefixer, typ CounterType, ip string) (time.Duration, bool) {
+	policy := Policies[typ]
+	counter := GetCounter()
+	lockedNow := false
+	key := counterKey(db, typ, ip)
+	n, err := counter.Increment(key, policy.Period)
+	if err != nil {
+		limitslog.Errorf("Cannot count the attempt for %s: %s", ip, err)
+	} else if n == policy.MaxAttempts {
+		lockedNow = true
+		if err = counter.Expire(key, policy.Lockout); err != nil {
+			limitslog.Errorf("Cannot lock out %s: %s", ip, err)
+		}
+	}
+
+	delay := delayFor(policy, n)
+
+	// The attempts from all the IP addresses only slow down the attacks on
+	// the instance: a lockout would also lock out its owner.
+	total, err := counter.Increment(counterKey(db, typ, AllIPs), policy.Period)
+	if err != nil {
+		limitslog.Errorf("Cannot count the attempt for %s: %s", db.DomainName(), err)
+	} else if total >= policy.InstanceMaxAttempts {
+		if total == policy.InstanceMaxAttempts {
+			limitslog.Warnf("Too many attempts for %s on %s from several IP addresses",
+				typ, db.DomainName())
+		}
+		delay = MaxDelay
+	}
+
+	if delay > 0 {
+		key := waitKey(db, typ, ip)
+		if _, err := counter.Increment(key, delay); err != nil {
+			limitslog.Errorf("Cannot delay the next attempt for %s: %s", ip, err)
+		} else if err = counter.Expire(key, delay); err != nil {
+			limitslog.Errorf("Cannot delay the next attempt for %s: %s", ip, err)
+		}
+	}
+	return delay, lockedNow
+}
+
+func delayFor(policy Policy, n int64) time.Duration {
+	if n <= policy.FreeAttempts {
+		return 0
+	}
+	delay := DelayStep
+	for k := policy.FreeAttempts + 1; k < n && delay < MaxDelay; k++ {
+		delay *= 2
+	}
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+	return delay
+}
+
+// Reset removes the counter of attempts for the IP address, after a
+// successful authentication for example. The counter for the whole instance
+// is kept.
+func Reset(db prefixer.Prefixer, typ CounterType, ip string) {
+	counter := GetCounter()
+	for _, key := range []string{counterKey(db, typ, ip), waitKey(db, typ, ip)} {
+		if err := counter.Reset(key); err != nil {
+			limitslog.Errorf("Cannot reset the attempts for %s: %s", ip, err)
+		}
+	}
+}
+
+// Attempts is the number of attempts made by an IP address for a type of
+// action. The IP address is AllIPs for the attempts made on the whole
+// instance, which is never locked out.
+type Attempts struct {
+	Type      CounterType `json:"type"`
+	IP        string      `json:"ip"`
+	Count     int64       `json:"count"`
+	Locked    bool        `json:"locked"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// List returns the counters of attempts for the instance.
+func List(db prefixer.Prefixer) ([]*Attempts, error) {
+	counter := GetCounter()
+	prefix := keyPrefix(db)
+	keys, err := counter.Keys(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	list := make([]*Attempts, 0, len(keys))
+	for _, key := range keys {
+		parts := strings.SplitN(strings.TrimPrefix(key, prefix), keySep, 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, expiresAt, err := counter.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		typ := CounterType(parts[0])
+		list = append(list, &Attempts{
+			Type:      typ,
+			IP:        parts[1],
+			Count:     n,
+			Locked:    parts[1] != AllIPs && n >= Policies[typ].MaxAttempts,
+			ExpiresAt: expiresAt,
+		})
+	}
+	return list, nil
+}
+
+// ResetAll removes the counters of attempts for the instance. If ip is not
+// empty, only the counters for this IP address are removed.
+func ResetAll(db prefixer.Prefixer, ip string) error {
+	counter := GetCounter()
+	keys, err := counter.Keys(keyPrefix(db))
+	if err != nil {
+		return err
+	}
+	waits, err := counter.Keys(waitPrefix(db))
+	if err != nil {
+		return err
+	}
+	keys = append(keys, waits...)
+	for _, key := range keys {
+		if ip != "" && !strings.HasSuffix(key, keySep+ip) {
+			continue
+		}
+		if err = counter.Reset(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
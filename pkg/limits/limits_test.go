@@ -0,0 +1,136 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemCounter(t *testing.T) {
+	c := NewMemCounter()
+	n, err := c.Increment("foo", time.Hour)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	n, err = c.Increment("foo", time.Hour)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+
+	n, expiresAt, err := c.Get("foo")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+	assert.True(t, expiresAt.After(time.Now()))
+
+	keys, err := c.Keys("fo")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, keys)
+
+	assert.NoError(t, c.Expire("foo", -time.Second))
+	n, _, err = c.Get("foo")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+
+	_, err = c.Increment("bar", time.Hour)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Reset("bar"))
+	keys, err = c.Keys("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestAttempts(t *testing.T) {
+	globalCounter = NewMemCounter()
+	db := prefixer.NewPrefixer("limits.example.net", "limits-example-net")
+	ip := "203.0.113.42"
+	policy := Policies[AuthType]
+
+	for k := int64(1); k <= policy.FreeAttempts; k++ {
+		delay, locked := Attempt(db, AuthType, ip)
+		assert.Equal(t, time.Duration(0), delay)
+		assert.False(t, locked)
+	}
+	assert.Equal(t, time.Duration(0), RetryAfter(db, AuthType, ip))
+	delay, _ := Attempt(db, AuthType, ip)
+	assert.Equal(t, DelayStep, delay)
+	// The client must wait for the delay before a new attempt
+	assert.True(t, RetryAfter(db, AuthType, ip) > 0)
+	delay, _ = Attempt(db, AuthType, ip)
+	assert.Equal(t, 2*DelayStep, delay)
+	assert.True(t, RetryAfter(db, AuthType, ip) <= policy.Lockout)
+
+	var locked bool
+	for k := policy.FreeAttempts + 3; k <= policy.MaxAttempts; k++ {
+		delay, locked = Attempt(db, AuthType, ip)
+		assert.True(t, delay <= MaxDelay)
+	}
+	assert.True(t, locked)
+	assert.True(t, RetryAfter(db, AuthType, ip) > MaxDelay)
+	assert.Equal(t, time.Duration(0), RetryAfter(db, TwoFactorType, ip))
+	assert.Equal(t, time.Duration(0), RetryAfter(db, AuthType, "198.51.100.1"))
+
+	list, err := List(db)
+	assert.NoError(t, err)
+	if assert.Len(t, list, 2) {
+		assert.Equal(t, AuthType, list[0].Type)
+		assert.Equal(t, ip, list[0].IP)
+		assert.Equal(t, policy.MaxAttempts, list[0].Count)
+		assert.True(t, list[0].Locked)
+		assert.Equal(t, AllIPs, list[1].IP)
+		assert.Equal(t, policy.MaxAttempts, list[1].Count)
+		assert.False(t, list[1].Locked)
+	}
+
+	assert.NoError(t, ResetAll(db, ip))
+	assert.Equal(t, time.Duration(0), RetryAfter(db, AuthType, ip))
+
+	Attempt(db, TwoFactorType, ip)
+	Reset(db, TwoFactorType, ip)
+	list, err = List(db)
+	assert.NoError(t, err)
+	for _, attempts := range list {
+		assert.Equal(t, AllIPs, attempts.IP)
+	}
+
+	assert.NoError(t, ResetAll(db, ""))
+	list, err = List(db)
+	assert.NoError(t, err)
+	assert.Empty(t, list)
+}
+
+func TestInstanceAttempts(t *testing.T) {
+	globalCounter = NewMemCounter()
+	db := prefixer.NewPrefixer("lockout.example.net", "lockout-example-net")
+	typ := CounterType("test")
+	Policies[typ] = Policy{
+		FreeAttempts:        10,
+		MaxAttempts:         10,
+		InstanceMaxAttempts: 3,
+		Period:              time.Hour,
+		Lockout:             time.Hour,
+	}
+	defer delete(Policies, typ)
+
+	delay, locked := Attempt(db, typ, "203.0.113.1")
+	assert.Equal(t, time.Duration(0), delay)
+	assert.False(t, locked)
+	_, locked = Attempt(db, typ, "203.0.113.2")
+	assert.False(t, locked)
+	delay, locked = Attempt(db, typ, "203.0.113.3")
+	assert.Equal(t, MaxDelay, delay)
+	assert.False(t, locked)
+
+	// The instance is not locked out, but the failed attempts are delayed
+	assert.Equal(t, time.Duration(0), RetryAfter(db, typ, "198.51.100.1"))
+	delay, locked = Attempt(db, typ, "198.51.100.1")
+	assert.Equal(t, MaxDelay, delay)
+	assert.False(t, locked)
+	retry := RetryAfter(db, typ, "198.51.100.1")
+	assert.True(t, retry > 0 && retry <= MaxDelay)
+
+	list, err := List(db)
+	assert.NoError(t, err)
+	for _, attempts := range list {
+		assert.False(t, attempts.Locked)
+	}
+}
@@ -0,0 +1,86 @@
+package limits
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+type memValue struct {
+	count     int64
+	expiresAt time.Time
+}
+
+type memCounter struct {
+	mu   sync.Mutex
+	vals map[string]*memValue
+}
+
+// NewMemCounter returns a counter that keeps its values in memory.
+func NewMemCounter() Counter {
+	return &memCounter{vals: make(map[string]*memValue)}
+}
+
+// get returns the value for the key if it has not expired. The caller must
+// hold the lock.
+func (c *memCounter) get(key string) *memValue {
+	val, ok := c.vals[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(val.expiresAt) {
+		delete(c.vals, key)
+		return nil
+	}
+	return val
+}
+
+func (c *memCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val := c.get(key)
+	if val == nil {
+		val = &memValue{expiresAt: time.Now().Add(ttl)}
+		c.vals[key] = val
+	}
+	val.count++
+	return val.count, nil
+}
+
+func (c *memCounter) Expire(key string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if val := c.get(key); val != nil {
+		val.expiresAt = time.Now().Add(ttl)
+	}
+	return nil
+}
+
+func (c *memCounter) Get(key string) (int64, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val := c.get(key)
+	if val == nil {
+		return 0, time.Time{}, nil
+	}
+	return val.count, val.expiresAt, nil
+}
+
+func (c *memCounter) Reset(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.vals, key)
+	return nil
+}
+
+func (c *memCounter) Keys(prefix string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for key := range c.vals {
+		if strings.HasPrefix(key, prefix) && c.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
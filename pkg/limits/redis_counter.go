@@ -0,0 +1,73 @@
+package limits
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type redisCounter struct {
+	cl redis.UniversalClient
+}
+
+// NewRedisCounter returns a counter that keeps its values in redis.
+func NewRedisCounter(cl redis.UniversalClient) Counter {
+	return &redisCounter{cl: cl}
+}
+
+func (c *redisCounter) Increment(key string, ttl time.Duration) (int64, error) {
+	n, err := c.cl.Incr(key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 {
+		if err = c.cl.Expire(key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (c *redisCounter) Expire(key string, ttl time.Duration) error {
+	return c.cl.Expire(key, ttl).Err()
+}
+
+func (c *redisCounter) Get(key string) (int64, time.Time, error) {
+	n, err := c.cl.Get(key).Int64()
+	if err == redis.Nil {
+		return 0, time.Time{}, nil
+	}
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	ttl, err := c.cl.TTL(key).Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	return n, expiresAt, nil
+}
+
+func (c *redisCounter) Reset(key string) error {
+	return c.cl.Del(key).Err()
+}
+
+func (c *redisCounter) Keys(prefix string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		var batch []string
+		var err error
+		batch, cursor, err = c.cl.Scan(cursor, prefix+"*", 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
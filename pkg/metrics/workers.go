@@ -9,6 +9,13 @@ const (
 	WorkerExecResultSuccess = "success"
 	// WorkerExecResultErrored for errored result label
 	WorkerExecResultErrored = "errored"
+
+	// WorkerDLQAdded for the jobs added to a dead-letter queue
+	WorkerDLQAdded = "added"
+	// WorkerDLQReplayed for the jobs replayed from a dead-letter queue
+	WorkerDLQReplayed = "replayed"
+	// WorkerDLQPurged for the jobs purged from a dead-letter queue
+	WorkerDLQPurged = "purged"
 )
 
 // WorkerExecDurations is a histogram metric of the execution duration in
@@ -60,6 +67,22 @@ var WorkerExecRetries = prometheus.NewHistogramVec(
 	[]string{"worker_type"},
 )
 
+// WorkerDLQCounter is a counter of the jobs added to and removed from the
+// dead-letter queues, labelled by worker type and action.
+var WorkerDLQCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "workers",
+		Subsystem: "dlq",
+		Name:      "count",
+
+		Help: `Number of jobs added to and removed from the dead-letter queues, labelled by
+worker type and action (added, replayed or purged). The size of the dead-letter
+queue of a worker type is the number of added jobs minus the replayed and purged
+ones.`,
+	},
+	[]string{"worker_type", "action"},
+)
+
 // WorkersKonnectorsExecDurations is a histogram metric of the number of
 // execution durations of the commands executed for konnectors and services,
 // labelled by application slug
@@ -85,6 +108,7 @@ func init() {
 		WorkerExecDurations,
 		WorkerExecCounter,
 		WorkerExecRetries,
+		WorkerDLQCounter,
 
 		WorkersKonnectorsExecDurations,
 	)
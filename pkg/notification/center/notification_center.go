@@ -23,6 +23,9 @@ const (
 	// NotificationDiskQuota category for sending alert when reaching 90% of disk
 	// usage quota.
 	NotificationDiskQuota = "disk-quota"
+	// NotificationSharingConflict category for warning the user that a shared
+	// file has been modified at the same time on two cozy instances.
+	NotificationSharingConflict = "sharing-conflict"
 )
 
 var (
@@ -34,6 +37,11 @@ var (
 			MailTemplate: "notifications_diskquota",
 			MinInterval:  7 * 24 * time.Hour,
 		},
+		NotificationSharingConflict: {
+			Description:  "Warn about a conflict on a shared file",
+			Multiple:     true,
+			MailTemplate: "notifications_sharing_conflict",
+		},
 	}
 )
 
@@ -55,11 +63,13 @@ func init() {
 				"CozyDriveLink": cozyDriveLink.String(),
 			},
 		}
-		pushStack(domain, NotificationDiskQuota, n)
+		PushStack(domain, NotificationDiskQuota, n)
 	})
 }
 
-func pushStack(domain string, category string, n *notification.Notification) error {
+// PushStack creates and sends a new notification from the stack, for one of
+// the categories of the stack notifications.
+func PushStack(domain string, category string, n *notification.Notification) error {
 	inst, err := instance.Get(domain)
 	if err != nil {
 		return err
@@ -1,6 +1,10 @@
 package oauth
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -10,12 +14,18 @@ import (
 // AccessCode is struct used during the OAuth2 flow. It has to be persisted in
 // CouchDB, not just sent as a JSON Web Token, because it can be used only
 // once (no replay attacks).
+//
+// When the client uses PKCE (RFC 7636), the code challenge is kept with the
+// access code, to be checked against the code verifier sent by the client for
+// the access token.
 type AccessCode struct {
-	Code     string `json:"_id,omitempty"`
-	CouchRev string `json:"_rev,omitempty"`
-	ClientID string `json:"client_id"`
-	IssuedAt int64  `json:"issued_at"`
-	Scope    string `json:"scope"`
+	Code                string `json:"_id,omitempty"`
+	CouchRev            string `json:"_rev,omitempty"`
+	ClientID            string `json:"client_id"`
+	IssuedAt            int64  `json:"issued_at"`
+	Scope               string `json:"scope"`
+	CodeChallenge       string `json:"code_challenge,omitempty"`
+	CodeChallengeMethod string `json:"code_challenge_method,omitempty"`
 }
 
 // ID returns the access code qualified identifier
@@ -36,12 +46,33 @@ func (ac *AccessCode) SetID(id string) { ac.Code = id }
 // SetRev changes the access code revision
 func (ac *AccessCode) SetRev(rev string) { ac.CouchRev = rev }
 
-// CreateAccessCode an access code for the given clientID, persisted in CouchDB
-func CreateAccessCode(i *instance.Instance, clientID, scope string) (*AccessCode, error) {
+// VerifyCodeVerifier checks that the code verifier sent by the client matches
+// the code challenge of the access code. It is always true for an access code
+// without a code challenge.
+func (ac *AccessCode) VerifyCodeVerifier(verifier string) bool {
+	if ac.CodeChallenge == "" {
+		return true
+	}
+	if !validCodeVerifier(verifier) {
+		return false
+	}
+	expected := verifier
+	if ac.CodeChallengeMethod == ChallengeMethodS256 {
+		sum := sha256.Sum256([]byte(verifier))
+		expected = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(ac.CodeChallenge)) == 1
+}
+
+// CreateAccessCode an access code for the given clientID, persisted in CouchDB.
+// The code challenge and its method are optional.
+func CreateAccessCode(i *instance.Instance, clientID, scope, challenge, challengeMethod string) (*AccessCode, error) {
 	ac := &AccessCode{
-		ClientID: clientID,
-		IssuedAt: crypto.Timestamp(),
-		Scope:    scope,
+		ClientID:            clientID,
+		IssuedAt:            crypto.Timestamp(),
+		Scope:               scope,
+		CodeChallenge:       challenge,
+		CodeChallengeMethod: challengeMethod,
 	}
 	if err := couchdb.CreateDoc(i, ac); err != nil {
 		return nil, err
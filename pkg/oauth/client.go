@@ -29,6 +29,17 @@ const (
 // ClientSecretLen is the number of random bytes used for generating the client secret
 const ClientSecretLen = 24 // #nosec
 
+const (
+	// AuthMethodClientSecretPost is the authentication method of the
+	// confidential clients: they send their client_secret to the token
+	// endpoint.
+	AuthMethodClientSecretPost = "client_secret_post"
+	// AuthMethodNone is the authentication method of the public clients, like
+	// the mobile and desktop applications that can't keep a secret: they
+	// don't have a client_secret and must use PKCE.
+	AuthMethodNone = "none"
+)
+
 // ScopeLogin is the special scope used by the manager or any other client
 // for login/authentication purposes.
 const ScopeLogin = "login"
@@ -51,6 +62,8 @@ type Client struct {
 	RegistrationToken string `json:"registration_access_token,omitempty"` // Generated by the server
 	AllowLoginScope   bool   `json:"allow_login_scope,omitempty"`         // Allow to generate token for a "login" scope (no permissions)
 
+	TokenEndpointAuthMethod string `json:"token_endpoint_auth_method,omitempty"` // Declared by the client (optional, "none" for a public client)
+
 	RedirectURIs    []string `json:"redirect_uris"`              // Declared by the client (mandatory)
 	GrantTypes      []string `json:"grant_types"`                // Forced by the server to ["authorization_code", "refresh_token"]
 	ResponseTypes   []string `json:"response_types"`             // Forced by the server to ["code"]
@@ -101,6 +114,12 @@ func (c *Client) Clone() couchdb.Doc {
 	return &cloned
 }
 
+// IsPublic returns true if the client can't keep a secret, like the mobile
+// and desktop applications.
+func (c *Client) IsPublic() bool {
+	return c.TokenEndpointAuthMethod == AuthMethodNone
+}
+
 // SetID changes the client qualified identifier
 func (c *Client) SetID(id string) { c.CouchID = id }
 
@@ -219,6 +238,15 @@ func (c *Client) checkMandatoryFields(i *instance.Instance) *ClientRegistrationE
 			Description: "software_id is mandatory",
 		}
 	}
+	switch c.TokenEndpointAuthMethod {
+	case "", AuthMethodClientSecretPost, AuthMethodNone:
+	default:
+		return &ClientRegistrationError{
+			Code:        http.StatusBadRequest,
+			Error:       "invalid_client_metadata",
+			Description: "token_endpoint_auth_method is invalid",
+		}
+	}
 	c.NotificationPlatform = strings.ToLower(c.NotificationPlatform)
 	switch c.NotificationPlatform {
 	case "", PlatformFirebase, PlatformAPNS:
@@ -237,6 +265,13 @@ func (c *Client) Create(i *instance.Instance) *ClientRegistrationError {
 	if err := c.checkMandatoryFields(i); err != nil {
 		return err
 	}
+	if c.IsPublic() && !GetPolicy(i).PublicClients {
+		return &ClientRegistrationError{
+			Code:        http.StatusBadRequest,
+			Error:       "invalid_client_metadata",
+			Description: "public clients are not allowed",
+		}
+	}
 
 	var results []*Client
 	req := &couchdb.FindRequest{
@@ -284,8 +319,13 @@ func (c *Client) Create(i *instance.Instance) *ClientRegistrationError {
 	c.CouchID = ""
 	c.CouchRev = ""
 	c.ClientID = ""
-	secret := crypto.GenerateRandomBytes(ClientSecretLen)
-	c.ClientSecret = string(crypto.Base64Encode(secret))
+	if c.IsPublic() {
+		c.ClientSecret = ""
+	} else {
+		c.TokenEndpointAuthMethod = AuthMethodClientSecretPost
+		secret := crypto.GenerateRandomBytes(ClientSecretLen)
+		c.ClientSecret = string(crypto.Base64Encode(secret))
+	}
 	c.SecretExpiresAt = 0
 	c.RegistrationToken = ""
 	c.GrantTypes = []string{"authorization_code", "refresh_token"}
@@ -331,17 +371,23 @@ func (c *Client) Update(i *instance.Instance, old *Client) *ClientRegistrationEr
 		return err
 	}
 
-	switch c.ClientSecret {
-	case "":
-		c.ClientSecret = old.ClientSecret
-	case old.ClientSecret:
-		secret := crypto.GenerateRandomBytes(ClientSecretLen)
-		c.ClientSecret = string(crypto.Base64Encode(secret))
-	default:
-		return &ClientRegistrationError{
-			Code:        http.StatusBadRequest,
-			Error:       "invalid_client_secret",
-			Description: "client_secret is invalid",
+	// A public client can't become confidential, and vice versa
+	c.TokenEndpointAuthMethod = old.TokenEndpointAuthMethod
+	if old.IsPublic() {
+		c.ClientSecret = ""
+	} else {
+		switch c.ClientSecret {
+		case "":
+			c.ClientSecret = old.ClientSecret
+		case old.ClientSecret:
+			secret := crypto.GenerateRandomBytes(ClientSecretLen)
+			c.ClientSecret = string(crypto.Base64Encode(secret))
+		default:
+			return &ClientRegistrationError{
+				Code:        http.StatusBadRequest,
+				Error:       "invalid_client_secret",
+				Description: "client_secret is invalid",
+			}
 		}
 	}
 
@@ -448,6 +494,11 @@ func (c *Client) ValidToken(i *instance.Instance, audience, token string) (permi
 			Errorf("Expected %s subject for %s token, but was: %s", audience, c.CouchID, claims.Subject)
 		return claims, false
 	}
+	if permissions.IsRevoked(i, token, &claims) {
+		i.Logger().WithField("nspace", "oauth").
+			Errorf("Failed to verify the %s token: revoked", audience)
+		return claims, false
+	}
 	return claims, true
 }
 
@@ -58,6 +58,32 @@ func TestParseJWTInvalidAudience(t *testing.T) {
 	assert.False(t, ok, "The token should be invalid")
 }
 
+func TestRevokeRefreshToken(t *testing.T) {
+	revoked := &oauth.Client{CouchID: "revoked-client-id"}
+	refresh, err := revoked.CreateJWT(testInstance, "refresh", "foo:read")
+	assert.NoError(t, err)
+	access, err := revoked.CreateJWT(testInstance, "access", "foo:read")
+	assert.NoError(t, err)
+	claims, ok := revoked.ValidToken(testInstance, permissions.RefreshTokenAudience, refresh)
+	assert.True(t, ok)
+	_, ok = revoked.ValidToken(testInstance, permissions.AccessTokenAudience, access)
+	assert.True(t, ok)
+
+	// The access tokens issued before are revoked with the refresh token
+	err = permissions.RevokeToken(testInstance, refresh, &claims)
+	assert.NoError(t, err)
+	_, ok = revoked.ValidToken(testInstance, permissions.RefreshTokenAudience, refresh)
+	assert.False(t, ok)
+	_, ok = revoked.ValidToken(testInstance, permissions.AccessTokenAudience, access)
+	assert.False(t, ok)
+
+	// The tokens of the other clients are still valid
+	other, err := c.CreateJWT(testInstance, "access", "foo:read")
+	assert.NoError(t, err)
+	_, ok = c.ValidToken(testInstance, permissions.AccessTokenAudience, other)
+	assert.True(t, ok)
+}
+
 func TestCreateClient(t *testing.T) {
 	client := &oauth.Client{
 		ClientName:   "foo",
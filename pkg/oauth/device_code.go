@@ -0,0 +1,304 @@
+package oauth
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+const (
+	// DeviceCodeGrantType is the grant type for exchanging a device code
+	// against an access token, as defined by RFC 8628.
+	DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// DeviceCodeTTL is the duration during which the user can enter the user
+	// code and approve the device.
+	DeviceCodeTTL = 10 * time.Minute
+
+	// DeviceCodeInterval is the minimal number of seconds that the client
+	// must wait between two polling requests on the token endpoint. It is
+	// increased by the same amount each time the client polls too fast.
+	DeviceCodeInterval = 5
+
+	// DeviceCodePending is the status of a device code that has not been
+	// approved or denied by the user yet.
+	DeviceCodePending = "pending"
+	// DeviceCodeApproved is the status of a device code approved by the user.
+	DeviceCodeApproved = "approved"
+	// DeviceCodeDenied is the status of a device code denied by the user.
+	DeviceCodeDenied = "denied"
+)
+
+// userCodeAlphabet is the set of characters used for the user codes: only
+// consonants, to avoid ambiguous characters and forming words.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength is the number of characters of a user code (without the
+// dash).
+const userCodeLength = 8
+
+var (
+	// ErrAuthorizationPending is returned when the user has not approved the
+	// device yet.
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	// ErrSlowDown is returned when the client polls faster than the interval.
+	ErrSlowDown = errors.New("slow_down")
+	// ErrAccessDenied is returned when the user has denied the device.
+	ErrAccessDenied = errors.New("access_denied")
+	// ErrExpiredToken is returned when the device code has expired.
+	ErrExpiredToken = errors.New("expired_token")
+	// ErrInvalidDeviceCode is returned when the device code or the user code
+	// is unknown.
+	ErrInvalidDeviceCode = errors.New("invalid device code")
+)
+
+// DeviceCode is used by the device authorization grant (RFC 8628), for the
+// clients that can't open a browser, like a CLI or a smart TV. The user code
+// is used as the identifier of the document, and the device code sent to the
+// client is the user code followed by a secret.
+type DeviceCode struct {
+	UserCode   string `json:"_id,omitempty"`
+	CouchRev   string `json:"_rev,omitempty"`
+	Secret     string `json:"secret"`
+	ClientID   string `json:"client_id"`
+	Scope      string `json:"scope"`
+	Status     string `json:"status"`
+	IssuedAt   int64  `json:"issued_at"`
+	Interval   int64  `json:"interval"`
+	LastPollAt int64  `json:"last_poll_at,omitempty"`
+}
+
+// ID returns the device code qualified identifier
+func (dc *DeviceCode) ID() string { return dc.UserCode }
+
+// Rev returns the device code revision
+func (dc *DeviceCode) Rev() string { return dc.CouchRev }
+
+// DocType returns the device code document type
+func (dc *DeviceCode) DocType() string { return consts.OAuthDeviceCodes }
+
+// Clone implements couchdb.Doc
+func (dc *DeviceCode) Clone() couchdb.Doc { cloned := *dc; return &cloned }
+
+// SetID changes the device code qualified identifier
+func (dc *DeviceCode) SetID(id string) { dc.UserCode = id }
+
+// SetRev changes the device code revision
+func (dc *DeviceCode) SetRev(rev string) { dc.CouchRev = rev }
+
+// DeviceCode returns the code that the client must send to the token
+// endpoint.
+func (dc *DeviceCode) DeviceCode() string {
+	return dc.UserCode + "." + dc.Secret
+}
+
+// DisplayUserCode returns the user code in a format easier to read and type,
+// like BCDF-GHJK.
+func (dc *DeviceCode) DisplayUserCode() string {
+	return dc.UserCode[:userCodeLength/2] + "-" + dc.UserCode[userCodeLength/2:]
+}
+
+// ExpiresIn returns the number of seconds before the expiration of the code.
+func (dc *DeviceCode) ExpiresIn() int64 {
+	return dc.IssuedAt + int64(DeviceCodeTTL/time.Second) - crypto.Timestamp()
+}
+
+// Expired returns true if the device code can no longer be used.
+func (dc *DeviceCode) Expired() bool {
+	return dc.ExpiresIn() <= 0
+}
+
+// Approve marks the device code as approved by the user.
+func (dc *DeviceCode) Approve(i *instance.Instance) error {
+	dc.Status = DeviceCodeApproved
+	return couchdb.UpdateDoc(i, dc)
+}
+
+// Deny marks the device code as denied by the user.
+func (dc *DeviceCode) Deny(i *instance.Instance) error {
+	dc.Status = DeviceCodeDenied
+	return couchdb.UpdateDoc(i, dc)
+}
+
+// Poll is called when the client asks for an access token with the device
+// code. It returns nil if the user has approved the device, or else the
+// error that must be sent to the client. The code is deleted when it can no
+// longer be used.
+func (dc *DeviceCode) Poll(i *instance.Instance) error {
+	if dc.Expired() {
+		dc.delete(i)
+		return ErrExpiredToken
+	}
+	switch dc.Status {
+	case DeviceCodeApproved:
+		return nil
+	case DeviceCodeDenied:
+		dc.delete(i)
+		return ErrAccessDenied
+	}
+
+	now := crypto.Timestamp()
+	tooFast := dc.LastPollAt > 0 && now-dc.LastPollAt < dc.Interval
+	if tooFast {
+		dc.Interval += DeviceCodeInterval
+	}
+	dc.LastPollAt = now
+	if err := couchdb.UpdateDoc(i, dc); err != nil {
+		return err
+	}
+	if tooFast {
+		return ErrSlowDown
+	}
+	return ErrAuthorizationPending
+}
+
+// Consume deletes the device code before the tokens are issued, as it can be
+// used only once. The deletion is made with the revision of the document: if
+// another request has already consumed the code, ErrInvalidDeviceCode is
+// returned and no tokens must be issued.
+func (dc *DeviceCode) Consume(i *instance.Instance) error {
+	if err := couchdb.DeleteDoc(i, dc); err != nil {
+		if couchdb.IsConflictError(err) || couchdb.IsNotFoundError(err) {
+			return ErrInvalidDeviceCode
+		}
+		return err
+	}
+	return nil
+}
+
+func (dc *DeviceCode) delete(i *instance.Instance) {
+	if err := couchdb.DeleteDoc(i, dc); err != nil {
+		i.Logger().Errorf("[oauth] Failed to delete the device code: %s", err)
+	}
+}
+
+// CreateDeviceCode creates a device code for the given client, persisted in
+// CouchDB. The expired device codes, that the clients have stopped polling,
+// are deleted at the same time.
+func CreateDeviceCode(i *instance.Instance, clientID, scope string) (*DeviceCode, error) {
+	cleanExpiredDeviceCodes(i)
+	var err error
+	for k := 0; k < 3; k++ {
+		dc := &DeviceCode{
+			UserCode: generateUserCode(),
+			Secret:   base64.RawURLEncoding.EncodeToString(crypto.GenerateRandomBytes(24)),
+			ClientID: clientID,
+			Scope:    scope,
+			Status:   DeviceCodePending,
+			IssuedAt: crypto.Timestamp(),
+			Interval: DeviceCodeInterval,
+		}
+		err = couchdb.CreateNamedDocWithDB(i, dc)
+		if err == nil {
+			return dc, nil
+		}
+		// Retry with another user code if this one is already taken
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// FindDeviceCodeByUserCode returns the device code for the user code typed
+// by the user. The user code is case-insensitive, and the dashes and spaces
+// are ignored.
+func FindDeviceCodeByUserCode(i *instance.Instance, userCode string) (*DeviceCode, error) {
+	userCode = normalizeUserCode(userCode)
+	if len(userCode) != userCodeLength {
+		return nil, ErrInvalidDeviceCode
+	}
+	dc := &DeviceCode{}
+	if err := couchdb.GetDoc(i, consts.OAuthDeviceCodes, userCode, dc); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidDeviceCode
+		}
+		return nil, err
+	}
+	if dc.Expired() {
+		return nil, ErrExpiredToken
+	}
+	return dc, nil
+}
+
+// FindDeviceCode returns the device code sent by the client to the token
+// endpoint.
+func FindDeviceCode(i *instance.Instance, deviceCode string) (*DeviceCode, error) {
+	parts := strings.SplitN(deviceCode, ".", 2)
+	if len(parts) != 2 || len(parts[0]) != userCodeLength {
+		return nil, ErrInvalidDeviceCode
+	}
+	dc := &DeviceCode{}
+	if err := couchdb.GetDoc(i, consts.OAuthDeviceCodes, parts[0], dc); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidDeviceCode
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(parts[1]), []byte(dc.Secret)) == 0 {
+		return nil, ErrInvalidDeviceCode
+	}
+	return dc, nil
+}
+
+// maxDeviceCodesCleaned is the maximal number of device codes that are
+// looked at when cleaning the expired ones.
+const maxDeviceCodesCleaned = 100
+
+// cleanExpiredDeviceCodes deletes the device codes that have expired. The
+// codes are deleted when they are polled after their expiration, but a
+// client can stop polling before that.
+func cleanExpiredDeviceCodes(i *instance.Instance) {
+	var codes []*DeviceCode
+	req := &couchdb.AllDocsRequest{Limit: maxDeviceCodesCleaned}
+	if err := couchdb.GetAllDocs(i, consts.OAuthDeviceCodes, req, &codes); err != nil {
+		if !couchdb.IsNoDatabaseError(err) {
+			i.Logger().Errorf("[oauth] Failed to list the device codes: %s", err)
+		}
+		return
+	}
+	var expired []couchdb.Doc
+	for _, dc := range codes {
+		if dc.Expired() {
+			expired = append(expired, dc)
+		}
+	}
+	if err := couchdb.BulkDeleteDocs(i, consts.OAuthDeviceCodes, expired); err != nil {
+		i.Logger().Errorf("[oauth] Failed to delete the expired device codes: %s", err)
+	}
+}
+
+func generateUserCode() string {
+	code := make([]byte, 0, userCodeLength)
+	for len(code) < userCodeLength {
+		for _, b := range crypto.GenerateRandomBytes(userCodeLength) {
+			// Reject the bytes that would introduce a bias in the distribution
+			if int(b) >= 256-256%len(userCodeAlphabet) {
+				continue
+			}
+			code = append(code, userCodeAlphabet[int(b)%len(userCodeAlphabet)])
+			if len(code) == userCodeLength {
+				break
+			}
+		}
+	}
+	return string(code)
+}
+
+func normalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.Replace(userCode, "-", "", -1)
+	userCode = strings.Replace(userCode, " ", "", -1)
+	return userCode
+}
+
+var (
+	_ couchdb.Doc = &DeviceCode{}
+)
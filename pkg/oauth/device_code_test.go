@@ -0,0 +1,47 @@
+package oauth_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceCodeConsumedOnce(t *testing.T) {
+	dc, err := oauth.CreateDeviceCode(testInstance, "my-client-id", "files:read")
+	if !assert.NoError(t, err) {
+		return
+	}
+	first, err := oauth.FindDeviceCode(testInstance, dc.DeviceCode())
+	assert.NoError(t, err)
+	second, err := oauth.FindDeviceCode(testInstance, dc.DeviceCode())
+	assert.NoError(t, err)
+
+	assert.NoError(t, first.Consume(testInstance))
+	assert.Equal(t, oauth.ErrInvalidDeviceCode, second.Consume(testInstance))
+	_, err = oauth.FindDeviceCode(testInstance, dc.DeviceCode())
+	assert.Equal(t, oauth.ErrInvalidDeviceCode, err)
+}
+
+func TestExpiredDeviceCodesAreCleaned(t *testing.T) {
+	old, err := oauth.CreateDeviceCode(testInstance, "my-client-id", "files:read")
+	if !assert.NoError(t, err) {
+		return
+	}
+	old.IssuedAt = time.Now().Add(-oauth.DeviceCodeTTL - time.Minute).Unix()
+	if !assert.NoError(t, couchdb.UpdateDoc(testInstance, old)) {
+		return
+	}
+
+	recent, err := oauth.CreateDeviceCode(testInstance, "my-client-id", "files:read")
+	if !assert.NoError(t, err) {
+		return
+	}
+	err = couchdb.GetDoc(testInstance, consts.OAuthDeviceCodes, old.ID(), &oauth.DeviceCode{})
+	assert.True(t, couchdb.IsNotFoundError(err))
+	err = couchdb.GetDoc(testInstance, consts.OAuthDeviceCodes, recent.ID(), &oauth.DeviceCode{})
+	assert.NoError(t, err)
+}
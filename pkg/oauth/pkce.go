@@ -0,0 +1,98 @@
+package oauth
+
+import (
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+const (
+	// ChallengeMethodS256 is the PKCE method where the code challenge is the
+	// SHA-256 of the code verifier, encoded in base64url.
+	ChallengeMethodS256 = "S256"
+	// ChallengeMethodPlain is the PKCE method where the code challenge is the
+	// code verifier itself.
+	ChallengeMethodPlain = "plain"
+)
+
+// Policy is the set of rules for the OAuth clients of an instance. It can be
+// configured for the context of the instance, in its oauth section:
+//
+//	contexts:
+//	  my-context:
+//	    oauth:
+//	      pkce_required: true
+//	      pkce_plain: false
+//	      public_clients: true
+type Policy struct {
+	// PKCERequired is true when all the clients must use PKCE for the
+	// authorization code flow. The public clients must always use it.
+	PKCERequired bool
+	// PKCEPlain is true when the plain method is accepted for the code
+	// challenges. By default, only S256 is accepted.
+	PKCEPlain bool
+	// PublicClients is false when the registration of new public clients is
+	// refused.
+	PublicClients bool
+}
+
+// GetPolicy returns the policy for the OAuth clients of the given instance.
+func GetPolicy(i *instance.Instance) Policy {
+	policy := Policy{PublicClients: true}
+	context, err := i.SettingsContext()
+	if err != nil {
+		return policy
+	}
+	settings, ok := context["oauth"].(map[string]interface{})
+	if !ok {
+		return policy
+	}
+	if required, ok := settings["pkce_required"].(bool); ok {
+		policy.PKCERequired = required
+	}
+	if plain, ok := settings["pkce_plain"].(bool); ok {
+		policy.PKCEPlain = plain
+	}
+	if public, ok := settings["public_clients"].(bool); ok {
+		policy.PublicClients = public
+	}
+	return policy
+}
+
+// RequirePKCE returns true if the given client must use PKCE.
+func (p Policy) RequirePKCE(c *Client) bool {
+	return p.PKCERequired || c.IsPublic()
+}
+
+// AcceptChallengeMethod returns true if the given code challenge method can
+// be used. An empty method means plain, as defined by RFC 7636.
+func (p Policy) AcceptChallengeMethod(method string) bool {
+	switch method {
+	case ChallengeMethodS256:
+		return true
+	case "", ChallengeMethodPlain:
+		return p.PKCEPlain
+	}
+	return false
+}
+
+// ValidCodeChallenge returns true if the given code challenge has the format
+// of a code verifier (or of its SHA-256 for the S256 method).
+func ValidCodeChallenge(challenge string) bool {
+	return validCodeVerifier(challenge)
+}
+
+// validCodeVerifier checks that the code verifier has between 43 and 128
+// characters from the unreserved set of RFC 3986.
+func validCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
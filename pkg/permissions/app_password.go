@@ -0,0 +1,182 @@
+package permissions
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// An app password is a password for the clients that can't use OAuth, like
+// the WebDAV mounts or some scripts. It is given by the client with the HTTP
+// basic authentication, and it is valid only for a restricted set of
+// permissions.
+//
+// The app password is made of two parts in hexadecimal: the identifier of its
+// document, followed by a secret. Only a hash of the secret is persisted. As
+// the secret is random and long, a single round of SHA-256 is enough, and it
+// avoids spending time on a slow hash for each request of the client.
+
+const (
+	appPasswordIDLength     = 8
+	appPasswordSecretLength = 16
+
+	// AppPasswordLength is the number of characters of an app password.
+	AppPasswordLength = 2 * (appPasswordIDLength + appPasswordSecretLength)
+)
+
+// lastUsedPrecision is the minimal duration between two updates of the
+// last-used date of an app password, to avoid a write in CouchDB for each
+// request of a client.
+const lastUsedPrecision = 1 * time.Minute
+
+// ErrInvalidAppPassword is used when an app password is unknown or invalid.
+var ErrInvalidAppPassword = errors.New("Invalid app password")
+
+// AppPassword is the document of an app password.
+type AppPassword struct {
+	DocID       string     `json:"_id,omitempty"`
+	DocRev      string     `json:"_rev,omitempty"`
+	Name        string     `json:"name"`
+	Hash        []byte     `json:"hash"`
+	Permissions Set        `json:"permissions"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+}
+
+// ID implements couchdb.Doc
+func (a *AppPassword) ID() string { return a.DocID }
+
+// Rev implements couchdb.Doc
+func (a *AppPassword) Rev() string { return a.DocRev }
+
+// DocType implements couchdb.Doc
+func (a *AppPassword) DocType() string { return consts.AppPasswords }
+
+// SetID implements couchdb.Doc
+func (a *AppPassword) SetID(id string) { a.DocID = id }
+
+// SetRev implements couchdb.Doc
+func (a *AppPassword) SetRev(rev string) { a.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (a *AppPassword) Clone() couchdb.Doc {
+	cloned := *a
+	cloned.Hash = make([]byte, len(a.Hash))
+	copy(cloned.Hash, a.Hash)
+	cloned.Permissions = make(Set, len(a.Permissions))
+	copy(cloned.Permissions, a.Permissions)
+	if a.LastUsedAt != nil {
+		last := *a.LastUsedAt
+		cloned.LastUsedAt = &last
+	}
+	return &cloned
+}
+
+// Permission returns the non-persisted permission document for the requests
+// made with this app password.
+func (a *AppPassword) Permission() *Permission {
+	return &Permission{
+		Type:        TypeAppPassword,
+		Permissions: a.Permissions,
+		SourceID:    consts.AppPasswords + "/" + a.DocID,
+	}
+}
+
+// Revoke deletes the app password: it can't be used anymore.
+func (a *AppPassword) Revoke(db prefixer.Prefixer) error {
+	return couchdb.DeleteDoc(db, a)
+}
+
+// CreateAppPassword creates a new app password with the given name and set
+// of permissions. The password is returned in clear, and it is the only time
+// it can be known.
+func CreateAppPassword(db prefixer.Prefixer, name string, set Set) (*AppPassword, string, error) {
+	id := hex.EncodeToString(crypto.GenerateRandomBytes(appPasswordIDLength))
+	secret := hex.EncodeToString(crypto.GenerateRandomBytes(appPasswordSecretLength))
+	hash := sha256.Sum256([]byte(secret))
+	a := &AppPassword{
+		DocID:       id,
+		Name:        name,
+		Hash:        hash[:],
+		Permissions: set,
+		CreatedAt:   time.Now(),
+	}
+	if err := couchdb.CreateNamedDocWithDB(db, a); err != nil {
+		return nil, "", err
+	}
+	return a, id + secret, nil
+}
+
+// GetAppPassword returns the app password with the given identifier.
+func GetAppPassword(db prefixer.Prefixer, id string) (*AppPassword, error) {
+	var a AppPassword
+	if err := couchdb.GetDoc(db, consts.AppPasswords, id, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// GetAppPasswords returns all the app passwords of the instance, the most
+// recent first.
+func GetAppPasswords(db prefixer.Prefixer) ([]*AppPassword, error) {
+	var list []*AppPassword
+	err := couchdb.GetAllDocs(db, consts.AppPasswords, nil, &list)
+	if err != nil && !couchdb.IsNoDatabaseError(err) {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+// IsAppPassword returns true if the given string has the format of an app
+// password. It is used to tell them apart from the tokens.
+func IsAppPassword(password string) bool {
+	if len(password) != AppPasswordLength {
+		return false
+	}
+	_, err := hex.DecodeString(password)
+	return err == nil
+}
+
+// CheckAppPassword returns the app password document for the given password,
+// or ErrInvalidAppPassword if the password is not valid. The last-used date
+// of the app password is updated.
+func CheckAppPassword(db prefixer.Prefixer, password string) (*AppPassword, error) {
+	if !IsAppPassword(password) {
+		return nil, ErrInvalidAppPassword
+	}
+	id := password[:2*appPasswordIDLength]
+	secret := password[2*appPasswordIDLength:]
+	a, err := GetAppPassword(db, id)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrInvalidAppPassword
+		}
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare(hash[:], a.Hash) != 1 {
+		return nil, ErrInvalidAppPassword
+	}
+
+	now := time.Now()
+	if a.LastUsedAt == nil || now.Sub(*a.LastUsedAt) > lastUsedPrecision {
+		a.LastUsedAt = &now
+		if err := couchdb.UpdateDoc(db, a); err != nil && !couchdb.IsConflictError(err) {
+			logger.WithDomain(db.DomainName()).WithField("nspace", "permissions").
+				Warnf("Cannot update the last use of the app password %s: %s", id, err)
+		}
+	}
+	return a, nil
+}
@@ -18,9 +18,12 @@ var blackList = map[string]bool{
 	consts.Intents:          none,
 	consts.OAuthClients:     none,
 	consts.OAuthAccessCodes: none,
+	consts.OAuthDeviceCodes: none,
+	consts.RevokedTokens:    none,
 	consts.Archives:         none,
 	consts.Sharings:         none,
 	consts.Shared:           none,
+	consts.AppPasswords:     none,
 
 	// TODO: uncomment to restric jobs permissions (make these none instead of
 	// readable).
@@ -34,6 +37,11 @@ var blackList = map[string]bool{
 	consts.Notifications:  readable,
 	consts.RemoteRequests: readable,
 	consts.SessionsLogins: readable,
+
+	consts.PermissionsAccesses: readable,
+	consts.Audit:               readable,
+	consts.SharingsActivity:    readable,
+	consts.SharingsConflicts:   readable,
 }
 
 // CheckReadable will abort the context and returns false if the doctype
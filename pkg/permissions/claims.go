@@ -12,6 +12,7 @@ const (
 	KonnectorAudience         = "konn"         // used by konnectors
 	CLIAudience               = "cli"          // used by command line interface
 	ShareAudience             = "share"        // used for share by links code
+	UnlockedShareAudience     = "unlocked"     // share by links code after the password check
 	RegistrationTokenAudience = "registration" // OAuth registration tokens
 	AccessTokenAudience       = "access"       // OAuth access tokens
 	RefreshTokenAudience      = "refresh"      // OAuth refresh tokens
@@ -43,6 +44,16 @@ func (claims *Claims) IssuedAtUTC() time.Time {
 
 // Expired returns true if a Claim is expired
 func (claims *Claims) Expired() bool {
+	validUntil, ok := claims.ExpiresAtUTC()
+	if !ok {
+		return false
+	}
+	return validUntil.Before(time.Now().UTC())
+}
+
+// ExpiresAtUTC returns the time after which the token is no longer valid. The
+// boolean is false for the tokens that never expire.
+func (claims *Claims) ExpiresAtUTC() (time.Time, bool) {
 	var validityDuration time.Duration
 	switch claims.Audience {
 	case AppAudience:
@@ -66,11 +77,10 @@ func (claims *Claims) Expired() bool {
 
 	// Share, RefreshToken and RegistrationToken never expire
 	case ShareAudience, RegistrationTokenAudience, RefreshTokenAudience:
-		return false
+		return time.Time{}, false
 
 	default:
 		validityDuration = DefaultValidityDuration
 	}
-	validUntil := claims.IssuedAtUTC().Add(validityDuration)
-	return validUntil.Before(time.Now().UTC())
+	return claims.IssuedAtUTC().Add(validityDuration), true
 }
@@ -0,0 +1,248 @@
+package permissions
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// The rules can have some conditions, in addition to the doctype, verbs and
+// values: a validity window, a list of allowed IP ranges, a maximal number of
+// uses, and a list of fields to redact on read. In a scope string, they are
+// added after the rule, separated by semicolons:
+//
+//	io.cozy.files:GET:some-id;not_after=1541164800;ip=192.168.0.0/16;max_uses=3
+//	io.cozy.contacts:GET;redact=phone,address
+//
+// The times are unix timestamps, and the IP ranges and redacted fields are
+// separated by commas.
+
+const condSep = ";"
+const condAssign = "="
+
+const (
+	condNotBefore = "not_before"
+	condNotAfter  = "not_after"
+	condIP        = "ip"
+	condMaxUses   = "max_uses"
+	condRedact    = "redact"
+)
+
+// HasConditions returns true if the rule has at least one condition.
+func (r Rule) HasConditions() bool {
+	return r.NotBefore != nil || r.NotAfter != nil || len(r.IPRanges) > 0 ||
+		r.MaxUses > 0 || len(r.Redact) > 0
+}
+
+// ValidAt returns true if the given time is in the validity window of the
+// rule.
+func (r Rule) ValidAt(t time.Time) bool {
+	if r.NotBefore != nil && t.Before(*r.NotBefore) {
+		return false
+	}
+	if r.NotAfter != nil && t.After(*r.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// AllowIP returns true if the given IP is in one of the allowed ranges of the
+// rule, or if the rule has no IP ranges.
+func (r Rule) AllowIP(ip net.IP) bool {
+	if len(r.IPRanges) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range r.IPRanges {
+		if _, ipnet, err := parseIPRange(cidr); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) sameConditions(other Rule) bool {
+	return reflect.DeepEqual(r.NotBefore, other.NotBefore) &&
+		reflect.DeepEqual(r.NotAfter, other.NotAfter) &&
+		reflect.DeepEqual(r.IPRanges, other.IPRanges) &&
+		r.MaxUses == other.MaxUses &&
+		reflect.DeepEqual(r.Redact, other.Redact)
+}
+
+func (r Rule) marshalConditions() string {
+	out := ""
+	if r.NotBefore != nil {
+		out += condSep + condNotBefore + condAssign + strconv.FormatInt(r.NotBefore.Unix(), 10)
+	}
+	if r.NotAfter != nil {
+		out += condSep + condNotAfter + condAssign + strconv.FormatInt(r.NotAfter.Unix(), 10)
+	}
+	if len(r.IPRanges) > 0 {
+		out += condSep + condIP + condAssign + strings.Join(r.IPRanges, valueSep)
+	}
+	if r.MaxUses > 0 {
+		out += condSep + condMaxUses + condAssign + strconv.Itoa(r.MaxUses)
+	}
+	if len(r.Redact) > 0 {
+		out += condSep + condRedact + condAssign + strings.Join(r.Redact, valueSep)
+	}
+	return out
+}
+
+func (r *Rule) unmarshalCondition(in string) error {
+	parts := strings.SplitN(in, condAssign, 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return ErrBadScope
+	}
+	key, value := parts[0], parts[1]
+	switch key {
+	case condNotBefore, condNotAfter:
+		ts, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return ErrBadScope
+		}
+		t := time.Unix(ts, 0).UTC()
+		if key == condNotBefore {
+			r.NotBefore = &t
+		} else {
+			r.NotAfter = &t
+		}
+	case condIP:
+		r.IPRanges = strings.Split(value, valueSep)
+		for _, cidr := range r.IPRanges {
+			if _, _, err := parseIPRange(cidr); err != nil {
+				return ErrBadScope
+			}
+		}
+	case condMaxUses:
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return ErrBadScope
+		}
+		r.MaxUses = n
+	case condRedact:
+		r.Redact = strings.Split(value, valueSep)
+	default:
+		return ErrBadScope
+	}
+	return nil
+}
+
+// parseIPRange parses a CIDR, or a single IP address.
+func parseIPRange(cidr string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, nil, ErrBadScope
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	return net.ParseCIDR(cidr)
+}
+
+// usesKey returns the key used to count the uses of the rule in the
+// permission document. The title of a rule is optional, so the scope string of
+// the rule is used instead.
+func (r Rule) usesKey() string {
+	key, _ := r.MarshalScopeString()
+	return key
+}
+
+// remainingUses returns false if the rule can no longer be used. The uses
+// are counted in the permission document, so a rule with a maximal number of
+// uses can't be used for a permission without a document (OAuth or CLI).
+func (p *Permission) remainingUses(r Rule) bool {
+	if r.MaxUses == 0 {
+		return true
+	}
+	if p.PID == "" {
+		return false
+	}
+	return p.Uses[r.usesKey()] < r.MaxUses
+}
+
+// ApplicableRules returns the rules of the permission whose conditions are
+// fulfilled for a request made at the given time, from the given IP.
+func (p *Permission) ApplicableRules(t time.Time, ip net.IP) Set {
+	set := make(Set, 0, len(p.Permissions))
+	for _, r := range p.Permissions {
+		if r.ValidAt(t) && r.AllowIP(ip) && p.remainingUses(r) {
+			set = append(set, r)
+		}
+	}
+	return set
+}
+
+// HasConditions returns true if at least one rule of the permission has
+// conditions.
+func (p *Permission) HasConditions() bool {
+	return p.Permissions.Some(func(r Rule) bool { return r.HasConditions() })
+}
+
+// ConsumeUse increments the number of uses of the given rule, and persists it
+// in the permission document.
+func (p *Permission) ConsumeUse(db prefixer.Prefixer, r Rule) error {
+	if r.MaxUses == 0 {
+		return nil
+	}
+	if p.Uses == nil {
+		p.Uses = make(map[string]int)
+	}
+	p.Uses[r.usesKey()]++
+	return couchdb.UpdateDoc(db, p)
+}
+
+// RedactedFields returns the fields that must be redacted for a document
+// allowed by the given rules: a field is redacted only if all the rules
+// redact it.
+func RedactedFields(rules Set) []string {
+	if len(rules) == 0 {
+		return nil
+	}
+	fields := rules[0].Redact
+	for _, r := range rules[1:] {
+		var kept []string
+		for _, f := range fields {
+			for _, f2 := range r.Redact {
+				if f == f2 {
+					kept = append(kept, f)
+					break
+				}
+			}
+		}
+		fields = kept
+	}
+	return fields
+}
+
+// RedactDoc removes the given fields from a document. The fields can be
+// nested, with a dot as separator, like metadata.gps.
+func RedactDoc(doc map[string]interface{}, fields []string) {
+	for _, field := range fields {
+		m := doc
+		parts := strings.Split(field, ".")
+		for _, part := range parts[:len(parts)-1] {
+			sub, ok := m[part].(map[string]interface{})
+			if !ok {
+				m = nil
+				break
+			}
+			m = sub
+		}
+		if m != nil {
+			delete(m, parts[len(parts)-1])
+		}
+	}
+}
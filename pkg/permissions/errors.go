@@ -38,4 +38,14 @@ var (
 	// ErrNotParent is used when the permissions should have a specific parent.
 	ErrNotParent = echo.NewHTTPError(http.StatusForbidden,
 		"Permissions can be updated only by its parent")
+
+	// ErrPasswordRequired is used when a share by link is protected by a
+	// password, and the code has been used without checking the password.
+	ErrPasswordRequired = echo.NewHTTPError(http.StatusUnauthorized,
+		"A password is required for this share by link")
+
+	// ErrDownloadLimitReached is used when the maximal number of downloads of
+	// a share by link has been reached.
+	ErrDownloadLimitReached = echo.NewHTTPError(http.StatusForbidden,
+		"The maximal number of downloads has been reached")
 )
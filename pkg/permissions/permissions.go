@@ -10,6 +10,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 )
 
@@ -23,6 +24,13 @@ type Permission struct {
 	Permissions Set               `json:"permissions,omitempty"`
 	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
 	Codes       map[string]string `json:"codes,omitempty"`
+	Uses        map[string]int    `json:"uses,omitempty"`
+
+	// Password is the hash of the password for a share by link, if any
+	Password      []byte     `json:"password,omitempty"`
+	MaxDownloads  int        `json:"max_downloads,omitempty"`
+	Downloads     int        `json:"downloads,omitempty"`
+	FirstAccessAt *time.Time `json:"first_access_at,omitempty"`
 
 	Client interface{} `json:"-"` // Contains the *oauth.Client client pointer for Oauth permission type
 }
@@ -50,6 +58,10 @@ const (
 	// TypeSharePreview is the value of Permission.Type to preview a
 	// cozy-to-cozy sharing
 	TypeSharePreview = "share-preview"
+
+	// TypeAppPassword is the value of Permission.Type for the permissions of
+	// an app password, used with the HTTP basic authentication
+	TypeAppPassword = "app-password"
 )
 
 // ID implements jsonapi.Doc
@@ -68,6 +80,20 @@ func (p *Permission) Clone() couchdb.Doc {
 	for k, v := range p.Codes {
 		cloned.Codes[k] = v
 	}
+	if p.Password != nil {
+		cloned.Password = make([]byte, len(p.Password))
+		copy(cloned.Password, p.Password)
+	}
+	if p.FirstAccessAt != nil {
+		firstAccessAt := *p.FirstAccessAt
+		cloned.FirstAccessAt = &firstAccessAt
+	}
+	if p.Uses != nil {
+		cloned.Uses = make(map[string]int)
+		for k, v := range p.Uses {
+			cloned.Uses[k] = v
+		}
+	}
 	cloned.Permissions = make([]Rule, len(p.Permissions))
 	for i, r := range p.Permissions {
 		vals := r.Values
@@ -114,9 +140,18 @@ func (p *Permission) PatchCodes(codes map[string]string) {
 	p.Codes = codes
 }
 
-// Revoke destroy a Permission
+// Revoke destroy a Permission, and the access log of a share by link
 func (p *Permission) Revoke(db prefixer.Prefixer) error {
-	return couchdb.DeleteDoc(db, p)
+	if err := couchdb.DeleteDoc(db, p); err != nil {
+		return err
+	}
+	if p.Type == TypeShareByLink {
+		if err := deleteShareAccesses(db, p.PID, 0); err != nil {
+			logger.WithDomain(db.DomainName()).WithField("nspace", "permissions").
+				Errorf("Cannot delete the access log of %s: %s", p.PID, err)
+		}
+	}
+	return nil
 }
 
 // ParentOf check if child has been created by p
@@ -256,26 +291,52 @@ func GetForShareCode(db prefixer.Prefixer, tokenCode string) (*Permission, error
 	if perm.Expired() {
 		return nil, ErrExpiredToken
 	}
+	if err := checkShareSource(db, perm); err != nil {
+		return nil, err
+	}
+	return perm, nil
+}
 
-	// Check for sharing made by a webapp/konnector that the app is still
-	// present (but not for OAuth). It is not checked in development release,
-	// since the --appdir does not create the expected document.
-	if !config.IsDevRelease() {
-		parts := strings.SplitN(perm.SourceID, "/", 2)
-		if len(parts) == 2 {
-			var doc couchdb.JSONDoc
-			docID := parts[0] + "/" + parts[1]
-			if parts[0] == consts.Sharings {
-				docID = parts[1]
-			}
-			if err := couchdb.GetDoc(db, parts[0], docID, &doc); err != nil {
-				return nil, ErrExpiredToken
-			}
+// GetForUnlockedShare retrieves the Permission doc of a share by link, for a
+// token given after the password of the share has been checked.
+func GetForUnlockedShare(db prefixer.Prefixer, permID string) (*Permission, error) {
+	perm, err := GetByID(db, permID)
+	if err != nil {
+		if couchdb.IsNotFoundError(err) {
+			return nil, ErrInvalidToken
 		}
+		return nil, err
+	}
+	if perm.Type != TypeShareByLink {
+		return nil, ErrInvalidToken
+	}
+	if err := checkShareSource(db, perm); err != nil {
+		return nil, err
 	}
 	return perm, nil
 }
 
+// checkShareSource checks for sharing made by a webapp/konnector that the app
+// is still present (but not for OAuth). It is not checked in development
+// release, since the --appdir does not create the expected document.
+func checkShareSource(db prefixer.Prefixer, perm *Permission) error {
+	if config.IsDevRelease() {
+		return nil
+	}
+	parts := strings.SplitN(perm.SourceID, "/", 2)
+	if len(parts) == 2 {
+		var doc couchdb.JSONDoc
+		docID := parts[0] + "/" + parts[1]
+		if parts[0] == consts.Sharings {
+			docID = parts[1]
+		}
+		if err := couchdb.GetDoc(db, parts[0], docID, &doc); err != nil {
+			return ErrExpiredToken
+		}
+	}
+	return nil
+}
+
 // CreateWebappSet creates a Permission doc for an app
 func CreateWebappSet(db prefixer.Prefixer, slug string, set Set) (*Permission, error) {
 	existing, _ := GetForWebapp(db, slug)
@@ -334,8 +395,15 @@ func updateAppSet(db prefixer.Prefixer, doc *Permission, typ, docType, slug stri
 	return doc, nil
 }
 
+// ShareOptions are the optional parameters for a share by link.
+type ShareOptions struct {
+	ExpiresAt    *time.Time
+	Password     string
+	MaxDownloads int
+}
+
 // CreateShareSet creates a Permission doc for sharing by link
-func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]string, set Set, expiresAt *time.Time) (*Permission, error) {
+func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]string, set Set, opts ShareOptions) (*Permission, error) {
 	if parent.Type != TypeWebapp && parent.Type != TypeKonnector && parent.Type != TypeOauth {
 		return nil, ErrOnlyAppCanCreateSubSet
 	}
@@ -356,11 +424,17 @@ func CreateShareSet(db prefixer.Prefixer, parent *Permission, codes map[string]s
 
 	// SourceID stays the same, allow quick destruction of all children permissions
 	doc := &Permission{
-		Type:        TypeShareByLink,
-		SourceID:    parent.SourceID,
-		Permissions: set,
-		Codes:       codes,
-		ExpiresAt:   expiresAt,
+		Type:         TypeShareByLink,
+		SourceID:     parent.SourceID,
+		Permissions:  set,
+		Codes:        codes,
+		ExpiresAt:    opts.ExpiresAt,
+		MaxDownloads: opts.MaxDownloads,
+	}
+	if opts.Password != "" {
+		if err := doc.SetPassword(opts.Password); err != nil {
+			return nil, err
+		}
 	}
 
 	err := couchdb.CreateDoc(db, doc)
@@ -3,8 +3,10 @@ package permissions
 import (
 	"bytes"
 	"encoding/json"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cozy/echo"
 	"github.com/stretchr/testify/assert"
@@ -208,6 +210,84 @@ func TestStringToSet(t *testing.T) {
 
 }
 
+func TestScopeStringWithConditions(t *testing.T) {
+	rule, err := UnmarshalRuleString("io.cozy.files:GET:some-id;not_before=1500000000;not_after=1600000000;ip=192.168.0.0/16,2001:db8::/32;max_uses=3")
+	assert.NoError(t, err)
+	assert.Equal(t, "io.cozy.files", rule.Type)
+	assert.Equal(t, Verbs(GET), rule.Verbs)
+	assert.Equal(t, []string{"some-id"}, rule.Values)
+	assert.Equal(t, int64(1500000000), rule.NotBefore.Unix())
+	assert.Equal(t, int64(1600000000), rule.NotAfter.Unix())
+	assert.Equal(t, []string{"192.168.0.0/16", "2001:db8::/32"}, rule.IPRanges)
+	assert.Equal(t, 3, rule.MaxUses)
+
+	out, err := rule.MarshalScopeString()
+	assert.NoError(t, err)
+	assert.Equal(t, "io.cozy.files:GET:some-id;not_before=1500000000;not_after=1600000000;ip=192.168.0.0/16,2001:db8::/32;max_uses=3", out)
+
+	set, err := UnmarshalScopeString("io.cozy.contacts;redact=phone,address.city io.cozy.files:GET")
+	assert.NoError(t, err)
+	assert.Len(t, set, 2)
+	assert.Equal(t, []string{"phone", "address.city"}, set[0].Redact)
+	assert.False(t, set[1].HasConditions())
+
+	_, err = UnmarshalRuleString("io.cozy.files;ip=foo")
+	assert.Error(t, err)
+	_, err = UnmarshalRuleString("io.cozy.files;max_uses=0")
+	assert.Error(t, err)
+	_, err = UnmarshalRuleString("io.cozy.files;unknown=bar")
+	assert.Error(t, err)
+}
+
+func TestApplicableRules(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	p := &Permission{
+		PID: "perm-id",
+		Permissions: Set{
+			Rule{Title: "expired", Type: "io.cozy.files", NotAfter: &past},
+			Rule{Title: "not-yet", Type: "io.cozy.files", NotBefore: &future},
+			Rule{Title: "lan", Type: "io.cozy.files", IPRanges: []string{"192.168.0.0/16"}},
+			Rule{Type: "io.cozy.files", Verbs: Verbs(GET), MaxUses: 1},
+		},
+		Uses: map[string]int{},
+	}
+
+	set := p.ApplicableRules(time.Now(), net.ParseIP("10.0.0.1"))
+	assert.Len(t, set, 1)
+	assert.Equal(t, 1, set[0].MaxUses)
+
+	// The rules without a title can be used only once too
+	p.Uses[set[0].usesKey()] = 1
+	set = p.ApplicableRules(time.Now(), net.ParseIP("192.168.1.1"))
+	assert.Len(t, set, 1)
+	assert.Equal(t, "lan", set[0].Title)
+
+	// The uses can't be counted without a permission document
+	p2 := &Permission{Permissions: Set{Rule{Title: "once", Type: "io.cozy.files", MaxUses: 1}}}
+	assert.Len(t, p2.ApplicableRules(time.Now(), nil), 0)
+}
+
+func TestRedactDoc(t *testing.T) {
+	rules := Set{
+		Rule{Type: "io.cozy.contacts", Redact: []string{"phone", "address.city"}},
+		Rule{Type: "io.cozy.contacts", Redact: []string{"address.city"}},
+	}
+	fields := RedactedFields(rules)
+	assert.Equal(t, []string{"address.city"}, fields)
+
+	doc := map[string]interface{}{
+		"name":    "Alice",
+		"phone":   "0123456789",
+		"address": map[string]interface{}{"city": "Paris", "country": "France"},
+	}
+	RedactDoc(doc, []string{"phone", "address.city", "email.work"})
+	assert.Equal(t, map[string]interface{}{
+		"name":    "Alice",
+		"address": map[string]interface{}{"country": "France"},
+	}, doc)
+}
+
 func TestAllowType(t *testing.T) {
 	s := Set{Rule{Type: "io.cozy.contacts"}}
 	assert.True(t, s.Allow(GET, &validable{doctype: "io.cozy.contacts"}))
@@ -298,7 +378,7 @@ func TestSubset(t *testing.T) {
 func TestCreateShareSetBlacklist(t *testing.T) {
 	s := Set{Rule{Type: "io.cozy.notifications"}}
 	parent := &Permission{Type: TypeWebapp, Permissions: s}
-	_, err := CreateShareSet(nil, parent, nil, s, nil)
+	_, err := CreateShareSet(nil, parent, nil, s, ShareOptions{})
 	assert.Error(t, err)
 	e, ok := err.(*echo.HTTPError)
 	assert.True(t, ok)
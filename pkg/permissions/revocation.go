@@ -0,0 +1,329 @@
+package permissions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/go-redis/redis"
+)
+
+// The tokens are stateless JWT, so they can't be deleted before their
+// expiration. Instead, a per-instance revocation list keeps the tokens that
+// have been revoked, until their expiration. It is stored in redis if it is
+// configured for the sessions, and in CouchDB else.
+
+// revokedSessionPrefix is the prefix used in the revocation list for the
+// sessions: all the tokens tied to a revoked session are invalid.
+const revokedSessionPrefix = "session-"
+
+// revokedClientPrefix is the prefix used in the revocation list for the OAuth
+// clients that had their refresh token revoked: their access tokens issued
+// before the revocation are invalid.
+const revokedClientPrefix = "client-"
+
+// revocationCacheTTL is the duration during which a lookup in the revocation
+// list in CouchDB is kept in memory, when the token is not revoked.
+const revocationCacheTTL = 1 * time.Minute
+
+// revocationCacheMaxSize is the maximal number of lookups kept in memory.
+const revocationCacheMaxSize = 10000
+
+var revocationlog = logger.WithNamespace("revocation")
+
+// revokedToken is an entry of the revocation list in CouchDB.
+type revokedToken struct {
+	DocID     string `json:"_id,omitempty"`
+	DocRev    string `json:"_rev,omitempty"`
+	RevokedAt int64  `json:"revoked_at,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+func (r *revokedToken) ID() string         { return r.DocID }
+func (r *revokedToken) Rev() string        { return r.DocRev }
+func (r *revokedToken) DocType() string    { return consts.RevokedTokens }
+func (r *revokedToken) Clone() couchdb.Doc { cloned := *r; return &cloned }
+func (r *revokedToken) SetID(id string)    { r.DocID = id }
+func (r *revokedToken) SetRev(rev string)  { r.DocRev = rev }
+
+func (r *revokedToken) expired() bool {
+	return r.ExpiresAt > 0 && r.ExpiresAt < time.Now().Unix()
+}
+
+type revocationStorage interface {
+	// Add puts an entry in the revocation list. A zero expiresAt means that
+	// the entry never expires.
+	Add(db prefixer.Prefixer, id string, revokedAt, expiresAt time.Time) error
+	// Get returns the time of the revocation of the entry, or a zero time if
+	// the entry is not in the revocation list.
+	Get(db prefixer.Prefixer, id string) (time.Time, error)
+}
+
+type couchRevocationStorage struct{}
+
+func (store *couchRevocationStorage) Add(db prefixer.Prefixer, id string, revokedAt, expiresAt time.Time) error {
+	doc := &revokedToken{DocID: id, RevokedAt: revokedAt.Unix()}
+	if !expiresAt.IsZero() {
+		doc.ExpiresAt = expiresAt.Unix()
+	}
+	err := couchdb.CreateNamedDocWithDB(db, doc)
+	if !couchdb.IsConflictError(err) {
+		return err
+	}
+	// Already in the list: the revocation time is updated, for the clients
+	// that can be revoked several times
+	old := &revokedToken{}
+	if err = couchdb.GetDoc(db, consts.RevokedTokens, id, old); err != nil {
+		return err
+	}
+	doc.DocRev = old.DocRev
+	return couchdb.UpdateDoc(db, doc)
+}
+
+func (store *couchRevocationStorage) Get(db prefixer.Prefixer, id string) (time.Time, error) {
+	doc := &revokedToken{}
+	if err := couchdb.GetDoc(db, consts.RevokedTokens, id, doc); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	if doc.expired() {
+		// The token has expired, it is no longer useful to keep it
+		if err := couchdb.DeleteDoc(db, doc); err != nil {
+			revocationlog.Errorf("Cannot clean the revocation list: %s", err)
+		}
+		return time.Time{}, nil
+	}
+	// The entries created before the revocation time was stored are
+	// considered as revoked since the beginning
+	return time.Unix(doc.RevokedAt, 0), nil
+}
+
+// cachedRevocationStorage keeps the lookups in memory, as the revocation list
+// is checked for each request with a token. The revoked entries are kept until
+// their expiration, and the others for a short duration, in case the entry is
+// added by another stack.
+type cachedRevocationStorage struct {
+	store   revocationStorage
+	mu      sync.Mutex
+	entries map[string]cachedRevocation
+}
+
+type cachedRevocation struct {
+	revokedAt time.Time
+	until     time.Time
+}
+
+func newCachedRevocationStorage(store revocationStorage) *cachedRevocationStorage {
+	return &cachedRevocationStorage{
+		store:   store,
+		entries: make(map[string]cachedRevocation),
+	}
+}
+
+func (cache *cachedRevocationStorage) set(key string, revokedAt, until time.Time) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) >= revocationCacheMaxSize {
+		cache.entries = make(map[string]cachedRevocation)
+	}
+	cache.entries[key] = cachedRevocation{revokedAt: revokedAt, until: until}
+}
+
+func (cache *cachedRevocationStorage) Add(db prefixer.Prefixer, id string, revokedAt, expiresAt time.Time) error {
+	if err := cache.store.Add(db, id, revokedAt, expiresAt); err != nil {
+		return err
+	}
+	until := expiresAt
+	if until.IsZero() {
+		until = time.Now().Add(AccessTokenValidityDuration)
+	}
+	cache.set(revocationKey(db, id), revokedAt, until)
+	return nil
+}
+
+func (cache *cachedRevocationStorage) Get(db prefixer.Prefixer, id string) (time.Time, error) {
+	key := revocationKey(db, id)
+	now := time.Now()
+	cache.mu.Lock()
+	entry, ok := cache.entries[key]
+	cache.mu.Unlock()
+	if ok && now.Before(entry.until) {
+		return entry.revokedAt, nil
+	}
+
+	revokedAt, err := cache.store.Get(db, id)
+	if err != nil {
+		return revokedAt, err
+	}
+	until := now.Add(revocationCacheTTL)
+	if !revokedAt.IsZero() {
+		until = now.Add(AccessTokenValidityDuration)
+	}
+	cache.set(key, revokedAt, until)
+	return revokedAt, nil
+}
+
+type redisRevocationStorage struct {
+	cl redis.UniversalClient
+}
+
+func revocationKey(db prefixer.Prefixer, id string) string {
+	return "revoked:" + db.DBPrefix() + ":" + id
+}
+
+func (store *redisRevocationStorage) Add(db prefixer.Prefixer, id string, revokedAt, expiresAt time.Time) error {
+	var ttl time.Duration
+	if !expiresAt.IsZero() {
+		ttl = time.Until(expiresAt)
+		if ttl <= 0 {
+			return nil
+		}
+	}
+	err := store.cl.Set(revocationKey(db, id), revokedAt.Unix(), ttl).Err()
+	if err != nil {
+		revocationlog.Errorf("Cannot add a token to the revocation list: %s", err)
+	}
+	return err
+}
+
+func (store *redisRevocationStorage) Get(db prefixer.Prefixer, id string) (time.Time, error) {
+	revokedAt, err := store.cl.Get(revocationKey(db, id)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(revokedAt, 0), nil
+}
+
+var globalRevocationStorage revocationStorage
+var globalRevocationStorageMutex sync.Mutex
+
+func getRevocationStorage() revocationStorage {
+	globalRevocationStorageMutex.Lock()
+	defer globalRevocationStorageMutex.Unlock()
+	if globalRevocationStorage != nil {
+		return globalRevocationStorage
+	}
+	cli := config.GetConfig().SessionStorage.Client()
+	if cli == nil {
+		globalRevocationStorage = newCachedRevocationStorage(&couchRevocationStorage{})
+	} else {
+		globalRevocationStorage = &redisRevocationStorage{cl: cli}
+	}
+	return globalRevocationStorage
+}
+
+// tokenRevocationID returns the identifier of a token in the revocation list.
+// The tokens have no jti, so a hash of the token is used instead.
+func tokenRevocationID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeToken adds the token to the revocation list of the instance, until
+// its expiration. When a refresh token is revoked, the access tokens issued
+// before for the same client are revoked too (RFC 7009, section 2.1).
+func RevokeToken(db prefixer.Prefixer, token string, claims *Claims) error {
+	store := getRevocationStorage()
+	now := time.Now()
+	expiresAt, _ := claims.ExpiresAtUTC()
+	if err := store.Add(db, tokenRevocationID(token), now, expiresAt); err != nil {
+		return err
+	}
+	if claims.Audience != RefreshTokenAudience || claims.Subject == "" {
+		return nil
+	}
+	expiresAt = now.Add(AccessTokenValidityDuration)
+	return store.Add(db, revokedClientPrefix+claims.Subject, now, expiresAt)
+}
+
+// RevokeSession revokes all the tokens tied to the given session.
+func RevokeSession(db prefixer.Prefixer, sessionID string) error {
+	// The tokens of a session are app tokens, and they can't have been issued
+	// after the revocation of the session.
+	now := time.Now()
+	expiresAt := now.Add(AppTokenValidityDuration)
+	return getRevocationStorage().Add(db, revokedSessionPrefix+sessionID, now, expiresAt)
+}
+
+// IsRevoked returns true if the token, or the session it is tied to, has been
+// revoked. If the revocation list can't be checked, the token is considered
+// as revoked.
+func IsRevoked(db prefixer.Prefixer, token string, claims *Claims) bool {
+	store := getRevocationStorage()
+	if claims.SessionID != "" {
+		revokedAt, err := store.Get(db, revokedSessionPrefix+claims.SessionID)
+		if err != nil {
+			revocationlog.Errorf("Cannot check the revocation list: %s", err)
+			return true
+		}
+		if !revokedAt.IsZero() {
+			return true
+		}
+	}
+	if claims.Audience == AccessTokenAudience && claims.Subject != "" {
+		revokedAt, err := store.Get(db, revokedClientPrefix+claims.Subject)
+		if err != nil {
+			revocationlog.Errorf("Cannot check the revocation list: %s", err)
+			return true
+		}
+		if !revokedAt.IsZero() && claims.IssuedAt <= revokedAt.Unix() {
+			return true
+		}
+	}
+	revokedAt, err := store.Get(db, tokenRevocationID(token))
+	if err != nil {
+		revocationlog.Errorf("Cannot check the revocation list: %s", err)
+		return true
+	}
+	return !revokedAt.IsZero()
+}
+
+// PurgeExpiredRevocations removes the entries of the revocation list that
+// have expired. It is only useful when the list is stored in CouchDB: redis
+// removes the expired keys by itself.
+func PurgeExpiredRevocations(db prefixer.Prefixer) error {
+	var expired []couchdb.Doc
+	err := couchdb.ForeachDocs(db, consts.RevokedTokens, func(_ string, data json.RawMessage) error {
+		doc := &revokedToken{}
+		if err := json.Unmarshal(data, doc); err != nil {
+			return err
+		}
+		if doc.expired() {
+			expired = append(expired, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil
+		}
+		return err
+	}
+	for len(expired) > 0 {
+		n := len(expired)
+		if n > 100 {
+			n = 100
+		}
+		if err = couchdb.BulkDeleteDocs(db, consts.RevokedTokens, expired[:n]); err != nil {
+			return err
+		}
+		expired = expired[n:]
+	}
+	return nil
+}
+
+var (
+	_ couchdb.Doc = &revokedToken{}
+)
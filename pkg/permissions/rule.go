@@ -2,6 +2,7 @@ package permissions
 
 import (
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 )
@@ -31,6 +32,22 @@ type Rule struct {
 	// Selector is the field which must be one of Values.
 	Selector string   `json:"selector,omitempty"`
 	Values   []string `json:"values,omitempty"`
+
+	// NotBefore and NotAfter restrict the rule to a validity window.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+
+	// IPRanges is a list of CIDR for the IP addresses of the clients allowed
+	// to use this rule.
+	IPRanges []string `json:"ip_ranges,omitempty"`
+
+	// MaxUses is the maximal number of requests that can be made with this
+	// rule (0 means no limit).
+	MaxUses int `json:"max_uses,omitempty"`
+
+	// Redact is a list of fields that are removed from the documents read
+	// with this rule.
+	Redact []string `json:"redact,omitempty"`
 }
 
 // MarshalScopeString transform a Rule into a string of the shape
@@ -53,13 +70,21 @@ func (r Rule) MarshalScopeString() (string, error) {
 		out += partSep + r.Selector
 	}
 
+	out += r.marshalConditions()
+
 	return out, nil
 }
 
 // UnmarshalRuleString parse a scope formated rule
 func UnmarshalRuleString(in string) (Rule, error) {
 	var out Rule
-	parts := strings.Split(in, partSep)
+	conditions := strings.Split(in, condSep)
+	for _, cond := range conditions[1:] {
+		if err := out.unmarshalCondition(cond); err != nil {
+			return out, err
+		}
+	}
+	parts := strings.Split(conditions[0], partSep)
 	switch len(parts) {
 	case 4:
 		out.Selector = parts[3]
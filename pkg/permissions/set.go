@@ -111,6 +111,12 @@ func (ps *Set) RuleInSubset(r2 Rule) bool {
 			continue
 		}
 
+		// A rule with conditions can only be delegated with the same
+		// conditions
+		if r.HasConditions() && !r.sameConditions(r2) {
+			continue
+		}
+
 		if r.Selector == "" && len(r.Values) == 0 {
 			return true
 		}
@@ -150,6 +156,7 @@ func (ps Set) HasSameRules(other Set) bool {
 		for _, otherRule := range other {
 			if reflect.DeepEqual(rule.Values, otherRule.Values) &&
 				rule.Selector == otherRule.Selector &&
+				rule.sameConditions(otherRule) &&
 				rule.Verbs.ContainsAll(otherRule.Verbs) &&
 				otherRule.Verbs.ContainsAll(rule.Verbs) &&
 				reflect.DeepEqual(otherRule.Type, rule.Type) {
@@ -0,0 +1,218 @@
+package permissions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// A share by link can be protected by a password. In that case, the codes
+// can't be used directly as tokens: the password must be checked first, and
+// a short-lived token with the UnlockedShareAudience is given in exchange. A
+// share by link can also have a maximal number of downloads, and each access
+// to it is written in an access log.
+
+const (
+	// ShareAccessOpen is the action logged when the public page of a share by
+	// link is opened.
+	ShareAccessOpen = "open"
+	// ShareAccessDownload is the action logged when a file is downloaded via
+	// a share by link.
+	ShareAccessDownload = "download"
+	// ShareAccessWrongPassword is the action logged when a wrong password has
+	// been given for a share by link.
+	ShareAccessWrongPassword = "wrong_password"
+)
+
+// maxDownloadRetries is the number of times that a download is retried when
+// the permission document has been updated concurrently.
+const maxDownloadRetries = 3
+
+// MaxShareAccesses is the maximal number of entries kept in the access log of
+// a share by link: the older ones are deleted when a new one is written.
+const MaxShareAccesses = 100
+
+// accessesBatchSize is the number of entries of an access log deleted at once.
+const accessesBatchSize = 100
+
+// ShareAccess is an entry of the access log of a share by link.
+type ShareAccess struct {
+	DocID        string    `json:"_id,omitempty"`
+	DocRev       string    `json:"_rev,omitempty"`
+	PermissionID string    `json:"permission_id"`
+	Action       string    `json:"action"`
+	IP           string    `json:"ip"`
+	UA           string    `json:"user_agent"`
+	FirstAccess  bool      `json:"first_access,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ID implements couchdb.Doc
+func (a *ShareAccess) ID() string { return a.DocID }
+
+// Rev implements couchdb.Doc
+func (a *ShareAccess) Rev() string { return a.DocRev }
+
+// DocType implements couchdb.Doc
+func (a *ShareAccess) DocType() string { return consts.PermissionsAccesses }
+
+// Clone implements couchdb.Doc
+func (a *ShareAccess) Clone() couchdb.Doc { cloned := *a; return &cloned }
+
+// SetID implements couchdb.Doc
+func (a *ShareAccess) SetID(id string) { a.DocID = id }
+
+// SetRev implements couchdb.Doc
+func (a *ShareAccess) SetRev(rev string) { a.DocRev = rev }
+
+// HasPassword returns true if the share by link is protected by a password.
+func (p *Permission) HasPassword() bool {
+	return len(p.Password) > 0
+}
+
+// SetPassword hashes the given password and puts it on the permission
+// document.
+func (p *Permission) SetPassword(password string) error {
+	hash, err := crypto.GenerateFromPassphrase([]byte(password))
+	if err != nil {
+		return err
+	}
+	p.Password = hash
+	return nil
+}
+
+// CheckPassword returns true if the given password is the password of the
+// share by link.
+func (p *Permission) CheckPassword(password string) bool {
+	if !p.HasPassword() {
+		return false
+	}
+	_, err := crypto.CompareHashAndPassphrase(p.Password, []byte(password))
+	return err == nil
+}
+
+// ConsumeDownload counts a download for the share by link, and returns
+// ErrDownloadLimitReached if the maximal number of downloads has already been
+// reached.
+func (p *Permission) ConsumeDownload(db prefixer.Prefixer) error {
+	if p.MaxDownloads == 0 {
+		return nil
+	}
+	var err error
+	for k := 0; k < maxDownloadRetries; k++ {
+		if p.Downloads >= p.MaxDownloads {
+			return ErrDownloadLimitReached
+		}
+		p.Downloads++
+		err = couchdb.UpdateDoc(db, p)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+		// Another download has been counted in the meantime
+		fresh, errg := GetByID(db, p.PID)
+		if errg != nil {
+			return errg
+		}
+		p.PRev = fresh.PRev
+		p.Downloads = fresh.Downloads
+	}
+	return err
+}
+
+// LogShareAccess writes an entry in the access log of the share by link. The
+// first access is flagged, and the entry is published on the realtime hub
+// when created, so that the owner can be notified.
+func LogShareAccess(db prefixer.Prefixer, p *Permission, action string, req *http.Request) {
+	ip := req.RemoteAddr
+	if clientIP := config.ClientIP(req); clientIP != nil {
+		ip = clientIP.String()
+	}
+
+	now := time.Now()
+	entry := &ShareAccess{
+		PermissionID: p.PID,
+		Action:       action,
+		IP:           ip,
+		UA:           req.UserAgent(),
+		CreatedAt:    now,
+	}
+
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "permissions")
+	if p.FirstAccessAt == nil && action != ShareAccessWrongPassword {
+		p.FirstAccessAt = &now
+		if err := couchdb.UpdateDoc(db, p); err == nil {
+			entry.FirstAccess = true
+		} else if !couchdb.IsConflictError(err) {
+			// On a conflict, another request has been the first access
+			log.Errorf("Cannot save the first access of %s: %s", p.PID, err)
+		}
+	}
+
+	if err := couchdb.CreateDoc(db, entry); err != nil {
+		log.Errorf("Cannot log the access to %s: %s", p.PID, err)
+		return
+	}
+	if err := deleteShareAccesses(db, p.PID, MaxShareAccesses); err != nil {
+		log.Warnf("Cannot prune the access log of %s: %s", p.PID, err)
+	}
+}
+
+// GetShareAccesses returns the last entries of the access log of the share by
+// link, from the most recent to the oldest.
+func GetShareAccesses(db prefixer.Prefixer, permID string) ([]*ShareAccess, error) {
+	return findShareAccesses(db, permID, 0, MaxShareAccesses)
+}
+
+func findShareAccesses(db prefixer.Prefixer, permID string, skip, limit int) ([]*ShareAccess, error) {
+	var accesses []*ShareAccess
+	req := &couchdb.FindRequest{
+		UseIndex: "by-permission-id",
+		Selector: mango.Equal("permission_id", permID),
+		Sort: mango.SortBy{
+			{Field: "permission_id", Direction: mango.Desc},
+			{Field: "created_at", Direction: mango.Desc},
+		},
+		Skip:  skip,
+		Limit: limit,
+	}
+	err := couchdb.FindDocs(db, consts.PermissionsAccesses, req, &accesses)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
+
+// deleteShareAccesses deletes the entries of the access log of a share by
+// link, except the skip most recent ones.
+func deleteShareAccesses(db prefixer.Prefixer, permID string, skip int) error {
+	for {
+		accesses, err := findShareAccesses(db, permID, skip, accessesBatchSize)
+		if err != nil || len(accesses) == 0 {
+			return err
+		}
+		docs := make([]couchdb.Doc, len(accesses))
+		for i, a := range accesses {
+			docs[i] = a
+		}
+		if err = couchdb.BulkDeleteDocs(db, consts.PermissionsAccesses, docs); err != nil {
+			return err
+		}
+		if len(accesses) < accessesBatchSize {
+			return nil
+		}
+	}
+}
+
+var (
+	_ couchdb.Doc = &ShareAccess{}
+)
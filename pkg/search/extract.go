@@ -0,0 +1,157 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/ledongthuc/pdf"
+)
+
+// maxFileSize is the maximal size of the files whose content is extracted.
+const maxFileSize = 50 << 20
+
+// maxContentSize is the maximal size of the text indexed for a file.
+const maxContentSize = 1 << 20
+
+// The XML files with the text of the office documents, in the OOXML formats
+// of Microsoft Office and in the OpenDocument formats.
+var officeTextFiles = []string{
+	"word/document.xml",
+	"xl/sharedStrings.xml",
+	"content.xml",
+}
+
+const officeSlidesPrefix = "ppt/slides/slide"
+
+// ExtractText returns the text content of a file, for the formats that are
+// supported: plain text, markdown, PDF with a text layer, and office
+// documents. An empty string is returned for the other formats.
+func ExtractText(fs vfs.VFS, doc *vfs.FileDoc) (string, error) {
+	if doc.ByteSize > maxFileSize {
+		return "", nil
+	}
+	kind := contentKind(doc)
+	if kind == "" {
+		return "", nil
+	}
+	f, err := fs.OpenFile(doc)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	switch kind {
+	case "text":
+		return extractPlainText(f)
+	case "pdf":
+		return extractPDFText(f, doc.ByteSize)
+	case "office":
+		return extractOfficeText(f, doc.ByteSize)
+	}
+	return "", nil
+}
+
+func contentKind(doc *vfs.FileDoc) string {
+	ext := strings.ToLower(path.Ext(doc.DocName))
+	switch {
+	case strings.HasPrefix(doc.Mime, "text/"), ext == ".md", ext == ".markdown", ext == ".txt":
+		return "text"
+	case doc.Mime == "application/pdf", ext == ".pdf":
+		return "pdf"
+	case ext == ".docx", ext == ".xlsx", ext == ".pptx",
+		ext == ".odt", ext == ".ods", ext == ".odp":
+		return "office"
+	}
+	return ""
+}
+
+func extractPlainText(r io.Reader) (string, error) {
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxContentSize))
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func extractPDFText(r io.ReaderAt, size int64) (string, error) {
+	reader, err := pdf.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	text, err := reader.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+	return extractPlainText(text)
+}
+
+func extractOfficeText(r io.ReaderAt, size int64) (string, error) {
+	z, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	var files []*zip.File
+	for _, file := range z.File {
+		if isOfficeTextFile(file.Name) {
+			files = append(files, file)
+		}
+	}
+	// Keep the slides in their order
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	var buf bytes.Buffer
+	for _, file := range files {
+		rc, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		err = xmlText(&buf, rc)
+		rc.Close()
+		if err != nil {
+			return "", err
+		}
+		if buf.Len() >= maxContentSize {
+			break
+		}
+	}
+	text := buf.String()
+	if len(text) > maxContentSize {
+		text = text[:maxContentSize]
+	}
+	return text, nil
+}
+
+func isOfficeTextFile(name string) bool {
+	for _, n := range officeTextFiles {
+		if name == n {
+			return true
+		}
+	}
+	return strings.HasPrefix(name, officeSlidesPrefix) && strings.HasSuffix(name, ".xml")
+}
+
+// xmlText writes the text nodes of an XML document, separated by spaces.
+func xmlText(w *bytes.Buffer, r io.Reader) error {
+	decoder := xml.NewDecoder(io.LimitReader(r, maxFileSize))
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if data, ok := tok.(xml.CharData); ok {
+			if text := strings.TrimSpace(string(data)); text != "" {
+				w.WriteString(text)
+				w.WriteByte(' ')
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package search
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentKind(t *testing.T) {
+	assert.Equal(t, "text", contentKind(&vfs.FileDoc{DocName: "notes.txt", Mime: "text/plain"}))
+	assert.Equal(t, "text", contentKind(&vfs.FileDoc{DocName: "README.md"}))
+	assert.Equal(t, "pdf", contentKind(&vfs.FileDoc{DocName: "bill", Mime: "application/pdf"}))
+	assert.Equal(t, "office", contentKind(&vfs.FileDoc{DocName: "Report.DOCX"}))
+	assert.Equal(t, "office", contentKind(&vfs.FileDoc{DocName: "budget.ods"}))
+	assert.Equal(t, "", contentKind(&vfs.FileDoc{DocName: "photo.jpg", Mime: "image/jpeg"}))
+}
+
+func TestExtractPlainText(t *testing.T) {
+	text, err := extractPlainText(strings.NewReader("foo bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo bar", text)
+
+	big := strings.Repeat("a", maxContentSize+10)
+	text, err = extractPlainText(strings.NewReader(big))
+	assert.NoError(t, err)
+	assert.Len(t, text, maxContentSize)
+}
+
+func TestXMLText(t *testing.T) {
+	var buf bytes.Buffer
+	doc := `<w:document><w:body><w:p><w:r><w:t>Hello</w:t></w:r>
+	<w:r><w:t>world</w:t></w:r></w:p></w:body></w:document>`
+	assert.NoError(t, xmlText(&buf, strings.NewReader(doc)))
+	assert.Equal(t, "Hello world ", buf.String())
+}
+
+func TestExtractOfficeText(t *testing.T) {
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	files := map[string]string{
+		"[Content_Types].xml":    `<Types><Default Extension="xml"/></Types>`,
+		"ppt/slides/slide2.xml":  `<p:sld><a:t>second</a:t></p:sld>`,
+		"ppt/slides/slide1.xml":  `<p:sld><a:t>first</a:t></p:sld>`,
+		"ppt/slides/_rels/a.xml": `<r>ignored</r>`,
+	}
+	for name, content := range files {
+		w, err := z.Create(name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, z.Close())
+
+	r := bytes.NewReader(buf.Bytes())
+	text, err := extractOfficeText(r, int64(buf.Len()))
+	assert.NoError(t, err)
+	assert.Equal(t, "first second ", text)
+}
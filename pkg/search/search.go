@@ -0,0 +1,382 @@
+// Package search is used for the full-text search on the files. Each instance
+// has its own index, stored on the local disk, where the name, the tags and the
+// text content of the files are indexed.
+//
+// An index can be opened by only one process at a time: the other processes
+// wait for it to be closed, and give up after a few seconds. It means that only
+// one cozy-stack process must use the search_path directory, for both the
+// indexing by the workers and the search requests.
+package search
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// MaxLimit is the maximal number of results returned for a query.
+const MaxLimit = 100
+
+// ErrDisabled is used when the full-text search has not been configured.
+var ErrDisabled = errors.New("The full-text search is not enabled")
+
+// ErrEmptyQuery is used when a search is made without terms.
+var ErrEmptyQuery = errors.New("The query is empty")
+
+const (
+	// maxOpenIndexes is the number of indexes that are kept open. When a new
+	// index is opened, the least recently used ones are closed.
+	maxOpenIndexes = 64
+
+	// indexIdleTimeout is the duration after which an index that has not been
+	// used is closed.
+	indexIdleTimeout   = 10 * time.Minute
+	indexCleanInterval = time.Minute
+
+	// openTimeout is how long we wait for an index locked by another process.
+	openTimeout = "5s"
+)
+
+// openIndex is an index kept open, with the number of calls that are using it,
+// as it can be closed only when they have released it.
+type openIndex struct {
+	bleve.Index
+	domain   string
+	users    int
+	lastUsed time.Time
+}
+
+var (
+	indexesMu   sync.Mutex
+	indexes     = make(map[string]*openIndex)
+	cleanerOnce sync.Once
+)
+
+// Enabled returns true if the full-text search has been configured.
+func Enabled() bool {
+	return config.GetConfig().Fs.SearchPath != ""
+}
+
+// document is what is indexed for a file.
+type document struct {
+	Name      string    `json:"name"`
+	Tags      []string  `json:"tags"`
+	Content   string    `json:"content"`
+	Class     string    `json:"class"`
+	Mime      string    `json:"mime"`
+	UpdatedAt time.Time `json:"updated_at"`
+	MD5Sum    string    `json:"md5sum"`
+}
+
+func indexPath(db prefixer.Prefixer) string {
+	return filepath.Join(config.GetConfig().Fs.SearchPath, db.DomainName())
+}
+
+func newMapping() *mapping.IndexMappingImpl {
+	text := bleve.NewTextFieldMapping()
+	stored := bleve.NewTextFieldMapping()
+	stored.Index = false
+	kw := bleve.NewTextFieldMapping()
+	kw.Analyzer = keyword.Name
+	date := bleve.NewDateTimeFieldMapping()
+
+	doc := bleve.NewDocumentMapping()
+	doc.AddFieldMappingsAt("name", text)
+	doc.AddFieldMappingsAt("tags", text)
+	doc.AddFieldMappingsAt("content", text)
+	doc.AddFieldMappingsAt("class", kw)
+	doc.AddFieldMappingsAt("mime", kw)
+	doc.AddFieldMappingsAt("updated_at", date)
+	doc.AddFieldMappingsAt("md5sum", stored)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+	return m
+}
+
+// getIndex returns the index of the instance, and creates it if it does not
+// exist yet. The index must be released with releaseIndex after use.
+func getIndex(db prefixer.Prefixer) (*openIndex, error) {
+	if !Enabled() {
+		return nil, ErrDisabled
+	}
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	cleanerOnce.Do(func() { go indexesCleaner() })
+	domain := db.DomainName()
+	if idx, ok := indexes[domain]; ok {
+		idx.users++
+		idx.lastUsed = time.Now()
+		return idx, nil
+	}
+	closeIndexes(maxOpenIndexes - 1)
+	p := indexPath(db)
+	runtimeConfig := map[string]interface{}{"bolt_timeout": openTimeout}
+	bidx, err := bleve.OpenUsing(p, runtimeConfig)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+		bidx, err = bleve.NewUsing(p, newMapping(), bleve.Config.DefaultIndexType,
+			bleve.Config.DefaultKVStore, runtimeConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := &openIndex{Index: bidx, domain: domain, users: 1, lastUsed: time.Now()}
+	indexes[domain] = idx
+	return idx, nil
+}
+
+// releaseIndex must be called when an index returned by getIndex is no
+// longer used.
+func releaseIndex(idx *openIndex) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	idx.users--
+	idx.lastUsed = time.Now()
+}
+
+// closeIndexes closes the unused indexes that have been idle for too long,
+// and then the least recently used ones until at most max indexes are open.
+// The indexes in use are never closed. It must be called with indexesMu
+// locked.
+func closeIndexes(max int) {
+	now := time.Now()
+	var unused []*openIndex
+	for _, idx := range indexes {
+		if idx.users > 0 {
+			continue
+		}
+		if now.Sub(idx.lastUsed) > indexIdleTimeout {
+			closeIndex(idx)
+		} else {
+			unused = append(unused, idx)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return unused[i].lastUsed.Before(unused[j].lastUsed)
+	})
+	for _, idx := range unused {
+		if len(indexes) <= max {
+			break
+		}
+		closeIndex(idx)
+	}
+}
+
+func closeIndex(idx *openIndex) {
+	idx.Close() // #nosec
+	delete(indexes, idx.domain)
+}
+
+func indexesCleaner() {
+	for range time.Tick(indexCleanInterval) {
+		indexesMu.Lock()
+		closeIndexes(maxOpenIndexes)
+		indexesMu.Unlock()
+	}
+}
+
+// DeleteIndex removes the index of an instance, for example when the instance
+// is destroyed or before a reindexation.
+func DeleteIndex(db prefixer.Prefixer) error {
+	if !Enabled() {
+		return nil
+	}
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	domain := db.DomainName()
+	if idx, ok := indexes[domain]; ok {
+		closeIndex(idx)
+	}
+	err := os.RemoveAll(indexPath(db))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// IndexFile adds a file to the index, or updates it. If olddoc is given and
+// has the same content, the text is not extracted again.
+func IndexFile(fs vfs.VFS, doc, olddoc *vfs.FileDoc) error {
+	idx, err := getIndex(fs)
+	if err != nil {
+		return err
+	}
+	defer releaseIndex(idx)
+	if doc.Trashed {
+		return idx.Delete(doc.ID())
+	}
+
+	var content string
+	if olddoc != nil && !olddoc.Trashed && bytes.Equal(doc.MD5Sum, olddoc.MD5Sum) {
+		content, err = indexedContent(idx, doc)
+	} else {
+		content, err = ExtractText(fs, doc)
+	}
+	if err != nil {
+		// The file is still indexed by its name and tags
+		content = ""
+	}
+
+	return idx.Index(doc.ID(), &document{
+		Name:      doc.DocName,
+		Tags:      doc.Tags,
+		Content:   content,
+		Class:     doc.Class,
+		Mime:      doc.Mime,
+		UpdatedAt: doc.UpdatedAt,
+		MD5Sum:    hex.EncodeToString(doc.MD5Sum),
+	})
+}
+
+// indexedContent returns the content that has been indexed for a file, if
+// the indexed version has the same checksum.
+func indexedContent(idx bleve.Index, doc *vfs.FileDoc) (string, error) {
+	req := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{doc.ID()}))
+	req.Fields = []string{"content", "md5sum"}
+	res, err := idx.Search(req)
+	if err != nil {
+		return "", err
+	}
+	if len(res.Hits) == 0 {
+		return "", errors.New("Not indexed")
+	}
+	fields := res.Hits[0].Fields
+	if sum, _ := fields["md5sum"].(string); sum != hex.EncodeToString(doc.MD5Sum) {
+		return "", errors.New("Not indexed")
+	}
+	content, _ := fields["content"].(string)
+	return content, nil
+}
+
+// RemoveFile removes a file from the index.
+func RemoveFile(db prefixer.Prefixer, fileID string) error {
+	idx, err := getIndex(db)
+	if err != nil {
+		return err
+	}
+	defer releaseIndex(idx)
+	return idx.Delete(fileID)
+}
+
+// Reindex rebuilds the index of an instance from the files of its VFS.
+func Reindex(fs vfs.VFS) error {
+	if err := DeleteIndex(fs); err != nil {
+		return err
+	}
+	return vfs.Walk(fs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == nil || strings.HasPrefix(name, vfs.TrashDirName+"/") {
+			return nil
+		}
+		return IndexFile(fs, file, nil)
+	})
+}
+
+// Request is a full-text search, with some optional filters.
+type Request struct {
+	Query         string     `json:"q"`
+	Class         string     `json:"class,omitempty"`
+	Mime          string     `json:"mime,omitempty"`
+	UpdatedAfter  *time.Time `json:"updated_after,omitempty"`
+	UpdatedBefore *time.Time `json:"updated_before,omitempty"`
+	Limit         int        `json:"limit,omitempty"`
+	Skip          int        `json:"skip,omitempty"`
+}
+
+// Hit is a file that matches a full-text search.
+type Hit struct {
+	FileID string
+	Score  float64
+}
+
+// Search makes a full-text search on the files of an instance. All the terms
+// of the query must be found, in the name, the tags or the content of a
+// file, and the results are sorted by relevance, with a boost for the terms
+// found in the name and the tags. It returns the hits for the requested page,
+// and the total number of hits.
+func Search(db prefixer.Prefixer, req *Request) ([]Hit, int, error) {
+	terms := strings.Fields(req.Query)
+	if len(terms) == 0 {
+		return nil, 0, ErrEmptyQuery
+	}
+	idx, err := getIndex(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer releaseIndex(idx)
+
+	var must []query.Query
+	for _, term := range terms {
+		must = append(must, bleve.NewDisjunctionQuery(
+			matchQuery(term, "name", 3),
+			matchQuery(term, "tags", 2),
+			matchQuery(term, "content", 1),
+		))
+	}
+	if req.Class != "" {
+		q := bleve.NewTermQuery(req.Class)
+		q.SetField("class")
+		must = append(must, q)
+	}
+	if req.Mime != "" {
+		q := bleve.NewTermQuery(req.Mime)
+		q.SetField("mime")
+		must = append(must, q)
+	}
+	if req.UpdatedAfter != nil || req.UpdatedBefore != nil {
+		var start, end time.Time
+		if req.UpdatedAfter != nil {
+			start = *req.UpdatedAfter
+		}
+		if req.UpdatedBefore != nil {
+			end = *req.UpdatedBefore
+		}
+		q := bleve.NewDateRangeQuery(start, end)
+		q.SetField("updated_at")
+		must = append(must, q)
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > MaxLimit {
+		limit = MaxLimit
+	}
+	sreq := bleve.NewSearchRequestOptions(bleve.NewConjunctionQuery(must...), limit, req.Skip, false)
+	res, err := idx.Search(sreq)
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := make([]Hit, len(res.Hits))
+	for i, hit := range res.Hits {
+		hits[i] = Hit{FileID: hit.ID, Score: hit.Score}
+	}
+	return hits, int(res.Total), nil
+}
+
+func matchQuery(term, field string, boost float64) query.Query {
+	q := bleve.NewMatchQuery(term)
+	q.SetField(field)
+	q.SetBoost(boost)
+	return q
+}
+
+// IsIndexable returns true if the document is a file that can be indexed.
+func IsIndexable(doc *vfs.FileDoc) bool {
+	return doc.Type == consts.FileType
+}
@@ -0,0 +1,52 @@
+package search
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/stretchr/testify/assert"
+)
+
+func addMemIndex(t *testing.T, domain string, users int, lastUsed time.Time) {
+	idx, err := bleve.NewMemOnly(newMapping())
+	if !assert.NoError(t, err) {
+		return
+	}
+	indexes[domain] = &openIndex{Index: idx, domain: domain, users: users, lastUsed: lastUsed}
+}
+
+func TestCloseIndexes(t *testing.T) {
+	indexesMu.Lock()
+	defer indexesMu.Unlock()
+	defer func() {
+		closeIndexes(0)
+		indexes = make(map[string]*openIndex)
+	}()
+
+	now := time.Now()
+	addMemIndex(t, "idle.cozy.tools", 0, now.Add(-2*indexIdleTimeout))
+	addMemIndex(t, "busy.cozy.tools", 1, now.Add(-2*indexIdleTimeout))
+	addMemIndex(t, "old.cozy.tools", 0, now.Add(-3*time.Minute))
+	addMemIndex(t, "recent.cozy.tools", 0, now.Add(-1*time.Minute))
+
+	// The idle index is closed, even if the limit is not reached
+	closeIndexes(10)
+	assert.Len(t, indexes, 3)
+	assert.NotContains(t, indexes, "idle.cozy.tools")
+
+	// The least recently used index is closed first, and the one in use is kept
+	closeIndexes(2)
+	assert.Len(t, indexes, 2)
+	assert.Contains(t, indexes, "busy.cozy.tools")
+	assert.Contains(t, indexes, "recent.cozy.tools")
+
+	closeIndexes(0)
+	assert.Len(t, indexes, 1)
+	assert.Contains(t, indexes, "busy.cozy.tools")
+
+	idx := indexes["busy.cozy.tools"]
+	idx.users--
+	closeIndexes(0)
+	assert.Len(t, indexes, 0)
+}
@@ -11,6 +11,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/echo"
 )
@@ -171,12 +172,16 @@ func GetAll(inst *instance.Instance) ([]*Session, error) {
 }
 
 // Delete is a function to delete the session in couchdb,
-// and returns a cookie with a negative MaxAge to clear it
+// and returns a cookie with a negative MaxAge to clear it. The tokens tied to
+// this session are revoked.
 func (s *Session) Delete(i *instance.Instance) *http.Cookie {
 	err := couchdb.DeleteDoc(i, s)
 	if err != nil {
 		i.Logger().Error("[session] Failed to delete session:", err)
 	}
+	if err = permissions.RevokeSession(i, s.ID()); err != nil {
+		i.Logger().Error("[session] Failed to revoke the tokens of the session:", err)
+	}
 	return &http.Cookie{
 		Name:   SessionCookieName,
 		Value:  "",
@@ -0,0 +1,271 @@
+package sharing
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+// ActivityAction is the kind of change made on a shared document
+type ActivityAction string
+
+const (
+	// ActivityAdded is used when a document is added to the sharing
+	ActivityAdded ActivityAction = "added"
+	// ActivityUpdated is used when a shared document is modified
+	ActivityUpdated ActivityAction = "updated"
+	// ActivityRemoved is used when a document is removed from the sharing
+	ActivityRemoved ActivityAction = "removed"
+	// ActivityBulk is used for the summary of the changes made on several
+	// documents by a bulk of the replication
+	ActivityBulk ActivityAction = "bulk"
+)
+
+// DefaultActivityLimit is the default number of entries returned by a page
+// of the activity feed.
+const DefaultActivityLimit = 50
+
+// activityBatchSize is the number of entries deleted at once when the
+// activity feed is pruned or removed.
+const activityBatchSize = 100
+
+var (
+	// MaxActivities is the maximal number of entries kept in the activity
+	// feed of a sharing: the oldest entries are removed.
+	MaxActivities = 1000
+	// ActivityRetention is the maximal age of the entries of the activity
+	// feed.
+	ActivityRetention = 90 * 24 * time.Hour
+)
+
+// Activity is an entry of the activity feed of a sharing: it records that a
+// member has added, changed or removed a shared document. As they are
+// created like the other documents, they are also sent to the realtime hub.
+type Activity struct {
+	DocID       string         `json:"_id,omitempty"`
+	DocRev      string         `json:"_rev,omitempty"`
+	SharingID   string         `json:"sharing_id"`
+	MemberIndex int            `json:"member_index"`
+	MemberName  string         `json:"member_name,omitempty"`
+	Action      ActivityAction `json:"action"`
+	DocType     string         `json:"doctype"`
+	SharedID    string         `json:"shared_id"`
+	Name        string         `json:"name,omitempty"`
+	// Counts is the number of documents for each action, for a summary entry
+	// (the shared_id and name are then empty)
+	Counts    map[ActivityAction]int `json:"counts,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+// ID implements couchdb.Doc
+func (a *Activity) ID() string { return a.DocID }
+
+// Rev implements couchdb.Doc
+func (a *Activity) Rev() string { return a.DocRev }
+
+// DocType implements couchdb.Doc
+func (a *Activity) DocType() string { return consts.SharingsActivity }
+
+// SetID implements couchdb.Doc
+func (a *Activity) SetID(id string) { a.DocID = id }
+
+// SetRev implements couchdb.Doc
+func (a *Activity) SetRev(rev string) { a.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (a *Activity) Clone() couchdb.Doc {
+	cloned := *a
+	return &cloned
+}
+
+// localMember returns the member of the sharing for the current instance
+func (s *Sharing) localMember() *Member {
+	if s.Owner {
+		return &s.Members[0]
+	}
+	for i, m := range s.Members {
+		if i > 0 && m.Instance != "" {
+			return &s.Members[i]
+		}
+	}
+	return nil
+}
+
+// RecordActivity adds an entry to the activity feed of the sharing, for a
+// change made by the given member. A failure is logged, but it doesn't stop
+// the synchronization.
+func (s *Sharing) RecordActivity(inst *instance.Instance, m *Member, action ActivityAction, doctype, id, name string) {
+	s.recordActivity(inst, m, &Activity{
+		Action:   action,
+		DocType:  doctype,
+		SharedID: id,
+		Name:     name,
+	})
+}
+
+// RecordBulkActivity adds a single entry to the activity feed of the sharing
+// for the changes made by a bulk of the replication on documents of the given
+// doctype. When several documents have been changed, the entry is a summary
+// with the number of documents for each action.
+func (s *Sharing) RecordBulkActivity(inst *instance.Instance, m *Member, doctype string, activities []Activity) {
+	switch len(activities) {
+	case 0:
+		return
+	case 1:
+		a := activities[0]
+		s.recordActivity(inst, m, &a)
+		return
+	}
+	counts := make(map[ActivityAction]int)
+	for _, a := range activities {
+		counts[a.Action]++
+	}
+	s.recordActivity(inst, m, &Activity{
+		Action:  ActivityBulk,
+		DocType: doctype,
+		Counts:  counts,
+	})
+}
+
+func (s *Sharing) recordActivity(inst *instance.Instance, m *Member, a *Activity) {
+	index := -1
+	for i := range s.Members {
+		if &s.Members[i] == m {
+			index = i
+			break
+		}
+	}
+	log := inst.Logger().WithField("nspace", "sharing")
+	if index < 0 {
+		log.Debugf("No member for the activity on %s/%s", a.DocType, a.SharedID)
+		return
+	}
+	a.SharingID = s.SID
+	a.MemberIndex = index
+	a.MemberName = m.PrimaryName()
+	a.CreatedAt = time.Now()
+	if err := couchdb.CreateDoc(inst, a); err != nil {
+		log.Warnf("Cannot record the activity on %s/%s: %s", a.DocType, a.SharedID, err)
+		return
+	}
+	if err := s.pruneActivities(inst); err != nil {
+		log.Warnf("Cannot prune the activity of sharing %s: %s", s.SID, err)
+	}
+}
+
+// findActivities returns the entries of the activity feed for the given
+// request on the view.
+func findActivities(inst *instance.Instance, req *couchdb.ViewRequest) ([]couchdb.Doc, error) {
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, consts.SharingsActivityView, req, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	docs := make([]couchdb.Doc, len(res.Rows))
+	for i, row := range res.Rows {
+		var a Activity
+		if err := json.Unmarshal(row.Doc, &a); err != nil {
+			return nil, err
+		}
+		docs[i] = &a
+	}
+	return docs, nil
+}
+
+// pruneActivities removes the entries of the activity feed that are older
+// than ActivityRetention, and those after the MaxActivities most recent.
+func (s *Sharing) pruneActivities(inst *instance.Instance) error {
+	reqs := []*couchdb.ViewRequest{
+		{
+			StartKey:    []interface{}{s.SID},
+			EndKey:      []interface{}{s.SID, time.Now().Add(-ActivityRetention)},
+			IncludeDocs: true,
+			Limit:       activityBatchSize,
+		},
+		{
+			StartKey:    []interface{}{s.SID, map[string]interface{}{}},
+			EndKey:      []interface{}{s.SID},
+			Descending:  true,
+			Skip:        MaxActivities,
+			IncludeDocs: true,
+			Limit:       activityBatchSize,
+		},
+	}
+	for _, req := range reqs {
+		docs, err := findActivities(inst, req)
+		if err != nil {
+			return err
+		}
+		if err = couchdb.BulkDeleteDocs(inst, consts.SharingsActivity, docs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteActivities removes the whole activity feed of the sharing, when it is
+// revoked.
+func (s *Sharing) deleteActivities(inst *instance.Instance) error {
+	for {
+		docs, err := findActivities(inst, &couchdb.ViewRequest{
+			StartKey:    []interface{}{s.SID},
+			EndKey:      []interface{}{s.SID, map[string]interface{}{}},
+			IncludeDocs: true,
+			Limit:       activityBatchSize,
+		})
+		if err != nil {
+			return err
+		}
+		if err = couchdb.BulkDeleteDocs(inst, consts.SharingsActivity, docs); err != nil {
+			return err
+		}
+		if len(docs) < activityBatchSize {
+			return nil
+		}
+	}
+}
+
+// ListActivities returns a page of the activity feed of the sharing, the most
+// recent entries first.
+func (s *Sharing) ListActivities(inst *instance.Instance, cursor couchdb.Cursor) ([]*Activity, error) {
+	req := &couchdb.ViewRequest{
+		StartKey:    []interface{}{s.SID, map[string]interface{}{}},
+		EndKey:      []interface{}{s.SID},
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, consts.SharingsActivityView, req, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*Activity{}, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	activities := make([]*Activity, len(res.Rows))
+	for i, row := range res.Rows {
+		var a Activity
+		if err := json.Unmarshal(row.Doc, &a); err != nil {
+			return nil, err
+		}
+		activities[i] = &a
+	}
+	return activities, nil
+}
+
+// recordLocalActivity adds an entry to the activity feed of a sharing for a
+// change made on the current instance.
+func (s *Sharing) recordLocalActivity(inst *instance.Instance, action ActivityAction, doc couchdb.JSONDoc) {
+	name, _ := doc.Get("name").(string)
+	s.RecordActivity(inst, s.localMember(), action, doc.DocType(), doc.ID(), name)
+}
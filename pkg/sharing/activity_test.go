@@ -0,0 +1,185 @@
+package sharing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivityFeed(t *testing.T) {
+	couchdb.CreateDB(inst, consts.Shared)
+	couchdb.CreateDB(inst, foos)
+
+	s := Sharing{
+		SID:   uuidv4(),
+		Owner: true,
+		Rules: []Rule{
+			{
+				Title:    "foos rule",
+				DocType:  foos,
+				Selector: "hello",
+				Values:   []string{"world"},
+			},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+
+	fooID := uuidv4()
+	payload := DocsByDoctype{
+		foos: DocsList{
+			{
+				"_id":  fooID,
+				"_rev": "1-abc",
+				"_revisions": map[string]interface{}{
+					"start": float64(1),
+					"ids":   []interface{}{"abc"},
+				},
+				"hello": "world",
+			},
+		},
+	}
+	err := s.ApplyBulkDocs(inst, payload, &s.Members[1])
+	assert.NoError(t, err)
+
+	payload = DocsByDoctype{
+		foos: DocsList{
+			{
+				"_id":  fooID,
+				"_rev": "2-def",
+				"_revisions": map[string]interface{}{
+					"start": float64(2),
+					"ids":   []interface{}{"def", "abc"},
+				},
+				"hello": "world",
+			},
+		},
+	}
+	err = s.ApplyBulkDocs(inst, payload, &s.Members[1])
+	assert.NoError(t, err)
+
+	cursor := couchdb.NewKeyCursor(DefaultActivityLimit, nil, "")
+	activities, err := s.ListActivities(inst, cursor)
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 2) {
+		actions := []ActivityAction{activities[0].Action, activities[1].Action}
+		assert.ElementsMatch(t, []ActivityAction{ActivityAdded, ActivityUpdated}, actions)
+		for _, a := range activities {
+			assert.Equal(t, s.SID, a.SharingID)
+			assert.Equal(t, 1, a.MemberIndex)
+			assert.Equal(t, "Bob", a.MemberName)
+			assert.Equal(t, foos, a.DocType)
+			assert.Equal(t, fooID, a.SharedID)
+		}
+	}
+
+	// No activity is recorded when the member is unknown
+	s.RecordActivity(inst, nil, ActivityRemoved, foos, fooID, "")
+	activities, err = s.ListActivities(inst, couchdb.NewKeyCursor(DefaultActivityLimit, nil, ""))
+	assert.NoError(t, err)
+	assert.Len(t, activities, 2)
+}
+
+func TestActivitySummaryAndRetention(t *testing.T) {
+	s := Sharing{
+		SID:   uuidv4(),
+		Owner: true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+
+	// A bulk with several documents gives a single summary entry
+	s.RecordBulkActivity(inst, &s.Members[1], foos, []Activity{
+		{Action: ActivityAdded, DocType: foos, SharedID: uuidv4()},
+		{Action: ActivityAdded, DocType: foos, SharedID: uuidv4()},
+		{Action: ActivityRemoved, DocType: foos, SharedID: uuidv4()},
+	})
+	activities, err := s.ListActivities(inst, couchdb.NewKeyCursor(DefaultActivityLimit, nil, ""))
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 1) {
+		assert.Equal(t, ActivityBulk, activities[0].Action)
+		assert.Equal(t, foos, activities[0].DocType)
+		assert.Empty(t, activities[0].SharedID)
+		assert.Equal(t, map[ActivityAction]int{
+			ActivityAdded:   2,
+			ActivityRemoved: 1,
+		}, activities[0].Counts)
+	}
+
+	// Only the most recent entries are kept
+	previous := MaxActivities
+	MaxActivities = 2
+	defer func() { MaxActivities = previous }()
+	for i := 0; i < 3; i++ {
+		s.RecordActivity(inst, &s.Members[1], ActivityUpdated, foos, uuidv4(), "")
+	}
+	activities, err = s.ListActivities(inst, couchdb.NewKeyCursor(DefaultActivityLimit, nil, ""))
+	assert.NoError(t, err)
+	if assert.Len(t, activities, 2) {
+		assert.Equal(t, ActivityUpdated, activities[0].Action)
+		assert.Equal(t, ActivityUpdated, activities[1].Action)
+	}
+
+	// The activity feed is removed with the sharing
+	assert.NoError(t, s.deleteActivities(inst))
+	activities, err = s.ListActivities(inst, couchdb.NewKeyCursor(DefaultActivityLimit, nil, ""))
+	assert.NoError(t, err)
+	assert.Len(t, activities, 0)
+}
+
+func TestSyncStatus(t *testing.T) {
+	couchdb.CreateDB(inst, consts.Shared)
+	s := Sharing{
+		SID:   uuidv4(),
+		Owner: true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob", Instance: "https://bob.cozy.example"},
+			{Status: MemberStatusMailNotSent, Name: "Charlie"},
+		},
+	}
+
+	s.updateSyncStatus(inst, &s.Members[1], "replicator", nil)
+	s.updateSyncStatus(inst, &s.Members[1], "upload", ErrInternalServerError)
+	s.updateRetryStatus(inst, "share-upload", 2, time.Minute)
+
+	status, err := s.SyncStatus(inst)
+	assert.NoError(t, err)
+	if assert.Len(t, status.Members, 2) {
+		bob := status.Members[0]
+		assert.Equal(t, 1, bob.Index)
+		assert.Equal(t, "Bob", bob.Name)
+		assert.NotNil(t, bob.LastReplication)
+		assert.Nil(t, bob.LastUpload)
+		assert.Equal(t, ErrInternalServerError.Error(), bob.LastError)
+		assert.NotNil(t, bob.LastErrorAt)
+		charlie := status.Members[1]
+		assert.Equal(t, 2, charlie.Index)
+		assert.Nil(t, charlie.LastReplication)
+		assert.Equal(t, 0, charlie.PendingChanges)
+	}
+	if assert.Len(t, status.Retries, 1) {
+		assert.Equal(t, "share-upload", status.Retries[0].Worker)
+		assert.Equal(t, 2, status.Retries[0].Errors)
+		assert.NotNil(t, status.Retries[0].NextRetryAt)
+		assert.False(t, status.Retries[0].GaveUp)
+	}
+
+	// A success clears the retry schedule
+	s.updateRetryStatus(inst, "share-upload", 0, 0)
+	status, err = s.SyncStatus(inst)
+	assert.NoError(t, err)
+	assert.Len(t, status.Retries, 0)
+
+	err = s.ClearLastSequenceNumbers(inst, &s.Members[1])
+	assert.NoError(t, err)
+	_, err = couchdb.GetLocal(inst, consts.Shared, "sharing-"+s.SID+"-1/replicator")
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
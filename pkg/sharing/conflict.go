@@ -0,0 +1,400 @@
+package sharing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cozy/cozy-stack/client/request"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/notification"
+	"github.com/cozy/cozy-stack/pkg/notification/center"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ConflictResolution is the choice made by the user to resolve a conflict
+type ConflictResolution string
+
+const (
+	// KeepMine is used to keep the version of the file from this cozy
+	KeepMine ConflictResolution = "mine"
+	// KeepTheirs is used to keep the version of the file from the other cozy
+	KeepTheirs ConflictResolution = "theirs"
+	// KeepBoth is used to keep the two versions, in two files
+	KeepBoth ConflictResolution = "both"
+)
+
+// DefaultConflictLimit is the default number of conflicts returned by a page
+// of the list of conflicts.
+const DefaultConflictLimit = 50
+
+// Conflict is a document of io.cozy.sharings.conflicts: it records that a
+// shared file has been modified at the same time on two cozy instances. The
+// two versions have been kept, in two files.
+type Conflict struct {
+	DocID     string `json:"_id,omitempty"`
+	DocRev    string `json:"_rev,omitempty"`
+	SharingID string `json:"sharing_id"`
+	// Name is the name of the file before the conflict
+	Name string `json:"name"`
+	// LocalID is the identifier of the file with the version of this cozy,
+	// and RemoteID the identifier of the file with the version of the other
+	// cozy
+	LocalID  string `json:"local_file_id"`
+	RemoteID string `json:"remote_file_id"`
+	// LocalRev and RemoteRev are the revisions of the two files when the
+	// conflict was recorded, or when the user was told they have changed
+	LocalRev   string             `json:"local_file_rev,omitempty"`
+	RemoteRev  string             `json:"remote_file_rev,omitempty"`
+	Resolution ConflictResolution `json:"resolution,omitempty"`
+	CreatedAt  time.Time          `json:"created_at"`
+	ResolvedAt *time.Time         `json:"resolved_at,omitempty"`
+}
+
+// ID implements couchdb.Doc
+func (c *Conflict) ID() string { return c.DocID }
+
+// Rev implements couchdb.Doc
+func (c *Conflict) Rev() string { return c.DocRev }
+
+// DocType implements couchdb.Doc
+func (c *Conflict) DocType() string { return consts.SharingsConflicts }
+
+// SetID implements couchdb.Doc
+func (c *Conflict) SetID(id string) { c.DocID = id }
+
+// SetRev implements couchdb.Doc
+func (c *Conflict) SetRev(rev string) { c.DocRev = rev }
+
+// Clone implements couchdb.Doc
+func (c *Conflict) Clone() couchdb.Doc {
+	cloned := *c
+	if c.ResolvedAt != nil {
+		at := *c.ResolvedAt
+		cloned.ResolvedAt = &at
+	}
+	return &cloned
+}
+
+// ConflictResolvedMsg is sent to the other members of a sharing when a
+// conflict has been resolved, with the identifiers of the two files in
+// conflict and of the files that have been kept.
+type ConflictResolvedMsg struct {
+	FileIDs []string `json:"file_ids"`
+	KeptIDs []string `json:"kept_ids"`
+}
+
+// conflictDocID returns the identifier of the conflict between two files. It
+// doesn't depend on which file has the local version, so that a conflict can
+// be found from the identifiers of the files sent by another member.
+func conflictDocID(sharingID, fileID, otherID string) string {
+	if fileID > otherID {
+		fileID, otherID = otherID, fileID
+	}
+	return sharingID + "-" + fileID + "-" + otherID
+}
+
+// newConflict returns a conflict between the local and the remote versions of
+// a file. It must be recorded once the two files have been written.
+func (s *Sharing) newConflict(name, localID, remoteID string) *Conflict {
+	return &Conflict{
+		DocID:     conflictDocID(s.SID, localID, remoteID),
+		SharingID: s.SID,
+		Name:      name,
+		LocalID:   localID,
+		RemoteID:  remoteID,
+	}
+}
+
+// conflictFileRev returns the current revision of a file in conflict, or an
+// empty string if the file doesn't exist anymore.
+func conflictFileRev(fs vfs.VFS, fileID string) (string, error) {
+	file, err := fs.FileByID(fileID)
+	if err == os.ErrNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return file.DocRev, nil
+}
+
+// recordConflict saves a conflict on a shared file and notifies the user. A
+// failure is logged, but it doesn't stop the synchronization.
+func (s *Sharing) recordConflict(inst *instance.Instance, c *Conflict) {
+	if c == nil {
+		return
+	}
+	fs := inst.VFS()
+	c.LocalRev, _ = conflictFileRev(fs, c.LocalID)
+	c.RemoteRev, _ = conflictFileRev(fs, c.RemoteID)
+	c.CreatedAt = time.Now()
+	if err := couchdb.CreateNamedDocWithDB(inst, c); err != nil {
+		// The conflict on these two files has already been recorded
+		if couchdb.IsConflictError(err) {
+			return
+		}
+		inst.Logger().WithField("nspace", "sharing").
+			Warnf("Cannot record the conflict on %s: %s", c.LocalID, err)
+		return
+	}
+
+	slug := s.AppSlug
+	if slug == "" {
+		slug = consts.DriveSlug
+	}
+	n := &notification.Notification{
+		Title:   inst.Translate("Notification Sharing Conflict Title"),
+		Message: inst.Translate("Notification Sharing Conflict Message", c.Name),
+		Data: map[string]interface{}{
+			"SharingID":    s.SID,
+			"ConflictID":   c.ID(),
+			"FileName":     c.Name,
+			"Description":  s.Description,
+			"ConflictLink": inst.SubDomain(slug).String(),
+		},
+	}
+	if err := center.PushStack(inst.Domain, center.NotificationSharingConflict, n); err != nil {
+		inst.Logger().WithField("nspace", "sharing").
+			Warnf("Cannot notify the conflict on %s: %s", c.LocalID, err)
+	}
+}
+
+// FindConflict returns the conflict with the given identifier on the files of
+// the sharing.
+func (s *Sharing) FindConflict(inst *instance.Instance, conflictID string) (*Conflict, error) {
+	var c Conflict
+	if err := couchdb.GetDoc(inst, consts.SharingsConflicts, conflictID, &c); err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, ErrConflictNotFound
+		}
+		return nil, err
+	}
+	if c.SharingID != s.SID {
+		return nil, ErrConflictNotFound
+	}
+	return &c, nil
+}
+
+// ListConflicts returns a page of the conflicts on the files of the sharing,
+// the most recent first.
+func (s *Sharing) ListConflicts(inst *instance.Instance, cursor couchdb.Cursor) ([]*Conflict, error) {
+	req := &couchdb.ViewRequest{
+		StartKey:    []interface{}{s.SID, map[string]interface{}{}},
+		EndKey:      []interface{}{s.SID},
+		Descending:  true,
+		IncludeDocs: true,
+	}
+	cursor.ApplyTo(req)
+
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(inst, consts.SharingsConflictsView, req, &res)
+	if err != nil {
+		if couchdb.IsNoDatabaseError(err) {
+			return []*Conflict{}, nil
+		}
+		return nil, err
+	}
+	cursor.UpdateFrom(&res)
+
+	conflicts := make([]*Conflict, len(res.Rows))
+	for i, row := range res.Rows {
+		var c Conflict
+		if err := json.Unmarshal(row.Doc, &c); err != nil {
+			return nil, err
+		}
+		conflicts[i] = &c
+	}
+	return conflicts, nil
+}
+
+// ResolveConflict applies the choice of the user for a conflict: the file
+// with the other version is moved to the trash, and the file with the kept
+// version gets back the name from before the conflict. These changes are
+// then replicated to the other members like any other change on the files,
+// and the resolution must be sent to them with NotifyConflictResolved.
+//
+// If one of the files has changed since the conflict was recorded (or since
+// the last ErrConflictOutdated), the resolution is refused, as the user may
+// no longer keep the version they think.
+func (s *Sharing) ResolveConflict(inst *instance.Instance, c *Conflict, keep ConflictResolution) error {
+	if c.Resolution != "" {
+		return ErrConflictResolved
+	}
+	var winnerID, loserID string
+	switch keep {
+	case KeepMine:
+		winnerID, loserID = c.LocalID, c.RemoteID
+	case KeepTheirs:
+		winnerID, loserID = c.RemoteID, c.LocalID
+	case KeepBoth:
+		// Nothing to do on the files
+	default:
+		return ErrInvalidResolution
+	}
+
+	if loserID != "" {
+		fs := inst.VFS()
+		localRev, err := conflictFileRev(fs, c.LocalID)
+		if err != nil {
+			return err
+		}
+		remoteRev, err := conflictFileRev(fs, c.RemoteID)
+		if err != nil {
+			return err
+		}
+		if localRev != c.LocalRev || remoteRev != c.RemoteRev {
+			c.LocalRev, c.RemoteRev = localRev, remoteRev
+			if err = couchdb.UpdateDoc(inst, c); err != nil {
+				return err
+			}
+			return ErrConflictOutdated
+		}
+
+		loser, err := fs.FileByID(loserID)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if loser != nil && !loser.Trashed {
+			if _, err = vfs.TrashFile(fs, loser); err != nil {
+				return err
+			}
+		}
+		winner, err := fs.FileByID(winnerID)
+		if err != nil && err != os.ErrNotExist {
+			return err
+		}
+		if winner != nil && !winner.Trashed && winner.DocName != c.Name {
+			name := c.Name
+			_, err = vfs.ModifyFileMetadata(fs, winner, &vfs.DocPatch{Name: &name})
+			// The name can have been taken by another file since the conflict
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+	}
+
+	now := time.Now()
+	c.Resolution = keep
+	c.ResolvedAt = &now
+	return couchdb.UpdateDoc(inst, c)
+}
+
+// ResolveConflictByNotification is called when another member has resolved a
+// conflict: the same conflict on this cozy is marked as resolved, without
+// touching the files, as the changes made by the other member on them are
+// replicated. It returns the conflict, or nil if it was not recorded on this
+// cozy or is already resolved.
+func (s *Sharing) ResolveConflictByNotification(inst *instance.Instance, msg *ConflictResolvedMsg) (*Conflict, error) {
+	if len(msg.FileIDs) != 2 || len(msg.KeptIDs) == 0 {
+		return nil, ErrInvalidResolution
+	}
+	id := conflictDocID(s.SID, msg.FileIDs[0], msg.FileIDs[1])
+	c, err := s.FindConflict(inst, id)
+	if err != nil {
+		if err == ErrConflictNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if c.Resolution != "" {
+		return nil, nil
+	}
+
+	c.Resolution = KeepBoth
+	if len(msg.KeptIDs) == 1 {
+		if msg.KeptIDs[0] == c.LocalID {
+			c.Resolution = KeepMine
+		} else {
+			c.Resolution = KeepTheirs
+		}
+	}
+	now := time.Now()
+	c.ResolvedAt = &now
+	if err = couchdb.UpdateDoc(inst, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NotifyConflictResolved sends the resolution of a conflict to the other
+// members of the sharing (except the given one), so that they can close the
+// same conflict on their cozy. A recipient sends it to the owner, and the
+// owner to the recipients. It is meant to be used in a goroutine, errors are
+// just logged.
+func (s *Sharing) NotifyConflictResolved(inst *instance.Instance, c *Conflict, except *Member) {
+	kept := []string{c.LocalID, c.RemoteID}
+	switch c.Resolution {
+	case KeepMine:
+		kept = []string{c.LocalID}
+	case KeepTheirs:
+		kept = []string{c.RemoteID}
+	}
+
+	for i := range s.Members {
+		m := &s.Members[i]
+		if m == except {
+			continue
+		}
+		if s.Owner && (i == 0 || m.Status != MemberStatusReady) {
+			continue
+		}
+		if !s.Owner && i > 0 {
+			break
+		}
+		creds := s.FindCredentials(m)
+		if creds == nil || creds.AccessToken == nil {
+			continue
+		}
+		msg := &ConflictResolvedMsg{
+			FileIDs: []string{XorID(c.LocalID, creds.XorKey), XorID(c.RemoteID, creds.XorKey)},
+			KeptIDs: make([]string, len(kept)),
+		}
+		for j, id := range kept {
+			msg.KeptIDs[j] = XorID(id, creds.XorKey)
+		}
+		if err := s.sendConflictResolved(inst, m, creds, msg); err != nil {
+			inst.Logger().WithField("nspace", "sharing").
+				Infof("Can't notify %#v about the resolved conflict %s: %s", m, c.ID(), err)
+		}
+	}
+}
+
+func (s *Sharing) sendConflictResolved(inst *instance.Instance, m *Member, creds *Credentials, msg *ConflictResolvedMsg) error {
+	u, err := url.Parse(m.Instance)
+	if m.Instance == "" || err != nil {
+		return ErrInvalidURL
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	opts := &request.Options{
+		Method: http.MethodPut,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/" + s.SID + "/conflicts",
+		Headers: request.Headers{
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer " + creds.AccessToken.AccessToken,
+		},
+		Body: bytes.NewReader(body),
+	}
+	res, err := request.Req(opts)
+	if res != nil && res.StatusCode/100 == 4 {
+		res, err = RefreshToken(inst, s, m, creds, opts, body)
+	}
+	if err != nil {
+		if res != nil && res.StatusCode/100 == 5 {
+			return ErrInternalServerError
+		}
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
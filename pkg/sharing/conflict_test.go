@@ -0,0 +1,166 @@
+package sharing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConflicts(t *testing.T) {
+	s := Sharing{
+		SID:         uuidv4(),
+		Active:      true,
+		Owner:       true,
+		Description: "Holidays photos",
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+	other := Sharing{SID: uuidv4()}
+
+	localID, remoteID := uuidv4(), uuidv4()
+	s.recordConflict(inst, s.newConflict("cloudy.jpg", localID, remoteID))
+	// The same conflict can be found by the other members
+	s.recordConflict(inst, s.newConflict("cloudy.jpg", remoteID, localID))
+
+	conflicts, err := s.ListConflicts(inst, couchdb.NewKeyCursor(DefaultConflictLimit, nil, ""))
+	require.NoError(t, err)
+	require.Len(t, conflicts, 1)
+	c := conflicts[0]
+	assert.Equal(t, s.SID, c.SharingID)
+	assert.Equal(t, "cloudy.jpg", c.Name)
+	assert.Equal(t, localID, c.LocalID)
+	assert.Equal(t, remoteID, c.RemoteID)
+	assert.Equal(t, conflictDocID(s.SID, remoteID, localID), c.ID())
+	assert.Empty(t, c.Resolution)
+
+	conflicts, err = other.ListConflicts(inst, couchdb.NewKeyCursor(DefaultConflictLimit, nil, ""))
+	assert.NoError(t, err)
+	assert.Len(t, conflicts, 0)
+	_, err = other.FindConflict(inst, c.ID())
+	assert.Equal(t, ErrConflictNotFound, err)
+
+	found, err := s.FindConflict(inst, c.ID())
+	require.NoError(t, err)
+	assert.Equal(t, ErrInvalidResolution, s.ResolveConflict(inst, found, "none"))
+	assert.NoError(t, s.ResolveConflict(inst, found, KeepBoth))
+	assert.Equal(t, KeepBoth, found.Resolution)
+	assert.NotNil(t, found.ResolvedAt)
+	assert.Equal(t, ErrConflictResolved, s.ResolveConflict(inst, found, KeepMine))
+}
+
+func createConflictFile(t *testing.T, name, content string) *vfs.FileDoc {
+	fs := inst.VFS()
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, -1, nil, "text/plain", "text", time.Now(), false, false, nil)
+	require.NoError(t, err)
+	file, err := fs.CreateFile(doc, nil)
+	require.NoError(t, err)
+	_, err = file.Write([]byte(content))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	doc, err = fs.FileByID(doc.ID())
+	require.NoError(t, err)
+	return doc
+}
+
+func makeConflictOnFiles(t *testing.T, s *Sharing) (*Conflict, *vfs.FileDoc, *vfs.FileDoc) {
+	name := "report-" + uuidv4() + ".txt"
+	local := createConflictFile(t, name, "mine")
+	remote := createConflictFile(t, conflictName(name, "2-abc"), "theirs")
+	s.recordConflict(inst, s.newConflict(name, local.ID(), remote.ID()))
+	c, err := s.FindConflict(inst, conflictDocID(s.SID, local.ID(), remote.ID()))
+	require.NoError(t, err)
+	assert.Equal(t, local.Rev(), c.LocalRev)
+	assert.Equal(t, remote.Rev(), c.RemoteRev)
+	return c, local, remote
+}
+
+func TestResolveConflictKeepMine(t *testing.T) {
+	s := &Sharing{SID: uuidv4(), Active: true, Owner: true}
+	c, local, remote := makeConflictOnFiles(t, s)
+
+	require.NoError(t, s.ResolveConflict(inst, c, KeepMine))
+	assert.Equal(t, KeepMine, c.Resolution)
+
+	fs := inst.VFS()
+	kept, err := fs.FileByID(local.ID())
+	require.NoError(t, err)
+	assert.False(t, kept.Trashed)
+	assert.Equal(t, c.Name, kept.DocName)
+	trashed, err := fs.FileByID(remote.ID())
+	require.NoError(t, err)
+	assert.True(t, trashed.Trashed)
+}
+
+func TestResolveConflictKeepTheirs(t *testing.T) {
+	s := &Sharing{SID: uuidv4(), Active: true, Owner: true}
+	c, local, remote := makeConflictOnFiles(t, s)
+	fs := inst.VFS()
+
+	// The other version has been modified since the conflict
+	tags := []string{"draft"}
+	remote, err := vfs.ModifyFileMetadata(fs, remote, &vfs.DocPatch{Tags: &tags})
+	require.NoError(t, err)
+	assert.Equal(t, ErrConflictOutdated, s.ResolveConflict(inst, c, KeepTheirs))
+	assert.Empty(t, c.Resolution)
+	assert.Equal(t, remote.Rev(), c.RemoteRev)
+	trashed, err := fs.FileByID(local.ID())
+	require.NoError(t, err)
+	assert.False(t, trashed.Trashed)
+
+	// The user has seen the new version, and can keep it
+	require.NoError(t, s.ResolveConflict(inst, c, KeepTheirs))
+	assert.Equal(t, KeepTheirs, c.Resolution)
+	kept, err := fs.FileByID(remote.ID())
+	require.NoError(t, err)
+	assert.False(t, kept.Trashed)
+	assert.Equal(t, c.Name, kept.DocName)
+	trashed, err = fs.FileByID(local.ID())
+	require.NoError(t, err)
+	assert.True(t, trashed.Trashed)
+}
+
+func TestResolveConflictByNotification(t *testing.T) {
+	s := &Sharing{SID: uuidv4(), Active: true, Owner: true}
+	c, local, remote := makeConflictOnFiles(t, s)
+
+	// A conflict that was not recorded on this cozy
+	msg := &ConflictResolvedMsg{
+		FileIDs: []string{uuidv4(), uuidv4()},
+		KeptIDs: []string{uuidv4()},
+	}
+	found, err := s.ResolveConflictByNotification(inst, msg)
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+
+	// The other member has kept its version, which is the remote one here
+	msg = &ConflictResolvedMsg{
+		FileIDs: []string{remote.ID(), local.ID()},
+		KeptIDs: []string{remote.ID()},
+	}
+	found, err = s.ResolveConflictByNotification(inst, msg)
+	require.NoError(t, err)
+	require.NotNil(t, found)
+	assert.Equal(t, c.ID(), found.ID())
+	assert.Equal(t, KeepTheirs, found.Resolution)
+	assert.NotNil(t, found.ResolvedAt)
+
+	// The files are left to the replication
+	file, err := inst.VFS().FileByID(local.ID())
+	require.NoError(t, err)
+	assert.False(t, file.Trashed)
+
+	// The conflict can't be resolved a second time
+	found, err = s.ResolveConflictByNotification(inst, msg)
+	assert.NoError(t, err)
+	assert.Nil(t, found)
+	c, err = s.FindConflict(inst, c.ID())
+	require.NoError(t, err)
+	assert.Equal(t, ErrConflictResolved, s.ResolveConflict(inst, c, KeepMine))
+}
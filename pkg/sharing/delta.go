@@ -0,0 +1,381 @@
+package sharing
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+)
+
+// When the content of a large shared file has changed, the sharer can send
+// only the parts that are not already on the recipient's cozy, like rsync:
+//
+// 1. the recipient computes the signature of its current version of the file:
+//    for each block, a weak rolling checksum and a strong hash
+// 2. the sharer reads its version of the file with a sliding window, and uses
+//    the signature to find the blocks that the recipient already has
+// 3. the sharer sends a delta, made of references to the blocks of the
+//    recipient, and of the bytes that can't be found there (literals)
+// 4. the recipient rebuilds the new content from its current version of the
+//    file and the delta, and the VFS checks the md5sum of the result.
+
+const (
+	// MinDeltaSize is the minimal size of a file for using a delta: for the
+	// small files, sending the signature costs more than it saves.
+	MinDeltaSize = 1 << 20 // 1 MB
+
+	minBlockSize   = 4 << 10  // 4 KB
+	maxBlockSize   = 1 << 20  // 1 MB
+	maxLiteralSize = 64 << 10 // 64 KB
+
+	deltaMagic    = "CZDELTA1"
+	deltaOpCopy   = 'C'
+	deltaOpLit    = 'L'
+	deltaOpEnd    = 'E'
+	maxMD5SumSize = 64
+)
+
+// Signature describes the content of a file, block by block, for computing a
+// delta against it. The last block is ignored if it is shorter than the
+// others.
+type Signature struct {
+	MD5Sum    []byte           `json:"md5sum"`
+	Size      int64            `json:"size"`
+	BlockSize int              `json:"block_size"`
+	Blocks    []BlockSignature `json:"blocks"`
+}
+
+// BlockSignature is the signature of a block of a file.
+type BlockSignature struct {
+	Weak   uint32 `json:"weak"`
+	Strong []byte `json:"strong"`
+}
+
+// blockSizeFor returns the block size for a file: roughly the square root of
+// the size, like rsync, as it is a good balance between the size of the
+// signature and the precision of the delta.
+func blockSizeFor(size int64) int {
+	bs := minBlockSize
+	for bs < maxBlockSize && int64(bs)*int64(bs) < size {
+		bs *= 2
+	}
+	return bs
+}
+
+// weakChecksum returns the two halves of the rolling checksum of a block.
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// ComputeSignature reads the content of a file, and returns its signature.
+func ComputeSignature(r io.Reader, size int64, md5sum []byte) (*Signature, error) {
+	bs := blockSizeFor(size)
+	sig := &Signature{
+		MD5Sum:    md5sum,
+		Size:      size,
+		BlockSize: bs,
+		Blocks:    make([]BlockSignature, 0, size/int64(bs)),
+	}
+	block := make([]byte, bs)
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return sig, nil
+			}
+			return nil, err
+		}
+		a, b := weakChecksum(block)
+		strong := md5.Sum(block)
+		sig.Blocks = append(sig.Blocks, BlockSignature{
+			Weak:   a | b<<16,
+			Strong: strong[:],
+		})
+	}
+}
+
+// WriteDelta reads the new content of a file from r, and writes to w the
+// delta between the file described by the signature and this new content. It
+// returns the number of bytes of the delta.
+func WriteDelta(w io.Writer, sig *Signature, r io.Reader) (int64, error) {
+	bs := sig.BlockSize
+	if bs < minBlockSize || bs > maxBlockSize || len(sig.MD5Sum) > maxMD5SumSize {
+		return 0, ErrCannotApplyDelta
+	}
+	dw := &deltaWriter{w: bufio.NewWriter(w)}
+	if err := dw.writeHeader(sig.MD5Sum, bs); err != nil {
+		return dw.size, err
+	}
+
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+
+	br := bufio.NewReaderSize(r, bs)
+	window := make([]byte, bs) // a ring buffer, starting at pos
+	block := make([]byte, bs)
+	pos := 0
+	n, err := io.ReadFull(br, window)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if err = dw.addLiteral(window[:n]); err != nil {
+			return dw.size, err
+		}
+		return dw.finish()
+	} else if err != nil {
+		return dw.size, err
+	}
+	a, b := weakChecksum(window)
+
+	for {
+		if candidates, ok := index[a|b<<16]; ok {
+			copy(block, window[pos:])
+			copy(block[bs-pos:], window[:pos])
+			if idx := findBlock(sig, candidates, block); idx >= 0 {
+				if err = dw.addCopy(idx); err != nil {
+					return dw.size, err
+				}
+				pos = 0
+				n, err = io.ReadFull(br, window)
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					if err = dw.addLiteral(window[:n]); err != nil {
+						return dw.size, err
+					}
+					return dw.finish()
+				} else if err != nil {
+					return dw.size, err
+				}
+				a, b = weakChecksum(window)
+				continue
+			}
+		}
+
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			if err = dw.addLiteral(window[pos:]); err != nil {
+				return dw.size, err
+			}
+			if err = dw.addLiteral(window[:pos]); err != nil {
+				return dw.size, err
+			}
+			return dw.finish()
+		} else if err != nil {
+			return dw.size, err
+		}
+		out := window[pos]
+		if err = dw.addLiteral(window[pos : pos+1]); err != nil {
+			return dw.size, err
+		}
+		window[pos] = c
+		pos = (pos + 1) % bs
+		a = (a - uint32(out) + uint32(c)) & 0xffff
+		b = (b - uint32(bs)*uint32(out) + a) & 0xffff
+	}
+}
+
+// findBlock returns the index of the block of the signature that has the same
+// strong hash as the given block, or -1 if there is none.
+func findBlock(sig *Signature, candidates []int, block []byte) int {
+	strong := md5.Sum(block)
+	for _, idx := range candidates {
+		if bytes.Equal(sig.Blocks[idx].Strong, strong[:]) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// deltaWriter writes the operations of a delta. The consecutive blocks are
+// merged in a single copy, and the literals are buffered.
+type deltaWriter struct {
+	w         *bufio.Writer
+	size      int64
+	literal   []byte
+	copyIndex int
+	copyCount int
+}
+
+func (dw *deltaWriter) write(p []byte) error {
+	n, err := dw.w.Write(p)
+	dw.size += int64(n)
+	return err
+}
+
+func (dw *deltaWriter) writeUvarint(x uint64) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], x)
+	return dw.write(buf[:n])
+}
+
+func (dw *deltaWriter) writeHeader(md5sum []byte, blockSize int) error {
+	if err := dw.write([]byte(deltaMagic)); err != nil {
+		return err
+	}
+	if err := dw.writeUvarint(uint64(len(md5sum))); err != nil {
+		return err
+	}
+	if err := dw.write(md5sum); err != nil {
+		return err
+	}
+	return dw.writeUvarint(uint64(blockSize))
+}
+
+func (dw *deltaWriter) addCopy(idx int) error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	if dw.copyCount > 0 && dw.copyIndex+dw.copyCount == idx {
+		dw.copyCount++
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.copyIndex = idx
+	dw.copyCount = 1
+	return nil
+}
+
+func (dw *deltaWriter) addLiteral(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := maxLiteralSize - len(dw.literal)
+		if n > len(p) {
+			n = len(p)
+		}
+		dw.literal = append(dw.literal, p[:n]...)
+		p = p[n:]
+		if len(dw.literal) >= maxLiteralSize {
+			if err := dw.flushLiteral(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyCount == 0 {
+		return nil
+	}
+	if err := dw.write([]byte{deltaOpCopy}); err != nil {
+		return err
+	}
+	if err := dw.writeUvarint(uint64(dw.copyIndex)); err != nil {
+		return err
+	}
+	if err := dw.writeUvarint(uint64(dw.copyCount)); err != nil {
+		return err
+	}
+	dw.copyCount = 0
+	return nil
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.literal) == 0 {
+		return nil
+	}
+	if err := dw.write([]byte{deltaOpLit}); err != nil {
+		return err
+	}
+	if err := dw.writeUvarint(uint64(len(dw.literal))); err != nil {
+		return err
+	}
+	if err := dw.write(dw.literal); err != nil {
+		return err
+	}
+	dw.literal = dw.literal[:0]
+	return nil
+}
+
+func (dw *deltaWriter) finish() (int64, error) {
+	if err := dw.flushLiteral(); err != nil {
+		return dw.size, err
+	}
+	if err := dw.flushCopy(); err != nil {
+		return dw.size, err
+	}
+	if err := dw.write([]byte{deltaOpEnd}); err != nil {
+		return dw.size, err
+	}
+	return dw.size, dw.w.Flush()
+}
+
+// readDeltaHeader reads the header of a delta, checks that the delta has been
+// computed for a file with the given md5sum, and returns the block size.
+func readDeltaHeader(r *bufio.Reader, md5sum []byte) (int, error) {
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return 0, ErrCannotApplyDelta
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil || size > maxMD5SumSize {
+		return 0, ErrCannotApplyDelta
+	}
+	sum := make([]byte, size)
+	if _, err = io.ReadFull(r, sum); err != nil || !bytes.Equal(sum, md5sum) {
+		return 0, ErrCannotApplyDelta
+	}
+	bs, err := binary.ReadUvarint(r)
+	if err != nil || bs < minBlockSize || bs > maxBlockSize {
+		return 0, ErrCannotApplyDelta
+	}
+	return int(bs), nil
+}
+
+// applyDelta writes to w the new content of a file, rebuilt from the base
+// content and the operations of the delta (after its header).
+func applyDelta(w io.Writer, base io.ReaderAt, baseSize int64, blockSize int, r *bufio.Reader) error {
+	bs := int64(blockSize)
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return ErrCannotApplyDelta
+		}
+		switch op {
+		case deltaOpCopy:
+			idx, err := binary.ReadUvarint(r)
+			if err != nil {
+				return ErrCannotApplyDelta
+			}
+			count, err := binary.ReadUvarint(r)
+			if err != nil || count == 0 {
+				return ErrCannotApplyDelta
+			}
+			off := int64(idx) * bs
+			length := int64(count) * bs
+			if off < 0 || length < 0 || off+length > baseSize {
+				return ErrCannotApplyDelta
+			}
+			if _, err = io.Copy(w, io.NewSectionReader(base, off, length)); err != nil {
+				return err
+			}
+		case deltaOpLit:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length == 0 || length > maxLiteralSize {
+				return ErrCannotApplyDelta
+			}
+			if _, err = io.CopyN(w, r, int64(length)); err != nil {
+				if err == io.EOF {
+					return ErrCannotApplyDelta
+				}
+				return err
+			}
+		case deltaOpEnd:
+			return nil
+		default:
+			return ErrCannotApplyDelta
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package sharing
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomContent(seed int64, size int) []byte {
+	buf := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(buf)
+	return buf
+}
+
+func roundTripDelta(t *testing.T, oldContent, newContent []byte) int64 {
+	sum := md5.Sum(oldContent)
+	sig, err := ComputeSignature(bytes.NewReader(oldContent), int64(len(oldContent)), sum[:])
+	require.NoError(t, err)
+
+	var delta bytes.Buffer
+	size, err := WriteDelta(&delta, sig, bytes.NewReader(newContent))
+	require.NoError(t, err)
+	assert.Equal(t, int64(delta.Len()), size)
+
+	r := bufio.NewReader(&delta)
+	bs, err := readDeltaHeader(r, sum[:])
+	require.NoError(t, err)
+	assert.Equal(t, sig.BlockSize, bs)
+
+	var rebuilt bytes.Buffer
+	err = applyDelta(&rebuilt, bytes.NewReader(oldContent), int64(len(oldContent)), bs, r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(newContent, rebuilt.Bytes()))
+	return size
+}
+
+func TestDeltaSameContent(t *testing.T) {
+	content := randomContent(1, 3*MinDeltaSize)
+	size := roundTripDelta(t, content, content)
+	assert.True(t, size < 1024)
+}
+
+func TestDeltaModifiedContent(t *testing.T) {
+	oldContent := randomContent(2, 8*MinDeltaSize)
+
+	// Some bytes are modified in the middle, some are inserted at the
+	// beginning, and some are removed at the end
+	newContent := make([]byte, len(oldContent))
+	copy(newContent, oldContent)
+	copy(newContent[len(newContent)/2:], []byte("modified in the middle"))
+	newContent = append([]byte("inserted at the beginning"), newContent...)
+	newContent = newContent[:len(newContent)-1000]
+
+	size := roundTripDelta(t, oldContent, newContent)
+	assert.True(t, size < int64(len(newContent))/50)
+}
+
+func TestDeltaSmallAndDifferentContent(t *testing.T) {
+	roundTripDelta(t, randomContent(3, 2*MinDeltaSize), randomContent(4, MinDeltaSize))
+	roundTripDelta(t, randomContent(5, MinDeltaSize), []byte("tiny"))
+	roundTripDelta(t, randomContent(6, MinDeltaSize), []byte{})
+	roundTripDelta(t, []byte{}, randomContent(7, 100000))
+}
+
+func TestDeltaOnAnotherBase(t *testing.T) {
+	content := randomContent(8, 2*MinDeltaSize)
+	sum := md5.Sum(content)
+	sig, err := ComputeSignature(bytes.NewReader(content), int64(len(content)), sum[:])
+	require.NoError(t, err)
+	var delta bytes.Buffer
+	_, err = WriteDelta(&delta, sig, bytes.NewReader(content))
+	require.NoError(t, err)
+
+	other := md5.Sum([]byte("another content"))
+	_, err = readDeltaHeader(bufio.NewReader(&delta), other[:])
+	assert.Equal(t, ErrCannotApplyDelta, err)
+}
@@ -15,6 +15,9 @@ var (
 	// ErrInvalidSharing is used when an action cannot be made on a sharing,
 	// because this sharing is not the expected state
 	ErrInvalidSharing = errors.New("Sharing is not in the expected state")
+	// ErrInvalidExpiration is used when an expiration date for a sharing, or
+	// for a recipient, is not in the future
+	ErrInvalidExpiration = errors.New("The expiration date must be in the future")
 	// ErrMemberNotFound is used when trying to find a member, but there is no
 	// member with the expected value for the criterion
 	ErrMemberNotFound = errors.New("The member was not found")
@@ -38,6 +41,9 @@ var (
 	// ErrMissingFileMetadata is used when uploading a file and the key is not
 	// in the cache (so no metadata and the upload can't succeed)
 	ErrMissingFileMetadata = errors.New("The metadata for this file were not found")
+	// ErrCannotApplyDelta is used when the delta of a file can't be applied
+	// on the current version of this file
+	ErrCannotApplyDelta = errors.New("The delta cannot be applied to this file")
 	// ErrFolderNotFound is used when informations about a folder is asked,
 	// but this folder was not found
 	ErrFolderNotFound = errors.New("This folder was not found")
@@ -46,4 +52,16 @@ var (
 	// ErrAlreadyAccepted is used when someone tries to accept twice a sharing
 	// on the same cozy instance
 	ErrAlreadyAccepted = errors.New("Sharing already accepted by this recipient")
+	// ErrConflictNotFound is used when a conflict on a shared file is asked,
+	// but it was not found for this sharing
+	ErrConflictNotFound = errors.New("This conflict was not found")
+	// ErrConflictResolved is used when trying to resolve a conflict that has
+	// already been resolved
+	ErrConflictResolved = errors.New("This conflict has already been resolved")
+	// ErrConflictOutdated is used when trying to resolve a conflict on files
+	// that have been modified since the user has seen them
+	ErrConflictOutdated = errors.New("The files in conflict have been modified")
+	// ErrInvalidResolution is used when the choice to resolve a conflict is
+	// not one of mine, theirs, or both
+	ErrInvalidResolution = errors.New("The resolution must be mine, theirs, or both")
 )
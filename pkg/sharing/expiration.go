@@ -0,0 +1,233 @@
+package sharing
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+)
+
+// ExpirationReminderDelay is how long before the expiration of a sharing, or
+// of the access of a recipient, the owner is reminded of it by mail.
+const ExpirationReminderDelay = 72 * time.Hour
+
+// expirationLeeway is the tolerance used to check that an expiration date is
+// still the one for which a trigger was created.
+const expirationLeeway = time.Minute
+
+// ExpireMsg is used for jobs on the share-expire worker.
+type ExpireMsg struct {
+	SharingID string `json:"sharing_id"`
+	// MemberIndex is the index of the recipient whose access expires, or 0
+	// when it is the whole sharing that expires
+	MemberIndex int `json:"member_index,omitempty"`
+	// Reminder is true for the job that sends a mail to the owner a few days
+	// before the expiration
+	Reminder bool `json:"reminder,omitempty"`
+}
+
+// HasExpirations returns true if the sharing, or the access of one of its
+// recipients, has an expiration date.
+func (s *Sharing) HasExpirations() bool {
+	if s.ExpiresAt != nil {
+		return true
+	}
+	for _, m := range s.Members {
+		if m.ExpiresAt != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateExpirations checks that the expiration dates are in the future.
+func (s *Sharing) ValidateExpirations() error {
+	now := time.Now()
+	if s.ExpiresAt != nil && !s.ExpiresAt.After(now) {
+		return ErrInvalidExpiration
+	}
+	for i, m := range s.Members {
+		if i > 0 && m.ExpiresAt != nil && !m.ExpiresAt.After(now) {
+			return ErrInvalidExpiration
+		}
+	}
+	return nil
+}
+
+// SetExpiration changes the expiration date of the sharing if index is 0, or
+// of the access of the recipient at this index, and schedules the triggers
+// for the new date. A nil date removes the expiration.
+func (s *Sharing) SetExpiration(inst *instance.Instance, index int, expiresAt *time.Time) error {
+	if !s.Owner || !s.Active {
+		return ErrInvalidSharing
+	}
+	if expiresAt != nil && !expiresAt.After(time.Now()) {
+		return ErrInvalidExpiration
+	}
+	if index == 0 {
+		s.ExpiresAt = expiresAt
+	} else {
+		if index < 0 || index >= len(s.Members) {
+			return ErrMemberNotFound
+		}
+		if s.Members[index].Status == MemberStatusRevoked {
+			return ErrInvalidSharing
+		}
+		s.Members[index].ExpiresAt = expiresAt
+	}
+	if err := s.ScheduleExpirations(inst); err != nil {
+		return err
+	}
+	return couchdb.UpdateDoc(inst, s)
+}
+
+// ScheduleExpirations removes the previous expiration triggers of the sharing,
+// and creates the @at triggers that will revoke the sharing, or the access of
+// the recipients, on their expiration dates, and send the reminders before.
+// The caller must persist the sharing to keep the identifiers of the triggers.
+func (s *Sharing) ScheduleExpirations(inst *instance.Instance) error {
+	if err := s.removeExpireTriggers(inst); err != nil {
+		return err
+	}
+	if !s.Owner || !s.Active {
+		return nil
+	}
+	if s.ExpiresAt != nil {
+		if err := s.addExpireTriggers(inst, 0, *s.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	for i, m := range s.Members {
+		if i == 0 || m.ExpiresAt == nil || m.Status == MemberStatusRevoked {
+			continue
+		}
+		// No need to revoke a recipient after the end of the whole sharing
+		if s.ExpiresAt != nil && !m.ExpiresAt.Before(*s.ExpiresAt) {
+			continue
+		}
+		if err := s.addExpireTriggers(inst, i, *m.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Sharing) addExpireTriggers(inst *instance.Instance, index int, expiresAt time.Time) error {
+	now := time.Now()
+	if reminder := expiresAt.Add(-ExpirationReminderDelay); reminder.After(now) {
+		if err := s.addExpireTrigger(inst, index, reminder, true); err != nil {
+			return err
+		}
+	}
+	if expiresAt.Before(now) {
+		expiresAt = now
+	}
+	return s.addExpireTrigger(inst, index, expiresAt, false)
+}
+
+func (s *Sharing) addExpireTrigger(inst *instance.Instance, index int, at time.Time, reminder bool) error {
+	msg, err := jobs.NewMessage(&ExpireMsg{
+		SharingID:   s.SID,
+		MemberIndex: index,
+		Reminder:    reminder,
+	})
+	if err != nil {
+		return err
+	}
+	t, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@at",
+		WorkerType: "share-expire",
+		Arguments:  at.Format(time.RFC3339),
+	}, msg)
+	if err != nil {
+		return err
+	}
+	if err = jobs.System().AddTrigger(t); err != nil {
+		return err
+	}
+	s.Triggers.ExpireIDs = append(s.Triggers.ExpireIDs, t.ID())
+	return nil
+}
+
+func (s *Sharing) removeExpireTriggers(inst *instance.Instance) error {
+	for _, id := range s.Triggers.ExpireIDs {
+		// An @at trigger is removed when its job is pushed
+		err := removeSharingTrigger(inst, id)
+		if err != nil && err != jobs.ErrNotFoundTrigger {
+			return err
+		}
+	}
+	s.Triggers.ExpireIDs = nil
+	return nil
+}
+
+// Expire is called by the share-expire worker. It revokes the sharing, or the
+// access of a recipient, when the expiration date is reached, or it sends a
+// reminder to the owner a few days before. Nothing is done if the expiration
+// date has been changed since the trigger was created.
+func (s *Sharing) Expire(inst *instance.Instance, msg *ExpireMsg) error {
+	if !s.Owner || !s.Active {
+		return nil
+	}
+	var m *Member
+	expiresAt := s.ExpiresAt
+	if msg.MemberIndex > 0 {
+		if msg.MemberIndex >= len(s.Members) {
+			return ErrMemberNotFound
+		}
+		m = &s.Members[msg.MemberIndex]
+		if m.Status == MemberStatusRevoked {
+			return nil
+		}
+		expiresAt = m.ExpiresAt
+	}
+	if expiresAt == nil {
+		return nil
+	}
+
+	remaining := time.Until(*expiresAt)
+	if msg.Reminder {
+		if remaining > ExpirationReminderDelay+expirationLeeway {
+			return nil
+		}
+		return s.sendExpirationReminder(inst, m, *expiresAt)
+	}
+	if remaining > expirationLeeway {
+		return nil
+	}
+	if m == nil {
+		return s.Revoke(inst)
+	}
+	if err := s.RevokeRecipient(inst, msg.MemberIndex); err != nil {
+		return err
+	}
+	s.NotifyRecipients(inst, nil)
+	return nil
+}
+
+// sendExpirationReminder sends a mail to the owner to tell that the sharing,
+// or the access of the given recipient, will soon expire. The mail is sent to
+// the instance itself, not to the members, hence inst.SendMail and not
+// SendMailsToMembers.
+func (s *Sharing) sendExpirationReminder(inst *instance.Instance, m *Member, expiresAt time.Time) error {
+	slug := s.AppSlug
+	if slug == "" {
+		slug = consts.DriveSlug
+	}
+	values := map[string]interface{}{
+		"Description": s.Description,
+		"ExpiresAt":   expiresAt.Format("2006-01-02"),
+		"SharingLink": inst.SubDomain(slug).String(),
+	}
+	template := "sharing_expiration"
+	if m != nil {
+		template = "sharing_member_expiration"
+		values["MemberName"] = m.PrimaryName()
+	}
+	return inst.SendMail(&instance.Mail{
+		TemplateName:   template,
+		TemplateValues: values,
+	})
+}
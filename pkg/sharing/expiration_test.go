@@ -0,0 +1,151 @@
+package sharing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateExpirations(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	s := Sharing{
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+	assert.False(t, s.HasExpirations())
+	assert.NoError(t, s.ValidateExpirations())
+
+	s.ExpiresAt = &future
+	assert.True(t, s.HasExpirations())
+	assert.NoError(t, s.ValidateExpirations())
+
+	s.Members[1].ExpiresAt = &past
+	assert.Equal(t, ErrInvalidExpiration, s.ValidateExpirations())
+
+	s.ExpiresAt = nil
+	s.Members[1].ExpiresAt = &future
+	assert.True(t, s.HasExpirations())
+	assert.NoError(t, s.ValidateExpirations())
+
+	s.ExpiresAt = &past
+	assert.Equal(t, ErrInvalidExpiration, s.ValidateExpirations())
+}
+
+func TestExpireWithAnotherDate(t *testing.T) {
+	later := time.Now().Add(30 * 24 * time.Hour)
+	s := Sharing{
+		SID:    uuidv4(),
+		Active: true,
+		Owner:  true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob", ExpiresAt: &later},
+			{Status: MemberStatusRevoked, Name: "Charlie"},
+		},
+	}
+
+	// The sharing has no expiration date anymore
+	assert.NoError(t, s.Expire(inst, &ExpireMsg{SharingID: s.SID}))
+	assert.True(t, s.Active)
+
+	// The expiration date of Bob has been extended
+	assert.NoError(t, s.Expire(inst, &ExpireMsg{SharingID: s.SID, MemberIndex: 1}))
+	assert.NoError(t, s.Expire(inst, &ExpireMsg{SharingID: s.SID, MemberIndex: 1, Reminder: true}))
+	assert.Equal(t, MemberStatusReady, s.Members[1].Status)
+
+	// Charlie has already been revoked
+	assert.NoError(t, s.Expire(inst, &ExpireMsg{SharingID: s.SID, MemberIndex: 2}))
+
+	assert.Equal(t, ErrMemberNotFound, s.Expire(inst, &ExpireMsg{SharingID: s.SID, MemberIndex: 3}))
+}
+
+func TestCreateSchedulesExpirations(t *testing.T) {
+	bobExpiresAt := time.Now().Add(10 * 24 * time.Hour)
+	expiresAt := time.Now().Add(30 * 24 * time.Hour)
+	s := Sharing{
+		Active: true,
+		Owner:  true,
+		Rules: []Rule{
+			{Title: "test", DocType: testDoctype, Values: []string{uuidv4()}},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusMailNotSent, Name: "Bob", ExpiresAt: &bobExpiresAt},
+		},
+		ExpiresAt: &expiresAt,
+	}
+	_, err := s.Create(inst)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// A reminder and a revocation for the sharing, and the same for Bob
+	saved, err := FindSharing(inst, s.SID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.Len(t, saved.Triggers.ExpireIDs, 4) {
+		return
+	}
+	for _, id := range saved.Triggers.ExpireIDs {
+		trigger, err := jobs.System().GetTrigger(inst, id)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, "@at", trigger.Infos().Type)
+		assert.Equal(t, "share-expire", trigger.Infos().WorkerType)
+	}
+
+	// Removing the expiration of the sharing keeps only the triggers for Bob
+	assert.NoError(t, saved.SetExpiration(inst, 0, nil))
+	assert.Len(t, saved.Triggers.ExpireIDs, 2)
+
+	assert.NoError(t, saved.RemoveTriggers(inst))
+	assert.Empty(t, saved.Triggers.ExpireIDs)
+}
+
+func TestExpireRevokes(t *testing.T) {
+	soon := time.Now().Add(10 * time.Second)
+	later := time.Now().Add(30 * 24 * time.Hour)
+	s := Sharing{
+		Active: true,
+		Owner:  true,
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusPendingInvitation, Name: "Bob", ExpiresAt: &soon},
+			{Status: MemberStatusReady, Name: "Charlie", Instance: "https://charlie.cozy.example"},
+		},
+		Credentials: make([]Credentials, 2),
+		ExpiresAt:   &later,
+	}
+	if !assert.NoError(t, couchdb.CreateDoc(inst, &s)) {
+		return
+	}
+
+	// The access of Bob expires, but the sharing is still active for Charlie
+	assert.NoError(t, s.Expire(inst, &ExpireMsg{SharingID: s.SID, MemberIndex: 1}))
+	var saved Sharing
+	if !assert.NoError(t, couchdb.GetDoc(inst, consts.Sharings, s.SID, &saved)) {
+		return
+	}
+	assert.Equal(t, MemberStatusRevoked, saved.Members[1].Status)
+	assert.Equal(t, MemberStatusReady, saved.Members[2].Status)
+	assert.True(t, saved.Active)
+
+	// The whole sharing is revoked on its expiration date
+	saved.ExpiresAt = &soon
+	assert.NoError(t, saved.Expire(inst, &ExpireMsg{SharingID: s.SID}))
+	saved = Sharing{}
+	if !assert.NoError(t, couchdb.GetDoc(inst, consts.Sharings, s.SID, &saved)) {
+		return
+	}
+	assert.False(t, saved.Active)
+	assert.Equal(t, MemberStatusRevoked, saved.Members[2].Status)
+}
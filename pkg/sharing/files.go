@@ -377,9 +377,11 @@ func (s *Sharing) GetFolder(inst *instance.Instance, m *Member, xoredID string)
 }
 
 // ApplyBulkFiles takes a list of documents for the io.cozy.files doctype and
-// will apply changes to the VFS according to those documents.
-func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
+// will apply changes to the VFS according to those documents. The changes are
+// recorded in the activity feed as made by the given member.
+func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList, from *Member) error {
 	var errm error
+	var activities []Activity
 	fs := inst.VFS()
 
 	for _, target := range docs {
@@ -414,6 +416,8 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			errm = multierror.Append(errm, err)
 			continue
 		}
+		var action ActivityAction
+		var name string
 		if _, ok := target["_deleted"]; ok {
 			if ref == nil || infos.Removed {
 				continue
@@ -421,9 +425,12 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 			if dir == nil && file == nil {
 				continue
 			}
+			action = ActivityRemoved
 			if dir != nil {
+				name = dir.DocName
 				err = s.TrashDir(inst, dir)
 			} else {
+				name = file.DocName
 				err = s.TrashFile(inst, file, &s.Rules[infos.Rule])
 			}
 		} else if file != nil {
@@ -431,18 +438,30 @@ func (s *Sharing) ApplyBulkFiles(inst *instance.Instance, docs DocsList) error {
 		} else if ref != nil && infos.Removed {
 			continue
 		} else if dir == nil {
+			action = ActivityAdded
+			name, _ = target["name"].(string)
 			err = s.CreateDir(inst, target)
 		} else if ref == nil {
 			err = multierror.Append(errm, ErrSafety)
 		} else {
+			action = ActivityUpdated
+			name, _ = target["name"].(string)
 			err = s.UpdateDir(inst, target, dir, ref)
 		}
 		if err != nil {
 			inst.Logger().WithField("nspace", "replicator").
 				Debugf("Error on apply bulk file: %s (%#v - %#v)", err, target, ref)
 			errm = multierror.Append(errm, err)
+		} else {
+			activities = append(activities, Activity{
+				Action:   action,
+				DocType:  consts.Files,
+				SharedID: id,
+				Name:     name,
+			})
 		}
 	}
+	s.RecordBulkActivity(inst, from, consts.Files, activities)
 
 	if errm != nil {
 		inst.Logger().WithField("nspace", "replicator").
@@ -524,13 +543,16 @@ func copySafeFieldsToDir(target map[string]interface{}, dir *vfs.DirDoc) {
 // If the winner is the local file/folder, this function returns the new name
 // and let the caller do its operation with the new name (the caller should
 // create a dummy revision to let the other cozy know of the renaming).
-func (s *Sharing) resolveConflictSamePath(inst *instance.Instance, visitorID, pth string) (string, error) {
+//
+// When the local document is a file, the conflict is also returned, and the
+// caller should record it once its operation has succeeded.
+func (s *Sharing) resolveConflictSamePath(inst *instance.Instance, visitorID, pth string) (string, *Conflict, error) {
 	inst.Logger().WithField("nspace", "replicator").
 		Infof("Resolve conflict for path=%s (docid=%s)", pth, visitorID)
 	fs := inst.VFS()
 	d, f, err := fs.DirOrFileByPath(pth)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	name := conflictName(path.Base(pth), "")
 	xorKey := s.Credentials[0].XorKey
@@ -541,24 +563,25 @@ func (s *Sharing) resolveConflictSamePath(inst *instance.Instance, visitorID, pt
 			visitorID = XorID(visitorID, xorKey)
 		}
 		if homeID > visitorID {
-			return name, nil
+			return name, nil, nil
 		}
 		old := d.Clone().(*vfs.DirDoc)
 		d.DocName = name
-		return "", fs.UpdateDirDoc(old, d)
+		return "", nil, fs.UpdateDirDoc(old, d)
 	}
+	conflict := s.newConflict(path.Base(pth), f.DocID, visitorID)
 	homeID := f.DocID
 	if !s.Owner {
 		homeID = XorID(homeID, xorKey)
 		visitorID = XorID(visitorID, xorKey)
 	}
 	if homeID > visitorID {
-		return name, nil
+		return name, conflict, nil
 	}
 	old := f.Clone().(*vfs.FileDoc)
 	f.DocName = name
 	f.ResetFullpath()
-	return "", fs.UpdateFileDoc(old, f)
+	return "", conflict, fs.UpdateFileDoc(old, f)
 }
 
 //getDirDocFromInstance fetches informations about a directory from the given
@@ -725,7 +748,7 @@ func (s *Sharing) CreateDir(inst *instance.Instance, target map[string]interface
 	ref.Infos[s.SID] = SharedInfo{Rule: ruleIndex}
 	err = fs.CreateDir(dir)
 	if err == os.ErrExist {
-		name, errr := s.resolveConflictSamePath(inst, dir.DocID, dir.Fullpath)
+		name, _, errr := s.resolveConflictSamePath(inst, dir.DocID, dir.Fullpath)
 		if errr != nil {
 			return errr
 		}
@@ -803,7 +826,7 @@ func (s *Sharing) UpdateDir(inst *instance.Instance, target map[string]interface
 
 	err = fs.UpdateDirDoc(oldDoc, dir)
 	if err == os.ErrExist {
-		name, errr := s.resolveConflictSamePath(inst, dir.DocID, dir.Fullpath)
+		name, _, errr := s.resolveConflictSamePath(inst, dir.DocID, dir.Fullpath)
 		if errr != nil {
 			return errr
 		}
@@ -38,12 +38,13 @@ const (
 
 // Member contains the information about a recipient (or the sharer) for a sharing
 type Member struct {
-	Status     string `json:"status"`
-	Name       string `json:"name,omitempty"`
-	PublicName string `json:"public_name,omitempty"`
-	Email      string `json:"email"`
-	Instance   string `json:"instance,omitempty"`
-	ReadOnly   bool   `json:"read_only,omitempty"`
+	Status     string     `json:"status"`
+	Name       string     `json:"name,omitempty"`
+	PublicName string     `json:"public_name,omitempty"`
+	Email      string     `json:"email"`
+	Instance   string     `json:"instance,omitempty"`
+	ReadOnly   bool       `json:"read_only,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
 }
 
 // PrimaryName returns the main name of this member
@@ -352,6 +353,7 @@ func (s *Sharing) UpdateRecipients(inst *instance.Instance, members []Member) er
 		s.Members[i].PublicName = m.PublicName
 		s.Members[i].Status = m.Status
 		s.Members[i].ReadOnly = m.ReadOnly
+		s.Members[i].ExpiresAt = m.ExpiresAt
 	}
 	return couchdb.UpdateDoc(inst, s)
 }
@@ -867,6 +869,7 @@ func (s *Sharing) NotifyRecipients(inst *instance.Instance, except *Member) {
 			PublicName: m.PublicName,
 			Email:      m.Email,
 			ReadOnly:   m.ReadOnly,
+			ExpiresAt:  m.ExpiresAt,
 			// Instance and name are private
 		}
 	}
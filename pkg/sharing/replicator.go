@@ -61,10 +61,13 @@ func (s *Sharing) Replicate(inst *instance.Instance, errors int) error {
 	}
 	if errm != nil {
 		s.retryWorker(inst, "share-replicate", errors)
-	} else if pending {
+		return errm
+	}
+	s.updateRetryStatus(inst, "share-replicate", 0, 0)
+	if pending {
 		s.pushJob(inst, "share-replicate")
 	}
-	return errm
+	return nil
 }
 
 // pushJob adds a new job to continue on the pending documents in the changes feed
@@ -97,6 +100,7 @@ func (s *Sharing) retryWorker(inst *instance.Instance, worker string, errors int
 		Debugf("Retry worker %s for sharing %s", worker, s.SID)
 	backoff := InitialBackoffPeriod << uint(errors*2)
 	errors++
+	s.updateRetryStatus(inst, worker, errors, backoff)
 	if errors == MaxRetries {
 		inst.Logger().WithField("nspace", "replicator").Warnf("Max retries reached")
 		return
@@ -131,7 +135,8 @@ func (s *Sharing) retryWorker(inst *instance.Instance, worker string, errors int
 // https://github.com/pouchdb/pouchdb/blob/master/packages/node_modules/pouchdb-replication/src/replicate.js
 // TODO pouch use the pending property of changes for its replicator
 // https://github.com/pouchdb/pouchdb/blob/master/packages/node_modules/pouchdb-replication/src/replicate.js#L298-L301
-func (s *Sharing) ReplicateTo(inst *instance.Instance, m *Member, initial bool) (bool, error) {
+func (s *Sharing) ReplicateTo(inst *instance.Instance, m *Member, initial bool) (pending bool, err error) {
+	defer func() { s.updateSyncStatus(inst, m, "replicator", err) }()
 	if m.Instance == "" {
 		return false, ErrInvalidURL
 	}
@@ -154,7 +159,9 @@ func (s *Sharing) ReplicateTo(inst *instance.Instance, m *Member, initial bool)
 		return false, nil
 	}
 	inst.Logger().WithField("nspace", "replicator").Debugf("changes = %#v", feed.Changes)
-	// TODO filter the changes according to the sharing rules
+	// TODO filter the changes according to the add and update actions of
+	// the sharing rules
+	s.filterRemovals(feed)
 
 	changes := &feed.Changes
 	if len(changes.Changed) > 0 {
@@ -305,6 +312,24 @@ type changesResponse struct {
 	Pending bool
 }
 
+// filterRemovals drops from the changes the documents that have been removed
+// from the sharing, but whose removal must not be replicated to the other
+// cozy according to the remove action of their rule. The files are left
+// untouched, as their removal is applied by moving them to the trash.
+func (s *Sharing) filterRemovals(feed *changesResponse) {
+	for key := range feed.Changes.Removed {
+		if strings.HasPrefix(key, consts.Files+"/") {
+			continue
+		}
+		idx, ok := feed.RuleIndexes[key]
+		if ok && idx < len(s.Rules) && s.Rules[idx].ReplicateRemoval(s.Owner) {
+			continue
+		}
+		delete(feed.Changes.Removed, key)
+		delete(feed.Changes.Changed, key)
+	}
+}
+
 // callChangesFeed fetches the last changes from the changes feed
 // http://docs.couchdb.org/en/stable/api/database/changes.html
 // TODO add a filter on the sharing
@@ -574,15 +599,18 @@ func (s *Sharing) sendBulkDocs(inst *instance.Instance, m *Member, creds *Creden
 	return nil
 }
 
-// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of CouchDB
-func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype) error {
+// ApplyBulkDocs is a multi-doctypes version of the POST _bulk_docs endpoint of
+// CouchDB. The changes are recorded in the activity feed as made by the given
+// member.
+func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype, from *Member) error {
 	var refs []*SharedRef
+	var activities []Activity
 
 	for doctype, docs := range payload {
 		inst.Logger().WithField("nspace", "replicator").
 			Debugf("Apply bulk docs %s: %#v", doctype, docs)
 		if doctype == consts.Files {
-			err := s.ApplyBulkFiles(inst, docs)
+			err := s.ApplyBulkFiles(inst, docs, from)
 			if err != nil {
 				return err
 			}
@@ -593,6 +621,9 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 		newDocs, existingDocs, err := partitionDocsPayload(inst, doctype, docs)
 		if err == nil {
 			okDocs, newRefs = s.filterDocsToAdd(inst, doctype, newDocs)
+			if err = s.reuseRemovedRefs(inst, newRefs); err != nil {
+				return err
+			}
 			docsToUpdate, existingRefs, err = s.filterDocsToUpdate(inst, doctype, existingDocs)
 			if err != nil {
 				return err
@@ -612,6 +643,7 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 			}
 			refs = append(refs, newRefs...)
 			refs = append(refs, existingRefs...)
+			activities = append(activities, docsActivities(doctype, okDocs, len(newRefs))...)
 		}
 	}
 
@@ -621,7 +653,35 @@ func (s *Sharing) ApplyBulkDocs(inst *instance.Instance, payload DocsByDoctype)
 		refsToUpdate[i] = ref
 	}
 	olds := make([]interface{}, len(refsToUpdate))
-	return couchdb.BulkUpdateDocs(inst, consts.Shared, refsToUpdate, olds)
+	if err := couchdb.BulkUpdateDocs(inst, consts.Shared, refsToUpdate, olds); err != nil {
+		return err
+	}
+	byDoctype := make(map[string][]Activity)
+	for _, a := range activities {
+		byDoctype[a.DocType] = append(byDoctype[a.DocType], a)
+	}
+	for doctype, list := range byDoctype {
+		s.RecordBulkActivity(inst, from, doctype, list)
+	}
+	return nil
+}
+
+// docsActivities returns the activities for the documents applied by a bulk
+// docs: the first nbNew documents have been added, the others updated or
+// removed.
+func docsActivities(doctype string, docs DocsList, nbNew int) []Activity {
+	activities := make([]Activity, len(docs))
+	for i, doc := range docs {
+		action := ActivityUpdated
+		if i < nbNew {
+			action = ActivityAdded
+		} else if _, ok := doc["_deleted"]; ok {
+			action = ActivityRemoved
+		}
+		id, _ := doc["_id"].(string)
+		activities[i] = Activity{Action: action, DocType: doctype, SharedID: id}
+	}
+	return activities
 }
 
 // partitionDocsPayload returns two slices: the first with documents that are new,
@@ -687,6 +747,35 @@ func (s *Sharing) filterDocsToAdd(inst *instance.Instance, doctype string, docs
 	return filtered, refs
 }
 
+// reuseRemovedRefs updates the references for the documents that come back
+// in the sharing, after having been removed from it (deleted, or no longer
+// matching a dynamic rule): the reference can't be created, as it still
+// exists in the io.cozy.shared database.
+func (s *Sharing) reuseRemovedRefs(inst *instance.Instance, refs []*SharedRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(refs))
+	for i, ref := range refs {
+		ids[i] = ref.SID
+	}
+	olds, err := FindReferences(inst, ids)
+	if err != nil {
+		return err
+	}
+	for i, old := range olds {
+		if old == nil {
+			continue
+		}
+		if rev := refs[i].Revisions.Rev; old.Revisions.Find(rev) == nil {
+			old.Revisions.Add(rev)
+		}
+		old.Infos[s.SID] = refs[i].Infos[s.SID]
+		refs[i] = old
+	}
+	return nil
+}
+
 // filterDocsToUpdate returns a subset of the docs slice with just the documents
 // that are referenced for this sharing in the io.cozy.shared database.
 func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, docs DocsList) (DocsList, []*SharedRef, error) {
@@ -718,6 +807,12 @@ func (s *Sharing) filterDocsToUpdate(inst *instance.Instance, doctype string, do
 					}
 				}
 				if _, ok := doc["_deleted"]; ok {
+					// The changes are sent by the owner to a recipient,
+					// or by a recipient to the owner
+					if infos.Rule < len(s.Rules) &&
+						!s.Rules[infos.Rule].ReplicateRemoval(!s.Owner) {
+						continue
+					}
 					infos.Removed = true
 					refs[i].Infos[s.SID] = infos
 				}
@@ -509,7 +509,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err := s.ApplyBulkDocs(inst, payload)
+	err := s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared := 1
 	assertNbSharedRef(t, nbShared)
@@ -536,7 +536,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	assertNbSharedRef(t, nbShared)
 	doc = getDoc(t, foos, fooOneID)
@@ -569,7 +569,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s2.ApplyBulkDocs(inst, payload)
+	err = s2.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared++
 	assertNbSharedRef(t, nbShared)
@@ -621,7 +621,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared += 3
 	assertNbSharedRef(t, nbShared)
@@ -741,7 +741,7 @@ func TestApplyBulkDocs(t *testing.T) {
 			},
 		},
 	}
-	err = s.ApplyBulkDocs(inst, payload)
+	err = s.ApplyBulkDocs(inst, payload, nil)
 	assert.NoError(t, err)
 	nbShared += 2 // fooFiveID and barSixID
 	assertNbSharedRef(t, nbShared)
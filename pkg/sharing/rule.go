@@ -159,6 +159,40 @@ func (r Rule) Accept(doctype string, doc map[string]interface{}) bool {
 			}
 		}
 	}
+	// Arrays in the documents decoded from JSON are []interface{}
+	if val, ok := obj.([]interface{}); ok {
+		for _, vv := range val {
+			for _, v := range r.Values {
+				if v == vv {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Dynamic returns true if the rule selects the documents on their content
+// (and not on their identifiers): a document can start or stop matching such
+// a rule each time it is modified, so the rule is re-evaluated on each change.
+func (r Rule) Dynamic() bool {
+	if r.Local || r.DocType == consts.Files {
+		return false
+	}
+	return r.Selector != "" && r.Selector != "id" && r.Selector != "_id"
+}
+
+// ReplicateRemoval returns true if a document that has been removed from the
+// sharing on a cozy (deleted, or no longer matching the rule) must be removed
+// on the other cozy too. fromOwner tells if the removal has been made on the
+// cozy of the owner of the sharing.
+func (r Rule) ReplicateRemoval(fromOwner bool) bool {
+	switch r.Remove {
+	case ActionRuleSync:
+		return true
+	case ActionRulePush:
+		return fromOwner
+	}
 	return false
 }
 
@@ -170,20 +204,28 @@ func (r Rule) TriggerArgs() string {
 		return ""
 	}
 	verbs := make([]string, 0, 3)
-	if r.Add == ActionRuleSync || r.Add == ActionRulePush {
+	add := r.Add == ActionRuleSync || r.Add == ActionRulePush
+	update := r.Update == ActionRuleSync || r.Update == ActionRulePush
+	remove := r.Remove == ActionRuleSync || r.Remove == ActionRulePush
+	if add {
 		verbs = append(verbs, "CREATED")
 	}
-	if r.Update == ActionRuleSync || r.Update == ActionRulePush {
+	// For a dynamic rule, a document can be added to (or removed from) the
+	// sharing when it is updated
+	if update || remove || (add && r.Dynamic()) {
 		verbs = append(verbs, "UPDATED")
 	}
-	if r.Remove == ActionRuleSync || r.Remove == ActionRulePush {
-		verbs = append(verbs, "UPDATED")
+	if remove && r.DocType != consts.Files {
+		verbs = append(verbs, "DELETED")
 	}
 	if len(verbs) == 0 {
 		return ""
 	}
 	args := r.DocType + ":" + strings.Join(verbs, ",")
-	if len(r.Values) > 0 {
+	// The event trigger can only compare the values to a top-level field of
+	// the documents: for a dynamic rule, the documents are filtered by the
+	// share-track worker instead.
+	if len(r.Values) > 0 && !r.Dynamic() {
 		args += ":" + strings.Join(r.Values, ",")
 		if r.Selector != "" && r.Selector != "id" {
 			args += ":" + r.Selector
@@ -147,6 +147,14 @@ func TestRuleAccept(t *testing.T) {
 	r.Values = []string{"group4"}
 	assert.False(t, r.Accept(doctype, doc))
 
+	// Arrays decoded from JSON
+	doc["tags"] = []interface{}{"work", "vacations"}
+	r.Selector = "tags"
+	r.Values = []string{"vacations"}
+	assert.True(t, r.Accept(doctype, doc))
+	r.Values = []string{"holidays"}
+	assert.False(t, r.Accept(doctype, doc))
+
 	// Referenced_by
 	file := map[string]interface{}{
 		"_id": "84fa49e2-3409-11e8-86de-7fff926238b1",
@@ -191,6 +199,54 @@ func TestTriggersArgs(t *testing.T) {
 
 	r.Local = true
 	assert.Equal(t, "", r.TriggerArgs())
+
+	r = Rule{
+		Title:    "test dynamic",
+		DocType:  doctype,
+		Selector: "tags",
+		Values:   []string{"vacations"},
+		Add:      "sync",
+		Update:   "none",
+		Remove:   "sync",
+	}
+	expected = "io.cozy.test.foos:CREATED,UPDATED,DELETED"
+	assert.Equal(t, expected, r.TriggerArgs())
+}
+
+func TestRuleDynamic(t *testing.T) {
+	r := Rule{
+		Title:   "test",
+		DocType: "io.cozy.test.foos",
+		Values:  []string{"foo"},
+	}
+	assert.False(t, r.Dynamic())
+	r.Selector = "id"
+	assert.False(t, r.Dynamic())
+	r.Selector = "metadata.category"
+	assert.True(t, r.Dynamic())
+	r.Local = true
+	assert.False(t, r.Dynamic())
+
+	r = Rule{
+		Title:    "test files",
+		DocType:  consts.Files,
+		Selector: couchdb.SelectorReferencedBy,
+		Values:   []string{"io.cozy.playlists/list1"},
+	}
+	assert.False(t, r.Dynamic())
+}
+
+func TestRuleReplicateRemoval(t *testing.T) {
+	r := Rule{Remove: ActionRuleSync}
+	assert.True(t, r.ReplicateRemoval(true))
+	assert.True(t, r.ReplicateRemoval(false))
+	r.Remove = ActionRulePush
+	assert.True(t, r.ReplicateRemoval(true))
+	assert.False(t, r.ReplicateRemoval(false))
+	r.Remove = ActionRuleNone
+	assert.False(t, r.ReplicateRemoval(true))
+	r.Remove = ActionRuleRevoke
+	assert.False(t, r.ReplicateRemoval(true))
 }
 
 func TestClearAppInHost(t *testing.T) {
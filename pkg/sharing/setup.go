@@ -162,6 +162,80 @@ func (s *Sharing) AddTrackTriggers(inst *instance.Instance) error {
 	return couchdb.UpdateDoc(inst, s)
 }
 
+// UpdateTrackTriggers replaces the share-track triggers of the instance whose
+// arguments are not the ones computed from the rule of their sharing, like
+// the triggers created before a change of Rule.TriggerArgs. It returns the
+// number of triggers that have been replaced or removed.
+func UpdateTrackTriggers(inst *instance.Instance) (int, error) {
+	sched := jobs.System()
+	triggers, err := sched.GetAllTriggers(inst)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	sharings := make(map[string]*Sharing)
+	updated := make(map[string]bool)
+	for _, t := range triggers {
+		infos := t.Infos()
+		if infos.WorkerType != "share-track" {
+			continue
+		}
+		var msg TrackMessage
+		if err = infos.Message.Unmarshal(&msg); err != nil {
+			continue
+		}
+		s, ok := sharings[msg.SharingID]
+		if !ok {
+			s, err = FindSharing(inst, msg.SharingID)
+			if err != nil && !couchdb.IsNotFoundError(err) {
+				return count, err
+			}
+			sharings[msg.SharingID] = s
+		}
+		if s == nil || !s.Active || msg.RuleIndex >= len(s.Rules) {
+			continue
+		}
+		args := s.Rules[msg.RuleIndex].TriggerArgs()
+		if args == infos.Arguments {
+			continue
+		}
+
+		if err = sched.DeleteTrigger(inst, infos.TID); err != nil {
+			return count, err
+		}
+		count++
+		updated[s.SID] = true
+		if s.Triggers.TrackID == infos.TID {
+			s.Triggers.TrackID = ""
+		}
+		if args == "" {
+			continue
+		}
+		var nt jobs.Trigger
+		nt, err = jobs.NewTrigger(inst, jobs.TriggerInfos{
+			Type:       "@event",
+			WorkerType: "share-track",
+			Arguments:  args,
+		}, &msg)
+		if err != nil {
+			return count, err
+		}
+		if err = sched.AddTrigger(nt); err != nil {
+			return count, err
+		}
+		if s.Triggers.TrackID == "" {
+			s.Triggers.TrackID = nt.ID()
+		}
+	}
+	for id := range updated {
+		if err = couchdb.UpdateDoc(inst, sharings[id]); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
 // AddReplicateTrigger creates the share-replicate trigger for this sharing:
 // it will starts the replicator when some changes are made to the
 // io.cozy.shared database.
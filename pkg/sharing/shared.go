@@ -116,9 +116,13 @@ func extractReferencedBy(doc *couchdb.JSONDoc) []couchdb.DocReference {
 
 // isNoLongerShared returns true for a document/file/folder that has matched a
 // rule of a sharing, but no longer does.
-func isNoLongerShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) (bool, error) {
+func isNoLongerShared(inst *instance.Instance, s *Sharing, msg TrackMessage, evt TrackEvent) (bool, error) {
+	rule := s.Rules[msg.RuleIndex]
 	if msg.DocType != consts.Files {
-		return false, nil // TODO rules for documents with a selector
+		if !rule.Dynamic() {
+			return false, nil
+		}
+		return !rule.Accept(msg.DocType, evt.Doc.M), nil
 	}
 
 	// Optim: if dir_id and referenced_by have not changed, the file/folder
@@ -134,11 +138,6 @@ func isNoLongerShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent)
 		}
 	}
 
-	s, err := FindSharing(inst, msg.SharingID)
-	if err != nil {
-		return false, err
-	}
-	rule := s.Rules[msg.RuleIndex]
 	if rule.Selector == couchdb.SelectorReferencedBy {
 		refs := extractReferencedBy(&evt.Doc)
 		for _, ref := range refs {
@@ -155,8 +154,7 @@ func isNoLongerShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent)
 		if !ok {
 			return false, ErrInternalServerError
 		}
-		var parent *vfs.DirDoc
-		parent, err = inst.VFS().DirByID(dirID)
+		parent, err := inst.VFS().DirByID(dirID)
 		if err != nil {
 			return false, err
 		}
@@ -177,25 +175,21 @@ func isNoLongerShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent)
 
 // isTheSharingDirectory returns true if the event was for the directory that
 // is the root of the sharing: we don't want to track it in io.cozy.shared.
-func isTheSharingDirectory(inst *instance.Instance, msg TrackMessage, evt TrackEvent) (bool, error) {
+func isTheSharingDirectory(s *Sharing, msg TrackMessage, evt TrackEvent) bool {
 	if evt.Doc.Type != consts.Files || evt.Doc.Get("type") != consts.DirType {
-		return false, nil
-	}
-	s, err := FindSharing(inst, msg.SharingID)
-	if err != nil {
-		return false, err
+		return false
 	}
 	rule := s.Rules[msg.RuleIndex]
 	if rule.Selector == couchdb.SelectorReferencedBy {
-		return false, nil
+		return false
 	}
 	id := evt.Doc.ID()
 	for _, val := range rule.Values {
 		if val == id {
-			return true, nil
+			return true
 		}
 	}
-	return false, nil
+	return false
 }
 
 // UpdateShared updates the io.cozy.shared database when a document is
@@ -205,6 +199,11 @@ func UpdateShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) err
 	mu.Lock()
 	defer mu.Unlock()
 
+	s, err := FindSharing(inst, msg.SharingID)
+	if err != nil {
+		return err
+	}
+
 	evt.Doc.Type = msg.DocType
 	sid := evt.Doc.Type + "/" + evt.Doc.ID()
 	var ref SharedRef
@@ -217,10 +216,17 @@ func UpdateShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) err
 	}
 
 	rev := evt.Doc.Rev()
-	if _, ok := ref.Infos[msg.SharingID]; ok {
+	previous, wasShared := ref.Infos[msg.SharingID]
+	readded := false
+	if wasShared {
 		if ref.Revisions.Find(rev) != nil {
 			return nil
 		}
+		// The document is shared via another rule of this sharing, and
+		// it is the job for this other rule that will update the reference
+		if previous.Rule != msg.RuleIndex && !previous.Removed && msg.DocType != consts.Files {
+			return nil
+		}
 	} else {
 		ref.Infos[msg.SharingID] = SharedInfo{
 			Rule: msg.RuleIndex,
@@ -238,16 +244,20 @@ func UpdateShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) err
 		if evt.Doc.Type == consts.Files && ref.Rev() == "" {
 			return nil
 		}
+		// Ignore the documents that were not in the sharing
+		if evt.Doc.Type != consts.Files && (!wasShared || previous.Removed) {
+			return nil
+		}
 		ref.Infos[msg.SharingID] = SharedInfo{
 			Rule:    ref.Infos[msg.SharingID].Rule,
 			Removed: true,
 			Binary:  false,
 		}
 	} else {
-		if skip, err := isTheSharingDirectory(inst, msg, evt); err != nil || skip {
-			return err
+		if isTheSharingDirectory(s, msg, evt) {
+			return nil
 		}
-		removed, err := isNoLongerShared(inst, msg, evt)
+		removed, err := isNoLongerShared(inst, s, msg, evt)
 		if err != nil {
 			return err
 		}
@@ -255,24 +265,48 @@ func UpdateShared(inst *instance.Instance, msg TrackMessage, evt TrackEvent) err
 			if ref.Rev() == "" {
 				return nil
 			}
+			// A document that doesn't match a dynamic rule and was not in
+			// the sharing can be just ignored
+			if msg.DocType != consts.Files && (!wasShared || previous.Removed) {
+				return nil
+			}
 			ref.Infos[msg.SharingID] = SharedInfo{
 				Rule:    ref.Infos[msg.SharingID].Rule,
 				Removed: true,
 				Binary:  false,
 			}
+		} else if previous.Removed && msg.DocType != consts.Files {
+			// The document matches again a dynamic rule: it comes back in
+			// the sharing
+			ref.Infos[msg.SharingID] = SharedInfo{Rule: msg.RuleIndex}
+			readded = true
 		}
 	}
 
 	if ref.Rev() == "" {
 		ref.Revisions = &RevsTree{Rev: rev}
-		return couchdb.CreateNamedDoc(inst, &ref)
+		if err := couchdb.CreateNamedDoc(inst, &ref); err != nil {
+			return err
+		}
+		s.recordLocalActivity(inst, ActivityAdded, evt.Doc)
+		return nil
 	}
 	var oldrev string
 	if evt.OldDoc != nil {
 		oldrev = evt.OldDoc.Rev()
 	}
 	ref.Revisions.InsertAfter(rev, oldrev)
-	return couchdb.UpdateDoc(inst, &ref)
+	if err := couchdb.UpdateDoc(inst, &ref); err != nil {
+		return err
+	}
+	action := ActivityUpdated
+	if ref.Infos[msg.SharingID].Removed {
+		action = ActivityRemoved
+	} else if readded || !wasShared {
+		action = ActivityAdded
+	}
+	s.recordLocalActivity(inst, action, evt.Doc)
+	return nil
 }
 
 // UpdateFileShared creates or updates the io.cozy.shared for a file with
@@ -0,0 +1,161 @@
+package sharing
+
+import (
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateSharedDynamicRule(t *testing.T) {
+	couchdb.CreateDB(inst, consts.Shared)
+	couchdb.CreateDB(inst, consts.Sharings)
+
+	s := Sharing{
+		Active: true,
+		Owner:  true,
+		Rules: []Rule{
+			{
+				Title:    "tagged foos",
+				DocType:  foos,
+				Selector: "tags",
+				Values:   []string{"shared"},
+				Add:      ActionRuleSync,
+				Update:   ActionRuleSync,
+				Remove:   ActionRuleSync,
+			},
+		},
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+	require.NoError(t, couchdb.CreateDoc(inst, &s))
+	msg := TrackMessage{SharingID: s.SID, RuleIndex: 0, DocType: foos}
+
+	id := uuidv4()
+	makeDoc := func(rev string, tags ...interface{}) couchdb.JSONDoc {
+		return couchdb.JSONDoc{
+			Type: foos,
+			M: map[string]interface{}{
+				"_id":  id,
+				"_rev": rev,
+				"tags": tags,
+			},
+		}
+	}
+	getInfo := func() (SharedInfo, bool) {
+		var ref SharedRef
+		err := couchdb.GetDoc(inst, consts.Shared, foos+"/"+id, &ref)
+		if err != nil {
+			return SharedInfo{}, false
+		}
+		info, ok := ref.Infos[s.SID]
+		return info, ok
+	}
+
+	// A document that doesn't match the rule is ignored
+	private := makeDoc("1-aaa", "private")
+	err := UpdateShared(inst, msg, TrackEvent{Verb: "CREATED", Doc: private})
+	assert.NoError(t, err)
+	_, ok := getInfo()
+	assert.False(t, ok)
+
+	// It is added to the sharing when it starts matching the rule
+	tagged := makeDoc("2-bbb", "private", "shared")
+	err = UpdateShared(inst, msg, TrackEvent{Verb: "UPDATED", Doc: tagged, OldDoc: &private})
+	assert.NoError(t, err)
+	info, ok := getInfo()
+	assert.True(t, ok)
+	assert.False(t, info.Removed)
+
+	// It is removed when it stops matching the rule
+	untagged := makeDoc("3-ccc", "private")
+	err = UpdateShared(inst, msg, TrackEvent{Verb: "UPDATED", Doc: untagged, OldDoc: &tagged})
+	assert.NoError(t, err)
+	info, ok = getInfo()
+	assert.True(t, ok)
+	assert.True(t, info.Removed)
+
+	// And it comes back when it matches again
+	retagged := makeDoc("4-ddd", "shared")
+	err = UpdateShared(inst, msg, TrackEvent{Verb: "UPDATED", Doc: retagged, OldDoc: &untagged})
+	assert.NoError(t, err)
+	info, ok = getInfo()
+	assert.True(t, ok)
+	assert.False(t, info.Removed)
+
+	// A removal is replicated according to the remove behavior of the rule
+	feed := &changesResponse{
+		Changes: Changes{
+			Changed: Changed{foos + "/" + id: {"5-eee"}},
+			Removed: Removed{foos + "/" + id: struct{}{}},
+		},
+		RuleIndexes: map[string]int{foos + "/" + id: 0},
+	}
+	s.filterRemovals(feed)
+	assert.Len(t, feed.Changes.Removed, 1)
+	s.Rules[0].Remove = ActionRuleNone
+	s.filterRemovals(feed)
+	assert.Len(t, feed.Changes.Removed, 0)
+	assert.Len(t, feed.Changes.Changed, 0)
+}
+
+func TestUpdateTrackTriggers(t *testing.T) {
+	couchdb.CreateDB(inst, consts.Sharings)
+
+	rule := Rule{
+		Title:    "tagged foos",
+		DocType:  foos,
+		Selector: "tags",
+		Values:   []string{"shared"},
+		Add:      ActionRuleSync,
+		Update:   ActionRuleNone,
+		Remove:   ActionRuleNone,
+	}
+	s := Sharing{
+		Active: true,
+		Owner:  true,
+		Rules:  []Rule{rule},
+		Members: []Member{
+			{Status: MemberStatusOwner, PublicName: "Alice"},
+			{Status: MemberStatusReady, Name: "Bob"},
+		},
+	}
+	require.NoError(t, couchdb.CreateDoc(inst, &s))
+
+	// A trigger with the arguments computed before the dynamic rules
+	msg, err := jobs.NewMessage(&TrackMessage{SharingID: s.SID, RuleIndex: 0, DocType: foos})
+	require.NoError(t, err)
+	old, err := jobs.NewTrigger(inst, jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "share-track",
+		Arguments:  foos + ":CREATED:shared:tags",
+	}, msg)
+	require.NoError(t, err)
+	require.NoError(t, jobs.System().AddTrigger(old))
+	s.Triggers.TrackID = old.ID()
+	require.NoError(t, couchdb.UpdateDoc(inst, &s))
+
+	count, err := UpdateTrackTriggers(inst)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	_, err = jobs.System().GetTrigger(inst, old.ID())
+	assert.Equal(t, jobs.ErrNotFoundTrigger, err)
+
+	saved, err := FindSharing(inst, s.SID)
+	require.NoError(t, err)
+	assert.NotEqual(t, old.ID(), saved.Triggers.TrackID)
+	trigger, err := jobs.System().GetTrigger(inst, saved.Triggers.TrackID)
+	require.NoError(t, err)
+	assert.Equal(t, rule.TriggerArgs(), trigger.Infos().Arguments)
+
+	// Nothing to do the second time
+	count, err = UpdateTrackTriggers(inst)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	assert.NoError(t, saved.RemoveTriggers(inst))
+}
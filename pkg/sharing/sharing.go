@@ -25,9 +25,10 @@ const (
 
 // Triggers keep record of which triggers are active
 type Triggers struct {
-	TrackID     string `json:"track_id,omitempty"`
-	ReplicateID string `json:"replicate_id,omitempty"`
-	UploadID    string `json:"upload_id,omitempty"`
+	TrackID     string   `json:"track_id,omitempty"`
+	ReplicateID string   `json:"replicate_id,omitempty"`
+	UploadID    string   `json:"upload_id,omitempty"`
+	ExpireIDs   []string `json:"expire_ids,omitempty"`
 }
 
 // Sharing contains all the information about a sharing.
@@ -46,6 +47,9 @@ type Sharing struct {
 	UpdatedAt   time.Time `json:"updated_at"`
 	NbFiles     int       `json:"initial_number_of_files_to_sync,omitempty"`
 
+	// ExpiresAt is the date after which the sharing is revoked
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
 	Rules []Rule `json:"rules"`
 
 	// Members[0] is the owner, Members[1...] are the recipients
@@ -74,6 +78,10 @@ func (s *Sharing) SetRev(rev string) { s.SRev = rev }
 // Clone implements couchdb.Doc
 func (s *Sharing) Clone() couchdb.Doc {
 	cloned := *s
+	if s.Triggers.ExpireIDs != nil {
+		cloned.Triggers.ExpireIDs = make([]string, len(s.Triggers.ExpireIDs))
+		copy(cloned.Triggers.ExpireIDs, s.Triggers.ExpireIDs)
+	}
 	cloned.Rules = make([]Rule, len(s.Rules))
 	copy(cloned.Rules, s.Rules)
 	for i := range cloned.Rules {
@@ -198,10 +206,32 @@ func (s *Sharing) Create(inst *instance.Instance) (map[string]string, error) {
 	if len(s.Members) < 2 {
 		return nil, ErrNoRecipients
 	}
+	if err := s.ValidateExpirations(); err != nil {
+		return nil, err
+	}
 
 	if err := couchdb.CreateDoc(inst, s); err != nil {
 		return nil, err
 	}
+	if s.Owner && s.HasExpirations() {
+		// The triggers need the ID of the sharing, so they can only be
+		// created after the document, and we delete it if they fail
+		err := s.ScheduleExpirations(inst)
+		if err == nil {
+			err = couchdb.UpdateDoc(inst, s)
+		}
+		if err != nil {
+			if errt := s.removeExpireTriggers(inst); errt != nil {
+				inst.Logger().WithField("nspace", "sharing").
+					Warnf("Can't remove the expiration triggers of %s: %s", s.SID, errt)
+			}
+			if errd := couchdb.DeleteDoc(inst, s); errd != nil {
+				inst.Logger().WithField("nspace", "sharing").
+					Warnf("Can't delete the sharing %s: %s", s.SID, errd)
+			}
+			return nil, err
+		}
+	}
 
 	if s.Owner && s.PreviewPath != "" {
 		return s.CreatePreviewPermissions(inst)
@@ -267,6 +297,9 @@ func (s *Sharing) Revoke(inst *instance.Instance) error {
 	if err := RemoveSharedRefs(inst, s.SID); err != nil {
 		return err
 	}
+	if err := s.deleteActivities(inst); err != nil {
+		return err
+	}
 	if s.PreviewPath != "" {
 		if err := s.RevokePreviewPermissions(inst); err != nil {
 			return err
@@ -324,6 +357,9 @@ func (s *Sharing) RevokeRecipientBySelf(inst *instance.Instance) error {
 	if err := RemoveSharedRefs(inst, s.SID); err != nil {
 		return err
 	}
+	if err := s.deleteActivities(inst); err != nil {
+		return err
+	}
 	if s.FirstFilesRule() != nil {
 		if err := s.RemoveSharingDir(inst); err != nil {
 			return err
@@ -352,6 +388,9 @@ func (s *Sharing) RemoveTriggers(inst *instance.Instance) error {
 	if err := removeSharingTrigger(inst, s.Triggers.UploadID); err != nil {
 		return err
 	}
+	if err := s.removeExpireTriggers(inst); err != nil {
+		return err
+	}
 	s.Triggers = Triggers{}
 	return nil
 }
@@ -384,6 +423,9 @@ func (s *Sharing) RevokeByNotification(inst *instance.Instance) error {
 	if err := RemoveSharedRefs(inst, s.SID); err != nil {
 		return err
 	}
+	if err := s.deleteActivities(inst); err != nil {
+		return err
+	}
 	if s.FirstFilesRule() != nil {
 		if err := s.RemoveSharingDir(inst); err != nil {
 			return err
@@ -434,6 +476,9 @@ func (s *Sharing) NoMoreRecipient(inst *instance.Instance) error {
 	if err := RemoveSharedRefs(inst, s.SID); err != nil {
 		return err
 	}
+	if err := s.deleteActivities(inst); err != nil {
+		return err
+	}
 	s.Active = false
 	return couchdb.UpdateDoc(inst, s)
 }
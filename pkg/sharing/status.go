@@ -0,0 +1,210 @@
+package sharing
+
+import (
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/instance"
+)
+
+// The synchronization status of a member is kept in the same local documents
+// as the last sequence numbers of the replicator and of the upload. The retry
+// schedule of the workers is kept in a local document for the sharing.
+
+// MemberSyncStatus tells if a member of the sharing is up to date.
+type MemberSyncStatus struct {
+	Index           int        `json:"index"`
+	Name            string     `json:"name,omitempty"`
+	Instance        string     `json:"instance,omitempty"`
+	Status          string     `json:"status"`
+	LastReplication *time.Time `json:"last_replication,omitempty"`
+	LastUpload      *time.Time `json:"last_upload,omitempty"`
+	// PendingChanges is the number of changes in io.cozy.shared that the
+	// replicator has still to look at. It is an upper bound, as these changes
+	// can be for other sharings.
+	PendingChanges int        `json:"pending_changes"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+// RetryStatus gives the retry schedule of a worker after some errors.
+type RetryStatus struct {
+	Worker      string     `json:"worker"`
+	Errors      int        `json:"errors"`
+	NextRetryAt *time.Time `json:"next_retry_at,omitempty"`
+	GaveUp      bool       `json:"gave_up,omitempty"`
+}
+
+// SyncStatus is the synchronization status of a sharing.
+type SyncStatus struct {
+	Members []MemberSyncStatus `json:"members"`
+	Retries []RetryStatus      `json:"retries"`
+}
+
+// updateSyncStatus records the result of a replication or of an upload to
+// the given member.
+func (s *Sharing) updateSyncStatus(inst *instance.Instance, m *Member, worker string, syncErr error) {
+	id, err := s.replicationID(m)
+	if err != nil {
+		return
+	}
+	result, err := couchdb.GetLocal(inst, consts.Shared, id+"/"+worker)
+	if err != nil {
+		if !couchdb.IsNotFoundError(err) {
+			inst.Logger().WithField("nspace", "replicator").
+				Warnf("Cannot update the sync status of %s: %s", id, err)
+			return
+		}
+		result = make(map[string]interface{})
+	}
+	now := time.Now()
+	if syncErr == nil {
+		result["last_success"] = now
+	} else {
+		result["last_error"] = syncErr.Error()
+		result["last_error_at"] = now
+	}
+	if err = couchdb.PutLocal(inst, consts.Shared, id+"/"+worker, result); err != nil {
+		inst.Logger().WithField("nspace", "replicator").
+			Warnf("Cannot update the sync status of %s: %s", id, err)
+	}
+}
+
+// updateRetryStatus records the number of errors for a worker of this
+// sharing, and when it will be retried.
+func (s *Sharing) updateRetryStatus(inst *instance.Instance, worker string, errors int, backoff time.Duration) {
+	id := "sharing-" + s.SID + "/" + worker
+	result, err := couchdb.GetLocal(inst, consts.Shared, id)
+	if err != nil {
+		if !couchdb.IsNotFoundError(err) {
+			inst.Logger().WithField("nspace", "replicator").
+				Warnf("Cannot update the retry status of %s: %s", id, err)
+			return
+		}
+		if errors == 0 {
+			return
+		}
+		result = make(map[string]interface{})
+	} else if n, _ := result["errors"].(float64); n == 0 && errors == 0 {
+		return
+	}
+	result["errors"] = errors
+	delete(result, "next_retry_at")
+	delete(result, "gave_up")
+	if errors >= MaxRetries {
+		result["gave_up"] = true
+	} else if errors > 0 {
+		result["next_retry_at"] = time.Now().Add(backoff)
+	}
+	if err = couchdb.PutLocal(inst, consts.Shared, id, result); err != nil {
+		inst.Logger().WithField("nspace", "replicator").
+			Warnf("Cannot update the retry status of %s: %s", id, err)
+	}
+}
+
+// SyncStatus returns the synchronization status of the sharing, for the
+// members to which this instance sends its changes: the recipients for the
+// owner, and the owner for a recipient.
+func (s *Sharing) SyncStatus(inst *instance.Instance) (*SyncStatus, error) {
+	status := &SyncStatus{
+		Members: []MemberSyncStatus{},
+		Retries: []RetryStatus{},
+	}
+	for i := range s.Members {
+		if (s.Owner && i == 0) || (!s.Owner && i > 0) {
+			continue
+		}
+		ms, err := s.memberSyncStatus(inst, i)
+		if err != nil {
+			return nil, err
+		}
+		status.Members = append(status.Members, *ms)
+	}
+
+	for _, worker := range []string{"share-replicate", "share-upload"} {
+		result, err := couchdb.GetLocal(inst, consts.Shared, "sharing-"+s.SID+"/"+worker)
+		if err != nil {
+			if couchdb.IsNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		errors, _ := result["errors"].(float64)
+		if errors == 0 {
+			continue
+		}
+		gaveUp, _ := result["gave_up"].(bool)
+		status.Retries = append(status.Retries, RetryStatus{
+			Worker:      worker,
+			Errors:      int(errors),
+			NextRetryAt: parseStatusTime(result["next_retry_at"]),
+			GaveUp:      gaveUp,
+		})
+	}
+	return status, nil
+}
+
+func (s *Sharing) memberSyncStatus(inst *instance.Instance, index int) (*MemberSyncStatus, error) {
+	m := &s.Members[index]
+	ms := &MemberSyncStatus{
+		Index:    index,
+		Name:     m.PrimaryName(),
+		Instance: m.Instance,
+		Status:   m.Status,
+	}
+	id, err := s.replicationID(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastSeq string
+	for _, worker := range []string{"replicator", "upload"} {
+		result, err := couchdb.GetLocal(inst, consts.Shared, id+"/"+worker)
+		if err != nil {
+			if couchdb.IsNotFoundError(err) {
+				continue
+			}
+			return nil, err
+		}
+		success := parseStatusTime(result["last_success"])
+		if worker == "replicator" {
+			ms.LastReplication = success
+			lastSeq, _ = result["last_seq"].(string)
+		} else {
+			ms.LastUpload = success
+		}
+		errorAt := parseStatusTime(result["last_error_at"])
+		if errorAt != nil && (ms.LastErrorAt == nil || errorAt.After(*ms.LastErrorAt)) {
+			ms.LastErrorAt = errorAt
+			ms.LastError, _ = result["last_error"].(string)
+		}
+	}
+
+	if m.Status == MemberStatusReady {
+		response, err := couchdb.GetChanges(inst, &couchdb.ChangesRequest{
+			DocType: consts.Shared,
+			Since:   lastSeq,
+			Limit:   1,
+		})
+		if err != nil && !couchdb.IsNoDatabaseError(err) {
+			return nil, err
+		}
+		if response != nil {
+			ms.PendingChanges = len(response.Results) + response.Pending
+		}
+	}
+	return ms, nil
+}
+
+func parseStatusTime(v interface{}) *time.Time {
+	str, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
@@ -1,6 +1,7 @@
 package sharing
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
@@ -65,10 +66,13 @@ func (s *Sharing) Upload(inst *instance.Instance, errors int) error {
 	if errm != nil {
 		s.retryWorker(inst, "share-upload", errors)
 		inst.Logger().WithField("nspace", "upload").Infof("errm=%s\n", errm)
-	} else if len(members) > 0 {
+		return errm
+	}
+	s.updateRetryStatus(inst, "share-upload", 0, 0)
+	if len(members) > 0 {
 		s.pushJob(inst, "share-upload")
 	}
-	return errm
+	return nil
 }
 
 // InitialUpload uploads files to just a member, for the first time
@@ -121,7 +125,8 @@ func (s *Sharing) sendInitialEndNotif(inst *instance.Instance, m *Member) error
 
 // UploadTo uploads one file to the given member. It returns false if there
 // are no more files to upload to this member currently.
-func (s *Sharing) UploadTo(inst *instance.Instance, m *Member) (bool, error) {
+func (s *Sharing) UploadTo(inst *instance.Instance, m *Member) (more bool, err error) {
+	defer func() { s.updateSyncStatus(inst, m, "upload", err) }()
 	if m.Instance == "" {
 		return false, ErrInvalidURL
 	}
@@ -280,6 +285,18 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 	}
 	defer content.Close()
 
+	if resBody.Delta && fileDoc.ByteSize >= MinDeltaSize {
+		err = s.uploadDelta(inst, u, creds, resBody.Key, fileDoc, content)
+		if err == nil {
+			return nil
+		}
+		inst.Logger().WithField("nspace", "upload").
+			Infof("Cannot upload the delta for %s, the whole content will be sent: %s", origFileID, err)
+		if _, err = content.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
 	res2, err := request.Req(&request.Options{
 		Method: http.MethodPut,
 		Scheme: u.Scheme,
@@ -301,6 +318,67 @@ func (s *Sharing) uploadFile(inst *instance.Instance, m *Member, file map[string
 	return nil
 }
 
+// uploadDelta sends the delta between the current content of the file on the
+// recipient's cozy and the new content. The recipient gives the signature of
+// its version of the file, and it is used to compute the delta.
+func (s *Sharing) uploadDelta(inst *instance.Instance, u *url.URL, creds *Credentials, key string, fileDoc *vfs.FileDoc, content io.Reader) error {
+	res, err := request.Req(&request.Options{
+		Method: http.MethodGet,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/" + s.SID + "/io.cozy.files/" + key + "/signature",
+		Headers: request.Headers{
+			"Accept":        "application/json",
+			"Authorization": "Bearer " + creds.AccessToken.AccessToken,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var sig Signature
+	err = json.NewDecoder(res.Body).Decode(&sig)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	type deltaResult struct {
+		size int64
+		err  error
+	}
+	pr, pw := io.Pipe()
+	done := make(chan deltaResult, 1)
+	go func() {
+		size, err := WriteDelta(pw, &sig, content)
+		pw.CloseWithError(err)
+		done <- deltaResult{size, err}
+	}()
+
+	res2, err := request.Req(&request.Options{
+		Method: http.MethodPut,
+		Scheme: u.Scheme,
+		Domain: u.Host,
+		Path:   "/sharings/" + s.SID + "/io.cozy.files/" + key + "/delta",
+		Headers: request.Headers{
+			"Authorization": "Bearer " + creds.AccessToken.AccessToken,
+			"Content-Type":  "application/octet-stream",
+		},
+		Body: pr,
+	})
+	pr.Close()
+	result := <-done
+	if err != nil {
+		return err
+	}
+	res2.Body.Close()
+	if result.err != nil {
+		return result.err
+	}
+	inst.Logger().WithField("nspace", "upload").
+		Infof("Delta for %s: %d bytes sent instead of %d", fileDoc.DocID, result.size, fileDoc.ByteSize)
+	return nil
+}
+
 // FileDocWithRevisions is the struct of the payload for synchronizing a file
 type FileDocWithRevisions struct {
 	*vfs.FileDoc
@@ -313,9 +391,11 @@ func (f *FileDocWithRevisions) Clone() couchdb.Doc {
 }
 
 // KeyToUpload contains the key for uploading a file (when syncing metadata is
-// not enough)
+// not enough). Delta is true when the recipient can receive a delta of the
+// content instead of the whole content.
 type KeyToUpload struct {
-	Key string `json:"key"`
+	Key   string `json:"key"`
+	Delta bool   `json:"delta,omitempty"`
 }
 
 func (s *Sharing) createUploadKey(inst *instance.Instance, target *FileDocWithRevisions) (*KeyToUpload, error) {
@@ -327,8 +407,9 @@ func (s *Sharing) createUploadKey(inst *instance.Instance, target *FileDocWithRe
 }
 
 // SyncFile tries to synchronize a file with just the metadata. If it can't,
-// it will return a key to upload the content.
-func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions) (*KeyToUpload, error) {
+// it will return a key to upload the content. The change is recorded in the
+// activity feed as made by the given member.
+func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions, from *Member) (*KeyToUpload, error) {
 	inst.Logger().WithField("nspace", "upload").Debugf("SyncFile %#v", target)
 	mu := lock.ReadWrite(inst, "shared")
 	mu.Lock()
@@ -363,9 +444,18 @@ func (s *Sharing) SyncFile(inst *instance.Instance, target *FileDocWithRevisions
 		return nil, nil
 	}
 	if !bytes.Equal(target.MD5Sum, current.MD5Sum) {
-		return s.createUploadKey(inst, target)
+		key, err := s.createUploadKey(inst, target)
+		if err != nil {
+			return nil, err
+		}
+		key.Delta = current.ByteSize >= MinDeltaSize && target.ByteSize >= MinDeltaSize
+		return key, nil
 	}
-	return nil, s.updateFileMetadata(inst, target, current, &ref)
+	if err = s.updateFileMetadata(inst, target, current, &ref); err != nil {
+		return nil, err
+	}
+	s.RecordActivity(inst, from, ActivityUpdated, consts.Files, target.DocID, target.DocName)
+	return nil, nil
 }
 
 // prepareFileWithAncestors find the parent directory for file, and recreates it
@@ -423,13 +513,16 @@ func (s *Sharing) updateFileMetadata(inst *instance.Instance, target *FileDocWit
 	rule := &s.Rules[infos.Rule]
 	newdoc.ReferencedBy = buildReferencedBy(target.FileDoc, newdoc, rule)
 
+	var conflict *Conflict
 	err := fs.UpdateFileDoc(olddoc, newdoc)
 	if err == os.ErrExist {
 		pth, errp := newdoc.Path(fs)
 		if errp != nil {
 			return errp
 		}
-		name, errr := s.resolveConflictSamePath(inst, newdoc.DocID, pth)
+		var name string
+		var errr error
+		name, conflict, errr = s.resolveConflictSamePath(inst, newdoc.DocID, pth)
 		if errr != nil {
 			return errr
 		}
@@ -444,12 +537,14 @@ func (s *Sharing) updateFileMetadata(inst *instance.Instance, target *FileDocWit
 			Debugf("Cannot update file: %s", err)
 		return err
 	}
+	s.recordConflict(inst, conflict)
 	return nil
 }
 
 // HandleFileUpload is used to receive a file upload when synchronizing just
-// the metadata was not enough.
-func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.ReadCloser) error {
+// the metadata was not enough. The change is recorded in the activity feed as
+// made by the given member.
+func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.ReadCloser, from *Member) error {
 	defer body.Close()
 	target, err := getStore().Get(inst, key)
 	inst.Logger().WithField("nspace", "upload").Debugf("HandleFileUpload %#v", target)
@@ -471,9 +566,91 @@ func (s *Sharing) HandleFileUpload(inst *instance.Instance, key string, body io.
 	}
 
 	if current == nil {
-		return s.UploadNewFile(inst, target, body)
+		err = s.UploadNewFile(inst, target, body)
+	} else {
+		err = s.UploadExistingFile(inst, target, current, body)
+	}
+	if err != nil {
+		return err
+	}
+	action := ActivityUpdated
+	if current == nil {
+		action = ActivityAdded
 	}
-	return s.UploadExistingFile(inst, target, current, body)
+	s.RecordActivity(inst, from, action, consts.Files, target.DocID, target.DocName)
+	return nil
+}
+
+// FileSignature returns the signature of the current content of a file, for
+// the sender to compute a delta against it.
+func (s *Sharing) FileSignature(inst *instance.Instance, key string) (*Signature, error) {
+	target, err := getStore().Get(inst, key)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, ErrMissingFileMetadata
+	}
+	fs := inst.VFS()
+	current, err := fs.FileByID(target.DocID)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return nil, ErrCannotApplyDelta
+		}
+		return nil, err
+	}
+	content, err := fs.OpenFile(current)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	return ComputeSignature(content, current.ByteSize, current.MD5Sum)
+}
+
+// HandleFileDelta is used to receive the delta of the content of a file, when
+// synchronizing just the metadata was not enough. The new content is rebuilt
+// from the current content and the delta, and then uploaded like a normal
+// file upload.
+func (s *Sharing) HandleFileDelta(inst *instance.Instance, key string, body io.ReadCloser, from *Member) error {
+	defer body.Close()
+	target, err := getStore().Get(inst, key)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return ErrMissingFileMetadata
+	}
+	fs := inst.VFS()
+	current, err := fs.FileByID(target.DocID)
+	if err != nil {
+		if err == os.ErrNotExist {
+			return ErrCannotApplyDelta
+		}
+		return err
+	}
+	delta := bufio.NewReader(body)
+	blockSize, err := readDeltaHeader(delta, current.MD5Sum)
+	if err != nil {
+		return err
+	}
+	base, err := fs.OpenFile(current)
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := applyDelta(pw, base, current.ByteSize, blockSize, delta)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err = s.HandleFileUpload(inst, key, pr, from)
+	if errApply := <-done; errApply == ErrCannotApplyDelta {
+		return errApply
+	}
+	return err
 }
 
 // UploadNewFile is used to receive a new file.
@@ -525,13 +702,16 @@ func (s *Sharing) UploadNewFile(inst *instance.Instance, target *FileDocWithRevi
 	ref.Infos[s.SID] = SharedInfo{Rule: ruleIndex, Binary: true}
 	newdoc.ReferencedBy = buildReferencedBy(target.FileDoc, nil, rule)
 
+	var conflict *Conflict
 	file, err := fs.CreateFile(newdoc, nil)
 	if err == os.ErrExist {
 		pth, errp := newdoc.Path(fs)
 		if errp != nil {
 			return errp
 		}
-		name, errr := s.resolveConflictSamePath(inst, newdoc.DocID, pth)
+		var name string
+		var errr error
+		name, conflict, errr = s.resolveConflictSamePath(inst, newdoc.DocID, pth)
 		if errr != nil {
 			return errr
 		}
@@ -549,7 +729,11 @@ func (s *Sharing) UploadNewFile(inst *instance.Instance, target *FileDocWithRevi
 	if s.NbFiles > 0 {
 		defer s.countReceivedFiles(inst)
 	}
-	return copyFileContent(inst, file, body)
+	if err = copyFileContent(inst, file, body); err != nil {
+		return err
+	}
+	s.recordConflict(inst, conflict)
+	return nil
 }
 
 // countReceivedFiles counts the number of files received during the initial
@@ -633,12 +817,12 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 	newdoc.MD5Sum = target.MD5Sum
 
 	chain := revsStructToChain(target.Revisions)
-	conflict := detectConflict(newdoc.DocRev, chain)
-	switch conflict {
+	var conflict *Conflict
+	switch detectConflict(newdoc.DocRev, chain) {
 	case LostConflict:
 		return s.uploadLostConflict(inst, target, newdoc, body)
 	case WonConflict:
-		if err = s.uploadWonConflict(inst, olddoc); err != nil {
+		if conflict, err = s.uploadWonConflict(inst, olddoc); err != nil {
 			return err
 		}
 	case NoConflict:
@@ -652,7 +836,11 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 		if errf != nil {
 			return errf
 		}
-		return copyFileContent(inst, file, body)
+		if err = copyFileContent(inst, file, body); err != nil {
+			return err
+		}
+		s.recordConflict(inst, conflict)
+		return nil
 	}
 
 	stash := indexer.StashRevision(false)
@@ -670,13 +858,16 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 
 	indexer.UnstashRevision(stash)
 	newdoc.DocRev = tmpdoc.DocRev
+	var pathConflict *Conflict
 	err = fs.UpdateFileDoc(tmpdoc, newdoc)
 	if err == os.ErrExist {
 		pth, errp := newdoc.Path(fs)
 		if errp != nil {
 			return errp
 		}
-		name, errr := s.resolveConflictSamePath(inst, newdoc.DocID, pth)
+		var name string
+		var errr error
+		name, pathConflict, errr = s.resolveConflictSamePath(inst, newdoc.DocID, pth)
 		if errr != nil {
 			return errr
 		}
@@ -686,7 +877,12 @@ func (s *Sharing) UploadExistingFile(inst *instance.Instance, target *FileDocWit
 		}
 		err = fs.UpdateFileDoc(tmpdoc, newdoc)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	s.recordConflict(inst, conflict)
+	s.recordConflict(inst, pathConflict)
+	return nil
 }
 
 // uploadLostConflict manages an upload where a file is in conflict, and the
@@ -715,12 +911,17 @@ func (s *Sharing) uploadLostConflict(inst *instance.Instance, target *FileDocWit
 		return err
 	}
 	inst.Logger().WithField("nspace", "upload").Debugf("1. loser = %#v", newdoc)
-	return copyFileContent(inst, file, body)
+	if err = copyFileContent(inst, file, body); err != nil {
+		return err
+	}
+	s.recordConflict(inst, s.newConflict(target.DocName, target.DocID, newdoc.DocID))
+	return nil
 }
 
 // uploadWonConflict manages an upload where a file is in conflict, and the
-// existing file is copied to a new file to let the upload succeed.
-func (s *Sharing) uploadWonConflict(inst *instance.Instance, src *vfs.FileDoc) error {
+// existing file is copied to a new file to let the upload succeed. It returns
+// the conflict, that the caller must record after the upload.
+func (s *Sharing) uploadWonConflict(inst *instance.Instance, src *vfs.FileDoc) (*Conflict, error) {
 	rev := src.Rev()
 	inst.Logger().WithField("nspace", "upload").Debugf("uploadWonConflict %s", rev)
 	indexer := newSharingIndexer(inst, &bulkRevs{
@@ -731,21 +932,24 @@ func (s *Sharing) uploadWonConflict(inst *instance.Instance, src *vfs.FileDoc) e
 	dst := src.Clone().(*vfs.FileDoc)
 	dst.DocID = conflictID(dst.DocID, rev)
 	if _, err := fs.FileByID(dst.DocID); err != os.ErrNotExist {
-		return err
+		return nil, err
 	}
 	dst.DocName = conflictName(dst.DocName, rev)
 	dst.ResetFullpath()
 	content, err := fs.OpenFile(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer content.Close()
 	file, err := fs.CreateFile(dst, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	inst.Logger().WithField("nspace", "upload").Debugf("2. loser = %#v", dst)
-	return copyFileContent(inst, file, content)
+	if err = copyFileContent(inst, file, content); err != nil {
+		return nil, err
+	}
+	return s.newConflict(src.DocName, dst.DocID, src.DocID), nil
 }
 
 // copyFileContent will copy the body of the HTTP request to the file, and
@@ -10,6 +10,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config_dyn"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/sessions"
@@ -86,10 +87,26 @@ security features. Please do not use this binary as your production server.
 		return
 	}
 
-	// Init the main global connection to the swift server
+	// Init the main global connection to the swift or S3 server, and a
+	// separate one for the previous storage if the files are being moved.
 	fsURL := config.FsURL()
-	if fsURL.Scheme == config.SchemeSwift {
-		if err = config.InitSwiftConnection(fsURL); err != nil {
+	switch fsURL.Scheme {
+	case config.SchemeSwift:
+		err = config.InitSwiftConnection(fsURL)
+	case config.SchemeS3:
+		err = config.InitS3Client(fsURL)
+	}
+	if err != nil {
+		return
+	}
+	if previous := config.FsPreviousURL(); previous != nil {
+		switch previous.Scheme {
+		case config.SchemeSwift:
+			err = config.InitPreviousSwiftConnection(previous)
+		case config.SchemeS3:
+			err = config.InitPreviousS3Client(previous)
+		}
+		if err != nil {
 			return
 		}
 	}
@@ -110,6 +127,7 @@ security features. Please do not use this binary as your production server.
 		schder = jobs.NewMemScheduler()
 	}
 
+	jobs.SetWeightFunc(instance.JobsWeightOf)
 	if err = jobs.SystemStart(broker, schder, workersList); err != nil {
 		return
 	}
@@ -0,0 +1,355 @@
+package vfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// BlobsDirName is the path of the directory used by the afero VFS to store
+// the deduplicated contents of the files.
+const BlobsDirName = "/.cozy_blobs"
+
+// maxBlobConflicts is the number of times we retry to save the references of
+// a blob when several files are written in parallel.
+const maxBlobConflicts = 10
+
+// Blob is used for the reference counting of a content shared by several
+// files. Its identifier is computed from the md5sum and the size of the
+// content, and the references are the identifiers of the files. As md5
+// collisions can be crafted, the sha256 of the content is recorded too, and a
+// new content is deduplicated with the blob only if it has the same sha256.
+type Blob struct {
+	DocID     string   `json:"_id,omitempty"`
+	DocRev    string   `json:"_rev,omitempty"`
+	ByteSize  int64    `json:"size"`
+	MD5Sum    []byte   `json:"md5sum"`
+	SHA256    []byte   `json:"sha256,omitempty"`
+	Encrypted bool     `json:"encrypted,omitempty"`
+	Refs      []string `json:"refs"`
+}
+
+// ID returns the blob identifier
+func (b *Blob) ID() string { return b.DocID }
+
+// Rev returns the blob revision
+func (b *Blob) Rev() string { return b.DocRev }
+
+// DocType returns the blob document type
+func (b *Blob) DocType() string { return consts.FilesBlobs }
+
+// Clone implements couchdb.Doc
+func (b *Blob) Clone() couchdb.Doc {
+	cloned := *b
+	cloned.MD5Sum = make([]byte, len(b.MD5Sum))
+	copy(cloned.MD5Sum, b.MD5Sum)
+	cloned.SHA256 = make([]byte, len(b.SHA256))
+	copy(cloned.SHA256, b.SHA256)
+	cloned.Refs = make([]string, len(b.Refs))
+	copy(cloned.Refs, b.Refs)
+	return &cloned
+}
+
+// SetID changes the blob qualified identifier
+func (b *Blob) SetID(id string) { b.DocID = id }
+
+// SetRev changes the blob revision
+func (b *Blob) SetRev(rev string) { b.DocRev = rev }
+
+// HasRef returns true if the given file references this blob.
+func (b *Blob) HasRef(fileID string) bool {
+	for _, ref := range b.Refs {
+		if ref == fileID {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if a content with the given sha256 is the content of
+// this blob. A blob created before the sha256 was recorded never matches.
+func (b *Blob) matches(sha256sum []byte) bool {
+	return len(b.SHA256) > 0 && bytes.Equal(b.SHA256, sha256sum)
+}
+
+func (b *Blob) removeRef(fileID string) {
+	refs := b.Refs[:0]
+	for _, ref := range b.Refs {
+		if ref != fileID {
+			refs = append(refs, ref)
+		}
+	}
+	b.Refs = refs
+}
+
+// DedupEnabled returns true if the contents of the new files should be stored
+// by their hash, with a single copy for the files with the same content.
+func DedupEnabled() bool {
+	return config.GetConfig().Fs.Dedup
+}
+
+// BlobID returns the identifier of the blob for the content of a file. An
+// encrypted content and a content in clear are two different blobs, even if
+// they have the same md5sum, as a file is read according to its encrypted
+// flag.
+func BlobID(doc *FileDoc) string {
+	return blobID(doc.MD5Sum, doc.ByteSize, doc.Encrypted)
+}
+
+func blobID(md5sum []byte, size int64, encrypted bool) string {
+	id := hex.EncodeToString(md5sum) + "-" + strconv.FormatInt(size, 10)
+	if encrypted {
+		id += "-encrypted"
+	}
+	return id
+}
+
+// GetBlob returns the blob document with the given identifier.
+func GetBlob(db prefixer.Prefixer, id string) (*Blob, error) {
+	var b Blob
+	if err := couchdb.GetDoc(db, consts.FilesBlobs, id, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// HasBlobRef returns true if the given file references the blob of its
+// content, i.e. if its content is deduplicated.
+func HasBlobRef(db prefixer.Prefixer, doc *FileDoc) (bool, error) {
+	b, err := GetBlob(db, BlobID(doc))
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return b.HasRef(doc.ID()), nil
+}
+
+// CheckBlobContent must be called before the content of a file, whose sha256
+// is given, replaces or is replaced by the stored content of its blob. It
+// returns ErrBlobMismatch if the blob has another content with the same
+// md5sum and size. The stored argument tells if the content of the blob is
+// already stored: a stored content without a blob document is an orphan, and
+// nothing is known about it, so it doesn't match either.
+func CheckBlobContent(db prefixer.Prefixer, doc *FileDoc, sha256sum []byte, stored bool) error {
+	b, err := GetBlob(db, BlobID(doc))
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		if stored {
+			return ErrBlobMismatch
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !b.matches(sha256sum) {
+		return ErrBlobMismatch
+	}
+	return nil
+}
+
+// AddBlobRef adds a reference from the given file to the blob of its content,
+// whose sha256 is given. The blob document is created if it is the first
+// reference.
+func AddBlobRef(db prefixer.Prefixer, doc *FileDoc, sha256sum []byte) error {
+	id := BlobID(doc)
+	var err error
+	for i := 0; i < maxBlobConflicts; i++ {
+		var b *Blob
+		b, err = GetBlob(db, id)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			b = &Blob{DocID: id, ByteSize: doc.ByteSize, MD5Sum: doc.MD5Sum, SHA256: sha256sum, Encrypted: doc.Encrypted}
+			b.Refs = []string{doc.ID()}
+			err = couchdb.CreateNamedDocWithDB(db, b)
+		} else if err == nil {
+			if !b.matches(sha256sum) {
+				return ErrBlobMismatch
+			}
+			if b.HasRef(doc.ID()) {
+				return nil
+			}
+			b.Refs = append(b.Refs, doc.ID())
+			err = couchdb.UpdateDoc(db, b)
+		}
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// RemoveBlobRef removes the reference from the given file to a blob. It
+// returns the blob if the file was referencing it, and nil otherwise, for
+// example if the file was written before the deduplication was enabled. When
+// the last reference is removed, the blob document is deleted, and the caller
+// must remove the stored content.
+func RemoveBlobRef(db prefixer.Prefixer, blobID, fileID string) (*Blob, error) {
+	var err error
+	for i := 0; i < maxBlobConflicts; i++ {
+		var b *Blob
+		b, err = GetBlob(db, blobID)
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !b.HasRef(fileID) {
+			return nil, nil
+		}
+		b.removeRef(fileID)
+		if len(b.Refs) == 0 {
+			err = couchdb.DeleteDoc(db, b)
+		} else {
+			err = couchdb.UpdateDoc(db, b)
+		}
+		if err == nil {
+			return b, nil
+		}
+		if !couchdb.IsConflictError(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// ReleaseBlob removes the reference from a file to the blob of its content,
+// if any. When it was the last reference, the content of the blob is removed
+// from the storage by the remove function of the VFS. The errors are only
+// logged, as a blob that is not released only takes some space.
+func ReleaseBlob(db prefixer.Prefixer, doc *FileDoc, remove func(blobs []*Blob) error) {
+	b, err := RemoveBlobRef(db, BlobID(doc), doc.ID())
+	if err == nil && b != nil && len(b.Refs) == 0 {
+		err = remove([]*Blob{b})
+	}
+	if err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "vfs").
+			Warnf("Could not release the blob of %s: %s", doc.ID(), err)
+	}
+}
+
+// ReleaseOldBlob is called when the content of a file has been replaced, to
+// release the blob of the old content, except if the new content has been
+// stored in the same blob.
+func ReleaseOldBlob(db prefixer.Prefixer, olddoc, newdoc *FileDoc, stored bool, remove func(blobs []*Blob) error) {
+	if stored && BlobID(olddoc) == BlobID(newdoc) {
+		return
+	}
+	ReleaseBlob(db, olddoc, remove)
+}
+
+// ReleaseBlobs is the same as ReleaseBlob for a list of destroyed files.
+func ReleaseBlobs(db prefixer.Prefixer, fileIDs []string, remove func(blobs []*Blob) error) {
+	unused, err := removeBlobRefs(db, fileIDs)
+	if len(unused) > 0 {
+		if errr := remove(unused); errr != nil && err == nil {
+			err = errr
+		}
+	}
+	if err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "vfs").
+			Warnf("Could not release the blobs: %s", err)
+	}
+}
+
+// removeBlobRefs removes the references from the given files to their blobs.
+// It returns the blobs that have no more references.
+func removeBlobRefs(db prefixer.Prefixer, fileIDs []string) ([]*Blob, error) {
+	if len(fileIDs) == 0 {
+		return nil, nil
+	}
+	keys := make([]interface{}, len(fileIDs))
+	for i, id := range fileIDs {
+		keys[i] = id
+	}
+	var res couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.BlobsByRefView, &couchdb.ViewRequest{
+		Keys: keys,
+	}, &res)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var unused []*Blob
+	for _, row := range res.Rows {
+		fileID, _ := row.Key.(string)
+		b, err := RemoveBlobRef(db, row.ID, fileID)
+		if err != nil {
+			return unused, err
+		}
+		if b != nil && len(b.Refs) == 0 {
+			unused = append(unused, b)
+		}
+	}
+	return unused, nil
+}
+
+// BlobsDiskSavings computes the disk space saved by the deduplication: a
+// content shared by n files is counted only once in the disk usage.
+func BlobsDiskSavings(db prefixer.Prefixer) (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.BlobsDiskSavingsView, &couchdb.ViewRequest{
+		Reduce: true,
+	}, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(f64), nil
+}
+
+// FsckBlobs checks the blobs against the index and the storage: each
+// reference must be a file of the index with the same content, and the
+// content of each blob must be stored. The files argument is the files of the
+// index, by their identifiers, and the function returns the identifiers of
+// the files that reference a blob.
+func FsckBlobs(db prefixer.Prefixer, files map[string]*TreeFile, stored func(b *Blob) (bool, error), accumulate func(log *FsckLog)) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	err := couchdb.ForeachDocs(db, consts.FilesBlobs, func(_ string, data json.RawMessage) error {
+		var b Blob
+		if err := json.Unmarshal(data, &b); err != nil {
+			return err
+		}
+		ok, err := stored(&b)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			accumulate(&FsckLog{Type: BlobMissing, Blob: &b})
+		}
+		for _, ref := range b.Refs {
+			f, ok := files[ref]
+			if !ok || f.IsDir || blobID(f.MD5Sum, f.ByteSize, f.Encrypted) != b.ID() {
+				accumulate(&FsckLog{Type: BlobDanglingRef, Blob: &b, FileID: ref})
+				continue
+			}
+			referenced[ref] = true
+		}
+		return nil
+	})
+	if couchdb.IsNoDatabaseError(err) {
+		return referenced, nil
+	}
+	return referenced, err
+}
+
+var _ couchdb.Doc = &Blob{}
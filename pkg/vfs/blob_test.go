@@ -0,0 +1,36 @@
+package vfs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobRefs(t *testing.T) {
+	doc := &FileDoc{ByteSize: 12, MD5Sum: []byte{0xde, 0xad, 0xbe, 0xef}}
+	assert.Equal(t, "deadbeef-12", BlobID(doc))
+	encrypted := &FileDoc{ByteSize: 12, MD5Sum: doc.MD5Sum, Encrypted: true}
+	assert.Equal(t, "deadbeef-12-encrypted", BlobID(encrypted))
+
+	b := &Blob{DocID: BlobID(doc), Refs: []string{"file1", "file2", "file3"}}
+	assert.True(t, b.HasRef("file2"))
+	assert.False(t, b.HasRef("file4"))
+
+	b.removeRef("file2")
+	assert.Equal(t, []string{"file1", "file3"}, b.Refs)
+	assert.False(t, b.HasRef("file2"))
+
+	b.removeRef("file4")
+	assert.Equal(t, []string{"file1", "file3"}, b.Refs)
+}
+
+func TestBlobMatches(t *testing.T) {
+	b := &Blob{DocID: "deadbeef-12"}
+	assert.False(t, b.matches(nil))
+	assert.False(t, b.matches([]byte{0x01, 0x02}))
+
+	b.SHA256 = []byte{0x01, 0x02}
+	assert.True(t, b.matches([]byte{0x01, 0x02}))
+	assert.False(t, b.matches([]byte{0x01, 0x03}))
+	assert.False(t, b.matches(nil))
+}
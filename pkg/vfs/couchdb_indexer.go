@@ -73,7 +73,22 @@ func (c *couchdbIndexer) DiskUsage() (int64, error) {
 	if !ok {
 		return 0, ErrWrongCouchdbState
 	}
-	return int64(f64), nil
+	// The old versions of the files are also counted in the quota
+	versions, err := VersionsDiskUsage(c.db)
+	if err != nil {
+		return 0, err
+	}
+	// The space reserved by the pending upload sessions is taken too
+	reserved, err := UploadsReservedSize(c.db)
+	if err != nil {
+		return 0, err
+	}
+	// A content shared by several files is only counted once
+	savings, err := BlobsDiskSavings(c.db)
+	if err != nil {
+		return 0, err
+	}
+	return int64(f64) + versions + reserved - savings, nil
 }
 
 func (c *couchdbIndexer) CreateFileDoc(doc *FileDoc) error {
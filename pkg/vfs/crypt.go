@@ -0,0 +1,355 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The contents of the files can be encrypted at rest with a key per instance.
+// An encrypted content starts with a header, made of a magic string and a
+// random prefix for the nonces, followed by the content split in chunks of
+// 64KB, each one sealed with secretbox. The nonce of a chunk is the prefix
+// followed by the index of the chunk, with the highest bit set for the last
+// chunk, so that a content can't be truncated or reordered without being
+// detected. As the chunks have a fixed size, the content can be read from any
+// offset, for the range requests.
+//
+// The documents of the files, of their versions, of the blobs and of the
+// chunks of the upload sessions have an encrypted flag, and a content is only
+// decrypted when this flag is set. The contents written before the encryption
+// was enabled on an instance are read in clear, even if they start with the
+// magic string.
+
+const (
+	cryptMagic           = "COZYENC1"
+	cryptPrefixSize      = 16
+	cryptHeaderSize      = len(cryptMagic) + cryptPrefixSize
+	cryptChunkSize       = 64 << 10
+	cryptSealedChunkSize = cryptChunkSize + secretbox.Overhead
+	cryptLastChunkFlag   = 1 << 63
+)
+
+// EncryptedHeaderSize is the size of the header of an encrypted content.
+const EncryptedHeaderSize = cryptHeaderSize
+
+var (
+	// ErrNotEncrypted is used when a content is read with a decrypter, but
+	// was written in clear.
+	ErrNotEncrypted = errors.New("The content is not encrypted")
+	// ErrInvalidEncryptedContent is used when an encrypted content can't be
+	// decrypted with the key of the instance.
+	ErrInvalidEncryptedContent = errors.New("The encrypted content is invalid")
+	// ErrEncryptionDisabled is used when trying to encrypt the contents of an
+	// instance that has no key for its files.
+	ErrEncryptionDisabled = errors.New("The encryption of the files is not enabled")
+	// ErrEncryptionNotSupported is used when the storage of an instance does
+	// not support the encryption.
+	ErrEncryptionNotSupported = errors.New("The encryption of the files is not supported by this storage")
+)
+
+// ContentKeyer is implemented by the instances whose files are encrypted at
+// rest, and gives the key used for the contents of their files.
+type ContentKeyer interface {
+	FilesKey() (*keymgmt.SecretKey, error)
+}
+
+// ContentKey returns the key used to encrypt the contents of the files for
+// the given instance, or nil if its files are not encrypted.
+func ContentKey(db prefixer.Prefixer) (*keymgmt.SecretKey, error) {
+	if keyer, ok := db.(ContentKeyer); ok {
+		return keyer.FilesKey()
+	}
+	return nil, nil
+}
+
+// EncryptedSize returns the size of the encrypted content for a content of
+// the given size.
+func EncryptedSize(size int64) int64 {
+	chunks := size / cryptChunkSize
+	if size == 0 || size%cryptChunkSize != 0 {
+		chunks++
+	}
+	return int64(cryptHeaderSize) + size + chunks*secretbox.Overhead
+}
+
+// DecryptedSize returns the size of the content for an encrypted content of
+// the given size.
+func DecryptedSize(encsize int64) (int64, error) {
+	body := encsize - int64(cryptHeaderSize)
+	if body < secretbox.Overhead {
+		return 0, ErrInvalidEncryptedContent
+	}
+	chunks := (body + cryptSealedChunkSize - 1) / cryptSealedChunkSize
+	if last := body - (chunks-1)*cryptSealedChunkSize; last < secretbox.Overhead {
+		return 0, ErrInvalidEncryptedContent
+	}
+	return body - chunks*secretbox.Overhead, nil
+}
+
+// EncryptedWith returns true if the content of r has been written by an
+// encrypter with the given key: the header must be the one of an encrypted
+// content, and the first chunk must be authenticated by the key. It is used
+// by the migration to recognize the contents encrypted by a previous run that
+// was interrupted before their documents were updated, not to decide how a
+// content is read. The reader is rewound to the beginning of the content.
+func EncryptedWith(r io.ReadSeeker, size int64, key *keymgmt.SecretKey) (bool, error) {
+	encrypted := false
+	d, err := NewDecrypter(r, size, key)
+	if err == nil {
+		encrypted = d.load(0) == nil
+	} else if err == ErrNotEncrypted || err == ErrInvalidEncryptedContent {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err = r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return encrypted, nil
+}
+
+func cryptNonce(prefix []byte, index uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix)
+	if last {
+		index |= cryptLastChunkFlag
+	}
+	binary.BigEndian.PutUint64(nonce[cryptPrefixSize:], index)
+	return &nonce
+}
+
+// Encrypter is a writer that encrypts a content with the key of an instance.
+// It must be closed to write the last chunk, but it does not close the
+// underlying writer.
+type Encrypter struct {
+	w      io.Writer
+	key    *[32]byte
+	prefix []byte
+	index  uint64
+	buf    []byte
+	sealed []byte
+	err    error
+}
+
+// NewEncrypter returns an encrypter that writes the encrypted content on w.
+// The header is written immediately.
+func NewEncrypter(w io.Writer, key *keymgmt.SecretKey) (*Encrypter, error) {
+	header := make([]byte, cryptHeaderSize)
+	copy(header, cryptMagic)
+	prefix := header[len(cryptMagic):]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &Encrypter{
+		w:      w,
+		key:    (*[32]byte)(key),
+		prefix: prefix,
+		buf:    make([]byte, 0, cryptChunkSize),
+		sealed: make([]byte, 0, cryptSealedChunkSize),
+	}, nil
+}
+
+// Write implements io.Writer. A full chunk is kept in memory until more data
+// is written, as the last chunk is sealed differently.
+func (e *Encrypter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(e.buf) == cryptChunkSize {
+			if e.err = e.seal(false); e.err != nil {
+				return written, e.err
+			}
+		}
+		n := copy(e.buf[len(e.buf):cryptChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the last chunk.
+func (e *Encrypter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	e.err = e.seal(true)
+	if e.err != nil {
+		return e.err
+	}
+	e.err = os.ErrClosed
+	return nil
+}
+
+func (e *Encrypter) seal(last bool) error {
+	nonce := cryptNonce(e.prefix, e.index, last)
+	e.sealed = secretbox.Seal(e.sealed[:0], e.buf, nonce, e.key)
+	if _, err := e.w.Write(e.sealed); err != nil {
+		return err
+	}
+	e.index++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// Decrypter is a reader for an encrypted content. It implements io.Reader,
+// io.ReaderAt and io.Seeker, with the offsets of the decrypted content. The
+// underlying reader is not closed by the decrypter. It is safe for concurrent
+// use, as the decrypted chunk and the position of the underlying reader are
+// guarded by a mutex, but the calls are serialized.
+type Decrypter struct {
+	mu      sync.Mutex
+	r       io.ReadSeeker
+	key     *[32]byte
+	prefix  []byte
+	encsize int64
+	size    int64
+	chunks  int64
+	offset  int64
+	current int64
+	plain   []byte
+	sealed  []byte
+}
+
+// NewDecrypter returns a decrypter for the encrypted content of r, whose size
+// is encsize. It returns ErrNotEncrypted if the content has not been written
+// by an encrypter, and the caller can read it in clear from the beginning.
+func NewDecrypter(r io.ReadSeeker, encsize int64, key *keymgmt.SecretKey) (*Decrypter, error) {
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(cryptMagic)) {
+		return nil, ErrNotEncrypted
+	}
+	size, err := DecryptedSize(encsize)
+	if err != nil {
+		return nil, err
+	}
+	chunks := (encsize - int64(cryptHeaderSize) + cryptSealedChunkSize - 1) / cryptSealedChunkSize
+	return &Decrypter{
+		r:       r,
+		key:     (*[32]byte)(key),
+		prefix:  header[len(cryptMagic):],
+		encsize: encsize,
+		size:    size,
+		chunks:  chunks,
+		current: -1,
+	}, nil
+}
+
+// Size returns the size of the decrypted content.
+func (d *Decrypter) Size() int64 {
+	return d.size
+}
+
+// Read implements io.Reader.
+func (d *Decrypter) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.readAt(p, d.offset)
+	d.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt. It does not use nor change the offset used
+// by Read and Seek.
+func (d *Decrypter) ReadAt(p []byte, off int64) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readAt(p, off)
+}
+
+func (d *Decrypter) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	read := 0
+	for read < len(p) {
+		if off >= d.size {
+			return read, io.EOF
+		}
+		index := off / cryptChunkSize
+		if err := d.load(index); err != nil {
+			return read, err
+		}
+		n := copy(p[read:], d.plain[off-index*cryptChunkSize:])
+		read += n
+		off += int64(n)
+	}
+	return read, nil
+}
+
+// Seek implements io.Seeker.
+func (d *Decrypter) Seek(offset int64, whence int) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *Decrypter) load(index int64) error {
+	if index == d.current {
+		return nil
+	}
+	pos := int64(cryptHeaderSize) + index*cryptSealedChunkSize
+	length := d.encsize - pos
+	if length > cryptSealedChunkSize {
+		length = cryptSealedChunkSize
+	}
+	if _, err := d.r.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	if cap(d.sealed) < cryptSealedChunkSize {
+		d.sealed = make([]byte, cryptSealedChunkSize)
+	}
+	sealed := d.sealed[:length]
+	if _, err := io.ReadFull(d.r, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidEncryptedContent
+		}
+		return err
+	}
+	nonce := cryptNonce(d.prefix, uint64(index), index == d.chunks-1)
+	plain, ok := secretbox.Open(d.plain[:0], sealed, nonce, d.key)
+	if !ok {
+		d.current = -1
+		return ErrInvalidEncryptedContent
+	}
+	d.plain = plain
+	d.current = index
+	return nil
+}
@@ -0,0 +1,151 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/stretchr/testify/assert"
+)
+
+func encrypt(t *testing.T, key *keymgmt.SecretKey, content []byte) []byte {
+	var buf bytes.Buffer
+	enc, err := NewEncrypter(&buf, key)
+	assert.NoError(t, err)
+	_, err = enc.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, enc.Close())
+	return buf.Bytes()
+}
+
+func TestEncryptedSizes(t *testing.T) {
+	for _, size := range []int64{0, 1, cryptChunkSize - 1, cryptChunkSize, cryptChunkSize + 1, 3 * cryptChunkSize} {
+		encsize := EncryptedSize(size)
+		decsize, err := DecryptedSize(encsize)
+		assert.NoError(t, err)
+		assert.Equal(t, size, decsize)
+	}
+	_, err := DecryptedSize(int64(cryptHeaderSize))
+	assert.Equal(t, ErrInvalidEncryptedContent, err)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := keymgmt.GenerateSecretKey()
+	assert.NoError(t, err)
+
+	content := make([]byte, 2*cryptChunkSize+1234)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	encrypted := encrypt(t, key, content)
+	assert.EqualValues(t, EncryptedSize(int64(len(content))), len(encrypted))
+	ok, err := EncryptedWith(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, bytes.Contains(encrypted, content[:100]))
+
+	d, err := NewDecrypter(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(content), d.Size())
+	plain, err := ioutil.ReadAll(d)
+	assert.NoError(t, err)
+	assert.Equal(t, content, plain)
+
+	// Range requests
+	buf := make([]byte, 100)
+	off := int64(cryptChunkSize - 50)
+	n, err := d.ReadAt(buf, off)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, content[off:off+100], buf)
+	pos, err := d.Seek(-10, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.EqualValues(t, len(content)-10, pos)
+	rest, err := ioutil.ReadAll(d)
+	assert.NoError(t, err)
+	assert.Equal(t, content[len(content)-10:], rest)
+
+	// An empty content
+	empty := encrypt(t, key, nil)
+	d, err = NewDecrypter(bytes.NewReader(empty), int64(len(empty)), key)
+	assert.NoError(t, err)
+	plain, err = ioutil.ReadAll(d)
+	assert.NoError(t, err)
+	assert.Len(t, plain, 0)
+}
+
+func TestDecryptInvalid(t *testing.T) {
+	key, _ := keymgmt.GenerateSecretKey()
+	other, _ := keymgmt.GenerateSecretKey()
+	content := bytes.Repeat([]byte("cozy"), cryptChunkSize)
+	encrypted := encrypt(t, key, content)
+
+	// Clear content
+	_, err := NewDecrypter(bytes.NewReader(content), int64(len(content)), key)
+	assert.Equal(t, ErrNotEncrypted, err)
+
+	// Wrong key
+	d, err := NewDecrypter(bytes.NewReader(encrypted), int64(len(encrypted)), other)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(d)
+	assert.Equal(t, ErrInvalidEncryptedContent, err)
+
+	// Truncated on a chunk boundary
+	truncated := encrypted[:cryptHeaderSize+cryptSealedChunkSize]
+	d, err = NewDecrypter(bytes.NewReader(truncated), int64(len(truncated)), key)
+	assert.NoError(t, err)
+	_, err = ioutil.ReadAll(d)
+	assert.Equal(t, ErrInvalidEncryptedContent, err)
+}
+
+func TestEncryptedWith(t *testing.T) {
+	key, _ := keymgmt.GenerateSecretKey()
+	other, _ := keymgmt.GenerateSecretKey()
+
+	// A clear content that starts like an encrypted one
+	clear := append([]byte(cryptMagic), bytes.Repeat([]byte("cozy"), 100)...)
+	ok, err := EncryptedWith(bytes.NewReader(clear), int64(len(clear)), key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A content encrypted with another key
+	encrypted := encrypt(t, other, []byte("foo"))
+	ok, err = EncryptedWith(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A short content
+	ok, err = EncryptedWith(bytes.NewReader([]byte("foo")), 3, key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDecrypterConcurrentReadAt(t *testing.T) {
+	key, _ := keymgmt.GenerateSecretKey()
+	content := make([]byte, 4*cryptChunkSize)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	encrypted := encrypt(t, key, content)
+	d, err := NewDecrypter(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, 1000)
+			off := int64(i) * cryptChunkSize / 2
+			n, err := d.ReadAt(buf, off)
+			assert.NoError(t, err)
+			assert.Equal(t, content[off:off+int64(n)], buf[:n])
+		}(i)
+	}
+	wg.Wait()
+}
@@ -36,8 +36,14 @@ var (
 	// ErrDirNotEmpty is used to inform that the directory is not
 	// empty
 	ErrDirNotEmpty = errors.New("Directory is not empty")
+	// ErrBlobMismatch is used when a content has the same md5sum and size as
+	// a blob, but not the same sha256: it can't be deduplicated with it
+	ErrBlobMismatch = errors.New("The content does not match the blob with the same md5sum")
 	// ErrWrongCouchdbState is given when couchdb gives us an unexpected value
 	ErrWrongCouchdbState = errors.New("Wrong couchdb reduce value")
 	// ErrFileTooBig is used when there is no more space left on the filesystem
 	ErrFileTooBig = errors.New("The file is too big and exceeds the disk quota")
+	// ErrImportNotSupported is used when the contents of the files can't be
+	// moved to the storage of an instance
+	ErrImportNotSupported = errors.New("The import of the contents is not supported by this storage")
 )
@@ -40,6 +40,9 @@ type FileDoc struct {
 	Executable bool     `json:"executable"`
 	Trashed    bool     `json:"trashed"`
 	Tags       []string `json:"tags"`
+	// Encrypted is true if the content has been encrypted with the key of
+	// the instance
+	Encrypted bool `json:"encrypted,omitempty"`
 
 	Metadata Metadata `json:"metadata,omitempty"`
 
@@ -26,6 +26,12 @@ const (
 	// ContentMismatch is used when a document content checksum does not match
 	// with the one in the underlying fs.
 	ContentMismatch FsckLogType = "content_mismatch"
+	// BlobMissing is used when the content of a deduplicated blob is missing
+	// from the underlying fs.
+	BlobMissing FsckLogType = "blob_missing"
+	// BlobDanglingRef is used when a blob is referenced by a file that does not
+	// exist or that has another content.
+	BlobDanglingRef FsckLogType = "blob_dangling_ref"
 )
 
 // FsckLog is a struct for an inconsistency in the VFS
@@ -36,6 +42,8 @@ type FsckLog struct {
 	IsFile           bool                 `json:"is_file"`
 	ContentMismatch  *FsckContentMismatch `json:"content_mismatch,omitempty"`
 	ExpectedFullpath string               `json:"expected_fullpath,omitempty"`
+	Blob             *Blob                `json:"blob,omitempty"`
+	FileID           string               `json:"file_id,omitempty"`
 }
 
 // String returns a string describing the FsckLog
@@ -64,6 +72,10 @@ func (f *FsckLog) String() string {
 		return "the document is present on the local filesystem but not in the index"
 	case ContentMismatch:
 		return "the document content does not match the store content checksum"
+	case BlobMissing:
+		return "the content of the blob is not present on the filesystem"
+	case BlobDanglingRef:
+		return "the blob is referenced by a file that does not exist or has another content"
 	}
 	panic("bad FsckLog type")
 }
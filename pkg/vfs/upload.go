@@ -0,0 +1,460 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+)
+
+// UploadsDirName is the path of the directory used by the afero VFS to store
+// the chunks of the resumable uploads.
+const UploadsDirName = "/.cozy_uploads"
+
+// UploadSessionTTL is the duration after which an upload session that has not
+// been completed is considered as stale, and can be removed.
+const UploadSessionTTL = 24 * time.Hour
+
+// MaxUploadChunks is the maximal number of chunks for an upload session.
+const MaxUploadChunks = 10000
+
+// maxUploadSessions is the maximal number of upload sessions fetched in a
+// single request.
+const maxUploadSessions = 1000
+
+// maxChunkConflicts is the number of times we retry to save an upload session
+// when chunks are sent in parallel.
+const maxChunkConflicts = 10
+
+var (
+	// ErrUploadSessionNotFound is used when an upload session does not exist,
+	// or has expired.
+	ErrUploadSessionNotFound = errors.New("Upload session not found")
+	// ErrInvalidChunkIndex is used when the index of a chunk is out of the
+	// bounds.
+	ErrInvalidChunkIndex = errors.New("Invalid chunk index")
+	// ErrUploadIncomplete is used when an upload session is completed, but
+	// some chunks are missing.
+	ErrUploadIncomplete = errors.New("Some chunks of the upload are missing")
+	// ErrUploadCompleting is used when a chunk is sent for an upload session
+	// whose file is being assembled.
+	ErrUploadCompleting = errors.New("The upload session is being completed")
+)
+
+// UploadChunk is the metadata of a chunk that has been received for an upload
+// session.
+type UploadChunk struct {
+	Index     int    `json:"index"`
+	Size      int64  `json:"size,string"`
+	MD5Sum    []byte `json:"md5sum"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// UploadSession is used to upload a file in several requests. The client sends
+// the chunks of the file, in any order, and can resume the upload by looking
+// at the chunks that were already received. When all the chunks are there,
+// the file is assembled and written in the VFS.
+type UploadSession struct {
+	DocID      string        `json:"_id,omitempty"`
+	DocRev     string        `json:"_rev,omitempty"`
+	DirID      string        `json:"dir_id"`
+	Name       string        `json:"name"`
+	FileID     string        `json:"file_id,omitempty"`
+	ByteSize   int64         `json:"size,string"`
+	MD5Sum     []byte        `json:"md5sum,omitempty"`
+	Mime       string        `json:"mime"`
+	Class      string        `json:"class"`
+	Executable bool          `json:"executable"`
+	Tags       []string      `json:"tags"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ExpiresAt  time.Time     `json:"expires_at"`
+	Chunks     []UploadChunk `json:"chunks"`
+	// Completing is true while the file is assembled: the space reserved by
+	// the session is then released, as it is taken by the file itself
+	Completing bool `json:"completing,omitempty"`
+}
+
+// ID returns the upload session identifier
+func (s *UploadSession) ID() string { return s.DocID }
+
+// Rev returns the upload session revision
+func (s *UploadSession) Rev() string { return s.DocRev }
+
+// DocType returns the upload session document type
+func (s *UploadSession) DocType() string { return consts.FilesUploads }
+
+// Clone implements couchdb.Doc
+func (s *UploadSession) Clone() couchdb.Doc {
+	cloned := *s
+	cloned.MD5Sum = make([]byte, len(s.MD5Sum))
+	copy(cloned.MD5Sum, s.MD5Sum)
+	cloned.Tags = make([]string, len(s.Tags))
+	copy(cloned.Tags, s.Tags)
+	cloned.Chunks = make([]UploadChunk, len(s.Chunks))
+	copy(cloned.Chunks, s.Chunks)
+	return &cloned
+}
+
+// SetID changes the upload session qualified identifier
+func (s *UploadSession) SetID(id string) { s.DocID = id }
+
+// SetRev changes the upload session revision
+func (s *UploadSession) SetRev(rev string) { s.DocRev = rev }
+
+// Expired returns true if the upload session is stale.
+func (s *UploadSession) Expired() bool {
+	return s.ExpiresAt.Before(time.Now())
+}
+
+// ReceivedSize returns the number of bytes received for this session.
+func (s *UploadSession) ReceivedSize() int64 {
+	var size int64
+	for _, chunk := range s.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
+
+// NewUploadSession creates an upload session for the given file document.
+// The size of the file must be known, as the space is reserved on the disk
+// quota for the whole duration of the session. If olddoc is not nil, the
+// upload will overwrite the content of this file. The reserved space is always
+// the full size of the new content, even when a file is overwritten, as the
+// old content is still on the disk until the session is completed: it is the
+// same definition as in the view used by UploadsReservedSize.
+func NewUploadSession(fs VFS, doc, olddoc *FileDoc) (*UploadSession, error) {
+	if doc.ByteSize < 0 {
+		return nil, ErrContentLengthMismatch
+	}
+	if err := checkFileName(doc.DocName); err != nil {
+		return nil, err
+	}
+	if _, err := fs.DirByID(doc.DirID); err != nil {
+		return nil, err
+	}
+
+	if err := CleanStaleUploadSessions(fs); err != nil {
+		return nil, err
+	}
+	// The disk usage includes the space reserved by the other sessions
+	if quota := fs.DiskQuota(); quota > 0 {
+		used, err := fs.DiskUsage()
+		if err != nil {
+			return nil, err
+		}
+		if used+doc.ByteSize > quota {
+			return nil, ErrFileTooBig
+		}
+	}
+
+	now := time.Now().UTC()
+	s := &UploadSession{
+		DirID:      doc.DirID,
+		Name:       doc.DocName,
+		ByteSize:   doc.ByteSize,
+		MD5Sum:     doc.MD5Sum,
+		Mime:       doc.Mime,
+		Class:      doc.Class,
+		Executable: doc.Executable,
+		Tags:       doc.Tags,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(UploadSessionTTL),
+		Chunks:     []UploadChunk{},
+	}
+	if olddoc != nil {
+		s.FileID = olddoc.ID()
+	}
+	if err := couchdb.CreateDoc(fs, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// GetUploadSession returns the upload session with the given identifier. An
+// expired session is not returned.
+func GetUploadSession(db prefixer.Prefixer, id string) (*UploadSession, error) {
+	var s UploadSession
+	err := couchdb.GetDoc(db, consts.FilesUploads, id, &s)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrUploadSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Expired() {
+		return nil, ErrUploadSessionNotFound
+	}
+	return &s, nil
+}
+
+// UploadsReservedSize returns the space reserved on the disk quota by the
+// upload sessions that have not expired.
+func UploadsReservedSize(db prefixer.Prefixer) (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.UploadsDiskUsageView, &couchdb.ViewRequest{
+		StartKey: time.Now().UTC(),
+		Reduce:   true,
+	}, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(f64), nil
+}
+
+// CleanStaleUploadSessions removes the upload sessions that have expired,
+// with their chunks.
+func CleanStaleUploadSessions(fs VFS) error {
+	var sessions []*UploadSession
+	req := &couchdb.AllDocsRequest{Limit: maxUploadSessions}
+	err := couchdb.GetAllDocs(fs, consts.FilesUploads, req, &sessions)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if !s.Expired() {
+			continue
+		}
+		if err := s.Abort(fs); err != nil {
+			logger.WithDomain(fs.DomainName()).WithField("nspace", "vfs").
+				Warnf("Could not remove the stale upload session %s: %s", s.ID(), err)
+		}
+	}
+	return nil
+}
+
+// PutChunk stores a chunk of the file. If md5sum is not nil, it is checked
+// against the content of the chunk. A chunk can be sent again, and the new
+// content replaces the old one.
+func (s *UploadSession) PutChunk(fs VFS, index int, md5sum []byte, content io.Reader) error {
+	if index < 0 || index >= MaxUploadChunks {
+		return ErrInvalidChunkIndex
+	}
+	// The chunks can't be replaced while the file is assembled
+	if s.Completing {
+		return ErrUploadCompleting
+	}
+
+	// The chunk can't be larger than what is left to receive: we read at most
+	// one byte more to detect the chunks that are too big
+	limit := s.ByteSize - s.ReceivedSize()
+	for _, chunk := range s.Chunks {
+		if chunk.Index == index {
+			limit += chunk.Size
+		}
+	}
+	h := md5.New() // #nosec
+	size, encrypted, err := fs.PutUploadChunk(s.ID(), index, io.TeeReader(io.LimitReader(content, limit+1), h))
+	if err != nil {
+		return err
+	}
+	sum := h.Sum(nil)
+
+	// When the chunk is invalid, its content has still replaced the previous
+	// chunk with the same index, if any, so this chunk is removed and must be
+	// sent again.
+	valid := md5sum == nil || bytes.Equal(md5sum, sum)
+	var tooBig, completing bool
+	err = s.updateChunks(fs, func() {
+		// The session may have been reloaded after the start of the assembly
+		if completing = s.Completing; completing {
+			return
+		}
+		s.removeChunk(index)
+		tooBig = s.ReceivedSize()+size > s.ByteSize
+		if valid && !tooBig {
+			s.Chunks = append(s.Chunks, UploadChunk{
+				Index:     index,
+				Size:      size,
+				MD5Sum:    sum,
+				Encrypted: encrypted,
+			})
+			sort.Slice(s.Chunks, func(i, j int) bool {
+				return s.Chunks[i].Index < s.Chunks[j].Index
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if completing {
+		return ErrUploadCompleting
+	}
+	if !valid || tooBig {
+		if err = fs.DeleteUploadChunk(s.ID(), index); err != nil {
+			logger.WithDomain(fs.DomainName()).WithField("nspace", "vfs").
+				Warnf("Could not remove the rejected chunk %d of %s: %s", index, s.ID(), err)
+		}
+	}
+	if !valid {
+		return ErrInvalidHash
+	}
+	if tooBig {
+		return ErrContentLengthMismatch
+	}
+	return nil
+}
+
+// updateChunks applies fn to the session, and saves it. If the session has
+// been modified in parallel, it is reloaded and fn is applied again.
+func (s *UploadSession) updateChunks(fs VFS, fn func()) error {
+	var err error
+	for i := 0; i < maxChunkConflicts; i++ {
+		fn()
+		err = couchdb.UpdateDoc(fs, s)
+		if !couchdb.IsConflictError(err) {
+			return err
+		}
+		var fresh *UploadSession
+		if fresh, err = GetUploadSession(fs, s.ID()); err != nil {
+			return err
+		}
+		*s = *fresh
+	}
+	return err
+}
+
+func (s *UploadSession) removeChunk(index int) {
+	chunks := s.Chunks[:0]
+	for _, c := range s.Chunks {
+		if c.Index != index {
+			chunks = append(chunks, c)
+		}
+	}
+	s.Chunks = chunks
+}
+
+// FileDoc returns the document of the file that will be written when the
+// upload session is completed. It can be used to check the permissions.
+func (s *UploadSession) FileDoc() (*FileDoc, error) {
+	doc, err := NewFileDoc(s.Name, s.DirID, s.ByteSize, s.MD5Sum, s.Mime,
+		s.Class, s.CreatedAt, s.Executable, false, s.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if s.FileID != "" {
+		doc.SetID(s.FileID)
+	}
+	return doc, nil
+}
+
+// checkComplete returns an error if some chunks are missing.
+func (s *UploadSession) checkComplete() error {
+	for i, chunk := range s.Chunks {
+		if chunk.Index != i {
+			return ErrUploadIncomplete
+		}
+	}
+	if s.ReceivedSize() != s.ByteSize {
+		return ErrUploadIncomplete
+	}
+	return nil
+}
+
+// Complete assembles the chunks to write the file in the VFS, and removes the
+// upload session.
+func (s *UploadSession) Complete(fs VFS) (*FileDoc, error) {
+	if err := s.checkComplete(); err != nil {
+		return nil, err
+	}
+
+	// The space reserved by the session is released, so that it is not
+	// counted twice when the quota is checked for the new file
+	if err := s.updateChunks(fs, func() { s.Completing = true }); err != nil {
+		return nil, err
+	}
+	newdoc, err := s.assemble(fs)
+	if err != nil {
+		if uerr := s.updateChunks(fs, func() { s.Completing = false }); uerr != nil {
+			logger.WithDomain(fs.DomainName()).WithField("nspace", "vfs").
+				Warnf("Could not restore the upload session %s: %s", s.ID(), uerr)
+		}
+		return nil, err
+	}
+
+	if err = s.Abort(fs); err != nil {
+		logger.WithDomain(fs.DomainName()).WithField("nspace", "vfs").
+			Warnf("Could not remove the upload session %s: %s", s.ID(), err)
+	}
+	return newdoc, nil
+}
+
+func (s *UploadSession) assemble(fs VFS) (*FileDoc, error) {
+	// The session may have been reloaded with new chunks
+	if err := s.checkComplete(); err != nil {
+		return nil, err
+	}
+
+	var olddoc *FileDoc
+	if s.FileID != "" {
+		var err error
+		if olddoc, err = fs.FileByID(s.FileID); err != nil {
+			return nil, err
+		}
+	}
+	newdoc, err := s.FileDoc()
+	if err != nil {
+		return nil, err
+	}
+	newdoc.UpdatedAt = time.Now()
+	if olddoc != nil {
+		newdoc.CreatedAt = olddoc.CreatedAt
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range s.Chunks {
+		if err = copyChunk(fs, s.ID(), chunk, file); err != nil {
+			break
+		}
+	}
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+func copyChunk(fs VFS, sessionID string, chunk UploadChunk, dst io.Writer) error {
+	content, err := fs.OpenUploadChunk(sessionID, chunk.Index, chunk.Encrypted)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	_, err = io.Copy(dst, content)
+	return err
+}
+
+// Abort removes the chunks and the document of the upload session.
+func (s *UploadSession) Abort(fs VFS) error {
+	if err := fs.DeleteUploadChunks(s.ID()); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(fs, s)
+}
+
+var _ couchdb.Doc = &UploadSession{}
@@ -0,0 +1,46 @@
+package vfs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSessionChunks(t *testing.T) {
+	s := &UploadSession{
+		ByteSize:  10,
+		ExpiresAt: time.Now().Add(UploadSessionTTL),
+		Chunks: []UploadChunk{
+			{Index: 0, Size: 4},
+			{Index: 2, Size: 2},
+		},
+	}
+	assert.False(t, s.Expired())
+	assert.Equal(t, int64(6), s.ReceivedSize())
+	assert.Equal(t, ErrUploadIncomplete, s.checkComplete())
+
+	s.Chunks = []UploadChunk{{Index: 0, Size: 4}, {Index: 1, Size: 4}, {Index: 2, Size: 2}}
+	assert.NoError(t, s.checkComplete())
+
+	s.removeChunk(1)
+	assert.Equal(t, []UploadChunk{{Index: 0, Size: 4}, {Index: 2, Size: 2}}, s.Chunks)
+	assert.Equal(t, ErrUploadIncomplete, s.checkComplete())
+
+	s.Chunks = []UploadChunk{{Index: 0, Size: 4}, {Index: 1, Size: 4}}
+	assert.Equal(t, ErrUploadIncomplete, s.checkComplete())
+
+	s.ExpiresAt = time.Now().Add(-1 * time.Minute)
+	assert.True(t, s.Expired())
+}
+
+func TestUploadSessionCompletingRefusesChunks(t *testing.T) {
+	s := &UploadSession{
+		ByteSize:   10,
+		ExpiresAt:  time.Now().Add(UploadSessionTTL),
+		Completing: true,
+	}
+	err := s.PutChunk(nil, 0, nil, strings.NewReader("0123456789"))
+	assert.Equal(t, ErrUploadCompleting, err)
+}
@@ -0,0 +1,334 @@
+package vfs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/utils"
+)
+
+// VersionsDirName is the path of the directory used by the afero VFS to store
+// the content of the old versions of the files.
+const VersionsDirName = "/.cozy_versions"
+
+// maxVersionsPerFile is the maximal number of versions of a file fetched in a
+// single request.
+const maxVersionsPerFile = 1000
+
+// ErrVersionNotFound is used when the version of a file cannot be found.
+var ErrVersionNotFound = errors.New("Version not found")
+
+// Version is used for storing the metadata about an old version of the
+// content of a file. Its identifier is composed of the identifier of the file,
+// a slash, and a random suffix.
+type Version struct {
+	DocID     string    `json:"_id,omitempty"`
+	DocRev    string    `json:"_rev,omitempty"`
+	FileID    string    `json:"file_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ByteSize  int64     `json:"size,string"`
+	MD5Sum    []byte    `json:"md5sum"`
+	Mime      string    `json:"mime"`
+	Class     string    `json:"class"`
+	Tags      []string  `json:"tags"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Metadata  Metadata  `json:"metadata,omitempty"`
+}
+
+// ID returns the version identifier
+func (v *Version) ID() string { return v.DocID }
+
+// Rev returns the version revision
+func (v *Version) Rev() string { return v.DocRev }
+
+// DocType returns the version document type
+func (v *Version) DocType() string { return consts.FilesVersions }
+
+// Clone implements couchdb.Doc
+func (v *Version) Clone() couchdb.Doc {
+	cloned := *v
+	cloned.MD5Sum = make([]byte, len(v.MD5Sum))
+	copy(cloned.MD5Sum, v.MD5Sum)
+	cloned.Tags = make([]string, len(v.Tags))
+	copy(cloned.Tags, v.Tags)
+	cloned.Metadata = copyMetadata(v.Metadata)
+	return &cloned
+}
+
+// SetID changes the version qualified identifier
+func (v *Version) SetID(id string) { v.DocID = id }
+
+// SetRev changes the version revision
+func (v *Version) SetRev(rev string) { v.DocRev = rev }
+
+// ShortID returns the part of the identifier of the version after the
+// identifier of the file.
+func (v *Version) ShortID() string {
+	return strings.TrimPrefix(v.DocID, v.FileID+"/")
+}
+
+// NewVersion returns a version document for the current content of the given
+// file, before it is overwritten.
+func NewVersion(file *FileDoc) *Version {
+	tags := make([]string, len(file.Tags))
+	copy(tags, file.Tags)
+	md5sum := make([]byte, len(file.MD5Sum))
+	copy(md5sum, file.MD5Sum)
+	return &Version{
+		DocID:     file.ID() + "/" + utils.RandomString(16),
+		FileID:    file.ID(),
+		UpdatedAt: file.UpdatedAt,
+		ByteSize:  file.ByteSize,
+		MD5Sum:    md5sum,
+		Mime:      file.Mime,
+		Class:     file.Class,
+		Tags:      tags,
+		Encrypted: file.Encrypted,
+		Metadata:  copyMetadata(file.Metadata),
+	}
+}
+
+// copyMetadata returns a deep copy of the metadata, so that the changes made
+// later on the metadata of the file are not reflected on its old versions.
+func copyMetadata(m Metadata) Metadata {
+	if m == nil {
+		return nil
+	}
+	cloned := make(Metadata, len(m))
+	for k, v := range m {
+		cloned[k] = copyMetadataValue(v)
+	}
+	return cloned
+}
+
+func copyMetadataValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case Metadata:
+		return copyMetadata(v)
+	case map[string]interface{}:
+		return map[string]interface{}(copyMetadata(v))
+	case []interface{}:
+		cloned := make([]interface{}, len(v))
+		for i, val := range v {
+			cloned[i] = copyMetadataValue(val)
+		}
+		return cloned
+	case []string:
+		cloned := make([]string, len(v))
+		copy(cloned, v)
+		return cloned
+	}
+	return v
+}
+
+// VersioningEnabled returns true if the old versions of the files should be
+// kept when their content is overwritten.
+func VersioningEnabled() bool {
+	return config.GetConfig().Fs.Versioning.MaxNumberToKeep > 0
+}
+
+// VersionsFor returns the list of the old versions of the given file, sorted
+// from the most recent to the oldest.
+func VersionsFor(db prefixer.Prefixer, fileID string) ([]*Version, error) {
+	var versions []*Version
+	req := &couchdb.FindRequest{
+		UseIndex: "by-file-id",
+		Selector: mango.Equal("file_id", fileID),
+		Sort: mango.SortBy{
+			{Field: "file_id", Direction: mango.Desc},
+			{Field: "updated_at", Direction: mango.Desc},
+		},
+		Limit: maxVersionsPerFile,
+	}
+	err := couchdb.FindDocs(db, consts.FilesVersions, req, &versions)
+	if couchdb.IsNoDatabaseError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// FindVersion returns the version of the given file with the given short
+// identifier.
+func FindVersion(db prefixer.Prefixer, fileID, shortID string) (*Version, error) {
+	var version Version
+	err := couchdb.GetDoc(db, consts.FilesVersions, fileID+"/"+shortID, &version)
+	if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+		return nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// VersionsDiskUsage computes the total size of the old versions of the files.
+func VersionsDiskUsage(db prefixer.Prefixer) (int64, error) {
+	var doc couchdb.ViewResponse
+	err := couchdb.ExecView(db, consts.VersionsDiskUsageView, &couchdb.ViewRequest{
+		Reduce: true,
+	}, &doc)
+	if couchdb.IsNoDatabaseError(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(doc.Rows) == 0 {
+		return 0, nil
+	}
+	f64, ok := doc.Rows[0].Value.(float64)
+	if !ok {
+		return 0, ErrWrongCouchdbState
+	}
+	return int64(f64), nil
+}
+
+// DetectVersionsToClean returns the versions that should be removed to respect
+// the retention policy: at most maxNumber versions are kept, and the versions
+// older than maxAge are removed. A zero maxAge means no limit on the age.
+func DetectVersionsToClean(versions []*Version, maxNumber int, maxAge time.Duration, now time.Time) []*Version {
+	sorted := make([]*Version, len(versions))
+	copy(sorted, versions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].UpdatedAt.After(sorted[j].UpdatedAt)
+	})
+	var toClean []*Version
+	for i, v := range sorted {
+		if i >= maxNumber || (maxAge > 0 && now.Sub(v.UpdatedAt) > maxAge) {
+			toClean = append(toClean, v)
+		}
+	}
+	return toClean
+}
+
+// CleanOldVersions removes the old versions of the given file that are not
+// kept by the retention policy.
+func CleanOldVersions(fs VFS, fileID string) error {
+	versions, err := VersionsFor(fs, fileID)
+	if err != nil {
+		return err
+	}
+	policy := config.GetConfig().Fs.Versioning
+	toClean := DetectVersionsToClean(versions, policy.MaxNumberToKeep, policy.MaxAge, time.Now())
+	for _, v := range toClean {
+		if err = fs.CleanOldVersion(fileID, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RevertFileVersion replaces the content of the file by the content of the
+// given version. The current content is itself kept as a new version, and the
+// restored version is removed from the list of the old versions.
+func RevertFileVersion(fs VFS, olddoc *FileDoc, version *Version) (*FileDoc, error) {
+	if version.FileID != olddoc.ID() {
+		return nil, ErrVersionNotFound
+	}
+	content, err := fs.OpenFileVersion(olddoc, version)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	newdoc := olddoc.Clone().(*FileDoc)
+	newdoc.ByteSize = version.ByteSize
+	newdoc.MD5Sum = version.MD5Sum
+	newdoc.Mime = version.Mime
+	newdoc.Class = version.Class
+	newdoc.UpdatedAt = time.Now()
+	if newdoc.UpdatedAt.Before(newdoc.CreatedAt) {
+		newdoc.UpdatedAt = newdoc.CreatedAt
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = fs.CleanOldVersion(olddoc.ID(), version); err != nil {
+		logger.WithDomain(fs.DomainName()).WithField("nspace", "vfs").
+			Warnf("Could not remove the restored version %s: %s", version.ID(), err)
+	}
+	return newdoc, nil
+}
+
+// ServeFileVersionContent replies to a http request with the content of an
+// old version of a file.
+func ServeFileVersionContent(fs VFS, doc *FileDoc, version *Version, disposition string, req *http.Request, w http.ResponseWriter) error {
+	header := w.Header()
+	header.Set("Content-Type", version.Mime)
+	if disposition != "" {
+		header.Set("Content-Disposition", ContentDisposition(disposition, doc.DocName))
+	}
+
+	if header.Get("Range") == "" {
+		eTag := base64.StdEncoding.EncodeToString(version.MD5Sum)
+		header.Set("Etag", fmt.Sprintf(`"%s"`, eTag))
+	}
+
+	content, err := fs.OpenFileVersion(doc, version)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	http.ServeContent(w, req, doc.DocName, version.UpdatedAt, content)
+	return nil
+}
+
+// DeleteVersionsDocs removes the documents of the given versions from
+// CouchDB.
+func DeleteVersionsDocs(db prefixer.Prefixer, versions []*Version) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	docs := make([]couchdb.Doc, len(versions))
+	for i, v := range versions {
+		docs[i] = v
+	}
+	return couchdb.BulkDeleteDocs(db, consts.FilesVersions, docs)
+}
+
+// DestroyVersions removes the old versions of the given files, that have
+// been destroyed: their contents are removed from the storage by the remove
+// function of the VFS, and then their documents are deleted. The errors are
+// only logged, as the files themselves have already been destroyed.
+func DestroyVersions(db prefixer.Prefixer, fileIDs []string, remove func(fileID string, versions []*Version) error) {
+	for _, fileID := range fileIDs {
+		versions, err := VersionsFor(db, fileID)
+		if err == nil && len(versions) > 0 {
+			if err = remove(fileID, versions); err == nil {
+				err = DeleteVersionsDocs(db, versions)
+			}
+		}
+		if err != nil {
+			logger.WithDomain(db.DomainName()).WithField("nspace", "vfs").
+				Warnf("Could not destroy the versions of %s: %s", fileID, err)
+		}
+	}
+}
+
+var _ couchdb.Doc = &Version{}
@@ -0,0 +1,62 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectVersionsToClean(t *testing.T) {
+	now := time.Now()
+	v1 := &Version{DocID: "file/1", FileID: "file", UpdatedAt: now.Add(-1 * time.Hour)}
+	v2 := &Version{DocID: "file/2", FileID: "file", UpdatedAt: now.Add(-2 * time.Hour)}
+	v3 := &Version{DocID: "file/3", FileID: "file", UpdatedAt: now.Add(-72 * time.Hour)}
+	versions := []*Version{v3, v1, v2}
+
+	toClean := DetectVersionsToClean(versions, 5, 0, now)
+	assert.Len(t, toClean, 0)
+
+	toClean = DetectVersionsToClean(versions, 2, 0, now)
+	assert.Equal(t, []*Version{v3}, toClean)
+
+	toClean = DetectVersionsToClean(versions, 1, 0, now)
+	assert.Equal(t, []*Version{v2, v3}, toClean)
+
+	toClean = DetectVersionsToClean(versions, 5, 24*time.Hour, now)
+	assert.Equal(t, []*Version{v3}, toClean)
+
+	toClean = DetectVersionsToClean(versions, 1, 90*time.Minute, now)
+	assert.Equal(t, []*Version{v2, v3}, toClean)
+
+	assert.Equal(t, "1", v1.ShortID())
+}
+
+func TestNewVersionCopiesMetadata(t *testing.T) {
+	file := &FileDoc{
+		DocID:  "file",
+		MD5Sum: []byte("md5"),
+		Tags:   []string{"foo"},
+		Metadata: Metadata{
+			"datetime": "2018-05-07T10:32:15Z",
+			"gps": map[string]interface{}{
+				"lat":  48.85,
+				"long": 2.35,
+			},
+			"keywords": []interface{}{"bar"},
+		},
+	}
+	version := NewVersion(file)
+
+	file.MD5Sum[0] = 'x'
+	file.Tags[0] = "baz"
+	file.Metadata["datetime"] = "2019-01-01T00:00:00Z"
+	file.Metadata["gps"].(map[string]interface{})["lat"] = 0.0
+	file.Metadata["keywords"].([]interface{})[0] = "qux"
+
+	assert.Equal(t, []byte("md5"), version.MD5Sum)
+	assert.Equal(t, []string{"foo"}, version.Tags)
+	assert.Equal(t, "2018-05-07T10:32:15Z", version.Metadata["datetime"])
+	assert.Equal(t, 48.85, version.Metadata["gps"].(map[string]interface{})["lat"])
+	assert.Equal(t, []interface{}{"bar"}, version.Metadata["keywords"])
+}
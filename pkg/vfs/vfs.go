@@ -86,6 +86,39 @@ type Fs interface {
 	// DestroyFile  destroys a file from the trash.
 	DestroyFile(doc *FileDoc) error
 
+	// OpenFileVersion returns a file handler for reading the content of an old
+	// version of the given file.
+	OpenFileVersion(doc *FileDoc, version *Version) (File, error)
+	// CleanOldVersion deletes an old version of a file, both its content and
+	// its document.
+	CleanOldVersion(fileID string, version *Version) error
+
+	// PutUploadChunk stores a chunk of a resumable upload session, and returns
+	// its size and true if it has been encrypted. If the chunk already exists,
+	// it is replaced.
+	PutUploadChunk(sessionID string, index int, content io.Reader) (int64, bool, error)
+	// OpenUploadChunk returns a reader for a chunk of an upload session. The
+	// content is decrypted if encrypted is true.
+	OpenUploadChunk(sessionID string, index int, encrypted bool) (io.ReadCloser, error)
+	// DeleteUploadChunk removes a chunk of an upload session. It is not an
+	// error if the chunk doesn't exist.
+	DeleteUploadChunk(sessionID string, index int) error
+	// DeleteUploadChunks removes all the chunks of an upload session.
+	DeleteUploadChunks(sessionID string) error
+
+	// EncryptContents encrypts the contents that have been written in clear
+	// before the encryption was enabled for the instance, and sets the
+	// encrypted flag on their documents.
+	EncryptContents() error
+
+	// ImportDir and ImportFileContent are used to move the files of an
+	// instance from another storage, without changing the index. ImportDir
+	// creates a directory if the storage needs it, and ImportFileContent
+	// writes the content of a file, or of one of its old versions if version
+	// is not nil.
+	ImportDir(doc *DirDoc) error
+	ImportFileContent(doc *FileDoc, version *Version, content io.Reader) error
+
 	// Fsck return the list of inconsistencies in the VFS
 	Fsck(func(log *FsckLog)) (err error)
 }
@@ -261,6 +294,7 @@ type DirOrFileDoc struct {
 	Class      string   `json:"class,omitempty"`
 	Executable bool     `json:"executable,omitempty"`
 	Trashed    bool     `json:"trashed,omitempty"`
+	Encrypted  bool     `json:"encrypted,omitempty"`
 	Metadata   Metadata `json:"metadata,omitempty"`
 }
 
@@ -292,6 +326,7 @@ func (fd *DirOrFileDoc) Refine() (*DirDoc, *FileDoc) {
 			Executable:   fd.Executable,
 			Trashed:      fd.Trashed,
 			Tags:         fd.Tags,
+			Encrypted:    fd.Encrypted,
 			Metadata:     fd.Metadata,
 			ReferencedBy: fd.ReferencedBy,
 		}
@@ -689,6 +724,48 @@ func DiskQuotaAfterDestroy(fs VFS, diskUsageBeforeWrite, destroyed int64) {
 	}
 }
 
+// CheckAvailableDiskSpace checks that the new content of a file can be
+// written without exceeding the disk quota, nor maxFileSize, the maximal size
+// of a content for the storage, if it is not negative. It returns the maximal
+// size for the new content, or -1 if there is no limit, the size from which
+// the disk quota alert must be sent, or 0, and if the old content, if any, can
+// be kept as a version.
+func CheckAvailableDiskSpace(fs VFS, newdoc, olddoc *FileDoc, maxFileSize int64) (maxsize, capsize int64, keepVersion bool, err error) {
+	newsize := newdoc.ByteSize
+	keepVersion = olddoc != nil && VersioningEnabled()
+	maxsize = maxFileSize
+
+	var oldsize int64
+	diskQuota := fs.DiskQuota()
+	if diskQuota > 0 {
+		diskUsage, err := fs.DiskUsage()
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if olddoc != nil {
+			oldsize = olddoc.Size()
+		}
+		maxsize = diskQuota - diskUsage
+		if maxFileSize >= 0 && maxsize > maxFileSize {
+			maxsize = maxFileSize
+		}
+		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
+			capsize = quotaBytes - diskUsage
+		}
+		// The old content is not kept as a version if it would exceed the quota
+		if newsize < 0 || newsize > maxsize {
+			keepVersion = false
+		}
+	} else if maxFileSize < 0 {
+		return -1, 0, keepVersion, nil
+	}
+
+	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
+		return 0, 0, false, ErrFileTooBig
+	}
+	return maxsize, capsize, keepVersion, nil
+}
+
 // getRestoreDir returns the restoration directory document from a file a
 // directory path. The specified file path should be part of the trash
 // directory.
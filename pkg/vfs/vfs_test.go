@@ -3,6 +3,7 @@ package vfs_test
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/md5"
 	"errors"
 	"fmt"
 	"io"
@@ -24,7 +25,10 @@ import (
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsafero"
+	"github.com/cozy/cozy-stack/pkg/vfs/vfss3"
 	"github.com/cozy/cozy-stack/pkg/vfs/vfsswift"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
 	"github.com/ncw/swift/swifttest"
 	"github.com/stretchr/testify/assert"
 )
@@ -32,6 +36,10 @@ import (
 var fs vfs.VFS
 var diskQuota int64
 
+// dedupSupported is true when the tested storage can deduplicate the contents
+// of the files (the layout v1 of swift can't).
+var dedupSupported bool
+
 type diskImpl struct{}
 
 func (d *diskImpl) DiskQuota() int64 {
@@ -764,6 +772,191 @@ func TestCreateFileTooBig(t *testing.T) {
 	assert.NoError(t, fs.DestroyDirContent(root))
 }
 
+func TestUploadSessionChunkTooBig(t *testing.T) {
+	used, err := fs.DiskUsage()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	doc, err := vfs.NewFileDoc("uploaded", consts.RootDirID, 10, nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	session, err := vfs.NewUploadSession(fs, doc, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer session.Abort(fs)
+
+	// The size of the session is reserved on the disk usage
+	reserved, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, used+10, reserved)
+
+	err = session.PutChunk(fs, 0, nil, strings.NewReader("123456"))
+	assert.NoError(t, err)
+
+	// This chunk would exceed the size of the file
+	err = session.PutChunk(fs, 1, nil, strings.NewReader("7890123"))
+	assert.Equal(t, vfs.ErrContentLengthMismatch, err)
+	_, err = fs.OpenUploadChunk(session.ID(), 1, false)
+	assert.Error(t, err)
+
+	// A chunk with a bad checksum is removed too
+	err = session.PutChunk(fs, 1, []byte("bad md5"), strings.NewReader("7890"))
+	assert.Equal(t, vfs.ErrInvalidHash, err)
+	_, err = fs.OpenUploadChunk(session.ID(), 1, false)
+	assert.Error(t, err)
+
+	// The first chunk can be replaced by a bigger one
+	err = session.PutChunk(fs, 0, nil, strings.NewReader("1234567890"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), session.ReceivedSize())
+
+	file, err := session.Complete(fs)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, int64(10), file.ByteSize)
+	f, err := fs.OpenFile(file)
+	if assert.NoError(t, err) {
+		content, err := ioutil.ReadAll(f)
+		assert.NoError(t, err)
+		assert.Equal(t, "1234567890", string(content))
+		assert.NoError(t, f.Close())
+	}
+
+	// The reservation is released when the session is completed
+	after, err := fs.DiskUsage()
+	assert.NoError(t, err)
+	assert.Equal(t, used+10, after)
+	assert.NoError(t, vfs.Remove(fs, "/uploaded"))
+}
+
+func createFileWithContent(name, content string) (*vfs.FileDoc, error) {
+	doc, err := vfs.NewFileDoc(name, consts.RootDirID, int64(len(content)), nil,
+		"text/plain", "text", time.Now(), false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	file, err := fs.CreateFile(doc, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.WriteString(file, content); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Close(); err != nil {
+		return nil, err
+	}
+	return fs.FileByID(doc.ID())
+}
+
+func readFileContent(doc *vfs.FileDoc) (string, error) {
+	file, err := fs.OpenFile(doc)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	b, err := ioutil.ReadAll(file)
+	return string(b), err
+}
+
+func TestDedupSameContent(t *testing.T) {
+	if !dedupSupported {
+		t.Skip("this storage does not deduplicate the contents")
+	}
+	config.GetConfig().Fs.Dedup = true
+	defer func() { config.GetConfig().Fs.Dedup = false }()
+
+	content := "the same content for two files"
+	doc1, err := createFileWithContent("dedup-1", content)
+	if !assert.NoError(t, err) {
+		return
+	}
+	doc2, err := createFileWithContent("dedup-2", content)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	blob, err := vfs.GetBlob(fs, vfs.BlobID(doc1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, blob.HasRef(doc1.ID()))
+	assert.True(t, blob.HasRef(doc2.ID()))
+	assert.NotEmpty(t, blob.SHA256)
+
+	for _, doc := range []*vfs.FileDoc{doc1, doc2} {
+		read, err := readFileContent(doc)
+		assert.NoError(t, err)
+		assert.Equal(t, content, read)
+	}
+
+	assert.NoError(t, fs.DestroyFile(doc1))
+	blob, err = vfs.GetBlob(fs, vfs.BlobID(doc2))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, blob.HasRef(doc1.ID()))
+	assert.True(t, blob.HasRef(doc2.ID()))
+	read, err := readFileContent(doc2)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+
+	assert.NoError(t, fs.DestroyFile(doc2))
+	_, err = vfs.GetBlob(fs, vfs.BlobID(doc2))
+	assert.True(t, couchdb.IsNotFoundError(err))
+}
+
+func TestDedupBlobMismatch(t *testing.T) {
+	if !dedupSupported {
+		t.Skip("this storage does not deduplicate the contents")
+	}
+	config.GetConfig().Fs.Dedup = true
+	defer func() { config.GetConfig().Fs.Dedup = false }()
+
+	// A blob with the same md5sum and size, but another sha256, must not be
+	// used for the content.
+	content := "a content with a crafted md5 collision"
+	md5sum := md5.Sum([]byte(content))
+	fake := &vfs.Blob{
+		ByteSize: int64(len(content)),
+		MD5Sum:   md5sum[:],
+		SHA256:   []byte("not the sha256 of the content"),
+		Refs:     []string{"another-file"},
+	}
+	fake.DocID = vfs.BlobID(&vfs.FileDoc{MD5Sum: fake.MD5Sum, ByteSize: fake.ByteSize})
+	if !assert.NoError(t, couchdb.CreateNamedDocWithDB(fs, fake)) {
+		return
+	}
+	defer couchdb.DeleteDoc(fs, fake)
+
+	doc, err := createFileWithContent("dedup-mismatch", content)
+	if !assert.NoError(t, err) {
+		return
+	}
+	blob, err := vfs.GetBlob(fs, fake.DocID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, blob.HasRef(doc.ID()))
+	assert.Equal(t, []string{"another-file"}, blob.Refs)
+
+	read, err := readFileContent(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, content, read)
+	assert.NoError(t, fs.DestroyFile(doc))
+
+	blob, err = vfs.GetBlob(fs, fake.DocID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"another-file"}, blob.Refs)
+		fake.SetRev(blob.Rev())
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 
@@ -774,6 +967,7 @@ func TestMain(m *testing.M) {
 	}
 
 	var rollback func()
+	dedupSupported = true
 	fs, rollback, err = makeAferoFS()
 	if err != nil {
 		fmt.Println(err)
@@ -790,6 +984,7 @@ func TestMain(m *testing.M) {
 	res2 := m.Run()
 	rollback()
 
+	dedupSupported = false
 	fs, rollback, err = makeSwiftFS(false)
 	if err != nil {
 		fmt.Println(err)
@@ -798,7 +993,16 @@ func TestMain(m *testing.M) {
 	res3 := m.Run()
 	rollback()
 
-	os.Exit(res1 + res2 + res3)
+	dedupSupported = true
+	fs, rollback, err = makeS3FS()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res4 := m.Run()
+	rollback()
+
+	os.Exit(res1 + res2 + res3 + res4)
 }
 
 func makeAferoFS() (vfs.VFS, func(), error) {
@@ -825,8 +1029,10 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	for _, doctype := range []string{consts.Files, consts.FilesVersions, consts.FilesUploads} {
+		if err = couchdb.DefineViews(db, consts.ViewsByDoctype(doctype)); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	err = aferoFs.InitFs()
@@ -837,6 +1043,9 @@ func makeAferoFS() (vfs.VFS, func(), error) {
 	return aferoFs, func() {
 		os.RemoveAll(tempdir)
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
 	}, nil
 }
 
@@ -860,10 +1069,10 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 	var swiftFs vfs.VFS
 	if layoutV2 {
 		swiftFs, err = vfsswift.NewV2(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swiftv2-test"))
+			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swiftv2-test"), config.GetSwiftConnection())
 	} else {
 		swiftFs, err = vfsswift.New(db,
-			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swift-test"))
+			index, &diskImpl{}, lock.ReadWrite(db, "vfs-swift-test"), config.GetSwiftConnection())
 	}
 	if err != nil {
 		return nil, nil, err
@@ -879,8 +1088,10 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 		return nil, nil, err
 	}
 
-	if err = couchdb.DefineViews(db, consts.ViewsByDoctype(consts.Files)); err != nil {
-		return nil, nil, err
+	for _, doctype := range []string{consts.Files, consts.FilesVersions, consts.FilesUploads} {
+		if err = couchdb.DefineViews(db, consts.ViewsByDoctype(doctype)); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	err = swiftFs.InitFs()
@@ -890,8 +1101,69 @@ func makeSwiftFS(layoutV2 bool) (vfs.VFS, func(), error) {
 
 	return swiftFs, func() {
 		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
 		if swiftSrv != nil {
 			swiftSrv.Close()
 		}
 	}, nil
 }
+
+func makeS3FS() (vfs.VFS, func(), error) {
+	db := prefixer.NewPrefixer("io.cozy.vfs.test", "io.cozy.vfs.test")
+	index := vfs.NewCouchdbIndexer(db)
+	s3Srv := httptest.NewServer(gofakes3.New(s3mem.New()).Server())
+
+	srvURL, err := url.Parse(s3Srv.URL)
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+	err = config.InitS3Client(&url.URL{
+		Scheme:   "s3",
+		Host:     srvURL.Host,
+		Path:     "/cozy-vfs-test",
+		RawQuery: "AccessKeyID=s3test&SecretAccessKey=s3test&Region=us-east-1&DisableSSL=true",
+	})
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, fmt.Errorf("failed to connect to the s3 server %s", err)
+	}
+
+	s3Fs, err := vfss3.New(db, index, &diskImpl{}, lock.ReadWrite(db, "vfs-s3-test"),
+		config.GetS3Client(), config.GetS3Bucket())
+	if err != nil {
+		s3Srv.Close()
+		return nil, nil, err
+	}
+
+	err = couchdb.ResetDB(db, consts.Files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = couchdb.DefineIndexes(db, consts.IndexesByDoctype(consts.Files))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, doctype := range []string{consts.Files, consts.FilesVersions, consts.FilesUploads} {
+		if err = couchdb.DefineViews(db, consts.ViewsByDoctype(doctype)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = s3Fs.InitFs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s3Fs, func() {
+		couchdb.DeleteDB(db, consts.Files)
+		couchdb.DeleteDB(db, consts.FilesVersions)
+		couchdb.DeleteDB(db, consts.FilesUploads)
+		couchdb.DeleteDB(db, consts.FilesBlobs)
+		s3Srv.Close()
+	}, nil
+}
@@ -0,0 +1,157 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+
+	"github.com/cozy/afero"
+)
+
+// The deduplicated contents are stored in the blobs directory, and the files
+// are hard links to them. It means that moving, renaming or reading a file
+// works the same way for a deduplicated file, and that a content is kept on
+// the disk as long as a file or an old version is linked to it, even if the
+// blob has been removed. It is only available for the file:// urls, as the
+// in-memory store does not support hard links.
+
+func (afs *aferoVFS) dedupEnabled() bool {
+	return afs.osFS && vfs.DedupEnabled()
+}
+
+func blobPath(blobID string) string {
+	return path.Join(vfs.BlobsDirName, blobID[:2], blobID)
+}
+
+func (afs *aferoVFS) realPath(name string) string {
+	return filepath.Join(afs.pth, filepath.FromSlash(name))
+}
+
+func (afs *aferoVFS) blobStored(b *vfs.Blob) (bool, error) {
+	_, err := afs.fs.Stat(blobPath(b.ID()))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// storeBlob replaces the content of the file at the given path by a hard link
+// to the blob with the same content, or makes this content a new blob, and
+// adds a reference from the file to the blob. The sha256 of the content must
+// be given, to check that the blob has the same content.
+func (afs *aferoVFS) storeBlob(name string, doc *vfs.FileDoc, sha256sum []byte) error {
+	blob := blobPath(vfs.BlobID(doc))
+	if err := afs.fs.MkdirAll(path.Dir(blob), 0755); err != nil {
+		return err
+	}
+	_, err := afs.fs.Stat(blob)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	stored := err == nil
+	if err = vfs.CheckBlobContent(afs, doc, sha256sum, stored); err != nil {
+		return err
+	}
+	if !stored {
+		err = os.Link(afs.realPath(name), afs.realPath(blob))
+	} else {
+		// The link is made on a temporary path and then renamed, to replace the
+		// content of the file atomically.
+		tmp := blob + "_" + doc.ID()
+		if err = os.Link(afs.realPath(blob), afs.realPath(tmp)); err != nil {
+			return err
+		}
+		if err = afs.fs.Rename(tmp, name); err != nil {
+			afs.fs.Remove(tmp) // #nosec
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return vfs.AddBlobRef(afs, doc, sha256sum)
+}
+
+// dedupContent is called when the content of a file, with the given sha256,
+// has been written at the given path. The errors are only logged, as a file
+// that is not deduplicated is still valid.
+func (afs *aferoVFS) dedupContent(name string, newdoc, olddoc *vfs.FileDoc, sha256sum []byte) {
+	stored := false
+	if afs.dedupEnabled() && !newdoc.Executable {
+		if err := afs.storeBlob(name, newdoc, sha256sum); err != nil {
+			logger.WithDomain(afs.domain).WithField("nspace", "vfsafero").
+				Warnf("Could not deduplicate the content of %s: %s", newdoc.ID(), err)
+		} else {
+			stored = true
+		}
+	}
+	if olddoc != nil {
+		vfs.ReleaseOldBlob(afs, olddoc, newdoc, stored, afs.removeBlobs)
+	}
+}
+
+// removeBlobs removes the contents of the blobs that are no longer
+// referenced.
+func (afs *aferoVFS) removeBlobs(blobs []*vfs.Blob) error {
+	for _, b := range blobs {
+		err := afs.fs.Remove(blobPath(b.ID()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unshareContent replaces the hard link to a blob by a copy of the content,
+// before changing the mode of a file, as the mode is shared by all the links.
+func (afs *aferoVFS) unshareContent(name string, doc *vfs.FileDoc) error {
+	blob := blobPath(vfs.BlobID(doc))
+	infoBlob, err := afs.fs.Stat(blob)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	infoFile, err := afs.fs.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(infoBlob, infoFile) {
+		return nil
+	}
+
+	tmp := blob + "_" + doc.ID()
+	if err = copyContent(afs.rawFs(), name, tmp); err != nil {
+		afs.fs.Remove(tmp) // #nosec
+		return err
+	}
+	if err = afs.fs.Rename(tmp, name); err != nil {
+		afs.fs.Remove(tmp) // #nosec
+		return err
+	}
+	vfs.ReleaseBlob(afs, doc, afs.removeBlobs)
+	return nil
+}
+
+// copyContent copies a content as it is stored, encrypted or not, so fs must
+// not be the cryptFs.
+func copyContent(fs afero.Fs, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
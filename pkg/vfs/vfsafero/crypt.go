@@ -0,0 +1,292 @@
+package vfsafero
+
+import (
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+
+	"github.com/cozy/afero"
+)
+
+// encryptingDirName is the directory used for the temporary files when the
+// contents of an instance are encrypted by the migration.
+const encryptingDirName = "/.cozy_encrypting"
+
+// cryptFs wraps the afero.Fs of an instance to encrypt the contents of the
+// files when they are written. The files are written sequentially, so only
+// the flags used by the VFS to create or overwrite a file are supported for
+// writing. The contents are read as they are stored: the VFS decrypts them
+// with decrypt when their documents have the encrypted flag.
+type cryptFs struct {
+	afero.Fs
+	key *keymgmt.SecretKey
+}
+
+func newCryptFs(fs afero.Fs, key *keymgmt.SecretKey) *cryptFs {
+	return &cryptFs{Fs: fs, key: key}
+}
+
+func (c *cryptFs) Create(name string) (afero.File, error) {
+	return c.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (c *cryptFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return c.Fs.OpenFile(name, flag, perm)
+	}
+	if flag&(os.O_RDWR|os.O_APPEND) != 0 ||
+		(flag&os.O_TRUNC == 0 && flag&os.O_EXCL == 0) {
+		return nil, os.ErrInvalid
+	}
+	f, err := c.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := vfs.NewEncrypter(f, c.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cryptFileCreation{File: f, enc: enc}, nil
+}
+
+func (c *cryptFs) decrypt(f afero.File) (afero.File, error) {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d, err := vfs.NewDecrypter(f, info.Size(), c.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &cryptFileOpen{File: f, d: d}, nil
+}
+
+// open opens a content for reading, and decrypts it if encrypted is true.
+func (afs *aferoVFS) open(name string, encrypted bool) (afero.File, error) {
+	f, err := afs.fs.Open(name)
+	if err != nil || !encrypted {
+		return f, err
+	}
+	cfs, ok := afs.fs.(*cryptFs)
+	if !ok {
+		f.Close()
+		return nil, vfs.ErrEncryptionDisabled
+	}
+	return cfs.decrypt(f)
+}
+
+// rawFs returns the afero.Fs without the encryption, to copy or import the
+// contents as they are stored.
+func (afs *aferoVFS) rawFs() afero.Fs {
+	if cfs, ok := afs.fs.(*cryptFs); ok {
+		return cfs.Fs
+	}
+	return afs.fs
+}
+
+type cryptFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i *cryptFileInfo) Size() int64 { return i.size }
+
+// cryptFileOpen is a file opened for reading, with an encrypted content.
+type cryptFileOpen struct {
+	afero.File
+	d *vfs.Decrypter
+}
+
+func (f *cryptFileOpen) Read(p []byte) (int, error) {
+	return f.d.Read(p)
+}
+
+func (f *cryptFileOpen) ReadAt(p []byte, off int64) (int, error) {
+	return f.d.ReadAt(p, off)
+}
+
+func (f *cryptFileOpen) Seek(offset int64, whence int) (int64, error) {
+	return f.d.Seek(offset, whence)
+}
+
+func (f *cryptFileOpen) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &cryptFileInfo{FileInfo: info, size: f.d.Size()}, nil
+}
+
+func (f *cryptFileOpen) Write(p []byte) (int, error)              { return 0, os.ErrInvalid }
+func (f *cryptFileOpen) WriteAt(p []byte, off int64) (int, error) { return 0, os.ErrInvalid }
+func (f *cryptFileOpen) WriteString(s string) (int, error)        { return 0, os.ErrInvalid }
+func (f *cryptFileOpen) Truncate(size int64) error                { return os.ErrInvalid }
+
+// cryptFileCreation is a file opened for writing, whose content is encrypted.
+type cryptFileCreation struct {
+	afero.File
+	enc *vfs.Encrypter
+}
+
+func (f *cryptFileCreation) Write(p []byte) (int, error) {
+	return f.enc.Write(p)
+}
+
+func (f *cryptFileCreation) WriteString(s string) (int, error) {
+	return f.enc.Write([]byte(s))
+}
+
+func (f *cryptFileCreation) Close() error {
+	err := f.enc.Close()
+	if errc := f.File.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
+
+func (f *cryptFileCreation) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (f *cryptFileCreation) ReadAt(p []byte, off int64) (int, error)      { return 0, os.ErrInvalid }
+func (f *cryptFileCreation) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (f *cryptFileCreation) WriteAt(p []byte, off int64) (int, error)     { return 0, os.ErrInvalid }
+func (f *cryptFileCreation) Truncate(size int64) error                    { return os.ErrInvalid }
+
+// EncryptContents encrypts the contents of the files and of their old
+// versions that have been written in clear before the encryption was enabled,
+// and sets the encrypted flag on their documents. A deduplicated file is then
+// linked to the blob of its encrypted content. The chunks of the upload
+// sessions are left as they are, as they are removed with their sessions.
+func (afs *aferoVFS) EncryptContents() error {
+	cfs, ok := afs.fs.(*cryptFs)
+	if !ok {
+		return vfs.ErrEncryptionDisabled
+	}
+	raw := cfs.Fs
+	if err := raw.MkdirAll(encryptingDirName, 0755); err != nil {
+		return err
+	}
+	defer raw.RemoveAll(encryptingDirName) // #nosec
+
+	return vfs.Walk(afs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil || file == nil {
+			return err
+		}
+		return afs.encryptFile(raw, cfs.key, file)
+	})
+}
+
+func (afs *aferoVFS) encryptFile(raw afero.Fs, key *keymgmt.SecretKey, file *vfs.FileDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	olddoc, err := afs.Indexer.FileByID(file.ID())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !olddoc.Encrypted {
+		name, err := afs.Indexer.FilePath(olddoc)
+		if err != nil {
+			return err
+		}
+		if err = encryptContent(raw, key, name); err != nil {
+			return err
+		}
+		newdoc := olddoc.Clone().(*vfs.FileDoc)
+		newdoc.Encrypted = true
+		b, err := vfs.GetBlob(afs, vfs.BlobID(olddoc))
+		if err != nil && !couchdb.IsNotFoundError(err) && !couchdb.IsNoDatabaseError(err) {
+			return err
+		}
+		deduplicated := b != nil && b.HasRef(olddoc.ID())
+		if deduplicated {
+			// The encrypted content is kept only as the content of the file if
+			// it doesn't match the blob of the encrypted contents
+			err = afs.storeBlob(name, newdoc, b.SHA256)
+			if err != nil && err != vfs.ErrBlobMismatch {
+				return err
+			}
+		}
+		if err = afs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+			return err
+		}
+		if deduplicated {
+			vfs.ReleaseBlob(afs, olddoc, afs.removeBlobs)
+		}
+	}
+
+	versions, err := vfs.VersionsFor(afs, olddoc.ID())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Encrypted {
+			continue
+		}
+		if err = encryptContent(raw, key, versionPath(version)); err != nil {
+			return err
+		}
+		version.Encrypted = true
+		if err = couchdb.UpdateDoc(afs, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptContent encrypts the content at the given path on a temporary file,
+// that is then renamed in place. A content encrypted by a previous run of the
+// migration, that was interrupted before its document was updated, is kept
+// as is.
+func encryptContent(raw afero.Fs, key *keymgmt.SecretKey, name string) error {
+	in, err := raw.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	encrypted, err := vfs.EncryptedWith(in, info.Size(), key)
+	if err != nil || encrypted {
+		return err
+	}
+
+	tmp := path.Join(encryptingDirName, utils.RandomString(16))
+	out, err := raw.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	enc, err := vfs.NewEncrypter(out, key)
+	if err == nil {
+		_, err = io.Copy(enc, in)
+		if errc := enc.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}
+	if errc := out.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = raw.Rename(tmp, name)
+	}
+	if err != nil {
+		raw.Remove(tmp) // #nosec
+	}
+	return err
+}
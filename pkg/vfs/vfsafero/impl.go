@@ -4,6 +4,7 @@ package vfsafero
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -72,6 +74,13 @@ func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu l
 	default:
 		return nil, fmt.Errorf("vfsafero: non supported scheme %s", fsURL.Scheme)
 	}
+	key, err := vfs.ContentKey(db)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		fs = newCryptFs(fs, key)
+	}
 	return &aferoVFS{
 		Indexer:         index,
 		DiskThresholder: disk,
@@ -100,6 +109,7 @@ func (afs *aferoVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		Indexer:         index,
 		DiskThresholder: afs.DiskThresholder,
 		domain:          afs.domain,
+		prefix:          afs.prefix,
 		fs:              afs.fs,
 		mu:              afs.mu,
 		pth:             afs.pth,
@@ -167,30 +177,10 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}
 	defer afs.mu.Unlock()
 
-	diskQuota := afs.DiskQuota()
-
-	var maxsize, newsize, capsize int64
-	newsize = newdoc.ByteSize
-	if diskQuota > 0 {
-		diskUsage, err := afs.DiskUsage()
-		if err != nil {
-			return nil, err
-		}
-
-		var oldsize int64
-		if olddoc != nil {
-			oldsize = olddoc.Size()
-		}
-		maxsize = diskQuota - diskUsage
-		if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
-			return nil, vfs.ErrFileTooBig
-		}
-
-		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
-			capsize = quotaBytes - diskUsage
-		}
-	} else {
-		maxsize = -1 // no limit
+	newsize := newdoc.ByteSize
+	maxsize, capsize, keepVersion, err := vfs.CheckAvailableDiskSpace(afs, newdoc, olddoc, -1)
+	if err != nil {
+		return nil, err
 	}
 
 	newpath, err := afs.Indexer.FilePath(newdoc)
@@ -202,8 +192,17 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}
 
 	tmppath := newpath
+	var oldpath string
+	var version *vfs.Version
 	if olddoc != nil {
 		tmppath = fmt.Sprintf("/.%s_%s", olddoc.ID(), olddoc.Rev())
+		oldpath, err = afs.Indexer.FilePath(olddoc)
+		if err != nil {
+			return nil, err
+		}
+		if keepVersion {
+			version = vfs.NewVersion(olddoc)
+		}
 	}
 
 	if olddoc != nil {
@@ -217,6 +216,9 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.ByteSize = 0
 	}
 
+	// The content is encrypted when the instance has a key for its files.
+	_, newdoc.Encrypted = afs.fs.(*cryptFs)
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = afs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -258,11 +260,14 @@ func (afs *aferoVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		afs:     afs,
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		oldpath: oldpath,
 		tmppath: tmppath,
+		version: version,
 		maxsize: maxsize,
 		capsize: capsize,
 
 		hash: hash,
+		sha:  sha256.New(),
 		meta: extractor,
 	}, nil
 }
@@ -273,11 +278,13 @@ func (afs *aferoVFS) DestroyDirContent(doc *vfs.DirDoc) error {
 	}
 	defer afs.mu.Unlock()
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
+	destroyed, ids, err := afs.Indexer.DeleteDirDocAndContent(doc, true)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	vfs.DestroyVersions(afs, ids, afs.removeVersions)
+	vfs.ReleaseBlobs(afs, ids, afs.removeBlobs)
 	infos, err := afero.ReadDir(afs.fs, doc.Fullpath)
 	if err != nil {
 		return err
@@ -302,11 +309,13 @@ func (afs *aferoVFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
 	}
 	defer afs.mu.Unlock()
 	diskUsage, _ := afs.DiskUsage()
-	destroyed, _, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
+	destroyed, ids, err := afs.Indexer.DeleteDirDocAndContent(doc, false)
 	if err != nil {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(afs, diskUsage, destroyed)
+	vfs.DestroyVersions(afs, ids, afs.removeVersions)
+	vfs.ReleaseBlobs(afs, ids, afs.removeBlobs)
 	return afs.fs.RemoveAll(doc.Fullpath)
 }
 
@@ -325,9 +334,20 @@ func (afs *aferoVFS) DestroyFile(doc *vfs.FileDoc) error {
 	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	vfs.DestroyVersions(afs, []string{doc.ID()}, afs.removeVersions)
+	vfs.ReleaseBlob(afs, doc, afs.removeBlobs)
 	return afs.Indexer.DeleteFileDoc(doc)
 }
 
+// removeVersions removes the contents of the old versions of a file.
+func (afs *aferoVFS) removeVersions(fileID string, versions []*vfs.Version) error {
+	err := afs.fs.RemoveAll(path.Join(vfs.VersionsDirName, fileID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
 func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if lockerr := afs.mu.RLock(); lockerr != nil {
 		return nil, lockerr
@@ -337,19 +357,112 @@ func (afs *aferoVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	f, err := afs.fs.Open(name)
+	f, err := afs.open(name, doc.Encrypted)
 	if err != nil {
 		return nil, err
 	}
 	return &aferoFileOpen{f}, nil
 }
 
+func (afs *aferoVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := afs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer afs.mu.RUnlock()
+	if version.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	f, err := afs.open(versionPath(version), version.Encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return &aferoFileOpen{f}, nil
+}
+
+func (afs *aferoVFS) CleanOldVersion(fileID string, version *vfs.Version) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	if version.FileID != fileID {
+		return vfs.ErrVersionNotFound
+	}
+	if err := afs.fs.Remove(versionPath(version)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return couchdb.DeleteDoc(afs, version)
+}
+
+// keepVersion moves the current content of a file to the directory of the old
+// versions, and persists the document of this version.
+func (afs *aferoVFS) keepVersion(oldpath string, version *vfs.Version) error {
+	dst := versionPath(version)
+	if err := afs.fs.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := afs.fs.Rename(oldpath, dst); err != nil {
+		return err
+	}
+	if err := couchdb.CreateNamedDocWithDB(afs, version); err != nil {
+		afs.fs.Remove(dst) // #nosec
+		return err
+	}
+	return nil
+}
+
+func versionPath(version *vfs.Version) string {
+	return path.Join(vfs.VersionsDirName, version.FileID, version.ShortID())
+}
+
+// The chunks of the upload sessions are stored outside of the tree of the
+// files, so they don't need the lock of the VFS.
+
+func (afs *aferoVFS) PutUploadChunk(sessionID string, index int, content io.Reader) (int64, bool, error) {
+	dir := path.Join(vfs.UploadsDirName, sessionID)
+	if err := afs.fs.MkdirAll(dir, 0755); err != nil {
+		return 0, false, err
+	}
+	name := path.Join(dir, strconv.Itoa(index))
+	f, err := afs.fs.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, false, err
+	}
+	n, err := io.Copy(f, content)
+	if cerr := f.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		afs.fs.Remove(name) // #nosec
+		return 0, false, err
+	}
+	_, encrypted := afs.fs.(*cryptFs)
+	return n, encrypted, nil
+}
+
+func (afs *aferoVFS) OpenUploadChunk(sessionID string, index int, encrypted bool) (io.ReadCloser, error) {
+	return afs.open(path.Join(vfs.UploadsDirName, sessionID, strconv.Itoa(index)), encrypted)
+}
+
+func (afs *aferoVFS) DeleteUploadChunk(sessionID string, index int) error {
+	err := afs.fs.Remove(path.Join(vfs.UploadsDirName, sessionID, strconv.Itoa(index)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (afs *aferoVFS) DeleteUploadChunks(sessionID string) error {
+	return afs.fs.RemoveAll(path.Join(vfs.UploadsDirName, sessionID))
+}
+
 func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 	entries := make(map[string]*vfs.TreeFile, 1024)
+	byID := make(map[string]*vfs.TreeFile, 1024)
 	_, err = afs.BuildTree(func(f *vfs.TreeFile) {
 		if !f.IsOrphan {
 			entries[f.Fullpath] = f
 		}
+		byID[f.DocID] = f
 	})
 	if err != nil {
 		return
@@ -362,7 +475,10 @@ func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 
 		if fullpath == vfs.WebappsDirName ||
 			fullpath == vfs.KonnectorsDirName ||
-			fullpath == vfs.ThumbsDirName {
+			fullpath == vfs.ThumbsDirName ||
+			fullpath == vfs.VersionsDirName ||
+			fullpath == vfs.UploadsDirName ||
+			fullpath == vfs.BlobsDirName {
 			return filepath.SkipDir
 		}
 
@@ -391,12 +507,13 @@ func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 			}
 		} else if !f.IsDir {
 			var fd afero.File
-			fd, err = afs.fs.Open(fullpath)
+			fd, err = afs.open(fullpath, f.Encrypted)
 			if err != nil {
 				return err
 			}
 			h := md5.New()
-			if _, err = io.Copy(h, fd); err != nil {
+			var size int64
+			if size, err = io.Copy(h, fd); err != nil {
 				fd.Close()
 				return err
 			}
@@ -404,13 +521,13 @@ func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 				return err
 			}
 			md5sum := h.Sum(nil)
-			if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != info.Size() {
+			if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != size {
 				accumulate(&vfs.FsckLog{
 					Type:    vfs.ContentMismatch,
 					IsFile:  true,
 					FileDoc: f,
 					ContentMismatch: &vfs.FsckContentMismatch{
-						SizeFile:    info.Size(),
+						SizeFile:    size,
 						SizeIndex:   f.ByteSize,
 						MD5SumFile:  md5sum,
 						MD5SumIndex: f.MD5Sum,
@@ -441,6 +558,9 @@ func (afs *aferoVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 		}
 	}
 
+	// The deduplicated files are hard links to the blobs, so their contents
+	// have already been checked, and only the blobs themselves are left.
+	_, err = vfs.FsckBlobs(afs, byID, afs.blobStored, accumulate)
 	return
 }
 
@@ -512,6 +632,9 @@ func (afs *aferoVFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
 		if err != nil {
 			return err
 		}
+		if err = afs.unshareContent(newpath, olddoc); err != nil {
+			return err
+		}
 		err = afs.fs.Chmod(newpath, newdoc.Mode())
 		if err != nil {
 			return err
@@ -630,10 +753,13 @@ type aferoFileCreation struct {
 	afs     *aferoVFS          // parent vfs
 	newdoc  *vfs.FileDoc       // new document
 	olddoc  *vfs.FileDoc       // old document
+	oldpath string             // path of the old document
 	tmppath string             // temporary file path for uploading a new version of this file
+	version *vfs.Version       // version used to keep the old content, nil if not kept
 	maxsize int64              // maximum size allowed for the file
 	capsize int64              // size cap from which we send a notification to the user
 	hash    hash.Hash          // hash we build up along the file
+	sha     hash.Hash          // sha256 of the content, for the deduplication
 	meta    *vfs.MetaExtractor // extracts metadata from the content
 	err     error              // write error
 }
@@ -675,6 +801,7 @@ func (f *aferoFileCreation) Write(p []byte) (int, error) {
 		}
 	}
 
+	f.sha.Write(p) // #nosec
 	_, err = f.hash.Write(p)
 	return n, err
 }
@@ -684,10 +811,22 @@ func (f *aferoFileCreation) Close() (err error) {
 	defer func() {
 		if err == nil {
 			if f.olddoc != nil {
+				// keep the old content as a version of the file
+				if f.version != nil {
+					if errv := f.afs.keepVersion(f.oldpath, f.version); errv != nil {
+						logger.WithNamespace("vfsafero").Warnf("Error on keeping version: %s", errv)
+						f.version = nil
+					}
+				}
 				// move the temporary file to its final location
 				if errf := f.afs.fs.Rename(f.tmppath, newpath); errf != nil {
 					logger.WithNamespace("vfsafero").Warnf("Error on close file: %s", errf)
 				}
+				if f.version != nil {
+					if errc := vfs.CleanOldVersions(f.afs, f.newdoc.ID()); errc != nil {
+						logger.WithNamespace("vfsafero").Warnf("Error on cleaning versions: %s", errc)
+					}
+				}
 			}
 			if f.capsize > 0 && f.size >= f.capsize {
 				vfs.PushDiskQuotaAlert(f.afs, true)
@@ -766,7 +905,11 @@ func (f *aferoFileCreation) Close() (err error) {
 		return vfs.ErrParentInTrash
 	}
 
-	return f.afs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	if err = f.afs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+		return err
+	}
+	f.afs.dedupContent(f.tmppath, newdoc, f.olddoc, f.sha.Sum(nil))
+	return nil
 }
 
 func safeCreateFile(name string, mode os.FileMode, fs afero.Fs) (afero.File, error) {
@@ -0,0 +1,92 @@
+package vfsafero
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ImportDir creates the directory on the disk, as the files are stored in the
+// same hierarchy as in the index.
+func (afs *aferoVFS) ImportDir(doc *vfs.DirDoc) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+	err := afs.fs.MkdirAll(doc.Fullpath, 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ImportFileContent writes the content on a temporary file, that is renamed
+// to the path of the file, or of its version, when it has been fully written.
+// As the index is kept, the content is encrypted only if the document has the
+// encrypted flag, and it is linked to a blob if the file references one.
+func (afs *aferoVFS) ImportFileContent(doc *vfs.FileDoc, version *vfs.Version, content io.Reader) error {
+	if lockerr := afs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer afs.mu.Unlock()
+
+	var name string
+	encrypted := doc.Encrypted
+	if version != nil {
+		if version.FileID != doc.ID() {
+			return vfs.ErrVersionNotFound
+		}
+		name = versionPath(version)
+		encrypted = version.Encrypted
+	} else {
+		var err error
+		if name, err = afs.Indexer.FilePath(doc); err != nil {
+			return err
+		}
+	}
+	fs := afs.rawFs()
+	if encrypted {
+		if _, ok := afs.fs.(*cryptFs); !ok {
+			return vfs.ErrEncryptionDisabled
+		}
+		fs = afs.fs
+	}
+	if err := afs.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	tmppath := path.Join(path.Dir(name), ".import_"+utils.RandomString(16))
+	f, err := safeCreateFile(tmppath, doc.Mode(), fs)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(f, io.TeeReader(content, h))
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = afs.fs.Rename(tmppath, name)
+	}
+	if err != nil {
+		afs.fs.Remove(tmppath) // #nosec
+		return err
+	}
+	if version == nil && afs.osFS {
+		var dedup bool
+		if dedup, err = vfs.HasBlobRef(afs, doc); err == nil && dedup {
+			err = afs.storeBlob(name, doc, h.Sum(nil))
+		}
+		// The content doesn't match the blob that the file references: it is
+		// kept only as the content of the file
+		if err == vfs.ErrBlobMismatch {
+			vfs.ReleaseBlob(afs, doc, afs.removeBlobs)
+			err = nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package vfss3
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/magic"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	web_utils "github.com/cozy/cozy-stack/web/utils"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// The applications are shared by the instances, and their files are stored
+// gzipped in the bucket, with the same names as in the swift containers:
+// apps-web/<slug>/<version>/<file>. An empty object, apps-web/<slug>/<version>,
+// is written when all the files of a version have been copied.
+func appsObjects(c *minio.Client, bucket string, appsType apps.AppType) objects {
+	var prefix string
+	switch appsType {
+	case apps.Webapp:
+		prefix = "apps-web/"
+	case apps.Konnector:
+		prefix = "apps-konnectors/"
+	default:
+		panic("Unknown AppType")
+	}
+	return objects{c: c, bucket: bucket, prefix: prefix}
+}
+
+type copier struct {
+	objects
+	appObj  string
+	tmpObj  string
+	started bool
+}
+
+// NewAppsCopier defines an apps.Copier storing the files of the applications
+// on S3.
+func NewAppsCopier(c *minio.Client, bucket string, appsType apps.AppType) apps.Copier {
+	return &copier{objects: appsObjects(c, bucket, appsType)}
+}
+
+func (f *copier) Start(slug, version string) (bool, error) {
+	f.appObj = path.Join(slug, version)
+	exists, err := f.exists(f.appObj)
+	if err != nil || exists {
+		return exists, err
+	}
+	f.tmpObj = "tmp-" + utils.RandomString(20) + "/"
+	f.started = true
+	return false, nil
+}
+
+func (f *copier) Copy(stat os.FileInfo, src io.Reader) (err error) {
+	if !f.started {
+		panic("copier should call Start() before Copy()")
+	}
+
+	objName := path.Join(f.tmpObj, stat.Name())
+	meta := map[string]string{
+		"original-content-length": strconv.FormatInt(stat.Size(), 10),
+	}
+
+	contentType := magic.MIMETypeByExtension(path.Ext(stat.Name()))
+	if contentType == "" {
+		contentType, src = magic.MIMETypeFromReader(src)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w := f.writer(objName, -1, contentType, meta)
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err == nil {
+		_, err = io.Copy(gw, src)
+		if errc := gw.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}
+	if err != nil {
+		w.Abort(err)
+		return err
+	}
+	return w.Close()
+}
+
+func (f *copier) Abort() error {
+	if !f.started {
+		return nil
+	}
+	return f.removePrefix(f.tmpObj)
+}
+
+func (f *copier) Commit() error {
+	objNames, err := f.names(f.tmpObj)
+	if err != nil {
+		return err
+	}
+	defer f.removeAll(objNames) // #nosec
+	// We check if the appObj has not been created concurrently by another
+	// copier.
+	if exists, err := f.exists(f.appObj); err != nil || exists {
+		return err
+	}
+	for _, srcObjName := range objNames {
+		dstObjName := path.Join(f.appObj, strings.TrimPrefix(srcObjName, f.tmpObj))
+		if err = f.copy(srcObjName, dstObjName); err != nil {
+			return err
+		}
+	}
+	_, err = f.put(f.appObj, strings.NewReader(""), 0, "text/plain", nil)
+	return err
+}
+
+type fileServer struct {
+	objects
+}
+
+// NewAppsFileServer returns the apps.FileServer implementation for the files of
+// the applications stored on S3.
+func NewAppsFileServer(c *minio.Client, bucket string, appsType apps.AppType) apps.FileServer {
+	return &fileServer{appsObjects(c, bucket, appsType)}
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	obj *minio.Object
+}
+
+func (g *gzipReadCloser) Close() error {
+	err := g.Reader.Close()
+	if errc := g.obj.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	return err
+}
+
+func (s *fileServer) Open(slug, version, file string) (io.ReadCloser, error) {
+	obj, _, err := s.open(path.Join(slug, version, file))
+	if err != nil {
+		return nil, err
+	}
+	gr, err := gzip.NewReader(obj)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: gr, obj: obj}, nil
+}
+
+func (s *fileServer) ServeFileContent(w http.ResponseWriter, req *http.Request, slug, version, file string) error {
+	obj, info, err := s.open(path.Join(slug, version, file))
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	if checkETag := req.Header.Get("Cache-Control") == ""; checkETag {
+		etag := strings.Trim(info.ETag, `"`)
+		if len(etag) > 10 {
+			etag = etag[:10]
+		}
+		etag = fmt.Sprintf(`"%s"`, etag)
+		if web_utils.CheckPreconditions(w, req, etag) {
+			return nil
+		}
+		w.Header().Set("Etag", etag)
+	}
+
+	var r io.Reader = obj
+	size := info.Size
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+	} else {
+		size, _ = strconv.ParseInt(info.Metadata.Get("X-Amz-Meta-Original-Content-Length"), 10, 64)
+		var gr *gzip.Reader
+		gr, err = gzip.NewReader(obj)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	ext := path.Ext(file)
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = magic.MIMETypeByExtension(ext)
+	}
+	if contentType == "text/html" {
+		contentType = "text/html; charset=utf-8"
+	} else if contentType == "text/xml" && ext == ".svg" {
+		// override for files with text/xml content because of leading <?xml tag
+		contentType = "image/svg+xml"
+	}
+
+	web_utils.ServeContent(w, req, contentType, size, r)
+	return nil
+}
+
+func (s *fileServer) FilesList(slug, version string) ([]string, error) {
+	prefix := path.Join(slug, version) + "/"
+	names, err := s.names(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range names {
+		names[i] = strings.TrimPrefix(n, prefix)
+	}
+	return names, nil
+}
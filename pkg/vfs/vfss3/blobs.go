@@ -0,0 +1,100 @@
+package vfss3
+
+import (
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go/v6"
+)
+
+func makeBlobObjectName(blobID string) string {
+	return blobsObjectPrefix + blobID
+}
+
+func (s *s3VFS) blobStored(b *vfs.Blob) (bool, error) {
+	return s.exists(makeBlobObjectName(b.ID()))
+}
+
+// contentObjectName returns the name of the object with the content of a
+// file: its blob if the file references it, or its own object. A blob with
+// the same md5sum is not enough, as it can have another content.
+func (s *s3VFS) contentObjectName(doc *vfs.FileDoc) (string, error) {
+	dedup, err := vfs.HasBlobRef(s, doc)
+	if err != nil {
+		return "", err
+	}
+	if dedup {
+		return makeBlobObjectName(vfs.BlobID(doc)), nil
+	}
+	return MakeObjectName(doc.DocID), nil
+}
+
+// openContent opens the object with the content of a file.
+func (s *s3VFS) openContent(doc *vfs.FileDoc) (*minio.Object, minio.ObjectInfo, error) {
+	objName, err := s.contentObjectName(doc)
+	if err != nil {
+		return nil, minio.ObjectInfo{}, err
+	}
+	return s.open(objName)
+}
+
+// copyContentToVersion makes a server-side copy of the current content of a
+// file, from its blob or its object, before it is overwritten.
+func (s *s3VFS) copyContentToVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	objName, err := s.contentObjectName(doc)
+	if err != nil {
+		return err
+	}
+	return s.copy(objName, makeVersionObjectName(version))
+}
+
+// dedupContent is called when the content of a file, with the given sha256,
+// has been written on a temporary object. The object becomes the blob for its
+// content, or is removed if the blob already exists with the same sha256. If
+// the content can't be deduplicated, the object is moved to the object of the
+// file. It returns true if the content has been stored as a blob.
+func (s *s3VFS) dedupContent(tmpName string, doc *vfs.FileDoc, sha256sum []byte) (bool, error) {
+	blobName := makeBlobObjectName(vfs.BlobID(doc))
+	exists, err := s.exists(blobName)
+	if err == nil {
+		err = vfs.CheckBlobContent(s, doc, sha256sum, exists)
+	}
+	if err == nil {
+		if exists {
+			err = s.remove(tmpName)
+		} else {
+			err = s.move(tmpName, blobName)
+		}
+	}
+	if err == nil {
+		err = vfs.AddBlobRef(s, doc, sha256sum)
+	}
+	if err != nil {
+		s.log.Warnf("Could not deduplicate the content of %s: %s", doc.ID(), err)
+		if exists, _ := s.exists(tmpName); !exists {
+			return false, err
+		}
+		return false, s.move(tmpName, MakeObjectName(doc.DocID))
+	}
+	return true, nil
+}
+
+// releaseOldContent is called when the content of a file has been replaced,
+// to remove the reference to the blob of the old content, or the object of
+// the file if the new content is a blob. The errors are only logged, as the
+// new content has already been written.
+func (s *s3VFS) releaseOldContent(olddoc, newdoc *vfs.FileDoc, stored bool) {
+	if stored {
+		if err := s.remove(MakeObjectName(olddoc.DocID)); err != nil {
+			s.log.Warnf("Could not remove the object of %s: %s", olddoc.ID(), err)
+		}
+	}
+	vfs.ReleaseOldBlob(s, olddoc, newdoc, stored, s.removeBlobs)
+}
+
+// removeBlobs removes the objects of the blobs that are no longer referenced.
+func (s *s3VFS) removeBlobs(blobs []*vfs.Blob) error {
+	objNames := make([]string, len(blobs))
+	for i, b := range blobs {
+		objNames[i] = makeBlobObjectName(b.ID())
+	}
+	return s.removeAll(objNames)
+}
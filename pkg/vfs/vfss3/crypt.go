@@ -0,0 +1,199 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// openFile returns the file for reading an object, and decrypts its content
+// if its document says that it has been encrypted.
+func (s *s3VFS) openFile(obj *minio.Object, info minio.ObjectInfo, encrypted bool) (vfs.File, error) {
+	if !encrypted {
+		return &s3FileOpen{obj: obj}, nil
+	}
+	if s.key == nil {
+		obj.Close()
+		return nil, vfs.ErrEncryptionDisabled
+	}
+	d, err := vfs.NewDecrypter(obj, info.Size, s.key)
+	if err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return &s3FileOpen{obj: obj, d: d}, nil
+}
+
+// encryptingReader returns a reader with the encrypted content of r. It must
+// be closed to stop the goroutine that encrypts the content if the reader has
+// not been read until its end.
+func (s *s3VFS) encryptingReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := vfs.NewEncrypter(pw, s.key)
+		if err == nil {
+			_, err = io.Copy(enc, r)
+			if errc := enc.Close(); errc != nil && err == nil {
+				err = errc
+			}
+		}
+		pw.CloseWithError(err) // #nosec
+	}()
+	return pr
+}
+
+// EncryptContents encrypts the objects of the files and of their old versions
+// that have been written in clear before the encryption was enabled, and sets
+// the encrypted flag on their documents. The content of a deduplicated file
+// is encrypted on the blob of the encrypted content. The chunks of the upload
+// sessions are left as they are, as they are removed with their sessions.
+func (s *s3VFS) EncryptContents() error {
+	if s.key == nil {
+		return vfs.ErrEncryptionDisabled
+	}
+	return vfs.Walk(s, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil || file == nil {
+			return err
+		}
+		return s.encryptFile(file)
+	})
+}
+
+func (s *s3VFS) encryptFile(file *vfs.FileDoc) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+
+	olddoc, err := s.Indexer.FileByID(file.ID())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !olddoc.Encrypted {
+		if err = s.encryptFileContent(olddoc); err != nil {
+			return err
+		}
+	}
+
+	versions, err := vfs.VersionsFor(s, olddoc.ID())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Encrypted {
+			continue
+		}
+		objName := makeVersionObjectName(version)
+		if err = s.encryptObject(objName, objName); err != nil {
+			return err
+		}
+		version.Encrypted = true
+		if err = couchdb.UpdateDoc(s, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3VFS) encryptFileContent(olddoc *vfs.FileDoc) error {
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	newdoc.Encrypted = true
+	b, err := vfs.GetBlob(s, vfs.BlobID(olddoc))
+	if err != nil && !couchdb.IsNotFoundError(err) && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	if b == nil || !b.HasRef(olddoc.ID()) {
+		objName := MakeObjectName(olddoc.DocID)
+		if err = s.encryptObject(objName, objName); err != nil {
+			return err
+		}
+		return s.Indexer.UpdateFileDoc(olddoc, newdoc)
+	}
+
+	// The file is deduplicated: it now references the blob of the encrypted
+	// content, and an object left by the time the file was not deduplicated
+	// is removed as it is in clear.
+	blobName := makeBlobObjectName(vfs.BlobID(newdoc))
+	exists, err := s.exists(blobName)
+	if err == nil {
+		err = vfs.CheckBlobContent(s, newdoc, b.SHA256, exists)
+	}
+	if err == vfs.ErrBlobMismatch {
+		// The blob of the encrypted content has another content: the file
+		// is no longer deduplicated, and its content is encrypted in its
+		// own object.
+		if err = s.encryptObject(makeBlobObjectName(b.ID()), MakeObjectName(olddoc.DocID)); err != nil {
+			return err
+		}
+		if err = s.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+			return err
+		}
+		vfs.ReleaseBlob(s, olddoc, s.removeBlobs)
+		return nil
+	}
+	if err == nil && !exists {
+		err = s.encryptObject(makeBlobObjectName(b.ID()), blobName)
+	}
+	if err == nil {
+		err = vfs.AddBlobRef(s, newdoc, b.SHA256)
+	}
+	if err == nil {
+		err = s.Indexer.UpdateFileDoc(olddoc, newdoc)
+	}
+	if err != nil {
+		return err
+	}
+	vfs.ReleaseBlob(s, olddoc, s.removeBlobs)
+	return s.remove(MakeObjectName(olddoc.DocID))
+}
+
+// encryptObject writes the encrypted content of the src object on a
+// temporary object, that is then moved to dst with its metadata. A content
+// encrypted by a previous run of the migration, that was interrupted before
+// its document was updated, is not encrypted again.
+func (s *s3VFS) encryptObject(src, dst string) error {
+	obj, info, err := s.open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	encrypted, err := vfs.EncryptedWith(obj, info.Size, s.key)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		if src == dst {
+			return nil
+		}
+		return s.copy(src, dst)
+	}
+
+	meta := make(map[string]string)
+	for k, v := range info.Metadata {
+		if len(v) > 0 && strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k[len("x-amz-meta-"):]] = v[0]
+		}
+	}
+	tmpName := makeTmpObjectName(path.Base(dst))
+	er := s.encryptingReader(obj)
+	_, err = s.put(tmpName, er, vfs.EncryptedSize(info.Size), info.ContentType, meta)
+	er.Close()
+	if err == nil {
+		err = s.move(tmpName, dst)
+	}
+	if err != nil {
+		s.remove(tmpName) // #nosec
+	}
+	return err
+}
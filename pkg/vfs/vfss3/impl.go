@@ -0,0 +1,757 @@
+// Package vfss3 is the implementation of the VFS on a storage compatible with
+// the S3 API, like AWS S3 or MinIO. The contents of the files are stored in
+// a bucket shared by all the instances, with the same layout as the layout v2
+// of swift: the objects are named by the identifiers of the files, and the
+// hierarchy is only kept in the index.
+package vfss3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
+	"github.com/cozy/cozy-stack/pkg/lock"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go/v6"
+	"github.com/sirupsen/logrus"
+)
+
+// maxFileSize is the maximal size of a file: a content whose size is not
+// known in advance is sent with at most 10000 parts.
+const maxFileSize = 10000 * partSize
+
+type s3VFS struct {
+	vfs.Indexer
+	vfs.DiskThresholder
+	objects
+	domain   string
+	dbPrefix string
+	mu       lock.ErrorRWLocker
+	log      *logrus.Entry
+	key      *keymgmt.SecretKey
+}
+
+// New returns a vfs.VFS instance associated with the specified indexer and
+// the S3 client, that stores the contents of the files in the given bucket.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, c *minio.Client, bucket string) (vfs.VFS, error) {
+	key, err := vfs.ContentKey(db)
+	if err != nil {
+		return nil, err
+	}
+	return &s3VFS{
+		Indexer:         index,
+		DiskThresholder: disk,
+		objects: objects{
+			c:      c,
+			bucket: bucket,
+			prefix: makeKeyPrefix(db.DBPrefix()),
+		},
+		domain:   db.DomainName(),
+		dbPrefix: db.DBPrefix(),
+		mu:       mu,
+		log:      logger.WithDomain(db.DomainName()).WithField("nspace", "vfss3"),
+		key:      key,
+	}, nil
+}
+
+func (s *s3VFS) DBPrefix() string {
+	return s.dbPrefix
+}
+
+func (s *s3VFS) DomainName() string {
+	return s.domain
+}
+
+func (s *s3VFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
+	clone := *s
+	clone.Indexer = index
+	return &clone
+}
+
+// InitFs only creates the index, as the bucket is created when the stack is
+// started.
+func (s *s3VFS) InitFs() error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	return s.Indexer.InitIndex()
+}
+
+func (s *s3VFS) Delete() error {
+	s.log.Infof("Removing the objects with the prefix %q", s.prefix)
+	return s.removePrefix("")
+}
+
+func (s *s3VFS) CreateDir(doc *vfs.DirDoc) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	exists, err := s.Indexer.DirChildExists(doc.DirID, doc.DocName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return os.ErrExist
+	}
+	if doc.ID() == "" {
+		return s.Indexer.CreateDirDoc(doc)
+	}
+	return s.Indexer.CreateNamedDirDoc(doc)
+}
+
+func (s *s3VFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.Unlock()
+
+	newsize := newdoc.ByteSize
+	maxsize, capsize, keepVersion, err := vfs.CheckAvailableDiskSpace(s, newdoc, olddoc, maxFileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if olddoc != nil {
+		newdoc.SetID(olddoc.ID())
+		newdoc.SetRev(olddoc.Rev())
+		newdoc.CreatedAt = olddoc.CreatedAt
+	}
+
+	newpath, err := s.Indexer.FilePath(newdoc)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(newpath, vfs.TrashDirName+"/") {
+		return nil, vfs.ErrParentInTrash
+	}
+
+	// Avoid storing negative size in the index.
+	if newdoc.ByteSize < 0 {
+		newdoc.ByteSize = 0
+	}
+
+	// The content is encrypted when the instance has a key for its files.
+	newdoc.Encrypted = s.key != nil
+
+	if olddoc == nil {
+		var exists bool
+		exists, err = s.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			return nil, os.ErrExist
+		}
+
+		// When added to the index, the document is first considered hidden. This
+		// flag will only be removed at the end of the upload when all its metadata
+		// are known. See the Close() method.
+		newdoc.Trashed = true
+
+		if newdoc.ID() == "" {
+			err = s.Indexer.CreateFileDoc(newdoc)
+		} else {
+			err = s.Indexer.CreateNamedFileDoc(newdoc)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var version *vfs.Version
+	if keepVersion {
+		version = vfs.NewVersion(olddoc)
+		if err = s.copyContentToVersion(olddoc, version); err != nil {
+			s.log.Warnf("Could not keep the version of %s: %s", olddoc.ID(), err)
+			version = nil
+		}
+	}
+
+	// The content is written on a temporary object, and moved to the object
+	// of the file, or to a blob, only when it has been fully uploaded and
+	// checked. S3 can't check the md5sum of a multipart upload, so it is
+	// computed by the stack.
+	tmpName := makeTmpObjectName(newdoc.DocID)
+	size := newsize
+	if size >= 0 && s.key != nil {
+		size = vfs.EncryptedSize(size)
+	}
+	meta := map[string]string{
+		"created-at": newdoc.CreatedAt.Format(time.RFC3339),
+		"exec":       strconv.FormatBool(newdoc.Executable),
+	}
+	ow := s.writer(tmpName, size, newdoc.Mime, meta)
+	var w io.Writer = ow
+	var enc *vfs.Encrypter
+	if s.key != nil {
+		if enc, err = vfs.NewEncrypter(ow, s.key); err != nil {
+			ow.Abort(err)
+			if version != nil {
+				s.remove(makeVersionObjectName(version)) // #nosec
+			}
+			if olddoc == nil {
+				s.Indexer.DeleteFileDoc(newdoc) // #nosec
+			}
+			return nil, err
+		}
+		w = enc
+	}
+
+	return &s3FileCreation{
+		ow:      ow,
+		w:       w,
+		enc:     enc,
+		hash:    md5.New(), // #nosec
+		sha:     sha256.New(),
+		fs:      s,
+		size:    newsize,
+		name:    tmpName,
+		meta:    vfs.NewMetaExtractor(newdoc),
+		newdoc:  newdoc,
+		olddoc:  olddoc,
+		version: version,
+		maxsize: maxsize,
+		capsize: capsize,
+	}, nil
+}
+
+func (s *s3VFS) DestroyDirContent(doc *vfs.DirDoc) error {
+	return s.destroyDir(doc, true)
+}
+
+func (s *s3VFS) DestroyDirAndContent(doc *vfs.DirDoc) error {
+	return s.destroyDir(doc, false)
+}
+
+func (s *s3VFS) destroyDir(doc *vfs.DirDoc, onlyContent bool) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	diskUsage, _ := s.Indexer.DiskUsage()
+	destroyed, ids, err := s.Indexer.DeleteDirDocAndContent(doc, onlyContent)
+	if err != nil {
+		return err
+	}
+	vfs.DiskQuotaAfterDestroy(s, diskUsage, destroyed)
+	vfs.DestroyVersions(s, ids, s.removeVersions)
+	vfs.ReleaseBlobs(s, ids, s.removeBlobs)
+	objNames := make([]string, len(ids))
+	for i, id := range ids {
+		objNames[i] = MakeObjectName(id)
+	}
+	return s.removeAll(objNames)
+}
+
+func (s *s3VFS) DestroyFile(doc *vfs.FileDoc) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	diskUsage, _ := s.Indexer.DiskUsage()
+	err := s.Indexer.DeleteFileDoc(doc)
+	if err == nil {
+		// A deduplicated file has no object, only a reference to a blob
+		err = s.remove(MakeObjectName(doc.DocID))
+	}
+	if err == nil {
+		vfs.DiskQuotaAfterDestroy(s, diskUsage, doc.ByteSize)
+		vfs.DestroyVersions(s, []string{doc.ID()}, s.removeVersions)
+		vfs.ReleaseBlob(s, doc, s.removeBlobs)
+	}
+	return err
+}
+
+func (s *s3VFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	obj, info, err := s.openContent(doc)
+	if err != nil {
+		return nil, err
+	}
+	return s.openFile(obj, info, doc.Encrypted)
+}
+
+func (s *s3VFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	if version.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	obj, info, err := s.open(makeVersionObjectName(version))
+	if err != nil {
+		return nil, err
+	}
+	return s.openFile(obj, info, version.Encrypted)
+}
+
+func (s *s3VFS) CleanOldVersion(fileID string, version *vfs.Version) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	if version.FileID != fileID {
+		return vfs.ErrVersionNotFound
+	}
+	if err := s.remove(makeVersionObjectName(version)); err != nil {
+		return err
+	}
+	return couchdb.DeleteDoc(s, version)
+}
+
+func (s *s3VFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
+	entries := make(map[string]*vfs.TreeFile, 1024)
+	_, err = s.BuildTree(func(f *vfs.TreeFile) {
+		if !f.IsDir {
+			entries[f.DocID] = f
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	// The deduplicated files have no object: their contents are in the blobs.
+	referenced, err := vfs.FsckBlobs(s, entries, s.blobStored, accumulate)
+	if err != nil {
+		return
+	}
+	for docID := range referenced {
+		delete(entries, docID)
+	}
+
+	err = s.list("", func(objName string, obj minio.ObjectInfo) error {
+		if isInternalObjectName(objName) {
+			return nil
+		}
+		docID := makeDocID(objName)
+		if referenced[docID] {
+			// An object left by the time the file was not deduplicated
+			return nil
+		}
+		f, ok := entries[docID]
+		if !ok {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.IndexMissing,
+				IsFile:  true,
+				FileDoc: objectToFileDoc(objName, obj),
+			})
+			return nil
+		}
+		delete(entries, docID)
+		size, md5sum := obj.Size, etagToMD5(obj.ETag)
+		if f.Encrypted {
+			// The md5sum of an encrypted content is not known by S3
+			md5sum = nil
+			if size == vfs.EncryptedSize(f.ByteSize) {
+				size = f.ByteSize
+			}
+		}
+		if (md5sum != nil && !bytes.Equal(md5sum, f.MD5Sum)) || f.ByteSize != size {
+			accumulate(&vfs.FsckLog{
+				Type:    vfs.ContentMismatch,
+				IsFile:  true,
+				FileDoc: f,
+				ContentMismatch: &vfs.FsckContentMismatch{
+					SizeFile:    obj.Size,
+					SizeIndex:   f.ByteSize,
+					MD5SumFile:  md5sum,
+					MD5SumIndex: f.MD5Sum,
+				},
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	// entries should contain only data that does not contain an associated
+	// index.
+	for _, f := range entries {
+		accumulate(&vfs.FsckLog{
+			Type:    vfs.FileMissing,
+			IsFile:  true,
+			FileDoc: f,
+		})
+	}
+
+	return
+}
+
+// UpdateFileDoc calls the indexer UpdateFileDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateFileDoc
+func (s *s3VFS) UpdateFileDoc(olddoc, newdoc *vfs.FileDoc) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := s.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return s.Indexer.UpdateFileDoc(olddoc, newdoc)
+}
+
+// UdpdateDirDoc calls the indexer UdpdateDirDoc function and adds a few checks
+// before actually calling this method:
+//   - locks the filesystem for writing
+//   - checks in case we have a move operation that the new path is available
+//
+// @override Indexer.UpdateDirDoc
+func (s *s3VFS) UpdateDirDoc(olddoc, newdoc *vfs.DirDoc) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+	if newdoc.DirID != olddoc.DirID || newdoc.DocName != olddoc.DocName {
+		exists, err := s.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return os.ErrExist
+		}
+	}
+	return s.Indexer.UpdateDirDoc(olddoc, newdoc)
+}
+
+func (s *s3VFS) DirByID(fileID string) (*vfs.DirDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.DirByID(fileID)
+}
+
+func (s *s3VFS) DirByPath(name string) (*vfs.DirDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.DirByPath(name)
+}
+
+func (s *s3VFS) FileByID(fileID string) (*vfs.FileDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.FileByID(fileID)
+}
+
+func (s *s3VFS) FileByPath(name string) (*vfs.FileDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.FileByPath(name)
+}
+
+func (s *s3VFS) FilePath(doc *vfs.FileDoc) (string, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return "", lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.FilePath(doc)
+}
+
+func (s *s3VFS) DirOrFileByID(fileID string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.DirOrFileByID(fileID)
+}
+
+func (s *s3VFS) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc, error) {
+	if lockerr := s.mu.RLock(); lockerr != nil {
+		return nil, nil, lockerr
+	}
+	defer s.mu.RUnlock()
+	return s.Indexer.DirOrFileByPath(name)
+}
+
+type s3FileCreation struct {
+	ow      *objectWriter  // the upload of the temporary object
+	w       io.Writer      // ow, or enc if the content is encrypted
+	enc     *vfs.Encrypter // encrypts the content, nil if not encrypted
+	hash    hash.Hash
+	sha     hash.Hash // sha256 of the content, for the deduplication
+	n       int64
+	size    int64
+	fs      *s3VFS
+	name    string
+	err     error
+	meta    *vfs.MetaExtractor
+	newdoc  *vfs.FileDoc
+	olddoc  *vfs.FileDoc
+	version *vfs.Version
+	maxsize int64
+	capsize int64
+}
+
+func (f *s3FileCreation) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) ReadAt(p []byte, off int64) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileCreation) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	// The sizes are checked before writing, as the upload of an object with a
+	// known size stops reading the pipe after the expected number of bytes.
+	total := f.n + int64(len(p))
+	if f.maxsize >= 0 && total > f.maxsize {
+		f.err = vfs.ErrFileTooBig
+		return 0, f.err
+	}
+	if f.size >= 0 && total > f.size {
+		f.err = vfs.ErrContentLengthMismatch
+		return 0, f.err
+	}
+
+	if f.meta != nil {
+		if _, err := (*f.meta).Write(p); err != nil && err != io.ErrClosedPipe {
+			(*f.meta).Abort(err)
+			f.meta = nil
+		}
+	}
+
+	n, err := f.w.Write(p)
+	f.hash.Write(p[:n]) // #nosec
+	f.sha.Write(p[:n])  // #nosec
+	f.n += int64(n)
+	if err != nil {
+		f.err = err
+	}
+	return n, err
+}
+
+func (f *s3FileCreation) Close() (err error) {
+	defer func() {
+		if err == nil {
+			if f.capsize > 0 && f.size >= f.capsize {
+				vfs.PushDiskQuotaAlert(f.fs, true)
+			}
+			if f.version != nil {
+				if errv := couchdb.CreateNamedDocWithDB(f.fs, f.version); errv != nil {
+					f.fs.remove(makeVersionObjectName(f.version)) // #nosec
+					f.fs.log.Warnf("Could not keep the version of %s: %s", f.olddoc.ID(), errv)
+				} else if errc := vfs.CleanOldVersions(f.fs, f.olddoc.ID()); errc != nil {
+					f.fs.log.Warnf("Could not clean the versions of %s: %s", f.olddoc.ID(), errc)
+				}
+			}
+		} else {
+			f.fs.remove(f.name) // #nosec
+			if f.version != nil {
+				f.fs.remove(makeVersionObjectName(f.version)) // #nosec
+			}
+
+			// If an error has occurred that is not due to the index update, we should
+			// delete the file from the index.
+			_, isCouchErr := couchdb.IsCouchError(err)
+			if !isCouchErr && f.olddoc == nil {
+				f.fs.Indexer.DeleteFileDoc(f.newdoc) // #nosec
+			}
+		}
+	}()
+
+	if f.err == nil && f.size >= 0 && f.n != f.size {
+		f.err = vfs.ErrContentLengthMismatch
+	}
+	if f.err == nil && f.enc != nil {
+		f.err = f.enc.Close()
+	}
+	if f.err != nil {
+		f.ow.Abort(f.err)
+	} else if errc := f.ow.Close(); errc != nil {
+		f.err = errc
+	}
+	if f.err != nil && f.meta != nil {
+		(*f.meta).Abort(f.err)
+		f.meta = nil
+	}
+
+	newdoc, olddoc, written := f.newdoc, f.olddoc, f.n
+	if olddoc == nil {
+		olddoc = newdoc.Clone().(*vfs.FileDoc)
+	}
+
+	if f.meta != nil {
+		if errc := (*f.meta).Close(); errc == nil {
+			newdoc.Metadata = (*f.meta).Result()
+		}
+	}
+
+	if f.err != nil {
+		return f.err
+	}
+
+	md5sum := f.hash.Sum(nil)
+	if newdoc.MD5Sum == nil {
+		newdoc.MD5Sum = md5sum
+	} else if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+		return vfs.ErrInvalidHash
+	}
+
+	if f.size < 0 {
+		newdoc.ByteSize = written
+	}
+
+	if newdoc.ByteSize != written {
+		return vfs.ErrContentLengthMismatch
+	}
+
+	// The document is already added to the index when closing the file creation
+	// handler. When updating the content of the document with the final
+	// informations (size, md5, ...) we can reuse the same document as olddoc.
+	if f.olddoc == nil || !f.olddoc.Trashed {
+		newdoc.Trashed = false
+	}
+	lockerr := f.fs.mu.Lock()
+	if lockerr != nil {
+		return lockerr
+	}
+	defer f.fs.mu.Unlock()
+	err = f.fs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	// If we reach a conflict error, the document has been modified while
+	// uploading the content of the file.
+	if couchdb.IsConflictError(err) {
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
+		if err != nil {
+			return err
+		}
+		resdoc.Metadata = newdoc.Metadata
+		resdoc.ByteSize = newdoc.ByteSize
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+	}
+	if err != nil {
+		return err
+	}
+
+	stored := false
+	if vfs.DedupEnabled() {
+		if stored, err = f.fs.dedupContent(f.name, newdoc, f.sha.Sum(nil)); err != nil {
+			return err
+		}
+	} else if err = f.fs.move(f.name, MakeObjectName(newdoc.DocID)); err != nil {
+		return err
+	}
+	if f.olddoc != nil {
+		f.fs.releaseOldContent(f.olddoc, newdoc, stored)
+	}
+	return nil
+}
+
+type s3FileOpen struct {
+	obj *minio.Object
+	d   *vfs.Decrypter // decrypts the content, nil if not encrypted
+}
+
+func (f *s3FileOpen) Read(p []byte) (int, error) {
+	if f.d != nil {
+		return f.d.Read(p)
+	}
+	return f.obj.Read(p)
+}
+
+func (f *s3FileOpen) ReadAt(p []byte, off int64) (int, error) {
+	if f.d != nil {
+		return f.d.ReadAt(p, off)
+	}
+	return f.obj.ReadAt(p, off)
+}
+
+func (f *s3FileOpen) Seek(offset int64, whence int) (int64, error) {
+	if f.d != nil {
+		return f.d.Seek(offset, whence)
+	}
+	return f.obj.Seek(offset, whence)
+}
+
+func (f *s3FileOpen) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (f *s3FileOpen) Close() error {
+	return f.obj.Close()
+}
+
+// etagToMD5 returns the md5sum of the content of an object from its ETag, or
+// nil if the object has been sent with a multipart upload, as its ETag is not
+// the md5sum of the content.
+func etagToMD5(etag string) []byte {
+	md5sum, err := hex.DecodeString(strings.Trim(etag, `"`))
+	if err != nil || len(md5sum) != md5.Size {
+		return nil
+	}
+	return md5sum
+}
+
+func objectToFileDoc(objName string, obj minio.ObjectInfo) *vfs.TreeFile {
+	md5sum := etagToMD5(obj.ETag)
+	name := "unknown"
+	mime, class := vfs.ExtractMimeAndClass(obj.ContentType)
+	return &vfs.TreeFile{
+		DirOrFileDoc: vfs.DirOrFileDoc{
+			DirDoc: &vfs.DirDoc{
+				Type:      consts.FileType,
+				DocID:     makeDocID(objName),
+				DocName:   name,
+				DirID:     "",
+				CreatedAt: obj.LastModified,
+				UpdatedAt: obj.LastModified,
+				Fullpath:  path.Join(vfs.OrphansDirName, name),
+			},
+			ByteSize:   obj.Size,
+			Mime:       mime,
+			Class:      class,
+			Executable: false,
+			MD5Sum:     md5sum,
+		},
+	}
+}
+
+var (
+	_ vfs.VFS  = &s3VFS{}
+	_ vfs.File = &s3FileCreation{}
+	_ vfs.File = &s3FileOpen{}
+)
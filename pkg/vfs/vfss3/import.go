@@ -0,0 +1,69 @@
+package vfss3
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ImportDir does nothing, as the directories only exist in the index.
+func (s *s3VFS) ImportDir(doc *vfs.DirDoc) error {
+	return nil
+}
+
+// ImportFileContent uploads the content on the object of the file, or of its
+// version. As the index is kept, the content is encrypted only if the
+// document has the encrypted flag, and it is stored as a blob if the file
+// references one.
+func (s *s3VFS) ImportFileContent(doc *vfs.FileDoc, version *vfs.Version, content io.Reader) error {
+	if lockerr := s.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer s.mu.Unlock()
+
+	objName := MakeObjectName(doc.DocID)
+	dedup := false
+	if version != nil {
+		if version.FileID != doc.ID() {
+			return vfs.ErrVersionNotFound
+		}
+		objName = makeVersionObjectName(version)
+	} else {
+		var err error
+		if dedup, err = vfs.HasBlobRef(s, doc); err != nil {
+			return err
+		}
+		if dedup {
+			objName = makeTmpObjectName(doc.DocID)
+		}
+	}
+	size, encrypted := doc.ByteSize, doc.Encrypted
+	if version != nil {
+		size, encrypted = version.ByteSize, version.Encrypted
+	}
+	if encrypted && s.key == nil {
+		return vfs.ErrEncryptionDisabled
+	}
+	h := sha256.New()
+	content = io.TeeReader(content, h)
+	if encrypted {
+		er := s.encryptingReader(content)
+		defer er.Close()
+		content, size = er, vfs.EncryptedSize(size)
+	}
+	if _, err := s.put(objName, content, size, doc.Mime, nil); err != nil {
+		s.remove(objName) // #nosec
+		return err
+	}
+	if dedup {
+		// The content is kept as the object of the file if it doesn't match
+		// the blob that the file references
+		stored, err := s.dedupContent(objName, doc, h.Sum(nil))
+		if err == nil && !stored {
+			vfs.ReleaseBlob(s, doc, s.removeBlobs)
+		}
+		return err
+	}
+	return nil
+}
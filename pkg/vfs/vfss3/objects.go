@@ -0,0 +1,253 @@
+package vfss3
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	minio "github.com/minio/minio-go/v6"
+)
+
+// The objects of all the instances are stored in the same bucket. The key of
+// an object starts with a prefix for its instance, followed by the name of
+// the object, with the same layout as the layout v2 of swift:
+//
+//   - <docid split>             for the content of a file
+//   - .cozy_versions/<id>/<v>   for the old versions of a file
+//   - .cozy_blobs/<blob id>     for the deduplicated contents
+//   - .cozy_uploads/<id>/<n>    for the chunks of the resumable uploads
+//   - .cozy_tmp/<docid>-<rand>  for the contents being uploaded
+//   - thumbs/<docid split>-<f>  for the thumbnails
+const instancesKeyPrefix = "instances/"
+
+const (
+	versionsObjectPrefix = ".cozy_versions/"
+	blobsObjectPrefix    = ".cozy_blobs/"
+	uploadsObjectPrefix  = ".cozy_uploads/"
+	tmpObjectPrefix      = ".cozy_tmp/"
+	thumbsObjectPrefix   = "thumbs/"
+)
+
+// partSize is the size of the parts for the multipart uploads of the contents
+// whose size is not known in advance. It limits the memory used by an upload,
+// and the maximal size of such a content to 10000 parts.
+const partSize = 16 << 20
+
+// MakeObjectName build the name of the object for a given file document. It
+// creates a virtual subfolder by splitting the document ID, which should be
+// 32 bytes long, to avoid having a flat hierarchy.
+func MakeObjectName(docID string) string {
+	if len(docID) != 32 {
+		return docID
+	}
+	return docID[:22] + "/" + docID[22:27] + "/" + docID[27:]
+}
+
+func makeDocID(objName string) string {
+	if len(objName) != 34 {
+		return objName
+	}
+	return objName[:22] + objName[23:28] + objName[29:]
+}
+
+func makeKeyPrefix(dbPrefix string) string {
+	return instancesKeyPrefix + dbPrefix + "/"
+}
+
+func makeTmpObjectName(docID string) string {
+	return tmpObjectPrefix + docID + "-" + utils.RandomString(16)
+}
+
+// isInternalObjectName returns true for the objects that are not the content
+// of a file.
+func isInternalObjectName(objName string) bool {
+	for _, prefix := range []string{versionsObjectPrefix, blobsObjectPrefix,
+		uploadsObjectPrefix, tmpObjectPrefix, thumbsObjectPrefix} {
+		if strings.HasPrefix(objName, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NoSuchBucket"
+}
+
+func wrapS3Err(err error) error {
+	if isNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// objects is a helper for the operations on the objects of a bucket whose
+// keys start with the same prefix.
+type objects struct {
+	c      *minio.Client
+	bucket string
+	prefix string
+}
+
+func (o *objects) key(objName string) string {
+	return o.prefix + objName
+}
+
+func (o *objects) stat(objName string) (minio.ObjectInfo, error) {
+	return o.c.StatObject(o.bucket, o.key(objName), minio.StatObjectOptions{})
+}
+
+func (o *objects) exists(objName string) (bool, error) {
+	_, err := o.stat(objName)
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// open returns the object for reading, and os.ErrNotExist if it does not
+// exist, as the errors of the GET request are only known on the first read.
+func (o *objects) open(objName string) (*minio.Object, minio.ObjectInfo, error) {
+	obj, err := o.c.GetObject(o.bucket, o.key(objName), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, minio.ObjectInfo{}, wrapS3Err(err)
+	}
+	return obj, info, nil
+}
+
+// put writes an object. If the size is negative, the content is sent with a
+// multipart upload.
+func (o *objects) put(objName string, r io.Reader, size int64, contentType string, meta map[string]string) (int64, error) {
+	opts := minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: meta,
+	}
+	if size < 0 {
+		opts.PartSize = partSize
+	}
+	return o.c.PutObject(o.bucket, o.key(objName), r, size, opts)
+}
+
+// copy makes a server-side copy of an object, with its metadata. A multipart
+// copy is used for the large objects.
+func (o *objects) copy(src, dst string) error {
+	dstInfo, err := minio.NewDestinationInfo(o.bucket, o.key(dst), nil, nil)
+	if err != nil {
+		return err
+	}
+	srcInfo := minio.NewSourceInfo(o.bucket, o.key(src), nil)
+	return wrapS3Err(o.c.ComposeObject(dstInfo, []minio.SourceInfo{srcInfo}))
+}
+
+// move renames an object, with a server-side copy, as S3 has no rename
+// operation.
+func (o *objects) move(src, dst string) error {
+	if err := o.copy(src, dst); err != nil {
+		return err
+	}
+	return o.remove(src)
+}
+
+func (o *objects) remove(objName string) error {
+	err := o.c.RemoveObject(o.bucket, o.key(objName))
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// removeAll removes the objects with the given names. It is not an error if
+// some of them don't exist.
+func (o *objects) removeAll(objNames []string) error {
+	if len(objNames) == 0 {
+		return nil
+	}
+	keys := make(chan string, len(objNames))
+	for _, objName := range objNames {
+		keys <- o.key(objName)
+	}
+	close(keys)
+	var err error
+	for res := range o.c.RemoveObjects(o.bucket, keys) {
+		if res.Err != nil && !isNotFound(res.Err) && err == nil {
+			err = res.Err
+		}
+	}
+	return err
+}
+
+// list calls fn for each object whose name starts with the given prefix.
+func (o *objects) list(prefix string, fn func(objName string, info minio.ObjectInfo) error) error {
+	done := make(chan struct{})
+	defer close(done)
+	for info := range o.c.ListObjectsV2(o.bucket, o.key(prefix), true, done) {
+		if info.Err != nil {
+			return info.Err
+		}
+		if err := fn(strings.TrimPrefix(info.Key, o.prefix), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// names returns the names of the objects that start with the given prefix.
+func (o *objects) names(prefix string) ([]string, error) {
+	var objNames []string
+	err := o.list(prefix, func(objName string, _ minio.ObjectInfo) error {
+		objNames = append(objNames, objName)
+		return nil
+	})
+	return objNames, err
+}
+
+// removePrefix removes all the objects whose names start with the prefix.
+func (o *objects) removePrefix(prefix string) error {
+	objNames, err := o.names(prefix)
+	if err != nil {
+		return err
+	}
+	return o.removeAll(objNames)
+}
+
+// writer returns a writer for an object: the content is sent to S3 by a
+// goroutine, with a pipe, and the result of the upload is known when the
+// writer is closed.
+func (o *objects) writer(objName string, size int64, contentType string, meta map[string]string) *objectWriter {
+	pr, pw := io.Pipe()
+	w := &objectWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := o.put(objName, pr, size, contentType, meta)
+		pr.CloseWithError(err) // #nosec
+		w.done <- err
+	}()
+	return w
+}
+
+type objectWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close ends the content of the object, and waits for the end of the upload.
+func (w *objectWriter) Close() error {
+	w.pw.Close() // #nosec
+	return <-w.done
+}
+
+// Abort interrupts the upload.
+func (w *objectWriter) Abort(err error) {
+	w.pw.CloseWithError(err) // #nosec
+	<-w.done
+}
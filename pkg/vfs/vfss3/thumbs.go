@@ -0,0 +1,101 @@
+package vfss3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	minio "github.com/minio/minio-go/v6"
+)
+
+var unixEpochZero = time.Time{}
+
+var errThumbAborted = errors.New("vfss3: the thumbnail has been aborted")
+
+// NewThumbsFs creates a new thumb filesystem on S3. The thumbnails are stored
+// in the same bucket as the contents of the files.
+func NewThumbsFs(c *minio.Client, bucket string, db prefixer.Prefixer) vfs.Thumbser {
+	return &thumbs{objects{
+		c:      c,
+		bucket: bucket,
+		prefix: makeKeyPrefix(db.DBPrefix()),
+	}}
+}
+
+type thumbs struct {
+	objects
+}
+
+type thumb struct {
+	*objectWriter
+	t    *thumbs
+	name string
+}
+
+func (t *thumb) Abort() error {
+	t.objectWriter.Abort(errThumbAborted)
+	return t.t.remove(t.name)
+}
+
+func (t *thumb) Commit() error {
+	return t.objectWriter.Close()
+}
+
+func (t *thumbs) CreateThumb(img *vfs.FileDoc, format string) (vfs.ThumbFiler, error) {
+	name := t.makeName(img, format)
+	meta := map[string]string{
+		"file-md5": hex.EncodeToString(img.MD5Sum),
+	}
+	w := t.writer(name, -1, img.Mime, meta)
+	return &thumb{objectWriter: w, t: t, name: name}, nil
+}
+
+func (t *thumbs) ThumbExists(img *vfs.FileDoc, format string) (bool, error) {
+	info, err := t.stat(t.makeName(img, format))
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size == 0 {
+		return false, nil
+	}
+	if md5 := info.Metadata.Get("X-Amz-Meta-File-Md5"); md5 != "" {
+		md5sum, err := hex.DecodeString(md5)
+		if err == nil && !bytes.Equal(md5sum, img.MD5Sum) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *thumbs) RemoveThumbs(img *vfs.FileDoc, formats []string) error {
+	objNames := make([]string, len(formats))
+	for i, format := range formats {
+		objNames[i] = t.makeName(img, format)
+	}
+	return t.removeAll(objNames)
+}
+
+func (t *thumbs) ServeThumbContent(w http.ResponseWriter, req *http.Request, img *vfs.FileDoc, format string) error {
+	name := t.makeName(img, format)
+	obj, info, err := t.open(name)
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+
+	w.Header().Set("Etag", fmt.Sprintf(`"%s"`, info.ETag))
+	http.ServeContent(w, req, name, unixEpochZero, obj)
+	return nil
+}
+
+func (t *thumbs) makeName(img *vfs.FileDoc, format string) string {
+	return fmt.Sprintf("%s%s-%s", thumbsObjectPrefix, MakeObjectName(img.ID()), format)
+}
@@ -0,0 +1,57 @@
+package vfss3
+
+import (
+	"io"
+	"strconv"
+)
+
+func makeChunkObjectName(sessionID string, index int) string {
+	return uploadsObjectPrefix + sessionID + "/" + strconv.Itoa(index)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The chunks of the upload sessions don't need the lock of the VFS, as they
+// are not visible in the tree of the files.
+
+func (s *s3VFS) PutUploadChunk(sessionID string, index int, content io.Reader) (int64, bool, error) {
+	objName := makeChunkObjectName(sessionID, index)
+	cr := &countingReader{r: content}
+	var r io.Reader = cr
+	encrypted := s.key != nil
+	if encrypted {
+		er := s.encryptingReader(cr)
+		defer er.Close()
+		r = er
+	}
+	if _, err := s.put(objName, r, -1, "application/octet-stream", nil); err != nil {
+		s.remove(objName) // #nosec
+		return 0, false, err
+	}
+	return cr.n, encrypted, nil
+}
+
+func (s *s3VFS) OpenUploadChunk(sessionID string, index int, encrypted bool) (io.ReadCloser, error) {
+	obj, info, err := s.open(makeChunkObjectName(sessionID, index))
+	if err != nil {
+		return nil, err
+	}
+	return s.openFile(obj, info, encrypted)
+}
+
+func (s *s3VFS) DeleteUploadChunk(sessionID string, index int) error {
+	return s.remove(makeChunkObjectName(sessionID, index))
+}
+
+func (s *s3VFS) DeleteUploadChunks(sessionID string) error {
+	return s.removePrefix(uploadsObjectPrefix + sessionID + "/")
+}
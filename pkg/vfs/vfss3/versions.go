@@ -0,0 +1,19 @@
+package vfss3
+
+import (
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+func makeVersionObjectName(version *vfs.Version) string {
+	return versionsObjectPrefix + version.FileID + "/" + version.ShortID()
+}
+
+// removeVersions removes the objects of the old versions of a file, for
+// vfs.DestroyVersions.
+func (s *s3VFS) removeVersions(fileID string, versions []*vfs.Version) error {
+	objNames := make([]string, len(versions))
+	for i, v := range versions {
+		objNames[i] = makeVersionObjectName(v)
+	}
+	return s.removeAll(objNames)
+}
@@ -0,0 +1,138 @@
+package vfsswift
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// blobsObjectPrefix is the prefix of the names of the objects used to store
+// the deduplicated contents of the files. Only the layout v2 supports the
+// deduplication.
+const blobsObjectPrefix = ".cozy_blobs/"
+
+// blobsTmpObjectPrefix is the prefix of the objects where the contents are
+// written when the deduplication is enabled, as the md5sum is only known at
+// the end of the upload.
+const blobsTmpObjectPrefix = blobsObjectPrefix + "tmp/"
+
+func makeBlobObjectName(blobID string) string {
+	return blobsObjectPrefix + blobID
+}
+
+func makeTmpBlobObjectName(docID string) string {
+	return blobsTmpObjectPrefix + docID + "-" + utils.RandomString(16)
+}
+
+func isBlobObjectName(objName string) bool {
+	return strings.HasPrefix(objName, blobsObjectPrefix)
+}
+
+func (sfs *swiftVFSV2) blobStored(b *vfs.Blob) (bool, error) {
+	_, _, err := sfs.c.Object(sfs.container, makeBlobObjectName(b.ID()))
+	if err == swift.ObjectNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// contentObjectName returns the name of the object with the content of a
+// file: its blob if the file references it, or its own object. A blob with
+// the same md5sum is not enough, as it can have another content.
+func (sfs *swiftVFSV2) contentObjectName(doc *vfs.FileDoc) (string, error) {
+	dedup, err := vfs.HasBlobRef(sfs, doc)
+	if err != nil {
+		return "", err
+	}
+	if dedup {
+		return makeBlobObjectName(vfs.BlobID(doc)), nil
+	}
+	return MakeObjectName(doc.DocID), nil
+}
+
+// openContent opens the object with the content of a file.
+func (sfs *swiftVFSV2) openContent(doc *vfs.FileDoc) (*swift.ObjectOpenFile, error) {
+	objName, err := sfs.contentObjectName(doc)
+	if err != nil {
+		return nil, err
+	}
+	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	return f, err
+}
+
+// copyContentToVersion is the same as copyToVersion, but it looks for the
+// content of the file in its blob too.
+func (sfs *swiftVFSV2) copyContentToVersion(doc *vfs.FileDoc, version *vfs.Version) error {
+	objName, err := sfs.contentObjectName(doc)
+	if err != nil {
+		return err
+	}
+	return copyToVersion(sfs.c, sfs.container, objName, version)
+}
+
+// storeBlob makes the temporary object the blob for its content, or removes
+// it if the blob already exists with the same sha256, and adds a reference
+// from the file to the blob.
+func (sfs *swiftVFSV2) storeBlob(tmpName string, doc *vfs.FileDoc, sha256sum []byte) error {
+	blobName := makeBlobObjectName(vfs.BlobID(doc))
+	_, _, err := sfs.c.Object(sfs.container, blobName)
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	stored := err == nil
+	if err = vfs.CheckBlobContent(sfs, doc, sha256sum, stored); err != nil {
+		return err
+	}
+	if stored {
+		err = sfs.c.ObjectDelete(sfs.container, tmpName)
+	} else {
+		err = sfs.c.ObjectMove(sfs.container, tmpName, sfs.container, blobName)
+	}
+	if err != nil {
+		return err
+	}
+	return vfs.AddBlobRef(sfs, doc, sha256sum)
+}
+
+// dedupContent is called when the content of a file, with the given sha256,
+// has been written on a temporary object. If this content can't be
+// deduplicated, the object is moved to the object of the file. It returns
+// true if the content has been stored as a blob.
+func (sfs *swiftVFSV2) dedupContent(tmpName string, doc *vfs.FileDoc, sha256sum []byte) (bool, error) {
+	if err := sfs.storeBlob(tmpName, doc, sha256sum); err != nil {
+		sfs.log.Warnf("Could not deduplicate the content of %s: %s", doc.ID(), err)
+		return false, sfs.c.ObjectMove(sfs.container, tmpName, sfs.container, MakeObjectName(doc.DocID))
+	}
+	return true, nil
+}
+
+// releaseOldContent is called when the content of a file has been replaced,
+// to remove the reference to the blob of the old content, or the object of
+// the file if the new content is a blob. The errors are only logged, as the
+// new content has already been written.
+func (sfs *swiftVFSV2) releaseOldContent(olddoc, newdoc *vfs.FileDoc, stored bool) {
+	if stored {
+		err := sfs.c.ObjectDelete(sfs.container, MakeObjectName(olddoc.DocID))
+		if err != nil && err != swift.ObjectNotFound {
+			sfs.log.Warnf("Could not remove the object of %s: %s", olddoc.ID(), err)
+		}
+	}
+	vfs.ReleaseOldBlob(sfs, olddoc, newdoc, stored, sfs.removeBlobs)
+}
+
+// removeBlobs removes the objects of the blobs that are no longer referenced.
+func (sfs *swiftVFSV2) removeBlobs(blobs []*vfs.Blob) error {
+	for _, b := range blobs {
+		err := sfs.c.ObjectDelete(sfs.container, makeBlobObjectName(b.ID()))
+		if err != nil && err != swift.ObjectNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package vfsswift
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// encryptingObjectPrefix is the prefix of the temporary objects used when the
+// contents of an instance are encrypted by the migration.
+const encryptingObjectPrefix = ".cozy_encrypting/"
+
+// openFile returns the file for reading an object, and decrypts its content
+// if its document says that it has been encrypted.
+func (sfs *swiftVFSV2) openFile(f *swift.ObjectOpenFile, encrypted bool) (vfs.File, error) {
+	if !encrypted {
+		return &swiftFileOpenV2{f: f}, nil
+	}
+	if sfs.key == nil {
+		f.Close()
+		return nil, vfs.ErrEncryptionDisabled
+	}
+	length, err := f.Length()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d, err := vfs.NewDecrypter(f, length, sfs.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &swiftFileOpenV2{f: f, d: d}, nil
+}
+
+func (sfs *swiftVFSV2) putEncryptedUploadChunk(sessionID string, index int, content io.Reader) (int64, error) {
+	objName := makeChunkObjectName(sessionID, index)
+	f, err := sfs.c.ObjectCreate(sfs.container, objName, false, "", "application/octet-stream", nil)
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	enc, err := vfs.NewEncrypter(f, sfs.key)
+	if err == nil {
+		n, err = io.Copy(enc, content)
+		if errc := enc.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return 0, err
+	}
+	return n, nil
+}
+
+// EncryptContents encrypts the objects of the files and of their old versions
+// that have been written in clear before the encryption was enabled, and sets
+// the encrypted flag on their documents. The content of a deduplicated file
+// is encrypted on the blob of the encrypted content. The chunks of the upload
+// sessions are left as they are, as they are removed with their sessions.
+func (sfs *swiftVFSV2) EncryptContents() error {
+	if sfs.key == nil {
+		return vfs.ErrEncryptionDisabled
+	}
+	return vfs.Walk(sfs, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil || file == nil {
+			return err
+		}
+		return sfs.encryptFile(file)
+	})
+}
+
+func (sfs *swiftVFSV2) encryptFile(file *vfs.FileDoc) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	olddoc, err := sfs.Indexer.FileByID(file.ID())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !olddoc.Encrypted {
+		if err = sfs.encryptFileContent(olddoc); err != nil {
+			return err
+		}
+	}
+
+	versions, err := vfs.VersionsFor(sfs, olddoc.ID())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Encrypted {
+			continue
+		}
+		objName := makeVersionObjectName(version)
+		if err = sfs.encryptObject(objName, objName); err != nil {
+			return err
+		}
+		version.Encrypted = true
+		if err = couchdb.UpdateDoc(sfs, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sfs *swiftVFSV2) encryptFileContent(olddoc *vfs.FileDoc) error {
+	newdoc := olddoc.Clone().(*vfs.FileDoc)
+	newdoc.Encrypted = true
+	b, err := vfs.GetBlob(sfs, vfs.BlobID(olddoc))
+	if err != nil && !couchdb.IsNotFoundError(err) && !couchdb.IsNoDatabaseError(err) {
+		return err
+	}
+	if b == nil || !b.HasRef(olddoc.ID()) {
+		objName := MakeObjectName(olddoc.DocID)
+		if err = sfs.encryptObject(objName, objName); err != nil {
+			return err
+		}
+		return sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	}
+
+	// The file is deduplicated: it now references the blob of the encrypted
+	// content, and an object left by the time the file was not deduplicated
+	// is removed as it is in clear.
+	blobName := makeBlobObjectName(vfs.BlobID(newdoc))
+	_, _, err = sfs.c.Object(sfs.container, blobName)
+	stored := err == nil
+	if err == nil || err == swift.ObjectNotFound {
+		err = vfs.CheckBlobContent(sfs, newdoc, b.SHA256, stored)
+	}
+	if err == vfs.ErrBlobMismatch {
+		// The blob of the encrypted content has another content: the file
+		// is no longer deduplicated, and its content is encrypted in its
+		// own object.
+		if err = sfs.encryptObject(makeBlobObjectName(b.ID()), MakeObjectName(olddoc.DocID)); err != nil {
+			return err
+		}
+		if err = sfs.Indexer.UpdateFileDoc(olddoc, newdoc); err != nil {
+			return err
+		}
+		vfs.ReleaseBlob(sfs, olddoc, sfs.removeBlobs)
+		return nil
+	}
+	if err == nil && !stored {
+		err = sfs.encryptObject(makeBlobObjectName(b.ID()), blobName)
+	}
+	if err == nil {
+		err = vfs.AddBlobRef(sfs, newdoc, b.SHA256)
+	}
+	if err == nil {
+		err = sfs.Indexer.UpdateFileDoc(olddoc, newdoc)
+	}
+	if err != nil {
+		return err
+	}
+	vfs.ReleaseBlob(sfs, olddoc, sfs.removeBlobs)
+	err = sfs.c.ObjectDelete(sfs.container, MakeObjectName(olddoc.DocID))
+	if err == swift.ObjectNotFound {
+		err = nil
+	}
+	return err
+}
+
+// encryptObject writes the encrypted content of the src object on a
+// temporary object, that is then moved to dst with its metadata. A content
+// encrypted by a previous run of the migration, that was interrupted before
+// its document was updated, is not encrypted again.
+func (sfs *swiftVFSV2) encryptObject(src, dst string) error {
+	in, headers, err := sfs.c.ObjectOpen(sfs.container, src, false, nil)
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	length, err := in.Length()
+	if err != nil {
+		return err
+	}
+	encrypted, err := vfs.EncryptedWith(in, length, sfs.key)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		if src == dst {
+			return nil
+		}
+		_, err = sfs.c.ObjectCopy(sfs.container, src, sfs.container, dst, nil)
+		return err
+	}
+
+	// The metadata of the object are kept on the encrypted object
+	objHeaders := make(swift.Headers)
+	for k, v := range headers {
+		if strings.HasPrefix(strings.ToLower(k), "x-object-meta-") {
+			objHeaders[k] = v
+		}
+	}
+	tmpName := encryptingObjectPrefix + utils.RandomString(16)
+	out, err := sfs.c.ObjectCreate(sfs.container, tmpName, false, "", headers["Content-Type"], objHeaders)
+	if err != nil {
+		return err
+	}
+	enc, err := vfs.NewEncrypter(out, sfs.key)
+	if err == nil {
+		_, err = io.Copy(enc, in)
+		if errc := enc.Close(); errc != nil && err == nil {
+			err = errc
+		}
+	}
+	if errc := out.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err == nil {
+		err = sfs.c.ObjectMove(sfs.container, tmpName, sfs.container, dst)
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(sfs.container, tmpName) // #nosec
+	}
+	return err
+}
+
+// EncryptContents is not supported by the layout v1.
+func (sfs *swiftVFS) EncryptContents() error {
+	return vfs.ErrEncryptionNotSupported
+}
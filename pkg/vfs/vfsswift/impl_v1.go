@@ -9,7 +9,6 @@ import (
 	"path"
 	"strings"
 
-	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/lock"
@@ -42,13 +41,13 @@ type swiftVFS struct {
 }
 
 // New returns a vfs.VFS instance associated with the specified indexer and the
-// swift storage url.
-func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+// swift connection to the storage.
+func New(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, c *swift.Connection) (vfs.VFS, error) {
 	return &swiftVFS{
 		Indexer:         index,
 		DiskThresholder: disk,
 
-		c:             config.GetSwiftConnection(),
+		c:             c,
 		domain:        db.DomainName(),
 		prefix:        db.DBPrefix(),
 		container:     swiftV1ContainerPrefix + db.DBPrefix(),
@@ -73,6 +72,7 @@ func (sfs *swiftVFS) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		DiskThresholder: sfs.DiskThresholder,
 		c:               sfs.c,
 		domain:          sfs.domain,
+		prefix:          sfs.prefix,
 		container:       sfs.container,
 		version:         sfs.version,
 		mu:              sfs.mu,
@@ -204,30 +204,10 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 	}
 	defer sfs.mu.Unlock()
 
-	diskQuota := sfs.DiskQuota()
-
-	var maxsize, newsize, oldsize, capsize int64
-	newsize = newdoc.ByteSize
-	if diskQuota > 0 {
-		diskUsage, err := sfs.DiskUsage()
-		if err != nil {
-			return nil, err
-		}
-		if olddoc != nil {
-			oldsize = olddoc.Size()
-		}
-		maxsize = diskQuota - diskUsage
-		if maxsize > maxFileSize {
-			maxsize = maxFileSize
-		}
-		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
-			capsize = quotaBytes - diskUsage
-		}
-	} else {
-		maxsize = maxFileSize
-	}
-	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
-		return nil, vfs.ErrFileTooBig
+	newsize := newdoc.ByteSize
+	maxsize, capsize, keepVersion, err := vfs.CheckAvailableDiskSpace(sfs, newdoc, olddoc, maxFileSize)
+	if err != nil {
+		return nil, err
 	}
 
 	if olddoc != nil {
@@ -249,6 +229,9 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		newdoc.ByteSize = 0
 	}
 
+	// The layout v1 does not support the encryption.
+	newdoc.Encrypted = false
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -274,6 +257,15 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		}
 	}
 
+	var version *vfs.Version
+	if keepVersion {
+		version = vfs.NewVersion(olddoc)
+		if err = copyToVersion(sfs.c, sfs.container, olddoc.DirID+"/"+olddoc.DocName, version); err != nil {
+			sfs.log.Warnf("Could not keep the version of %s: %s", olddoc.ID(), err)
+			version = nil
+		}
+	}
+
 	objName := newdoc.DirID + "/" + newdoc.DocName
 	hash := hex.EncodeToString(newdoc.MD5Sum)
 	f, err := sfs.c.ObjectCreate(
@@ -285,6 +277,9 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		nil,
 	)
 	if err != nil {
+		if version != nil {
+			sfs.c.ObjectDelete(sfs.container, makeVersionObjectName(version)) // #nosec
+		}
 		return nil, err
 	}
 	return &swiftFileCreation{
@@ -296,6 +291,7 @@ func (sfs *swiftVFS) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error) {
 		meta:    vfs.NewMetaExtractor(newdoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		version: version,
 		maxsize: maxsize,
 		capsize: capsize,
 	}, nil
@@ -391,7 +387,11 @@ func (sfs *swiftVFS) destroyFile(doc *vfs.FileDoc) error {
 	if err != nil && err != swift.ObjectNotFound {
 		return err
 	}
-	return sfs.Indexer.DeleteFileDoc(doc)
+	if err = sfs.Indexer.DeleteFileDoc(doc); err != nil {
+		return err
+	}
+	vfs.DestroyVersions(sfs, []string{doc.ID()}, removeVersions(sfs.c, sfs.container))
+	return nil
 }
 
 func (sfs *swiftVFS) destroyFileVersions(objName string) error {
@@ -426,6 +426,46 @@ func (sfs *swiftVFS) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 	return &swiftFileOpen{f, nil}, nil
 }
 
+func (sfs *swiftVFS) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	f, err := openVersion(sfs.c, sfs.container, doc, version)
+	if err != nil {
+		return nil, err
+	}
+	return &swiftFileOpen{f, nil}, nil
+}
+
+func (sfs *swiftVFS) CleanOldVersion(fileID string, version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return cleanVersion(sfs.c, sfs.container, sfs, fileID, version)
+}
+
+func (sfs *swiftVFS) PutUploadChunk(sessionID string, index int, content io.Reader) (int64, bool, error) {
+	n, err := putUploadChunk(sfs.c, sfs.container, sessionID, index, content)
+	return n, false, err
+}
+
+func (sfs *swiftVFS) OpenUploadChunk(sessionID string, index int, encrypted bool) (io.ReadCloser, error) {
+	if encrypted {
+		return nil, vfs.ErrEncryptionNotSupported
+	}
+	return openUploadChunk(sfs.c, sfs.container, sessionID, index)
+}
+
+func (sfs *swiftVFS) DeleteUploadChunk(sessionID string, index int) error {
+	return deleteUploadChunk(sfs.c, sfs.container, sessionID, index)
+}
+
+func (sfs *swiftVFS) DeleteUploadChunks(sessionID string) error {
+	return deleteUploadChunks(sfs.c, sfs.container, sessionID)
+}
+
 func (sfs *swiftVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 	entries := make(map[string]*vfs.TreeFile, 1024)
 	_, err = sfs.BuildTree(func(f *vfs.TreeFile) {
@@ -446,6 +486,9 @@ func (sfs *swiftVFS) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 			return nil, err
 		}
 		for _, obj := range objs {
+			if isVersionObjectName(obj.Name) || isUploadObjectName(obj.Name) {
+				continue
+			}
 			f, ok := entries[obj.Name]
 			if !ok {
 				orphansObjs = append(orphansObjs, obj)
@@ -659,6 +702,7 @@ type swiftFileCreation struct {
 	meta    *vfs.MetaExtractor
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
+	version *vfs.Version
 	maxsize int64
 	capsize int64
 }
@@ -709,10 +753,20 @@ func (f *swiftFileCreation) Close() (err error) {
 			if f.capsize > 0 && f.size >= f.capsize {
 				vfs.PushDiskQuotaAlert(f.fs, true)
 			}
+			if f.version != nil {
+				if errv := persistVersion(f.fs.c, f.fs.container, f.fs, f.version); errv != nil {
+					f.fs.log.Warnf("Could not keep the version of %s: %s", f.olddoc.ID(), errv)
+				} else if errc := vfs.CleanOldVersions(f.fs, f.olddoc.ID()); errc != nil {
+					f.fs.log.Warnf("Could not clean the versions of %s: %s", f.olddoc.ID(), errc)
+				}
+			}
 		} else {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
 			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			if f.version != nil {
+				f.fs.c.ObjectDelete(f.fs.container, makeVersionObjectName(f.version)) // #nosec
+			}
 
 			// If an error has occurred that is not due to the index update, we should
 			// delete the file from the index.
@@ -2,7 +2,10 @@ package vfsswift
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
@@ -11,9 +14,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/keymgmt"
 	"github.com/cozy/cozy-stack/pkg/lock"
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
@@ -34,6 +37,7 @@ type swiftVFSV2 struct {
 	dataContainer string
 	mu            lock.ErrorRWLocker
 	log           *logrus.Entry
+	key           *keymgmt.SecretKey
 }
 
 const (
@@ -42,17 +46,21 @@ const (
 )
 
 // NewV2 returns a vfs.VFS instance associated with the specified indexer and
-// the swift storage url.
+// the swift connection to the storage.
 //
 // This version implements a simpler layout where swift does not contain any
 // hierarchy: meaning no index informations. This help with index incoherency
 // and as many performance improvements regarding moving / renaming folders.
-func NewV2(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker) (vfs.VFS, error) {
+func NewV2(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu lock.ErrorRWLocker, c *swift.Connection) (vfs.VFS, error) {
+	key, err := vfs.ContentKey(db)
+	if err != nil {
+		return nil, err
+	}
 	return &swiftVFSV2{
 		Indexer:         index,
 		DiskThresholder: disk,
 
-		c:             config.GetSwiftConnection(),
+		c:             c,
 		domain:        db.DomainName(),
 		prefix:        db.DBPrefix(),
 		container:     swiftV2ContainerPrefixCozy + db.DBPrefix(),
@@ -60,6 +68,7 @@ func NewV2(db prefixer.Prefixer, index vfs.Indexer, disk vfs.DiskThresholder, mu
 		dataContainer: swiftV2ContainerPrefixData + db.DBPrefix(),
 		mu:            mu,
 		log:           logger.WithDomain(db.DomainName()).WithField("nspace", "vfsswift"),
+		key:           key,
 	}, nil
 }
 
@@ -94,11 +103,13 @@ func (sfs *swiftVFSV2) UseSharingIndexer(index vfs.Indexer) vfs.VFS {
 		DiskThresholder: sfs.DiskThresholder,
 		c:               sfs.c,
 		domain:          sfs.domain,
+		prefix:          sfs.prefix,
 		container:       sfs.container,
 		version:         sfs.version,
 		dataContainer:   sfs.dataContainer,
 		mu:              sfs.mu,
 		log:             sfs.log,
+		key:             sfs.key,
 	}
 }
 
@@ -119,6 +130,10 @@ func (sfs *swiftVFSV2) InitFs() error {
 	if err := sfs.Indexer.InitIndex(); err != nil {
 		return err
 	}
+	return sfs.createContainers()
+}
+
+func (sfs *swiftVFSV2) createContainers() error {
 	if err := sfs.c.VersionContainerCreate(sfs.container, sfs.version); err != nil {
 		if err != swift.Forbidden {
 			sfs.log.Errorf("Could not create container %s: %s",
@@ -217,30 +232,10 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 	}
 	defer sfs.mu.Unlock()
 
-	diskQuota := sfs.DiskQuota()
-
-	var maxsize, newsize, oldsize, capsize int64
-	newsize = newdoc.ByteSize
-	if diskQuota > 0 {
-		diskUsage, err := sfs.DiskUsage()
-		if err != nil {
-			return nil, err
-		}
-		if olddoc != nil {
-			oldsize = olddoc.Size()
-		}
-		maxsize = diskQuota - diskUsage
-		if maxsize > maxFileSize {
-			maxsize = maxFileSize
-		}
-		if quotaBytes := int64(9.0 / 10.0 * float64(diskQuota)); diskUsage <= quotaBytes {
-			capsize = quotaBytes - diskUsage
-		}
-	} else {
-		maxsize = maxFileSize
-	}
-	if maxsize <= 0 || (newsize >= 0 && (newsize-oldsize) > maxsize) {
-		return nil, vfs.ErrFileTooBig
+	newsize := newdoc.ByteSize
+	maxsize, capsize, keepVersion, err := vfs.CheckAvailableDiskSpace(sfs, newdoc, olddoc, maxFileSize)
+	if err != nil {
+		return nil, err
 	}
 
 	if olddoc != nil {
@@ -262,6 +257,9 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		newdoc.ByteSize = 0
 	}
 
+	// The content is encrypted when the instance has a key for its files.
+	newdoc.Encrypted = sfs.key != nil
+
 	if olddoc == nil {
 		var exists bool
 		exists, err = sfs.Indexer.DirChildExists(newdoc.DirID, newdoc.DocName)
@@ -287,33 +285,76 @@ func (sfs *swiftVFSV2) CreateFile(newdoc, olddoc *vfs.FileDoc) (vfs.File, error)
 		}
 	}
 
+	var version *vfs.Version
+	if keepVersion {
+		version = vfs.NewVersion(olddoc)
+		if err = sfs.copyContentToVersion(olddoc, version); err != nil {
+			sfs.log.Warnf("Could not keep the version of %s: %s", olddoc.ID(), err)
+			version = nil
+		}
+	}
+
+	// With the deduplication, the content is written on a temporary object,
+	// that will become a blob when the file is closed.
+	dedup := vfs.DedupEnabled()
 	objName := MakeObjectName(newdoc.DocID)
+	if dedup {
+		objName = makeTmpBlobObjectName(newdoc.DocID)
+	}
 	objMeta := swift.Metadata{
 		"creation-name": newdoc.Name(),
 		"created-at":    newdoc.CreatedAt.Format(time.RFC3339),
 		"exec":          strconv.FormatBool(newdoc.Executable),
 	}
-	hash := hex.EncodeToString(newdoc.MD5Sum)
+	// With the encryption, swift can't check the md5sum of the content, and
+	// it is computed by the stack.
+	checksum := hex.EncodeToString(newdoc.MD5Sum)
+	if sfs.key != nil {
+		checksum = ""
+	}
+	var enc *vfs.Encrypter
 	f, err := sfs.c.ObjectCreate(
 		sfs.container,
 		objName,
-		true,
-		hash,
+		sfs.key == nil,
+		checksum,
 		newdoc.Mime,
 		objMeta.ObjectHeaders(),
 	)
+	if err == nil && sfs.key != nil {
+		enc, err = vfs.NewEncrypter(f, sfs.key)
+		if err != nil {
+			f.Close()                                  // #nosec
+			sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		}
+	}
 	if err != nil {
+		if version != nil {
+			sfs.c.ObjectDelete(sfs.container, makeVersionObjectName(version)) // #nosec
+		}
 		return nil, err
 	}
+	var md5h, shah hash.Hash
+	if enc != nil {
+		md5h = md5.New()
+	}
+	if dedup {
+		shah = sha256.New()
+	}
 	return &swiftFileCreationV2{
 		f:       f,
+		enc:     enc,
+		hash:    md5h,
+		sha:     shah,
 		fs:      sfs,
 		w:       0,
 		size:    newsize,
 		name:    objName,
+		dedup:   dedup,
 		meta:    vfs.NewMetaExtractor(newdoc),
 		newdoc:  newdoc,
 		olddoc:  olddoc,
+		version: version,
 		maxsize: maxsize,
 		capsize: capsize,
 	}, nil
@@ -330,6 +371,8 @@ func (sfs *swiftVFSV2) DestroyDirContent(doc *vfs.DirDoc) error {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	vfs.DestroyVersions(sfs, ids, removeVersions(sfs.c, sfs.container))
+	vfs.ReleaseBlobs(sfs, ids, sfs.removeBlobs)
 	objNames := make([]string, len(ids))
 	for i, id := range ids {
 		objNames[i] = MakeObjectName(id)
@@ -357,6 +400,8 @@ func (sfs *swiftVFSV2) DestroyDirAndContent(doc *vfs.DirDoc) error {
 		return err
 	}
 	vfs.DiskQuotaAfterDestroy(sfs, diskUsage, destroyed)
+	vfs.DestroyVersions(sfs, ids, removeVersions(sfs.c, sfs.container))
+	vfs.ReleaseBlobs(sfs, ids, sfs.removeBlobs)
 	objNames := make([]string, len(ids))
 	for i, id := range ids {
 		objNames[i] = MakeObjectName(id)
@@ -382,9 +427,15 @@ func (sfs *swiftVFSV2) DestroyFile(doc *vfs.FileDoc) error {
 	err := sfs.Indexer.DeleteFileDoc(doc)
 	if err == nil {
 		err = sfs.c.ObjectDelete(sfs.container, MakeObjectName(doc.DocID))
+		// A deduplicated file has no object, only a reference to a blob
+		if err == swift.ObjectNotFound {
+			err = nil
+		}
 	}
 	if err == nil {
 		vfs.DiskQuotaAfterDestroy(sfs, diskUsage, doc.ByteSize)
+		vfs.DestroyVersions(sfs, []string{doc.ID()}, removeVersions(sfs.c, sfs.container))
+		vfs.ReleaseBlob(sfs, doc, sfs.removeBlobs)
 	}
 	return err
 }
@@ -394,15 +445,59 @@ func (sfs *swiftVFSV2) OpenFile(doc *vfs.FileDoc) (vfs.File, error) {
 		return nil, lockerr
 	}
 	defer sfs.mu.RUnlock()
-	objName := MakeObjectName(doc.DocID)
-	f, _, err := sfs.c.ObjectOpen(sfs.container, objName, false, nil)
+	f, err := sfs.openContent(doc)
+	if err != nil {
+		return nil, err
+	}
+	return sfs.openFile(f, doc.Encrypted)
+}
+
+func (sfs *swiftVFSV2) OpenFileVersion(doc *vfs.FileDoc, version *vfs.Version) (vfs.File, error) {
+	if lockerr := sfs.mu.RLock(); lockerr != nil {
+		return nil, lockerr
+	}
+	defer sfs.mu.RUnlock()
+	f, err := openVersion(sfs.c, sfs.container, doc, version)
+	if err != nil {
+		return nil, err
+	}
+	return sfs.openFile(f, version.Encrypted)
+}
+
+func (sfs *swiftVFSV2) CleanOldVersion(fileID string, version *vfs.Version) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return cleanVersion(sfs.c, sfs.container, sfs, fileID, version)
+}
+
+func (sfs *swiftVFSV2) PutUploadChunk(sessionID string, index int, content io.Reader) (int64, bool, error) {
+	if sfs.key != nil {
+		n, err := sfs.putEncryptedUploadChunk(sessionID, index, content)
+		return n, true, err
+	}
+	n, err := putUploadChunk(sfs.c, sfs.container, sessionID, index, content)
+	return n, false, err
+}
+
+func (sfs *swiftVFSV2) OpenUploadChunk(sessionID string, index int, encrypted bool) (io.ReadCloser, error) {
+	f, _, err := sfs.c.ObjectOpen(sfs.container, makeChunkObjectName(sessionID, index), false, nil)
 	if err == swift.ObjectNotFound {
 		return nil, os.ErrNotExist
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &swiftFileOpenV2{f, nil}, nil
+	return sfs.openFile(f, encrypted)
+}
+
+func (sfs *swiftVFSV2) DeleteUploadChunk(sessionID string, index int) error {
+	return deleteUploadChunk(sfs.c, sfs.container, sessionID, index)
+}
+
+func (sfs *swiftVFSV2) DeleteUploadChunks(sessionID string) error {
+	return deleteUploadChunks(sfs.c, sfs.container, sessionID)
 }
 
 func (sfs *swiftVFSV2) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
@@ -416,6 +511,15 @@ func (sfs *swiftVFSV2) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 		return
 	}
 
+	// The deduplicated files have no object: their contents are in the blobs.
+	referenced, err := vfs.FsckBlobs(sfs, entries, sfs.blobStored, accumulate)
+	if err != nil {
+		return
+	}
+	for docID := range referenced {
+		delete(entries, docID)
+	}
+
 	err = sfs.c.ObjectsWalk(sfs.container, nil, func(opts *swift.ObjectsOpts) (interface{}, error) {
 		var objs []swift.Object
 		objs, err = sfs.c.Objects(sfs.container, opts)
@@ -423,7 +527,15 @@ func (sfs *swiftVFSV2) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 			return nil, err
 		}
 		for _, obj := range objs {
+			if isVersionObjectName(obj.Name) || isUploadObjectName(obj.Name) ||
+				isBlobObjectName(obj.Name) {
+				continue
+			}
 			docID := makeDocID(obj.Name)
+			if referenced[docID] {
+				// An object left by the time the file was not deduplicated
+				continue
+			}
 			f, ok := entries[docID]
 			if !ok {
 				accumulate(&vfs.FsckLog{
@@ -437,7 +549,14 @@ func (sfs *swiftVFSV2) Fsck(accumulate func(log *vfs.FsckLog)) (err error) {
 				if err != nil {
 					return nil, err
 				}
-				if !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != obj.Bytes {
+				// The md5sum of an encrypted content is not known by swift
+				var mismatch bool
+				if f.Encrypted {
+					mismatch = obj.Bytes != vfs.EncryptedSize(f.ByteSize)
+				} else {
+					mismatch = !bytes.Equal(md5sum, f.MD5Sum) || f.ByteSize != obj.Bytes
+				}
+				if mismatch {
 					accumulate(&vfs.FsckLog{
 						Type:    vfs.ContentMismatch,
 						IsFile:  true,
@@ -576,14 +695,19 @@ func (sfs *swiftVFSV2) DirOrFileByPath(name string) (*vfs.DirDoc, *vfs.FileDoc,
 
 type swiftFileCreationV2 struct {
 	f       *swift.ObjectCreateFile
+	enc     *vfs.Encrypter // encrypts the content, nil if not encrypted
+	hash    hash.Hash      // md5 of the content, when swift can't check it
+	sha     hash.Hash      // sha256 of the content, when it is deduplicated
 	w       int64
 	size    int64
 	fs      *swiftVFSV2
 	name    string
+	dedup   bool
 	err     error
 	meta    *vfs.MetaExtractor
 	newdoc  *vfs.FileDoc
 	olddoc  *vfs.FileDoc
+	version *vfs.Version
 	maxsize int64
 	capsize int64
 }
@@ -608,11 +732,23 @@ func (f *swiftFileCreationV2) Write(p []byte) (int, error) {
 		}
 	}
 
-	n, err := f.f.Write(p)
+	var n int
+	var err error
+	if f.enc != nil {
+		n, err = f.enc.Write(p)
+	} else {
+		n, err = f.f.Write(p)
+	}
 	if err != nil {
 		f.err = err
 		return n, err
 	}
+	if f.hash != nil {
+		f.hash.Write(p[:n]) // #nosec
+	}
+	if f.sha != nil {
+		f.sha.Write(p[:n]) // #nosec
+	}
 
 	f.w += int64(n)
 	if f.maxsize >= 0 && f.w > f.maxsize {
@@ -634,10 +770,20 @@ func (f *swiftFileCreationV2) Close() (err error) {
 			if f.capsize > 0 && f.size >= f.capsize {
 				vfs.PushDiskQuotaAlert(f.fs, true)
 			}
+			if f.version != nil {
+				if errv := persistVersion(f.fs.c, f.fs.container, f.fs, f.version); errv != nil {
+					f.fs.log.Warnf("Could not keep the version of %s: %s", f.olddoc.ID(), errv)
+				} else if errc := vfs.CleanOldVersions(f.fs, f.olddoc.ID()); errc != nil {
+					f.fs.log.Warnf("Could not clean the versions of %s: %s", f.olddoc.ID(), errc)
+				}
+			}
 		} else {
 			// Deleting the object should be secure since we use X-Versions-Location
 			// on the container and the old object should be restored.
 			f.fs.c.ObjectDelete(f.fs.container, f.name) // #nosec
+			if f.version != nil {
+				f.fs.c.ObjectDelete(f.fs.container, makeVersionObjectName(f.version)) // #nosec
+			}
 
 			// If an error has occurred that is not due to the index update, we should
 			// delete the file from the index.
@@ -648,6 +794,11 @@ func (f *swiftFileCreationV2) Close() (err error) {
 		}
 	}()
 
+	if f.enc != nil {
+		if err = f.enc.Close(); err != nil && f.err == nil {
+			f.err = err
+		}
+	}
 	if err = f.f.Close(); err != nil {
 		if err == swift.ObjectCorrupted {
 			err = vfs.ErrInvalidHash
@@ -677,8 +828,15 @@ func (f *swiftFileCreationV2) Close() (err error) {
 	}
 
 	// The actual check of the optionally given md5 hash is handled by the swift
-	// library.
-	if newdoc.MD5Sum == nil {
+	// library, except for the encrypted contents.
+	if f.hash != nil {
+		md5sum := f.hash.Sum(nil)
+		if newdoc.MD5Sum == nil {
+			newdoc.MD5Sum = md5sum
+		} else if !bytes.Equal(newdoc.MD5Sum, md5sum) {
+			return vfs.ErrInvalidHash
+		}
+	} else if newdoc.MD5Sum == nil {
 		var headers swift.Headers
 		var md5sum []byte
 		headers, err = f.f.Headers()
@@ -726,27 +884,48 @@ func (f *swiftFileCreationV2) Close() (err error) {
 	// TODO: remove dep on couchdb, with a generalized conflict error for
 	// UpdateFileDoc/UpdateDirDoc.
 	if couchdb.IsConflictError(err) {
-		resdoc, err := f.fs.Indexer.FileByID(olddoc.ID())
+		var resdoc *vfs.FileDoc
+		resdoc, err = f.fs.Indexer.FileByID(olddoc.ID())
 		if err != nil {
 			return err
 		}
 		resdoc.Metadata = newdoc.Metadata
 		resdoc.ByteSize = newdoc.ByteSize
-		return f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
+		err = f.fs.Indexer.UpdateFileDoc(resdoc, resdoc)
 	}
-	return
+	if err != nil {
+		return err
+	}
+
+	stored := false
+	if f.dedup {
+		if stored, err = f.fs.dedupContent(f.name, newdoc, f.sha.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	if f.olddoc != nil {
+		f.fs.releaseOldContent(f.olddoc, newdoc, stored)
+	}
+	return nil
 }
 
 type swiftFileOpenV2 struct {
 	f  *swift.ObjectOpenFile
 	br *bytes.Reader
+	d  *vfs.Decrypter // decrypts the content, nil if not encrypted
 }
 
 func (f *swiftFileOpenV2) Read(p []byte) (int, error) {
+	if f.d != nil {
+		return f.d.Read(p)
+	}
 	return f.f.Read(p)
 }
 
 func (f *swiftFileOpenV2) ReadAt(p []byte, off int64) (int, error) {
+	if f.d != nil {
+		return f.d.ReadAt(p, off)
+	}
 	// TODO find something smarter than keeping the whole file in memory
 	if f.br == nil {
 		buf, err := ioutil.ReadAll(f.f)
@@ -759,6 +938,9 @@ func (f *swiftFileOpenV2) ReadAt(p []byte, off int64) (int, error) {
 }
 
 func (f *swiftFileOpenV2) Seek(offset int64, whence int) (int64, error) {
+	if f.d != nil {
+		return f.d.Seek(offset, whence)
+	}
 	return f.f.Seek(offset, whence)
 }
 
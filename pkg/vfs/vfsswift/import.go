@@ -0,0 +1,98 @@
+package vfsswift
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// ImportDir creates the containers when the root directory is imported. The
+// other directories are ignored, as the layout v2 has no hierarchy.
+func (sfs *swiftVFSV2) ImportDir(doc *vfs.DirDoc) error {
+	if doc.ID() != consts.RootDirID {
+		return nil
+	}
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+	return sfs.createContainers()
+}
+
+// ImportFileContent writes the content on the object of the file, or of its
+// version. As the index is kept, the content is encrypted only if the
+// document has the encrypted flag, and it is stored as a blob if the file
+// references one.
+func (sfs *swiftVFSV2) ImportFileContent(doc *vfs.FileDoc, version *vfs.Version, content io.Reader) error {
+	if lockerr := sfs.mu.Lock(); lockerr != nil {
+		return lockerr
+	}
+	defer sfs.mu.Unlock()
+
+	objName := MakeObjectName(doc.DocID)
+	encrypted := doc.Encrypted
+	dedup := false
+	if version != nil {
+		if version.FileID != doc.ID() {
+			return vfs.ErrVersionNotFound
+		}
+		objName = makeVersionObjectName(version)
+		encrypted = version.Encrypted
+	} else {
+		var err error
+		if dedup, err = vfs.HasBlobRef(sfs, doc); err != nil {
+			return err
+		}
+		if dedup {
+			objName = makeTmpBlobObjectName(doc.DocID)
+		}
+	}
+	if encrypted && sfs.key == nil {
+		return vfs.ErrEncryptionDisabled
+	}
+	f, err := sfs.c.ObjectCreate(sfs.container, objName, false, "", doc.Mime, nil)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	content = io.TeeReader(content, h)
+	if !encrypted {
+		_, err = io.Copy(f, content)
+	} else {
+		var enc *vfs.Encrypter
+		if enc, err = vfs.NewEncrypter(f, sfs.key); err == nil {
+			_, err = io.Copy(enc, content)
+			if errc := enc.Close(); errc != nil && err == nil {
+				err = errc
+			}
+		}
+	}
+	if errc := f.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		sfs.c.ObjectDelete(sfs.container, objName) // #nosec
+		return err
+	}
+	if dedup {
+		// The content is kept as the object of the file if it doesn't match
+		// the blob that the file references
+		var stored bool
+		if stored, err = sfs.dedupContent(objName, doc, h.Sum(nil)); err == nil && !stored {
+			vfs.ReleaseBlob(sfs, doc, sfs.removeBlobs)
+		}
+	}
+	return err
+}
+
+// ImportDir is not supported by the layout v1.
+func (sfs *swiftVFS) ImportDir(doc *vfs.DirDoc) error {
+	return vfs.ErrImportNotSupported
+}
+
+// ImportFileContent is not supported by the layout v1.
+func (sfs *swiftVFS) ImportFileContent(doc *vfs.FileDoc, version *vfs.Version, content io.Reader) error {
+	return vfs.ErrImportNotSupported
+}
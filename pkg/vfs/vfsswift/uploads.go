@@ -0,0 +1,82 @@
+package vfsswift
+
+import (
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/swift"
+)
+
+// uploadsObjectPrefix is the prefix of the names of the objects used to store
+// the chunks of the resumable uploads.
+const uploadsObjectPrefix = ".cozy_uploads/"
+
+func makeChunkObjectName(sessionID string, index int) string {
+	return uploadsObjectPrefix + sessionID + "/" + strconv.Itoa(index)
+}
+
+func isUploadObjectName(objName string) bool {
+	return strings.HasPrefix(objName, uploadsObjectPrefix)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func putUploadChunk(c *swift.Connection, container, sessionID string, index int, content io.Reader) (int64, error) {
+	objName := makeChunkObjectName(sessionID, index)
+	cr := &countingReader{r: content}
+	_, err := c.ObjectPut(container, objName, cr, false, "", "application/octet-stream", nil)
+	if err != nil {
+		c.ObjectDelete(container, objName) // #nosec
+		return 0, err
+	}
+	return cr.n, nil
+}
+
+func openUploadChunk(c *swift.Connection, container, sessionID string, index int) (io.ReadCloser, error) {
+	f, _, err := c.ObjectOpen(container, makeChunkObjectName(sessionID, index), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func deleteUploadChunk(c *swift.Connection, container, sessionID string, index int) error {
+	err := c.ObjectDelete(container, makeChunkObjectName(sessionID, index))
+	if err == swift.ObjectNotFound {
+		return nil
+	}
+	return err
+}
+
+func deleteUploadChunks(c *swift.Connection, container, sessionID string) error {
+	objNames, err := c.ObjectNamesAll(container, &swift.ObjectsOpts{
+		Prefix: uploadsObjectPrefix + sessionID + "/",
+	})
+	if err != nil || len(objNames) == 0 {
+		return err
+	}
+	_, err = c.BulkDelete(container, objNames)
+	if err == swift.Forbidden {
+		err = nil
+		for _, objName := range objNames {
+			if errd := c.ObjectDelete(container, objName); errd != nil && errd != swift.ObjectNotFound {
+				err = errd
+			}
+		}
+	}
+	return err
+}
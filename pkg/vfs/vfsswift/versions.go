@@ -0,0 +1,85 @@
+package vfsswift
+
+import (
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/swift"
+)
+
+// versionsObjectPrefix is the prefix of the names of the objects used to store
+// the content of the old versions of the files. Both layouts, v1 and v2, keep
+// them in the same container as the files.
+const versionsObjectPrefix = ".cozy_versions/"
+
+func makeVersionObjectName(version *vfs.Version) string {
+	return versionsObjectPrefix + version.FileID + "/" + version.ShortID()
+}
+
+func isVersionObjectName(objName string) bool {
+	return strings.HasPrefix(objName, versionsObjectPrefix)
+}
+
+// copyToVersion makes a server-side copy of the current content of a file
+// before it is overwritten.
+func copyToVersion(c *swift.Connection, container, objName string, version *vfs.Version) error {
+	_, err := c.ObjectCopy(container, objName, container, makeVersionObjectName(version), nil)
+	return err
+}
+
+// persistVersion saves the document of a version whose content has already
+// been copied. The content is removed if the document can't be saved.
+func persistVersion(c *swift.Connection, container string, db prefixer.Prefixer, version *vfs.Version) error {
+	if err := couchdb.CreateNamedDocWithDB(db, version); err != nil {
+		c.ObjectDelete(container, makeVersionObjectName(version)) // #nosec
+		return err
+	}
+	return nil
+}
+
+func openVersion(c *swift.Connection, container string, doc *vfs.FileDoc, version *vfs.Version) (*swift.ObjectOpenFile, error) {
+	if version.FileID != doc.ID() {
+		return nil, vfs.ErrVersionNotFound
+	}
+	f, _, err := c.ObjectOpen(container, makeVersionObjectName(version), false, nil)
+	if err == swift.ObjectNotFound {
+		return nil, os.ErrNotExist
+	}
+	return f, err
+}
+
+func cleanVersion(c *swift.Connection, container string, db prefixer.Prefixer, fileID string, version *vfs.Version) error {
+	if version.FileID != fileID {
+		return vfs.ErrVersionNotFound
+	}
+	err := c.ObjectDelete(container, makeVersionObjectName(version))
+	if err != nil && err != swift.ObjectNotFound {
+		return err
+	}
+	return couchdb.DeleteDoc(db, version)
+}
+
+// removeVersions returns the function used by vfs.DestroyVersions to remove
+// the objects of the old versions of a file.
+func removeVersions(c *swift.Connection, container string) func(string, []*vfs.Version) error {
+	return func(fileID string, versions []*vfs.Version) error {
+		objNames := make([]string, len(versions))
+		for i, v := range versions {
+			objNames[i] = makeVersionObjectName(v)
+		}
+		_, err := c.BulkDelete(container, objNames)
+		if err != swift.Forbidden {
+			return err
+		}
+		err = nil
+		for _, objName := range objNames {
+			if errd := c.ObjectDelete(container, objName); errd != nil && errd != swift.ObjectNotFound {
+				err = errd
+			}
+		}
+		return err
+	}
+}
@@ -335,6 +335,22 @@ func init() {
 			},
 			Outro: "Mail New Connection Outro",
 		},
+		{
+			Name:    "account_lockout",
+			Subject: "Mail Account Lockout Subject",
+			Intro:   "Mail Account Lockout Intro",
+			Entries: []MailEntry{
+				{Key: "Mail Account Lockout IP", Val: "{{.IP}}"},
+			},
+			Actions: []MailAction{
+				{
+					Instructions: "Mail Account Lockout Change Passphrase instruction",
+					Text:         "Mail Account Lockout Change Passphrase text",
+					Link:         "{{.ChangePassphraseLink}}",
+				},
+			},
+			Outro: "Mail Account Lockout Outro",
+		},
 		{
 			Name:    "new_registration",
 			Subject: "Mail New Registration Subject",
@@ -364,6 +380,30 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:    "sharing_expiration",
+			Subject: "Mail Sharing Expiration Subject",
+			Intro:   "Mail Sharing Expiration Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Mail Sharing Expiration Button instruction",
+					Text:         "Mail Sharing Expiration Button text",
+					Link:         "{{.SharingLink}}",
+				},
+			},
+		},
+		{
+			Name:    "sharing_member_expiration",
+			Subject: "Mail Sharing Member Expiration Subject",
+			Intro:   "Mail Sharing Member Expiration Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Mail Sharing Expiration Button instruction",
+					Text:         "Mail Sharing Expiration Button text",
+					Link:         "{{.SharingLink}}",
+				},
+			},
+		},
 
 		// Notifications
 		{
@@ -383,6 +423,18 @@ func init() {
 				},
 			},
 		},
+		{
+			Name:    "notifications_sharing_conflict",
+			Subject: "Notifications Sharing Conflict Subject",
+			Intro:   "Notifications Sharing Conflict Intro",
+			Actions: []MailAction{
+				{
+					Instructions: "Notifications Sharing Conflict instruction",
+					Text:         "Notifications Sharing Conflict text",
+					Link:         "{{.ConflictLink}}",
+				},
+			},
+		},
 	}}
 }
 
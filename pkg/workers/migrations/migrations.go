@@ -36,6 +36,8 @@ func init() {
 }
 
 const swiftV1ToV2 = "swift-v1-to-v2"
+const encryptFiles = "encrypt-files"
+const moveStorage = "move-storage"
 
 type message struct {
 	Type    string `json:"type"`
@@ -53,6 +55,10 @@ func worker(ctx *jobs.WorkerContext) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return migrateSwiftV1ToV2(domain)
+	case encryptFiles:
+		return migrateEncryptFiles(domain)
+	case moveStorage:
+		return migrateMoveStorage(domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
@@ -72,11 +78,29 @@ func commit(ctx *jobs.WorkerContext, err error) error {
 	switch msg.Type {
 	case swiftV1ToV2:
 		return commitSwiftV1ToV2(domain, msg.Cluster)
+	case encryptFiles:
+		return nil
+	case moveStorage:
+		return commitMoveStorage(domain)
 	default:
 		return fmt.Errorf("unknown migration type %q", msg.Type)
 	}
 }
 
+// migrateEncryptFiles generates the key of the instance for the encryption of
+// its files, and encrypts the contents that were written in clear. It can be
+// run again if it has been interrupted.
+func migrateEncryptFiles(domain string) error {
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if err = inst.EnableFilesEncryption(); err != nil {
+		return err
+	}
+	return inst.VFS().EncryptContents()
+}
+
 type object struct {
 	obj          swift.Object
 	containerSrc string
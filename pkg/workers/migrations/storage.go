@@ -0,0 +1,127 @@
+package migrations
+
+import (
+	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// migrateMoveStorage copies the files and the applications of an instance
+// from the storage of fs.previous_url to the storage of fs.url. The index of
+// the files and the references to the blobs are kept as is, only the
+// contents are copied. The instance should not be used while its storage is
+// moved.
+func migrateMoveStorage(domain string) error {
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if !inst.OnPreviousStorage() {
+		return nil
+	}
+
+	// The index already exists, so dst.InitFs() is not called: the root
+	// directory is imported first and prepares the storage.
+	src := inst.VFS()
+	dst, err := inst.NewStorageVFS()
+	if err != nil {
+		return err
+	}
+
+	err = vfs.Walk(src, "/", func(name string, dir *vfs.DirDoc, file *vfs.FileDoc, err error) error {
+		if err != nil {
+			return err
+		}
+		if dir != nil {
+			return dst.ImportDir(dir)
+		}
+		return moveFileContents(src, dst, file)
+	})
+	if err != nil {
+		return err
+	}
+
+	webapps, err := apps.ListWebapps(inst)
+	if err != nil {
+		return err
+	}
+	for _, app := range webapps {
+		err = apps.CopyVersion(inst.AppsFileServer(), inst.NewStorageAppsCopier(apps.Webapp),
+			app.Slug(), app.Version())
+		if err != nil {
+			return err
+		}
+	}
+	konnectors, err := apps.ListKonnectors(inst)
+	if err != nil {
+		return err
+	}
+	for _, konn := range konnectors {
+		err = apps.CopyVersion(inst.KonnectorsFileServer(), inst.NewStorageAppsCopier(apps.Konnector),
+			konn.Slug(), konn.Version())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveFileContents(src, dst vfs.VFS, file *vfs.FileDoc) error {
+	content, err := src.OpenFile(file)
+	if err != nil {
+		return err
+	}
+	err = dst.ImportFileContent(file, nil, content)
+	if errc := content.Close(); errc != nil && err == nil {
+		err = errc
+	}
+	if err != nil {
+		return err
+	}
+
+	versions, err := vfs.VersionsFor(src, file.ID())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		content, err = src.OpenFileVersion(file, version)
+		if err != nil {
+			return err
+		}
+		err = dst.ImportFileContent(file, version, content)
+		if errc := content.Close(); errc != nil && err == nil {
+			err = errc
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitMoveStorage switches the instance to the storage of fs.url. The
+// deduplicated contents have been imported as blobs on the new storage, so
+// the documents of the blobs are kept as is, and the thumbnails are generated
+// again.
+func commitMoveStorage(domain string) error {
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return err
+	}
+	if !inst.OnPreviousStorage() {
+		return nil
+	}
+	if err = inst.CommitNewStorage(); err != nil {
+		return err
+	}
+	msg, err := jobs.NewMessage(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	_, err = jobs.System().PushJob(inst, &jobs.JobRequest{
+		WorkerType: "thumbnailck",
+		Message:    msg,
+	})
+	return err
+}
@@ -694,7 +694,8 @@ func exportDocs(in *instance.Instance, withDoctypes []string, now time.Time, tw
 		}
 		switch doctype {
 		case consts.KonnectorLogs, consts.Archives,
-			consts.Sessions, consts.OAuthClients, consts.OAuthAccessCodes:
+			consts.Sessions, consts.OAuthClients, consts.OAuthAccessCodes,
+			consts.OAuthDeviceCodes, consts.RevokedTokens:
 			// ignore these doctypes
 		case consts.Sharings, consts.SharingsAnswer, consts.Shared:
 			// ignore sharings ? TBD
@@ -0,0 +1,32 @@
+// Package revocation is for the worker that removes the expired entries of
+// the revocation list of the tokens.
+package revocation
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+)
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "clean-revoked-tokens",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Timeout:      10 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+}
+
+// Worker is a worker that removes the tokens of the revocation list that have
+// expired, as they can no longer be used anyway.
+func Worker(ctx *jobs.WorkerContext) error {
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	return permissions.PurgeExpiredRevocations(i)
+}
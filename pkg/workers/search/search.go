@@ -0,0 +1,105 @@
+// Package search is for the workers that keep the full-text index of the files
+// up-to-date.
+package search
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+)
+
+// triggerArguments are the arguments of the trigger for the search worker.
+const triggerArguments = "io.cozy.files:CREATED,UPDATED,DELETED"
+
+type fileEvent struct {
+	Verb   string       `json:"verb"`
+	Doc    vfs.FileDoc  `json:"doc"`
+	OldDoc *vfs.FileDoc `json:"old,omitempty"`
+}
+
+func init() {
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "search",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      2 * time.Minute,
+		WorkerFunc:   Worker,
+	})
+
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "searchreindex",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 1,
+		Timeout:      1 * time.Hour,
+		WorkerFunc:   WorkerReindex,
+	})
+}
+
+// Worker is a worker that updates the full-text index when a file is created,
+// updated or removed.
+func Worker(ctx *jobs.WorkerContext) error {
+	if !search.Enabled() {
+		return nil
+	}
+	var ev fileEvent
+	if err := ctx.UnmarshalEvent(&ev); err != nil {
+		return err
+	}
+	if !search.IsIndexable(&ev.Doc) {
+		return nil
+	}
+
+	ctx.Logger().WithField("nspace", "search").Debugf("%s %s", ev.Verb, ev.Doc.ID())
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if ev.Verb == "DELETED" {
+		return search.RemoveFile(i, ev.Doc.ID())
+	}
+	return search.IndexFile(i.VFS(), &ev.Doc, ev.OldDoc)
+}
+
+// WorkerReindex is a worker that rebuilds the full-text index of an instance.
+// It also adds the trigger for the search worker if it is missing, for the
+// instances created before the full-text search.
+func WorkerReindex(ctx *jobs.WorkerContext) error {
+	if !search.Enabled() {
+		return search.ErrDisabled
+	}
+	i, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	if err = ensureTrigger(i); err != nil {
+		return err
+	}
+	return search.Reindex(i.VFS())
+}
+
+func ensureTrigger(i *instance.Instance) error {
+	sched := jobs.System()
+	triggers, err := sched.GetAllTriggers(i)
+	if err != nil {
+		return err
+	}
+	for _, t := range triggers {
+		infos := t.Infos()
+		if infos.WorkerType == "search" && infos.Type == "@event" {
+			return nil
+		}
+	}
+	t, err := jobs.NewTrigger(i, jobs.TriggerInfos{
+		Type:       "@event",
+		WorkerType: "search",
+		Arguments:  triggerArguments,
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return sched.AddTrigger(t)
+}
@@ -39,6 +39,14 @@ func init() {
 		Timeout:      1 * time.Hour,
 		WorkerFunc:   WorkerUpload,
 	})
+
+	jobs.AddWorker(&jobs.WorkerConfig{
+		WorkerType:   "share-expire",
+		Concurrency:  runtime.NumCPU(),
+		MaxExecCount: 2,
+		Timeout:      5 * time.Minute,
+		WorkerFunc:   WorkerExpire,
+	})
 }
 
 // WorkerTrack is used to update the io.cozy.shared database when a document
@@ -102,3 +110,25 @@ func WorkerUpload(ctx *jobs.WorkerContext) error {
 	}
 	return s.Upload(inst, msg.Errors)
 }
+
+// WorkerExpire is used to revoke a sharing, or the access of a recipient, when
+// its expiration date is reached, and to remind the owner of it before.
+func WorkerExpire(ctx *jobs.WorkerContext) error {
+	var msg sharing.ExpireMsg
+	if err := ctx.UnmarshalMessage(&msg); err != nil {
+		return err
+	}
+	inst, err := instance.Get(ctx.Domain())
+	if err != nil {
+		return err
+	}
+	inst.Logger().WithField("nspace", "share").Debugf("Expire %#v", msg)
+	s, err := sharing.FindSharing(inst, msg.SharingID)
+	if err != nil {
+		return err
+	}
+	if !s.Active {
+		return nil
+	}
+	return s.Expire(inst, &msg)
+}
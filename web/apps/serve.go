@@ -16,6 +16,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/intents"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web/middlewares"
@@ -26,6 +27,9 @@ import (
 // Serve is an handler for serving files from the VFS for a client-side app
 func Serve(c echo.Context) error {
 	method := c.Request().Method
+	if method == "POST" && c.QueryParam("sharecode") != "" {
+		return UnlockShareCode(c)
+	}
 	if method != "GET" && method != "HEAD" {
 		return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method "+method+" not allowed")
 	}
@@ -206,8 +210,14 @@ func ServeAppFile(c echo.Context, i *instance.Instance, fs apps.FileServer, app
 	var token string
 	if isLoggedIn {
 		token = i.BuildAppToken(app, session.ID())
-	} else {
-		token = c.QueryParam("sharecode")
+	} else if token = c.QueryParam("sharecode"); token != "" {
+		pdoc, err := middlewares.ParseJWT(c, i, token)
+		if err == permissions.ErrPasswordRequired {
+			return renderSharePassword(c, i, http.StatusOK, "")
+		}
+		if err == nil && pdoc.Type == permissions.TypeShareByLink {
+			permissions.LogShareAccess(i, pdoc, permissions.ShareAccessOpen, c.Request())
+		}
 	}
 
 	tracking := "false"
@@ -0,0 +1,71 @@
+package apps
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/auth"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// renderSharePassword displays the interstitial page where a visitor of a
+// share by link protected by a password can type it.
+func renderSharePassword(c echo.Context, i *instance.Instance, code int, errorKey string) error {
+	return c.Render(code, "share_password.html", echo.Map{
+		"Domain":        i.ContextualDomain(),
+		"Locale":        i.Locale,
+		"Action":        c.Request().URL.RequestURI(),
+		"PasswordError": errorKey,
+	})
+}
+
+// UnlockShareCode checks the password sent by the visitor of a share by link,
+// and if it is correct, redirects to the same page with an unlocked token in
+// place of the sharecode.
+func UnlockShareCode(c echo.Context) error {
+	i := middlewares.GetInstance(c)
+	sharecode := c.QueryParam("sharecode")
+	pdoc, err := permissions.GetForShareCode(i, sharecode)
+	if err != nil || !pdoc.HasPassword() {
+		return c.Render(http.StatusBadRequest, "error.html", echo.Map{
+			"Domain": i.ContextualDomain(),
+			"Error":  "Error Invalid sharing",
+		})
+	}
+
+	ip := limits.RequestIP(c.Request())
+	if delay := limits.RetryAfter(i, limits.SharePasswordType, ip); delay > 0 {
+		auth.SetRetryAfter(c, delay)
+		return renderSharePassword(c, i, http.StatusTooManyRequests, "Error Too many attempts")
+	}
+
+	if !pdoc.CheckPassword(c.FormValue("password")) {
+		delay, lockedNow := limits.Attempt(i, limits.SharePasswordType, ip)
+		// After the free attempts, only the lockout is written in the access
+		// log, to not create a document for each attempt of a brute-force.
+		if delay == 0 || lockedNow {
+			permissions.LogShareAccess(i, pdoc, permissions.ShareAccessWrongPassword, c.Request())
+		}
+		if delay > 0 {
+			auth.SetRetryAfter(c, delay)
+		}
+		if lockedNow {
+			return renderSharePassword(c, i, http.StatusTooManyRequests, "Error Too many attempts")
+		}
+		return renderSharePassword(c, i, http.StatusUnauthorized, "Share Password Invalid")
+	}
+
+	token, err := i.MakeJWT(permissions.UnlockedShareAudience, pdoc.PID, "", "", time.Now())
+	if err != nil {
+		return err
+	}
+	u := *c.Request().URL
+	q := u.Query()
+	q.Set("sharecode", token)
+	u.RawQuery = q.Encode()
+	return c.Redirect(http.StatusSeeOther, u.RequestURI())
+}
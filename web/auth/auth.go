@@ -10,12 +10,15 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
@@ -139,20 +142,29 @@ func renderLoginForm(c echo.Context, i *instance.Instance, code int, credsErrors
 		help = i.Translate("Login Password help")
 	}
 
+	var oidcProvider string
+	if conf := getOIDCConfig(i); conf != nil {
+		oidcProvider = conf.ProviderName
+	}
+
 	return c.Render(code, "login.html", echo.Map{
-		"Domain":           i.ContextualDomain(),
-		"Locale":           i.Locale,
-		"Title":            title,
-		"PasswordHelp":     help,
-		"CredentialsError": credsErrors,
-		"Redirect":         redirectStr,
-		"TwoFactorForm":    false,
-		"TwoFactorToken":   "",
-		"CSRF":             c.Get("csrf"),
+		"Domain":                i.ContextualDomain(),
+		"Locale":                i.Locale,
+		"Title":                 title,
+		"PasswordHelp":          help,
+		"OIDCProvider":          oidcProvider,
+		"CredentialsError":      credsErrors,
+		"Redirect":              redirectStr,
+		"TwoFactorForm":         false,
+		"TwoFactorToken":        "",
+		"TwoFactorMethod":       "",
+		"TwoFactorAlternatives": map[string]bool{},
+		"WebAuthnOptions":       "",
+		"CSRF":                  c.Get("csrf"),
 	})
 }
 
-func renderTwoFactorForm(c echo.Context, i *instance.Instance, code int, redirect *url.URL, twoFactorToken []byte, longRunSession bool) error {
+func renderTwoFactorForm(c echo.Context, i *instance.Instance, code int, redirect *url.URL, challenge *instance.TwoFactorChallenge, longRunSession bool) error {
 	var title string
 	publicName, err := i.PublicName()
 	if err != nil {
@@ -163,20 +175,55 @@ func renderTwoFactorForm(c echo.Context, i *instance.Instance, code int, redirec
 	} else {
 		title = i.Translate("Login Welcome name", publicName)
 	}
+	var webauthnOptions string
+	if challenge.WebAuthn != nil {
+		options, err := json.Marshal(challenge.WebAuthn)
+		if err != nil {
+			return err
+		}
+		webauthnOptions = string(options)
+	}
+	alternatives := make(map[string]bool)
+	for _, method := range i.TwoFactorMethods() {
+		if method != challenge.Method {
+			alternatives[method] = true
+		}
+	}
 	return c.Render(code, "login.html", echo.Map{
-		"Domain":           i.ContextualDomain(),
-		"Locale":           i.Locale,
-		"Title":            title,
-		"PasswordHelp":     "",
-		"CredentialsError": nil,
-		"Redirect":         redirect.String(),
-		"LongRunSession":   longRunSession,
-		"TwoFactorForm":    true,
-		"TwoFactorToken":   string(twoFactorToken),
-		"CSRF":             c.Get("csrf"),
+		"Domain":                i.ContextualDomain(),
+		"Locale":                i.Locale,
+		"Title":                 title,
+		"PasswordHelp":          "",
+		"CredentialsError":      nil,
+		"Redirect":              redirect.String(),
+		"LongRunSession":        longRunSession,
+		"TwoFactorForm":         true,
+		"TwoFactorToken":        string(challenge.Token),
+		"TwoFactorMethod":       challenge.Method,
+		"TwoFactorAlternatives": alternatives,
+		"WebAuthnOptions":       webauthnOptions,
+		"CSRF":                  c.Get("csrf"),
 	})
 }
 
+// renderTwoFactor asks the user for the second factor of the given challenge,
+// with the login form or in JSON.
+func renderTwoFactor(c echo.Context, i *instance.Instance, redirect *url.URL, challenge *instance.TwoFactorChallenge, longRunSession, wantsJSON bool) error {
+	if wantsJSON {
+		res := echo.Map{
+			"redirect":           redirect.String(),
+			"two_factor_token":   string(challenge.Token),
+			"two_factor_method":  challenge.Method,
+			"two_factor_methods": i.TwoFactorMethods(),
+		}
+		if challenge.WebAuthn != nil {
+			res["webauthn"] = challenge.WebAuthn
+		}
+		return c.JSON(http.StatusOK, res)
+	}
+	return renderTwoFactorForm(c, i, http.StatusOK, redirect, challenge, longRunSession)
+}
+
 func loginForm(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 
@@ -196,6 +243,11 @@ func loginForm(c echo.Context) error {
 		return c.Redirect(http.StatusSeeOther, redirect.String())
 	}
 
+	if IsPassphraseLoginDisabled(instance) {
+		q := url.Values{"redirect": {redirect.String()}}
+		return c.Redirect(http.StatusSeeOther, instance.PageURL("/auth/oidc/start", q))
+	}
+
 	return renderLoginForm(c, instance, http.StatusOK, "", redirect)
 }
 
@@ -211,6 +263,7 @@ func login(c echo.Context) error {
 	successfulAuthentication := false
 	twoFactorToken := []byte(c.FormValue("two-factor-token"))
 	twoFactorPasscode := c.FormValue("two-factor-passcode")
+	twoFactorMethod := c.FormValue("two-factor-method")
 	twoFactorTrustedDeviceToken := []byte(c.FormValue("two-factor-trusted-device-token"))
 	twoFactorGenerateTrustedDeviceToken, _ := strconv.ParseBool(c.FormValue("two-factor-generate-trusted-device-token"))
 	passphrase := []byte(c.FormValue("passphrase"))
@@ -219,42 +272,73 @@ func login(c echo.Context) error {
 	var twoFactorGeneratedTrustedDeviceToken []byte
 
 	twoFactorRequest := len(twoFactorToken) > 0 && twoFactorPasscode != ""
+	twoFactorMethodRequest := len(twoFactorToken) > 0 && twoFactorPasscode == "" && twoFactorMethod != ""
 	passphraseRequest := len(passphrase) > 0
 
+	counterType := limits.AuthType
+	if twoFactorRequest {
+		counterType = limits.TwoFactorType
+	}
+
 	var sessionID string
+	var retryAfter time.Duration
 	session, ok := middlewares.GetSession(c)
+	if !ok && (twoFactorRequest || passphraseRequest) {
+		retryAfter = RetryAfter(c, inst, counterType)
+	}
 	if ok {
 		sessionID = session.ID()
+	} else if retryAfter > 0 {
+		SetRetryAfter(c, retryAfter)
+		errorMessage := inst.Translate(TooManyAttemptsKey)
+		if wantsJSON {
+			return c.JSON(http.StatusTooManyRequests, echo.Map{
+				"error": errorMessage,
+			})
+		}
+		return renderLoginForm(c, inst, http.StatusTooManyRequests,
+			errorMessage, redirect)
 	} else if twoFactorRequest {
-		successfulAuthentication = inst.ValidateTwoFactorPasscode(
+		successfulAuthentication = inst.ValidateTwoFactor(
 			twoFactorToken, twoFactorPasscode)
 
 		if successfulAuthentication && twoFactorGenerateTrustedDeviceToken {
 			twoFactorGeneratedTrustedDeviceToken, _ =
 				inst.GenerateTwoFactorTrustedDeviceSecret(c.Request())
 		}
+	} else if twoFactorMethodRequest {
+		// The user has already entered the passphrase, and wants to use
+		// another of its second factors
+		if inst.ValidateTwoFactorToken(twoFactorToken) {
+			challenge, err := inst.BeginTwoFactor(twoFactorMethod)
+			if err == nil {
+				return renderTwoFactor(c, inst, redirect, challenge, longRunSession, wantsJSON)
+			}
+			if err != instance.ErrTwoFactorNotEnrolled {
+				return err
+			}
+		}
+		twoFactorRequest = true
+	} else if passphraseRequest && IsPassphraseLoginDisabled(inst) {
+		return echo.NewHTTPError(http.StatusForbidden,
+			"The login with a passphrase is disabled for this instance")
 	} else if passphraseRequest {
 		if inst.CheckPassphrase(passphrase) == nil {
+			ResetAttempts(c, inst, limits.AuthType)
 			switch {
-			// In case the second factor authentication mode is "mail", we also
-			// check that the mail has been confirmed. If not, 2FA is not actived.
-			case inst.HasAuthMode(instance.TwoFactorMail):
+			// In case of two-factor authentication, the second step can be
+			// skipped on the devices trusted by the user.
+			case inst.HasTwoFactor():
 				if len(twoFactorTrustedDeviceToken) > 0 {
 					successfulAuthentication = inst.ValidateTwoFactorTrustedDeviceSecret(
 						c.Request(), twoFactorTrustedDeviceToken)
 				}
 				if !successfulAuthentication {
-					twoFactorToken, err = inst.SendTwoFactorPasscode()
+					challenge, err := inst.BeginTwoFactor("")
 					if err != nil {
 						return err
 					}
-					if wantsJSON {
-						return c.JSON(http.StatusOK, echo.Map{
-							"redirect":         redirect.String(),
-							"two_factor_token": string(twoFactorToken),
-						})
-					}
-					return renderTwoFactorForm(c, inst, http.StatusOK, redirect, twoFactorToken, longRunSession)
+					return renderTwoFactor(c, inst, redirect, challenge, longRunSession, wantsJSON)
 				}
 			default:
 				successfulAuthentication = true
@@ -263,6 +347,7 @@ func login(c echo.Context) error {
 	}
 
 	if successfulAuthentication {
+		ResetAttempts(c, inst, limits.AuthType, limits.TwoFactorType)
 		if sessionID, err = SetCookieForNewSession(c, longRunSession); err != nil {
 			return err
 		}
@@ -286,6 +371,9 @@ func login(c echo.Context) error {
 
 	// not logged-in
 	if sessionID == "" {
+		if twoFactorRequest || passphraseRequest {
+			CountAttempt(c, inst, counterType)
+		}
 		var errorMessage string
 		if twoFactorRequest {
 			errorMessage = inst.Translate(TwoFactorErrorKey)
@@ -441,6 +529,11 @@ func registerClient(c echo.Context) error {
 	if err := client.Create(instance); err != nil {
 		return c.JSON(err.Code, err)
 	}
+	audit.Log(instance, c.Request(), audit.OAuthClientRegistered, map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_name": client.ClientName,
+		"software_id": client.SoftwareID,
+	})
 	return c.JSON(http.StatusCreated, client)
 }
 
@@ -470,17 +563,23 @@ func deleteClient(c echo.Context) error {
 	if err := client.Delete(instance); err != nil {
 		return c.JSON(err.Code, err)
 	}
+	audit.Log(instance, c.Request(), audit.OAuthClientRevoked, map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_name": client.ClientName,
+	})
 	return c.NoContent(http.StatusNoContent)
 }
 
 type authorizeParams struct {
-	instance    *instance.Instance
-	state       string
-	clientID    string
-	redirectURI string
-	scope       string
-	resType     string
-	client      *oauth.Client
+	instance        *instance.Instance
+	state           string
+	clientID        string
+	redirectURI     string
+	scope           string
+	resType         string
+	challenge       string
+	challengeMethod string
+	client          *oauth.Client
 }
 
 func checkAuthorizeParams(c echo.Context, params *authorizeParams) (bool, error) {
@@ -535,18 +634,46 @@ func checkAuthorizeParams(c echo.Context, params *authorizeParams) (bool, error)
 		})
 	}
 
+	policy := oauth.GetPolicy(params.instance)
+	if params.challenge == "" {
+		if params.challengeMethod != "" || policy.RequirePKCE(params.client) {
+			return true, c.Render(http.StatusBadRequest, "error.html", echo.Map{
+				"Domain": params.instance.ContextualDomain(),
+				"Error":  "Error No code_challenge parameter",
+			})
+		}
+	} else {
+		if !oauth.ValidCodeChallenge(params.challenge) {
+			return true, c.Render(http.StatusBadRequest, "error.html", echo.Map{
+				"Domain": params.instance.ContextualDomain(),
+				"Error":  "Error Invalid code_challenge",
+			})
+		}
+		if !policy.AcceptChallengeMethod(params.challengeMethod) {
+			return true, c.Render(http.StatusBadRequest, "error.html", echo.Map{
+				"Domain": params.instance.ContextualDomain(),
+				"Error":  "Error Invalid code_challenge_method",
+			})
+		}
+		if params.challengeMethod == "" {
+			params.challengeMethod = oauth.ChallengeMethodPlain
+		}
+	}
+
 	return false, nil
 }
 
 func authorizeForm(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	params := authorizeParams{
-		instance:    instance,
-		state:       c.QueryParam("state"),
-		clientID:    c.QueryParam("client_id"),
-		redirectURI: c.QueryParam("redirect_uri"),
-		scope:       c.QueryParam("scope"),
-		resType:     c.QueryParam("response_type"),
+		instance:        instance,
+		state:           c.QueryParam("state"),
+		clientID:        c.QueryParam("client_id"),
+		redirectURI:     c.QueryParam("redirect_uri"),
+		scope:           c.QueryParam("scope"),
+		resType:         c.QueryParam("response_type"),
+		challenge:       c.QueryParam("code_challenge"),
+		challengeMethod: c.QueryParam("code_challenge_method"),
 	}
 
 	if hasError, err := checkAuthorizeParams(c, &params); hasError {
@@ -564,7 +691,8 @@ func authorizeForm(c echo.Context) error {
 	// for the manager. It does not require any authorization from the user, and
 	// generate a code without asking any permission.
 	if params.scope == oauth.ScopeLogin {
-		access, err := oauth.CreateAccessCode(params.instance, params.clientID, "" /* = scope */)
+		access, err := oauth.CreateAccessCode(params.instance, params.clientID, "", /* = scope */
+			params.challenge, params.challengeMethod)
 		if err != nil {
 			return err
 		}
@@ -612,9 +740,28 @@ func authorizeForm(c echo.Context) error {
 		clientDomain = clientURL.Hostname()
 	}
 
-	// This Content-Security-Policy (CSP) nonce is here to allow the display of
-	// logos for OAuth clients on the authorize page.
-	if logoURI := params.client.LogoURI; logoURI != "" {
+	allowClientLogo(c, params.client)
+
+	return c.Render(http.StatusOK, "authorize.html", echo.Map{
+		"Domain":          instance.ContextualDomain(),
+		"ClientDomain":    clientDomain,
+		"Locale":          instance.Locale,
+		"Client":          params.client,
+		"State":           params.state,
+		"RedirectURI":     params.redirectURI,
+		"Scope":           params.scope,
+		"Challenge":       params.challenge,
+		"ChallengeMethod": params.challengeMethod,
+		"Permissions":     permissions,
+		"ReadOnly":        readOnly,
+		"CSRF":            c.Get("csrf"),
+	})
+}
+
+// allowClientLogo adds a Content-Security-Policy (CSP) nonce to allow the
+// display of the logo of an OAuth client on the authorize page.
+func allowClientLogo(c echo.Context, client *oauth.Client) {
+	if logoURI := client.LogoURI; logoURI != "" {
 		logoURL, err := url.Parse(logoURI)
 		if err == nil {
 			csp := c.Response().Header().Get(echo.HeaderContentSecurityPolicy)
@@ -624,30 +771,19 @@ func authorizeForm(c echo.Context) error {
 			}
 		}
 	}
-
-	return c.Render(http.StatusOK, "authorize.html", echo.Map{
-		"Domain":       instance.ContextualDomain(),
-		"ClientDomain": clientDomain,
-		"Locale":       instance.Locale,
-		"Client":       params.client,
-		"State":        params.state,
-		"RedirectURI":  params.redirectURI,
-		"Scope":        params.scope,
-		"Permissions":  permissions,
-		"ReadOnly":     readOnly,
-		"CSRF":         c.Get("csrf"),
-	})
 }
 
 func authorize(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
 	params := authorizeParams{
-		instance:    instance,
-		state:       c.FormValue("state"),
-		clientID:    c.FormValue("client_id"),
-		redirectURI: c.FormValue("redirect_uri"),
-		scope:       c.FormValue("scope"),
-		resType:     c.FormValue("response_type"),
+		instance:        instance,
+		state:           c.FormValue("state"),
+		clientID:        c.FormValue("client_id"),
+		redirectURI:     c.FormValue("redirect_uri"),
+		scope:           c.FormValue("scope"),
+		resType:         c.FormValue("response_type"),
+		challenge:       c.FormValue("code_challenge"),
+		challengeMethod: c.FormValue("code_challenge_method"),
 	}
 
 	if hasError, err := checkAuthorizeParams(c, &params); hasError {
@@ -669,7 +805,8 @@ func authorize(c echo.Context) error {
 		})
 	}
 
-	access, err := oauth.CreateAccessCode(params.instance, params.clientID, params.scope)
+	access, err := oauth.CreateAccessCode(params.instance, params.clientID, params.scope,
+		params.challenge, params.challengeMethod)
 	if err != nil {
 		return err
 	}
@@ -784,6 +921,10 @@ func authorizeSharing(c echo.Context) error {
 	if err = s.SendAnswer(instance, params.state); err != nil {
 		return err
 	}
+	audit.Log(instance, c.Request(), audit.SharingAccepted, map[string]interface{}{
+		"sharing_id": s.SID,
+		"sharer":     s.Members[0].Instance,
+	})
 	redirect := s.RedirectAfterAuthorizeURL(instance)
 	return c.Redirect(http.StatusSeeOther, redirect.String())
 }
@@ -870,42 +1011,60 @@ type accessTokenReponse struct {
 	Refresh string `json:"refresh_token,omitempty"`
 }
 
-func accessToken(c echo.Context) error {
-	grant := c.FormValue("grant_type")
+// checkClientCredentials checks the client_id and client_secret parameters
+// sent by a client to the token endpoints. If they are invalid, the response
+// is sent and hasError is true.
+func checkClientCredentials(c echo.Context, instance *instance.Instance) (client *oauth.Client, hasError bool, err error) {
 	clientID := c.FormValue("client_id")
 	clientSecret := c.FormValue("client_secret")
-	instance := middlewares.GetInstance(c)
 
-	if grant == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "the grant_type parameter is mandatory",
-		})
-	}
 	if clientID == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{
+		return nil, true, c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "the client_id parameter is mandatory",
 		})
 	}
-	if clientSecret == "" {
-		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "the client_secret parameter is mandatory",
-		})
-	}
 
-	client, err := oauth.FindClient(instance, clientID)
+	client, err = oauth.FindClient(instance, clientID)
 	if err != nil {
 		if couchErr, isCouchErr := couchdb.IsCouchError(err); isCouchErr && couchErr.StatusCode >= 500 {
-			return err
+			return nil, true, err
 		}
-		return c.JSON(http.StatusBadRequest, echo.Map{
+		return nil, true, c.JSON(http.StatusBadRequest, echo.Map{
 			"error": "the client must be registered",
 		})
 	}
-	if subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) == 0 {
+	// The public clients have no secret: they are authenticated by PKCE for
+	// the authorization code, and by their refresh token after that.
+	if clientSecret == "" && !client.IsPublic() {
+		return nil, true, c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "the client_secret parameter is mandatory",
+		})
+	}
+	if clientSecret != "" || !client.IsPublic() {
+		if subtle.ConstantTimeCompare([]byte(clientSecret), []byte(client.ClientSecret)) == 0 {
+			return nil, true, c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid client_secret",
+			})
+		}
+	}
+	return client, false, nil
+}
+
+func accessToken(c echo.Context) error {
+	grant := c.FormValue("grant_type")
+	clientID := c.FormValue("client_id")
+	instance := middlewares.GetInstance(c)
+
+	if grant == "" {
 		return c.JSON(http.StatusBadRequest, echo.Map{
-			"error": "invalid client_secret",
+			"error": "the grant_type parameter is mandatory",
 		})
 	}
+
+	client, hasError, err := checkClientCredentials(c, instance)
+	if hasError {
+		return err
+	}
 	out := accessTokenReponse{
 		Type: "bearer",
 	}
@@ -924,6 +1083,27 @@ func accessToken(c echo.Context) error {
 				"error": "invalid code",
 			})
 		}
+		if accessCode.ClientID != client.CouchID {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid code",
+			})
+		}
+		if accessCode.CodeChallenge == "" && oauth.GetPolicy(instance).RequirePKCE(client) {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid code",
+			})
+		}
+		if !accessCode.VerifyCodeVerifier(c.FormValue("code_verifier")) {
+			// The access code can't be used after a failed verification, to
+			// avoid brute-force attacks on the code verifier
+			if err = couchdb.DeleteDoc(instance, accessCode); err != nil {
+				instance.Logger().Errorf(
+					"[oauth] Failed to delete the access code: %s", err)
+			}
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid code_verifier",
+			})
+		}
 		out.Scope = accessCode.Scope
 		out.Refresh, err = client.CreateJWT(instance, permissions.RefreshTokenAudience, out.Scope)
 		if err != nil {
@@ -938,6 +1118,50 @@ func accessToken(c echo.Context) error {
 				"[oauth] Failed to delete the access code: %s", err)
 		}
 
+	case oauth.DeviceCodeGrantType:
+		var deviceCode *oauth.DeviceCode
+		deviceCode, err = oauth.FindDeviceCode(instance, c.FormValue("device_code"))
+		if err != nil {
+			if err != oauth.ErrInvalidDeviceCode {
+				return err
+			}
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid device_code",
+			})
+		}
+		if deviceCode.ClientID != client.CouchID {
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid device_code",
+			})
+		}
+		switch err = deviceCode.Poll(instance); err {
+		case nil:
+		case oauth.ErrAuthorizationPending, oauth.ErrSlowDown,
+			oauth.ErrAccessDenied, oauth.ErrExpiredToken:
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": err.Error(),
+			})
+		default:
+			return err
+		}
+		// Delete the device code before issuing the tokens, it can be used
+		// only once, even by two requests made at the same time
+		if err = deviceCode.Consume(instance); err != nil {
+			if err != oauth.ErrInvalidDeviceCode {
+				return err
+			}
+			return c.JSON(http.StatusBadRequest, echo.Map{
+				"error": "invalid_grant",
+			})
+		}
+		out.Scope = deviceCode.Scope
+		out.Refresh, err = client.CreateJWT(instance, permissions.RefreshTokenAudience, out.Scope)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, echo.Map{
+				"error": "Can't generate refresh token",
+			})
+		}
+
 	case "refresh_token":
 		claims, ok := client.ValidToken(instance, permissions.RefreshTokenAudience, c.FormValue("refresh_token"))
 		if !ok {
@@ -993,6 +1217,9 @@ func checkRegistrationToken(next echo.HandlerFunc) echo.HandlerFunc {
 
 func passphraseResetForm(c echo.Context) error {
 	instance := middlewares.GetInstance(c)
+	if IsPassphraseLoginDisabled(instance) {
+		return renderPassphraseDisabled(c, instance)
+	}
 	return c.Render(http.StatusOK, "passphrase_reset.html", echo.Map{
 		"Domain": instance.ContextualDomain(),
 		"Locale": instance.Locale,
@@ -1002,6 +1229,13 @@ func passphraseResetForm(c echo.Context) error {
 
 func passphraseReset(c echo.Context) error {
 	i := middlewares.GetInstance(c)
+	if IsPassphraseLoginDisabled(i) {
+		return renderPassphraseDisabled(c, i)
+	}
+	if delay := RetryAfter(c, i, limits.PassphraseResetType); delay > 0 {
+		return renderTooManyAttempts(c, i, delay)
+	}
+	CountAttempt(c, i, limits.PassphraseResetType)
 	// TODO: check user informations to allow the reset of the passphrase since
 	// this route is of course not protected by authentication/permission check.
 	if err := i.RequestPassphraseReset(); err != nil && err != instance.ErrResetAlreadyRequested {
@@ -1030,6 +1264,9 @@ func passphraseRenewForm(c echo.Context) error {
 		redirect := inst.DefaultRedirection().String()
 		return c.Redirect(http.StatusSeeOther, redirect)
 	}
+	if IsPassphraseLoginDisabled(inst) {
+		return renderPassphraseDisabled(c, inst)
+	}
 	// Check that the token is actually defined and well encoded. The actual
 	// token value checking is also done on the passphraseRenew handler.
 	token, err := hex.DecodeString(c.QueryParam("token"))
@@ -1064,6 +1301,9 @@ func passphraseRenew(c echo.Context) error {
 		redirect := inst.DefaultRedirection().String()
 		return c.Redirect(http.StatusSeeOther, redirect)
 	}
+	if IsPassphraseLoginDisabled(inst) {
+		return renderPassphraseDisabled(c, inst)
+	}
 	pass := []byte(c.FormValue("passphrase"))
 	token, err := hex.DecodeString(c.FormValue("passphrase_reset_token"))
 	if err != nil {
@@ -1083,6 +1323,7 @@ func passphraseRenew(c echo.Context) error {
 			"error": "invalid_token",
 		})
 	}
+	audit.Log(inst, c.Request(), audit.PassphraseRenewed, nil)
 	return c.Redirect(http.StatusSeeOther, inst.PageURL("/auth/login", nil))
 }
 
@@ -1098,6 +1339,9 @@ func Routes(router *echo.Group) {
 	router.GET("/login", loginForm, noCSRF)
 	router.POST("/login", login, noCSRF)
 
+	router.GET("/oidc/start", startOIDC)
+	router.GET("/oidc/callback", callbackOIDC, noCSRF)
+
 	router.DELETE("/login/others", logoutOthers)
 	router.OPTIONS("/login/others", logoutPreflight)
 	router.DELETE("/login", logout)
@@ -1122,4 +1366,9 @@ func Routes(router *echo.Group) {
 	authorizeGroup.POST("/app", authorizeApp)
 
 	router.POST("/access_token", accessToken)
+	router.POST("/introspect", introspectToken)
+	router.POST("/revoke", revokeToken)
+	router.POST("/device_authorization", deviceAuthorization)
+	router.GET("/device", deviceForm, noCSRF)
+	router.POST("/device", device, noCSRF)
 }
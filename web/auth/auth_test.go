@@ -18,6 +18,7 @@ import (
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	app "github.com/cozy/cozy-stack/pkg/apps"
 	"github.com/cozy/cozy-stack/pkg/config"
@@ -25,6 +26,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/oauth"
 	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
@@ -53,6 +55,11 @@ var altRegistrationToken string
 var csrfToken string
 var code string
 var refreshToken string
+var publicClientID string
+
+// codeVerifier and codeChallenge are the example of the appendix B of RFC 7636
+const codeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+const codeChallenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
 
 func getSessionID(cookies []*http.Cookie) string {
 	for _, c := range cookies {
@@ -189,6 +196,40 @@ func TestLoginWithBadPassphrase(t *testing.T) {
 	assert.Equal(t, "401 Unauthorized", res.Status)
 }
 
+func TestLoginWithTooManyAttempts(t *testing.T) {
+	defer limits.ResetAll(testInstance, "")
+	previousStep := limits.DelayStep
+	limits.DelayStep = 5 * time.Second
+	defer func() { limits.DelayStep = previousStep }()
+
+	var retryAfter string
+	for k := int64(0); k <= limits.Policies[limits.AuthType].FreeAttempts && retryAfter == ""; k++ {
+		res, err := postForm("/auth/login", &url.Values{
+			"passphrase": {"Nope"},
+			"csrf_token": {getLoginCSRFToken(client, t)},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, "401 Unauthorized", res.Status)
+		retryAfter = res.Header.Get("Retry-After")
+	}
+	assert.Equal(t, "5", retryAfter)
+
+	// The client must wait before trying again, even with the good passphrase
+	res, err := postForm("/auth/login", &url.Values{
+		"passphrase": {"MyPassphrase"},
+		"csrf_token": {getLoginCSRFToken(client, t)},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer res.Body.Close()
+	assert.Equal(t, "429 Too Many Requests", res.Status)
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+}
+
 func TestLoginWithGoodPassphrase(t *testing.T) {
 	token := getLoginCSRFToken(client, t)
 	res, err := postForm("/auth/login", &url.Values{
@@ -1079,6 +1120,256 @@ func TestRefreshTokenSuccess(t *testing.T) {
 	assertValidToken(t, response["access_token"], "access")
 }
 
+func TestIntrospectAndRevokeToken(t *testing.T) {
+	res, err := postForm("/auth/access_token", &url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"refresh_token": {refreshToken},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	var response map[string]string
+	err = json.NewDecoder(res.Body).Decode(&response)
+	assert.NoError(t, err)
+	accessToken := response["access_token"]
+
+	res, err = postForm("/auth/introspect", &url.Values{
+		"client_id":     {clientID},
+		"client_secret": {"foo"},
+		"token":         {accessToken},
+	})
+	assert.NoError(t, err)
+	assertJSONError(t, res, "invalid client_secret")
+
+	introspect := func() map[string]interface{} {
+		res, err := postForm("/auth/introspect", &url.Values{
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"token":         {accessToken},
+		})
+		assert.NoError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, "200 OK", res.Status)
+		var result map[string]interface{}
+		err = json.NewDecoder(res.Body).Decode(&result)
+		assert.NoError(t, err)
+		return result
+	}
+	result := introspect()
+	assert.Equal(t, true, result["active"])
+	assert.Equal(t, "files:read", result["scope"])
+	assert.Equal(t, clientID, result["client_id"])
+	assert.Equal(t, "access", result["aud"])
+	assert.NotNil(t, result["exp"])
+
+	// Revoking an invalid token is not an error
+	res, err = postForm("/auth/revoke", &url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"token":         {"foo"},
+	})
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+
+	res, err = postForm("/auth/revoke", &url.Values{
+		"client_id":       {clientID},
+		"client_secret":   {clientSecret},
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	})
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+
+	result = introspect()
+	assert.Equal(t, false, result["active"])
+	assert.Nil(t, result["scope"])
+}
+
+func TestRegisterPublicClient(t *testing.T) {
+	res, err := postJSON("/auth/register", echo.Map{
+		"redirect_uris":              []string{"https://example.org/oauth/callback"},
+		"client_name":                "cozy-test-public",
+		"software_id":                "github.com/cozy/cozy-test",
+		"token_endpoint_auth_method": "none",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "201 Created", res.Status)
+	var client oauth.Client
+	err = json.NewDecoder(res.Body).Decode(&client)
+	assert.NoError(t, err)
+	assert.NotEqual(t, client.ClientID, "")
+	assert.Equal(t, client.ClientSecret, "")
+	assert.Equal(t, client.TokenEndpointAuthMethod, "none")
+	publicClientID = client.ClientID
+}
+
+func TestAuthorizePublicClientWithoutChallenge(t *testing.T) {
+	res, err := postForm("/auth/authorize", &url.Values{
+		"state":         {"123456"},
+		"client_id":     {publicClientID},
+		"redirect_uri":  {"https://example.org/oauth/callback"},
+		"scope":         {"files:read"},
+		"csrf_token":    {csrfToken},
+		"response_type": {"code"},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "The code_challenge parameter is mandatory")
+}
+
+func TestAuthorizePublicClientWithPlainChallenge(t *testing.T) {
+	res, err := postForm("/auth/authorize", &url.Values{
+		"state":                 {"123456"},
+		"client_id":             {publicClientID},
+		"redirect_uri":          {"https://example.org/oauth/callback"},
+		"scope":                 {"files:read"},
+		"csrf_token":            {csrfToken},
+		"response_type":         {"code"},
+		"code_challenge":        {codeVerifier},
+		"code_challenge_method": {"plain"},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "The code_challenge_method parameter is invalid")
+}
+
+func TestAccessTokenPublicClientInvalidVerifier(t *testing.T) {
+	accessCode := authorizeWithChallenge(t)
+	res, err := postForm("/auth/access_token", &url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {publicClientID},
+		"code":          {accessCode},
+		"code_verifier": {"foo"},
+	})
+	assert.NoError(t, err)
+	assertJSONError(t, res, "invalid code_verifier")
+
+	// The access code can't be used after a failed verification
+	res, err = postForm("/auth/access_token", &url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {publicClientID},
+		"code":          {accessCode},
+		"code_verifier": {codeVerifier},
+	})
+	assert.NoError(t, err)
+	assertJSONError(t, res, "invalid code")
+}
+
+func TestAccessTokenPublicClientSuccess(t *testing.T) {
+	accessCode := authorizeWithChallenge(t)
+	res, err := postForm("/auth/access_token", &url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {publicClientID},
+		"code":          {accessCode},
+		"code_verifier": {codeVerifier},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	var response map[string]string
+	err = json.NewDecoder(res.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, "bearer", response["token_type"])
+	assert.Equal(t, "files:read", response["scope"])
+	assertValidToken(t, response["access_token"], "access")
+	assertValidToken(t, response["refresh_token"], "refresh")
+}
+
+func TestDeviceAuthorizationFlow(t *testing.T) {
+	res, err := postForm("/auth/device_authorization", &url.Values{
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"scope":         {"files:read"},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	var authz struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&authz)
+	assert.NoError(t, err)
+	assert.Regexp(t, "^[A-Z]{4}-[A-Z]{4}$", authz.UserCode)
+	assert.Equal(t, "https://"+domain+"/auth/device", authz.VerificationURI)
+	assert.Contains(t, authz.VerificationURIComplete, "user_code="+authz.UserCode)
+	assert.Equal(t, 5, authz.Interval)
+	assert.True(t, authz.ExpiresIn > 0)
+
+	poll := &url.Values{
+		"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+		"client_id":     {clientID},
+		"client_secret": {clientSecret},
+		"device_code":   {authz.DeviceCode},
+	}
+	res, err = postForm("/auth/access_token", poll)
+	assert.NoError(t, err)
+	assertJSONError(t, res, "authorization_pending")
+	res, err = postForm("/auth/access_token", poll)
+	assert.NoError(t, err)
+	assertJSONError(t, res, "slow_down")
+
+	req, _ := http.NewRequest("GET", ts.URL+"/auth/device?user_code=foo", nil)
+	req.Host = domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/device?user_code="+strings.ToLower(authz.UserCode), nil)
+	req.Host = domain
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), authz.UserCode)
+	re := regexp.MustCompile(`<input type="hidden" name="csrf_token" value="(\w+)"`)
+	matches := re.FindStringSubmatch(string(body))
+	if !assert.Len(t, matches, 2) {
+		return
+	}
+
+	res, err = postForm("/auth/device", &url.Values{
+		"user_code":  {authz.UserCode},
+		"approve":    {"true"},
+		"csrf_token": {matches[1]},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	body, _ = ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), "Your device is now connected")
+
+	res, err = postForm("/auth/access_token", poll)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	var response map[string]string
+	err = json.NewDecoder(res.Body).Decode(&response)
+	assert.NoError(t, err)
+	assert.Equal(t, "bearer", response["token_type"])
+	assert.Equal(t, "files:read", response["scope"])
+	assertValidToken(t, response["access_token"], "access")
+	assertValidToken(t, response["refresh_token"], "refresh")
+
+	// The device code can be used only once
+	res, err = postForm("/auth/access_token", poll)
+	assert.NoError(t, err)
+	assertJSONError(t, res, "invalid device_code")
+}
+
 func TestLogoutNoToken(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", ts.URL+"/auth/login", nil)
 	req.Host = domain
@@ -1311,6 +1602,166 @@ func TestPassphraseRenew(t *testing.T) {
 	}
 }
 
+func TestLoginWithOIDC(t *testing.T) {
+	var nonce string
+	mux := http.NewServeMux()
+	provider := httptest.NewServer(mux)
+	defer provider.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 provider.URL,
+			"authorization_endpoint": provider.URL + "/authorize",
+			"token_endpoint":         provider.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "valid-code" || r.FormValue("client_secret") != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		idToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"iss":         provider.URL,
+			"aud":         "cozy",
+			"sub":         "alice",
+			"exp":         time.Now().Add(time.Minute).Unix(),
+			"nonce":       nonce,
+			"cozy_domain": domain,
+		}).SignedString([]byte("key"))
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "foo",
+			"id_token":     idToken,
+		})
+	})
+
+	previous := config.GetConfig().Contexts
+	config.GetConfig().Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"oidc": map[string]interface{}{
+				"issuer":        provider.URL,
+				"client_id":     "cozy",
+				"client_secret": "secret",
+				"domain_claim":  "cozy_domain",
+			},
+		},
+	}
+	defer func() { config.GetConfig().Contexts = previous }()
+
+	j, _ := cookiejar.New(nil)
+	oidcClient := &http.Client{CheckRedirect: noRedirect, Jar: j}
+	req, _ := http.NewRequest("GET", ts.URL+"/auth/oidc/start", nil)
+	req.Host = domain
+	res, err := oidcClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	if !assert.Equal(t, "303 See Other", res.Status) {
+		return
+	}
+	location, err := url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, provider.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "cozy", location.Query().Get("client_id"))
+	state := location.Query().Get("state")
+	nonce = location.Query().Get("nonce")
+	var stateCookie *http.Cookie
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == "cozy_oidc" {
+			stateCookie = cookie
+		}
+	}
+	if !assert.NotNil(t, stateCookie) {
+		return
+	}
+
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/oidc/callback?code=valid-code&state="+state, nil)
+	req.Host = domain
+	res, err = oidcClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	if assert.Equal(t, "303 See Other", res.Status) {
+		var hasSession bool
+		for _, cookie := range res.Cookies() {
+			if cookie.Name == sessions.SessionCookieName && cookie.Value != "" {
+				hasSession = true
+			}
+		}
+		assert.True(t, hasSession)
+	}
+
+	// The state can be used only once, even if the cookie is replayed
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/oidc/callback?code=valid-code&state="+state, nil)
+	req.Host = domain
+	req.AddCookie(&http.Cookie{Name: stateCookie.Name, Value: stateCookie.Value})
+	res, err = (&http.Client{CheckRedirect: noRedirect}).Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "400 Bad Request", res.Status)
+
+	// The two-factor authentication of the instance is still required
+	err = instance.Patch(testInstance, &instance.Options{AuthMode: "two_factor_mail"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		_ = instance.Patch(testInstance, &instance.Options{AuthMode: "basic"})
+	}()
+	j, _ = cookiejar.New(nil)
+	oidcClient = &http.Client{CheckRedirect: noRedirect, Jar: j}
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/oidc/start", nil)
+	req.Host = domain
+	res, err = oidcClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	if !assert.Equal(t, "303 See Other", res.Status) {
+		return
+	}
+	location, err = url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	state = location.Query().Get("state")
+	nonce = location.Query().Get("nonce")
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/oidc/callback?code=valid-code&state="+state, nil)
+	req.Host = domain
+	res, err = oidcClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessions.SessionCookieName {
+			assert.Empty(t, cookie.Value)
+		}
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	assert.Contains(t, string(body), `name="two-factor-token"`)
+}
+
+func TestPassphraseDisabledWithOIDC(t *testing.T) {
+	previous := config.GetConfig().Contexts
+	config.GetConfig().Contexts = map[string]interface{}{
+		"default": map[string]interface{}{
+			"oidc": map[string]interface{}{
+				"issuer":             "https://id.example.org",
+				"client_id":          "cozy",
+				"domain_claim":       "cozy_domain",
+				"disable_passphrase": true,
+			},
+		},
+	}
+	defer func() { config.GetConfig().Contexts = previous }()
+
+	req, _ := http.NewRequest("GET", ts.URL+"/auth/passphrase_reset", nil)
+	req.Host = domain
+	res, err := (&http.Client{CheckRedirect: noRedirect}).Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "403 Forbidden", res.Status)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/auth/passphrase_renew?token=badbee", nil)
+	req.Host = domain
+	res, err = (&http.Client{CheckRedirect: noRedirect}).Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, "403 Forbidden", res.Status)
+}
+
 func TestIsLoggedOutAfterLogout(t *testing.T) {
 	content, err := getTestURL()
 	assert.NoError(t, err)
@@ -1435,6 +1886,27 @@ func assertValidToken(t *testing.T, token, audience string) {
 	assert.Equal(t, "files:read", claims.Scope)
 }
 
+func authorizeWithChallenge(t *testing.T) string {
+	res, err := postForm("/auth/authorize", &url.Values{
+		"state":                 {"123456"},
+		"client_id":             {publicClientID},
+		"redirect_uri":          {"https://example.org/oauth/callback"},
+		"scope":                 {"files:read"},
+		"csrf_token":            {csrfToken},
+		"response_type":         {"code"},
+		"code_challenge":        {codeChallenge},
+		"code_challenge_method": {"S256"},
+	})
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	if !assert.Equal(t, "302 Found", res.Status) {
+		return ""
+	}
+	u, err := url.Parse(res.Header.Get("Location"))
+	assert.NoError(t, err)
+	return u.Query().Get("code")
+}
+
 func assertJSONError(t *testing.T, res *http.Response, message string) {
 	defer res.Body.Close()
 	assert.Equal(t, "400 Bad Request", res.Status)
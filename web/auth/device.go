@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// The device authorization grant (RFC 8628) is used by the clients that
+// can't open a browser with a redirection to their redirect_uri, like the
+// CLI, a smart TV or a NAS. The client asks for a device code and a user
+// code, and displays the user code with the verification URI. The user opens
+// this URI in a browser, logs in and types the user code to approve the
+// device. In the meantime, the client polls the token endpoint with the
+// device code, until the user has approved or denied it.
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+func deviceAuthorization(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	scope := c.FormValue("scope")
+
+	client, hasError, err := checkClientCredentials(c, inst)
+	if hasError {
+		return err
+	}
+	if scope == "" || scope == oauth.ScopeLogin {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid_scope",
+		})
+	}
+	if _, err = permissions.UnmarshalScopeString(scope); err != nil {
+		return c.JSON(http.StatusBadRequest, echo.Map{
+			"error": "invalid_scope",
+		})
+	}
+
+	deviceCode, err := oauth.CreateDeviceCode(inst, client.CouchID, scope)
+	if err != nil {
+		return err
+	}
+	userCode := deviceCode.DisplayUserCode()
+	return c.JSON(http.StatusOK, deviceAuthorizationResponse{
+		DeviceCode:              deviceCode.DeviceCode(),
+		UserCode:                userCode,
+		VerificationURI:         inst.PageURL("/auth/device", nil),
+		VerificationURIComplete: inst.PageURL("/auth/device", url.Values{"user_code": {userCode}}),
+		ExpiresIn:               deviceCode.ExpiresIn(),
+		Interval:                deviceCode.Interval,
+	})
+}
+
+// findPendingDeviceCode returns the device code for the user code sent by the
+// user, or the translation key of the error to display.
+func findPendingDeviceCode(inst *instance.Instance, userCode string) (*oauth.DeviceCode, string, error) {
+	deviceCode, err := oauth.FindDeviceCodeByUserCode(inst, userCode)
+	switch err {
+	case nil:
+	case oauth.ErrInvalidDeviceCode:
+		return nil, "Device Invalid code", nil
+	case oauth.ErrExpiredToken:
+		return nil, "Device Expired code", nil
+	default:
+		return nil, "", err
+	}
+	if deviceCode.Status != oauth.DeviceCodePending {
+		return nil, "Device Invalid code", nil
+	}
+	return deviceCode, "", nil
+}
+
+func renderUserCodeForm(c echo.Context, inst *instance.Instance, code int, userCode, errorKey string) error {
+	return c.Render(code, "authorize.html", echo.Map{
+		"Domain":        inst.ContextualDomain(),
+		"Locale":        inst.Locale,
+		"AskUserCode":   true,
+		"UserCodeValue": userCode,
+		"UserCodeError": errorKey,
+	})
+}
+
+func deviceForm(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if !middlewares.IsLoggedIn(c) {
+		u := inst.PageURL("/auth/login", url.Values{
+			"redirect": {inst.FromURL(c.Request().URL)},
+		})
+		return c.Redirect(http.StatusSeeOther, u)
+	}
+
+	userCode := c.QueryParam("user_code")
+	if userCode == "" {
+		return renderUserCodeForm(c, inst, http.StatusOK, "", "")
+	}
+	deviceCode, errorKey, err := findPendingDeviceCode(inst, userCode)
+	if err != nil {
+		return err
+	}
+	if errorKey != "" {
+		return renderUserCodeForm(c, inst, http.StatusBadRequest, userCode, errorKey)
+	}
+
+	client, err := oauth.FindClient(inst, deviceCode.ClientID)
+	if err != nil {
+		return renderUserCodeForm(c, inst, http.StatusBadRequest, userCode, "Device Invalid code")
+	}
+	perms, err := permissions.UnmarshalScopeString(deviceCode.Scope)
+	if err != nil {
+		return c.Render(http.StatusBadRequest, "error.html", echo.Map{
+			"Domain": inst.ContextualDomain(),
+			"Error":  "Error Invalid scope",
+		})
+	}
+	readOnly := true
+	for _, p := range perms {
+		if !p.Verbs.ReadOnly() {
+			readOnly = false
+		}
+	}
+	client.ClientID = client.CouchID
+	allowClientLogo(c, client)
+
+	return c.Render(http.StatusOK, "authorize.html", echo.Map{
+		"Domain":      inst.ContextualDomain(),
+		"Locale":      inst.Locale,
+		"Client":      client,
+		"UserCode":    deviceCode.DisplayUserCode(),
+		"Permissions": perms,
+		"ReadOnly":    readOnly,
+		"CSRF":        c.Get("csrf"),
+	})
+}
+
+func device(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if !middlewares.IsLoggedIn(c) {
+		return c.Render(http.StatusUnauthorized, "error.html", echo.Map{
+			"Domain": inst.ContextualDomain(),
+			"Error":  "Error Must be authenticated",
+		})
+	}
+
+	userCode := c.FormValue("user_code")
+	deviceCode, errorKey, err := findPendingDeviceCode(inst, userCode)
+	if err != nil {
+		return err
+	}
+	if errorKey != "" {
+		return renderUserCodeForm(c, inst, http.StatusBadRequest, userCode, errorKey)
+	}
+
+	result := "Device Denied"
+	if c.FormValue("approve") == "true" {
+		result = "Device Approved"
+		err = deviceCode.Approve(inst)
+	} else {
+		err = deviceCode.Deny(inst)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "authorize.html", echo.Map{
+		"Domain":       inst.ContextualDomain(),
+		"Locale":       inst.Locale,
+		"DeviceResult": result,
+	})
+}
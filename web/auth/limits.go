@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/echo"
+)
+
+// TooManyAttemptsKey is the key for translating the message showed to the
+// user when they are locked out after too many failed attempts.
+const TooManyAttemptsKey = "Login Too many attempts"
+
+// RetryAfter returns how long the client must wait before a new attempt for
+// this type of action, or 0 if it can try now.
+func RetryAfter(c echo.Context, inst *instance.Instance, typ limits.CounterType) time.Duration {
+	return limits.RetryAfter(inst, typ, limits.RequestIP(c.Request()))
+}
+
+// SetRetryAfter puts the Retry-After header on the response, with the given
+// delay rounded up to the second.
+func SetRetryAfter(c echo.Context, delay time.Duration) {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// CheckAttempts returns a 429 Too Many Requests error, with a Retry-After
+// header, if the client must wait before a new attempt for this type of
+// action.
+func CheckAttempts(c echo.Context, inst *instance.Instance, typ limits.CounterType) error {
+	if delay := RetryAfter(c, inst, typ); delay > 0 {
+		SetRetryAfter(c, delay)
+		return jsonapi.NewError(http.StatusTooManyRequests, inst.Translate(TooManyAttemptsKey))
+	}
+	return nil
+}
+
+// CountAttempt counts a failed attempt of the client. If the client must
+// wait before the next attempt, the delay is put in the Retry-After header.
+// When the client is locked out, the owner of the instance is warned by mail.
+func CountAttempt(c echo.Context, inst *instance.Instance, typ limits.CounterType) {
+	ip := limits.RequestIP(c.Request())
+	delay, lockedNow := limits.Attempt(inst, typ, ip)
+	if lockedNow {
+		inst.Logger().WithField("nspace", "auth").
+			Warnf("Too many attempts for %s from %s", typ, ip)
+		if err := sendLockoutMail(inst, typ, ip); err != nil {
+			inst.Logger().Errorf("Could not send the lockout mail: %s", err)
+		}
+	}
+	if delay > 0 {
+		SetRetryAfter(c, delay)
+	}
+}
+
+// ResetAttempts resets the counter of attempts of the client, after a
+// successful authentication.
+func ResetAttempts(c echo.Context, inst *instance.Instance, types ...limits.CounterType) {
+	ip := limits.RequestIP(c.Request())
+	for _, typ := range types {
+		limits.Reset(inst, typ, ip)
+	}
+}
+
+func sendLockoutMail(inst *instance.Instance, typ limits.CounterType, ip string) error {
+	changePassphraseURL := inst.SubDomain(consts.SettingsSlug)
+	changePassphraseURL.Fragment = "/profile"
+	minutes := int(limits.Policies[typ].Lockout / time.Minute)
+	return inst.SendMail(&instance.Mail{
+		TemplateName: "account_lockout",
+		TemplateValues: map[string]interface{}{
+			"IP":                   ip,
+			"Minutes":              minutes,
+			"ChangePassphraseLink": changePassphraseURL.String(),
+		},
+	})
+}
+
+func renderTooManyAttempts(c echo.Context, inst *instance.Instance, delay time.Duration) error {
+	SetRetryAfter(c, delay)
+	return c.Render(http.StatusTooManyRequests, "error.html", echo.Map{
+		"Domain": inst.ContextualDomain(),
+		"Error":  "Error Too many attempts",
+	})
+}
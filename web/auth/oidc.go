@@ -0,0 +1,401 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/sessions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+	"github.com/mitchellh/mapstructure"
+	jwt "gopkg.in/dgrijalva/jwt-go.v3"
+)
+
+// The login of the instances of a context can be delegated to an OpenID
+// Connect provider, with the authorization code flow. It is configured in the
+// oidc section of the context:
+//
+//	contexts:
+//	  my-context:
+//	    oidc:
+//	      provider_name: My Company
+//	      issuer: https://id.example.org
+//	      client_id: cozy
+//	      client_secret: xxxxxxxx
+//	      scope: openid profile
+//	      domain_claim: preferred_username
+//	      domain_suffix: .cozy.example.org
+//	      disable_passphrase: true
+//
+// The domain of the instance is given by a claim of the ID token (or of the
+// userinfo endpoint), with an optional suffix. The redirect URI to register
+// on the provider is https://<instance>/auth/oidc/callback.
+
+const oidcCookieName = "cozy_oidc"
+
+// oidcDiscoveryTTL is the duration during which the configuration of an
+// OpenID Connect provider is kept in memory.
+const oidcDiscoveryTTL = 1 * time.Hour
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+var (
+	oidcProviders   = make(map[string]*oidcProvider)
+	oidcProvidersMu sync.Mutex
+)
+
+type oidcConfig struct {
+	ProviderName      string `mapstructure:"provider_name"`
+	Issuer            string `mapstructure:"issuer"`
+	ClientID          string `mapstructure:"client_id"`
+	ClientSecret      string `mapstructure:"client_secret"`
+	Scope             string `mapstructure:"scope"`
+	DomainClaim       string `mapstructure:"domain_claim"`
+	DomainSuffix      string `mapstructure:"domain_suffix"`
+	DisablePassphrase bool   `mapstructure:"disable_passphrase"`
+}
+
+// oidcProvider is the configuration of an OpenID Connect provider, as given
+// by its discovery endpoint.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	expires               time.Time
+}
+
+// getOIDCConfig returns the configuration of the OpenID Connect login for
+// the context of the instance, or nil if the login is not delegated.
+func getOIDCConfig(inst *instance.Instance) *oidcConfig {
+	context, err := inst.SettingsContext()
+	if err != nil {
+		return nil
+	}
+	section, ok := context["oidc"]
+	if !ok {
+		return nil
+	}
+	var conf oidcConfig
+	if err = mapstructure.Decode(section, &conf); err != nil {
+		inst.Logger().WithField("nspace", "oidc").
+			Warnf("Invalid configuration for the context %s: %s", inst.ContextName, err)
+		return nil
+	}
+	if conf.Issuer == "" || conf.ClientID == "" || conf.DomainClaim == "" {
+		return nil
+	}
+	if conf.Scope == "" {
+		conf.Scope = "openid"
+	}
+	if conf.ProviderName == "" {
+		conf.ProviderName = conf.Issuer
+	}
+	return &conf
+}
+
+// IsPassphraseLoginDisabled returns true if the user of the instance can log
+// in only with the OpenID Connect provider of its context. In that case, the
+// passphrase can't be reset or changed either.
+func IsPassphraseLoginDisabled(inst *instance.Instance) bool {
+	conf := getOIDCConfig(inst)
+	return conf != nil && conf.DisablePassphrase
+}
+
+// getOIDCProvider returns the configuration of the provider, from its
+// discovery endpoint.
+func getOIDCProvider(issuer string) (*oidcProvider, error) {
+	oidcProvidersMu.Lock()
+	provider, ok := oidcProviders[issuer]
+	oidcProvidersMu.Unlock()
+	if ok && time.Now().Before(provider.expires) {
+		return provider, nil
+	}
+
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	res, err := oidcClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code for the discovery: %d", res.StatusCode)
+	}
+	provider = &oidcProvider{}
+	if err = json.NewDecoder(res.Body).Decode(provider); err != nil {
+		return nil, err
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" {
+		return nil, errors.New("Missing endpoints in the discovery")
+	}
+	provider.expires = time.Now().Add(oidcDiscoveryTTL)
+
+	oidcProvidersMu.Lock()
+	oidcProviders[issuer] = provider
+	oidcProvidersMu.Unlock()
+	return provider, nil
+}
+
+func renderOIDCError(c echo.Context, inst *instance.Instance, code int, key string) error {
+	return c.Render(code, "error.html", echo.Map{
+		"Domain": inst.ContextualDomain(),
+		"Error":  key,
+	})
+}
+
+// renderPassphraseDisabled is used for the routes of the passphrase when the
+// login is delegated to the OpenID Connect provider.
+func renderPassphraseDisabled(c echo.Context, inst *instance.Instance) error {
+	return renderOIDCError(c, inst, http.StatusForbidden, "Error OIDC passphrase disabled")
+}
+
+func startOIDC(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	conf := getOIDCConfig(inst)
+	if conf == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "OpenID Connect is not configured")
+	}
+
+	redirect, err := checkRedirectParam(c, inst.DefaultRedirection())
+	if err != nil {
+		return err
+	}
+
+	provider, err := getOIDCProvider(conf.Issuer)
+	if err != nil {
+		inst.Logger().WithField("nspace", "oidc").
+			Warnf("Cannot discover the provider %s: %s", conf.Issuer, err)
+		return renderOIDCError(c, inst, http.StatusBadGateway, "Error OIDC provider unavailable")
+	}
+
+	state := &oidcState{
+		Domain:   inst.Domain,
+		Nonce:    hex.EncodeToString(crypto.GenerateRandomBytes(16)),
+		Redirect: redirect.String(),
+	}
+	ref, err := getOIDCStateStorage().Add(state)
+	if err != nil {
+		return err
+	}
+	// The cookie binds the state to the browser that has started the login.
+	c.SetCookie(&http.Cookie{
+		Name:     oidcCookieName,
+		Value:    ref,
+		Path:     "/auth/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   !config.IsDevRelease(),
+	})
+
+	u, err := url.Parse(provider.AuthorizationEndpoint)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", conf.ClientID)
+	q.Set("redirect_uri", inst.PageURL("/auth/oidc/callback", nil))
+	q.Set("scope", conf.Scope)
+	q.Set("state", ref)
+	q.Set("nonce", state.Nonce)
+	u.RawQuery = q.Encode()
+	return c.Redirect(http.StatusSeeOther, u.String())
+}
+
+func callbackOIDC(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	logger := inst.Logger().WithField("nspace", "oidc")
+	conf := getOIDCConfig(inst)
+	if conf == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "OpenID Connect is not configured")
+	}
+
+	cookie, err := c.Cookie(oidcCookieName)
+	if err != nil || cookie.Value == "" || c.QueryParam("state") != cookie.Value {
+		return renderOIDCError(c, inst, http.StatusBadRequest, "Error OIDC invalid state")
+	}
+	// The state is deleted from the storage, so that the callback can't be
+	// replayed, even with the same cookie.
+	state := getOIDCStateStorage().FindAndDelete(cookie.Value)
+	c.SetCookie(&http.Cookie{
+		Name:     oidcCookieName,
+		Value:    "",
+		Path:     "/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !config.IsDevRelease(),
+	})
+	if state == nil || state.Domain != inst.Domain {
+		return renderOIDCError(c, inst, http.StatusBadRequest, "Error OIDC invalid state")
+	}
+	if errCode := c.QueryParam("error"); errCode != "" {
+		logger.Infof("The provider has returned an error: %s", errCode)
+		return renderOIDCError(c, inst, http.StatusForbidden, "Error OIDC failed")
+	}
+
+	provider, err := getOIDCProvider(conf.Issuer)
+	if err != nil {
+		logger.Warnf("Cannot discover the provider %s: %s", conf.Issuer, err)
+		return renderOIDCError(c, inst, http.StatusBadGateway, "Error OIDC provider unavailable")
+	}
+	redirectURI := inst.PageURL("/auth/oidc/callback", nil)
+	claims, err := exchangeOIDCCode(conf, provider, redirectURI, c.QueryParam("code"), state.Nonce)
+	if err != nil {
+		logger.Infof("Cannot check the authorization code: %s", err)
+		return renderOIDCError(c, inst, http.StatusForbidden, "Error OIDC failed")
+	}
+	domain, ok := claims[conf.DomainClaim].(string)
+	if !ok || !inst.HasDomain(strings.ToLower(domain+conf.DomainSuffix)) {
+		logger.Infof("The claim %s does not match the instance", conf.DomainClaim)
+		return renderOIDCError(c, inst, http.StatusForbidden, "Error OIDC invalid domain")
+	}
+
+	redirect, err := url.Parse(state.Redirect)
+	if err != nil {
+		redirect = inst.DefaultRedirection()
+	}
+
+	// The provider replaces the passphrase, not the second factor: if the
+	// instance has a two-factor authentication, the user must go through it
+	// before having a session.
+	if inst.HasTwoFactor() {
+		challenge, err := inst.BeginTwoFactor("")
+		if err != nil {
+			return err
+		}
+		return renderTwoFactorForm(c, inst, http.StatusOK, redirect, challenge, false)
+	}
+
+	sessionID, err := SetCookieForNewSession(c, false)
+	if err != nil {
+		return err
+	}
+	if err = sessions.StoreNewLoginEntry(inst, sessionID, "", c.Request(), true); err != nil {
+		inst.Logger().Errorf("Could not store session history %q: %s", sessionID, err)
+	}
+
+	redirect = addCodeToRedirect(redirect, inst.ContextualDomain(), sessionID)
+	return c.Redirect(http.StatusSeeOther, redirect.String())
+}
+
+// exchangeOIDCCode exchanges the authorization code for the tokens, and
+// returns the claims of the user. The claims of the ID token are completed
+// with the userinfo endpoint if they don't have the claim for the domain.
+func exchangeOIDCCode(conf *oidcConfig, provider *oidcProvider, redirectURI, code, nonce string) (jwt.MapClaims, error) {
+	if code == "" {
+		return nil, errors.New("Missing code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {conf.ClientID},
+		"client_secret": {conf.ClientSecret},
+	}
+	req, err := http.NewRequest(http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code for the token endpoint: %d", res.StatusCode)
+	}
+	var tokens struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+
+	// The ID token comes directly from the token endpoint, over TLS: its
+	// signature doesn't need to be checked (OpenID Connect Core, 3.1.3.7),
+	// but its claims do.
+	claims := jwt.MapClaims{}
+	if _, _, err = new(jwt.Parser).ParseUnverified(tokens.IDToken, claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != provider.Issuer {
+		return nil, errors.New("Invalid issuer")
+	}
+	if !oidcAudienceContains(claims["aud"], conf.ClientID) {
+		return nil, errors.New("Invalid audience")
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, errors.New("Expired ID token")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("Invalid nonce")
+	}
+
+	if _, ok := claims[conf.DomainClaim]; !ok && provider.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		userinfo, err := fetchOIDCUserinfo(provider, tokens.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		sub, _ := claims["sub"].(string)
+		if s, _ := userinfo["sub"].(string); s == "" || s != sub {
+			return nil, errors.New("Invalid subject for userinfo")
+		}
+		for k, v := range userinfo {
+			if _, ok := claims[k]; !ok {
+				claims[k] = v
+			}
+		}
+	}
+	return claims, nil
+}
+
+func fetchOIDCUserinfo(provider *oidcProvider, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, provider.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accessToken)
+	req.Header.Set(echo.HeaderAccept, echo.MIMEApplicationJSON)
+	res, err := oidcClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status code for the userinfo endpoint: %d", res.StatusCode)
+	}
+	var userinfo map[string]interface{}
+	if err = json.NewDecoder(res.Body).Decode(&userinfo); err != nil {
+		return nil, err
+	}
+	return userinfo, nil
+}
+
+// oidcAudienceContains checks the aud claim, that can be a string or an
+// array of strings.
+func oidcAudienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/go-redis/redis"
+)
+
+// oidcStateTTL is the maximal duration between the redirection to the
+// OpenID Connect provider and the callback.
+const oidcStateTTL = 15 * time.Minute
+
+// oidcState is kept on the server between the redirection to the provider and
+// the callback. It is deleted when the callback is called, so that it can be
+// used only once.
+type oidcState struct {
+	Domain    string `json:"domain"`
+	Nonce     string `json:"nonce"`
+	Redirect  string `json:"redirect"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type oidcStateStorage interface {
+	Add(*oidcState) (string, error)
+	FindAndDelete(ref string) *oidcState
+}
+
+type memOIDCStateStorage struct {
+	mu     sync.Mutex
+	states map[string]*oidcState
+}
+
+func (store *memOIDCStateStorage) Add(state *oidcState) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now().UTC().Unix()
+	for ref, s := range store.states {
+		if s.ExpiresAt < now {
+			delete(store.states, ref)
+		}
+	}
+	state.ExpiresAt = time.Now().UTC().Add(oidcStateTTL).Unix()
+	ref := hex.EncodeToString(crypto.GenerateRandomBytes(16))
+	store.states[ref] = state
+	return ref, nil
+}
+
+func (store *memOIDCStateStorage) FindAndDelete(ref string) *oidcState {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state, ok := store.states[ref]
+	if !ok {
+		return nil
+	}
+	delete(store.states, ref)
+	if state.ExpiresAt < time.Now().UTC().Unix() {
+		return nil
+	}
+	return state
+}
+
+type subRedisOIDCInterface interface {
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+}
+
+type redisOIDCStateStorage struct {
+	cl subRedisOIDCInterface
+}
+
+func oidcStateKey(ref string) string {
+	return "oidc-state:" + ref
+}
+
+func (store *redisOIDCStateStorage) Add(state *oidcState) (string, error) {
+	ref := hex.EncodeToString(crypto.GenerateRandomBytes(16))
+	state.ExpiresAt = time.Now().UTC().Add(oidcStateTTL).Unix()
+	bb, err := json.Marshal(state)
+	if err != nil {
+		return "", err
+	}
+	return ref, store.cl.Set(oidcStateKey(ref), bb, oidcStateTTL).Err()
+}
+
+const luaOIDCGetAndDelete = `local v = redis.call("GET", KEYS[1]); redis.call("DEL", KEYS[1]); return v`
+
+func (store *redisOIDCStateStorage) FindAndDelete(ref string) *oidcState {
+	res, err := store.cl.Eval(luaOIDCGetAndDelete, []string{oidcStateKey(ref)}).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logger.WithNamespace("oidc").Errorf("Cannot fetch the state: %s", err)
+		}
+		return nil
+	}
+	bb, ok := res.(string)
+	if !ok {
+		return nil
+	}
+	var state oidcState
+	if err = json.Unmarshal([]byte(bb), &state); err != nil {
+		logger.WithNamespace("oidc").Errorf("Bad state in redis %s", bb)
+		return nil
+	}
+	return &state
+}
+
+var oidcStorage oidcStateStorage
+var oidcStorageMutex sync.Mutex
+
+func getOIDCStateStorage() oidcStateStorage {
+	oidcStorageMutex.Lock()
+	defer oidcStorageMutex.Unlock()
+	if oidcStorage != nil {
+		return oidcStorage
+	}
+	cli := config.GetConfig().SessionStorage.Client()
+	if cli == nil {
+		oidcStorage = &memOIDCStateStorage{states: make(map[string]*oidcState)}
+	} else {
+		oidcStorage = &redisOIDCStateStorage{cl: cli}
+	}
+	return oidcStorage
+}
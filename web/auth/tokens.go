@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// introspectionResponse is the response of the introspection endpoint, as
+// defined by RFC 7662.
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+}
+
+// findClientToken returns the claims of the given token if it is a valid
+// access or refresh token of the client. The hint is used to check first the
+// most probable type of token.
+func findClientToken(inst *instance.Instance, client *oauth.Client, token, hint string) (permissions.Claims, bool) {
+	audiences := []string{permissions.AccessTokenAudience, permissions.RefreshTokenAudience}
+	if hint == "refresh_token" {
+		audiences[0], audiences[1] = audiences[1], audiences[0]
+	}
+	for _, audience := range audiences {
+		if claims, ok := client.ValidToken(inst, audience, token); ok {
+			return claims, true
+		}
+	}
+	return permissions.Claims{}, false
+}
+
+func introspectToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	client, hasError, err := checkClientCredentials(c, inst)
+	if hasError {
+		return err
+	}
+
+	// An OAuth client can introspect only its own tokens. For the other
+	// tokens, the response is the same as for an invalid token.
+	token := c.FormValue("token")
+	claims, ok := findClientToken(inst, client, token, c.FormValue("token_type_hint"))
+	if !ok {
+		return c.JSON(http.StatusOK, introspectionResponse{Active: false})
+	}
+
+	out := introspectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  client.CouchID,
+		TokenType: "bearer",
+		IssuedAt:  claims.IssuedAt,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+	}
+	if expiresAt, ok := claims.ExpiresAtUTC(); ok {
+		out.ExpiresAt = expiresAt.Unix()
+	}
+	return c.JSON(http.StatusOK, out)
+}
+
+func revokeToken(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	client, hasError, err := checkClientCredentials(c, inst)
+	if hasError {
+		return err
+	}
+
+	// As said by RFC 7009, an invalid token, or a token of another client,
+	// doesn't cause an error response: the client can't do anything about it.
+	token := c.FormValue("token")
+	claims, ok := findClientToken(inst, client, token, c.FormValue("token_type_hint"))
+	if ok {
+		if err = permissions.RevokeToken(inst, token, &claims); err != nil {
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{
+				"error": "temporarily_unavailable",
+			})
+		}
+	}
+	return c.NoContent(http.StatusOK)
+}
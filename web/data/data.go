@@ -89,6 +89,13 @@ func getDoc(c echo.Context) error {
 	}
 
 	if paramIsTrue(c, "revs") {
+		if err := middlewares.AllowWholeType(c, permissions.GET, doctype); err != nil {
+			return err
+		}
+		// The document is sent by CouchDB, without redacting the fields
+		if err := middlewares.RefuseRedacted(c); err != nil {
+			return err
+		}
 		return proxy(c, docid)
 	}
 
@@ -104,6 +111,7 @@ func getDoc(c echo.Context) error {
 		return err
 	}
 
+	perm.RedactDoc(out.M, middlewares.RedactedFields(c))
 	return c.JSON(http.StatusOK, out.ToMapWithType())
 }
 
@@ -351,6 +359,11 @@ func findDocuments(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if fields := middlewares.RedactedFields(c); len(fields) > 0 {
+		for _, doc := range results {
+			perm.RedactDoc(doc.M, fields)
+		}
+	}
 
 	out := echo.Map{
 		"docs":  results,
@@ -373,6 +386,10 @@ func allDocs(c echo.Context) error {
 	if err := middlewares.AllowWholeType(c, permissions.GET, doctype); err != nil {
 		return err
 	}
+	// The documents are sent by CouchDB, without redacting the fields
+	if err := middlewares.RefuseRedacted(c); err != nil {
+		return err
+	}
 	return proxy(c, "_all_docs")
 }
 
@@ -397,6 +414,18 @@ func normalDocs(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if fields := middlewares.RedactedFields(c); len(fields) > 0 {
+		for k, row := range res.Rows {
+			var doc map[string]interface{}
+			if err = json.Unmarshal(row, &doc); err != nil {
+				return err
+			}
+			perm.RedactDoc(doc, fields)
+			if res.Rows[k], err = json.Marshal(doc); err != nil {
+				return err
+			}
+		}
+	}
 	return c.JSON(http.StatusOK, res)
 }
 
@@ -445,7 +474,7 @@ func Routes(router *echo.Group) {
 	replicationRoutes(group)
 
 	// API Routes under /:doctype
-	group.GET("/:docid", getDoc)
+	group.GET("/:docid", getDoc, middlewares.AcceptRedaction)
 	group.PUT("/:docid", UpdateDoc)
 	group.DELETE("/:docid", DeleteDoc)
 	group.GET("/:docid/relationships/references", files.ListReferencesHandler)
@@ -454,7 +483,7 @@ func Routes(router *echo.Group) {
 	group.POST("/", createDoc)
 	group.GET("/_all_docs", allDocs)
 	group.POST("/_all_docs", allDocs)
-	group.GET("/_normal_docs", normalDocs)
+	group.GET("/_normal_docs", normalDocs, middlewares.AcceptRedaction)
 	group.POST("/_index", defineIndex)
-	group.POST("/_find", findDocuments)
+	group.POST("/_find", findDocuments, middlewares.AcceptRedaction)
 }
@@ -78,6 +78,11 @@ func bulkGet(c echo.Context) error {
 		return err
 	}
 
+	// The documents are sent by CouchDB, without redacting the fields
+	if err := middlewares.RefuseRedacted(c); err != nil {
+		return err
+	}
+
 	return proxy(c, "_bulk_get")
 }
 
@@ -225,6 +230,14 @@ func changesFeed(c echo.Context) error {
 		return err
 	}
 
+	if fields := middlewares.RedactedFields(c); includeDocs && len(fields) > 0 {
+		for _, change := range results.Results {
+			if change.Doc.M != nil {
+				perm.RedactDoc(change.Doc.M, fields)
+			}
+		}
+	}
+
 	return c.JSON(http.StatusOK, results)
 }
 
@@ -254,9 +267,9 @@ func replicationRoutes(group *echo.Group) {
 	// Routes used only for replication
 	group.GET("/", dbStatus)
 	group.GET("/_design/:designdocid", getDesignDoc)
-	group.GET("/_changes", changesFeed)
+	group.GET("/_changes", changesFeed, middlewares.AcceptRedaction)
 	// POST=GET see http://docs.couchdb.org/en/stable/api/database/changes.html#post--db-_changes)
-	group.POST("/_changes", changesFeed)
+	group.POST("/_changes", changesFeed, middlewares.AcceptRedaction)
 
 	group.POST("/_ensure_full_commit", fullCommit)
 
@@ -496,6 +496,9 @@ func ReadFileContentFromIDHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = consumeShareDownload(c); err != nil {
+		return err
+	}
 
 	disposition := "inline"
 	if c.QueryParam("Dl") == "1" {
@@ -596,6 +599,9 @@ func sendFileFromPath(c echo.Context, path string, checkPermission bool) error {
 		if err != nil {
 			return err
 		}
+		if err = consumeShareDownload(c); err != nil {
+			return err
+		}
 	}
 
 	disposition := "inline"
@@ -651,6 +657,9 @@ func ArchiveDownloadCreateHandler(c echo.Context) error {
 			return err
 		}
 	}
+	if err = consumeShareDownload(c); err != nil {
+		return err
+	}
 
 	// if accept header is application/zip, send the archive immediately
 	if c.Request().Header.Get("Accept") == "application/zip" {
@@ -697,6 +706,9 @@ func FileDownloadCreateHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err = consumeShareDownload(c); err != nil {
+		return err
+	}
 
 	secret, err := vfs.GetStore().AddFile(instance, path)
 	if err != nil {
@@ -909,6 +921,10 @@ func FindFilesMango(c echo.Context) error {
 	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
 		return err
 	}
+	// The metadata of the files are not redacted
+	if err := middlewares.RefuseRedacted(c); err != nil {
+		return err
+	}
 
 	// drop the fields, they can cause issues if not properly manipulated
 	// TODO : optimization potential, necessary fields so far are class & type
@@ -1003,12 +1019,17 @@ func Routes(router *echo.Group) {
 	router.GET("/download/:file-id", ReadFileContentFromIDHandler)
 
 	router.POST("/_find", FindFilesMango)
+	router.POST("/_search", SearchFilesHandler)
 
 	router.HEAD("/:file-id", HeadDirOrFile)
 
 	router.GET("/metadata", ReadMetadataFromPathHandler)
 	router.GET("/:file-id", ReadMetadataFromIDHandler)
 	router.GET("/:file-id/relationships/contents", GetChildrenHandler)
+	router.GET("/:file-id/versions", ListVersionsHandler)
+	router.GET("/:file-id/versions/:version-id", ReadVersionContentHandler)
+	router.POST("/:file-id/versions/:version-id", RevertVersionHandler)
+	router.DELETE("/:file-id/versions/:version-id", DeleteVersionHandler)
 
 	router.PATCH("/metadata", ModifyMetadataByPathHandler)
 	router.PATCH("/:file-id", ModifyMetadataByIDHandler)
@@ -1023,6 +1044,12 @@ func Routes(router *echo.Group) {
 	router.POST("/archive", ArchiveDownloadCreateHandler)
 	router.GET("/archive/:secret/:fake-name", ArchiveDownloadHandler)
 
+	router.POST("/uploads", CreateUploadSessionHandler)
+	router.GET("/uploads/:session-id", GetUploadSessionHandler)
+	router.PUT("/uploads/:session-id/:index", UploadChunkHandler)
+	router.POST("/uploads/:session-id", CompleteUploadSessionHandler)
+	router.DELETE("/uploads/:session-id", AbortUploadSessionHandler)
+
 	router.POST("/downloads", FileDownloadCreateHandler)
 	router.GET("/downloads/:secret/:fake-name", FileDownloadHandler)
 
@@ -1058,7 +1085,7 @@ func wrapVfsError(err error) *jsonapi.Error {
 	switch err {
 	case ErrDocTypeInvalid:
 		return jsonapi.InvalidAttribute("type", err)
-	case os.ErrNotExist:
+	case os.ErrNotExist, vfs.ErrVersionNotFound, vfs.ErrUploadSessionNotFound:
 		return jsonapi.NotFound(err)
 	case vfs.ErrParentDoesNotExist:
 		return jsonapi.NotFound(err)
@@ -1074,11 +1101,13 @@ func wrapVfsError(err error) *jsonapi.Error {
 		return jsonapi.PreconditionFailed("Content-MD5", err)
 	case vfs.ErrContentLengthMismatch:
 		return jsonapi.PreconditionFailed("Content-Length", err)
-	case vfs.ErrConflict:
+	case vfs.ErrConflict, vfs.ErrUploadCompleting:
 		return jsonapi.Conflict(err)
 	case vfs.ErrFileInTrash, vfs.ErrNonAbsolutePath,
-		vfs.ErrDirNotEmpty:
+		vfs.ErrDirNotEmpty, vfs.ErrInvalidChunkIndex:
 		return jsonapi.BadRequest(err)
+	case vfs.ErrUploadIncomplete:
+		return jsonapi.PreconditionFailed("chunks", err)
 	case vfs.ErrFileTooBig:
 		return jsonapi.Errorf(http.StatusRequestEntityTooLarge, "%s", err)
 	}
@@ -1174,6 +1203,23 @@ func checkPerm(c echo.Context, v pkgperm.Verb, d *vfs.DirDoc, f *vfs.FileDoc) er
 	return middlewares.AllowVFS(c, v, f)
 }
 
+// consumeShareDownload counts a download when the request is made with the
+// code of a share by link, and checks that the maximal number of downloads
+// has not been reached. Every request is counted, even the partial ones, as
+// the ranges can be chosen by the client to download a file piece by piece.
+func consumeShareDownload(c echo.Context) error {
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil || pdoc.Type != pkgperm.TypeShareByLink {
+		return nil
+	}
+	instance := middlewares.GetInstance(c)
+	if err = pdoc.ConsumeDownload(instance); err != nil {
+		return err
+	}
+	pkgperm.LogShareAccess(instance, pdoc, pkgperm.ShareAccessDownload, c.Request())
+	return nil
+}
+
 func parseMD5Hash(md5B64 string) ([]byte, error) {
 	// Encoded md5 hash in base64 should at least have 22 caracters in
 	// base64: 16*3/4 = 21+1/3
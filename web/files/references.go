@@ -48,6 +48,12 @@ func ListReferencesHandler(c echo.Context) error {
 			return err
 		}
 	}
+	// The metadata of the included files are not redacted
+	if includeDocs {
+		if err := middlewares.RefuseRedacted(c); err != nil {
+			return err
+		}
+	}
 
 	cursor, err := jsonapi.ExtractPaginationCursor(c, maxRefLimit)
 	if err != nil {
@@ -0,0 +1,60 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/search"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// SearchFilesHandler is the route POST /files/_search, for a full-text search
+// on the name, the tags and the content of the files.
+func SearchFilesHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	var req search.Request
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return jsonapi.BadJSON()
+	}
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Files); err != nil {
+		return err
+	}
+	// The metadata of the files are not redacted
+	if err := middlewares.RefuseRedacted(c); err != nil {
+		return err
+	}
+
+	hits, total, err := search.Search(instance, &req)
+	switch err {
+	case nil:
+	case search.ErrDisabled:
+		return jsonapi.Errorf(http.StatusNotImplemented, "%s", err)
+	case search.ErrEmptyQuery:
+		return jsonapi.InvalidParameter("q", err)
+	default:
+		return err
+	}
+
+	fs := instance.VFS()
+	out := make([]jsonapi.Object, 0, len(hits))
+	for _, hit := range hits {
+		doc, err := fs.FileByID(hit.FileID)
+		if err != nil {
+			// The index can be a bit late when a file is removed
+			if os.IsNotExist(err) {
+				total--
+				continue
+			}
+			return WrapVfsError(err)
+		}
+		out = append(out, newFile(doc, instance))
+	}
+
+	return jsonapi.DataListWithTotal(c, http.StatusOK, total, out, nil)
+}
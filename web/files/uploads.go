@@ -0,0 +1,205 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiUploadSession struct {
+	doc *vfs.UploadSession
+}
+
+func newUploadSession(doc *vfs.UploadSession) *apiUploadSession {
+	return &apiUploadSession{doc}
+}
+
+func (u *apiUploadSession) ID() string                             { return u.doc.ID() }
+func (u *apiUploadSession) Rev() string                            { return u.doc.Rev() }
+func (u *apiUploadSession) SetID(id string)                        { u.doc.SetID(id) }
+func (u *apiUploadSession) SetRev(rev string)                      { u.doc.SetRev(rev) }
+func (u *apiUploadSession) DocType() string                        { return u.doc.DocType() }
+func (u *apiUploadSession) Clone() couchdb.Doc                     { cloned := *u; return &cloned }
+func (u *apiUploadSession) Relationships() jsonapi.RelationshipMap { return nil }
+func (u *apiUploadSession) Included() []jsonapi.Object             { return nil }
+func (u *apiUploadSession) MarshalJSON() ([]byte, error)           { return json.Marshal(u.doc) }
+func (u *apiUploadSession) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/uploads/" + u.doc.ID()}
+}
+
+var _ jsonapi.Object = (*apiUploadSession)(nil)
+
+type uploadSessionAttrs struct {
+	DirID      string   `json:"dir_id"`
+	FileID     string   `json:"file_id"`
+	Name       string   `json:"name"`
+	ByteSize   *int64   `json:"size,string"`
+	MD5Sum     []byte   `json:"md5sum"`
+	Mime       string   `json:"mime"`
+	Executable bool     `json:"executable"`
+	Tags       []string `json:"tags"`
+}
+
+// CreateUploadSessionHandler starts a resumable upload, for a new file or for
+// overwriting the content of an existing file.
+// POST /files/uploads
+func CreateUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	fs := instance.VFS()
+
+	var attrs uploadSessionAttrs
+	if _, err := jsonapi.Bind(c.Request().Body, &attrs); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if attrs.ByteSize == nil {
+		return jsonapi.InvalidAttribute("size", vfs.ErrContentLengthMismatch)
+	}
+
+	var olddoc *vfs.FileDoc
+	if attrs.FileID != "" {
+		var err error
+		if olddoc, err = fs.FileByID(attrs.FileID); err != nil {
+			return WrapVfsError(err)
+		}
+		if err = checkPerm(c, permissions.PUT, nil, olddoc); err != nil {
+			return err
+		}
+		attrs.DirID = olddoc.DirID
+		attrs.Name = olddoc.DocName
+		if attrs.Tags == nil {
+			attrs.Tags = olddoc.Tags
+		}
+	}
+
+	var mime, class string
+	if attrs.Mime == "" {
+		mime, class = vfs.ExtractMimeAndClassFromFilename(attrs.Name)
+	} else {
+		mime, class = vfs.ExtractMimeAndClass(attrs.Mime)
+	}
+	doc, err := vfs.NewFileDoc(attrs.Name, attrs.DirID, *attrs.ByteSize,
+		attrs.MD5Sum, mime, class, time.Now(), attrs.Executable, false, attrs.Tags)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if olddoc != nil {
+		doc.SetID(olddoc.ID())
+		err = checkPerm(c, permissions.PUT, nil, doc)
+	} else {
+		err = checkPerm(c, permissions.POST, nil, doc)
+	}
+	if err != nil {
+		return err
+	}
+
+	session, err := vfs.NewUploadSession(fs, doc, olddoc)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusCreated, newUploadSession(session), nil)
+}
+
+// uploadSessionFromReq loads the upload session of the request, and checks
+// that the request is allowed to write the file of this session.
+func uploadSessionFromReq(c echo.Context) (*vfs.UploadSession, error) {
+	instance := middlewares.GetInstance(c)
+	session, err := vfs.GetUploadSession(instance, c.Param("session-id"))
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	doc, err := session.FileDoc()
+	if err != nil {
+		return nil, WrapVfsError(err)
+	}
+	var verb pkgperm.Verb = permissions.POST
+	if session.FileID != "" {
+		verb = permissions.PUT
+	}
+	if err = checkPerm(c, verb, nil, doc); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// GetUploadSessionHandler returns the state of an upload session, with the
+// list of the chunks that were received, to resume an upload.
+// GET /files/uploads/:session-id
+func GetUploadSessionHandler(c echo.Context) error {
+	session, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, newUploadSession(session), nil)
+}
+
+// UploadChunkHandler receives a chunk of an upload session. The Content-MD5
+// header is mandatory, and the chunk is refused if it does not match.
+// PUT /files/uploads/:session-id/:index
+func UploadChunkHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		return jsonapi.InvalidParameter("index", vfs.ErrInvalidChunkIndex)
+	}
+	md5Str := c.Request().Header.Get("Content-MD5")
+	if md5Str == "" {
+		return jsonapi.InvalidParameter("Content-MD5", vfs.ErrInvalidHash)
+	}
+	md5Sum, err := parseMD5Hash(md5Str)
+	if err != nil {
+		return jsonapi.InvalidParameter("Content-MD5", err)
+	}
+
+	session, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	if err = session.PutChunk(instance.VFS(), index, md5Sum, c.Request().Body); err != nil {
+		return WrapVfsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, newUploadSession(session), nil)
+}
+
+// CompleteUploadSessionHandler assembles the chunks of an upload session to
+// write the file in the VFS.
+// POST /files/uploads/:session-id
+func CompleteUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	session, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	doc, err := session.Complete(instance.VFS())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	status := http.StatusCreated
+	if session.FileID != "" {
+		status = http.StatusOK
+	}
+	return fileData(c, status, doc, nil)
+}
+
+// AbortUploadSessionHandler cancels an upload session, and removes the chunks
+// that were received.
+// DELETE /files/uploads/:session-id
+func AbortUploadSessionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	session, err := uploadSessionFromReq(c)
+	if err != nil {
+		return err
+	}
+	if err = session.Abort(instance.VFS()); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,130 @@
+package files
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	pkgperm "github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiVersion struct {
+	doc *vfs.Version
+}
+
+func newVersion(doc *vfs.Version) *apiVersion {
+	return &apiVersion{doc}
+}
+
+func (v *apiVersion) ID() string                             { return v.doc.ID() }
+func (v *apiVersion) Rev() string                            { return v.doc.Rev() }
+func (v *apiVersion) SetID(id string)                        { v.doc.SetID(id) }
+func (v *apiVersion) SetRev(rev string)                      { v.doc.SetRev(rev) }
+func (v *apiVersion) DocType() string                        { return v.doc.DocType() }
+func (v *apiVersion) Clone() couchdb.Doc                     { cloned := *v; return &cloned }
+func (v *apiVersion) Relationships() jsonapi.RelationshipMap { return nil }
+func (v *apiVersion) Included() []jsonapi.Object             { return nil }
+func (v *apiVersion) MarshalJSON() ([]byte, error)           { return json.Marshal(v.doc) }
+func (v *apiVersion) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/files/" + v.doc.FileID + "/versions/" + v.doc.ShortID()}
+}
+
+var _ jsonapi.Object = (*apiVersion)(nil)
+
+func fileAndVersionFromReq(c echo.Context, verb pkgperm.Verb) (*vfs.FileDoc, *vfs.Version, error) {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return nil, nil, WrapVfsError(err)
+	}
+	if err = checkPerm(c, verb, nil, doc); err != nil {
+		return nil, nil, err
+	}
+	version, err := vfs.FindVersion(instance, doc.ID(), c.Param("version-id"))
+	if err != nil {
+		return nil, nil, WrapVfsError(err)
+	}
+	return doc, version, nil
+}
+
+// ListVersionsHandler returns the list of the old versions of a file
+// GET /files/:file-id/versions
+func ListVersionsHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, err := instance.VFS().FileByID(c.Param("file-id"))
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	if err = checkPerm(c, permissions.GET, nil, doc); err != nil {
+		return err
+	}
+	versions, err := vfs.VersionsFor(instance, doc.ID())
+	if err != nil {
+		return err
+	}
+	objs := make([]jsonapi.Object, len(versions))
+	for i, v := range versions {
+		objs[i] = newVersion(v)
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+// ReadVersionContentHandler sends the content of an old version of a file
+// GET /files/:file-id/versions/:version-id
+func ReadVersionContentHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, version, err := fileAndVersionFromReq(c, permissions.GET)
+	if err != nil {
+		return err
+	}
+	if err = consumeShareDownload(c); err != nil {
+		return err
+	}
+	disposition := "inline"
+	if c.QueryParam("Dl") == "1" {
+		disposition = "attachment"
+	}
+	err = vfs.ServeFileVersionContent(instance.VFS(), doc, version, disposition, c.Request(), c.Response())
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return nil
+}
+
+// RevertVersionHandler replaces the content of a file by the content of one
+// of its old versions
+// POST /files/:file-id/versions/:version-id
+func RevertVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, version, err := fileAndVersionFromReq(c, permissions.PUT)
+	if err != nil {
+		return err
+	}
+	if err = CheckIfMatch(c, doc.Rev()); err != nil {
+		return WrapVfsError(err)
+	}
+	newdoc, err := vfs.RevertFileVersion(instance.VFS(), doc, version)
+	if err != nil {
+		return WrapVfsError(err)
+	}
+	return fileData(c, http.StatusOK, newdoc, nil)
+}
+
+// DeleteVersionHandler destroys an old version of a file
+// DELETE /files/:file-id/versions/:version-id
+func DeleteVersionHandler(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	doc, version, err := fileAndVersionFromReq(c, permissions.DELETE)
+	if err != nil {
+		return err
+	}
+	if err = instance.VFS().CleanOldVersion(doc.ID(), version); err != nil {
+		return WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,109 @@
+package files
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/echo"
+	"github.com/stretchr/testify/assert"
+)
+
+func listVersions(t *testing.T, fileID string) []interface{} {
+	res, err := httpGet(ts.URL + "/files/" + fileID + "/versions")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+	var v map[string]interface{}
+	assert.NoError(t, extractJSONRes(res, &v))
+	data, _ := v["data"].([]interface{})
+	return data
+}
+
+func versionLink(t *testing.T, version interface{}) string {
+	links := version.(map[string]interface{})["links"].(map[string]interface{})
+	self, ok := links["self"].(string)
+	assert.True(t, ok)
+	return self
+}
+
+func TestFileVersions(t *testing.T) {
+	versioning := config.GetConfig().Fs.Versioning
+	config.GetConfig().Fs.Versioning.MaxNumberToKeep = 5
+	defer func() { config.GetConfig().Fs.Versioning = versioning }()
+
+	res, data := upload(t, "/files/?Type=file&Name=versioned", "text/plain", "one", "")
+	if !assert.Equal(t, 201, res.StatusCode) {
+		return
+	}
+	fileID := data["data"].(map[string]interface{})["id"].(string)
+
+	assert.Len(t, listVersions(t, fileID), 0)
+
+	res, _ = uploadMod(t, "/files/"+fileID, "text/plain", "two", "")
+	assert.Equal(t, 200, res.StatusCode)
+
+	versions := listVersions(t, fileID)
+	if !assert.Len(t, versions, 1) {
+		return
+	}
+	link := versionLink(t, versions[0])
+
+	// Read the content of the old version
+	res, err := httpGet(ts.URL + link)
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "one", string(body))
+
+	res, err = httpGet(ts.URL + "/files/" + fileID + "/versions/unknown")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 404, res.StatusCode)
+
+	// Restore it: the current content becomes an old version
+	req, err := http.NewRequest(http.MethodPost, ts.URL+link, nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 200, res.StatusCode)
+
+	buf, err := readFile(testInstance.VFS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(buf))
+
+	versions = listVersions(t, fileID)
+	if !assert.Len(t, versions, 1) {
+		return
+	}
+	newLink := versionLink(t, versions[0])
+	assert.NotEqual(t, link, newLink)
+
+	res, err = httpGet(ts.URL + newLink)
+	assert.NoError(t, err)
+	body, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "two", string(body))
+
+	// Delete the old version
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+newLink, nil)
+	assert.NoError(t, err)
+	req.Header.Add(echo.HeaderAuthorization, "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, 204, res.StatusCode)
+
+	assert.Len(t, listVersions(t, fileID), 0)
+	buf, err = readFile(testInstance.VFS(), "/versioned")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", string(buf))
+}
@@ -11,13 +11,16 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/accounts"
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config_dyn"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/jobs"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
+	"github.com/cozy/cozy-stack/pkg/sharing"
 	"github.com/cozy/cozy-stack/pkg/statik/fs"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/pkg/vfs"
@@ -238,6 +241,36 @@ func rebuildRedis(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// updateSharingTriggers recreates the share-track triggers of the sharings
+// of an instance that are not up-to-date with the rules.
+func updateSharingTriggers(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	count, err := sharing.UpdateTrackTriggers(inst)
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"updated": count})
+}
+
+// addMissingTriggers creates the triggers of an instance that were added to
+// the default ones after the creation of this instance.
+func addMissingTriggers(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	count, err := instance.AddMissingTriggers(inst)
+	if err != nil {
+		return wrapError(err)
+	}
+	return c.JSON(http.StatusOK, echo.Map{"created": count})
+}
+
 // Renders the assets list loaded in memory and served by the cozy
 func assetsInfos(c echo.Context) error {
 	assetsMap := make(map[string][]*fs.Asset)
@@ -425,6 +458,46 @@ func showPrefix(c echo.Context) error {
 	return c.JSON(http.StatusOK, instance.DBPrefix())
 }
 
+func listAuthAttempts(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	list, err := limits.List(inst)
+	if err != nil {
+		return wrapError(err)
+	}
+	if list == nil {
+		list = []*limits.Attempts{}
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+func resetAuthAttempts(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	if err = limits.ResetAll(inst, c.QueryParam("IP")); err != nil {
+		return wrapError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func exportAudit(c echo.Context) error {
+	domain := c.Param("domain")
+	inst, err := instance.Get(domain)
+	if err != nil {
+		return wrapError(err)
+	}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.WriteHeader(http.StatusOK)
+	return audit.Export(inst, res)
+}
+
 func getSwiftBucketName(c echo.Context) error {
 	domain := c.Param("domain")
 
@@ -482,9 +555,14 @@ func Routes(router *echo.Group) {
 	router.POST("/:domain/export", exporter)
 	router.POST("/:domain/import", importer)
 	router.POST("/:domain/orphan_accounts", cleanOrphanAccounts)
+	router.POST("/:domain/sharing_triggers", updateSharingTriggers)
+	router.POST("/:domain/triggers", addMissingTriggers)
 	router.POST("/redis", rebuildRedis)
 	router.GET("/assets", assetsInfos)
 	router.POST("/assets", addAssets)
 	router.GET("/:domain/prefix", showPrefix)
 	router.GET("/:domain/swift-prefix", getSwiftBucketName)
+	router.GET("/:domain/auth_attempts", listAuthAttempts)
+	router.DELETE("/:domain/auth_attempts", resetAuthAttempts)
+	router.GET("/:domain/audit", exportAudit)
 }
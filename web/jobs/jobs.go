@@ -26,10 +26,13 @@ import (
 	_ "github.com/cozy/cozy-stack/pkg/workers/migrations"
 	_ "github.com/cozy/cozy-stack/pkg/workers/move"
 	_ "github.com/cozy/cozy-stack/pkg/workers/push"
+	_ "github.com/cozy/cozy-stack/pkg/workers/revocation"
+	_ "github.com/cozy/cozy-stack/pkg/workers/search"
 	_ "github.com/cozy/cozy-stack/pkg/workers/share"
 	_ "github.com/cozy/cozy-stack/pkg/workers/thumbnail"
 	_ "github.com/cozy/cozy-stack/pkg/workers/unzip"
 	_ "github.com/cozy/cozy-stack/pkg/workers/updates"
+	_ "github.com/cozy/cozy-stack/pkg/workers/uploads"
 )
 
 type (
@@ -44,6 +47,15 @@ type (
 	apiQueue struct {
 		workerType string
 	}
+	apiWorkflow struct {
+		w *jobs.Workflow
+	}
+	apiDeadLetter struct {
+		d *jobs.DeadLetter
+	}
+	apiWorkflowRequest struct {
+		Steps []*jobs.WorkflowStep `json:"steps"`
+	}
 	apiTrigger struct {
 		t *jobs.TriggerInfos
 	}
@@ -76,6 +88,36 @@ func (j apiJob) MarshalJSON() ([]byte, error) {
 	return json.Marshal(j.j)
 }
 
+func (w apiWorkflow) ID() string                             { return w.w.ID() }
+func (w apiWorkflow) Rev() string                            { return w.w.Rev() }
+func (w apiWorkflow) DocType() string                        { return consts.JobsWorkflows }
+func (w apiWorkflow) Clone() couchdb.Doc                     { return w }
+func (w apiWorkflow) SetID(_ string)                         {}
+func (w apiWorkflow) SetRev(_ string)                        {}
+func (w apiWorkflow) Relationships() jsonapi.RelationshipMap { return nil }
+func (w apiWorkflow) Included() []jsonapi.Object             { return nil }
+func (w apiWorkflow) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/workflows/" + w.w.ID()}
+}
+func (w apiWorkflow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.w)
+}
+
+func (d apiDeadLetter) ID() string                             { return d.d.ID() }
+func (d apiDeadLetter) Rev() string                            { return d.d.Rev() }
+func (d apiDeadLetter) DocType() string                        { return consts.JobsDeadLetters }
+func (d apiDeadLetter) Clone() couchdb.Doc                     { return d }
+func (d apiDeadLetter) SetID(_ string)                         {}
+func (d apiDeadLetter) SetRev(_ string)                        {}
+func (d apiDeadLetter) Relationships() jsonapi.RelationshipMap { return nil }
+func (d apiDeadLetter) Included() []jsonapi.Object             { return nil }
+func (d apiDeadLetter) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/jobs/dlq/" + d.d.ID()}
+}
+func (d apiDeadLetter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.d)
+}
+
 func (q apiQueue) ID() string      { return q.workerType }
 func (q apiQueue) DocType() string { return consts.Jobs }
 func (q apiQueue) Match(key, value string) bool {
@@ -461,6 +503,189 @@ func cleanJobs(c echo.Context) error {
 	return c.JSON(200, map[string]int{"deleted": len(ups)})
 }
 
+// allowWorkflow checks that the request has the permission to use the
+// workers of all the steps of a workflow.
+func allowWorkflow(c echo.Context, v permissions.Verb, steps []*jobs.WorkflowStep) error {
+	for _, s := range steps {
+		jr := &jobs.JobRequest{WorkerType: s.WorkerType}
+		if err := middlewares.Allow(c, v, jr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pushWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	req := apiWorkflowRequest{}
+	if _, err := jsonapi.Bind(c.Request().Body, &req); err != nil {
+		return wrapJobsError(err)
+	}
+	if err := allowWorkflow(c, webpermissions.POST, req.Steps); err != nil {
+		return err
+	}
+
+	w, err := jobs.PushWorkflow(jobs.System(), instance, &jobs.WorkflowRequest{
+		Steps: req.Steps,
+	})
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiWorkflow{w}, nil)
+}
+
+func getWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	w, err := jobs.GetWorkflow(instance, c.Param("workflow-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = allowWorkflow(c, webpermissions.GET, w.Steps); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, apiWorkflow{w}, nil)
+}
+
+func cancelWorkflow(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	w, err := jobs.GetWorkflow(instance, c.Param("workflow-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = allowWorkflow(c, webpermissions.DELETE, w.Steps); err != nil {
+		return err
+	}
+	w, err = jobs.CancelWorkflow(instance, w.ID())
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusOK, apiWorkflow{w}, nil)
+}
+
+// allowDeadLetters checks the permission on the dead-letter queue of a
+// worker type, or on all the dead-letter queues if workerType is empty.
+func allowDeadLetters(c echo.Context, v permissions.Verb, workerType string) error {
+	if err := middlewares.AllowWholeType(c, v, consts.JobsDeadLetters); err != nil {
+		if workerType == "" {
+			return err
+		}
+		o := &jobs.DeadLetter{WorkerType: workerType}
+		return middlewares.AllowOnFields(c, v, o, "worker")
+	}
+	return nil
+}
+
+func getDeadLetters(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	workerType := c.QueryParam("Worker")
+	if err := allowDeadLetters(c, webpermissions.GET, workerType); err != nil {
+		return err
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, jobs.DefaultDeadLettersLimit)
+	if err != nil {
+		return err
+	}
+	letters, err := jobs.GetDeadLetters(instance, workerType, cursor)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		if workerType != "" {
+			params.Set("Worker", workerType)
+		}
+		links.Next = "/jobs/dlq?" + params.Encode()
+	}
+
+	objs := make([]jsonapi.Object, len(letters))
+	for i, d := range letters {
+		objs[i] = apiDeadLetter{d}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+func getDeadLetter(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	d, err := jobs.GetDeadLetter(instance, c.Param("dead-letter-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, webpermissions.GET, d); err != nil {
+		return err
+	}
+	return jsonapi.Data(c, http.StatusOK, apiDeadLetter{d}, nil)
+}
+
+func replayDeadLetter(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	d, err := jobs.GetDeadLetter(instance, c.Param("dead-letter-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, webpermissions.POST, d); err != nil {
+		return err
+	}
+	permd, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	admin := permd.Type == permissions.TypeCLI
+	job, err := jobs.ReplayDeadLetter(jobs.System(), instance, d, admin)
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return jsonapi.Data(c, http.StatusAccepted, apiJob{job}, nil)
+}
+
+func deleteDeadLetter(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	d, err := jobs.GetDeadLetter(instance, c.Param("dead-letter-id"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	if err = middlewares.Allow(c, webpermissions.DELETE, d); err != nil {
+		return err
+	}
+	if err = jobs.PurgeDeadLetters(instance, []*jobs.DeadLetter{d}); err != nil {
+		return wrapJobsError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func purgeDeadLetters(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+	workerType := c.QueryParam("Worker")
+	if err := allowDeadLetters(c, webpermissions.DELETE, workerType); err != nil {
+		return err
+	}
+
+	// The first page is fetched again after each deletion, until the queue
+	// is empty.
+	deleted := 0
+	for {
+		cursor := couchdb.NewSkipCursor(jobs.DefaultDeadLettersLimit, 0)
+		letters, err := jobs.GetDeadLetters(instance, workerType, cursor)
+		if err != nil {
+			return wrapJobsError(err)
+		}
+		if err = jobs.PurgeDeadLetters(instance, letters); err != nil {
+			return wrapJobsError(err)
+		}
+		deleted += len(letters)
+		if !cursor.HasMore() {
+			break
+		}
+	}
+	return c.JSON(http.StatusOK, map[string]int{"deleted": deleted})
+}
+
 // Routes sets the routing for the jobs service
 func Routes(router *echo.Group) {
 	router.GET("/queue/:worker-type", getQueue)
@@ -474,18 +699,52 @@ func Routes(router *echo.Group) {
 	router.POST("/triggers/:trigger-id/launch", launchTrigger)
 	router.DELETE("/triggers/:trigger-id", deleteTrigger)
 
+	router.POST("/workflows", pushWorkflow)
+	router.GET("/workflows/:workflow-id", getWorkflow)
+	router.DELETE("/workflows/:workflow-id", cancelWorkflow)
+
+	router.GET("/dlq", getDeadLetters)
+	router.DELETE("/dlq", purgeDeadLetters)
+	router.GET("/dlq/:dead-letter-id", getDeadLetter)
+	router.POST("/dlq/:dead-letter-id/replay", replayDeadLetter)
+	router.DELETE("/dlq/:dead-letter-id", deleteDeadLetter)
+
 	router.POST("/clean", cleanJobs)
 	router.GET("/:job-id", getJob)
 }
 
+// getBacklog returns the number of pending jobs of each instance in the queue
+// of a worker type. It is used by the administrators to see which instances
+// are waiting for the workers.
+func getBacklog(c echo.Context) error {
+	counts, err := jobs.System().WorkerQueueLenByDomain(c.Param("worker-type"))
+	if err != nil {
+		return wrapJobsError(err)
+	}
+	return c.JSON(http.StatusOK, counts)
+}
+
+// AdminRoutes sets the routing for the administration of the jobs
+func AdminRoutes(router *echo.Group) {
+	router.GET("/backlog/:worker-type", getBacklog)
+}
+
 func wrapJobsError(err error) error {
 	switch err {
 	case jobs.ErrNotFoundTrigger,
 		jobs.ErrNotFoundJob,
+		jobs.ErrNotFoundWorkflow,
+		jobs.ErrNotFoundDeadLetter,
 		jobs.ErrUnknownWorker:
 		return jsonapi.NotFound(err)
 	case jobs.ErrUnknownTrigger:
 		return jsonapi.InvalidAttribute("Type", err)
+	case jobs.ErrWorkflowNoSteps,
+		jobs.ErrWorkflowStepName,
+		jobs.ErrWorkflowDependency,
+		jobs.ErrWorkflowCycle,
+		jobs.ErrWorkflowFailurePolicy:
+		return jsonapi.InvalidAttribute("steps", err)
 	}
 	return err
 }
@@ -5,10 +5,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/crypto"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/echo"
 )
 
@@ -58,3 +62,38 @@ func BasicAuth(secretFileName string) echo.MiddlewareFunc {
 		}
 	}
 }
+
+// AppPasswordAuth is a middleware that authenticates the requests made with
+// an app password in the HTTP basic authentication. The username is ignored.
+// When the app password is valid, its permissions are used for the request.
+// The failed attempts have their own counters, and an IP address with too
+// many failed attempts must wait before trying again. This middleware must be
+// used only on the routes that accept the app passwords.
+func AppPasswordAuth(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		_, password, ok := c.Request().BasicAuth()
+		if !ok || !permissions.IsAppPassword(password) {
+			return next(c)
+		}
+
+		inst := GetInstance(c)
+		ip := limits.RequestIP(c.Request())
+		if delay := limits.RetryAfter(inst, limits.AppPasswordType, ip); delay > 0 {
+			seconds := int64((delay + time.Second - 1) / time.Second)
+			c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+			return echo.NewHTTPError(http.StatusTooManyRequests)
+		}
+
+		a, err := permissions.CheckAppPassword(inst, password)
+		if err == permissions.ErrInvalidAppPassword {
+			limits.Attempt(inst, limits.AppPasswordType, ip)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="cozy"`)
+			return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+		c.Set(contextPermissionDoc, a.Permission())
+		return next(c)
+	}
+}
@@ -1,9 +1,12 @@
 package middlewares
 
 import (
+	"net/http/httptest"
 	"testing"
 
 	"github.com/cozy/cozy-stack/pkg/config"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/echo"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -35,3 +38,57 @@ func TestSplitHost(t *testing.T) {
 	assert.Equal(t, "", app)
 	assert.Equal(t, "", siblings)
 }
+
+func TestCheckRulesRedaction(t *testing.T) {
+	config.UseTestFile()
+	pdoc := &permissions.Permission{
+		Permissions: permissions.Set{
+			permissions.Rule{
+				Type:   "io.cozy.contacts",
+				Verbs:  permissions.Verbs(permissions.GET),
+				Redact: []string{"phone"},
+			},
+		},
+	}
+	allowed := func(set permissions.Set) bool {
+		return set.AllowWholeType(permissions.GET, "io.cozy.contacts")
+	}
+
+	e := echo.New()
+	req := httptest.NewRequest("GET", "/data/io.cozy.contacts/_all_docs", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	assert.Equal(t, ErrForbidden, checkRules(c, pdoc, allowed))
+
+	req = httptest.NewRequest("POST", "/data/io.cozy.contacts/_find", nil)
+	c = e.NewContext(req, httptest.NewRecorder())
+	err := AcceptRedaction(func(c echo.Context) error {
+		return checkRules(c, pdoc, allowed)
+	})(c)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"phone"}, RedactedFields(c))
+}
+
+func TestCheckRulesConsumesOneUsePerRequest(t *testing.T) {
+	config.UseTestFile()
+	pdoc := &permissions.Permission{
+		Permissions: permissions.Set{
+			permissions.Rule{
+				Type:    "io.cozy.files",
+				Verbs:   permissions.Verbs(permissions.GET),
+				MaxUses: 1,
+			},
+		},
+	}
+	allowed := func(set permissions.Set) bool {
+		return set.AllowWholeType(permissions.GET, "io.cozy.files")
+	}
+
+	// The use has already been consumed by a previous check of the request:
+	// the permission document is not updated again.
+	e := echo.New()
+	req := httptest.NewRequest("GET", "/files/123", nil)
+	c := e.NewContext(req, httptest.NewRecorder())
+	c.Set(contextUseConsumed, true)
+	assert.NoError(t, checkRules(c, pdoc, allowed))
+	assert.Empty(t, pdoc.Uses)
+}
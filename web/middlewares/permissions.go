@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/cozy/cozy-stack/pkg/apps"
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -22,6 +24,9 @@ import (
 const bearerAuthScheme = "Bearer "
 const basicAuthScheme = "Basic "
 const contextPermissionDoc = "permissions_doc"
+const contextRedactedFields = "redacted_fields"
+const contextAcceptRedaction = "accept_redaction"
+const contextUseConsumed = "use_consumed"
 
 // ErrForbidden is used to send a forbidden response when the request does not
 // have the right permissions.
@@ -81,6 +86,10 @@ func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permi
 		return nil, permissions.ErrExpiredToken
 	}
 
+	if permissions.IsRevoked(instance, token, &claims) {
+		return nil, permissions.ErrInvalidToken
+	}
+
 	// If claims contains a SessionID, we check that we are actually authorized
 	// with the corresponding session.
 	if claims.SessionID != "" {
@@ -125,8 +134,16 @@ func ParseJWT(c echo.Context, instance *instance.Instance, token string) (*permi
 		if err != nil {
 			return nil, err
 		}
+		// The code of a share protected by a password can't be used directly,
+		// it must be exchanged against an unlocked token first.
+		if pdoc.HasPassword() {
+			return nil, permissions.ErrPasswordRequired
+		}
 		return pdoc, nil
 
+	case permissions.UnlockedShareAudience:
+		return permissions.GetForUnlockedShare(instance, claims.Subject)
+
 	default:
 		return nil, echo.NewHTTPError(http.StatusBadRequest, "Unrecognized token audience "+claims.Audience)
 	}
@@ -160,6 +177,84 @@ func GetPermission(c echo.Context) (*permissions.Permission, error) {
 	return pdoc, nil
 }
 
+// checkRules validates that the request is allowed by the context permission
+// set. Only the rules whose conditions (validity window, IP ranges and number
+// of uses) are fulfilled are taken into account. If the request is allowed
+// only by rules with a maximal number of uses, one use is consumed, once per
+// request. The fields to redact for the allowing rules are kept in the
+// context, and the request is refused if the route does not accept redaction.
+func checkRules(c echo.Context, pdoc *permissions.Permission, allowed func(permissions.Set) bool) error {
+	if !pdoc.HasConditions() {
+		if !allowed(pdoc.Permissions) {
+			return ErrForbidden
+		}
+		return nil
+	}
+
+	var matched permissions.Set
+	ip := config.ClientIP(c.Request())
+	for _, r := range pdoc.ApplicableRules(time.Now(), ip) {
+		if allowed(permissions.Set{r}) {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) == 0 {
+		return ErrForbidden
+	}
+	fields := permissions.RedactedFields(matched)
+	if len(fields) > 0 && c.Get(contextAcceptRedaction) == nil {
+		return ErrForbidden
+	}
+	c.Set(contextRedactedFields, fields)
+
+	for _, r := range matched {
+		if r.MaxUses == 0 {
+			return nil
+		}
+	}
+	// A request can check its permissions several times, but it is only one
+	// use of the rule.
+	if c.Get(contextUseConsumed) != nil {
+		return nil
+	}
+	if err := pdoc.ConsumeUse(GetInstance(c), matched[0]); err != nil {
+		if couchdb.IsConflictError(err) {
+			return ErrForbidden
+		}
+		return err
+	}
+	c.Set(contextUseConsumed, true)
+	return nil
+}
+
+// AcceptRedaction is a middleware for the routes that remove the redacted
+// fields from the documents of their responses. On the other routes, a
+// request allowed only by rules that redact some fields is refused.
+func AcceptRedaction(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Set(contextAcceptRedaction, true)
+		return next(c)
+	}
+}
+
+// RedactedFields returns the list of fields that must be removed from the
+// documents sent in the response, as said by the rules that have allowed the
+// request.
+func RedactedFields(c echo.Context) []string {
+	fields, _ := c.Get(contextRedactedFields).([]string)
+	return fields
+}
+
+// RefuseRedacted returns an error if some fields must be redacted for the
+// request. It is used by the routes that can't redact the fields, like those
+// that proxy the response of CouchDB.
+func RefuseRedacted(c echo.Context) error {
+	if len(RedactedFields(c)) > 0 {
+		return ErrForbidden
+	}
+	return nil
+}
+
 // AllowWholeType validates that the context permission set can use a verb on
 // the whold doctype
 func AllowWholeType(c echo.Context, v permissions.Verb, doctype string) error {
@@ -167,10 +262,9 @@ func AllowWholeType(c echo.Context, v permissions.Verb, doctype string) error {
 	if err != nil {
 		return err
 	}
-	if !pdoc.Permissions.AllowWholeType(v, doctype) {
-		return ErrForbidden
-	}
-	return nil
+	return checkRules(c, pdoc, func(set permissions.Set) bool {
+		return set.AllowWholeType(v, doctype)
+	})
 }
 
 // Allow validates the validable object against the context permission set
@@ -179,10 +273,9 @@ func Allow(c echo.Context, v permissions.Verb, o permissions.Matcher) error {
 	if err != nil {
 		return err
 	}
-	if !pdoc.Permissions.Allow(v, o) {
-		return ErrForbidden
-	}
-	return nil
+	return checkRules(c, pdoc, func(set permissions.Set) bool {
+		return set.Allow(v, o)
+	})
 }
 
 // AllowOnFields validates the validable object againt the context permission
@@ -192,10 +285,9 @@ func AllowOnFields(c echo.Context, v permissions.Verb, o permissions.Matcher, fi
 	if err != nil {
 		return err
 	}
-	if !pdoc.Permissions.AllowOnFields(v, o, fields...) {
-		return ErrForbidden
-	}
-	return nil
+	return checkRules(c, pdoc, func(set permissions.Set) bool {
+		return set.AllowOnFields(v, o, fields...)
+	})
 }
 
 // AllowTypeAndID validates a type & ID against the context permission set
@@ -204,10 +296,9 @@ func AllowTypeAndID(c echo.Context, v permissions.Verb, doctype, id string) erro
 	if err != nil {
 		return err
 	}
-	if !pdoc.Permissions.AllowID(v, doctype, id) {
-		return ErrForbidden
-	}
-	return nil
+	return checkRules(c, pdoc, func(set permissions.Set) bool {
+		return set.AllowID(v, doctype, id)
+	})
 }
 
 // AllowVFS validates a vfs.Matcher against the context permission set
@@ -217,11 +308,14 @@ func AllowVFS(c echo.Context, v permissions.Verb, o vfs.Matcher) error {
 	if err != nil {
 		return err
 	}
-	err = vfs.Allows(instance.VFS(), pdoc.Permissions, v, o)
+	err = checkRules(c, pdoc, func(set permissions.Set) bool {
+		return vfs.Allows(instance.VFS(), set, v, o) == nil
+	})
 	if err != nil {
-		return ErrForbidden
+		return err
 	}
-	return nil
+	// The metadata of the files are not redacted
+	return RefuseRedacted(c)
 }
 
 // AllowInstallApp checks that the current context is tied to the store app,
@@ -270,8 +364,11 @@ func AllowForApp(c echo.Context, v permissions.Verb, o permissions.Matcher) (slu
 	if pdoc.Type != permissions.TypeWebapp && pdoc.Type != permissions.TypeKonnector {
 		return "", ErrForbidden
 	}
-	if !pdoc.Permissions.Allow(v, o) {
-		return "", ErrForbidden
+	err = checkRules(c, pdoc, func(set permissions.Set) bool {
+		return set.Allow(v, o)
+	})
+	if err != nil {
+		return "", err
 	}
 	return pdoc.SourceID, nil
 }
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/jobs"
 	"github.com/cozy/cozy-stack/pkg/workers/move"
@@ -48,8 +49,15 @@ func exportDataHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
 
-	return move.ExportCopyData(c.Response(), inst, move.SystemArchiver(), exportMAC,
-		c.QueryParam("cursor"))
+	cursor := c.QueryParam("cursor")
+	err = move.ExportCopyData(c.Response(), inst, move.SystemArchiver(), exportMAC, cursor)
+	if err != nil {
+		return err
+	}
+	audit.Log(inst, c.Request(), audit.ExportDownloaded, map[string]interface{}{
+		"cursor": cursor,
+	})
+	return nil
 }
 
 func createExport(c echo.Context) error {
@@ -76,6 +84,7 @@ func createExport(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	audit.Log(inst, c.Request(), audit.ExportRequested, nil)
 
 	return c.NoContent(http.StatusCreated)
 }
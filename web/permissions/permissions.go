@@ -2,11 +2,13 @@ package permissions
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/permissions"
@@ -47,7 +49,15 @@ type APIPermission struct {
 
 // MarshalJSON implements jsonapi.Doc
 func (p *APIPermission) MarshalJSON() ([]byte, error) {
-	return json.Marshal(p.Permission)
+	if !p.HasPassword() {
+		return json.Marshal(p.Permission)
+	}
+	// The hash of the password is never sent, only the fact that there is a
+	// password for this share by link
+	return json.Marshal(struct {
+		*permissions.Permission
+		Password bool `json:"password"`
+	}{p.Permission, true})
 }
 
 // Relationships implements jsonapi.Doc
@@ -86,10 +96,19 @@ func createPermission(c echo.Context) error {
 		return err
 	}
 
-	var subdoc permissions.Permission
+	// Only the attributes chosen by the client are read: the counters, like
+	// downloads, uses and first_access_at, are managed by the stack.
+	var subdoc struct {
+		Permissions  permissions.Set `json:"permissions"`
+		MaxDownloads int             `json:"max_downloads,omitempty"`
+		Password     string          `json:"password,omitempty"`
+	}
 	if _, err = jsonapi.Bind(c.Request().Body, &subdoc); err != nil {
 		return err
 	}
+	if subdoc.MaxDownloads < 0 {
+		return jsonapi.InvalidParameter("max_downloads", errors.New("Must be positive"))
+	}
 
 	var codes map[string]string
 	if names != nil {
@@ -114,10 +133,19 @@ func createPermission(c echo.Context) error {
 		}
 	}
 
-	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, expiresAt)
+	pdoc, err := permissions.CreateShareSet(instance, parent, codes, subdoc.Permissions, permissions.ShareOptions{
+		ExpiresAt:    expiresAt,
+		Password:     subdoc.Password,
+		MaxDownloads: subdoc.MaxDownloads,
+	})
 	if err != nil {
 		return err
 	}
+	audit.Log(instance, c.Request(), audit.PermissionCreated, map[string]interface{}{
+		"permission_id": pdoc.ID(),
+		"type":          pdoc.Type,
+		"source_id":     pdoc.SourceID,
+	})
 
 	return jsonapi.Data(c, http.StatusOK, &APIPermission{pdoc}, nil)
 }
@@ -292,10 +320,57 @@ func revokePermission(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	audit.Log(instance, c.Request(), audit.PermissionRevoked, map[string]interface{}{
+		"permission_id": toRevoke.ID(),
+		"type":          toRevoke.Type,
+		"source_id":     toRevoke.SourceID,
+	})
 
 	return c.NoContent(http.StatusNoContent)
 }
 
+// apiShareAccess is the struct used to serialize an entry of the access log
+// of a share by link to JSON-API
+type apiShareAccess struct {
+	*permissions.ShareAccess
+}
+
+func (a *apiShareAccess) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.ShareAccess)
+}
+func (a *apiShareAccess) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiShareAccess) Included() []jsonapi.Object             { return nil }
+func (a *apiShareAccess) Links() *jsonapi.LinksList              { return nil }
+
+func listShareAccesses(c echo.Context) error {
+	instance := middlewares.GetInstance(c)
+
+	current, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+
+	perm, err := permissions.GetByID(instance, c.Param("permdocid"))
+	if err != nil {
+		return err
+	}
+
+	if !current.ParentOf(perm) {
+		return permissions.ErrNotParent
+	}
+
+	accesses, err := permissions.GetShareAccesses(instance, perm.PID)
+	if err != nil {
+		return err
+	}
+
+	out := make([]jsonapi.Object, len(accesses))
+	for i, a := range accesses {
+		out[i] = &apiShareAccess{a}
+	}
+	return jsonapi.DataList(c, http.StatusOK, out, nil)
+}
+
 // Routes sets the routing for the permissions service
 func Routes(router *echo.Group) {
 	// API Routes
@@ -304,6 +379,7 @@ func Routes(router *echo.Group) {
 	router.POST("/exists", listPermissions)
 	router.PATCH("/:permdocid", patchPermission(permissions.GetByID, "permdocid"))
 	router.DELETE("/:permdocid", revokePermission)
+	router.GET("/:permdocid/accesses", listShareAccesses)
 
 	router.PATCH("/apps/:slug", patchPermission(permissions.GetForWebapp, "slug"))
 	router.PATCH("/konnectors/:slug", patchPermission(permissions.GetForKonnector, "slug"))
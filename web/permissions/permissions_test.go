@@ -332,6 +332,97 @@ func TestRevoke(t *testing.T) {
 
 }
 
+func TestCreateSubPermissionWithPassword(t *testing.T) {
+	out, err := doRequest("POST", ts.URL+"/permissions?codes=john", token, `{
+"data": {
+	"type": "io.cozy.permissions",
+	"attributes": {
+		"password": "s3cr3t",
+		"max_downloads": 2,
+		"downloads": 1,
+		"uses": {"whatever": 1},
+		"first_access_at": "2018-01-01T00:00:00Z",
+		"permissions": {
+			"whatever": {
+				"type":   "io.cozy.files",
+				"verbs":  ["GET"],
+				"values": ["io.cozy.music"]
+			}
+		}
+	}
+}
+	}`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data := out["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["password"])
+	assert.Equal(t, float64(2), attrs["max_downloads"])
+	// The counters can't be set by the client
+	assert.Nil(t, attrs["downloads"])
+	assert.Nil(t, attrs["uses"])
+	assert.Nil(t, attrs["first_access_at"])
+	johnCode := attrs["codes"].(map[string]interface{})["john"].(string)
+
+	// The code can't be used before the password has been checked
+	_, err = doRequest("GET", ts.URL+"/permissions/self", johnCode, "")
+	assert.Error(t, err)
+
+	unlocked, err := testInstance.MakeJWT(permissions.UnlockedShareAudience, id, "", "", time.Now())
+	assert.NoError(t, err)
+	out, err = doRequest("GET", ts.URL+"/permissions/self", unlocked, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	data = out["data"].(map[string]interface{})
+	assert.Equal(t, id, data["id"])
+	attrs = data["attributes"].(map[string]interface{})
+	assert.Equal(t, true, attrs["password"])
+
+	pdoc, err := permissions.GetByID(testInstance, id)
+	assert.NoError(t, err)
+	assert.True(t, pdoc.CheckPassword("s3cr3t"))
+	assert.False(t, pdoc.CheckPassword("wrong"))
+	assert.NoError(t, pdoc.ConsumeDownload(testInstance))
+	assert.NoError(t, pdoc.ConsumeDownload(testInstance))
+	assert.Equal(t, permissions.ErrDownloadLimitReached, pdoc.ConsumeDownload(testInstance))
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	permissions.LogShareAccess(testInstance, pdoc, permissions.ShareAccessOpen, req)
+	out, err = doRequest("GET", ts.URL+"/permissions/"+id+"/accesses", token, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	accesses := out["data"].([]interface{})
+	if assert.Len(t, accesses, 1) {
+		attrs = accesses[0].(map[string]interface{})["attributes"].(map[string]interface{})
+		assert.Equal(t, permissions.ShareAccessOpen, attrs["action"])
+		assert.Equal(t, true, attrs["first_access"])
+	}
+
+	_, err = doRequest("GET", ts.URL+"/permissions/"+id+"/accesses", unlocked, "")
+	assert.Error(t, err)
+
+	// The unlocked token can't be used after the expiration of the share
+	pdoc, err = permissions.GetByID(testInstance, id)
+	if !assert.NoError(t, err) {
+		return
+	}
+	past := time.Now().Add(-time.Hour)
+	pdoc.ExpiresAt = &past
+	assert.NoError(t, couchdb.UpdateDoc(testInstance, pdoc))
+	_, err = permissions.GetForUnlockedShare(testInstance, id)
+	assert.Equal(t, permissions.ErrExpiredToken, err)
+
+	// The access log is deleted with the share
+	assert.NoError(t, pdoc.Revoke(testInstance))
+	logs, err := permissions.GetShareAccesses(testInstance, id)
+	assert.NoError(t, err)
+	assert.Empty(t, logs)
+}
+
 func createTestSubPermissions(tok string, codes string) (string, map[string]interface{}, error) {
 	out, err := doRequest("POST", ts.URL+"/permissions?codes="+codes, tok, `{
 "data": {
@@ -426,8 +517,8 @@ func TestListPermission(t *testing.T) {
 		}}
 
 	codes := map[string]string{"bob": "secret"}
-	permissions.CreateShareSet(testInstance, parent, codes, p1, nil)
-	permissions.CreateShareSet(testInstance, parent, codes, p2, nil)
+	permissions.CreateShareSet(testInstance, parent, codes, p1, permissions.ShareOptions{})
+	permissions.CreateShareSet(testInstance, parent, codes, p2, permissions.ShareOptions{})
 
 	reqbody := strings.NewReader(`{
 "data": [
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/logger"
@@ -174,7 +175,7 @@ func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *web
 		// XXX: no permissions are required for io.cozy.sharings.initial-sync
 		if withAuthentication &&
 			cmd.Payload.Type != consts.SharingsInitialSync &&
-			!pdoc.Permissions.AllowWholeType(permissions.GET, cmd.Payload.Type) {
+			!allowSubscribe(c, pdoc, cmd.Payload.Type) {
 			sendErr(ctx, errc, forbidden(cmd))
 			continue
 		}
@@ -190,6 +191,24 @@ func readPump(ctx context.Context, c echo.Context, i *instance.Instance, ws *web
 	}
 }
 
+// allowSubscribe returns true if the permission allows to subscribe to the
+// events of the doctype. The documents in the events are not redacted, and a
+// subscription can't consume a use, so the rules with those conditions can't
+// be used for the realtime.
+func allowSubscribe(c echo.Context, pdoc *permissions.Permission, doctype string) bool {
+	if !pdoc.HasConditions() {
+		return pdoc.Permissions.AllowWholeType(permissions.GET, doctype)
+	}
+	ip := config.ClientIP(c.Request())
+	for _, r := range pdoc.ApplicableRules(time.Now(), ip) {
+		if r.MaxUses == 0 && len(r.Redact) == 0 &&
+			(permissions.Set{r}).AllowWholeType(permissions.GET, doctype) {
+			return true
+		}
+	}
+	return false
+}
+
 func ws(c echo.Context) error {
 	var db prefixer.Prefixer
 
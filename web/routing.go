@@ -32,6 +32,7 @@ import (
 	"github.com/cozy/cozy-stack/web/statik"
 	"github.com/cozy/cozy-stack/web/status"
 	"github.com/cozy/cozy-stack/web/version"
+	"github.com/cozy/cozy-stack/web/webdav"
 	"github.com/cozy/echo"
 	"github.com/cozy/echo/middleware"
 	"github.com/prometheus/client_golang/prometheus"
@@ -108,6 +109,7 @@ func SetupAssets(router *echo.Echo, assetsPath string) (err error) {
 
 // SetupRoutes sets the routing for HTTP endpoints
 func SetupRoutes(router *echo.Echo) error {
+	router.Pre(webdav.MethodOverride)
 	router.Use(timersMiddleware)
 
 	if !config.GetConfig().CSPDisabled {
@@ -147,9 +149,12 @@ func SetupRoutes(router *echo.Echo) error {
 			}),
 		}
 		mws := append(mwsNotBlocked, middlewares.CheckInstanceBlocked)
+		// The app passwords can only be used for the documents and the files
+		mwsAppPassword := append([]echo.MiddlewareFunc{}, mws...)
+		mwsAppPassword = append(mwsAppPassword, middlewares.AppPasswordAuth)
 		registry.Routes(router.Group("/registry", mws...))
-		data.Routes(router.Group("/data", mws...))
-		files.Routes(router.Group("/files", mws...))
+		data.Routes(router.Group("/data", mwsAppPassword...))
+		files.Routes(router.Group("/files", mwsAppPassword...))
 		intents.Routes(router.Group("/intents", mws...))
 		jobs.Routes(router.Group("/jobs", mws...))
 		notifications.Routes(router.Group("/notifications", mws...))
@@ -165,6 +170,16 @@ func SetupRoutes(router *echo.Echo) error {
 		settings.Routes(router.Group("/settings", mwsNotBlocked...))
 		compat.Routes(router.Group("/compat", mwsNotBlocked...))
 
+		// WebDAV clients do not use the session cookies, and the responses are
+		// in XML, not JSON-API.
+		webdav.Routes(router.Group("/dav",
+			middlewares.NeedInstance,
+			middlewares.AppPasswordAuth,
+			middlewares.Accept(middlewares.AcceptOptions{
+				DefaultContentTypeOffer: echo.MIMETextPlain,
+			}),
+			middlewares.CheckInstanceBlocked))
+
 		// Careful, the normal middlewares NeedInstance and LoadSession are not
 		// applied to this group in web/routing since they should not be used for
 		// oauth redirection.
@@ -213,6 +228,7 @@ func SetupAdminRoutes(router *echo.Echo) error {
 	}
 
 	instances.Routes(router.Group("/instances", mws...))
+	jobs.AdminRoutes(router.Group("/jobs", mws...))
 	version.Routes(router.Group("/version", mws...))
 	metrics.Routes(router.Group("/metrics", mws...))
 	realtime.Routes(router.Group("/realtime", mws...))
@@ -241,6 +257,18 @@ func CreateSubdomainProxy(router *echo.Echo, appsHandler echo.HandlerFunc) (*ech
 	main.HideBanner = true
 	main.HidePort = true
 	main.Renderer = router.Renderer
+	// The WebDAV methods are unknown to the router of echo: the requests for
+	// WebDAV on the host of an instance are sent to the stack router before the
+	// routing of main.
+	main.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if webdav.IsDavRequest(c.Request()) && isMainHost(c.Request().Host) {
+				router.ServeHTTP(c.Response(), c.Request())
+				return nil
+			}
+			return next(c)
+		}
+	})
 	main.Any("/*", func(c echo.Context) error {
 		// TODO(optim): minimize the number of instance requests
 		if parent, slug, _ := middlewares.SplitHost(c.Request().Host); slug != "" {
@@ -268,3 +296,10 @@ func setupRecover(router *echo.Echo) {
 		router.Use(recoverMiddleware)
 	}
 }
+
+// isMainHost returns true if the host is the one of an instance, and not the
+// subdomain of one of its applications. WebDAV is only served on the former.
+func isMainHost(host string) bool {
+	_, slug, _ := middlewares.SplitHost(host)
+	return slug == ""
+}
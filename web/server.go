@@ -101,6 +101,9 @@ func ListenAndServeWithAppDir(appsdir map[string]string) (*Servers, error) {
 			return webapps.Serve(c)
 		}
 		method := c.Request().Method
+		if method == "POST" && c.QueryParam("sharecode") != "" {
+			return webapps.UnlockShareCode(c)
+		}
 		if method != "GET" && method != "HEAD" {
 			return echo.NewHTTPError(http.StatusMethodNotAllowed, "Method not allowed")
 		}
@@ -0,0 +1,152 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+// apiAppPassword is the JSON-API representation of an app password. The hash
+// is never sent, and the password in clear is sent only on creation.
+type apiAppPassword struct {
+	doc      *permissions.AppPassword
+	password string
+}
+
+func (a *apiAppPassword) ID() string                             { return a.doc.ID() }
+func (a *apiAppPassword) Rev() string                            { return a.doc.Rev() }
+func (a *apiAppPassword) DocType() string                        { return consts.AppPasswords }
+func (a *apiAppPassword) Clone() couchdb.Doc                     { return a }
+func (a *apiAppPassword) SetID(id string)                        {}
+func (a *apiAppPassword) SetRev(rev string)                      {}
+func (a *apiAppPassword) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiAppPassword) Included() []jsonapi.Object             { return nil }
+func (a *apiAppPassword) Links() *jsonapi.LinksList {
+	return &jsonapi.LinksList{Self: "/settings/app_passwords/" + a.doc.ID()}
+}
+
+func (a *apiAppPassword) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name        string          `json:"name"`
+		Password    string          `json:"password,omitempty"`
+		Permissions permissions.Set `json:"permissions"`
+		CreatedAt   time.Time       `json:"created_at"`
+		LastUsedAt  *time.Time      `json:"last_used_at,omitempty"`
+	}{
+		Name:        a.doc.Name,
+		Password:    a.password,
+		Permissions: a.doc.Permissions,
+		CreatedAt:   a.doc.CreatedAt,
+		LastUsedAt:  a.doc.LastUsedAt,
+	})
+}
+
+// allowAppPasswords checks that the request can manage the app passwords. An
+// app password can't be used to create or revoke other app passwords.
+func allowAppPasswords(c echo.Context, v permissions.Verb) (*permissions.Permission, error) {
+	if err := middlewares.AllowWholeType(c, v, consts.AppPasswords); err != nil {
+		return nil, err
+	}
+	pdoc, err := middlewares.GetPermission(c)
+	if err != nil {
+		return nil, err
+	}
+	if pdoc.Type == permissions.TypeAppPassword {
+		return nil, middlewares.ErrForbidden
+	}
+	return pdoc, nil
+}
+
+func listAppPasswords(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if _, err := allowAppPasswords(c, permissions.GET); err != nil {
+		return err
+	}
+
+	list, err := permissions.GetAppPasswords(inst)
+	if err != nil {
+		return err
+	}
+
+	objs := make([]jsonapi.Object, len(list))
+	for i, a := range list {
+		objs[i] = &apiAppPassword{doc: a}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, nil)
+}
+
+func createAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	current, err := allowAppPasswords(c, permissions.POST)
+	if err != nil {
+		return err
+	}
+
+	var args struct {
+		Name        string          `json:"name"`
+		Permissions permissions.Set `json:"permissions"`
+		Current     string          `json:"current_passphrase"`
+	}
+	if _, err = jsonapi.Bind(c.Request().Body, &args); err != nil {
+		return jsonapi.BadJSON()
+	}
+	// An app password gives a long-lived access to the instance: a stolen
+	// token is not enough to create one.
+	if err = checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+	if args.Name == "" {
+		return jsonapi.InvalidAttribute("name", errors.New("Missing name"))
+	}
+	if len(args.Permissions) == 0 {
+		return jsonapi.InvalidAttribute("permissions", errors.New("Missing permissions"))
+	}
+	if !args.Permissions.IsSubSetOf(current.Permissions) {
+		return permissions.ErrNotSubset
+	}
+
+	a, password, err := permissions.CreateAppPassword(inst, args.Name, args.Permissions)
+	if err != nil {
+		return err
+	}
+	audit.Log(inst, c.Request(), audit.AppPasswordCreated, map[string]interface{}{
+		"app_password_id": a.ID(),
+		"name":            a.Name,
+	})
+	return jsonapi.Data(c, http.StatusCreated, &apiAppPassword{doc: a, password: password}, nil)
+}
+
+func revokeAppPassword(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if _, err := allowAppPasswords(c, permissions.DELETE); err != nil {
+		return err
+	}
+
+	a, err := permissions.GetAppPassword(inst, c.Param("id"))
+	if err != nil {
+		if couchdb.IsNotFoundError(err) || couchdb.IsNoDatabaseError(err) {
+			return jsonapi.NotFound(permissions.ErrInvalidAppPassword)
+		}
+		return err
+	}
+	if err = a.Revoke(inst); err != nil {
+		return err
+	}
+	audit.Log(inst, c.Request(), audit.AppPasswordRevoked, map[string]interface{}{
+		"app_password_id": a.ID(),
+		"name":            a.Name,
+	})
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package settings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+type apiAuditEntry struct{ *audit.Entry }
+
+func (e *apiAuditEntry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Entry)
+}
+func (e *apiAuditEntry) Links() *jsonapi.LinksList              { return nil }
+func (e *apiAuditEntry) Relationships() jsonapi.RelationshipMap { return nil }
+func (e *apiAuditEntry) Included() []jsonapi.Object             { return nil }
+
+func listAuditEntries(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Audit); err != nil {
+		return err
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, audit.DefaultLimit)
+	if err != nil {
+		return err
+	}
+
+	entries, err := audit.List(inst, cursor)
+	if err != nil {
+		return err
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		links.Next = "/settings/audit?" + params.Encode()
+	}
+
+	objs := make([]jsonapi.Object, len(entries))
+	for i, e := range entries {
+		objs[i] = &apiAuditEntry{e}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
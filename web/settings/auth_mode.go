@@ -0,0 +1,283 @@
+package settings
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/audit"
+	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/web/auth"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiWebAuthnCredential struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func toAPIWebAuthnCredential(c *instance.WebAuthnCredential) apiWebAuthnCredential {
+	return apiWebAuthnCredential{
+		ID:        base64.RawURLEncoding.EncodeToString(c.ID),
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt,
+	}
+}
+
+func wrapAuthModeError(err error) error {
+	switch err {
+	case instance.ErrInvalidTwoFactor:
+		return jsonapi.NewError(http.StatusUnprocessableEntity, err.Error())
+	case instance.ErrTwoFactorNotEnrolled:
+		return jsonapi.NotFound(err)
+	case instance.ErrTwoFactorInUse:
+		return jsonapi.Conflict(err)
+	}
+	return err
+}
+
+// checkFreshPassphrase is used by the routes that change the second factors
+// or create app passwords: they can only be called by the user logged in the
+// browser, who must type the passphrase again. The failed attempts are limited
+// like for the login.
+func checkFreshPassphrase(c echo.Context, inst *instance.Instance, passphrase string) error {
+	if !middlewares.IsLoggedIn(c) {
+		return jsonapi.Forbidden(errors.New("a session is required for this action"))
+	}
+	if err := auth.CheckAttempts(c, inst, limits.AuthType); err != nil {
+		return err
+	}
+	if err := inst.CheckPassphrase([]byte(passphrase)); err != nil {
+		auth.CountAttempt(c, inst, limits.AuthType)
+		return jsonapi.Forbidden(instance.ErrInvalidPassphrase)
+	}
+	auth.ResetAttempts(c, inst, limits.AuthType)
+	return nil
+}
+
+func getInstanceAuthMode(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.GET, consts.Settings); err != nil {
+		return err
+	}
+
+	creds := make([]apiWebAuthnCredential, len(inst.WebAuthnCredentials))
+	for k := range inst.WebAuthnCredentials {
+		creds[k] = toAPIWebAuthnCredential(&inst.WebAuthnCredentials[k])
+	}
+	methods := inst.TwoFactorMethods()
+	if methods == nil {
+		methods = []string{}
+	}
+	return c.JSON(http.StatusOK, echo.Map{
+		"auth_mode":          instance.AuthModeToString(inst.AuthMode),
+		"two_factor_methods": methods,
+		"totp":               inst.TOTPSecret != "",
+		"webauthn":           creds,
+		"recovery_codes":     len(inst.RecoveryCodes),
+	})
+}
+
+func beginTOTPEnrollment(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current string `json:"current_passphrase"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	enrollment, err := inst.BeginTOTPEnrollment()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+func finishTOTPEnrollment(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current  string `json:"current_passphrase"`
+		Token    string `json:"token"`
+		Passcode string `json:"passcode"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	codes, err := inst.FinishTOTPEnrollment([]byte(args.Token), args.Passcode)
+	if err != nil {
+		return wrapAuthModeError(err)
+	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"totp": "enrolled",
+	})
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
+
+func removeTOTP(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current string `json:"current_passphrase"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	if err := inst.RemoveTOTP(); err != nil {
+		return wrapAuthModeError(err)
+	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"totp": "removed",
+	})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func beginWebAuthnRegistration(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current string `json:"current_passphrase"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	registration, err := inst.BeginWebAuthnRegistration()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, registration)
+}
+
+func finishWebAuthnRegistration(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current    string          `json:"current_passphrase"`
+		Token      string          `json:"token"`
+		Name       string          `json:"name"`
+		Credential json.RawMessage `json:"credential"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	cred, codes, err := inst.FinishWebAuthnRegistration([]byte(args.Token), args.Name, args.Credential)
+	if err != nil {
+		return wrapAuthModeError(err)
+	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"webauthn":      "registered",
+		"credential_id": toAPIWebAuthnCredential(cred).ID,
+	})
+	return c.JSON(http.StatusOK, echo.Map{
+		"webauthn":       toAPIWebAuthnCredential(cred),
+		"recovery_codes": codes,
+	})
+}
+
+func removeWebAuthnCredential(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current string `json:"current_passphrase"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	id, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		return jsonapi.NotFound(instance.ErrTwoFactorNotEnrolled)
+	}
+	if err = inst.RemoveWebAuthnCredential(id); err != nil {
+		return wrapAuthModeError(err)
+	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"webauthn":      "removed",
+		"credential_id": c.Param("id"),
+	})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func regenerateRecoveryCodes(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+
+	if err := middlewares.AllowWholeType(c, permissions.PUT, consts.Settings); err != nil {
+		return err
+	}
+
+	args := struct {
+		Current string `json:"current_passphrase"`
+	}{}
+	if err := c.Bind(&args); err != nil {
+		return jsonapi.BadRequest(err)
+	}
+	if err := checkFreshPassphrase(c, inst, args.Current); err != nil {
+		return err
+	}
+
+	codes, err := inst.RegenerateRecoveryCodes()
+	if err != nil {
+		return wrapAuthModeError(err)
+	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"recovery_codes": "regenerated",
+	})
+	return c.JSON(http.StatusOK, echo.Map{"recovery_codes": codes})
+}
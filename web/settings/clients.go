@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/crypto"
@@ -75,6 +76,10 @@ func revokeClient(c echo.Context) error {
 	if err := client.Delete(instance); err != nil {
 		return errors.New(err.Error)
 	}
+	audit.Log(instance, c.Request(), audit.OAuthClientRevoked, map[string]interface{}{
+		"client_id":   client.ClientID,
+		"client_name": client.ClientName,
+	})
 	return c.NoContent(http.StatusNoContent)
 }
 
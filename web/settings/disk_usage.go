@@ -7,6 +7,7 @@ import (
 
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
+	"github.com/cozy/cozy-stack/pkg/vfs"
 	"github.com/cozy/cozy-stack/web/jsonapi"
 	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/cozy-stack/web/permissions"
@@ -14,8 +15,9 @@ import (
 )
 
 type apiDiskUsage struct {
-	Used  int64 `json:"used,string"`
-	Quota int64 `json:"quota,string,omitempty"`
+	Used     int64 `json:"used,string"`
+	Quota    int64 `json:"quota,string,omitempty"`
+	Versions int64 `json:"versions,string"`
 }
 
 func (j *apiDiskUsage) ID() string                             { return consts.DiskUsageID }
@@ -51,9 +53,15 @@ func diskUsage(c echo.Context) error {
 		return err
 	}
 
+	versions, err := vfs.VersionsDiskUsage(instance)
+	if err != nil {
+		return err
+	}
+
 	quota := fs.DiskQuota()
 
 	result.Used = used
 	result.Quota = quota
+	result.Versions = versions
 	return jsonapi.Data(c, http.StatusOK, &result, nil)
 }
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
@@ -155,12 +156,25 @@ func updateInstanceAuthMode(c echo.Context) error {
 		if ok := inst.ValidateMailConfirmationCode(args.TwoFactorActivationCode); !ok {
 			return c.NoContent(http.StatusUnprocessableEntity)
 		}
+	// For the authenticator apps and the security keys, the enrollment has
+	// already checked that the user can use them.
+	case instance.TwoFactorTOTP:
+		if inst.TOTPSecret == "" {
+			return jsonapi.BadRequest(instance.ErrTwoFactorNotEnrolled)
+		}
+	case instance.TwoFactorWebAuthn:
+		if len(inst.WebAuthnCredentials) == 0 {
+			return jsonapi.BadRequest(instance.ErrTwoFactorNotEnrolled)
+		}
 	}
 
 	err = instance.Patch(inst, &instance.Options{AuthMode: args.AuthMode})
 	if err != nil {
 		return err
 	}
+	audit.Log(inst, c.Request(), audit.TwoFactorChanged, map[string]interface{}{
+		"auth_mode": args.AuthMode,
+	})
 
 	return c.NoContent(http.StatusNoContent)
 }
@@ -4,10 +4,13 @@ package settings
 
 import (
 	"encoding/hex"
+	"errors"
 	"net/http"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/limits"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/web/auth"
 	"github.com/cozy/cozy-stack/web/jsonapi"
@@ -60,11 +63,16 @@ func updatePassphrase(c echo.Context) error {
 		return err
 	}
 
+	if auth.IsPassphraseLoginDisabled(inst) {
+		return jsonapi.Forbidden(errors.New("The passphrase is disabled for this instance"))
+	}
+
 	args := struct {
 		Current           string `json:"current_passphrase"`
 		Passphrase        string `json:"new_passphrase"`
 		TwoFactorPasscode string `json:"two_factor_passcode"`
 		TwoFactorToken    []byte `json:"two_factor_token"`
+		TwoFactorMethod   string `json:"two_factor_method"`
 	}{}
 	err := c.Bind(&args)
 	if err != nil {
@@ -74,25 +82,48 @@ func updatePassphrase(c echo.Context) error {
 	newPassphrase := []byte(args.Passphrase)
 	currentPassphrase := []byte(args.Current)
 
-	if inst.HasAuthMode(instance.TwoFactorMail) && len(args.TwoFactorToken) == 0 {
+	// The current passphrase and the two-factor passcode can be guessed, so
+	// the failed attempts are limited like for the login.
+	counterType := limits.AuthType
+	if inst.HasTwoFactor() && len(args.TwoFactorToken) > 0 {
+		counterType = limits.TwoFactorType
+	}
+	if err = auth.CheckAttempts(c, inst, counterType); err != nil {
+		return err
+	}
+
+	if inst.HasTwoFactor() && len(args.TwoFactorToken) == 0 {
 		if inst.CheckPassphrase(currentPassphrase) == nil {
-			var twoFactorToken []byte
-			twoFactorToken, err = inst.SendTwoFactorPasscode()
+			auth.ResetAttempts(c, inst, limits.AuthType)
+			var challenge *instance.TwoFactorChallenge
+			challenge, err = inst.BeginTwoFactor(args.TwoFactorMethod)
 			if err != nil {
-				return err
+				return jsonapi.BadRequest(err)
+			}
+			res := echo.Map{
+				"two_factor_token":   challenge.Token,
+				"two_factor_method":  challenge.Method,
+				"two_factor_methods": inst.TwoFactorMethods(),
 			}
-			return c.JSON(http.StatusOK, echo.Map{
-				"two_factor_token": twoFactorToken,
-			})
+			if challenge.WebAuthn != nil {
+				res["webauthn"] = challenge.WebAuthn
+			}
+			return c.JSON(http.StatusOK, res)
 		}
+		auth.CountAttempt(c, inst, limits.AuthType)
 		return instance.ErrInvalidPassphrase
 	}
 
 	err = inst.UpdatePassphrase(newPassphrase, currentPassphrase,
 		args.TwoFactorPasscode, args.TwoFactorToken)
+	if err == instance.ErrInvalidPassphrase || err == instance.ErrInvalidTwoFactor {
+		auth.CountAttempt(c, inst, counterType)
+	}
 	if err != nil {
 		return jsonapi.BadRequest(err)
 	}
+	auth.ResetAttempts(c, inst, counterType)
+	audit.Log(inst, c.Request(), audit.PassphraseChanged, nil)
 
 	longRunSession := true
 	if hasSession {
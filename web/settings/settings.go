@@ -83,10 +83,23 @@ func Routes(router *echo.Group) {
 
 	router.GET("/instance", getInstance)
 	router.PUT("/instance", updateInstance)
+	router.GET("/instance/auth_mode", getInstanceAuthMode)
 	router.PUT("/instance/auth_mode", updateInstanceAuthMode)
+	router.POST("/instance/auth_mode/totp", beginTOTPEnrollment)
+	router.PUT("/instance/auth_mode/totp", finishTOTPEnrollment)
+	router.DELETE("/instance/auth_mode/totp", removeTOTP)
+	router.POST("/instance/auth_mode/webauthn", beginWebAuthnRegistration)
+	router.PUT("/instance/auth_mode/webauthn", finishWebAuthnRegistration)
+	router.DELETE("/instance/auth_mode/webauthn/:id", removeWebAuthnCredential)
+	router.POST("/instance/auth_mode/recovery_codes", regenerateRecoveryCodes)
 	router.PUT("/instance/sign_tos", updateInstanceTOS)
 
 	router.GET("/sessions", getSessions)
+	router.GET("/audit", listAuditEntries)
+
+	router.GET("/app_passwords", listAppPasswords)
+	router.POST("/app_passwords", createAppPassword)
+	router.DELETE("/app_passwords/:id", revokeAppPassword)
 
 	router.GET("/clients", listClients)
 	router.DELETE("/clients/:id", revokeClient)
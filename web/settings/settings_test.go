@@ -8,15 +8,22 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/consts"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/instance"
 	"github.com/cozy/cozy-stack/pkg/oauth"
+	"github.com/cozy/cozy-stack/pkg/permissions"
 	"github.com/cozy/cozy-stack/pkg/sessions"
 	"github.com/cozy/cozy-stack/tests/testutils"
+	"github.com/cozy/cozy-stack/web/middlewares"
 	"github.com/cozy/echo"
+	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 
 	_ "github.com/cozy/cozy-stack/pkg/workers/mails"
@@ -294,6 +301,150 @@ func TestUpdatePassphraseWithTwoFactorAuth(t *testing.T) {
 	assert.Equal(t, "204 No Content", res.Status)
 }
 
+func TestEnrollTOTP(t *testing.T) {
+	session, err := sessions.New(testInstance, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cookie, err := session.ToCookie()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	args, _ := json.Marshal(&echo.Map{
+		"current_passphrase": "MyLastPassphrase",
+	})
+	req, _ := http.NewRequest("POST", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 403, res.StatusCode)
+
+	args, _ = json.Marshal(&echo.Map{
+		"current_passphrase": "NotMyPassphrase",
+	})
+	req, _ = http.NewRequest("POST", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 403, res.StatusCode)
+
+	args, _ = json.Marshal(&echo.Map{
+		"current_passphrase": "MyLastPassphrase",
+	})
+	req, _ = http.NewRequest("POST", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	if !assert.Equal(t, "200 OK", res.Status) {
+		return
+	}
+	var enrollment instance.TOTPEnrollment
+	err = json.NewDecoder(res.Body).Decode(&enrollment)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.URL, "otpauth://totp/")
+
+	args, _ = json.Marshal(&echo.Map{
+		"current_passphrase": "MyLastPassphrase",
+		"token":              enrollment.Token,
+		"passcode":           "foo",
+	})
+	req, _ = http.NewRequest("PUT", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, 422, res.StatusCode)
+
+	passcode, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	assert.NoError(t, err)
+	args, _ = json.Marshal(&echo.Map{
+		"current_passphrase": "MyLastPassphrase",
+		"token":              enrollment.Token,
+		"passcode":           passcode,
+	})
+	req, _ = http.NewRequest("PUT", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	var result struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	assert.Len(t, result.RecoveryCodes, 10)
+
+	body := `{"auth_mode": "two_factor_totp"}`
+	req, _ = http.NewRequest("PUT", ts.URL+"/settings/instance/auth_mode", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "204 No Content", res.Status)
+
+	req, _ = http.NewRequest("GET", ts.URL+"/settings/instance/auth_mode", nil)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "200 OK", res.Status)
+	var authMode map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&authMode)
+	assert.NoError(t, err)
+	assert.Equal(t, "two_factor_totp", authMode["auth_mode"])
+	assert.Equal(t, true, authMode["totp"])
+	assert.EqualValues(t, 10, authMode["recovery_codes"])
+	assert.Equal(t, []interface{}{"totp", "recovery_code"}, authMode["two_factor_methods"])
+
+	// The passcode used for the enrollment cannot be used again to log in
+	inst, err := instance.Get(testInstance.Domain)
+	if assert.NoError(t, err) {
+		challenge, err := inst.BeginTwoFactor(instance.TwoFactorMethodTOTP)
+		if assert.NoError(t, err) {
+			assert.False(t, inst.ValidateTwoFactor(challenge.Token, passcode))
+		}
+	}
+
+	args, _ = json.Marshal(&echo.Map{
+		"current_passphrase": "MyLastPassphrase",
+	})
+	req, _ = http.NewRequest("DELETE", ts.URL+"/settings/instance/auth_mode/totp", bytes.NewReader(args))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 409, res.StatusCode)
+
+	// Go back to the basic auth mode for the next tests
+	body = `{"auth_mode": "basic"}`
+	req, _ = http.NewRequest("PUT", ts.URL+"/settings/instance/auth_mode", bytes.NewBufferString(body))
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "204 No Content", res.Status)
+}
+
 func TestListClients(t *testing.T) {
 	res, err := http.Get(ts.URL + "/settings/clients")
 	assert.NoError(t, err)
@@ -371,6 +522,160 @@ func TestRevokeClient(t *testing.T) {
 	assert.Len(t, data, 1)
 }
 
+func TestListAuditEntries(t *testing.T) {
+	res, err := http.Get(ts.URL + "/settings/audit")
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/settings/audit?page[limit]=1", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].([]interface{})
+	assert.Len(t, data, 1)
+	obj := data[0].(map[string]interface{})
+	assert.Equal(t, consts.Audit, obj["type"].(string))
+	attrs := obj["attributes"].(map[string]interface{})
+	assert.Equal(t, "oauth_client_revoked", attrs["event"].(string))
+	details := attrs["details"].(map[string]interface{})
+	assert.Equal(t, oauthClientID, details["client_id"].(string))
+	links := result["links"].(map[string]interface{})
+	next := links["next"].(string)
+	assert.Contains(t, next, "/settings/audit?")
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+next, nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data = result["data"].([]interface{})
+	assert.Len(t, data, 1)
+	obj = data[0].(map[string]interface{})
+	attrs = obj["attributes"].(map[string]interface{})
+	assert.NotEqual(t, "oauth_client_revoked", attrs["event"].(string))
+}
+
+func TestAppPasswords(t *testing.T) {
+	session, err := sessions.New(testInstance, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cookie, err := session.ToCookie()
+	if !assert.NoError(t, err) {
+		return
+	}
+	makeBody := func(passphrase string) *bytes.Buffer {
+		return bytes.NewBufferString(`{"data": {"type": "io.cozy.app_passwords", "attributes": {
+		"name": "WebDAV",
+		"current_passphrase": "` + passphrase + `",
+		"permissions": {"settings": {"type": "io.cozy.settings", "verbs": ["GET"]}}
+	}}}`)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/settings/app_passwords", makeBody("MyLastPassphrase"))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 401, res.StatusCode)
+
+	// A token is not enough: the user must be logged in
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/settings/app_passwords", makeBody("MyLastPassphrase"))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+
+	// And they must type their passphrase again
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/settings/app_passwords", makeBody("NotMyPassphrase"))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 403, res.StatusCode)
+
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/settings/app_passwords", makeBody("MyLastPassphrase"))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/vnd.api+json")
+	req.Header.Add("Authorization", "Bearer "+token)
+	req.AddCookie(cookie)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, res.StatusCode)
+	var result map[string]interface{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	data := result["data"].(map[string]interface{})
+	id := data["id"].(string)
+	attrs := data["attributes"].(map[string]interface{})
+	assert.Equal(t, "WebDAV", attrs["name"].(string))
+	password := attrs["password"].(string)
+	assert.Len(t, password, permissions.AppPasswordLength)
+	assert.Nil(t, attrs["hash"])
+
+	a, err := permissions.CheckAppPassword(testInstance, password)
+	assert.NoError(t, err)
+	assert.Equal(t, id, a.ID())
+	assert.NotNil(t, a.LastUsedAt)
+	pdoc := a.Permission()
+	assert.Equal(t, permissions.TypeAppPassword, pdoc.Type)
+	assert.True(t, pdoc.Permissions.AllowWholeType(permissions.GET, consts.Settings))
+	assert.False(t, pdoc.Permissions.AllowWholeType(permissions.PUT, consts.Settings))
+	_, err = permissions.CheckAppPassword(testInstance, id+strings.Repeat("0", len(password)-len(id)))
+	assert.Equal(t, permissions.ErrInvalidAppPassword, err)
+
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/settings/app_passwords", nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, res.StatusCode)
+	result = nil
+	err = json.NewDecoder(res.Body).Decode(&result)
+	assert.NoError(t, err)
+	list := result["data"].([]interface{})
+	assert.Len(t, list, 1)
+	attrs = list[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	assert.Nil(t, attrs["password"])
+	assert.NotNil(t, attrs["last_used_at"])
+
+	req, err = http.NewRequest(http.MethodDelete, ts.URL+"/settings/app_passwords/"+id, nil)
+	assert.NoError(t, err)
+	req.Header.Add("Authorization", "Bearer "+token)
+	res, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, res.StatusCode)
+
+	_, err = permissions.CheckAppPassword(testInstance, password)
+	assert.Equal(t, permissions.ErrInvalidAppPassword, err)
+
+	// The creation and the revocation are recorded in the audit log
+	entries, err := audit.List(testInstance, couchdb.NewKeyCursor(2, nil, ""))
+	if assert.NoError(t, err) && assert.Len(t, entries, 2) {
+		assert.Equal(t, audit.AppPasswordRevoked, entries[0].Event)
+		assert.Equal(t, audit.AppPasswordCreated, entries[1].Event)
+		for _, e := range entries {
+			assert.Equal(t, id, e.Details["app_password_id"])
+			assert.Equal(t, "WebDAV", e.Details["name"])
+			assert.NotEmpty(t, e.IP)
+			assert.Equal(t, "Go-http-client/1.1", e.UA)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	config.UseTestFile()
 	testutils.NeedCouchdb()
@@ -380,9 +685,12 @@ func TestMain(m *testing.M) {
 		Timezone: "Europe/Berlin",
 		Email:    "alice@example.com",
 	})
-	scope := consts.Settings + " " + consts.OAuthClients
+	scope := consts.Settings + " " + consts.OAuthClients + " " + consts.Audit + " " + consts.AppPasswords
 	_, token = setup.GetTestClient(scope)
 
-	ts = setup.GetTestServer("/settings", Routes)
+	ts = setup.GetTestServer("/settings", func(g *echo.Group) {
+		g.Use(middlewares.LoadSession)
+		Routes(g)
+	})
 	os.Exit(setup.Run())
 }
@@ -0,0 +1,102 @@
+package sharings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/permissions"
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiActivity struct{ *sharing.Activity }
+
+func (a *apiActivity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Activity)
+}
+func (a *apiActivity) Links() *jsonapi.LinksList              { return nil }
+func (a *apiActivity) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiActivity) Included() []jsonapi.Object             { return nil }
+
+// checkStatusPermissions checks that the request can see the status and the
+// activity of a sharing: it is not allowed for the preview of a sharing.
+func checkStatusPermissions(c echo.Context, s *sharing.Sharing) error {
+	requestPerm, err := middlewares.GetPermission(c)
+	if err != nil {
+		return err
+	}
+	if requestPerm.Type == permissions.TypeSharePreview {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	return checkGetPermissions(c, s)
+}
+
+// GetSyncStatus returns the synchronization status of the members of a
+// sharing
+func GetSyncStatus(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkStatusPermissions(c, s); err != nil {
+		return wrapErrors(err)
+	}
+	status, err := s.SyncStatus(inst)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// ListActivities returns the activity feed of a sharing
+func ListActivities(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkStatusPermissions(c, s); err != nil {
+		return wrapErrors(err)
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, sharing.DefaultActivityLimit)
+	if err != nil {
+		return err
+	}
+	activities, err := s.ListActivities(inst, cursor)
+	if err != nil {
+		return wrapErrors(err)
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		links.Next = "/sharings/" + s.SID + "/activity?" + params.Encode()
+	}
+
+	objs := make([]jsonapi.Object, len(activities))
+	for i, a := range activities {
+		objs[i] = &apiActivity{a}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// senderMember returns the member that has sent the changes of a request: the
+// owner for a recipient, and the recipient that has made the request for the
+// owner.
+func senderMember(c echo.Context, s *sharing.Sharing) *sharing.Member {
+	if !s.Owner {
+		return &s.Members[0]
+	}
+	m, err := requestMember(c, s)
+	if err != nil {
+		return nil
+	}
+	return m
+}
@@ -0,0 +1,111 @@
+package sharings
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/sharing"
+	"github.com/cozy/cozy-stack/web/jsonapi"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/echo"
+)
+
+type apiConflict struct{ *sharing.Conflict }
+
+func (a *apiConflict) MarshalJSON() ([]byte, error) {
+	return json.Marshal(a.Conflict)
+}
+func (a *apiConflict) Links() *jsonapi.LinksList              { return nil }
+func (a *apiConflict) Relationships() jsonapi.RelationshipMap { return nil }
+func (a *apiConflict) Included() []jsonapi.Object             { return nil }
+
+// ListConflicts returns the conflicts on the files of a sharing
+func ListConflicts(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if err = checkStatusPermissions(c, s); err != nil {
+		return wrapErrors(err)
+	}
+
+	cursor, err := jsonapi.ExtractPaginationCursor(c, sharing.DefaultConflictLimit)
+	if err != nil {
+		return err
+	}
+	conflicts, err := s.ListConflicts(inst, cursor)
+	if err != nil {
+		return wrapErrors(err)
+	}
+
+	links := &jsonapi.LinksList{}
+	if cursor.HasMore() {
+		params, err := jsonapi.PaginationCursorToParams(cursor)
+		if err != nil {
+			return err
+		}
+		links.Next = "/sharings/" + s.SID + "/conflicts?" + params.Encode()
+	}
+
+	objs := make([]jsonapi.Object, len(conflicts))
+	for i, conflict := range conflicts {
+		objs[i] = &apiConflict{conflict}
+	}
+	return jsonapi.DataList(c, http.StatusOK, objs, links)
+}
+
+// ResolveConflict applies the choice of the user for a conflict on a shared
+// file: keep mine, theirs, or both versions.
+func ResolveConflict(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	if _, err = checkCreatePermissions(c, s); err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	conflict, err := s.FindConflict(inst, c.Param("conflict-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	var body struct {
+		Keep sharing.ConflictResolution `json:"keep"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.ResolveConflict(inst, conflict, body.Keep); err != nil {
+		return wrapErrors(err)
+	}
+	go s.NotifyConflictResolved(inst, conflict, nil)
+	return jsonapi.Data(c, http.StatusOK, &apiConflict{conflict}, nil)
+}
+
+// ConflictResolvedNotif is used to inform a member that another member has
+// resolved a conflict on a shared file
+func ConflictResolvedNotif(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	s, err := sharing.FindSharing(inst, c.Param("sharing-id"))
+	if err != nil {
+		return wrapErrors(err)
+	}
+	var msg sharing.ConflictResolvedMsg
+	if err = json.NewDecoder(c.Request().Body).Decode(&msg); err != nil {
+		return jsonapi.BadJSON()
+	}
+	conflict, err := s.ResolveConflictByNotification(inst, &msg)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	// The owner forwards the resolution to the other recipients
+	if conflict != nil && s.Owner {
+		member, err := requestMember(c, s)
+		if err != nil {
+			return wrapErrors(err)
+		}
+		go s.NotifyConflictResolved(inst, conflict, member)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
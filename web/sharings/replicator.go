@@ -55,7 +55,7 @@ func BulkDocs(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("No bulk docs")
 		return echo.NewHTTPError(http.StatusBadRequest)
 	}
-	err = s.ApplyBulkDocs(inst, docs)
+	err = s.ApplyBulkDocs(inst, docs, senderMember(c, s))
 	if err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on apply: %s", err)
 		return wrapErrors(err)
@@ -105,7 +105,7 @@ func SyncFile(c echo.Context) error {
 		err = errors.New("The identifiers in the URL and in the doc are not the same")
 		return jsonapi.InvalidAttribute("id", err)
 	}
-	key, err := s.SyncFile(inst, fileDoc)
+	key, err := s.SyncFile(inst, fileDoc, senderMember(c, s))
 	if err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on sync file: %s", err)
 		return wrapErrors(err)
@@ -125,13 +125,47 @@ func FileHandler(c echo.Context) error {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
 		return wrapErrors(err)
 	}
-	if err := s.HandleFileUpload(inst, c.Param("id"), c.Request().Body); err != nil {
+	if err := s.HandleFileUpload(inst, c.Param("id"), c.Request().Body, senderMember(c, s)); err != nil {
 		inst.Logger().WithField("nspace", "replicator").Debugf("Error on file upload: %s", err)
 		return wrapErrors(err)
 	}
 	return c.NoContent(http.StatusNoContent)
 }
 
+// FileSignature returns the signature of the current content of a file, for
+// computing a delta of its content
+func FileSignature(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
+		return wrapErrors(err)
+	}
+	sig, err := s.FileSignature(inst, c.Param("id"))
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Error on file signature: %s", err)
+		return wrapErrors(err)
+	}
+	return c.JSON(http.StatusOK, sig)
+}
+
+// FileDeltaHandler is used to receive the delta of the content of a file
+func FileDeltaHandler(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Sharing was not found: %s", err)
+		return wrapErrors(err)
+	}
+	if err := s.HandleFileDelta(inst, c.Param("id"), c.Request().Body, senderMember(c, s)); err != nil {
+		inst.Logger().WithField("nspace", "replicator").Debugf("Error on file delta: %s", err)
+		return wrapErrors(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
 // EndInitial is used for ending the initial sync phase of a sharing
 func EndInitial(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
@@ -154,6 +188,8 @@ func replicatorRoutes(router *echo.Group) {
 	group.GET("/:sharing-id/io.cozy.files/:id", GetFolder, checkSharingReadPermissions)
 	group.PUT("/:sharing-id/io.cozy.files/:id/metadata", SyncFile, checkSharingWritePermissions)
 	group.PUT("/:sharing-id/io.cozy.files/:id", FileHandler, checkSharingWritePermissions)
+	group.GET("/:sharing-id/io.cozy.files/:id/signature", FileSignature, checkSharingWritePermissions)
+	group.PUT("/:sharing-id/io.cozy.files/:id/delta", FileDeltaHandler, checkSharingWritePermissions)
 	group.DELETE("/:sharing-id/initial", EndInitial, checkSharingWritePermissions)
 }
 
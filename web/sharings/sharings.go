@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/audit"
 	"github.com/cozy/cozy-stack/pkg/consts"
 	"github.com/cozy/cozy-stack/pkg/contacts"
 	"github.com/cozy/cozy-stack/pkg/couchdb"
@@ -191,6 +193,10 @@ func AnswerSharing(c echo.Context) error {
 	if err != nil {
 		return wrapErrors(err)
 	}
+	audit.Log(inst, c.Request(), audit.SharingAccepted, map[string]interface{}{
+		"sharing_id": s.SID,
+		"recipient":  creds.PublicName,
+	})
 	return jsonapi.Data(c, http.StatusOK, ac, nil)
 }
 
@@ -450,6 +456,44 @@ func RevokeRecipient(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// SetExpiration is used by the owner to set, extend or remove the expiration
+// date of a sharing, or of the access of a recipient
+func SetExpiration(c echo.Context) error {
+	inst := middlewares.GetInstance(c)
+	sharingID := c.Param("sharing-id")
+	s, err := sharing.FindSharing(inst, sharingID)
+	if err != nil {
+		return wrapErrors(err)
+	}
+	_, err = checkCreatePermissions(c, s)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	index := 0
+	if param := c.Param("index"); param != "" {
+		index, err = strconv.Atoi(param)
+		if err != nil {
+			return jsonapi.InvalidParameter("index", err)
+		}
+		if index == 0 || index >= len(s.Members) {
+			return jsonapi.InvalidParameter("index", errors.New("Invalid index"))
+		}
+	}
+	var body struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err = json.NewDecoder(c.Request().Body).Decode(&body); err != nil {
+		return jsonapi.BadJSON()
+	}
+	if err = s.SetExpiration(inst, index, body.ExpiresAt); err != nil {
+		return wrapErrors(err)
+	}
+	if index > 0 {
+		go s.NotifyRecipients(inst, nil)
+	}
+	return jsonapiSharingWithDocs(c, s)
+}
+
 // RevocationRecipientNotif is used to inform a recipient that the sharing is revoked
 func RevocationRecipientNotif(c echo.Context) error {
 	inst := middlewares.GetInstance(c)
@@ -657,11 +701,24 @@ func Routes(router *echo.Group) {
 	router.DELETE("/:sharing-id/recipients/self", RevokeRecipientBySelf)                                     // On the recipient
 	router.DELETE("/:sharing-id/answer", RevocationOwnerNotif, checkSharingWritePermissions)                 // On the sharer
 
+	// Expiration of the sharing or of the access of a recipient
+	router.PUT("/:sharing-id/expiration", SetExpiration)                   // On the sharer
+	router.PUT("/:sharing-id/recipients/:index/expiration", SetExpiration) // On the sharer
+
 	// Delegated routes for open sharing
 	router.POST("/:sharing-id/recipients/delegated", AddRecipientsDelegated, checkSharingWritePermissions)
 
 	router.GET("/doctype/:doctype", GetSharingsInfoByDocType)
 
+	// Synchronization status and activity feed
+	router.GET("/:sharing-id/status", GetSyncStatus)
+	router.GET("/:sharing-id/activity", ListActivities)
+
+	// Conflicts on the shared files
+	router.GET("/:sharing-id/conflicts", ListConflicts)
+	router.POST("/:sharing-id/conflicts/:conflict-id", ResolveConflict)
+	router.PUT("/:sharing-id/conflicts", ConflictResolvedNotif, checkSharingWritePermissions)
+
 	// Register the URL of their Cozy for recipients
 	router.GET("/:sharing-id/discovery", GetDiscovery)
 	router.POST("/:sharing-id/discovery", PostDiscovery)
@@ -751,6 +808,8 @@ func wrapErrors(err error) error {
 		return jsonapi.InvalidParameter("url", err)
 	case sharing.ErrInvalidSharing, sharing.ErrInvalidRule:
 		return jsonapi.BadRequest(err)
+	case sharing.ErrInvalidExpiration:
+		return jsonapi.InvalidAttribute("expires_at", err)
 	case sharing.ErrMemberNotFound:
 		return jsonapi.NotFound(err)
 	case sharing.ErrMailNotSent:
@@ -767,12 +826,22 @@ func wrapErrors(err error) error {
 		return jsonapi.NotFound(err)
 	case vfs.ErrInvalidHash:
 		return jsonapi.InvalidParameter("md5sum", err)
+	case sharing.ErrCannotApplyDelta:
+		return jsonapi.PreconditionFailed("delta", err)
 	case sharing.ErrFolderNotFound:
 		return jsonapi.NotFound(err)
 	case sharing.ErrSafety:
 		return jsonapi.BadRequest(err)
 	case sharing.ErrAlreadyAccepted:
 		return jsonapi.Conflict(err)
+	case sharing.ErrConflictNotFound:
+		return jsonapi.NotFound(err)
+	case sharing.ErrConflictResolved:
+		return jsonapi.Conflict(err)
+	case sharing.ErrConflictOutdated:
+		return jsonapi.Conflict(err)
+	case sharing.ErrInvalidResolution:
+		return jsonapi.InvalidAttribute("keep", err)
 	}
 	return err
 }
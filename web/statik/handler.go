@@ -32,6 +32,7 @@ var (
 		"need_onboarding.html",
 		"passphrase_reset.html",
 		"passphrase_renew.html",
+		"share_password.html",
 		"sharing_discovery.html",
 	}
 )
@@ -0,0 +1,88 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/utils"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// lockTimeout is the timeout announced for the locks, in seconds.
+const lockTimeout = "Second-3600"
+
+// The locks are only advisory: some clients, like the Finder of macOS or the
+// explorer of Windows, refuse to write on a WebDAV server that does not
+// support them, but the VFS does not enforce them. A token is sent to the
+// client, and the requests are not checked against it.
+func handleLock(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	dir, file, err := fs.DirOrFileByPath(davPath(c))
+	if err != nil && !os.IsNotExist(err) {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		if err = middlewares.AllowVFS(c, permissions.PUT, dir); err != nil {
+			return err
+		}
+	} else if file != nil {
+		if err = middlewares.AllowVFS(c, permissions.PUT, file); err != nil {
+			return err
+		}
+	}
+
+	// A request without body is used to refresh a lock
+	token := tokenFromIfHeader(c.Request().Header.Get("If"))
+	if token == "" {
+		token = "opaquelocktoken:" + utils.RandomString(32)
+	}
+
+	depth := c.Request().Header.Get("Depth")
+	if depth != "0" {
+		depth = "infinity"
+	}
+	timeout := c.Request().Header.Get("Timeout")
+	if timeout == "" || strings.HasPrefix(timeout, "Infinite") {
+		timeout = lockTimeout
+	}
+
+	body := xml.Header +
+		`<D:prop xmlns:D="DAV:"><D:lockdiscovery><D:activelock>` +
+		`<D:locktype><D:write/></D:locktype>` +
+		`<D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:depth>` + depth + `</D:depth>` +
+		`<D:timeout>` + escapeXML(timeout) + `</D:timeout>` +
+		`<D:locktoken><D:href>` + escapeXML(token) + `</D:href></D:locktoken>` +
+		`<D:lockroot><D:href>` + escapeXML(c.Request().URL.EscapedPath()) + `</D:href></D:lockroot>` +
+		`</D:activelock></D:lockdiscovery></D:prop>`
+	c.Response().Header().Set("Lock-Token", "<"+token+">")
+	c.Response().Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+	return c.String(http.StatusOK, body)
+}
+
+func handleUnlock(c echo.Context) error {
+	if c.Request().Header.Get("Lock-Token") == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Missing Lock-Token header")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// tokenFromIfHeader returns the first lock token of an If header, like
+// (<opaquelocktoken:xxx>).
+func tokenFromIfHeader(header string) string {
+	start := strings.Index(header, "(<")
+	if start < 0 {
+		return ""
+	}
+	rest := header[start+2:]
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return ""
+	}
+	return rest[:end]
+}
@@ -0,0 +1,278 @@
+package webdav
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// destination returns the path in the VFS of the Destination header, used by
+// the COPY and MOVE methods.
+func destination(req *http.Request) (string, error) {
+	dest := req.Header.Get("Destination")
+	if dest == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Missing Destination header")
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid Destination header")
+	}
+	if u.Host != "" && u.Host != req.Host {
+		return "", echo.NewHTTPError(http.StatusBadGateway)
+	}
+	if u.Path != FilesPrefix && !strings.HasPrefix(u.Path, FilesPrefix+"/") {
+		return "", echo.NewHTTPError(http.StatusBadGateway)
+	}
+	return pathFromURLPath(u.Path), nil
+}
+
+// setAside is the document that was at the destination of a COPY or MOVE,
+// when the Overwrite header allows to replace it. It is renamed during the
+// operation, and then removed if the operation succeeds, or it gets back its
+// name if the operation fails.
+type setAside struct {
+	dir  *vfs.DirDoc
+	file *vfs.FileDoc
+	name string
+}
+
+// prepareDestination checks that the destination of a COPY or MOVE can be
+// used and that the request is allowed to create a document there. The
+// existing document at this place is set aside if the Overwrite header allows
+// it. It returns the parent directory and the document set aside, if any.
+func prepareDestination(c echo.Context, fs vfs.VFS, src, dest string) (*vfs.DirDoc, *setAside, error) {
+	if dest == "/" || dest == src || strings.HasPrefix(dest, src+"/") {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden)
+	}
+	parent, err := fs.DirByPath(path.Dir(dest))
+	if os.IsNotExist(err) {
+		return nil, nil, echo.NewHTTPError(http.StatusConflict)
+	}
+	if err != nil {
+		return nil, nil, files.WrapVfsError(err)
+	}
+	if err = middlewares.AllowVFS(c, permissions.POST, parent); err != nil {
+		return nil, nil, err
+	}
+	dir, file, err := fs.DirOrFileByPath(dest)
+	if os.IsNotExist(err) {
+		return parent, nil, nil
+	}
+	if err != nil {
+		return nil, nil, files.WrapVfsError(err)
+	}
+	if c.Request().Header.Get("Overwrite") == "F" {
+		return nil, nil, echo.NewHTTPError(http.StatusPreconditionFailed)
+	}
+
+	aside := &setAside{name: path.Base(dest)}
+	tmpname := fmt.Sprintf(".%s.overwritten-%d", aside.name, time.Now().UnixNano())
+	patch := &vfs.DocPatch{Name: &tmpname}
+	if dir != nil {
+		if err = middlewares.AllowVFS(c, permissions.PUT, dir); err != nil {
+			return nil, nil, err
+		}
+		aside.dir, err = vfs.ModifyDirMetadata(fs, dir, patch)
+	} else {
+		if err = middlewares.AllowVFS(c, permissions.PUT, file); err != nil {
+			return nil, nil, err
+		}
+		aside.file, err = vfs.ModifyFileMetadata(fs, file, patch)
+	}
+	if err == os.ErrInvalid {
+		return nil, nil, echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err != nil {
+		return nil, nil, files.WrapVfsError(err)
+	}
+	return parent, aside, nil
+}
+
+// finishDestination removes the document set aside if the operation has
+// succeeded, or gives it back its name if the operation has failed.
+func finishDestination(c echo.Context, fs vfs.VFS, aside *setAside, opErr error) error {
+	if aside == nil {
+		return opErr
+	}
+	if opErr == nil {
+		return removeDoc(c, fs, aside.dir, aside.file)
+	}
+	patch := &vfs.DocPatch{Name: &aside.name}
+	var err error
+	if aside.dir != nil {
+		_, err = vfs.ModifyDirMetadata(fs, aside.dir, patch)
+	} else {
+		_, err = vfs.ModifyFileMetadata(fs, aside.file, patch)
+	}
+	if err != nil {
+		middlewares.GetInstance(c).Logger().WithField("nspace", "webdav").
+			Warnf("Cannot restore the name of %s: %s", aside.name, err)
+	}
+	return opErr
+}
+
+func handleMove(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	src := davPath(c)
+	dest, err := destination(c.Request())
+	if err != nil {
+		return err
+	}
+	dir, file, err := fs.DirOrFileByPath(src)
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		err = middlewares.AllowVFS(c, permissions.PATCH, dir)
+	} else {
+		err = middlewares.AllowVFS(c, permissions.PATCH, file)
+	}
+	if err != nil {
+		return err
+	}
+
+	parent, aside, err := prepareDestination(c, fs, src, dest)
+	if err != nil {
+		return err
+	}
+	name := path.Base(dest)
+	dirID := parent.ID()
+	patch := &vfs.DocPatch{Name: &name, DirID: &dirID}
+	if dir != nil {
+		_, err = vfs.ModifyDirMetadata(fs, dir, patch)
+	} else {
+		_, err = vfs.ModifyFileMetadata(fs, file, patch)
+	}
+	if err == os.ErrInvalid {
+		err = echo.NewHTTPError(http.StatusForbidden)
+	} else if err != nil {
+		err = files.WrapVfsError(err)
+	}
+	if err = finishDestination(c, fs, aside, err); err != nil {
+		return err
+	}
+	if aside != nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+func handleCopy(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	src := davPath(c)
+	dest, err := destination(c.Request())
+	if err != nil {
+		return err
+	}
+	dir, file, err := fs.DirOrFileByPath(src)
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		err = middlewares.AllowVFS(c, permissions.GET, dir)
+	} else {
+		err = middlewares.AllowVFS(c, permissions.GET, file)
+	}
+	if err != nil {
+		return err
+	}
+
+	parent, aside, err := prepareDestination(c, fs, src, dest)
+	if err != nil {
+		return err
+	}
+	name := path.Base(dest)
+	if dir != nil {
+		recursive := c.Request().Header.Get("Depth") != "0"
+		_, err = copyDir(c, fs, dir, parent, name, recursive)
+	} else {
+		_, err = copyFile(c, fs, file, parent, name)
+	}
+	if err = finishDestination(c, fs, aside, err); err != nil {
+		if _, ok := err.(*echo.HTTPError); ok {
+			return err
+		}
+		return files.WrapVfsError(err)
+	}
+	if aside != nil {
+		return c.NoContent(http.StatusNoContent)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+// copyFile copies a file in the parent directory, if the request is allowed
+// to create it there.
+func copyFile(c echo.Context, fs vfs.VFS, src *vfs.FileDoc, parent *vfs.DirDoc, name string) (*vfs.FileDoc, error) {
+	newdoc, err := vfs.NewFileDoc(name, parent.ID(), src.ByteSize, src.MD5Sum,
+		src.Mime, src.Class, time.Now(), src.Executable, false, src.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if err = middlewares.AllowVFS(c, permissions.POST, newdoc); err != nil {
+		return nil, err
+	}
+	content, err := fs.OpenFile(src)
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+	file, err := fs.CreateFile(newdoc, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, content)
+	if cerr := file.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newdoc, nil
+}
+
+// copyDir copies a directory in the parent directory, and its content if
+// recursive is true. The permissions are checked for each created document.
+func copyDir(c echo.Context, fs vfs.VFS, src, parent *vfs.DirDoc, name string, recursive bool) (*vfs.DirDoc, error) {
+	newdir, err := vfs.NewDirDocWithParent(name, parent, src.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if err = middlewares.AllowVFS(c, permissions.POST, newdir); err != nil {
+		return nil, err
+	}
+	if err = fs.CreateDir(newdir); err != nil {
+		return nil, err
+	}
+	if !recursive {
+		return newdir, nil
+	}
+	iter := fs.DirIterator(src, nil)
+	for {
+		d, f, err := iter.Next()
+		if err == vfs.ErrIteratorDone {
+			return newdir, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			_, err = copyDir(c, fs, d, newdir, d.DocName, true)
+		} else {
+			_, err = copyFile(c, fs, f, newdir, f.DocName)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
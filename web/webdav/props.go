@@ -0,0 +1,374 @@
+package webdav
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+const davNS = "DAV:"
+
+// maxXMLBodySize is the maximal size of the XML bodies of the requests.
+const maxXMLBodySize = 1 << 20
+
+const (
+	statusOK        = "HTTP/1.1 200 OK"
+	statusNotFound  = "HTTP/1.1 404 Not Found"
+	statusForbidden = "HTTP/1.1 403 Forbidden"
+)
+
+// The live properties returned for allprop. The quota properties are only
+// returned when they are explicitly asked (RFC 4331).
+var allProps = []string{
+	"resourcetype",
+	"displayname",
+	"creationdate",
+	"getlastmodified",
+	"getetag",
+	"getcontentlength",
+	"getcontenttype",
+	"supportedlock",
+}
+
+var quotaProps = []string{
+	"quota-used-bytes",
+	"quota-available-bytes",
+}
+
+type propfindRequest struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+type propNames struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+type proppatchRequest struct {
+	XMLName xml.Name `xml:"DAV: propertyupdate"`
+	Set     []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: set"`
+	Remove []struct {
+		Prop propNames `xml:"DAV: prop"`
+	} `xml:"DAV: remove"`
+}
+
+type multistatus struct {
+	XMLName   xml.Name   `xml:"D:multistatus"`
+	XMLNS     string     `xml:"xmlns:D,attr"`
+	Responses []response `xml:"D:response"`
+}
+
+type response struct {
+	Href      string     `xml:"D:href"`
+	Propstats []propstat `xml:"D:propstat"`
+}
+
+type propstat struct {
+	Props  []prop `xml:"D:prop>prop"`
+	Status string `xml:"D:status"`
+}
+
+// prop is a property, with its value as raw XML.
+type prop struct {
+	Name     xml.Name
+	InnerXML string
+}
+
+// MarshalXML implements xml.Marshaler
+func (p prop) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	inner := struct {
+		InnerXML string `xml:",innerxml"`
+	}{p.InnerXML}
+	return e.EncodeElement(inner, xml.StartElement{Name: p.Name})
+}
+
+func davProp(local, innerXML string) prop {
+	return prop{Name: xml.Name{Local: "D:" + local}, InnerXML: innerXML}
+}
+
+func escapeXML(s string) string {
+	var buf xmlBuffer
+	xml.EscapeText(&buf, []byte(s)) // #nosec
+	return string(buf)
+}
+
+type xmlBuffer []byte
+
+func (b *xmlBuffer) Write(p []byte) (int, error) {
+	*b = append(*b, p...)
+	return len(p), nil
+}
+
+// propsFinder computes the values of the properties of the documents.
+type propsFinder struct {
+	c         echo.Context
+	used      int64
+	available int64
+	quotaDone bool
+}
+
+func (pf *propsFinder) quota() (int64, int64) {
+	if !pf.quotaDone {
+		used, quota, err := diskUsageAndQuota(middlewares.GetInstance(pf.c))
+		if err == nil {
+			pf.used = used
+			pf.available = -1
+			if quota > 0 {
+				pf.available = quota - used
+				if pf.available < 0 {
+					pf.available = 0
+				}
+			}
+		}
+		pf.quotaDone = true
+	}
+	return pf.used, pf.available
+}
+
+// value returns the XML value of a live property for a directory or file. The
+// boolean is false if the property is not defined for this document.
+func (pf *propsFinder) value(local string, dir *vfs.DirDoc, file *vfs.FileDoc) (string, bool) {
+	switch local {
+	case "resourcetype":
+		if dir != nil {
+			return "<D:collection/>", true
+		}
+		return "", true
+	case "displayname":
+		if dir != nil {
+			return escapeXML(dir.DocName), true
+		}
+		return escapeXML(file.DocName), true
+	case "creationdate":
+		if dir != nil {
+			return dir.CreatedAt.UTC().Format(time.RFC3339), true
+		}
+		return file.CreatedAt.UTC().Format(time.RFC3339), true
+	case "getlastmodified":
+		if dir != nil {
+			return dir.UpdatedAt.UTC().Format(http.TimeFormat), true
+		}
+		return file.UpdatedAt.UTC().Format(http.TimeFormat), true
+	case "getetag":
+		if dir != nil {
+			return escapeXML(`"` + dir.Rev() + `"`), true
+		}
+		return escapeXML(`"` + base64.StdEncoding.EncodeToString(file.MD5Sum) + `"`), true
+	case "getcontentlength":
+		if file == nil {
+			return "", false
+		}
+		return strconv.FormatInt(file.ByteSize, 10), true
+	case "getcontenttype":
+		if file == nil {
+			return "", false
+		}
+		return escapeXML(file.Mime), true
+	case "supportedlock":
+		return "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope>" +
+			"<D:locktype><D:write/></D:locktype></D:lockentry>", true
+	case "quota-used-bytes":
+		if dir == nil {
+			return "", false
+		}
+		used, _ := pf.quota()
+		return strconv.FormatInt(used, 10), true
+	case "quota-available-bytes":
+		if dir == nil {
+			return "", false
+		}
+		_, available := pf.quota()
+		if available < 0 {
+			return "", false
+		}
+		return strconv.FormatInt(available, 10), true
+	}
+	return "", false
+}
+
+func (pf *propsFinder) response(req *propfindRequest, fullpath string, dir *vfs.DirDoc, file *vfs.FileDoc) response {
+	res := response{Href: hrefFor(fullpath, dir != nil)}
+
+	if req.PropName != nil {
+		var names []prop
+		for _, local := range append(allProps, quotaProps...) {
+			if _, ok := pf.value(local, dir, file); ok {
+				names = append(names, davProp(local, ""))
+			}
+		}
+		res.Propstats = []propstat{{Props: names, Status: statusOK}}
+		return res
+	}
+
+	var found, missing []prop
+	if req.Prop != nil {
+		for _, n := range req.Prop.Names {
+			if n.XMLName.Space == davNS {
+				if val, ok := pf.value(n.XMLName.Local, dir, file); ok {
+					found = append(found, davProp(n.XMLName.Local, val))
+					continue
+				}
+			}
+			missing = append(missing, prop{Name: n.XMLName})
+		}
+	} else {
+		for _, local := range allProps {
+			if val, ok := pf.value(local, dir, file); ok {
+				found = append(found, davProp(local, val))
+			}
+		}
+	}
+	if len(found) > 0 {
+		res.Propstats = append(res.Propstats, propstat{Props: found, Status: statusOK})
+	}
+	if len(missing) > 0 {
+		res.Propstats = append(res.Propstats, propstat{Props: missing, Status: statusNotFound})
+	}
+	return res
+}
+
+func parsePropfind(body io.Reader) (*propfindRequest, error) {
+	var req propfindRequest
+	err := xml.NewDecoder(io.LimitReader(body, maxXMLBodySize)).Decode(&req)
+	if err == io.EOF {
+		// An empty body is the same as allprop
+		return &propfindRequest{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func writeMultistatus(c echo.Context, responses []response) error {
+	ms := multistatus{XMLNS: davNS, Responses: responses}
+	out, err := xml.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+	c.Response().WriteHeader(http.StatusMultiStatus)
+	if _, err = c.Response().Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	_, err = c.Response().Write(out)
+	return err
+}
+
+func handlePropfind(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	depth := c.Request().Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// Listing a whole tree can be very expensive, so it is not allowed
+		c.Response().Header().Set(echo.HeaderContentType, "application/xml; charset=utf-8")
+		return c.String(http.StatusForbidden, xml.Header+
+			`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+	}
+
+	req, err := parsePropfind(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+
+	dir, file, err := fs.DirOrFileByPath(davPath(c))
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		err = middlewares.AllowVFS(c, permissions.GET, dir)
+	} else {
+		err = middlewares.AllowVFS(c, permissions.GET, file)
+	}
+	if err != nil {
+		return err
+	}
+
+	var fullpath string
+	if dir != nil {
+		fullpath = dir.Fullpath
+	} else if fullpath, err = file.Path(fs); err != nil {
+		return files.WrapVfsError(err)
+	}
+
+	pf := &propsFinder{c: c}
+	responses := []response{pf.response(req, fullpath, dir, file)}
+	if dir != nil && depth == "1" {
+		iter := fs.DirIterator(dir, nil)
+		for {
+			d, f, err := iter.Next()
+			if err == vfs.ErrIteratorDone {
+				break
+			}
+			if err != nil {
+				return files.WrapVfsError(err)
+			}
+			if d != nil {
+				responses = append(responses, pf.response(req, d.Fullpath, d, nil))
+			} else {
+				childpath := path.Join(dir.Fullpath, f.DocName)
+				responses = append(responses, pf.response(req, childpath, nil, f))
+			}
+		}
+	}
+	return writeMultistatus(c, responses)
+}
+
+// handleProppatch refuses to change the properties, as the dead properties
+// are not stored, and the live ones are computed from the VFS.
+func handleProppatch(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	var req proppatchRequest
+	err := xml.NewDecoder(io.LimitReader(c.Request().Body, maxXMLBodySize)).Decode(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid XML body")
+	}
+
+	dir, file, err := fs.DirOrFileByPath(davPath(c))
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	var fullpath string
+	if dir != nil {
+		err = middlewares.AllowVFS(c, permissions.PATCH, dir)
+		fullpath = dir.Fullpath
+	} else {
+		err = middlewares.AllowVFS(c, permissions.PATCH, file)
+		fullpath, _ = file.Path(fs)
+	}
+	if err != nil {
+		return err
+	}
+
+	var props []prop
+	for _, set := range req.Set {
+		for _, n := range set.Prop.Names {
+			props = append(props, prop{Name: n.XMLName})
+		}
+	}
+	for _, remove := range req.Remove {
+		for _, n := range remove.Prop.Names {
+			props = append(props, prop{Name: n.XMLName})
+		}
+	}
+	res := response{Href: hrefFor(fullpath, dir != nil)}
+	if len(props) > 0 {
+		res.Propstats = []propstat{{Props: props, Status: statusForbidden}}
+	}
+	return writeMultistatus(c, []response{res})
+}
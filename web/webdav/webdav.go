@@ -0,0 +1,333 @@
+// Package webdav implements a WebDAV server on top of the VFS, so that the
+// users can mount their cozy as a network drive from their file managers.
+package webdav
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/instance"
+	"github.com/cozy/cozy-stack/pkg/vfs"
+	"github.com/cozy/cozy-stack/web/files"
+	"github.com/cozy/cozy-stack/web/middlewares"
+	"github.com/cozy/cozy-stack/web/permissions"
+	"github.com/cozy/echo"
+)
+
+// FilesPrefix is the path prefix of the WebDAV endpoint for the files.
+const FilesPrefix = "/dav/files"
+
+// The methods of WebDAV that are not known by the router of echo.
+const (
+	methodPropfind  = "PROPFIND"
+	methodProppatch = "PROPPATCH"
+	methodMkcol     = "MKCOL"
+	methodCopy      = "COPY"
+	methodMove      = "MOVE"
+	methodLock      = "LOCK"
+	methodUnlock    = "UNLOCK"
+)
+
+var davMethods = map[string]bool{
+	methodPropfind:  true,
+	methodProppatch: true,
+	methodMkcol:     true,
+	methodCopy:      true,
+	methodMove:      true,
+	methodLock:      true,
+	methodUnlock:    true,
+}
+
+const allowedMethods = "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK"
+
+const contextMethodKey = "webdav_method"
+
+// IsDavRequest returns true if the request is for the WebDAV endpoints.
+func IsDavRequest(req *http.Request) bool {
+	return req.URL.Path == "/dav" || strings.HasPrefix(req.URL.Path, "/dav/")
+}
+
+// MethodOverride is a pre-routing middleware. The router of echo does not
+// know the WebDAV methods like MKCOL or MOVE, so this middleware replaces them
+// by POST for routing, and keeps the real method in the context for Handler.
+func MethodOverride(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		if davMethods[req.Method] && IsDavRequest(req) {
+			c.Set(contextMethodKey, req.Method)
+			req.Method = echo.POST
+		}
+		return next(c)
+	}
+}
+
+func requestMethod(c echo.Context) string {
+	if method, ok := c.Get(contextMethodKey).(string); ok {
+		return method
+	}
+	return c.Request().Method
+}
+
+// Handler dispatches the WebDAV requests according to their method.
+func Handler(c echo.Context) error {
+	method := requestMethod(c)
+	if method == echo.OPTIONS {
+		return handleOptions(c)
+	}
+
+	// WebDAV clients expect a 401 with a challenge to ask the user for their
+	// credentials. The password is an OAuth access token or an app password.
+	if _, err := middlewares.GetPermission(c); err != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="cozy"`)
+		return echo.NewHTTPError(http.StatusUnauthorized)
+	}
+
+	switch method {
+	case echo.GET, echo.HEAD:
+		return handleGet(c)
+	case echo.PUT:
+		return handlePut(c)
+	case echo.DELETE:
+		return handleDelete(c)
+	case methodMkcol:
+		return handleMkcol(c)
+	case methodCopy:
+		return handleCopy(c)
+	case methodMove:
+		return handleMove(c)
+	case methodPropfind:
+		return handlePropfind(c)
+	case methodProppatch:
+		return handleProppatch(c)
+	case methodLock:
+		return handleLock(c)
+	case methodUnlock:
+		return handleUnlock(c)
+	}
+	c.Response().Header().Set(echo.HeaderAllow, allowedMethods)
+	return echo.NewHTTPError(http.StatusMethodNotAllowed)
+}
+
+// davPath returns the path in the VFS of the resource targeted by the request.
+func davPath(c echo.Context) string {
+	return pathFromURLPath(c.Request().URL.Path)
+}
+
+func pathFromURLPath(urlPath string) string {
+	p := strings.TrimPrefix(urlPath, FilesPrefix)
+	return path.Clean("/" + p)
+}
+
+// hrefFor returns the URL path of a resource from its path in the VFS.
+func hrefFor(fullpath string, isDir bool) string {
+	u := url.URL{Path: path.Join(FilesPrefix, fullpath)}
+	href := u.EscapedPath()
+	if isDir && !strings.HasSuffix(href, "/") {
+		href += "/"
+	}
+	return href
+}
+
+func handleOptions(c echo.Context) error {
+	h := c.Response().Header()
+	h.Set(echo.HeaderAllow, allowedMethods)
+	h.Set("DAV", "1, 2")
+	h.Set("MS-Author-Via", "DAV")
+	return c.NoContent(http.StatusOK)
+}
+
+func handleGet(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	dir, file, err := fs.DirOrFileByPath(davPath(c))
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		if err = middlewares.AllowVFS(c, permissions.GET, dir); err != nil {
+			return err
+		}
+		c.Response().Header().Set(echo.HeaderAllow, allowedMethods)
+		return echo.NewHTTPError(http.StatusMethodNotAllowed)
+	}
+	if err = middlewares.AllowVFS(c, permissions.GET, file); err != nil {
+		return err
+	}
+	err = vfs.ServeFileContent(fs, file, "", c.Request(), c.Response())
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	return nil
+}
+
+func handlePut(c echo.Context) (err error) {
+	inst := middlewares.GetInstance(c)
+	fs := inst.VFS()
+	name := davPath(c)
+	if name == "/" {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed)
+	}
+
+	parent, err := fs.DirByPath(path.Dir(name))
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusConflict)
+	}
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	dir, olddoc, err := fs.DirOrFileByPath(name)
+	if err != nil && !os.IsNotExist(err) {
+		return files.WrapVfsError(err)
+	}
+	if dir != nil {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed)
+	}
+
+	var tags []string
+	if olddoc != nil {
+		tags = olddoc.Tags
+	}
+	newdoc, err := files.FileDocFromReq(c, path.Base(name), parent.ID(), tags)
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if olddoc != nil {
+		if err = middlewares.AllowVFS(c, permissions.PUT, olddoc); err != nil {
+			return err
+		}
+		newdoc.SetID(olddoc.ID())
+		newdoc.ReferencedBy = olddoc.ReferencedBy
+		if err = middlewares.AllowVFS(c, permissions.PUT, newdoc); err != nil {
+			return err
+		}
+	} else {
+		if err = middlewares.AllowVFS(c, permissions.POST, newdoc); err != nil {
+			return err
+		}
+	}
+
+	file, err := fs.CreateFile(newdoc, olddoc)
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	defer func() {
+		if cerr := file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if err != nil {
+			inst.Logger().WithField("nspace", "webdav").
+				Warnf("Error on uploading file: %s", err)
+			err = files.WrapVfsError(err)
+			return
+		}
+		if olddoc != nil {
+			err = c.NoContent(http.StatusNoContent)
+		} else {
+			err = c.NoContent(http.StatusCreated)
+		}
+	}()
+	_, err = io.Copy(file, c.Request().Body)
+	return
+}
+
+func handleDelete(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	dir, file, err := fs.DirOrFileByPath(davPath(c))
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if err = removeDoc(c, fs, dir, file); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// removeDoc puts the given file or directory in the trash, or destroys it if
+// it is already in the trash.
+func removeDoc(c echo.Context, fs vfs.VFS, dir *vfs.DirDoc, file *vfs.FileDoc) error {
+	var err error
+	if dir != nil {
+		if err = middlewares.AllowVFS(c, permissions.PUT, dir); err != nil {
+			return err
+		}
+		_, err = vfs.TrashDir(fs, dir)
+		if err == vfs.ErrFileInTrash {
+			if err = middlewares.AllowVFS(c, permissions.DELETE, dir); err != nil {
+				return err
+			}
+			err = fs.DestroyDirAndContent(dir)
+		}
+	} else {
+		if err = middlewares.AllowVFS(c, permissions.PUT, file); err != nil {
+			return err
+		}
+		_, err = vfs.TrashFile(fs, file)
+		if err == vfs.ErrFileInTrash {
+			if err = middlewares.AllowVFS(c, permissions.DELETE, file); err != nil {
+				return err
+			}
+			err = fs.DestroyFile(file)
+		}
+	}
+	if err == os.ErrInvalid {
+		return echo.NewHTTPError(http.StatusForbidden)
+	}
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	return nil
+}
+
+func handleMkcol(c echo.Context) error {
+	fs := middlewares.GetInstance(c).VFS()
+	if c.Request().ContentLength > 0 {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType)
+	}
+	name := davPath(c)
+	if name == "/" {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed)
+	}
+	if _, _, err := fs.DirOrFileByPath(name); err == nil {
+		return echo.NewHTTPError(http.StatusMethodNotAllowed)
+	} else if !os.IsNotExist(err) {
+		return files.WrapVfsError(err)
+	}
+	parent, err := fs.DirByPath(path.Dir(name))
+	if os.IsNotExist(err) {
+		return echo.NewHTTPError(http.StatusConflict)
+	}
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	doc, err := vfs.NewDirDocWithParent(path.Base(name), parent, nil)
+	if err != nil {
+		return files.WrapVfsError(err)
+	}
+	if err = middlewares.AllowVFS(c, permissions.POST, doc); err != nil {
+		return err
+	}
+	if err = fs.CreateDir(doc); err != nil {
+		return files.WrapVfsError(err)
+	}
+	return c.NoContent(http.StatusCreated)
+}
+
+func diskUsageAndQuota(i *instance.Instance) (used, quota int64, err error) {
+	fs := i.VFS()
+	used, err = fs.DiskUsage()
+	if err != nil {
+		return
+	}
+	quota = fs.DiskQuota()
+	return
+}
+
+// Routes sets the routing for the WebDAV endpoints. The requests with the
+// WebDAV specific methods are routed thanks to the MethodOverride middleware.
+func Routes(router *echo.Group) {
+	router.Any("/files", Handler)
+	router.Any("/files/*", Handler)
+}
@@ -0,0 +1,91 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathFromURLPath(t *testing.T) {
+	assert.Equal(t, "/", pathFromURLPath("/dav/files"))
+	assert.Equal(t, "/", pathFromURLPath("/dav/files/"))
+	assert.Equal(t, "/foo/bar baz", pathFromURLPath("/dav/files/foo/bar baz/"))
+	assert.Equal(t, "/etc", pathFromURLPath("/dav/files/../../etc"))
+}
+
+func TestHrefFor(t *testing.T) {
+	assert.Equal(t, "/dav/files/", hrefFor("/", true))
+	assert.Equal(t, "/dav/files/foo/bar%20baz/", hrefFor("/foo/bar baz", true))
+	assert.Equal(t, "/dav/files/foo/bar.txt", hrefFor("/foo/bar.txt", false))
+}
+
+func TestDestination(t *testing.T) {
+	req := httptest.NewRequest("MOVE", "http://alice.cozy.tools/dav/files/foo", nil)
+	_, err := destination(req)
+	assert.Error(t, err)
+
+	req.Header.Set("Destination", "http://alice.cozy.tools/dav/files/bar/baz%20qux")
+	dest, err := destination(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "/bar/baz qux", dest)
+
+	req.Header.Set("Destination", "/dav/files/bar")
+	dest, err = destination(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "/bar", dest)
+
+	req.Header.Set("Destination", "http://bob.cozy.tools/dav/files/bar")
+	_, err = destination(req)
+	assert.Error(t, err)
+
+	req.Header.Set("Destination", "http://alice.cozy.tools/files/bar")
+	_, err = destination(req)
+	assert.Error(t, err)
+}
+
+func TestTokenFromIfHeader(t *testing.T) {
+	assert.Equal(t, "", tokenFromIfHeader(""))
+	assert.Equal(t, "opaquelocktoken:abc", tokenFromIfHeader("(<opaquelocktoken:abc>)"))
+	assert.Equal(t, "opaquelocktoken:abc",
+		tokenFromIfHeader(`</dav/files/foo> (<opaquelocktoken:abc>)`))
+}
+
+func TestParsePropfind(t *testing.T) {
+	req, err := parsePropfind(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.Nil(t, req.Prop)
+
+	body := `<?xml version="1.0" encoding="utf-8" ?>
+<D:propfind xmlns:D="DAV:" xmlns:A="http://apple.com/ns/">
+  <D:prop><D:getetag/><D:resourcetype/><A:foo/></D:prop>
+</D:propfind>`
+	req, err = parsePropfind(strings.NewReader(body))
+	assert.NoError(t, err)
+	if assert.NotNil(t, req.Prop) && assert.Len(t, req.Prop.Names, 3) {
+		assert.Equal(t, xml.Name{Space: "DAV:", Local: "getetag"}, req.Prop.Names[0].XMLName)
+		assert.Equal(t, xml.Name{Space: "http://apple.com/ns/", Local: "foo"}, req.Prop.Names[2].XMLName)
+	}
+
+	_, err = parsePropfind(strings.NewReader("<D:propfind"))
+	assert.Error(t, err)
+}
+
+func TestMarshalMultistatus(t *testing.T) {
+	ms := multistatus{XMLNS: davNS, Responses: []response{{
+		Href: "/dav/files/foo/",
+		Propstats: []propstat{{
+			Props:  []prop{davProp("resourcetype", "<D:collection/>")},
+			Status: statusOK,
+		}},
+	}}}
+	out, err := xml.Marshal(ms)
+	assert.NoError(t, err)
+	assert.Equal(t, `<D:multistatus xmlns:D="DAV:"><D:response>`+
+		`<D:href>/dav/files/foo/</D:href><D:propstat><D:prop>`+
+		`<D:resourcetype><D:collection/></D:resourcetype></D:prop>`+
+		`<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>`+
+		`</D:multistatus>`, string(out))
+}